@@ -18,6 +18,19 @@ provider_mirror "mirror" {
   // downloading then you must enable this setting so that the provider mirror
   // will insert the auth credentials when handling download requests.
   proxy_packages = true
+
+  # When used with proxy_packages, download requests that the origin registry
+  # answers with a redirect to some other host (such as a presigned storage
+  # URL) are redirected directly to that location, so that the package
+  # content doesn't pass through this server.
+  #redirect_packages = true
+
+  # Decides what to do with version tags that refer to something other than
+  # a Terraform provider release. "strict" (the default) lists all versions
+  # and fails requests for non-provider versions, while "lenient" checks
+  # each version's manifest and hides any that aren't provider releases, so
+  # that a namespace can also contain other kinds of artifact.
+  #artifact_checking = "lenient"
 }
 
 server {
@@ -31,10 +44,207 @@ server {
   # tokens passing through the server in "Authorization" headers.
   query_string_secret = "0000000000000000000000000000000000000000000000000000000000000000"
 
+  # The algorithm used to protect query string secrets, which can be either
+  # "secretbox" (the default) or "aes-256-gcm". Both use a 32-byte secret.
+  # Changing this invalidates any download URLs issued before the change.
+  #query_string_cipher = "aes-256-gcm"
+
+  # Download tokens generated by the server are valid for three minutes. If
+  # set, the server also rejects any token that claims to be valid for
+  # longer than this, as a precaution in case the secret is compromised.
+  #download_token_max_lifetime = "5m"
+
+  # If set, the server still accepts a download token for this long after
+  # it expires, logging a warning and counting it in the
+  # "download_token_grace_redemptions" metric so that you can tell whether
+  # clients need a longer lifetime.
+  #download_token_grace_period = "2m"
+
+  # If set, limits how many provider package downloads any single client
+  # can have in progress at once when using proxy_packages. Additional
+  # concurrent downloads are rejected with "429 Too Many Requests".
+  #max_downloads_per_client = 4
+
+  # If set, clients with IPv6 addresses are identified by the network prefix
+  # of this length containing their address, for max_downloads_per_client
+  # and in the audit log, so that a client rotating between addresses in its
+  # network still counts as one client. IPv4 clients are always identified
+  # by their full address.
+  #client_ipv6_prefix_length = 64
+
+  # If set, the server refuses to start with a configuration that declares
+  # more than this many services, to guard against accidentally loading an
+  # enormous generated configuration. Either way, the server logs how many
+  # services of each type it's configured with when it starts.
+  #max_services = 50
+
+  # Default policy for requests to the origin registries of all services.
+  # backend_timeout limits how long each metadata request may take, and
+  # backend_idle_timeout aborts a proxied package download if the origin
+  # registry sends nothing more for that long, and backend_max_concurrency
+  # limits how many requests to each origin registry can be in progress at
+  # once.
+  #
+  # backend_retry_attempts is how many times to send each GET request,
+  # including the first, when the origin registry responds with a 502, 503,
+  # or 504 status or drops the connection. The first retry waits for about
+  # backend_retry_delay, or for as long as a Retry-After header asks, and
+  # each later retry waits twice as long as the one before. The default of
+  # 1 disables retries. Each service block can override all of these.
+  #backend_timeout         = "30s"
+  #backend_idle_timeout    = "1m"
+  #backend_max_concurrency = 16
+  #backend_retry_attempts  = 3
+  #backend_retry_delay     = "200ms"
+
+  # If set, after this many consecutive failed requests to an origin
+  # registry host the server stops contacting that host for the cooldown
+  # period, responding to clients with "503 Service Unavailable" instead.
+  # After the cooldown a single request is allowed through to check whether
+  # the host has recovered.
+  #backend_breaker_threshold = 5
+  #backend_breaker_cooldown  = "30s"
+
+  # If set, once this many requests are in progress at once the server
+  # starts delaying new requests, rather than rejecting them, to smooth out
+  # bursts of load. The delay grows with the number of requests over the
+  # threshold, up to the maximum delay.
+  #backpressure_threshold = 100
+  #backpressure_max_delay = "1s"
+
+  # If set, the server logs an alert when it rejects more than this many
+  # package download tokens, because they are invalid or expired, within
+  # the alert window. A burst of rejections can mean that someone is probing
+  # the download URLs, that servers sharing a load balancer have different
+  # query string secrets, or that a server's clock is wrong. The metric
+  # download_token_rejections_by_reason counts rejections either way.
+  # Enable download_token_alert_unready to also make the readiness endpoint
+  # fail until the window ends, but note that anyone can then take the
+  # server out of service just by sending bad tokens.
+  #download_token_alert_threshold = 100
+  #download_token_alert_window    = "1m"
+  #download_token_alert_unready   = true
+
+  # How long to wait for in-progress requests, such as large package
+  # downloads, to complete when the server is shutting down. The server logs
+  # how many downloads are still active each second while it waits, and
+  # forcibly closes any remaining connections once this time has passed.
+  #shutdown_timeout = "10s"
+
+  # How long to keep accepting new requests after shutdown begins, before
+  # the shutdown timeout starts. During this time the readiness endpoint
+  # responds with "503 Service Unavailable" so that load balancers can stop
+  # sending traffic before the server stops listening.
+  #shutdown_delay = "5s"
+
+  # If set, the server checks at startup that each service's origin registry
+  # is reachable, waiting at most this long for each one, and logs a single
+  # warning listing every service that failed the check. The server starts
+  # either way. The checks run concurrently, at most
+  # startup_probe_concurrency at a time (default 4), so one slow registry
+  # can't hold up the others. Each service's backend_timeout also applies.
+  #startup_probe_timeout     = "5s"
+  #startup_probe_concurrency = 4
+
+  # If set, the server reports whether it's ready to accept new requests at
+  # this path, for load balancer health checks. It responds with "200 OK"
+  # until shutdown begins, and then with "503 Service Unavailable" while
+  # in-progress requests complete.
+  #readiness_path = "/readyz"
+
+  # The hash algorithms the server will accept for digests that identify
+  # provider packages. Package layers using any other algorithm are ignored.
+  #trusted_digest_algorithms = ["sha256", "sha512"]
+
+  # The absolute URL where clients can reach this server, if that differs
+  # from the URLs of the requests the server receives. Each service is then
+  # at a path named after the service beneath this URL, and URLs in
+  # responses are generated relative to it.
+  #external_url = "https://registry.example.com/"
+
+  # Set to "combined" to also write an access log line for each request in
+  # the Combined Log Format used by Apache httpd. The default, "text",
+  # writes only the server's usual freeform log messages.
+  #log_format = "combined"
+
+  # Enable this to include the name of the service handling each request,
+  # in square brackets after the client address, in all of the log lines
+  # written while handling it.
+  #log_service_names = true
+
+  # If set, the server appends security-relevant events to a separate audit
+  # log file, relative to this configuration file, as one JSON object per
+  # line. The events are client requests refused with 401 or 403, invalid or
+  # expired package download tokens, and origin registries refusing
+  # requests with 401 or 403. At most max_events_per_second events are
+  # written in any one second (100 by default, or 0 for no limit), and the
+  # number dropped is reported in a later event.
+  #audit_log {
+  #  file                  = "audit.log"
+  #  max_events_per_second = 100
+  #}
+
+  # Enable this to gzip-compress the JSON metadata responses of each
+  # service for clients that accept it.
+  #gzip_responses = true
+
+  # The gzip compression level for responses when gzip_responses is
+  # enabled, from 1 for the fastest compression to 9 for the smallest
+  # responses. Busy servers may prefer a lower level to save CPU time.
+  #compression_level = 6
+
+  # Enable this to add a Server-Timing header to each response, breaking
+  # down the time spent in the metadata cache, waiting for the origin
+  # registry, and in total, which browser developer tools can display.
+  # This reveals some information about the server's caching to clients.
+  #server_timing = true
+
+  # If set, the server exposes counters describing its activity as JSON at
+  # this path.
+  #metrics_path = "/metrics"
+
+  # If set, the server exposes a JSON description of the services it offers
+  # and their endpoints at this path, for use by operators and their tools.
+  # This is unrelated to Terraform's own service discovery.
+  #description_path = "/services.json"
+
+  # If set, the server exposes a JSON report at this path of which optional
+  # features the origin registry of each service supports, such as the
+  # catalog and referrers APIs, for diagnosing problems. The registries are
+  # probed when the report is requested, and each result is reused for the
+  # TTL. Set probe_provider in a service block to enable the probes that
+  # need a sample package.
+  #capabilities_path = "/capabilities.json"
+  #capabilities_ttl  = "10m"
+
+  # Extra entries for the Terraform service discovery document served at
+  # /.well-known/terraform.json, mapping service identifiers to URLs. These
+  # add to, or override, the entries derived from each service's
+  # discovery_ids, such as to advertise protocol versions from newer
+  # Terraform releases. The document is served only if it has any entries.
+  #discovery_services = {
+  #  "providers.v1" = "https://registry.example.com/v1/providers/"
+  #}
+
+  # Custom bodies for error responses with particular status codes, for
+  # example to match a branded portal. Each may give HTML and/or JSON
+  # content, either inline or from a file relative to this configuration
+  # file. Clients that prefer HTML in their Accept header get the HTML
+  # content and all others get the JSON content, when both are set. Other
+  # status codes use the server's minimal built-in responses.
+  #error_page "404" {
+  #  html_file = "errors/404.html"
+  #  json      = "{\"error\": \"Not found\"}"
+  #}
+
   # For a real server you'll need to use TLS, because Terraform requires that
   # for some of its protocols.
   #tls {
   #  certificate_file = "certs.pem"
   #  private_key_file = "private_key.pem"
+  #
+  #  # The server warns at startup if the certificate has expired or will
+  #  # expire within this period. The default is 30 days.
+  #  expiry_warning_threshold = "720h"
   #}
 }
@@ -0,0 +1,128 @@
+// Package cache implements a small in-memory cache for metadata fetched from
+// an OCI Distribution registry, with optional support for continuing to serve
+// expired entries while the registry is unavailable.
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Status describes where a value returned from [Cache.Get] came from.
+type Status int
+
+const (
+	// Fetched means that the value was just now fetched from the backend.
+	Fetched Status = iota
+
+	// Fresh means that the value came from the cache and had not yet
+	// reached its time-to-live.
+	Fresh
+
+	// Stale means that the value came from the cache after its time-to-live
+	// had passed, because the attempt to fetch a new value failed.
+	Stale
+)
+
+// Cache is a concurrency-safe cache of values of type V, keyed by values of
+// type K.
+//
+// A cache has a time-to-live, after which an entry is considered expired and
+// will be refetched on the next request, and a maximum staleness, which is
+// how long after expiry an entry may still be returned if refetching it fails.
+// If both are zero then the cache never retains anything and [Cache.Get]
+// just calls through to the given fetch function.
+//
+// Entries that are too old to be returned even when stale are eventually
+// removed, so that entries for keys that are never requested again don't
+// accumulate for the life of the process.
+type Cache[K comparable, V any] struct {
+	ttl      time.Duration
+	maxStale time.Duration
+
+	// now is the function used to determine the current time, which can
+	// be overridden in tests.
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[K]entry[V]
+
+	// lastSweep is when [Cache.sweep] last removed expired entries.
+	lastSweep time.Time
+}
+
+type entry[V any] struct {
+	value   V
+	fetched time.Time
+}
+
+// New constructs and returns a new, empty [Cache] with the given time-to-live
+// and maximum staleness.
+func New[K comparable, V any](ttl, maxStale time.Duration) *Cache[K, V] {
+	return &Cache[K, V]{
+		ttl:      ttl,
+		maxStale: maxStale,
+		now:      time.Now,
+		entries:  make(map[K]entry[V]),
+	}
+}
+
+// Get returns the value associated with the given key, calling fetch to
+// obtain a new value if there is no cached entry or if the cached entry has
+// expired.
+//
+// If fetch returns an error for which canServeStale returns true, and there
+// is a cached entry that expired no longer ago than the cache's maximum
+// staleness, Get returns the stale value with status [Stale] and no error.
+// Otherwise it returns the error from fetch.
+func (c *Cache[K, V]) Get(key K, fetch func() (V, error), canServeStale func(error) bool) (V, Status, error) {
+	if c.ttl == 0 && c.maxStale == 0 {
+		v, err := fetch()
+		return v, Fetched, err
+	}
+
+	now := c.now()
+	c.mu.Lock()
+	existing, exists := c.entries[key]
+	c.mu.Unlock()
+
+	if exists && now.Sub(existing.fetched) < c.ttl {
+		return existing.value, Fresh, nil
+	}
+
+	v, err := fetch()
+	if err != nil {
+		if exists && canServeStale(err) && now.Sub(existing.fetched) <= c.ttl+c.maxStale {
+			return existing.value, Stale, nil
+		}
+		return v, Fetched, err
+	}
+
+	c.mu.Lock()
+	c.entries[key] = entry[V]{
+		value:   v,
+		fetched: c.now(),
+	}
+	c.sweep(now)
+	c.mu.Unlock()
+	return v, Fetched, nil
+}
+
+// sweep removes the entries that are too old to be returned even when
+// stale. Checking every entry is relatively expensive, so sweep does nothing
+// if it already ran within the lifetime of an entry, which means that no
+// entry outlives its lifetime by more than that again.
+//
+// The caller must hold c.mu.
+func (c *Cache[K, V]) sweep(now time.Time) {
+	lifetime := c.ttl + c.maxStale
+	if now.Sub(c.lastSweep) < lifetime {
+		return
+	}
+	for key, e := range c.entries {
+		if now.Sub(e.fetched) > lifetime {
+			delete(c.entries, key)
+		}
+	}
+	c.lastSweep = now
+}
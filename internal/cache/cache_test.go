@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCacheGet(t *testing.T) {
+	errUnavailable := errors.New("backend unavailable")
+	canServeStale := func(err error) bool {
+		return err == errUnavailable
+	}
+
+	now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	c := New[string, string](1*time.Minute, 10*time.Minute)
+	c.now = func() time.Time {
+		return now
+	}
+
+	var fetchResult string
+	var fetchErr error
+	fetchCalls := 0
+	fetch := func() (string, error) {
+		fetchCalls++
+		return fetchResult, fetchErr
+	}
+
+	fetchResult = "v1"
+	got, status, err := c.Get("key", fetch, canServeStale)
+	if err != nil {
+		t.Fatalf("unexpected error on initial fetch: %s", err)
+	}
+	if got != "v1" || status != Fetched {
+		t.Fatalf("wrong initial result %q with status %d", got, status)
+	}
+
+	t.Run("fresh", func(t *testing.T) {
+		now = now.Add(30 * time.Second)
+		fetchResult = "v2"
+		got, status, err := c.Get("key", fetch, canServeStale)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got != "v1" || status != Fresh {
+			t.Errorf("wrong result %q with status %d; want cached v1", got, status)
+		}
+		if fetchCalls != 1 {
+			t.Errorf("fetch was called %d times; want 1", fetchCalls)
+		}
+	})
+
+	t.Run("stale-served", func(t *testing.T) {
+		now = now.Add(5 * time.Minute)
+		fetchErr = errUnavailable
+		got, status, err := c.Get("key", fetch, canServeStale)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got != "v1" || status != Stale {
+			t.Errorf("wrong result %q with status %d; want stale v1", got, status)
+		}
+	})
+
+	t.Run("not-servable-error", func(t *testing.T) {
+		fetchErr = errors.New("not found")
+		_, _, err := c.Get("key", fetch, canServeStale)
+		if err != fetchErr {
+			t.Errorf("wrong error %v; want %v", err, fetchErr)
+		}
+	})
+
+	t.Run("too-stale", func(t *testing.T) {
+		now = now.Add(10 * time.Minute)
+		fetchErr = errUnavailable
+		_, _, err := c.Get("key", fetch, canServeStale)
+		if err != errUnavailable {
+			t.Errorf("wrong error %v; want %v", err, errUnavailable)
+		}
+	})
+
+	t.Run("refetched", func(t *testing.T) {
+		fetchErr = nil
+		got, status, err := c.Get("key", fetch, canServeStale)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got != "v2" || status != Fetched {
+			t.Errorf("wrong result %q with status %d; want fetched v2", got, status)
+		}
+	})
+}
+
+func TestCacheEviction(t *testing.T) {
+	now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	c := New[string, string](1*time.Minute, 10*time.Minute)
+	c.now = func() time.Time {
+		return now
+	}
+	fetch := func() (string, error) {
+		return "v", nil
+	}
+	canServeStale := func(error) bool {
+		return true
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		if _, _, err := c.Get(key, fetch, canServeStale); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := len(c.entries), 3; got != want {
+		t.Fatalf("wrong number of entries %d; want %d", got, want)
+	}
+
+	// "a" is refetched while it's still within its maximum staleness, so
+	// it survives the sweep that the fetch of "d" triggers once the other
+	// entries are too old to ever be returned again.
+	now = now.Add(6 * time.Minute)
+	if _, _, err := c.Get("a", fetch, canServeStale); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(6 * time.Minute)
+	if _, _, err := c.Get("d", fetch, canServeStale); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(c.entries), 2; got != want {
+		t.Fatalf("wrong number of entries %d after expiry; want %d", got, want)
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, exists := c.entries[key]; exists {
+			t.Errorf("expired entry %q was not removed", key)
+		}
+	}
+}
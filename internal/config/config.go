@@ -1,46 +1,795 @@
 package config
 
 import (
+	"compress/gzip"
+	"crypto"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"mime"
 	"net"
+	"net/textproto"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/apparentlymart/go-versions/versions"
 	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/querysecret"
 	hcl "github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/gohcl"
 	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"golang.org/x/crypto/openpgp"
 )
 
 type Config struct {
-	ProviderMirrors map[string]*ProviderMirror
-	Server          *Server
+	ProviderMirrors    map[string]*ProviderMirror
+	ProviderRegistries map[string]*ProviderRegistry
+	ModuleRegistries   map[string]*ModuleRegistry
+	Server             *Server
 
 	Filename string
 }
 
+// ServiceCounts returns the number of services of each type in the
+// configuration, keyed by the type of the blocks that declare them, like
+// "provider_mirror".
+func (c *Config) ServiceCounts() map[string]int {
+	return map[string]int{
+		"provider_mirror":   len(c.ProviderMirrors),
+		"provider_registry": len(c.ProviderRegistries),
+		"module_registry":   len(c.ModuleRegistries),
+	}
+}
+
 type ProviderMirror struct {
 	Name          string
 	OriginURL     *url.URL
 	NamePrefix    ocidist.Namespace
 	ProxyPackages bool
 
+	// FallbackOriginURL, if set, is the base URL of a second registry that
+	// mirrors the same content as the one at OriginURL. Requests that fail
+	// to reach the primary registry, or that it answers with a server
+	// error, are retried against the fallback.
+	FallbackOriginURL *url.URL
+
+	// RedirectPackages, when used with ProxyPackages, makes the server
+	// redirect clients directly to wherever the origin registry redirects
+	// package downloads, such as presigned storage URLs, instead of
+	// proxying the package content.
+	RedirectPackages bool
+
+	// PackageFilenames, when used with ProxyPackages, makes the server set
+	// the Content-Disposition header of each proxied package download to
+	// suggest the conventional filename for the package, like
+	// "terraform-provider-aws_5.0.0_linux_amd64.zip", instead of relaying
+	// whatever the origin registry sent.
+	PackageFilenames bool
+
+	// ForwardQueryParams, when used with ProxyPackages, are the names of
+	// query string parameters that are copied from a package download
+	// request into the server's request for the package from the origin
+	// registry, for backends or CDNs that rely on them. Other parameters
+	// are ignored.
+	ForwardQueryParams []string
+
+	// RequiredArtifactType, if set, is the artifact type that a manifest
+	// must declare to be treated as a provider release. A manifest without
+	// an artifactType property is treated as having its config media type
+	// as its artifact type, as in the OCI Image specification. If empty,
+	// a manifest is instead recognized by its config media type alone.
+	RequiredArtifactType string
+
+	// HeadContentLength decides whether responses to HEAD requests for
+	// metadata include a Content-Length header, which requires generating
+	// the response body that a GET request would return.
+	HeadContentLength bool
+
+	// CacheGzipResponses makes the server remember the gzip-compressed form
+	// of each metadata response, so that it can send an unchanged response
+	// to clients that accept gzip without compressing it again. This
+	// requires the server's GzipResponses setting.
+	CacheGzipResponses bool
+
+	// VerifyLayers makes the server check that the blob for each package
+	// exists in the origin registry before including it in a version
+	// response, omitting any that are missing.
+	VerifyLayers bool
+
+	// PinManifestDigests makes the server resolve each version's tag to a
+	// manifest digest once per version request and then fetch the manifest
+	// by that digest, so that the response describes a single consistent
+	// snapshot even if the tag moves while the request is in progress.
+	PinManifestDigests bool
+
+	// YankedAnnotation, if set, is the name of a manifest annotation that
+	// marks a version as withdrawn. Versions whose manifests have that
+	// annotation with any value other than "" or "false" are left out of
+	// the version index, which requires fetching the manifest of every
+	// version.
+	YankedAnnotation string
+
+	// CreatedAnnotation, if set, is the name of a manifest annotation, such
+	// as "org.opencontainers.image.created", whose RFC 3339 timestamp is
+	// reported as the "created" property of each version in the version
+	// index, as an extension to the mirror protocol. Versions without a
+	// valid timestamp in that annotation have no "created" property. This
+	// requires fetching the manifest of every version.
+	CreatedAnnotation string
+
+	// MinVersion, if not [versions.Unspecified], is the lowest version of
+	// each provider that the service offers. Older versions are left out of
+	// the version index and their version responses are not found, without
+	// needing to delete them from the origin registry.
+	MinVersion versions.Version
+
+	// ResolveLatest makes the version index response include which version
+	// the origin registry's "latest" tag refers to, if that tag exists.
+	ResolveLatest bool
+
+	// LenientSelectors makes the server tolerate variations of the final
+	// path segment of metadata requests, such as different letter case or
+	// a repeated ".json" suffix, that some intermediaries produce.
+	LenientSelectors bool
+
+	// RejectMalformedPaths makes the server respond to requests whose paths
+	// can't represent a provider address with "400 Bad Request" and an
+	// explanation, instead of the default "404 Not Found".
+	RejectMalformedPaths bool
+
+	// CanonicalRedirects makes the server respond to GET and HEAD requests
+	// for a provider address in a non-canonical form, such as with
+	// uppercase letters, a trailing dot on the hostname, or Terraform's
+	// shorthand that omits the hostname or namespace, with a redirect to
+	// the canonical form of the same URL.
+	CanonicalRedirects bool
+
+	// StrictAnnotations makes the server fail requests for a version
+	// whose manifest has a package layer with a missing or malformed
+	// platforms annotation, instead of just ignoring that layer with a
+	// warning, so that publishing mistakes are noticed.
+	StrictAnnotations bool
+
+	// PackageVerification decides whether the server checks that proxied
+	// package content matches the digest the origin registry's manifest
+	// gave for it.
+	PackageVerification PackageVerification
+
+	// PackageCacheDir, if set, is a directory where the server keeps a
+	// copy of each package it proxies, so that later downloads of the same
+	// package, including after a restart, don't need the origin registry.
+	// A package is only stored once its content matches its digest.
+	PackageCacheDir string
+
+	// DuplicatePlatforms decides what happens when more than one package
+	// layer of the same media type claims to support the same platform.
+	DuplicatePlatforms DuplicatePlatforms
+
+	// MaxPlatforms is the largest number of platforms that the server will
+	// offer packages for in a single version response. Requests for
+	// versions whose manifests support more platforms than that fail, so
+	// that a pathological manifest can't make the server build an
+	// arbitrarily-large response.
+	MaxPlatforms int
+
+	// ArtifactChecking decides how the server treats tags whose manifest
+	// doesn't have the Terraform provider config media type.
+	ArtifactChecking ArtifactChecking
+
+	// MetadataNameSuffix and PackageNameSuffix are optional additional
+	// namespace parts appended to a provider's namespace when fetching
+	// tags and manifests, or when fetching package blobs, respectively.
+	// These allow bridging registry layouts that store metadata and
+	// packages in different namespaces.
+	MetadataNameSuffix ocidist.Namespace
+	PackageNameSuffix  ocidist.Namespace
+
+	// AddressLayout, if set, is how a provider's address maps to the
+	// namespace parts following NamePrefix, as one template per part in
+	// which "{hostname}", "{namespace}", and "{type}" stand for the parts of
+	// the address. If nil, each part of the address is its own namespace
+	// part, in order. The layout always includes all three placeholders,
+	// and placeholders in the same part are separated by underscores, so
+	// that each provider has a distinct namespace.
+	//
+	// NamespaceDepth, if nonzero, is the number of namespace parts that the
+	// origin registry expects for each provider, including NamePrefix, which
+	// the configuration has already been checked against.
+	AddressLayout  []string
+	NamespaceDepth int
+
+	// CacheTTL is how long metadata fetched from the origin registry
+	// remains fresh before it must be refetched. Zero means that metadata is
+	// never served from cache while fresh.
+	CacheTTL time.Duration
+
+	// CacheMaxStale is how long after CacheTTL has passed that cached
+	// metadata may still be served if the origin registry is failing.
+	// Zero means that stale metadata is never served.
+	CacheMaxStale time.Duration
+
+	// Backend is the policy for interacting with this service's origin
+	// registry, with any settings not overridden in the service's own
+	// block taken from the server-level defaults.
+	Backend BackendPolicy
+
+	// BackendForceHTTP1 makes the server use only HTTP/1.1 when talking to
+	// this service's origin registry, for registries with unreliable HTTP/2
+	// implementations.
+	BackendForceHTTP1 bool
+
+	// BackendIPPolicy, if set, restricts which IP addresses the server
+	// may connect to when talking to the origin registry, or to wherever
+	// the origin registry redirects to.
+	BackendIPPolicy *ocidist.IPPolicy
+
+	// OriginCredentials, if set, are what the server uses to authenticate
+	// to the origin registry, instead of passing through the Authorization
+	// header from each client's request. The server obtains tokens from
+	// the registry's token service as needed.
+	OriginCredentials *ocidist.Credentials
+
+	// BackendTLSSessionCacheSize is the number of TLS sessions the server
+	// remembers for resumption when connecting to this service's origin
+	// registry, or zero if sessions are never resumed.
+	BackendTLSSessionCacheSize int
+
+	// BackendTLSRenegotiation is whether the origin registry may request
+	// TLS renegotiation.
+	BackendTLSRenegotiation tls.RenegotiationSupport
+
+	// BackendPrefetchPages makes the server request the next page of a
+	// paginated response from the origin registry, such as a long tag list,
+	// while still processing the current page. This reduces latency at the
+	// expense of an additional concurrent request.
+	BackendPrefetchPages bool
+
+	// BackendStrictJSON makes the server reject responses from the origin
+	// registry that have unexpected data after the JSON document, which
+	// could indicate a corrupted or double-encoded response. By default
+	// such data is ignored.
+	BackendStrictJSON bool
+
+	// ProviderIndex enables an extra endpoint listing all of the providers
+	// that the origin registry's catalog reports under NamePrefix, for
+	// people looking for what's available. It's optional because catalogs
+	// can be very large.
+	ProviderIndex bool
+
+	// ProviderIndexPageSize, if nonzero, is the largest number of providers
+	// that the index includes in each response, with a "Link" header
+	// referring to the next page, like the OCI Distribution protocol's
+	// paginated responses. Clients may ask for smaller pages.
+	ProviderIndexPageSize int
+
+	// ExposedAnnotations are the keys of manifest annotations, such as
+	// provenance information, that are copied into the "annotations"
+	// property of version responses when present. If empty, no annotations
+	// are included.
+	ExposedAnnotations []string
+
+	// DeprecatedProviders maps the addresses of providers that are
+	// planned for removal, such as "example.com/foo/bar" in lowercase, to
+	// messages explaining the deprecation to their users. The server still
+	// serves these providers, but its responses include a notice.
+	DeprecatedProviders map[string]string
+
+	// WarmProviders are the addresses of providers, such as
+	// "example.com/foo/bar" in lowercase, whose tag lists and latest
+	// manifests are fetched into the metadata cache when the server starts,
+	// so that the first requests for them don't wait for the origin
+	// registry. This is only meaningful when CacheTTL is set.
+	WarmProviders []string
+
+	// ProbeProvider is the address of a provider, such as
+	// "example.com/foo/bar" in lowercase, whose newest package the server
+	// uses as a sample when probing the origin registry's capabilities, or
+	// empty to probe only the capabilities that don't need a sample.
+	ProbeProvider string
+
+	// PackageResponseHeaders are the names of the headers from the origin
+	// registry's response to a package download that are copied into the
+	// response to the client when ProxyPackages is set, in canonical form.
+	// All other headers from the origin registry are dropped.
+	PackageResponseHeaders []string
+
+	// PackageMediaTypes are the media types of manifest layers that may be
+	// offered as provider packages, in order of preference. When a
+	// manifest has packages of more than one of these types for the same
+	// platform, the most preferred one that the client is able to accept
+	// is offered.
+	PackageMediaTypes []string
+
+	// HashSchemes are the Terraform package hash schemes, such as "zh" and
+	// "h1", whose hashes are included in version responses for each
+	// package when known, in this order. Terraform uses whichever of them
+	// it understands to check the packages it downloads.
+	HashSchemes []string
+
+	// DiscoveryIDs are the service identifiers, like "example.v1", under
+	// which the server's Terraform service discovery document advertises
+	// this service.
+	DiscoveryIDs []string
+
+	// RootResponse decides how the server responds to requests for the
+	// root of this service, which isn't part of the mirror protocol.
+	RootResponse RootResponse
+
+	// RootRedirectURL is where requests for the root of this service are
+	// redirected when RootResponse is RootResponseRedirect.
+	RootRedirectURL *url.URL
+
+	// AcceptHeader decides whether the server takes into account the media
+	// types that clients accept when choosing how to respond.
+	AcceptHeader AcceptHeader
+
+	// ExternalURL, if set, is the absolute URL at which clients can reach
+	// this service, used as the base for any URLs generated in responses
+	// instead of the URL of the incoming request. If the service doesn't
+	// set this itself then it's derived from the server's ExternalURL, if
+	// any.
+	ExternalURL *url.URL
+
+	DeclRange hcl.Range
+}
+
+// ProviderRegistry is a service that serves the provider registry protocol,
+// so that Terraform can install providers from it directly rather than only
+// through a network mirror.
+//
+// Because a registry's hostname is part of the address of each provider it
+// serves, the namespaces of its providers in the origin registry are just
+// their namespace and type following NamePrefix.
+type ProviderRegistry struct {
+	Name       string
+	OriginURL  *url.URL
+	NamePrefix ocidist.Namespace
+
+	// CacheTTL is how long manifests fetched from the origin registry
+	// remain fresh before they must be refetched. Zero means that
+	// manifests are never served from cache while fresh.
+	CacheTTL time.Duration
+
+	// CacheMaxStale is how long after CacheTTL has passed that cached
+	// manifests may still be served if the origin registry is failing.
+	// Zero means that stale manifests are never served.
+	CacheMaxStale time.Duration
+
+	// Backend is the policy for interacting with this service's origin
+	// registry, with any settings not overridden in the service's own
+	// block taken from the server-level defaults.
+	Backend BackendPolicy
+
+	// SigningKey is the OpenPGP key that signs the SHA256SUMS documents
+	// the service generates. Download responses offer its public key so
+	// that Terraform can verify the signatures.
+	SigningKey *openpgp.Entity
+
+	DeclRange hcl.Range
+}
+
+// ModuleRegistry is a service that serves the module registry protocol, so
+// that Terraform can install modules published as OCI artifacts.
+//
+// The namespace of each module in the origin registry is its namespace,
+// name, and target system following NamePrefix.
+type ModuleRegistry struct {
+	Name       string
+	OriginURL  *url.URL
+	NamePrefix ocidist.Namespace
+
+	// ProxyPackages makes the server relay module packages from the origin
+	// registry itself, using download URLs authenticated with the server's
+	// query string secret, instead of referring clients directly to the
+	// origin registry.
+	ProxyPackages bool
+
+	// CacheTTL is how long manifests fetched from the origin registry
+	// remain fresh before they must be refetched. Zero means that
+	// manifests are never served from cache while fresh.
+	CacheTTL time.Duration
+
+	// CacheMaxStale is how long after CacheTTL has passed that cached
+	// manifests may still be served if the origin registry is failing.
+	// Zero means that stale manifests are never served.
+	CacheMaxStale time.Duration
+
+	// Backend is the policy for interacting with this service's origin
+	// registry, with any settings not overridden in the service's own
+	// block taken from the server-level defaults.
+	Backend BackendPolicy
+
 	DeclRange hcl.Range
 }
 
+// ArtifactChecking represents the possible ways to handle tags in a
+// provider's namespace that refer to something other than a Terraform
+// provider release.
+type ArtifactChecking string
+
+const (
+	// ArtifactCheckingStrict means that all version-like tags are included in
+	// a provider's version index, and requesting the details of a version
+	// whose tag refers to some other kind of artifact is an error.
+	// This is the default.
+	ArtifactCheckingStrict ArtifactChecking = "strict"
+
+	// ArtifactCheckingLenient means that version-like tags which refer to
+	// other kinds of artifact are treated as if they don't exist, so that a
+	// namespace can contain a mixture of artifact types. This requires
+	// fetching the manifest for every version when building the index.
+	ArtifactCheckingLenient ArtifactChecking = "lenient"
+)
+
+// RootResponse represents the possible ways to respond to requests for the
+// root of a service, letting operators decide how much the server reveals
+// about itself to anyone who visits it.
+type RootResponse string
+
+const (
+	// RootResponseHTML means that the server responds with a short HTML
+	// page advertising the service. This is the default.
+	RootResponseHTML RootResponse = "html"
+
+	// RootResponseJSON means that the server responds with a JSON summary
+	// of the service, for automated tools that check on it.
+	RootResponseJSON RootResponse = "json"
+
+	// RootResponseNotFound means that the server responds as if there were
+	// nothing at the root.
+	RootResponseNotFound RootResponse = "not_found"
+
+	// RootResponseRedirect means that the server redirects to the
+	// service's documentation at RootRedirectURL.
+	RootResponseRedirect RootResponse = "redirect"
+)
+
+// AcceptHeader represents the possible ways to handle the Accept header in
+// requests for a service's JSON and HTML resources.
+type AcceptHeader string
+
+const (
+	// AcceptHeaderIgnore means that the server ignores the Accept header,
+	// always responding with the resource's usual media type. This is the
+	// default, because intermediaries sometimes rewrite Accept headers.
+	AcceptHeaderIgnore AcceptHeader = "ignore"
+
+	// AcceptHeaderNegotiate means that the server chooses between the
+	// media types available for a resource, such as HTML or JSON for the
+	// root of a service, according to the Accept header, and responds with
+	// "406 Not Acceptable" if the client accepts none of them.
+	AcceptHeaderNegotiate AcceptHeader = "negotiate"
+)
+
+// downloadMode is how a provider mirror serves package downloads, as decided
+// by the proxy_packages and redirect_packages arguments. Other
+// download-related arguments are valid only with some modes.
+type downloadMode string
+
+const (
+	// downloadModeDirect means that clients download packages directly
+	// from the origin registry.
+	downloadModeDirect downloadMode = "direct"
+
+	// downloadModeProxy means that the server fetches package content from
+	// the origin registry and relays it to clients.
+	downloadModeProxy downloadMode = "proxy"
+
+	// downloadModeRedirect is like downloadModeProxy except that clients are
+	// redirected to wherever the origin registry offloads package content.
+	downloadModeRedirect downloadMode = "redirect"
+)
+
+// oneOf returns true if the receiver is any of the given modes.
+func (m downloadMode) oneOf(modes []downloadMode) bool {
+	for _, candidate := range modes {
+		if m == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+// DuplicatePlatforms represents the possible ways to handle a manifest
+// with more than one package layer for the same platform.
+type DuplicatePlatforms string
+
+const (
+	// DuplicatePlatformsLowestDigest means that the layer with the lowest
+	// digest is offered, with a warning, so that the choice doesn't depend
+	// on the order of the layers. This is the default.
+	DuplicatePlatformsLowestDigest DuplicatePlatforms = "lowest_digest"
+
+	// DuplicatePlatformsFirst means that the first of the layers in the
+	// manifest is offered, with a warning.
+	DuplicatePlatformsFirst DuplicatePlatforms = "first"
+
+	// DuplicatePlatformsLast means that the last of the layers in the
+	// manifest is offered, with a warning.
+	DuplicatePlatformsLast DuplicatePlatforms = "last"
+
+	// DuplicatePlatformsError means that requests for the version fail,
+	// for registries where duplicates can only be a publishing mistake.
+	DuplicatePlatformsError DuplicatePlatforms = "error"
+)
+
+// PackageVerification represents the possible ways to check proxied
+// package content against its expected digest.
+type PackageVerification string
+
+const (
+	// PackageVerificationNone means that package content is relayed to
+	// clients without checking it. This is the default.
+	PackageVerificationNone PackageVerification = "none"
+
+	// PackageVerificationStreaming means that the server computes the
+	// digest of package content while relaying it, and aborts the response
+	// before it's complete if the digest doesn't match.
+	PackageVerificationStreaming PackageVerification = "streaming"
+
+	// PackageVerificationBuffered means that the server downloads and
+	// checks the whole package into a temporary file before sending any
+	// of it, so that clients never receive content that doesn't match.
+	PackageVerificationBuffered PackageVerification = "buffered"
+)
+
+// LogFormat represents the supported formats for the server's logs.
+type LogFormat string
+
+const (
+	// LogFormatText is the server's default freeform log output, with no
+	// separate access log.
+	LogFormatText LogFormat = "text"
+
+	// LogFormatCombined adds a line in the Combined Log Format used by
+	// Apache httpd for each request, for compatibility with existing
+	// log-processing tools.
+	LogFormatCombined LogFormat = "combined"
+)
+
 type Server struct {
 	ListenAddr string
 	TLS        *TLSConfig
 
-	QueryStringSecret *[32]byte
+	// QueryStringSecret is the secret key for QueryStringCipher, or nil if
+	// no services need one. It has the length that the cipher requires.
+	QueryStringSecret []byte
+
+	// QueryStringCipher is the algorithm used with QueryStringSecret to
+	// protect the secrets in package download URLs.
+	QueryStringCipher querysecret.Cipher
+
+	// DownloadTokenMaxLifetime, if nonzero, is the longest remaining
+	// lifetime that a package download token may claim for the server to
+	// accept it.
+	DownloadTokenMaxLifetime time.Duration
+
+	// DownloadTokenGracePeriod is how long after a package download token
+	// expires that the server still accepts it, or zero to reject expired
+	// tokens immediately.
+	DownloadTokenGracePeriod time.Duration
+
+	// ExternalURL, if set, is the absolute URL at which clients can reach
+	// the server, under which each service is available at a path named
+	// after the service.
+	ExternalURL *url.URL
+
+	// LogFormat selects whether and how the server writes access logs.
+	LogFormat LogFormat
+
+	// LogServiceNames adds the name of the service handling each request to
+	// the prefix of each log line written while handling it, so that logs
+	// from servers with multiple services can be filtered by service.
+	LogServiceNames bool
+
+	// MetricsPath is the path where the server exposes its metrics in
+	// the JSON format used by the expvar package, or empty if metrics
+	// should not be exposed.
+	MetricsPath string
+
+	// GzipResponses enables compressing the JSON metadata responses of each
+	// service for clients that accept gzip.
+	GzipResponses bool
+
+	// CompressionLevel is the gzip compression level used for responses
+	// when GzipResponses is enabled, from 1 for the fastest compression to
+	// 9 for the smallest responses.
+	CompressionLevel int
+
+	// ServerTiming enables the Server-Timing response header, which breaks
+	// down how long each response took to produce, for debugging slow
+	// requests from browsers and other timing-aware clients.
+	ServerTiming bool
+
+	// DescriptionPath is the path where the server exposes a JSON
+	// description of the services it offers, for use by operators and
+	// their tools, or empty if the description should not be exposed.
+	DescriptionPath string
+
+	// CapabilitiesPath is the path where the server exposes a JSON report
+	// of which optional features each service's origin registry supports,
+	// for use by operators diagnosing problems, or empty if the report
+	// should not be exposed.
+	//
+	// CapabilitiesTTL is how long the server reuses the result of probing
+	// an origin registry before probing it again.
+	CapabilitiesPath string
+	CapabilitiesTTL  time.Duration
+
+	// ReadinessPath is the path where the server reports whether it's ready
+	// to accept new requests, for load balancers and orchestrators, or
+	// empty if readiness should not be exposed. The server reports that it
+	// isn't ready as soon as shutdown begins.
+	ReadinessPath string
+
+	// DiscoveryServices are additional entries for the server's Terraform
+	// service discovery document, mapping service identifiers to URLs. These
+	// take precedence over any entries for the same identifiers derived
+	// from the services' DiscoveryIDs.
+	DiscoveryServices map[string]string
+
+	// MaxServices is the maximum number of services of all types that the
+	// configuration may declare, or zero if there is no limit. This guards
+	// against accidentally loading an enormous generated configuration.
+	MaxServices int
+
+	// MaxDownloadsPerClient is the maximum number of provider package
+	// downloads that any single client may have in progress at once, or
+	// zero if there is no limit.
+	MaxDownloadsPerClient int
+
+	// ClientIPv6PrefixLength, if nonzero, is the length of the network
+	// prefix that identifies a client with an IPv6 address for per-client
+	// limits and in the audit log, so that all of the addresses within
+	// that network count as the same client. If zero, each address is a
+	// separate client.
+	ClientIPv6PrefixLength int
+
+	// BreakerThreshold is the number of consecutive failed requests to an
+	// origin registry host after which the server stops sending requests
+	// to that host for BreakerCooldown, or zero to disable this behavior.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// BackpressureThreshold is the number of requests that may be in
+	// progress at once before the server starts delaying new requests, or
+	// zero to disable this behavior. The delay increases with the number of
+	// requests above the threshold, up to BackpressureMaxDelay.
+	BackpressureThreshold int
+	BackpressureMaxDelay  time.Duration
+
+	// TokenAlertThreshold is the number of rejected download tokens within
+	// TokenAlertWindow above which the server logs an alert, or zero to
+	// disable alerts. If TokenAlertUnready is set then the readiness
+	// endpoint also reports that the server isn't ready until the window
+	// ends.
+	TokenAlertThreshold int
+	TokenAlertWindow    time.Duration
+	TokenAlertUnready   bool
+
+	// ShutdownTimeout is how long the server waits for in-progress
+	// requests, including package downloads, to complete when shutting
+	// down before it forcibly closes their connections.
+	ShutdownTimeout time.Duration
+
+	// ShutdownDelay is how long the server continues accepting new requests
+	// after shutdown begins, while reporting that it isn't ready, so that
+	// load balancers can stop sending it traffic before it stops listening.
+	// The shutdown timeout begins only after this delay.
+	ShutdownDelay time.Duration
+
+	// StartupProbeTimeout, if nonzero, is how long the server waits for each
+	// service's origin registry to respond to a check that it's reachable
+	// at startup, or zero to skip that check. The checks run concurrently,
+	// at most StartupProbeConcurrency at a time, and the server logs any
+	// that fail but starts regardless.
+	StartupProbeTimeout     time.Duration
+	StartupProbeConcurrency int
+
+	// Backend is the default policy for interacting with origin
+	// registries, which individual services can override.
+	Backend BackendPolicy
+
+	// TrustedDigestAlgorithms are the hash algorithms that the server will
+	// accept when a digest is used to identify or verify content.
+	TrustedDigestAlgorithms []string
+
+	// ErrorPages maps HTTP status codes to custom bodies for error
+	// responses with those codes. Responses with other status codes use
+	// the server's minimal built-in bodies.
+	ErrorPages map[int]*ErrorPage
+
+	// AuditLog, if set, enables the server's audit log of
+	// security-relevant events.
+	AuditLog *AuditLog
 
 	DeclRange hcl.Range
 }
 
+// AuditLog configures the server's audit log, which records
+// security-relevant events such as authentication failures separately from
+// the server's other logs.
+type AuditLog struct {
+	// Filename is the file that the server appends audit events to, one
+	// JSON object per line.
+	Filename string
+
+	// MaxEventsPerSecond is the maximum number of events that the server
+	// writes to the audit log in any one second, or zero for no limit.
+	// Any further events in the same second are counted but not written.
+	MaxEventsPerSecond int
+}
+
+// ErrorPage is the custom content for error responses with a particular
+// status code. At least one of HTML and JSON is always set, and the server
+// chooses between them based on what the client accepts.
+type ErrorPage struct {
+	HTML []byte
+	JSON []byte
+}
+
+// BackendPolicy describes how the server interacts with an origin registry.
+//
+// The server block specifies the default policy, and each service can
+// override some or all of the settings for its own origin registry.
+type BackendPolicy struct {
+	// Timeout is the maximum time to wait for each metadata request to the
+	// origin registry to complete, or zero for no timeout.
+	//
+	// This doesn't apply to package downloads, which can legitimately take
+	// a long time for large packages.
+	Timeout time.Duration
+
+	// IdleTimeout is the maximum time to wait for the origin registry to
+	// send more of a package's content while proxying a download, or zero
+	// for no limit.
+	IdleTimeout time.Duration
+
+	// MaxConcurrency is the maximum number of requests to the origin
+	// registry that may be in progress at once, or zero for no limit.
+	MaxConcurrency int
+
+	// RetryAttempts is the maximum number of times to send each request
+	// to the origin registry when it fails in a way that's likely to be
+	// temporary, including the first, or zero if unset. Values less than
+	// two disable retries.
+	//
+	// RetryDelay is how long to wait before the first retry, which doubles
+	// for each later retry, or zero to use the default.
+	RetryAttempts int
+	RetryDelay    time.Duration
+}
+
+// withDefaults returns a copy of the receiver with any unset settings
+// replaced by the corresponding settings from the given defaults.
+func (p BackendPolicy) withDefaults(defaults BackendPolicy) BackendPolicy {
+	if p.Timeout == 0 {
+		p.Timeout = defaults.Timeout
+	}
+	if p.IdleTimeout == 0 {
+		p.IdleTimeout = defaults.IdleTimeout
+	}
+	if p.MaxConcurrency == 0 {
+		p.MaxConcurrency = defaults.MaxConcurrency
+	}
+	if p.RetryAttempts == 0 {
+		p.RetryAttempts = defaults.RetryAttempts
+	}
+	if p.RetryDelay == 0 {
+		p.RetryDelay = defaults.RetryDelay
+	}
+	return p
+}
+
 type TLSConfig struct {
 	Certificate tls.Certificate
 }
@@ -72,8 +821,10 @@ func LoadConfig(src []byte, filename string) (*Config, hcl.Diagnostics) {
 	}
 
 	ret := &Config{
-		Filename:        filename,
-		ProviderMirrors: make(map[string]*ProviderMirror),
+		Filename:           filename,
+		ProviderMirrors:    make(map[string]*ProviderMirror),
+		ProviderRegistries: make(map[string]*ProviderRegistry),
+		ModuleRegistries:   make(map[string]*ModuleRegistry),
 	}
 	namesUsed := make(map[string]hcl.Range)
 
@@ -98,6 +849,42 @@ func LoadConfig(src []byte, filename string) (*Config, hcl.Diagnostics) {
 
 			ret.ProviderMirrors[mirror.Name] = mirror
 
+		case "provider_registry":
+			registry, moreDiags := decodeProviderRegistry(block)
+			if existingRng, exists := namesUsed[registry.Name]; exists {
+				moreDiags = moreDiags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Duplicate service name",
+					Detail:   fmt.Sprintf("A service named %q was already declared at %s. Service names must be unique.", registry.Name, existingRng),
+					Subject:  block.DefRange.Ptr(),
+				})
+			}
+			diags = append(diags, moreDiags...)
+			namesUsed[registry.Name] = registry.DeclRange
+			if moreDiags.HasErrors() {
+				continue
+			}
+
+			ret.ProviderRegistries[registry.Name] = registry
+
+		case "module_registry":
+			registry, moreDiags := decodeModuleRegistry(block)
+			if existingRng, exists := namesUsed[registry.Name]; exists {
+				moreDiags = moreDiags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Duplicate service name",
+					Detail:   fmt.Sprintf("A service named %q was already declared at %s. Service names must be unique.", registry.Name, existingRng),
+					Subject:  block.DefRange.Ptr(),
+				})
+			}
+			diags = append(diags, moreDiags...)
+			namesUsed[registry.Name] = registry.DeclRange
+			if moreDiags.HasErrors() {
+				continue
+			}
+
+			ret.ModuleRegistries[registry.Name] = registry
+
 		case "server":
 			serverConfig, moreDiags := decodeServerConfig(block)
 			diags = append(diags, moreDiags...)
@@ -118,6 +905,39 @@ func LoadConfig(src []byte, filename string) (*Config, hcl.Diagnostics) {
 		}
 	}
 
+	if ret.Server != nil {
+		for _, mirror := range ret.ProviderMirrors {
+			mirror.Backend = mirror.Backend.withDefaults(ret.Server.Backend)
+			if mirror.ExternalURL == nil && ret.Server.ExternalURL != nil {
+				mirror.ExternalURL = ret.Server.ExternalURL.JoinPath(mirror.Name, "/")
+			}
+		}
+		for _, registry := range ret.ProviderRegistries {
+			registry.Backend = registry.Backend.withDefaults(ret.Server.Backend)
+		}
+		for _, registry := range ret.ModuleRegistries {
+			registry.Backend = registry.Backend.withDefaults(ret.Server.Backend)
+		}
+	}
+
+	if ret.Server != nil && ret.Server.MaxServices != 0 {
+		total := 0
+		for _, count := range ret.ServiceCounts() {
+			total += count
+		}
+		if total > ret.Server.MaxServices {
+			// This is a problem with the file as a whole rather than with
+			// any particular service, so we report it against the whole
+			// file.
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Too many services",
+				Detail:   fmt.Sprintf("The configuration declares %d services, but the server's max_services argument allows at most %d. If the configuration was generated, check that the generator is working correctly; otherwise, increase max_services.", total, ret.Server.MaxServices),
+				Subject:  f.Body.(*hclsyntax.Body).SrcRange.Ptr(),
+			})
+		}
+	}
+
 	diags = append(diags, validate(ret)...)
 
 	return ret, diags
@@ -126,7 +946,46 @@ func LoadConfig(src []byte, filename string) (*Config, hcl.Diagnostics) {
 func validate(cfg *Config) hcl.Diagnostics {
 	var diags hcl.Diagnostics
 
+	// Each discovery ID can refer to only one service, unless the server
+	// configuration overrides it.
+	var discoveryOverrides map[string]string
+	if cfg.Server != nil {
+		discoveryOverrides = cfg.Server.DiscoveryServices
+	}
+	mirrorNames := make([]string, 0, len(cfg.ProviderMirrors))
+	for name := range cfg.ProviderMirrors {
+		mirrorNames = append(mirrorNames, name)
+	}
+	sort.Strings(mirrorNames)
+	discoveryIDsUsed := make(map[string]*ProviderMirror)
+	for _, name := range mirrorNames {
+		mirror := cfg.ProviderMirrors[name]
+		for _, id := range mirror.DiscoveryIDs {
+			if _, overridden := discoveryOverrides[id]; overridden {
+				continue
+			}
+			if other, exists := discoveryIDsUsed[id]; exists {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Duplicate discovery service ID",
+					Detail:   fmt.Sprintf("The service %q is already advertised as %q. Each discovery service ID can refer to only one service.", other.Name, id),
+					Subject:  mirror.DeclRange.Ptr(),
+				})
+				continue
+			}
+			discoveryIDsUsed[id] = mirror
+		}
+	}
+
 	for _, mirror := range cfg.ProviderMirrors {
+		if mirror.CacheGzipResponses && (cfg.Server == nil || !cfg.Server.GzipResponses) {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Gzip response cache requires gzip responses",
+				Detail:   "The cache_gzip_responses option has no effect unless gzip_responses is also set inside the server block.",
+				Subject:  mirror.DeclRange.Ptr(),
+			})
+		}
 		if mirror.ProxyPackages && cfg.Server.QueryStringSecret == nil {
 			diags = diags.Append(&hcl.Diagnostic{
 				Severity: hcl.DiagError,
@@ -136,6 +995,16 @@ func validate(cfg *Config) hcl.Diagnostics {
 			})
 		}
 	}
+	for _, registry := range cfg.ModuleRegistries {
+		if registry.ProxyPackages && (cfg.Server == nil || cfg.Server.QueryStringSecret == nil) {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Query string secret required for package proxy",
+				Detail:   "The proxy_packages option requires that you set the query_string_secret argument inside the server block, to provide a secret key used to authenticate package download requests.",
+				Subject:  registry.DeclRange.Ptr(),
+			})
+		}
+	}
 
 	return diags
 }
@@ -146,10 +1015,88 @@ func decodeProviderMirror(block *hcl.Block) (*ProviderMirror, hcl.Diagnostics) {
 		DeclRange: block.DefRange,
 	}
 
+	type IPPolicyHCL struct {
+		Allow gohcl.WithRange[[]string] `hcl:"allow,optional"`
+		Deny  gohcl.WithRange[[]string] `hcl:"deny,optional"`
+	}
+	type CredentialsHCL struct {
+		Username gohcl.WithRange[*string] `hcl:"username,optional"`
+		Password gohcl.WithRange[*string] `hcl:"password,optional"`
+		Token    gohcl.WithRange[*string] `hcl:"token,optional"`
+	}
 	type Config struct {
-		OriginURL     gohcl.WithRange[string] `hcl:"origin_url"`
-		NamePrefix    gohcl.WithRange[string] `hcl:"name_prefix"`
-		ProxyPackages bool                    `hcl:"proxy_packages"`
+		OriginURL         gohcl.WithRange[string]  `hcl:"origin_url"`
+		FallbackOriginURL gohcl.WithRange[*string] `hcl:"fallback_origin_url,optional"`
+		NamePrefix        gohcl.WithRange[string]  `hcl:"name_prefix"`
+		ProxyPackages     bool                     `hcl:"proxy_packages"`
+		RedirectPackages  gohcl.WithRange[*bool]   `hcl:"redirect_packages,optional"`
+		PackageFilenames  gohcl.WithRange[*bool]   `hcl:"package_filenames,optional"`
+
+		ForwardQueryParams gohcl.WithRange[[]string] `hcl:"forward_query_params,optional"`
+
+		ArtifactChecking     gohcl.WithRange[*string] `hcl:"artifact_checking,optional"`
+		RequiredArtifactType gohcl.WithRange[*string] `hcl:"required_artifact_type,optional"`
+		YankedAnnotation     gohcl.WithRange[*string] `hcl:"yanked_annotation,optional"`
+		CreatedAnnotation    gohcl.WithRange[*string] `hcl:"created_annotation,optional"`
+		MinVersion           gohcl.WithRange[*string] `hcl:"min_version,optional"`
+
+		DuplicatePlatforms gohcl.WithRange[*string] `hcl:"duplicate_platforms,optional"`
+		MaxPlatforms       gohcl.WithRange[*int]    `hcl:"max_platforms,optional"`
+
+		PackageVerification gohcl.WithRange[*string] `hcl:"package_verification,optional"`
+		PackageCacheDir     gohcl.WithRange[*string] `hcl:"package_cache_dir,optional"`
+
+		RejectMalformedPaths bool `hcl:"reject_malformed_paths,optional"`
+		CanonicalRedirects   bool `hcl:"canonical_redirects,optional"`
+		ResolveLatest        bool `hcl:"resolve_latest,optional"`
+		VerifyLayers         bool `hcl:"verify_layers,optional"`
+		PinManifestDigests   bool `hcl:"pin_manifest_digests,optional"`
+		LenientSelectors     bool `hcl:"lenient_selectors,optional"`
+		StrictAnnotations    bool `hcl:"strict_annotations,optional"`
+
+		HeadContentLength  *bool `hcl:"head_content_length,optional"`
+		CacheGzipResponses bool  `hcl:"cache_gzip_responses,optional"`
+
+		MetadataNameSuffix gohcl.WithRange[*string] `hcl:"metadata_name_suffix,optional"`
+		PackageNameSuffix  gohcl.WithRange[*string] `hcl:"package_name_suffix,optional"`
+		AddressLayout      gohcl.WithRange[*string] `hcl:"address_layout,optional"`
+		NamespaceDepth     gohcl.WithRange[*int]    `hcl:"namespace_depth,optional"`
+
+		CacheTTL      gohcl.WithRange[*string] `hcl:"cache_ttl,optional"`
+		CacheMaxStale gohcl.WithRange[*string] `hcl:"cache_max_stale,optional"`
+
+		BackendTimeout        gohcl.WithRange[*string] `hcl:"backend_timeout,optional"`
+		BackendIdleTimeout    gohcl.WithRange[*string] `hcl:"backend_idle_timeout,optional"`
+		BackendMaxConcurrency gohcl.WithRange[*int]    `hcl:"backend_max_concurrency,optional"`
+		BackendRetryAttempts  gohcl.WithRange[*int]    `hcl:"backend_retry_attempts,optional"`
+		BackendRetryDelay     gohcl.WithRange[*string] `hcl:"backend_retry_delay,optional"`
+		BackendForceHTTP1     bool                     `hcl:"backend_force_http1,optional"`
+		BackendPrefetchPages  bool                     `hcl:"backend_prefetch_pages,optional"`
+		BackendStrictJSON     bool                     `hcl:"backend_strict_json,optional"`
+		BackendIPPolicy       *IPPolicyHCL             `hcl:"backend_ip_policy,block"`
+		OriginCredentials     *CredentialsHCL          `hcl:"origin_credentials,block"`
+
+		BackendTLSSessionCacheSize gohcl.WithRange[*int]    `hcl:"backend_tls_session_cache_size,optional"`
+		BackendTLSRenegotiation    gohcl.WithRange[*string] `hcl:"backend_tls_renegotiation,optional"`
+
+		ExternalURL  gohcl.WithRange[*string]  `hcl:"external_url,optional"`
+		DiscoveryIDs gohcl.WithRange[[]string] `hcl:"discovery_ids,optional"`
+
+		RootResponse          gohcl.WithRange[*string] `hcl:"root_response,optional"`
+		AcceptHeader          gohcl.WithRange[*string] `hcl:"accept_header,optional"`
+		RootRedirectURL       gohcl.WithRange[*string] `hcl:"root_redirect_url,optional"`
+		ProviderIndex         bool                     `hcl:"provider_index,optional"`
+		ProviderIndexPageSize gohcl.WithRange[*int]    `hcl:"provider_index_page_size,optional"`
+
+		ExposedAnnotations []string                   `hcl:"exposed_annotations,optional"`
+		PackageMediaTypes  gohcl.WithRange[*[]string] `hcl:"package_media_types,optional"`
+		HashSchemes        gohcl.WithRange[*[]string] `hcl:"hash_schemes,optional"`
+
+		PackageResponseHeaders gohcl.WithRange[*[]string] `hcl:"package_response_headers,optional"`
+
+		DeprecatedProviders gohcl.WithRange[map[string]string] `hcl:"deprecated_providers,optional"`
+		WarmProviders       gohcl.WithRange[[]string]          `hcl:"warm_providers,optional"`
+		ProbeProvider       gohcl.WithRange[*string]           `hcl:"probe_provider,optional"`
 	}
 	var config Config
 	diags := gohcl.DecodeBody(block.Body, nil, &config)
@@ -157,50 +1104,750 @@ func decodeProviderMirror(block *hcl.Block) (*ProviderMirror, hcl.Diagnostics) {
 		return ret, diags
 	}
 
-	var err error
-	ret.OriginURL, err = url.Parse(config.OriginURL.Value)
-	if err != nil {
-		diags = diags.Append(&hcl.Diagnostic{
-			Severity: hcl.DiagError,
-			Summary:  "Invalid OCI repository origin URL",
-			Detail:   fmt.Sprintf("Invalid URL syntax: %s.", err),
-			Subject:  config.OriginURL.Range.Ptr(),
-		})
-	} else {
-		if ret.OriginURL.Scheme != "http" && ret.OriginURL.Scheme != "https" {
+	externalURL, moreDiags := decodeExternalURL(config.ExternalURL)
+	diags = append(diags, moreDiags...)
+	ret.ExternalURL = externalURL
+
+	for _, id := range config.DiscoveryIDs.Value {
+		if !discoveryIDRe.MatchString(id) {
 			diags = diags.Append(&hcl.Diagnostic{
 				Severity: hcl.DiagError,
-				Summary:  "Invalid OCI repository origin URL",
-				Detail:   "OCI registry URL must use either the 'https' or 'http' scheme.",
-				Subject:  config.OriginURL.Range.Ptr(),
+				Summary:  "Invalid discovery service ID",
+				Detail:   fmt.Sprintf("%q is not a valid service identifier. Identifiers are a lowercase name and a version number separated by a period, like \"providers.v1\".", id),
+				Subject:  config.DiscoveryIDs.Range.Ptr(),
 			})
-		} else if !strings.HasSuffix(ret.OriginURL.Path, "/") {
+			continue
+		}
+		ret.DiscoveryIDs = append(ret.DiscoveryIDs, id)
+	}
+
+	ret.AcceptHeader = AcceptHeaderIgnore
+	if config.AcceptHeader.Value != nil {
+		switch mode := AcceptHeader(*config.AcceptHeader.Value); mode {
+		case AcceptHeaderIgnore, AcceptHeaderNegotiate:
+			ret.AcceptHeader = mode
+		default:
 			diags = diags.Append(&hcl.Diagnostic{
 				Severity: hcl.DiagError,
-				Summary:  "Invalid OCI repository origin URL",
-				Detail:   "OCI registry URL have a path ending with a slash '/'.",
-				Subject:  config.OriginURL.Range.Ptr(),
+				Summary:  "Invalid Accept header handling",
+				Detail:   fmt.Sprintf("The accept_header argument must be either %q or %q.", AcceptHeaderIgnore, AcceptHeaderNegotiate),
+				Subject:  config.AcceptHeader.Range.Ptr(),
 			})
 		}
 	}
 
-	namePrefix, err := ocidist.ParseNamespace(config.NamePrefix.Value)
-	if err != nil {
+	ret.RootResponse = RootResponseHTML
+	if config.RootResponse.Value != nil {
+		switch mode := RootResponse(*config.RootResponse.Value); mode {
+		case RootResponseHTML, RootResponseJSON, RootResponseNotFound, RootResponseRedirect:
+			ret.RootResponse = mode
+		default:
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid root response",
+				Detail:   fmt.Sprintf("The root response must be %q, %q, %q, or %q.", RootResponseHTML, RootResponseJSON, RootResponseNotFound, RootResponseRedirect),
+				Subject:  config.RootResponse.Range.Ptr(),
+			})
+		}
+	}
+	switch {
+	case ret.RootResponse == RootResponseRedirect && config.RootRedirectURL.Value == nil:
 		diags = diags.Append(&hcl.Diagnostic{
 			Severity: hcl.DiagError,
-			Summary:  "Invalid OCI repository name prefix",
-			Detail:   fmt.Sprintf("Incorrect OCI distribution namespace syntax: %s.", err),
-			Subject:  config.NamePrefix.Range.Ptr(),
+			Summary:  "Missing root redirect URL",
+			Detail:   "The root_redirect_url argument is required when root_response is \"redirect\".",
+			Subject:  config.RootResponse.Range.Ptr(),
 		})
-	} else {
-		ret.NamePrefix = namePrefix
+	case ret.RootResponse != RootResponseRedirect && config.RootRedirectURL.Value != nil:
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Root redirect URL requires redirect",
+			Detail:   "The root_redirect_url argument is valid only when root_response is \"redirect\".",
+			Subject:  config.RootRedirectURL.Range.Ptr(),
+		})
+	case config.RootRedirectURL.Value != nil:
+		u, err := url.Parse(*config.RootRedirectURL.Value)
+		if err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid root redirect URL",
+				Detail:   "The root redirect URL must be an absolute URL using either the 'https' or 'http' scheme.",
+				Subject:  config.RootRedirectURL.Range.Ptr(),
+			})
+		} else {
+			ret.RootRedirectURL = u
+		}
+	}
+
+	ret.ExposedAnnotations = config.ExposedAnnotations
+	if len(config.DeprecatedProviders.Value) != 0 {
+		ret.DeprecatedProviders = make(map[string]string, len(config.DeprecatedProviders.Value))
+		for addr, msg := range config.DeprecatedProviders.Value {
+			if !validProviderAddr(addr) {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid deprecated provider address",
+					Detail:   fmt.Sprintf("%q is not a valid provider address. Each provider address must have a hostname, namespace, and type separated by slashes, like \"registry.terraform.io/hashicorp/aws\".", addr),
+					Subject:  config.DeprecatedProviders.Range.Ptr(),
+				})
+				continue
+			}
+			ret.DeprecatedProviders[strings.ToLower(addr)] = msg
+		}
+	}
+	for _, addr := range config.WarmProviders.Value {
+		if !validProviderAddr(addr) {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid warm provider address",
+				Detail:   fmt.Sprintf("%q is not a valid provider address. Each provider address must have a hostname, namespace, and type separated by slashes, like \"registry.terraform.io/hashicorp/aws\".", addr),
+				Subject:  config.WarmProviders.Range.Ptr(),
+			})
+			continue
+		}
+		ret.WarmProviders = append(ret.WarmProviders, strings.ToLower(addr))
+	}
+	if config.ProbeProvider.Value != nil {
+		if addr := *config.ProbeProvider.Value; !validProviderAddr(addr) {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid probe provider address",
+				Detail:   fmt.Sprintf("%q is not a valid provider address. The provider address must have a hostname, namespace, and type separated by slashes, like \"registry.terraform.io/hashicorp/aws\".", addr),
+				Subject:  config.ProbeProvider.Range.Ptr(),
+			})
+		} else {
+			ret.ProbeProvider = strings.ToLower(addr)
+		}
+	}
+
+	ret.PackageResponseHeaders = DefaultPackageResponseHeaders
+	if config.PackageResponseHeaders.Value != nil {
+		names := make([]string, len(*config.PackageResponseHeaders.Value))
+		for i, name := range *config.PackageResponseHeaders.Value {
+			names[i] = textproto.CanonicalMIMEHeaderKey(name)
+		}
+		ret.PackageResponseHeaders = names
+	}
+	ret.PackageMediaTypes = DefaultPackageMediaTypes
+	if config.PackageMediaTypes.Value != nil {
+		types := *config.PackageMediaTypes.Value
+		if len(types) == 0 {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid package media types",
+				Detail:   "At least one package media type must be specified.",
+				Subject:  config.PackageMediaTypes.Range.Ptr(),
+			})
+		}
+		for _, ty := range types {
+			if parsed, params, err := mime.ParseMediaType(ty); err != nil || parsed != ty || len(params) != 0 {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid package media types",
+					Detail:   fmt.Sprintf("%q is not a valid media type. Media types must be written in lowercase, without parameters.", ty),
+					Subject:  config.PackageMediaTypes.Range.Ptr(),
+				})
+			}
+		}
+		ret.PackageMediaTypes = types
+	}
+	ret.HashSchemes = DefaultHashSchemes
+	if config.HashSchemes.Value != nil {
+		schemes := *config.HashSchemes.Value
+		seen := make(map[string]bool, len(schemes))
+		for _, scheme := range schemes {
+			switch {
+			case scheme != "zh" && scheme != "h1":
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid hash schemes",
+					Detail:   fmt.Sprintf("%q is not a supported hash scheme. The supported schemes are \"zh\" and \"h1\".", scheme),
+					Subject:  config.HashSchemes.Range.Ptr(),
+				})
+			case seen[scheme]:
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid hash schemes",
+					Detail:   fmt.Sprintf("The hash scheme %q is listed more than once.", scheme),
+					Subject:  config.HashSchemes.Range.Ptr(),
+				})
+			}
+			seen[scheme] = true
+		}
+		ret.HashSchemes = schemes
+	}
+	ret.RejectMalformedPaths = config.RejectMalformedPaths
+	ret.CanonicalRedirects = config.CanonicalRedirects
+	ret.ResolveLatest = config.ResolveLatest
+	ret.VerifyLayers = config.VerifyLayers
+	ret.PinManifestDigests = config.PinManifestDigests
+	ret.LenientSelectors = config.LenientSelectors
+	ret.StrictAnnotations = config.StrictAnnotations
+	ret.BackendForceHTTP1 = config.BackendForceHTTP1
+	ret.BackendPrefetchPages = config.BackendPrefetchPages
+	ret.BackendStrictJSON = config.BackendStrictJSON
+	ret.ProviderIndex = config.ProviderIndex
+	if config.ProviderIndexPageSize.Value != nil {
+		if size := *config.ProviderIndexPageSize.Value; size < 1 {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid provider index page size",
+				Detail:   "The provider index page size must be at least one. Omit this argument to list all providers in a single response.",
+				Subject:  config.ProviderIndexPageSize.Range.Ptr(),
+			})
+		} else {
+			ret.ProviderIndexPageSize = size
+		}
+	}
+	if config.BackendIPPolicy != nil {
+		allow, moreDiags := decodeIPNetworks(config.BackendIPPolicy.Allow)
+		diags = append(diags, moreDiags...)
+		deny, moreDiags := decodeIPNetworks(config.BackendIPPolicy.Deny)
+		diags = append(diags, moreDiags...)
+		ret.BackendIPPolicy = &ocidist.IPPolicy{Allow: allow, Deny: deny}
+	}
+	if creds := config.OriginCredentials; creds != nil {
+		var username, password, token string
+		if creds.Username.Value != nil {
+			username = *creds.Username.Value
+		}
+		if creds.Password.Value != nil {
+			password = *creds.Password.Value
+		}
+		if creds.Token.Value != nil {
+			token = *creds.Token.Value
+		}
+		switch {
+		case token != "" && (username != "" || password != ""):
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid origin credentials",
+				Detail:   "Origin credentials may have either a username and password or a static token, but not both.",
+				Subject:  creds.Token.Range.Ptr(),
+			})
+		case username == "" && password != "":
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid origin credentials",
+				Detail:   "A password requires a username. To use anonymous tokens from the origin registry's token service, set neither.",
+				Subject:  creds.Password.Range.Ptr(),
+			})
+		case username != "" && password == "":
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid origin credentials",
+				Detail:   "A username requires a password. To use anonymous tokens from the origin registry's token service, set neither.",
+				Subject:  creds.Username.Range.Ptr(),
+			})
+		default:
+			ret.OriginCredentials = &ocidist.Credentials{
+				Username: username,
+				Password: password,
+				Token:    token,
+			}
+		}
+	}
+	ret.BackendTLSSessionCacheSize = DefaultBackendTLSSessionCacheSize
+	if config.BackendTLSSessionCacheSize.Value != nil {
+		size := *config.BackendTLSSessionCacheSize.Value
+		if size < 0 || size > maxBackendTLSSessionCacheSize {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid TLS session cache size",
+				Detail:   fmt.Sprintf("The TLS session cache size must be between 0 and %d, where zero disables TLS session resumption.", maxBackendTLSSessionCacheSize),
+				Subject:  config.BackendTLSSessionCacheSize.Range.Ptr(),
+			})
+		}
+		ret.BackendTLSSessionCacheSize = size
+	}
+	ret.BackendTLSRenegotiation = tls.RenegotiateNever
+	if config.BackendTLSRenegotiation.Value != nil {
+		switch *config.BackendTLSRenegotiation.Value {
+		case "never":
+			ret.BackendTLSRenegotiation = tls.RenegotiateNever
+		case "once":
+			ret.BackendTLSRenegotiation = tls.RenegotiateOnceAsClient
+		case "freely":
+			ret.BackendTLSRenegotiation = tls.RenegotiateFreelyAsClient
+		default:
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid TLS renegotiation setting",
+				Detail:   `TLS renegotiation must be "never", "once", or "freely".`,
+				Subject:  config.BackendTLSRenegotiation.Range.Ptr(),
+			})
+		}
+	}
+	ret.CacheGzipResponses = config.CacheGzipResponses
+	ret.HeadContentLength = true
+	if config.HeadContentLength != nil {
+		ret.HeadContentLength = *config.HeadContentLength
+	}
+
+	originURL, moreDiags := decodeOriginURL(config.OriginURL.Value, config.OriginURL.Range, "OCI repository origin URL")
+	diags = append(diags, moreDiags...)
+	ret.OriginURL = originURL
+	if config.FallbackOriginURL.Value != nil {
+		fallbackURL, moreDiags := decodeOriginURL(*config.FallbackOriginURL.Value, config.FallbackOriginURL.Range, "fallback origin URL")
+		diags = append(diags, moreDiags...)
+		if fallbackURL != nil && originURL != nil && fallbackURL.String() == originURL.String() {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid fallback origin URL",
+				Detail:   "The fallback origin URL must be different from the primary origin URL.",
+				Subject:  config.FallbackOriginURL.Range.Ptr(),
+			})
+		} else {
+			ret.FallbackOriginURL = fallbackURL
+		}
+	}
+
+	namePrefix, err := ocidist.ParseNamespace(config.NamePrefix.Value)
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid OCI repository name prefix",
+			Detail:   fmt.Sprintf("Incorrect OCI distribution namespace syntax: %s.", err),
+			Subject:  config.NamePrefix.Range.Ptr(),
+		})
+	} else {
+		ret.NamePrefix = namePrefix
+	}
+
+	mode := downloadModeDirect
+	if config.ProxyPackages {
+		mode = downloadModeProxy
+		if config.RedirectPackages.Value != nil && *config.RedirectPackages.Value {
+			mode = downloadModeRedirect
+		}
+	}
+	ret.ProxyPackages = mode != downloadModeDirect
+	ret.RedirectPackages = mode == downloadModeRedirect
+	ret.PackageFilenames = mode != downloadModeDirect && config.PackageFilenames.Value != nil && *config.PackageFilenames.Value
+
+	// downloadOptions are the arguments that affect how package downloads
+	// are served, and which of the download modes each one is valid with.
+	// This is the one place that decides which combinations of
+	// download-related arguments make sense, so that the handler never has
+	// to guess what an ambiguous combination means.
+	proxied := []downloadMode{downloadModeProxy, downloadModeRedirect}
+	downloadOptions := []struct {
+		set     bool
+		rng     hcl.Range
+		modes   []downloadMode
+		summary string
+		detail  string
+	}{
+		{
+			set:     config.RedirectPackages.Value != nil && *config.RedirectPackages.Value,
+			rng:     config.RedirectPackages.Range,
+			modes:   []downloadMode{downloadModeRedirect},
+			summary: "Package redirects require package proxy",
+			detail:  "The redirect_packages option requires proxy_packages = true, because the server must request package locations from the origin registry on the client's behalf.",
+		},
+		{
+			set:     config.PackageFilenames.Value != nil && *config.PackageFilenames.Value,
+			rng:     config.PackageFilenames.Range,
+			modes:   proxied,
+			summary: "Package filenames require package proxy",
+			detail:  "The package_filenames option requires proxy_packages = true, because otherwise clients download packages directly from the origin registry.",
+		},
+		{
+			set:     len(config.ForwardQueryParams.Value) != 0,
+			rng:     config.ForwardQueryParams.Range,
+			modes:   proxied,
+			summary: "Forwarded query parameters require package proxy",
+			detail:  "The forward_query_params option requires proxy_packages = true, because otherwise the server never requests packages from the origin registry.",
+		},
+		{
+			set:     config.PackageResponseHeaders.Value != nil,
+			rng:     config.PackageResponseHeaders.Range,
+			modes:   proxied,
+			summary: "Package response headers require package proxy",
+			detail:  "The package_response_headers option requires proxy_packages = true, because otherwise clients download packages directly from the origin registry and receive all of its response headers.",
+		},
+		{
+			set:     config.PackageVerification.Value != nil && *config.PackageVerification.Value != string(PackageVerificationNone),
+			rng:     config.PackageVerification.Range,
+			modes:   []downloadMode{downloadModeProxy},
+			summary: "Package verification requires package proxy",
+			detail:  "The package_verification option requires proxy_packages = true and can't be used with redirect_packages, because the server can verify only the package content that it relays to clients itself.",
+		},
+		{
+			set:     config.PackageCacheDir.Value != nil,
+			rng:     config.PackageCacheDir.Range,
+			modes:   proxied,
+			summary: "Package cache requires package proxy",
+			detail:  "The package_cache_dir option requires proxy_packages = true, because otherwise clients download packages directly from the origin registry.",
+		},
+	}
+	for _, opt := range downloadOptions {
+		if opt.set && !mode.oneOf(opt.modes) {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  opt.summary,
+				Detail:   opt.detail,
+				Subject:  opt.rng.Ptr(),
+			})
+		}
+	}
+
+	for _, name := range config.ForwardQueryParams.Value {
+		if !queryParamNameRe.MatchString(name) {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid forwarded query parameter name",
+				Detail:   fmt.Sprintf("%q is not a valid query parameter name. Names may contain only letters, digits, and the punctuation characters \"-\", \".\", \"_\", and \"~\".", name),
+				Subject:  config.ForwardQueryParams.Range.Ptr(),
+			})
+			continue
+		}
+		ret.ForwardQueryParams = append(ret.ForwardQueryParams, name)
+	}
+
+	if config.RequiredArtifactType.Value != nil {
+		if _, _, err := mime.ParseMediaType(*config.RequiredArtifactType.Value); err != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid required artifact type",
+				Detail:   fmt.Sprintf("The required artifact type must be a media type, like \"application/vnd.hashicorp.terraform-provider\": %s.", err),
+				Subject:  config.RequiredArtifactType.Range.Ptr(),
+			})
+		} else {
+			ret.RequiredArtifactType = *config.RequiredArtifactType.Value
+		}
+	}
+
+	if config.MinVersion.Value != nil {
+		v, err := versions.ParseVersion(*config.MinVersion.Value)
+		if err != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid minimum version",
+				Detail:   fmt.Sprintf("The minimum version must be a version number, like \"1.2.0\": %s.", err),
+				Subject:  config.MinVersion.Range.Ptr(),
+			})
+		} else {
+			ret.MinVersion = v
+		}
+	}
+
+	if config.YankedAnnotation.Value != nil {
+		if *config.YankedAnnotation.Value == "" {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid yanked annotation",
+				Detail:   "The yanked annotation name must not be empty.",
+				Subject:  config.YankedAnnotation.Range.Ptr(),
+			})
+		} else {
+			ret.YankedAnnotation = *config.YankedAnnotation.Value
+		}
+	}
+
+	if config.CreatedAnnotation.Value != nil {
+		if *config.CreatedAnnotation.Value == "" {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid created annotation",
+				Detail:   "The created annotation name must not be empty.",
+				Subject:  config.CreatedAnnotation.Range.Ptr(),
+			})
+		} else {
+			ret.CreatedAnnotation = *config.CreatedAnnotation.Value
+		}
+	}
+
+	ret.ArtifactChecking = ArtifactCheckingStrict
+	if config.ArtifactChecking.Value != nil {
+		switch mode := ArtifactChecking(*config.ArtifactChecking.Value); mode {
+		case ArtifactCheckingStrict, ArtifactCheckingLenient:
+			ret.ArtifactChecking = mode
+		default:
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid artifact checking mode",
+				Detail:   fmt.Sprintf("The artifact checking mode must be either %q or %q.", ArtifactCheckingStrict, ArtifactCheckingLenient),
+				Subject:  config.ArtifactChecking.Range.Ptr(),
+			})
+		}
+	}
+
+	ret.DuplicatePlatforms = DuplicatePlatformsLowestDigest
+	if config.DuplicatePlatforms.Value != nil {
+		switch mode := DuplicatePlatforms(*config.DuplicatePlatforms.Value); mode {
+		case DuplicatePlatformsLowestDigest, DuplicatePlatformsFirst, DuplicatePlatformsLast, DuplicatePlatformsError:
+			ret.DuplicatePlatforms = mode
+		default:
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duplicate platforms mode",
+				Detail:   fmt.Sprintf("The duplicate platforms mode must be %q, %q, %q, or %q.", DuplicatePlatformsLowestDigest, DuplicatePlatformsFirst, DuplicatePlatformsLast, DuplicatePlatformsError),
+				Subject:  config.DuplicatePlatforms.Range.Ptr(),
+			})
+		}
+	}
+	ret.MaxPlatforms = DefaultMaxPlatforms
+	if config.MaxPlatforms.Value != nil {
+		n := *config.MaxPlatforms.Value
+		if n < 1 || n > maxMaxPlatforms {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid maximum platforms",
+				Detail:   fmt.Sprintf("The maximum number of platforms per version must be between 1 and %d.", maxMaxPlatforms),
+				Subject:  config.MaxPlatforms.Range.Ptr(),
+			})
+		}
+		ret.MaxPlatforms = n
+	}
+
+	ret.PackageVerification = PackageVerificationNone
+	if config.PackageVerification.Value != nil {
+		switch mode := PackageVerification(*config.PackageVerification.Value); mode {
+		case PackageVerificationNone, PackageVerificationStreaming, PackageVerificationBuffered:
+			ret.PackageVerification = mode
+		default:
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid package verification mode",
+				Detail:   fmt.Sprintf("The package verification mode must be %q, %q, or %q.", PackageVerificationNone, PackageVerificationStreaming, PackageVerificationBuffered),
+				Subject:  config.PackageVerification.Range.Ptr(),
+			})
+		}
+	}
+
+	if config.PackageCacheDir.Value != nil {
+		dir := *config.PackageCacheDir.Value
+		if dir == "" {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid package cache directory",
+				Detail:   "The package cache directory must not be empty. Omit package_cache_dir to disable the package cache.",
+				Subject:  config.PackageCacheDir.Range.Ptr(),
+			})
+		} else {
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(filepath.Dir(block.DefRange.Filename), dir)
+			}
+			ret.PackageCacheDir = dir
+		}
+	}
+
+	if config.MetadataNameSuffix.Value != nil {
+		suffix, err := ocidist.ParseNamespace(*config.MetadataNameSuffix.Value)
+		if err != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid OCI repository name suffix",
+				Detail:   fmt.Sprintf("Incorrect OCI distribution namespace syntax: %s.", err),
+				Subject:  config.MetadataNameSuffix.Range.Ptr(),
+			})
+		} else {
+			ret.MetadataNameSuffix = suffix
+		}
+	}
+	if config.PackageNameSuffix.Value != nil {
+		suffix, err := ocidist.ParseNamespace(*config.PackageNameSuffix.Value)
+		if err != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid OCI repository name suffix",
+				Detail:   fmt.Sprintf("Incorrect OCI distribution namespace syntax: %s.", err),
+				Subject:  config.PackageNameSuffix.Range.Ptr(),
+			})
+		} else {
+			ret.PackageNameSuffix = suffix
+		}
+	}
+
+	layout, moreDiags := decodeAddressLayout(config.AddressLayout)
+	diags = append(diags, moreDiags...)
+	ret.AddressLayout = layout
+	if config.NamespaceDepth.Value != nil && !moreDiags.HasErrors() && ret.NamePrefix != nil {
+		depth := *config.NamespaceDepth.Value
+		actual := len(ret.NamePrefix) + len(layoutOrDefault(layout))
+		switch {
+		case depth < 1:
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid namespace depth",
+				Detail:   "The namespace depth must be at least one.",
+				Subject:  config.NamespaceDepth.Range.Ptr(),
+			})
+		case depth != actual:
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid namespace depth",
+				Detail: fmt.Sprintf(
+					"The origin registry expects namespaces with %d parts, but the name prefix %q followed by the address layout %q produces %d parts. Use address_layout to add or remove parts so that provider addresses match the origin registry's layout.",
+					depth, ret.NamePrefix, strings.Join(layoutOrDefault(layout), "/"), actual,
+				),
+				Subject: config.NamespaceDepth.Range.Ptr(),
+			})
+		default:
+			ret.NamespaceDepth = depth
+		}
+	}
+
+	ttl, moreDiags := decodeDuration(config.CacheTTL, "cache TTL")
+	diags = append(diags, moreDiags...)
+	ret.CacheTTL = ttl
+	maxStale, moreDiags := decodeDuration(config.CacheMaxStale, "cache maximum staleness")
+	diags = append(diags, moreDiags...)
+	ret.CacheMaxStale = maxStale
+
+	if len(ret.WarmProviders) != 0 && ret.CacheTTL <= 0 && !diags.HasErrors() {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Warm providers require a cache",
+			Detail:   "The warm_providers argument has no effect unless cache_ttl is also set, because there is no cache to warm.",
+			Subject:  config.WarmProviders.Range.Ptr(),
+		})
+	}
+
+	backend, moreDiags := decodeBackendPolicy(config.BackendTimeout, config.BackendIdleTimeout, config.BackendMaxConcurrency, config.BackendRetryAttempts, config.BackendRetryDelay)
+	diags = append(diags, moreDiags...)
+	ret.Backend = backend
+
+	return ret, diags
+}
+
+func decodeProviderRegistry(block *hcl.Block) (*ProviderRegistry, hcl.Diagnostics) {
+	ret := &ProviderRegistry{
+		Name:      block.Labels[0],
+		DeclRange: block.DefRange,
+	}
+
+	type Config struct {
+		OriginURL  gohcl.WithRange[string] `hcl:"origin_url"`
+		NamePrefix gohcl.WithRange[string] `hcl:"name_prefix"`
+
+		SigningKeyFile gohcl.WithRange[string] `hcl:"signing_key_file"`
+
+		CacheTTL      gohcl.WithRange[*string] `hcl:"cache_ttl,optional"`
+		CacheMaxStale gohcl.WithRange[*string] `hcl:"cache_max_stale,optional"`
+
+		BackendTimeout        gohcl.WithRange[*string] `hcl:"backend_timeout,optional"`
+		BackendIdleTimeout    gohcl.WithRange[*string] `hcl:"backend_idle_timeout,optional"`
+		BackendMaxConcurrency gohcl.WithRange[*int]    `hcl:"backend_max_concurrency,optional"`
+		BackendRetryAttempts  gohcl.WithRange[*int]    `hcl:"backend_retry_attempts,optional"`
+		BackendRetryDelay     gohcl.WithRange[*string] `hcl:"backend_retry_delay,optional"`
+	}
+	var config Config
+	diags := gohcl.DecodeBody(block.Body, nil, &config)
+	if diags.HasErrors() {
+		return ret, diags
+	}
+
+	originURL, moreDiags := decodeOriginURL(config.OriginURL.Value, config.OriginURL.Range, "OCI repository origin URL")
+	diags = append(diags, moreDiags...)
+	ret.OriginURL = originURL
+
+	namePrefix, err := ocidist.ParseNamespace(config.NamePrefix.Value)
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid OCI repository name prefix",
+			Detail:   fmt.Sprintf("Incorrect OCI distribution namespace syntax: %s.", err),
+			Subject:  config.NamePrefix.Range.Ptr(),
+		})
+	} else {
+		ret.NamePrefix = namePrefix
+	}
+
+	ttl, moreDiags := decodeDuration(config.CacheTTL, "cache TTL")
+	diags = append(diags, moreDiags...)
+	ret.CacheTTL = ttl
+	maxStale, moreDiags := decodeDuration(config.CacheMaxStale, "cache maximum staleness")
+	diags = append(diags, moreDiags...)
+	ret.CacheMaxStale = maxStale
+
+	backend, moreDiags := decodeBackendPolicy(config.BackendTimeout, config.BackendIdleTimeout, config.BackendMaxConcurrency, config.BackendRetryAttempts, config.BackendRetryDelay)
+	diags = append(diags, moreDiags...)
+	ret.Backend = backend
+
+	signingKey, moreDiags := decodeSigningKey(config.SigningKeyFile, block.DefRange.Filename)
+	diags = append(diags, moreDiags...)
+	ret.SigningKey = signingKey
+
+	return ret, diags
+}
+
+func decodeModuleRegistry(block *hcl.Block) (*ModuleRegistry, hcl.Diagnostics) {
+	ret := &ModuleRegistry{
+		Name:      block.Labels[0],
+		DeclRange: block.DefRange,
+	}
+
+	type Config struct {
+		OriginURL     gohcl.WithRange[string] `hcl:"origin_url"`
+		NamePrefix    gohcl.WithRange[string] `hcl:"name_prefix"`
+		ProxyPackages bool                    `hcl:"proxy_packages,optional"`
+
+		CacheTTL      gohcl.WithRange[*string] `hcl:"cache_ttl,optional"`
+		CacheMaxStale gohcl.WithRange[*string] `hcl:"cache_max_stale,optional"`
+
+		BackendTimeout        gohcl.WithRange[*string] `hcl:"backend_timeout,optional"`
+		BackendIdleTimeout    gohcl.WithRange[*string] `hcl:"backend_idle_timeout,optional"`
+		BackendMaxConcurrency gohcl.WithRange[*int]    `hcl:"backend_max_concurrency,optional"`
+		BackendRetryAttempts  gohcl.WithRange[*int]    `hcl:"backend_retry_attempts,optional"`
+		BackendRetryDelay     gohcl.WithRange[*string] `hcl:"backend_retry_delay,optional"`
+	}
+	var config Config
+	diags := gohcl.DecodeBody(block.Body, nil, &config)
+	if diags.HasErrors() {
+		return ret, diags
 	}
 
+	originURL, moreDiags := decodeOriginURL(config.OriginURL.Value, config.OriginURL.Range, "OCI repository origin URL")
+	diags = append(diags, moreDiags...)
+	ret.OriginURL = originURL
+
+	namePrefix, err := ocidist.ParseNamespace(config.NamePrefix.Value)
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid OCI repository name prefix",
+			Detail:   fmt.Sprintf("Incorrect OCI distribution namespace syntax: %s.", err),
+			Subject:  config.NamePrefix.Range.Ptr(),
+		})
+	} else {
+		ret.NamePrefix = namePrefix
+	}
 	ret.ProxyPackages = config.ProxyPackages
 
+	ttl, moreDiags := decodeDuration(config.CacheTTL, "cache TTL")
+	diags = append(diags, moreDiags...)
+	ret.CacheTTL = ttl
+	maxStale, moreDiags := decodeDuration(config.CacheMaxStale, "cache maximum staleness")
+	diags = append(diags, moreDiags...)
+	ret.CacheMaxStale = maxStale
+
+	backend, moreDiags := decodeBackendPolicy(config.BackendTimeout, config.BackendIdleTimeout, config.BackendMaxConcurrency, config.BackendRetryAttempts, config.BackendRetryDelay)
+	diags = append(diags, moreDiags...)
+	ret.Backend = backend
+
 	return ret, diags
 }
 
+// queryParamNameRe matches the query parameter names that may be given in
+// forward_query_params. These are the URL "unreserved" characters, so that
+// names never need escaping.
+var queryParamNameRe = regexp.MustCompile(`^[A-Za-z0-9._~-]+$`)
+
+// discoveryIDRe matches the service identifiers used in Terraform's service
+// discovery documents, like "providers.v1".
+var discoveryIDRe = regexp.MustCompile(`^[a-z][a-z0-9-]*\.v[0-9]+$`)
+
+// validProviderAddr returns true if the given string has the three
+// slash-separated parts of a provider address. It does not check whether
+// each part is otherwise valid, because an invalid part can only cause a
+// lookup that never matches.
+func validProviderAddr(addr string) bool {
+	parts := strings.Split(addr, "/")
+	return len(parts) == 3 && parts[0] != "" && parts[1] != "" && parts[2] != ""
+}
+
 func decodeServerConfig(block *hcl.Block) (*Server, hcl.Diagnostics) {
 	ret := &Server{
 		DeclRange: block.DefRange,
@@ -209,53 +1856,475 @@ func decodeServerConfig(block *hcl.Block) (*Server, hcl.Diagnostics) {
 	type TLSConfigHCL struct {
 		CertificateFile gohcl.WithRange[string] `hcl:"certificate_file"`
 		PrivateKeyFile  gohcl.WithRange[string] `hcl:"private_key_file"`
+
+		ExpiryWarningThreshold gohcl.WithRange[*string] `hcl:"expiry_warning_threshold,optional"`
+	}
+	type ErrorPageHCL struct {
+		Status   string                   `hcl:"status,label"`
+		HTML     gohcl.WithRange[*string] `hcl:"html,optional"`
+		HTMLFile gohcl.WithRange[*string] `hcl:"html_file,optional"`
+		JSON     gohcl.WithRange[*string] `hcl:"json,optional"`
+		JSONFile gohcl.WithRange[*string] `hcl:"json_file,optional"`
+
+		Body hcl.Body `hcl:",body"`
+	}
+	type AuditLogHCL struct {
+		File               string                `hcl:"file"`
+		MaxEventsPerSecond gohcl.WithRange[*int] `hcl:"max_events_per_second,optional"`
 	}
 	type Config struct {
 		ListenAddr        gohcl.WithRange[*string] `hcl:"listen_addr,optional"`
 		TLS               *TLSConfigHCL            `hcl:"tls,block"`
+		ErrorPages        []*ErrorPageHCL          `hcl:"error_page,block"`
+		AuditLog          *AuditLogHCL             `hcl:"audit_log,block"`
 		QueryStringSecret gohcl.WithRange[*string] `hcl:"query_string_secret,optional"`
+		QueryStringCipher gohcl.WithRange[*string] `hcl:"query_string_cipher,optional"`
+
+		DownloadTokenMaxLifetime gohcl.WithRange[*string] `hcl:"download_token_max_lifetime,optional"`
+		DownloadTokenGracePeriod gohcl.WithRange[*string] `hcl:"download_token_grace_period,optional"`
+		GzipResponses            bool                     `hcl:"gzip_responses,optional"`
+		CompressionLevel         gohcl.WithRange[*int]    `hcl:"compression_level,optional"`
+		ServerTiming             bool                     `hcl:"server_timing,optional"`
+		MetricsPath              gohcl.WithRange[*string] `hcl:"metrics_path,optional"`
+		DescriptionPath          gohcl.WithRange[*string] `hcl:"description_path,optional"`
+		CapabilitiesPath         gohcl.WithRange[*string] `hcl:"capabilities_path,optional"`
+		CapabilitiesTTL          gohcl.WithRange[*string] `hcl:"capabilities_ttl,optional"`
+		ReadinessPath            gohcl.WithRange[*string] `hcl:"readiness_path,optional"`
+
+		DiscoveryServices gohcl.WithRange[map[string]string] `hcl:"discovery_services,optional"`
+
+		MaxDownloadsPerClient  gohcl.WithRange[*int] `hcl:"max_downloads_per_client,optional"`
+		ClientIPv6PrefixLength gohcl.WithRange[*int] `hcl:"client_ipv6_prefix_length,optional"`
+		MaxServices            gohcl.WithRange[*int] `hcl:"max_services,optional"`
+
+		BackendBreakerThreshold gohcl.WithRange[*int]    `hcl:"backend_breaker_threshold,optional"`
+		BackendBreakerCooldown  gohcl.WithRange[*string] `hcl:"backend_breaker_cooldown,optional"`
+
+		BackendTimeout        gohcl.WithRange[*string] `hcl:"backend_timeout,optional"`
+		BackendIdleTimeout    gohcl.WithRange[*string] `hcl:"backend_idle_timeout,optional"`
+		BackendMaxConcurrency gohcl.WithRange[*int]    `hcl:"backend_max_concurrency,optional"`
+		BackendRetryAttempts  gohcl.WithRange[*int]    `hcl:"backend_retry_attempts,optional"`
+		BackendRetryDelay     gohcl.WithRange[*string] `hcl:"backend_retry_delay,optional"`
+
+		BackpressureThreshold gohcl.WithRange[*int]    `hcl:"backpressure_threshold,optional"`
+		BackpressureMaxDelay  gohcl.WithRange[*string] `hcl:"backpressure_max_delay,optional"`
+
+		DownloadTokenAlertThreshold gohcl.WithRange[*int]    `hcl:"download_token_alert_threshold,optional"`
+		DownloadTokenAlertWindow    gohcl.WithRange[*string] `hcl:"download_token_alert_window,optional"`
+		DownloadTokenAlertUnready   bool                     `hcl:"download_token_alert_unready,optional"`
+
+		ShutdownTimeout gohcl.WithRange[*string] `hcl:"shutdown_timeout,optional"`
+		ShutdownDelay   gohcl.WithRange[*string] `hcl:"shutdown_delay,optional"`
+
+		StartupProbeTimeout     gohcl.WithRange[*string] `hcl:"startup_probe_timeout,optional"`
+		StartupProbeConcurrency gohcl.WithRange[*int]    `hcl:"startup_probe_concurrency,optional"`
+
+		TrustedDigestAlgorithms gohcl.WithRange[*[]string] `hcl:"trusted_digest_algorithms,optional"`
+
+		ExternalURL gohcl.WithRange[*string] `hcl:"external_url,optional"`
+		LogFormat   gohcl.WithRange[*string] `hcl:"log_format,optional"`
+
+		LogServiceNames bool `hcl:"log_service_names,optional"`
+	}
+	var config Config
+	diags := gohcl.DecodeBody(block.Body, nil, &config)
+	if diags.HasErrors() {
+		return ret, diags
+	}
+
+	externalURL, moreDiags := decodeExternalURL(config.ExternalURL)
+	diags = append(diags, moreDiags...)
+	ret.ExternalURL = externalURL
+
+	ret.LogFormat = LogFormatText
+	if config.LogFormat.Value != nil {
+		switch format := LogFormat(*config.LogFormat.Value); format {
+		case LogFormatText, LogFormatCombined:
+			ret.LogFormat = format
+		default:
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid log format",
+				Detail:   fmt.Sprintf("The log format must be either %q or %q.", LogFormatText, LogFormatCombined),
+				Subject:  config.LogFormat.Range.Ptr(),
+			})
+		}
+	}
+	ret.LogServiceNames = config.LogServiceNames
+
+	ret.TrustedDigestAlgorithms = DefaultTrustedDigestAlgorithms
+	if config.TrustedDigestAlgorithms.Value != nil {
+		algos := *config.TrustedDigestAlgorithms.Value
+		if len(algos) == 0 {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid trusted digest algorithms",
+				Detail:   "At least one digest algorithm must be trusted.",
+				Subject:  config.TrustedDigestAlgorithms.Range.Ptr(),
+			})
+		}
+		for _, algo := range algos {
+			if !ocidist.SupportedDigestAlgorithm(algo) {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid trusted digest algorithms",
+					Detail:   fmt.Sprintf("%q is not a supported digest algorithm. The server can verify only \"sha256\" and \"sha512\" digests.", algo),
+					Subject:  config.TrustedDigestAlgorithms.Range.Ptr(),
+				})
+			}
+		}
+		ret.TrustedDigestAlgorithms = algos
+	}
+
+	if config.ListenAddr.Value != nil {
+		_, _, err := net.SplitHostPort(*config.ListenAddr.Value)
+		if err != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid listen address",
+				Detail:   "Listen address must be an IP address followed by a colon and then a port number.",
+				Subject:  config.ListenAddr.Range.Ptr(),
+			})
+		} else {
+			ret.ListenAddr = *config.ListenAddr.Value
+		}
+	}
+
+	ret.QueryStringCipher = DefaultQueryStringCipher
+	if config.QueryStringCipher.Value != nil {
+		cipher := querysecret.Cipher(*config.QueryStringCipher.Value)
+		if cipher.KeySize() == 0 {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid query string cipher",
+				Detail:   fmt.Sprintf("The query string cipher must be either %q or %q.", querysecret.CipherSecretbox, querysecret.CipherAES256GCM),
+				Subject:  config.QueryStringCipher.Range.Ptr(),
+			})
+		} else {
+			ret.QueryStringCipher = cipher
+		}
+	}
+
+	key, moreDiags := decodeQueryStringSecret(config.QueryStringSecret, ret.QueryStringCipher)
+	diags = append(diags, moreDiags...)
+	ret.QueryStringSecret = key
+
+	maxLifetime, moreDiags := decodeDuration(config.DownloadTokenMaxLifetime, "download token maximum lifetime")
+	diags = append(diags, moreDiags...)
+	if config.DownloadTokenMaxLifetime.Value != nil && !moreDiags.HasErrors() && maxLifetime < querysecret.Lifetime {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid download token maximum lifetime",
+			Detail:   fmt.Sprintf("The maximum lifetime must be at least %s, which is how long the server makes each download token valid for.", querysecret.Lifetime),
+			Subject:  config.DownloadTokenMaxLifetime.Range.Ptr(),
+		})
+	} else {
+		ret.DownloadTokenMaxLifetime = maxLifetime
+	}
+
+	gracePeriod, moreDiags := decodeDuration(config.DownloadTokenGracePeriod, "download token grace period")
+	diags = append(diags, moreDiags...)
+	ret.DownloadTokenGracePeriod = gracePeriod
+
+	ret.GzipResponses = config.GzipResponses
+	ret.CompressionLevel = DefaultCompressionLevel
+	if config.CompressionLevel.Value != nil {
+		level := *config.CompressionLevel.Value
+		if level < gzip.BestSpeed || level > gzip.BestCompression {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid compression level",
+				Detail:   fmt.Sprintf("The compression level must be between %d, for the fastest compression, and %d, for the smallest responses.", gzip.BestSpeed, gzip.BestCompression),
+				Subject:  config.CompressionLevel.Range.Ptr(),
+			})
+		} else {
+			ret.CompressionLevel = level
+		}
+	}
+	ret.ServerTiming = config.ServerTiming
+
+	if config.MetricsPath.Value != nil {
+		if path := *config.MetricsPath.Value; !strings.HasPrefix(path, "/") {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid metrics path",
+				Detail:   "The metrics path must be an absolute URL path, starting with a slash '/'.",
+				Subject:  config.MetricsPath.Range.Ptr(),
+			})
+		} else {
+			ret.MetricsPath = path
+		}
+	}
+
+	if config.DescriptionPath.Value != nil {
+		if path := *config.DescriptionPath.Value; !strings.HasPrefix(path, "/") {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid description path",
+				Detail:   "The description path must be an absolute URL path, starting with a slash '/'.",
+				Subject:  config.DescriptionPath.Range.Ptr(),
+			})
+		} else {
+			ret.DescriptionPath = path
+		}
+	}
+
+	if config.CapabilitiesPath.Value != nil {
+		if path := *config.CapabilitiesPath.Value; !strings.HasPrefix(path, "/") {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid capabilities path",
+				Detail:   "The capabilities path must be an absolute URL path, starting with a slash '/'.",
+				Subject:  config.CapabilitiesPath.Range.Ptr(),
+			})
+		} else {
+			ret.CapabilitiesPath = path
+		}
+	}
+	if config.ReadinessPath.Value != nil {
+		if path := *config.ReadinessPath.Value; !strings.HasPrefix(path, "/") {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid readiness path",
+				Detail:   "The readiness path must be an absolute URL path, starting with a slash '/'.",
+				Subject:  config.ReadinessPath.Range.Ptr(),
+			})
+		} else {
+			ret.ReadinessPath = path
+		}
+	}
+
+	capabilitiesTTL, moreDiags := decodeDuration(config.CapabilitiesTTL, "capabilities TTL")
+	diags = append(diags, moreDiags...)
+	ret.CapabilitiesTTL = capabilitiesTTL
+	if config.CapabilitiesTTL.Value == nil {
+		ret.CapabilitiesTTL = defaultCapabilitiesTTL
+	}
+
+	for id, rawURL := range config.DiscoveryServices.Value {
+		if !discoveryIDRe.MatchString(id) {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid discovery service ID",
+				Detail:   fmt.Sprintf("%q is not a valid service identifier. Identifiers are a lowercase name and a version number separated by a period, like \"providers.v1\".", id),
+				Subject:  config.DiscoveryServices.Range.Ptr(),
+			})
+			continue
+		}
+		if _, err := url.Parse(rawURL); err != nil || rawURL == "" {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid discovery service URL",
+				Detail:   fmt.Sprintf("The URL for %q must be an absolute URL or a path relative to the discovery document.", id),
+				Subject:  config.DiscoveryServices.Range.Ptr(),
+			})
+			continue
+		}
+		if ret.DiscoveryServices == nil {
+			ret.DiscoveryServices = make(map[string]string)
+		}
+		ret.DiscoveryServices[id] = rawURL
+	}
+
+	if config.MaxDownloadsPerClient.Value != nil {
+		if limit := *config.MaxDownloadsPerClient.Value; limit < 1 {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid download limit",
+				Detail:   "The maximum number of concurrent downloads per client must be at least one. Omit this argument to allow unlimited concurrent downloads.",
+				Subject:  config.MaxDownloadsPerClient.Range.Ptr(),
+			})
+		} else {
+			ret.MaxDownloadsPerClient = limit
+		}
+	}
+	if config.ClientIPv6PrefixLength.Value != nil {
+		if length := *config.ClientIPv6PrefixLength.Value; length < 1 || length > 128 {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid client IPv6 prefix length",
+				Detail:   "The IPv6 prefix length must be between 1 and 128. Omit this argument to identify each IPv6 client by its full address.",
+				Subject:  config.ClientIPv6PrefixLength.Range.Ptr(),
+			})
+		} else {
+			ret.ClientIPv6PrefixLength = length
+		}
+	}
+
+	if config.MaxServices.Value != nil {
+		if limit := *config.MaxServices.Value; limit < 1 {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid service limit",
+				Detail:   "The maximum number of services must be at least one. Omit this argument to allow any number of services.",
+				Subject:  config.MaxServices.Range.Ptr(),
+			})
+		} else {
+			ret.MaxServices = limit
+		}
+	}
+
+	if config.AuditLog != nil {
+		auditLog := &AuditLog{
+			Filename:           config.AuditLog.File,
+			MaxEventsPerSecond: defaultAuditLogMaxEventsPerSecond,
+		}
+		if !filepath.IsAbs(auditLog.Filename) {
+			auditLog.Filename = filepath.Join(filepath.Dir(block.DefRange.Filename), auditLog.Filename)
+		}
+		if raw := config.AuditLog.MaxEventsPerSecond; raw.Value != nil {
+			if limit := *raw.Value; limit < 0 {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid audit log rate limit",
+					Detail:   "The maximum number of audit events per second must not be negative. Set it to zero to write all events however frequent they are.",
+					Subject:  raw.Range.Ptr(),
+				})
+			} else {
+				auditLog.MaxEventsPerSecond = limit
+			}
+		}
+		ret.AuditLog = auditLog
+	}
+
+	backend, moreDiags := decodeBackendPolicy(config.BackendTimeout, config.BackendIdleTimeout, config.BackendMaxConcurrency, config.BackendRetryAttempts, config.BackendRetryDelay)
+	diags = append(diags, moreDiags...)
+	ret.Backend = backend
+
+	if config.BackendBreakerThreshold.Value != nil {
+		if threshold := *config.BackendBreakerThreshold.Value; threshold < 1 {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid circuit breaker threshold",
+				Detail:   "The circuit breaker threshold must be at least one. Omit this argument to disable the circuit breaker.",
+				Subject:  config.BackendBreakerThreshold.Range.Ptr(),
+			})
+		} else {
+			ret.BreakerThreshold = threshold
+		}
+	}
+	cooldown, moreDiags := decodeDuration(config.BackendBreakerCooldown, "circuit breaker cooldown")
+	diags = append(diags, moreDiags...)
+	ret.BreakerCooldown = cooldown
+	if ret.BreakerCooldown == 0 {
+		ret.BreakerCooldown = defaultBreakerCooldown
+	}
+
+	if config.BackpressureThreshold.Value != nil {
+		if threshold := *config.BackpressureThreshold.Value; threshold < 1 {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid backpressure threshold",
+				Detail:   "The backpressure threshold must be at least one. Omit this argument to never delay requests.",
+				Subject:  config.BackpressureThreshold.Range.Ptr(),
+			})
+		} else {
+			ret.BackpressureThreshold = threshold
+		}
+	}
+	maxDelay, moreDiags := decodeDuration(config.BackpressureMaxDelay, "maximum backpressure delay")
+	diags = append(diags, moreDiags...)
+	ret.BackpressureMaxDelay = maxDelay
+	if ret.BackpressureMaxDelay == 0 {
+		ret.BackpressureMaxDelay = defaultBackpressureMaxDelay
+	}
+
+	if config.DownloadTokenAlertThreshold.Value != nil {
+		if threshold := *config.DownloadTokenAlertThreshold.Value; threshold < 1 {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid download token alert threshold",
+				Detail:   "The download token alert threshold must be at least one. Omit this argument to disable download token alerts.",
+				Subject:  config.DownloadTokenAlertThreshold.Range.Ptr(),
+			})
+		} else {
+			ret.TokenAlertThreshold = threshold
+		}
 	}
-	var config Config
-	diags := gohcl.DecodeBody(block.Body, nil, &config)
-	if diags.HasErrors() {
-		return ret, diags
+	alertWindow, moreDiags := decodeDuration(config.DownloadTokenAlertWindow, "download token alert window")
+	diags = append(diags, moreDiags...)
+	ret.TokenAlertWindow = alertWindow
+	if ret.TokenAlertWindow == 0 {
+		ret.TokenAlertWindow = defaultTokenAlertWindow
 	}
+	ret.TokenAlertUnready = config.DownloadTokenAlertUnready
 
-	if config.ListenAddr.Value != nil {
-		_, _, err := net.SplitHostPort(*config.ListenAddr.Value)
-		if err != nil {
+	shutdownTimeout, moreDiags := decodeDuration(config.ShutdownTimeout, "shutdown timeout")
+	diags = append(diags, moreDiags...)
+	ret.ShutdownTimeout = shutdownTimeout
+	if ret.ShutdownTimeout == 0 {
+		ret.ShutdownTimeout = defaultShutdownTimeout
+	}
+	shutdownDelay, moreDiags := decodeDuration(config.ShutdownDelay, "shutdown delay")
+	diags = append(diags, moreDiags...)
+	ret.ShutdownDelay = shutdownDelay
+
+	startupProbeTimeout, moreDiags := decodeDuration(config.StartupProbeTimeout, "startup probe timeout")
+	diags = append(diags, moreDiags...)
+	ret.StartupProbeTimeout = startupProbeTimeout
+	ret.StartupProbeConcurrency = DefaultStartupProbeConcurrency
+	if config.StartupProbeConcurrency.Value != nil {
+		if limit := *config.StartupProbeConcurrency.Value; limit < 1 {
 			diags = diags.Append(&hcl.Diagnostic{
 				Severity: hcl.DiagError,
-				Summary:  "Invalid listen address",
-				Detail:   "Listen address must be an IP address followed by a colon and then a port number.",
-				Subject:  config.ListenAddr.Range.Ptr(),
+				Summary:  "Invalid startup probe concurrency",
+				Detail:   "The number of startup probes to run at once must be at least one.",
+				Subject:  config.StartupProbeConcurrency.Range.Ptr(),
 			})
 		} else {
-			ret.ListenAddr = *config.ListenAddr.Value
+			ret.StartupProbeConcurrency = limit
 		}
 	}
 
-	if config.QueryStringSecret.Value != nil {
-		inHex := *config.QueryStringSecret.Value
-		if len(inHex) != 64 {
+	for _, pageConfig := range config.ErrorPages {
+		status, err := strconv.Atoi(pageConfig.Status)
+		if err != nil || status < 400 || status > 599 {
 			diags = diags.Append(&hcl.Diagnostic{
 				Severity: hcl.DiagError,
-				Summary:  "Invalid query string secret",
-				Detail:   "Must be exactly 64 hexadecimal digits, representing a 256-bit secret key.",
-				Subject:  config.QueryStringSecret.Range.Ptr(),
+				Summary:  "Invalid error page status code",
+				Detail:   fmt.Sprintf("The error_page block label must be an HTTP error status code between 400 and 599, not %q.", pageConfig.Status),
+				Subject:  pageConfig.Body.MissingItemRange().Ptr(),
 			})
-		} else if raw, err := hex.DecodeString(inHex); err != nil {
+			continue
+		}
+		if _, exists := ret.ErrorPages[status]; exists {
 			diags = diags.Append(&hcl.Diagnostic{
 				Severity: hcl.DiagError,
-				Summary:  "Invalid query string secret",
-				Detail:   fmt.Sprintf("Must be exactly 64 hexadecimal digits, representing a 256-bit secret key: %s.", err),
-				Subject:  config.QueryStringSecret.Range.Ptr(),
+				Summary:  "Duplicate error page",
+				Detail:   fmt.Sprintf("There is already an error_page block for status code %d.", status),
+				Subject:  pageConfig.Body.MissingItemRange().Ptr(),
 			})
-		} else {
-			var key [32]byte
-			copy(key[:], raw)
-			ret.QueryStringSecret = &key
+			continue
+		}
+		var pageDiags hcl.Diagnostics
+		htmlContent, moreDiags := decodeErrorPageContent(pageConfig.HTML, pageConfig.HTMLFile, "html", block.DefRange.Filename)
+		pageDiags = append(pageDiags, moreDiags...)
+		jsonContent, moreDiags := decodeErrorPageContent(pageConfig.JSON, pageConfig.JSONFile, "json", block.DefRange.Filename)
+		pageDiags = append(pageDiags, moreDiags...)
+		if jsonContent != nil && !json.Valid(jsonContent) {
+			pageDiags = pageDiags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid error page JSON",
+				Detail:   fmt.Sprintf("The JSON content for the status %d error page is not valid JSON.", status),
+				Subject:  pageConfig.Body.MissingItemRange().Ptr(),
+			})
+		}
+		if htmlContent == nil && jsonContent == nil && !pageDiags.HasErrors() {
+			pageDiags = pageDiags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Empty error page",
+				Detail:   fmt.Sprintf("The error_page block for status code %d must set at least one of html, html_file, json, or json_file.", status),
+				Subject:  pageConfig.Body.MissingItemRange().Ptr(),
+			})
+		}
+		diags = append(diags, pageDiags...)
+		if pageDiags.HasErrors() {
+			continue
 		}
+		if ret.ErrorPages == nil {
+			ret.ErrorPages = make(map[int]*ErrorPage)
+		}
+		ret.ErrorPages[status] = &ErrorPage{HTML: htmlContent, JSON: jsonContent}
 	}
 
 	if config.TLS != nil {
@@ -276,12 +2345,32 @@ func decodeServerConfig(block *hcl.Block) (*Server, hcl.Diagnostics) {
 			tlsDiags = tlsDiags[:0]
 			cert, err := tls.LoadX509KeyPair(certFilename, keyFilename)
 			if err != nil {
-				tlsDiags = tlsDiags.Append(&hcl.Diagnostic{
-					Severity: hcl.DiagError,
-					Summary:  "Failed to parse TLS keypair",
-					Detail:   fmt.Sprintf("Cannot build a valid TLS configuration from the specified certificate and private key: %s.", err),
-					Subject:  config.TLS.CertificateFile.Range.Ptr(),
-				})
+				if privateKeyMismatch(certFilename, keyFilename) {
+					// The standard library reports this as an opaque error,
+					// but it's a common enough mistake to deserve a more
+					// specific message.
+					tlsDiags = tlsDiags.Append(&hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "TLS private key does not match certificate",
+						Detail:   fmt.Sprintf("The private key in %s does not belong to the leaf certificate in %s.", keyFilename, certFilename),
+						Subject:  config.TLS.PrivateKeyFile.Range.Ptr(),
+					})
+				} else {
+					tlsDiags = tlsDiags.Append(&hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Failed to parse TLS keypair",
+						Detail:   fmt.Sprintf("Cannot build a valid TLS configuration from the specified certificate and private key: %s.", err),
+						Subject:  config.TLS.CertificateFile.Range.Ptr(),
+					})
+				}
+			} else {
+				threshold := defaultCertExpiryWarningThreshold
+				if config.TLS.ExpiryWarningThreshold.Value != nil {
+					var moreDiags hcl.Diagnostics
+					threshold, moreDiags = decodeDuration(config.TLS.ExpiryWarningThreshold, "certificate expiry warning threshold")
+					tlsDiags = append(tlsDiags, moreDiags...)
+				}
+				tlsDiags = append(tlsDiags, certificateExpiryDiagnostics(cert, time.Now(), threshold, config.TLS.CertificateFile.Range.Ptr())...)
 			}
 			diags = append(diags, tlsDiags...)
 			if !tlsDiags.HasErrors() {
@@ -295,9 +2384,602 @@ func decodeServerConfig(block *hcl.Block) (*Server, hcl.Diagnostics) {
 	return ret, diags
 }
 
+// defaultBreakerCooldown is the circuit breaker cooldown period used if the
+// configuration doesn't specify one.
+const defaultBreakerCooldown = 30 * time.Second
+
+// defaultBackpressureMaxDelay is the longest delay the server will add to a
+// request under load if the configuration doesn't specify one.
+const defaultBackpressureMaxDelay = 1 * time.Second
+
+// defaultTokenAlertWindow is the period over which rejected download tokens
+// are counted if the configuration doesn't specify one.
+const defaultTokenAlertWindow = time.Minute
+
+// defaultAuditLogMaxEventsPerSecond is the audit log's rate limit if the
+// configuration doesn't specify one, which is high enough to record any
+// plausible legitimate activity while preventing a flood of failures from
+// filling the log's destination.
+const defaultAuditLogMaxEventsPerSecond = 100
+
+// defaultCapabilitiesTTL is how long the server reuses the result of probing
+// an origin registry's capabilities if the configuration doesn't specify
+// otherwise.
+const defaultCapabilitiesTTL = 10 * time.Minute
+
+// defaultShutdownTimeout is how long the server waits for in-progress
+// requests to complete when shutting down if the configuration doesn't
+// specify otherwise.
+const defaultShutdownTimeout = 10 * time.Second
+
+// DefaultPackageMediaTypes are the package layer media types offered by a
+// provider mirror if the configuration doesn't specify
+// package_media_types, which is just Terraform's standard zip archive
+// format.
+var DefaultPackageMediaTypes = []string{"application/vnd.hashicorp.terraform.provider-package+zip"}
+
+// DefaultHashSchemes are the package hash schemes offered by a provider
+// mirror if the configuration doesn't specify hash_schemes, which is just
+// the "zh" scheme that a package's own sha256 digest can provide.
+var DefaultHashSchemes = []string{"zh"}
+
+// DefaultPackageResponseHeaders are the headers from the origin registry's
+// responses to package downloads that are relayed to clients if the
+// configuration doesn't specify package_response_headers.
+var DefaultPackageResponseHeaders = []string{"Content-Type", "Content-Length", "Content-Range"}
+
+// DefaultTrustedDigestAlgorithms are the digest algorithms the server trusts
+// if the configuration doesn't specify trusted_digest_algorithms.
+var DefaultTrustedDigestAlgorithms = []string{"sha256", "sha512"}
+
+// DefaultBackendTLSSessionCacheSize is the number of TLS sessions a provider
+// mirror remembers for resumption if the configuration doesn't specify
+// backend_tls_session_cache_size.
+const DefaultBackendTLSSessionCacheSize = 64
+
+// DefaultMaxPlatforms is the largest number of platforms a provider mirror
+// offers packages for in a single version if the configuration doesn't
+// specify max_platforms. This is several times the number of platforms that
+// Terraform itself supports.
+const DefaultMaxPlatforms = 128
+
+// DefaultCompressionLevel is the gzip compression level used for responses
+// if the configuration doesn't specify compression_level. This is the same
+// level that the gzip package uses by default.
+const DefaultCompressionLevel = 6
+
+// DefaultStartupProbeConcurrency is the number of origin registries the
+// server checks at once during startup if the configuration doesn't specify
+// startup_probe_concurrency.
+const DefaultStartupProbeConcurrency = 4
+
+// maxMaxPlatforms is the upper limit for max_platforms, which is here only
+// to catch obviously-incorrect values.
+const maxMaxPlatforms = 65536
+
+// maxBackendTLSSessionCacheSize is the upper limit for
+// backend_tls_session_cache_size, which is here only to catch
+// obviously-incorrect values.
+const maxBackendTLSSessionCacheSize = 65536
+
+// maxBackendConcurrency is the upper limit for backend_max_concurrency, which
+// is here only to catch obviously-incorrect values.
+const maxBackendConcurrency = 1024
+
+// maxBackendRetryAttempts is the upper limit for backend_retry_attempts,
+// which is here only to catch obviously-incorrect values.
+const maxBackendRetryAttempts = 10
+
+// decodeBackendPolicy decodes the arguments that make up a [BackendPolicy],
+// which can appear both in the server block and in service blocks.
+//
+// Arguments that aren't set are left as zero in the result, which is never
+// a valid explicit value for any of them.
+func decodeBackendPolicy(timeout, idleTimeout gohcl.WithRange[*string], maxConcurrency, retryAttempts gohcl.WithRange[*int], retryDelay gohcl.WithRange[*string]) (BackendPolicy, hcl.Diagnostics) {
+	var ret BackendPolicy
+	var diags hcl.Diagnostics
+
+	if timeout.Value != nil {
+		d, moreDiags := decodeDuration(timeout, "backend timeout")
+		diags = append(diags, moreDiags...)
+		if !moreDiags.HasErrors() && d == 0 {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid backend timeout",
+				Detail:   "The backend timeout must be a positive duration. Omit this argument to use the default.",
+				Subject:  timeout.Range.Ptr(),
+			})
+		}
+		ret.Timeout = d
+	}
+
+	if idleTimeout.Value != nil {
+		d, moreDiags := decodeDuration(idleTimeout, "backend idle timeout")
+		diags = append(diags, moreDiags...)
+		if !moreDiags.HasErrors() && d == 0 {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid backend idle timeout",
+				Detail:   "The backend idle timeout must be a positive duration. Omit this argument to use the default.",
+				Subject:  idleTimeout.Range.Ptr(),
+			})
+		}
+		ret.IdleTimeout = d
+	}
+
+	if maxConcurrency.Value != nil {
+		n := *maxConcurrency.Value
+		if n < 1 || n > maxBackendConcurrency {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid backend concurrency limit",
+				Detail:   fmt.Sprintf("The maximum number of concurrent backend requests must be between 1 and %d.", maxBackendConcurrency),
+				Subject:  maxConcurrency.Range.Ptr(),
+			})
+		} else {
+			ret.MaxConcurrency = n
+		}
+	}
+
+	if retryAttempts.Value != nil {
+		n := *retryAttempts.Value
+		if n < 1 || n > maxBackendRetryAttempts {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid backend retry attempts",
+				Detail:   fmt.Sprintf("The maximum number of attempts for each backend request must be between 1 and %d, where 1 disables retries.", maxBackendRetryAttempts),
+				Subject:  retryAttempts.Range.Ptr(),
+			})
+		} else {
+			ret.RetryAttempts = n
+		}
+	}
+
+	if retryDelay.Value != nil {
+		d, moreDiags := decodeDuration(retryDelay, "backend retry delay")
+		diags = append(diags, moreDiags...)
+		if !moreDiags.HasErrors() && d == 0 {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid backend retry delay",
+				Detail:   "The backend retry delay must be a positive duration. Omit this argument to use the default.",
+				Subject:  retryDelay.Range.Ptr(),
+			})
+		}
+		ret.RetryDelay = d
+	}
+
+	return ret, diags
+}
+
+// privateKeyMismatch returns true if the given PEM files contain a valid
+// certificate and a valid private key that doesn't belong to it. It returns
+// false if either can't be parsed, so that the caller can report the error
+// from [tls.LoadX509KeyPair] instead.
+func privateKeyMismatch(certFilename, keyFilename string) bool {
+	certPEM, err := os.ReadFile(certFilename)
+	if err != nil {
+		return false
+	}
+	keyPEM, err := os.ReadFile(keyFilename)
+	if err != nil {
+		return false
+	}
+	var leaf *x509.Certificate
+	for block, rest := pem.Decode(certPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			leaf, err = x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return false
+			}
+			break
+		}
+	}
+	var key crypto.Signer
+	for block, rest := pem.Decode(keyPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "PRIVATE KEY" || strings.HasSuffix(block.Type, " PRIVATE KEY") {
+			key = parsePrivateKey(block.Bytes)
+			break
+		}
+	}
+	if leaf == nil || key == nil {
+		return false
+	}
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	return ok && !pub.Equal(leaf.PublicKey)
+}
+
+// parsePrivateKey parses a DER-encoded private key in any of the encodings
+// that [tls.X509KeyPair] accepts, returning nil if it isn't valid.
+func parsePrivateKey(der []byte) crypto.Signer {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer
+		}
+		return nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key
+	}
+	return nil
+}
+
+// defaultCertExpiryWarningThreshold is how long before a TLS certificate
+// expires that we start warning about it, if not overridden in the
+// configuration.
+const defaultCertExpiryWarningThreshold = 30 * 24 * time.Hour
+
+// certificateExpiryDiagnostics returns a warning if the leaf certificate of
+// the given keypair has already expired at the given time, or will expire
+// within the given threshold.
+func certificateExpiryDiagnostics(cert tls.Certificate, now time.Time, threshold time.Duration, subject *hcl.Range) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	if len(cert.Certificate) == 0 {
+		return diags
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		// Should not get here because tls.LoadX509KeyPair already parsed
+		// the certificate successfully.
+		return diags
+	}
+
+	switch {
+	case now.After(leaf.NotAfter):
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "TLS certificate has expired",
+			Detail:   fmt.Sprintf("The TLS certificate for %q expired at %s, so clients will reject it.", leaf.Subject.CommonName, leaf.NotAfter.UTC().Format(time.RFC3339)),
+			Subject:  subject,
+		})
+	case now.Add(threshold).After(leaf.NotAfter):
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "TLS certificate expires soon",
+			Detail:   fmt.Sprintf("The TLS certificate for %q will expire at %s. Replace it before then to avoid clients rejecting it.", leaf.Subject.CommonName, leaf.NotAfter.UTC().Format(time.RFC3339)),
+			Subject:  subject,
+		})
+	}
+	return diags
+}
+
+// decodeIPNetworks parses a list of networks in CIDR notation, such as
+// "169.254.0.0/16", also accepting a bare IP address as a network containing
+// only that address.
+func decodeIPNetworks(raw gohcl.WithRange[[]string]) ([]*net.IPNet, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	var ret []*net.IPNet
+	for _, s := range raw.Value {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = 8 * net.IPv4len
+			}
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid IP network",
+				Detail:   fmt.Sprintf("%q is neither an IP address nor a network in CIDR notation, like \"169.254.0.0/16\".", s),
+				Subject:  raw.Range.Ptr(),
+			})
+			continue
+		}
+		ret = append(ret, network)
+	}
+	return ret, diags
+}
+
+// decodeOriginURL parses and validates the URL of an OCI distribution
+// registry, returning nil if it's invalid.
+func decodeOriginURL(raw string, rng hcl.Range, what string) (*url.URL, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	u, err := url.Parse(raw)
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  fmt.Sprintf("Invalid %s", what),
+			Detail:   fmt.Sprintf("Invalid URL syntax: %s.", err),
+			Subject:  rng.Ptr(),
+		})
+		return nil, diags
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  fmt.Sprintf("Invalid %s", what),
+			Detail:   "OCI registry URL must use either the 'https' or 'http' scheme.",
+			Subject:  rng.Ptr(),
+		})
+		return nil, diags
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  fmt.Sprintf("Invalid %s", what),
+			Detail:   "OCI registry URL have a path ending with a slash '/'.",
+			Subject:  rng.Ptr(),
+		})
+		return nil, diags
+	}
+	return u, diags
+}
+
+// decodeExternalURL decodes an optional external URL argument, returning nil
+// if the argument isn't set.
+//
+// The result always has a path ending with a slash, so that it's ready to
+// use as a base URL.
+func decodeExternalURL(raw gohcl.WithRange[*string]) (*url.URL, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	if raw.Value == nil {
+		return nil, diags
+	}
+	u, err := url.Parse(*raw.Value)
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid external URL",
+			Detail:   fmt.Sprintf("Invalid URL syntax: %s.", err),
+			Subject:  raw.Range.Ptr(),
+		})
+		return nil, diags
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid external URL",
+			Detail:   "The external URL must be an absolute URL using either the 'https' or 'http' scheme.",
+			Subject:  raw.Range.Ptr(),
+		})
+		return nil, diags
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid external URL",
+			Detail:   "The external URL must not include a query string or fragment.",
+			Subject:  raw.Range.Ptr(),
+		})
+		return nil, diags
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+		u.RawPath = ""
+	}
+	return u, diags
+}
+
+// decodeErrorPageContent returns the content for one format of an error
+// page, given either inline or as the name of a file relative to the
+// directory containing configFilename. The result is nil if neither is set.
+func decodeErrorPageContent(inline, file gohcl.WithRange[*string], format string, configFilename string) ([]byte, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	switch {
+	case inline.Value != nil && file.Value != nil:
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting error page content",
+			Detail:   fmt.Sprintf("Only one of %s and %s_file may be set.", format, format),
+			Subject:  file.Range.Ptr(),
+		})
+		return nil, diags
+	case inline.Value != nil:
+		return []byte(*inline.Value), diags
+	case file.Value != nil:
+		filename := *file.Value
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(filepath.Dir(configFilename), filename)
+		}
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Cannot read error page file",
+				Detail:   fmt.Sprintf("Failed to read %s: %s.", filename, err),
+				Subject:  file.Range.Ptr(),
+			})
+			return nil, diags
+		}
+		return content, diags
+	default:
+		return nil, diags
+	}
+}
+
+// decodeSigningKey reads an ASCII-armored OpenPGP private key from the named
+// file, relative to the directory containing configFilename. The file must
+// contain exactly one key, which must not be protected by a passphrase
+// because the server has no way to prompt for one.
+func decodeSigningKey(file gohcl.WithRange[string], configFilename string) (*openpgp.Entity, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	filename := file.Value
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(filepath.Dir(configFilename), filename)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Cannot read signing key file",
+			Detail:   fmt.Sprintf("Failed to read %s: %s.", filename, err),
+			Subject:  file.Range.Ptr(),
+		})
+		return nil, diags
+	}
+	defer f.Close()
+	entities, err := openpgp.ReadArmoredKeyRing(f)
+	var problem string
+	switch {
+	case err != nil:
+		problem = fmt.Sprintf("The file %s doesn't contain an ASCII-armored OpenPGP key: %s.", filename, err)
+	case len(entities) != 1:
+		problem = fmt.Sprintf("The file %s must contain exactly one OpenPGP key, but it contains %d.", filename, len(entities))
+	case entities[0].PrivateKey == nil:
+		problem = fmt.Sprintf("The file %s contains only a public key, but signing requires the private key.", filename)
+	case entities[0].PrivateKey.Encrypted:
+		problem = fmt.Sprintf("The private key in %s is protected by a passphrase, which the server can't provide.", filename)
+	}
+	if problem != "" {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid signing key",
+			Detail:   problem,
+			Subject:  file.Range.Ptr(),
+		})
+		return nil, diags
+	}
+	return entities[0], diags
+}
+
+// DefaultQueryStringCipher is the cipher used to protect the secrets in
+// package download URLs if query_string_cipher isn't set.
+const DefaultQueryStringCipher = querysecret.CipherSecretbox
+
+// decodeQueryStringSecret decodes a query string secret key for the given
+// cipher, written as hexadecimal digits, returning nil if the key isn't set
+// or is invalid.
+func decodeQueryStringSecret(raw gohcl.WithRange[*string], cipher querysecret.Cipher) ([]byte, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	if raw.Value == nil {
+		return nil, diags
+	}
+	size := cipher.KeySize()
+	inHex := *raw.Value
+	if len(inHex) != size*2 {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid query string secret",
+			Detail:   fmt.Sprintf("The %s cipher requires a %d-byte (%d-bit) secret key, written as exactly %d hexadecimal digits, but this value has %d characters.", cipher, size, size*8, size*2, len(inHex)),
+			Subject:  raw.Range.Ptr(),
+		})
+		return nil, diags
+	}
+	key, err := hex.DecodeString(inHex)
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid query string secret",
+			Detail:   fmt.Sprintf("The %s cipher requires a %d-byte (%d-bit) secret key, written as exactly %d hexadecimal digits: %s.", cipher, size, size*8, size*2, err),
+			Subject:  raw.Range.Ptr(),
+		})
+		return nil, diags
+	}
+	return key, diags
+}
+
+// defaultAddressLayout is the address layout that a provider mirror uses if
+// the configuration doesn't specify address_layout, with each part of the
+// provider address as its own namespace part.
+var defaultAddressLayout = []string{"{hostname}", "{namespace}", "{type}"}
+
+// addressLayoutPlaceholderRe matches the placeholders in an address layout.
+var addressLayoutPlaceholderRe = regexp.MustCompile(`\{[^{}]*\}`)
+
+// decodeAddressLayout parses an address_layout argument into one template
+// per namespace part, returning nil if the argument isn't set.
+func decodeAddressLayout(raw gohcl.WithRange[*string]) ([]string, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	if raw.Value == nil {
+		return nil, diags
+	}
+	invalid := func(detail string) hcl.Diagnostics {
+		return diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid address layout",
+			Detail:   detail,
+			Subject:  raw.Range.Ptr(),
+		})
+	}
+	layout := strings.Split(*raw.Value, "/")
+	used := make(map[string]bool)
+	for _, part := range layout {
+		for _, placeholder := range addressLayoutPlaceholderRe.FindAllString(part, -1) {
+			switch placeholder {
+			case "{hostname}", "{namespace}", "{type}":
+				used[placeholder] = true
+			default:
+				return nil, invalid(fmt.Sprintf("Unsupported placeholder %s. The address layout may refer only to {hostname}, {namespace}, and {type}.", placeholder))
+			}
+		}
+		// Provider namespaces and types can contain dashes, and hostnames
+		// can also contain periods, so joining placeholders with those
+		// would allow two different addresses to produce the same
+		// namespace. The server rejects addresses with underscores when
+		// the layout joins placeholders, so underscores are unambiguous.
+		locs := addressLayoutPlaceholderRe.FindAllStringIndex(part, -1)
+		for i := 1; i < len(locs); i++ {
+			if sep := part[locs[i-1][1]:locs[i][0]]; !strings.Contains(sep, "_") {
+				return nil, invalid(fmt.Sprintf("Namespace part %q joins placeholders with %q. Placeholders in the same namespace part must be separated by an underscore, such as {namespace}_{type}, because provider addresses can't contain underscores but can contain dashes and periods.", part, sep))
+			}
+		}
+		// Provider address parts are always valid namespace part syntax
+		// themselves, so we can check the rest of the template by
+		// substituting any valid part for each placeholder.
+		sample := addressLayoutPlaceholderRe.ReplaceAllString(part, "x")
+		if _, err := ocidist.ParseNamespacePart(sample); err != nil {
+			return nil, invalid(fmt.Sprintf("Namespace part %q is invalid: %s.", part, err))
+		}
+	}
+	if !used["{hostname}"] || !used["{namespace}"] || !used["{type}"] {
+		return nil, invalid("The address layout must include {hostname}, {namespace}, and {type}, so that each provider has its own namespace.")
+	}
+	return layout, diags
+}
+
+// layoutOrDefault returns the given address layout, or the default layout
+// if it's nil.
+func layoutOrDefault(layout []string) []string {
+	if layout == nil {
+		return defaultAddressLayout
+	}
+	return layout
+}
+
+// decodeDuration parses an optional duration string in the syntax accepted by
+// [time.ParseDuration], returning zero if the value is not set.
+//
+// "what" is a short description of the setting being decoded, for use in
+// the summary of any error diagnostics.
+func decodeDuration(raw gohcl.WithRange[*string], what string) (time.Duration, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	if raw.Value == nil {
+		return 0, diags
+	}
+	d, err := time.ParseDuration(*raw.Value)
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  fmt.Sprintf("Invalid %s", what),
+			Detail:   fmt.Sprintf("Must be a duration string like \"30s\" or \"5m\": %s.", err),
+			Subject:  raw.Range.Ptr(),
+		})
+		return 0, diags
+	}
+	if d < 0 {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  fmt.Sprintf("Invalid %s", what),
+			Detail:   "Duration must not be negative.",
+			Subject:  raw.Range.Ptr(),
+		})
+		return 0, diags
+	}
+	return d, diags
+}
+
 var rootSchema = &hcl.BodySchema{
 	Blocks: []hcl.BlockHeaderSchema{
 		{Type: "provider_mirror", LabelNames: []string{"name"}},
+		{Type: "provider_registry", LabelNames: []string{"name"}},
+		{Type: "module_registry", LabelNames: []string{"name"}},
 		{Type: "server"},
 	},
 }
@@ -1,13 +1,24 @@
 package config
 
 import (
+	"bytes"
 	"crypto/tls"
+	"io"
+	"net"
 	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/apparentlymart/go-versions/versions"
 	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/querysecret"
 	"github.com/google/go-cmp/cmp"
 	"github.com/hashicorp/hcl/v2"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -47,8 +58,21 @@ func TestLoadConfig(t *testing.T) {
 					Host:   "127.0.0.1:5000",
 					Path:   "/",
 				},
-				NamePrefix:    ocidist.Namespace{"terraform-providers"},
-				ProxyPackages: true,
+				NamePrefix:             ocidist.Namespace{"terraform-providers"},
+				ProxyPackages:          true,
+				ArtifactChecking:       ArtifactCheckingStrict,
+				HeadContentLength:      true,
+				PackageMediaTypes:      DefaultPackageMediaTypes,
+				PackageResponseHeaders: DefaultPackageResponseHeaders,
+				DuplicatePlatforms:     DuplicatePlatformsLowestDigest,
+				MaxPlatforms:           DefaultMaxPlatforms,
+				PackageVerification:    PackageVerificationNone,
+				RootResponse:           RootResponseHTML,
+				AcceptHeader:           AcceptHeaderIgnore,
+				HashSchemes:            DefaultHashSchemes,
+
+				BackendTLSSessionCacheSize: DefaultBackendTLSSessionCacheSize,
+
 				DeclRange: hcl.Range{
 					Filename: "testdata/test.hcl",
 					Start:    hcl.Pos{Line: 2, Column: 3, Byte: 3},
@@ -56,9 +80,12 @@ func TestLoadConfig(t *testing.T) {
 				},
 			},
 		},
+		ProviderRegistries: map[string]*ProviderRegistry{},
+		ModuleRegistries:   map[string]*ModuleRegistry{},
 		Server: &Server{
-			ListenAddr: ":8080",
-			QueryStringSecret: &[32]byte{
+			ListenAddr:        ":8080",
+			QueryStringCipher: DefaultQueryStringCipher,
+			QueryStringSecret: []byte{
 				0xfe, 0xed, 0xfa, 0xce,
 				0xfe, 0xed, 0xfa, 0xce,
 				0xfe, 0xed, 0xfa, 0xce,
@@ -71,6 +98,15 @@ func TestLoadConfig(t *testing.T) {
 			TLS: &TLSConfig{
 				Certificate: cert,
 			},
+			TrustedDigestAlgorithms: []string{"sha256", "sha512"},
+			LogFormat:               LogFormatText,
+			CompressionLevel:        DefaultCompressionLevel,
+			BreakerCooldown:         30 * time.Second,
+			BackpressureMaxDelay:    time.Second,
+			TokenAlertWindow:        time.Minute,
+			ShutdownTimeout:         10 * time.Second,
+			CapabilitiesTTL:         10 * time.Minute,
+			StartupProbeConcurrency: DefaultStartupProbeConcurrency,
 			DeclRange: hcl.Range{
 				Filename: "testdata/test.hcl",
 				Start:    hcl.Pos{Line: 8, Column: 3, Byte: 149},
@@ -83,3 +119,2986 @@ func TestLoadConfig(t *testing.T) {
 		t.Errorf("wrong config\n%s", diff)
 	}
 }
+
+func TestLoadConfigNameSuffixes(t *testing.T) {
+	src := []byte(`
+		provider_mirror "mirror" {
+			origin_url           = "http://127.0.0.1:5000/"
+			name_prefix          = "terraform-providers"
+			proxy_packages       = false
+			metadata_name_suffix = "meta"
+			package_name_suffix  = "packages/zip"
+		}
+
+		server {
+		}
+	`)
+
+	gotConfig, diags := LoadConfig(src, "test.hcl")
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+	mirror := gotConfig.ProviderMirrors["mirror"]
+	if got, want := mirror.MetadataNameSuffix, (ocidist.Namespace{"meta"}); !cmp.Equal(got, want) {
+		t.Errorf("wrong metadata suffix %#v; want %#v", got, want)
+	}
+	if got, want := mirror.PackageNameSuffix, (ocidist.Namespace{"packages", "zip"}); !cmp.Equal(got, want) {
+		t.Errorf("wrong package suffix %#v; want %#v", got, want)
+	}
+
+	src = []byte(`
+		provider_mirror "mirror" {
+			origin_url          = "http://127.0.0.1:5000/"
+			name_prefix         = "terraform-providers"
+			proxy_packages      = false
+			package_name_suffix = "Not Valid"
+		}
+
+		server {
+		}
+	`)
+	_, diags = LoadConfig(src, "test.hcl")
+	if !diags.HasErrors() {
+		t.Fatalf("no errors for invalid suffix")
+	}
+	if got, want := diags[0].Summary, "Invalid OCI repository name suffix"; got != want {
+		t.Errorf("wrong error summary %q; want %q", got, want)
+	}
+}
+
+func TestLoadConfigTLSWarnings(t *testing.T) {
+	// The certificate in testdata/certs.pem expired in October 2018.
+	src := []byte(`
+		server {
+			tls {
+				certificate_file = "certs.pem"
+				private_key_file = "private_key.pem"
+			}
+		}
+	`)
+	_, diags := LoadConfig(src, "testdata/test.hcl")
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+	if len(diags) != 1 {
+		t.Fatalf("wrong number of diagnostics %d; want 1\n%s", len(diags), diags.Error())
+	}
+	if got, want := diags[0].Summary, "TLS certificate has expired"; got != want {
+		t.Errorf("wrong warning summary %q; want %q", got, want)
+	}
+
+	src = []byte(`
+		server {
+			tls {
+				certificate_file = "certs.pem"
+				private_key_file = "other_private_key.pem"
+			}
+		}
+	`)
+	_, diags = LoadConfig(src, "testdata/test.hcl")
+	if !diags.HasErrors() {
+		t.Fatalf("no errors for mismatched private key")
+	}
+	if got, want := diags[0].Summary, "TLS private key does not match certificate"; got != want {
+		t.Errorf("wrong error summary %q; want %q", got, want)
+	}
+}
+
+func TestPrivateKeyMismatch(t *testing.T) {
+	tests := map[string]struct {
+		cert, key string
+		want      bool
+	}{
+		"matching":          {"certs.pem", "private_key.pem", false},
+		"mismatched":        {"certs.pem", "other_private_key.pem", true},
+		"key isn't a key":   {"certs.pem", "certs.pem", false},
+		"cert isn't a cert": {"private_key.pem", "other_private_key.pem", false},
+		"missing key":       {"certs.pem", "nonexistent.pem", false},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := privateKeyMismatch(filepath.Join("testdata", test.cert), filepath.Join("testdata", test.key))
+			if got != test.want {
+				t.Errorf("wrong result %t; want %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCertificateExpiryDiagnostics(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("testdata/certs.pem", "testdata/private_key.pem")
+	if err != nil {
+		t.Fatalf("failed to load TLS certificate to test with: %s", err)
+	}
+	notAfter := time.Date(2018, 10, 20, 19, 43, 6, 0, time.UTC)
+	threshold := 30 * 24 * time.Hour
+
+	tests := map[string]struct {
+		now  time.Time
+		want string
+	}{
+		"valid":         {notAfter.Add(-60 * 24 * time.Hour), ""},
+		"expiring soon": {notAfter.Add(-24 * time.Hour), "TLS certificate expires soon"},
+		"expired":       {notAfter.Add(time.Second), "TLS certificate has expired"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			diags := certificateExpiryDiagnostics(cert, test.now, threshold, nil)
+			got := ""
+			if len(diags) > 0 {
+				got = diags[0].Summary
+				if diags[0].Severity != hcl.DiagWarning {
+					t.Errorf("diagnostic is not a warning")
+				}
+			}
+			if got != test.want {
+				t.Errorf("wrong result %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigBackendPolicy(t *testing.T) {
+	src := []byte(`
+		provider_mirror "overridden" {
+			origin_url              = "http://127.0.0.1:5000/"
+			name_prefix             = "terraform-providers"
+			proxy_packages          = false
+			backend_timeout         = "5s"
+			backend_idle_timeout    = "2s"
+			backend_max_concurrency = 2
+			backend_retry_attempts  = 5
+			backend_retry_delay     = "1s"
+		}
+
+		provider_mirror "partial" {
+			origin_url              = "http://127.0.0.1:5000/"
+			name_prefix             = "terraform-providers"
+			proxy_packages          = false
+			backend_max_concurrency = 4
+		}
+
+		provider_mirror "defaults" {
+			origin_url     = "http://127.0.0.1:5000/"
+			name_prefix    = "terraform-providers"
+			proxy_packages = false
+		}
+
+		server {
+			backend_timeout         = "30s"
+			backend_idle_timeout    = "1m"
+			backend_max_concurrency = 16
+			backend_retry_attempts  = 3
+		}
+	`)
+
+	gotConfig, diags := LoadConfig(src, "test.hcl")
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+	got := map[string]BackendPolicy{}
+	for name, mirror := range gotConfig.ProviderMirrors {
+		got[name] = mirror.Backend
+	}
+	want := map[string]BackendPolicy{
+		"overridden": {Timeout: 5 * time.Second, IdleTimeout: 2 * time.Second, MaxConcurrency: 2, RetryAttempts: 5, RetryDelay: time.Second},
+		"partial":    {Timeout: 30 * time.Second, IdleTimeout: time.Minute, MaxConcurrency: 4, RetryAttempts: 3},
+		"defaults":   {Timeout: 30 * time.Second, IdleTimeout: time.Minute, MaxConcurrency: 16, RetryAttempts: 3},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong backend policies\n%s", diff)
+	}
+
+	src = []byte(`
+		provider_mirror "invalid" {
+			origin_url              = "http://127.0.0.1:5000/"
+			name_prefix             = "terraform-providers"
+			proxy_packages          = false
+			backend_timeout         = "0s"
+			backend_idle_timeout    = "0s"
+			backend_max_concurrency = 0
+			backend_retry_attempts  = 11
+			backend_retry_delay     = "0s"
+		}
+
+		server {
+		}
+	`)
+	_, diags = LoadConfig(src, "test.hcl")
+	var gotSummaries []string
+	for _, diag := range diags {
+		gotSummaries = append(gotSummaries, diag.Summary)
+	}
+	wantSummaries := []string{
+		"Invalid backend timeout",
+		"Invalid backend idle timeout",
+		"Invalid backend concurrency limit",
+		"Invalid backend retry attempts",
+		"Invalid backend retry delay",
+	}
+	if diff := cmp.Diff(wantSummaries, gotSummaries); diff != "" {
+		t.Errorf("wrong diagnostics\n%s", diff)
+	}
+}
+
+func TestLoadConfigRedirectPackages(t *testing.T) {
+	src := []byte(`
+		provider_mirror "mirror" {
+			origin_url        = "http://127.0.0.1:5000/"
+			name_prefix       = "terraform-providers"
+			proxy_packages    = true
+			redirect_packages = true
+		}
+
+		server {
+			query_string_secret = "0000000000000000000000000000000000000000000000000000000000000000"
+		}
+	`)
+	gotConfig, diags := LoadConfig(src, "test.hcl")
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+	if !gotConfig.ProviderMirrors["mirror"].RedirectPackages {
+		t.Errorf("RedirectPackages is not set")
+	}
+
+	src = []byte(`
+		provider_mirror "mirror" {
+			origin_url        = "http://127.0.0.1:5000/"
+			name_prefix       = "terraform-providers"
+			proxy_packages    = false
+			redirect_packages = true
+		}
+
+		server {
+		}
+	`)
+	_, diags = LoadConfig(src, "test.hcl")
+	if !diags.HasErrors() {
+		t.Fatalf("no errors for redirect_packages without proxy_packages")
+	}
+	if got, want := diags[0].Summary, "Package redirects require package proxy"; got != want {
+		t.Errorf("wrong error summary %q; want %q", got, want)
+	}
+}
+
+func TestLoadConfigArtifactChecking(t *testing.T) {
+	tests := map[string]struct {
+		setting string
+		want    ArtifactChecking
+		wantErr string
+	}{
+		"default": {
+			setting: "",
+			want:    ArtifactCheckingStrict,
+		},
+		"strict": {
+			setting: `artifact_checking = "strict"`,
+			want:    ArtifactCheckingStrict,
+		},
+		"lenient": {
+			setting: `artifact_checking = "lenient"`,
+			want:    ArtifactCheckingLenient,
+		},
+		"invalid": {
+			setting: `artifact_checking = "sloppy"`,
+			wantErr: "Invalid artifact checking mode",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.setting + `
+				}
+
+				server {
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if got := gotConfig.ProviderMirrors["mirror"].ArtifactChecking; got != test.want {
+				t.Errorf("wrong mode %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigPackageMediaTypes(t *testing.T) {
+	tests := map[string]struct {
+		setting string
+		want    []string
+		wantErr string
+	}{
+		"default": {
+			setting: "",
+			want:    DefaultPackageMediaTypes,
+		},
+		"multiple": {
+			setting: `package_media_types = ["application/vnd.example.package+tar", "application/vnd.hashicorp.terraform.provider-package+zip"]`,
+			want:    []string{"application/vnd.example.package+tar", "application/vnd.hashicorp.terraform.provider-package+zip"},
+		},
+		"empty": {
+			setting: `package_media_types = []`,
+			wantErr: "Invalid package media types",
+		},
+		"invalid": {
+			setting: `package_media_types = ["Application/Zip; foo=bar"]`,
+			wantErr: "Invalid package media types",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.setting + `
+				}
+
+				server {
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if diff := cmp.Diff(test.want, gotConfig.ProviderMirrors["mirror"].PackageMediaTypes); diff != "" {
+				t.Errorf("wrong media types\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLoadConfigHashSchemes(t *testing.T) {
+	tests := map[string]struct {
+		setting string
+		want    []string
+		wantErr string
+	}{
+		"default": {
+			setting: "",
+			want:    []string{"zh"},
+		},
+		"both": {
+			setting: `hash_schemes = ["h1", "zh"]`,
+			want:    []string{"h1", "zh"},
+		},
+		"none": {
+			setting: `hash_schemes = []`,
+			want:    []string{},
+		},
+		"unsupported": {
+			setting: `hash_schemes = ["zh", "sha512"]`,
+			wantErr: "Invalid hash schemes",
+		},
+		"duplicate": {
+			setting: `hash_schemes = ["zh", "zh"]`,
+			wantErr: "Invalid hash schemes",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.setting + `
+				}
+
+				server {
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if diff := cmp.Diff(test.want, gotConfig.ProviderMirrors["mirror"].HashSchemes); diff != "" {
+				t.Errorf("wrong hash schemes\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLoadConfigBackendTLS(t *testing.T) {
+	tests := map[string]struct {
+		setting           string
+		wantCacheSize     int
+		wantRenegotiation tls.RenegotiationSupport
+		wantErr           string
+	}{
+		"default": {
+			setting:           "",
+			wantCacheSize:     DefaultBackendTLSSessionCacheSize,
+			wantRenegotiation: tls.RenegotiateNever,
+		},
+		"no session cache": {
+			setting:           `backend_tls_session_cache_size = 0`,
+			wantCacheSize:     0,
+			wantRenegotiation: tls.RenegotiateNever,
+		},
+		"renegotiate once": {
+			setting:           `backend_tls_renegotiation = "once"`,
+			wantCacheSize:     DefaultBackendTLSSessionCacheSize,
+			wantRenegotiation: tls.RenegotiateOnceAsClient,
+		},
+		"negative session cache": {
+			setting: `backend_tls_session_cache_size = -1`,
+			wantErr: "Invalid TLS session cache size",
+		},
+		"invalid renegotiation": {
+			setting: `backend_tls_renegotiation = "sometimes"`,
+			wantErr: "Invalid TLS renegotiation setting",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.setting + `
+				}
+
+				server {
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			mirror := gotConfig.ProviderMirrors["mirror"]
+			if got, want := mirror.BackendTLSSessionCacheSize, test.wantCacheSize; got != want {
+				t.Errorf("wrong session cache size %d; want %d", got, want)
+			}
+			if got, want := mirror.BackendTLSRenegotiation, test.wantRenegotiation; got != want {
+				t.Errorf("wrong renegotiation setting %d; want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigPackageVerification(t *testing.T) {
+	tests := map[string]struct {
+		settings string
+		want     PackageVerification
+		wantErr  string
+	}{
+		"default": {
+			settings: `proxy_packages = true`,
+			want:     PackageVerificationNone,
+		},
+		"buffered": {
+			settings: `
+				proxy_packages       = true
+				package_verification = "buffered"
+			`,
+			want: PackageVerificationBuffered,
+		},
+		"none without proxy": {
+			settings: `
+				proxy_packages       = false
+				package_verification = "none"
+			`,
+			want: PackageVerificationNone,
+		},
+		"without proxy": {
+			settings: `
+				proxy_packages       = false
+				package_verification = "streaming"
+			`,
+			wantErr: "Package verification requires package proxy",
+		},
+		"with redirects": {
+			settings: `
+				proxy_packages       = true
+				redirect_packages    = true
+				package_verification = "streaming"
+			`,
+			wantErr: "Package verification requires package proxy",
+		},
+		"invalid": {
+			settings: `
+				proxy_packages       = true
+				package_verification = "paranoid"
+			`,
+			wantErr: "Invalid package verification mode",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url  = "http://127.0.0.1:5000/"
+					name_prefix = "terraform-providers"
+					` + test.settings + `
+				}
+
+				server {
+					query_string_secret = "0000000000000000000000000000000000000000000000000000000000000000"
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if got := gotConfig.ProviderMirrors["mirror"].PackageVerification; got != test.want {
+				t.Errorf("wrong package verification mode %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigPackageCacheDir(t *testing.T) {
+	tests := map[string]struct {
+		settings string
+		want     string
+		wantErr  string
+	}{
+		"default": {
+			settings: `proxy_packages = true`,
+			want:     "",
+		},
+		"relative": {
+			settings: `
+				proxy_packages    = true
+				package_cache_dir = "packages"
+			`,
+			want: filepath.Join("config", "packages"),
+		},
+		"absolute with redirects": {
+			settings: `
+				proxy_packages    = true
+				redirect_packages = true
+				package_cache_dir = "/var/cache/packages"
+			`,
+			want: "/var/cache/packages",
+		},
+		"without proxy": {
+			settings: `
+				proxy_packages    = false
+				package_cache_dir = "packages"
+			`,
+			wantErr: "Package cache requires package proxy",
+		},
+		"empty": {
+			settings: `
+				proxy_packages    = true
+				package_cache_dir = ""
+			`,
+			wantErr: "Invalid package cache directory",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url  = "http://127.0.0.1:5000/"
+					name_prefix = "terraform-providers"
+					` + test.settings + `
+				}
+
+				server {
+					query_string_secret = "0000000000000000000000000000000000000000000000000000000000000000"
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, filepath.Join("config", "test.hcl"))
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if got := gotConfig.ProviderMirrors["mirror"].PackageCacheDir; got != test.want {
+				t.Errorf("wrong package cache directory %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMaxPlatforms(t *testing.T) {
+	tests := map[string]struct {
+		setting string
+		want    int
+		wantErr string
+	}{
+		"default": {
+			setting: "",
+			want:    DefaultMaxPlatforms,
+		},
+		"set": {
+			setting: `max_platforms = 16`,
+			want:    16,
+		},
+		"zero": {
+			setting: `max_platforms = 0`,
+			wantErr: "Invalid maximum platforms",
+		},
+		"too large": {
+			setting: `max_platforms = 100000`,
+			wantErr: "Invalid maximum platforms",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.setting + `
+				}
+
+				server {
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if got := gotConfig.ProviderMirrors["mirror"].MaxPlatforms; got != test.want {
+				t.Errorf("wrong limit %d; want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigDuplicatePlatforms(t *testing.T) {
+	tests := map[string]struct {
+		setting string
+		want    DuplicatePlatforms
+		wantErr string
+	}{
+		"default": {
+			setting: "",
+			want:    DuplicatePlatformsLowestDigest,
+		},
+		"first": {
+			setting: `duplicate_platforms = "first"`,
+			want:    DuplicatePlatformsFirst,
+		},
+		"error": {
+			setting: `duplicate_platforms = "error"`,
+			want:    DuplicatePlatformsError,
+		},
+		"invalid": {
+			setting: `duplicate_platforms = "random"`,
+			wantErr: "Invalid duplicate platforms mode",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.setting + `
+				}
+
+				server {
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if got := gotConfig.ProviderMirrors["mirror"].DuplicatePlatforms; got != test.want {
+				t.Errorf("wrong mode %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigDeprecatedProviders(t *testing.T) {
+	tests := map[string]struct {
+		setting string
+		want    map[string]string
+		wantErr string
+	}{
+		"none": {
+			setting: "",
+			want:    nil,
+		},
+		"valid": {
+			setting: `deprecated_providers = { "Example.com/Foo/Bar" = "Use example.com/foo/baz instead." }`,
+			want:    map[string]string{"example.com/foo/bar": "Use example.com/foo/baz instead."},
+		},
+		"invalid": {
+			setting: `deprecated_providers = { "foo/bar" = "Gone." }`,
+			wantErr: "Invalid deprecated provider address",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.setting + `
+				}
+
+				server {
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if diff := cmp.Diff(test.want, gotConfig.ProviderMirrors["mirror"].DeprecatedProviders); diff != "" {
+				t.Errorf("wrong result\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLoadConfigWarmProviders(t *testing.T) {
+	tests := map[string]struct {
+		setting string
+		want    []string
+		wantErr string
+	}{
+		"none": {
+			setting: "",
+			want:    nil,
+		},
+		"valid": {
+			setting: `
+				cache_ttl      = "1m"
+				warm_providers = ["Example.com/Foo/Bar", "example.com/foo/baz"]
+			`,
+			want: []string{"example.com/foo/bar", "example.com/foo/baz"},
+		},
+		"invalid": {
+			setting: `
+				cache_ttl      = "1m"
+				warm_providers = ["foo/bar"]
+			`,
+			wantErr: "Invalid warm provider address",
+		},
+		"no cache": {
+			setting: `warm_providers = ["example.com/foo/bar"]`,
+			wantErr: "Warm providers require a cache",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.setting + `
+				}
+
+				server {
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if diff := cmp.Diff(test.want, gotConfig.ProviderMirrors["mirror"].WarmProviders); diff != "" {
+				t.Errorf("wrong result\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLoadConfigForwardQueryParams(t *testing.T) {
+	tests := map[string]struct {
+		setting string
+		want    []string
+		wantErr string
+	}{
+		"none": {
+			setting: "proxy_packages = true",
+			want:    nil,
+		},
+		"valid": {
+			setting: `
+				proxy_packages       = true
+				forward_query_params = ["sig", "X-Amz-Expires"]
+			`,
+			want: []string{"sig", "X-Amz-Expires"},
+		},
+		"invalid": {
+			setting: `
+				proxy_packages       = true
+				forward_query_params = ["a&b"]
+			`,
+			wantErr: "Invalid forwarded query parameter name",
+		},
+		"no proxy": {
+			setting: `
+				proxy_packages       = false
+				forward_query_params = ["sig"]
+			`,
+			wantErr: "Forwarded query parameters require package proxy",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url  = "http://127.0.0.1:5000/"
+					name_prefix = "terraform-providers"
+					` + test.setting + `
+				}
+
+				server {
+					query_string_secret = "0000000000000000000000000000000000000000000000000000000000000000"
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if diff := cmp.Diff(test.want, gotConfig.ProviderMirrors["mirror"].ForwardQueryParams); diff != "" {
+				t.Errorf("wrong result\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "404.html"), []byte("<p>Not here.</p>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		setting string
+		want    map[int]*ErrorPage
+		wantErr string
+	}{
+		"none": {
+			setting: "",
+			want:    nil,
+		},
+		"valid": {
+			setting: `
+				error_page "404" {
+					html_file = "404.html"
+					json      = "{\"error\":\"not here\"}"
+				}
+				error_page "503" {
+					json = "{}"
+				}
+			`,
+			want: map[int]*ErrorPage{
+				404: {HTML: []byte("<p>Not here.</p>"), JSON: []byte(`{"error":"not here"}`)},
+				503: {JSON: []byte("{}")},
+			},
+		},
+		"not an error status": {
+			setting: `
+				error_page "200" {
+					html = "ok"
+				}
+			`,
+			wantErr: "Invalid error page status code",
+		},
+		"duplicate": {
+			setting: `
+				error_page "404" {
+					html = "a"
+				}
+				error_page "404" {
+					html = "b"
+				}
+			`,
+			wantErr: "Duplicate error page",
+		},
+		"conflicting": {
+			setting: `
+				error_page "404" {
+					html      = "a"
+					html_file = "404.html"
+				}
+			`,
+			wantErr: "Conflicting error page content",
+		},
+		"missing file": {
+			setting: `
+				error_page "404" {
+					html_file = "nonexistent.html"
+				}
+			`,
+			wantErr: "Cannot read error page file",
+		},
+		"invalid JSON": {
+			setting: `
+				error_page "404" {
+					json = "{"
+				}
+			`,
+			wantErr: "Invalid error page JSON",
+		},
+		"empty": {
+			setting: `
+				error_page "404" {
+				}
+			`,
+			wantErr: "Empty error page",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+				}
+
+				server {
+					` + test.setting + `
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, filepath.Join(dir, "test.hcl"))
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if diff := cmp.Diff(test.want, gotConfig.Server.ErrorPages); diff != "" {
+				t.Errorf("wrong result\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLoadConfigDownloadOptions(t *testing.T) {
+	tests := map[string]struct {
+		setting string
+		wantErr string
+	}{
+		"direct": {
+			setting: `proxy_packages = false`,
+		},
+		"proxy with all options": {
+			setting: `
+				proxy_packages           = true
+				package_filenames        = true
+				forward_query_params     = ["sig"]
+				package_response_headers = ["Content-Type"]
+			`,
+		},
+		"redirect with all options": {
+			setting: `
+				proxy_packages           = true
+				redirect_packages        = true
+				package_filenames        = true
+				forward_query_params     = ["sig"]
+				package_response_headers = ["Content-Type"]
+			`,
+		},
+		"redirect without proxy": {
+			setting: `
+				proxy_packages    = false
+				redirect_packages = true
+			`,
+			wantErr: "Package redirects require package proxy",
+		},
+		"forwarded query parameters without proxy": {
+			setting: `
+				proxy_packages       = false
+				forward_query_params = ["sig"]
+			`,
+			wantErr: "Forwarded query parameters require package proxy",
+		},
+		"response headers without proxy": {
+			setting: `
+				proxy_packages           = false
+				package_response_headers = ["Content-Type"]
+			`,
+			wantErr: "Package response headers require package proxy",
+		},
+		"package filenames without proxy": {
+			setting: `
+				proxy_packages    = false
+				package_filenames = true
+			`,
+			wantErr: "Package filenames require package proxy",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url  = "http://127.0.0.1:5000/"
+					name_prefix = "terraform-providers"
+					` + test.setting + `
+				}
+
+				server {
+					query_string_secret = "0000000000000000000000000000000000000000000000000000000000000000"
+				}
+			`)
+			_, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr == "" {
+				if diags.HasErrors() {
+					t.Fatalf("unexpected errors: %s", diags.Error())
+				}
+				return
+			}
+			if !diags.HasErrors() {
+				t.Fatalf("no errors; want %q", test.wantErr)
+			}
+			if got := diags[0].Summary; got != test.wantErr {
+				t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+			}
+			if got := diags[0].Subject; got == nil || got.Start.Line < 3 {
+				t.Errorf("diagnostic doesn't point at the offending argument: %#v", got)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRequiredArtifactType(t *testing.T) {
+	tests := map[string]struct {
+		setting string
+		want    string
+		wantErr string
+	}{
+		"none": {
+			setting: "",
+			want:    "",
+		},
+		"valid": {
+			setting: `required_artifact_type = "application/vnd.hashicorp.terraform-provider"`,
+			want:    "application/vnd.hashicorp.terraform-provider",
+		},
+		"invalid": {
+			setting: `required_artifact_type = "not a media type"`,
+			wantErr: "Invalid required artifact type",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.setting + `
+				}
+
+				server {
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if got := gotConfig.ProviderMirrors["mirror"].RequiredArtifactType; got != test.want {
+				t.Errorf("wrong result %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFallbackOriginURL(t *testing.T) {
+	tests := map[string]struct {
+		originURL string
+		setting   string
+		want      string
+		wantErr   string
+	}{
+		"none": {
+			setting: "",
+			want:    "",
+		},
+		"valid": {
+			setting: `fallback_origin_url = "https://registry.example.com/mirror/"`,
+			want:    "https://registry.example.com/mirror/",
+		},
+		"wrong scheme": {
+			setting: `fallback_origin_url = "ftp://registry.example.com/"`,
+			wantErr: "Invalid fallback origin URL",
+		},
+		"no trailing slash": {
+			setting: `fallback_origin_url = "https://registry.example.com"`,
+			wantErr: "Invalid fallback origin URL",
+		},
+		"same as primary": {
+			setting: `fallback_origin_url = "http://127.0.0.1:5000/"`,
+			wantErr: "Invalid fallback origin URL",
+		},
+		"invalid primary": {
+			originURL: "ftp://127.0.0.1:5000/",
+			setting:   `fallback_origin_url = "https://registry.example.com/"`,
+			wantErr:   "Invalid OCI repository origin URL",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			originURL := test.originURL
+			if originURL == "" {
+				originURL = "http://127.0.0.1:5000/"
+			}
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "` + originURL + `"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.setting + `
+				}
+
+				server {
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			got := ""
+			if u := gotConfig.ProviderMirrors["mirror"].FallbackOriginURL; u != nil {
+				got = u.String()
+			}
+			if got != test.want {
+				t.Errorf("wrong result %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigYankedAnnotation(t *testing.T) {
+	tests := map[string]struct {
+		setting string
+		want    string
+		wantErr string
+	}{
+		"none": {
+			setting: "",
+			want:    "",
+		},
+		"valid": {
+			setting: `yanked_annotation = "io.terraform.yanked"`,
+			want:    "io.terraform.yanked",
+		},
+		"empty": {
+			setting: `yanked_annotation = ""`,
+			wantErr: "Invalid yanked annotation",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.setting + `
+				}
+
+				server {
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if got := gotConfig.ProviderMirrors["mirror"].YankedAnnotation; got != test.want {
+				t.Errorf("wrong result %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigCreatedAnnotation(t *testing.T) {
+	tests := map[string]struct {
+		setting string
+		want    string
+		wantErr string
+	}{
+		"none": {
+			setting: "",
+			want:    "",
+		},
+		"valid": {
+			setting: `created_annotation = "org.opencontainers.image.created"`,
+			want:    "org.opencontainers.image.created",
+		},
+		"empty": {
+			setting: `created_annotation = ""`,
+			wantErr: "Invalid created annotation",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.setting + `
+				}
+
+				server {
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if got := gotConfig.ProviderMirrors["mirror"].CreatedAnnotation; got != test.want {
+				t.Errorf("wrong result %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigBackendIPPolicy(t *testing.T) {
+	tests := map[string]struct {
+		setting   string
+		wantAllow []string
+		wantDeny  []string
+		wantNil   bool
+		wantErr   string
+	}{
+		"none": {
+			setting: "",
+			wantNil: true,
+		},
+		"networks": {
+			setting: `
+				backend_ip_policy {
+					allow = ["10.0.0.0/8"]
+					deny  = ["169.254.0.0/16", "fe80::/10"]
+				}
+			`,
+			wantAllow: []string{"10.0.0.0/8"},
+			wantDeny:  []string{"169.254.0.0/16", "fe80::/10"},
+		},
+		"addresses": {
+			setting: `
+				backend_ip_policy {
+					deny = ["169.254.169.254", "fd00:ec2::254"]
+				}
+			`,
+			wantDeny: []string{"169.254.169.254/32", "fd00:ec2::254/128"},
+		},
+		"invalid": {
+			setting: `
+				backend_ip_policy {
+					deny = ["metadata.internal"]
+				}
+			`,
+			wantErr: "Invalid IP network",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.setting + `
+				}
+
+				server {
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			policy := gotConfig.ProviderMirrors["mirror"].BackendIPPolicy
+			if test.wantNil {
+				if policy != nil {
+					t.Errorf("unexpected policy %#v", policy)
+				}
+				return
+			}
+			if policy == nil {
+				t.Fatalf("no policy")
+			}
+			networkStrings := func(networks []*net.IPNet) []string {
+				var ret []string
+				for _, network := range networks {
+					ret = append(ret, network.String())
+				}
+				return ret
+			}
+			if diff := cmp.Diff(test.wantAllow, networkStrings(policy.Allow)); diff != "" {
+				t.Errorf("wrong allowed networks\n%s", diff)
+			}
+			if diff := cmp.Diff(test.wantDeny, networkStrings(policy.Deny)); diff != "" {
+				t.Errorf("wrong denied networks\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLoadConfigDiscovery(t *testing.T) {
+	tests := map[string]struct {
+		mirrorSetting string
+		otherSetting  string
+		serverSetting string
+		wantIDs       []string
+		wantServices  map[string]string
+		wantErr       string
+	}{
+		"none": {},
+		"valid": {
+			mirrorSetting: `discovery_ids = ["example.v1"]`,
+			serverSetting: `discovery_services = { "login.v1" = "https://auth.example.com/" }`,
+			wantIDs:       []string{"example.v1"},
+			wantServices:  map[string]string{"login.v1": "https://auth.example.com/"},
+		},
+		"invalid service ID": {
+			mirrorSetting: `discovery_ids = ["Example"]`,
+			wantErr:       "Invalid discovery service ID",
+		},
+		"invalid server service ID": {
+			serverSetting: `discovery_services = { "login" = "https://auth.example.com/" }`,
+			wantErr:       "Invalid discovery service ID",
+		},
+		"invalid server service URL": {
+			serverSetting: `discovery_services = { "login.v1" = "" }`,
+			wantErr:       "Invalid discovery service URL",
+		},
+		"duplicate": {
+			mirrorSetting: `discovery_ids = ["example.v1"]`,
+			otherSetting:  `discovery_ids = ["example.v1"]`,
+			wantErr:       "Duplicate discovery service ID",
+		},
+		"duplicate overridden": {
+			mirrorSetting: `discovery_ids = ["example.v1"]`,
+			otherSetting:  `discovery_ids = ["example.v1"]`,
+			serverSetting: `discovery_services = { "example.v1" = "/other/" }`,
+			wantIDs:       []string{"example.v1"},
+			wantServices:  map[string]string{"example.v1": "/other/"},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.mirrorSetting + `
+				}
+
+				provider_mirror "other" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.otherSetting + `
+				}
+
+				server {
+					` + test.serverSetting + `
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if diff := cmp.Diff(test.wantIDs, gotConfig.ProviderMirrors["mirror"].DiscoveryIDs); diff != "" {
+				t.Errorf("wrong discovery IDs\n%s", diff)
+			}
+			if diff := cmp.Diff(test.wantServices, gotConfig.Server.DiscoveryServices); diff != "" {
+				t.Errorf("wrong discovery services\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLoadConfigGzipResponses(t *testing.T) {
+	tests := map[string]struct {
+		mirrorSetting string
+		serverSetting string
+		wantGzip      bool
+		wantCache     bool
+		wantErr       string
+	}{
+		"none": {},
+		"gzip only": {
+			serverSetting: `gzip_responses = true`,
+			wantGzip:      true,
+		},
+		"gzip with cache": {
+			mirrorSetting: `cache_gzip_responses = true`,
+			serverSetting: `gzip_responses = true`,
+			wantGzip:      true,
+			wantCache:     true,
+		},
+		"cache without gzip": {
+			mirrorSetting: `cache_gzip_responses = true`,
+			wantErr:       "Gzip response cache requires gzip responses",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.mirrorSetting + `
+				}
+
+				server {
+					` + test.serverSetting + `
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if got := gotConfig.Server.GzipResponses; got != test.wantGzip {
+				t.Errorf("wrong GzipResponses %v; want %v", got, test.wantGzip)
+			}
+			if got := gotConfig.ProviderMirrors["mirror"].CacheGzipResponses; got != test.wantCache {
+				t.Errorf("wrong CacheGzipResponses %v; want %v", got, test.wantCache)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMinVersion(t *testing.T) {
+	tests := map[string]struct {
+		setting string
+		want    versions.Version
+		wantErr string
+	}{
+		"none": {
+			setting: "",
+			want:    versions.Unspecified,
+		},
+		"valid": {
+			setting: `min_version = "1.2.0"`,
+			want:    versions.MustParseVersion("1.2.0"),
+		},
+		"invalid": {
+			setting: `min_version = "not a version"`,
+			wantErr: "Invalid minimum version",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.setting + `
+				}
+
+				server {
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if got := gotConfig.ProviderMirrors["mirror"].MinVersion; got != test.want {
+				t.Errorf("wrong result %s; want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigDownloadTokenGracePeriod(t *testing.T) {
+	tests := map[string]struct {
+		setting string
+		want    time.Duration
+		wantErr string
+	}{
+		"none": {
+			setting: "",
+			want:    0,
+		},
+		"valid": {
+			setting: `download_token_grace_period = "2m"`,
+			want:    2 * time.Minute,
+		},
+		"negative": {
+			setting: `download_token_grace_period = "-1m"`,
+			wantErr: "Invalid download token grace period",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+				}
+
+				server {
+					` + test.setting + `
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if got := gotConfig.Server.DownloadTokenGracePeriod; got != test.want {
+				t.Errorf("wrong result %s; want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigAuditLog(t *testing.T) {
+	tests := map[string]struct {
+		setting string
+		want    *AuditLog
+		wantErr string
+	}{
+		"none": {
+			setting: "",
+			want:    nil,
+		},
+		"defaults": {
+			setting: `
+				audit_log {
+					file = "audit.log"
+				}
+			`,
+			want: &AuditLog{
+				Filename:           filepath.Join("config", "audit.log"),
+				MaxEventsPerSecond: 100,
+			},
+		},
+		"absolute path and unlimited": {
+			setting: `
+				audit_log {
+					file                  = "/var/log/audit.log"
+					max_events_per_second = 0
+				}
+			`,
+			want: &AuditLog{
+				Filename:           "/var/log/audit.log",
+				MaxEventsPerSecond: 0,
+			},
+		},
+		"negative rate": {
+			setting: `
+				audit_log {
+					file                  = "audit.log"
+					max_events_per_second = -1
+				}
+			`,
+			wantErr: "Invalid audit log rate limit",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+				}
+
+				server {
+					` + test.setting + `
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, filepath.Join("config", "test.hcl"))
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if diff := cmp.Diff(test.want, gotConfig.Server.AuditLog); diff != "" {
+				t.Errorf("wrong result\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMaxServices(t *testing.T) {
+	mirrors := `
+		provider_mirror "a" {
+			origin_url     = "http://127.0.0.1:5000/"
+			name_prefix    = "terraform-providers"
+			proxy_packages = false
+		}
+		provider_mirror "b" {
+			origin_url     = "http://127.0.0.1:5000/"
+			name_prefix    = "terraform-providers"
+			proxy_packages = false
+		}
+	`
+	tests := map[string]struct {
+		setting string
+		want    int
+		wantErr string
+	}{
+		"no limit": {
+			setting: "",
+			want:    0,
+		},
+		"within limit": {
+			setting: `max_services = 2`,
+			want:    2,
+		},
+		"exceeded": {
+			setting: `max_services = 1`,
+			wantErr: "Too many services",
+		},
+		"zero": {
+			setting: `max_services = 0`,
+			wantErr: "Invalid service limit",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			src := []byte(mirrors + `
+				server {
+					` + test.setting + `
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				if test.wantErr == "Too many services" {
+					// The problem is with the file as a whole, rather than
+					// with any particular block.
+					if subject := diags[0].Subject; subject == nil || subject.Start.Line != 1 || subject.End.Byte != len(src) {
+						t.Errorf("wrong subject %v; want the whole file", subject)
+					}
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if got := gotConfig.Server.MaxServices; got != test.want {
+				t.Errorf("wrong result %d; want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigShutdownReadiness(t *testing.T) {
+	tests := map[string]struct {
+		server    string
+		wantPath  string
+		wantDelay time.Duration
+		wantErr   string
+	}{
+		"defaults": {},
+		"all set": {
+			server:    `readiness_path = "/readyz"` + "\n" + `shutdown_delay = "5s"`,
+			wantPath:  "/readyz",
+			wantDelay: 5 * time.Second,
+		},
+		"relative path": {
+			server:  `readiness_path = "readyz"`,
+			wantErr: "Invalid readiness path",
+		},
+		"negative delay": {
+			server:  `shutdown_delay = "-1s"`,
+			wantErr: "Invalid shutdown delay",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+				}
+
+				server {
+					` + test.server + `
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if got := gotConfig.Server.ReadinessPath; got != test.wantPath {
+				t.Errorf("wrong path %q; want %q", got, test.wantPath)
+			}
+			if got := gotConfig.Server.ShutdownDelay; got != test.wantDelay {
+				t.Errorf("wrong delay %s; want %s", got, test.wantDelay)
+			}
+		})
+	}
+}
+
+func TestLoadConfigAddressLayout(t *testing.T) {
+	tests := map[string]struct {
+		mirror     string
+		wantLayout []string
+		wantDepth  int
+		wantErr    string
+	}{
+		"default": {},
+		"default with depth": {
+			mirror:    `namespace_depth = 4`,
+			wantDepth: 4,
+		},
+		"flattened": {
+			mirror:     `address_layout = "{hostname}/{namespace}_{type}"` + "\n" + `namespace_depth = 3`,
+			wantLayout: []string{"{hostname}", "{namespace}_{type}"},
+			wantDepth:  3,
+		},
+		"flattened with double underscore": {
+			mirror:     `address_layout = "{hostname}__{namespace}__{type}"`,
+			wantLayout: []string{"{hostname}__{namespace}__{type}"},
+		},
+		"joined with dash": {
+			mirror:  `address_layout = "{hostname}/{namespace}-{type}"`,
+			wantErr: "Invalid address layout",
+		},
+		"joined with period": {
+			mirror:  `address_layout = "{hostname}.{namespace}/{type}"`,
+			wantErr: "Invalid address layout",
+		},
+		"joined without separator": {
+			mirror:  `address_layout = "{hostname}/{namespace}{type}"`,
+			wantErr: "Invalid address layout",
+		},
+		"missing hostname": {
+			mirror:  `address_layout = "{namespace}_{type}"`,
+			wantErr: "Invalid address layout",
+		},
+		"expanded": {
+			mirror:     `address_layout = "{hostname}/{namespace}/{type}/provider"`,
+			wantLayout: []string{"{hostname}", "{namespace}", "{type}", "provider"},
+		},
+		"default over depth": {
+			mirror:  `namespace_depth = 3`,
+			wantErr: "Invalid namespace depth",
+		},
+		"layout under depth": {
+			mirror:  `address_layout = "{hostname}/{namespace}/{type}"` + "\n" + `namespace_depth = 5`,
+			wantErr: "Invalid namespace depth",
+		},
+		"unknown placeholder": {
+			mirror:  `address_layout = "{host}/{namespace}/{type}"`,
+			wantErr: "Invalid address layout",
+		},
+		"missing type": {
+			mirror:  `address_layout = "{hostname}/{namespace}"`,
+			wantErr: "Invalid address layout",
+		},
+		"invalid part": {
+			mirror:  `address_layout = "{hostname}/{namespace}//{type}"`,
+			wantErr: "Invalid address layout",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.mirror + `
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			mirror := gotConfig.ProviderMirrors["mirror"]
+			if diff := cmp.Diff(test.wantLayout, mirror.AddressLayout); diff != "" {
+				t.Errorf("wrong layout\n%s", diff)
+			}
+			if got := mirror.NamespaceDepth; got != test.wantDepth {
+				t.Errorf("wrong depth %d; want %d", got, test.wantDepth)
+			}
+		})
+	}
+}
+
+func TestLoadConfigOriginCredentials(t *testing.T) {
+	tests := map[string]struct {
+		block   string
+		want    *ocidist.Credentials
+		wantErr string
+	}{
+		"none": {},
+		"anonymous": {
+			block: `origin_credentials {}`,
+			want:  &ocidist.Credentials{},
+		},
+		"password": {
+			block: `origin_credentials {
+				username = "user"
+				password = "secret"
+			}`,
+			want: &ocidist.Credentials{Username: "user", Password: "secret"},
+		},
+		"token": {
+			block: `origin_credentials {
+				token = "abc123"
+			}`,
+			want: &ocidist.Credentials{Token: "abc123"},
+		},
+		"both": {
+			block: `origin_credentials {
+				username = "user"
+				password = "secret"
+				token    = "abc123"
+			}`,
+			wantErr: "Invalid origin credentials",
+		},
+		"username only": {
+			block: `origin_credentials {
+				username = "user"
+			}`,
+			wantErr: "Invalid origin credentials",
+		},
+		"unknown argument": {
+			block: `origin_credentials {
+				username = "user"
+				pasword  = "secret"
+			}`,
+			wantErr: "Unsupported argument",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.block + `
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if diff := cmp.Diff(test.want, gotConfig.ProviderMirrors["mirror"].OriginCredentials); diff != "" {
+				t.Errorf("wrong credentials\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLoadConfigProviderIndexPageSize(t *testing.T) {
+	tests := map[string]struct {
+		setting string
+		want    int
+		wantErr string
+	}{
+		"unset": {},
+		"set": {
+			setting: `provider_index_page_size = 100`,
+			want:    100,
+		},
+		"zero": {
+			setting: `provider_index_page_size = 0`,
+			wantErr: "Invalid provider index page size",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					provider_index = true
+					` + test.setting + `
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if got := gotConfig.ProviderMirrors["mirror"].ProviderIndexPageSize; got != test.want {
+				t.Errorf("wrong page size %d; want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigStartupProbe(t *testing.T) {
+	tests := map[string]struct {
+		server          string
+		wantTimeout     time.Duration
+		wantConcurrency int
+		wantErr         string
+	}{
+		"defaults": {
+			wantConcurrency: DefaultStartupProbeConcurrency,
+		},
+		"all set": {
+			server:          `startup_probe_timeout = "5s"` + "\n" + `startup_probe_concurrency = 10`,
+			wantTimeout:     5 * time.Second,
+			wantConcurrency: 10,
+		},
+		"invalid timeout": {
+			server:  `startup_probe_timeout = "soon"`,
+			wantErr: "Invalid startup probe timeout",
+		},
+		"zero concurrency": {
+			server:  `startup_probe_concurrency = 0`,
+			wantErr: "Invalid startup probe concurrency",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+				}
+
+				server {
+					` + test.server + `
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if got := gotConfig.Server.StartupProbeTimeout; got != test.wantTimeout {
+				t.Errorf("wrong timeout %s; want %s", got, test.wantTimeout)
+			}
+			if got := gotConfig.Server.StartupProbeConcurrency; got != test.wantConcurrency {
+				t.Errorf("wrong concurrency %d; want %d", got, test.wantConcurrency)
+			}
+		})
+	}
+}
+
+func TestLoadConfigCompressionLevel(t *testing.T) {
+	tests := map[string]struct {
+		setting string
+		want    int
+		wantErr string
+	}{
+		"default": {
+			setting: "",
+			want:    DefaultCompressionLevel,
+		},
+		"fastest": {
+			setting: `compression_level = 1`,
+			want:    1,
+		},
+		"best": {
+			setting: `compression_level = 9`,
+			want:    9,
+		},
+		"zero": {
+			setting: `compression_level = 0`,
+			wantErr: "Invalid compression level",
+		},
+		"too high": {
+			setting: `compression_level = 10`,
+			wantErr: "Invalid compression level",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+				}
+
+				server {
+					gzip_responses = true
+					` + test.setting + `
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if got := gotConfig.Server.CompressionLevel; got != test.want {
+				t.Errorf("wrong CompressionLevel %d; want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigClientIPv6PrefixLength(t *testing.T) {
+	tests := map[string]struct {
+		setting string
+		want    int
+		wantErr string
+	}{
+		"default": {
+			setting: "",
+			want:    0,
+		},
+		"set": {
+			setting: `client_ipv6_prefix_length = 64`,
+			want:    64,
+		},
+		"zero": {
+			setting: `client_ipv6_prefix_length = 0`,
+			wantErr: "Invalid client IPv6 prefix length",
+		},
+		"too long": {
+			setting: `client_ipv6_prefix_length = 129`,
+			wantErr: "Invalid client IPv6 prefix length",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+				}
+
+				server {
+					` + test.setting + `
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if got := gotConfig.Server.ClientIPv6PrefixLength; got != test.want {
+				t.Errorf("wrong prefix length %d; want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigQueryStringSecret(t *testing.T) {
+	tests := map[string]struct {
+		secret      string
+		cipher      string
+		want        []byte
+		wantCipher  querysecret.Cipher
+		wantSummary string
+		wantDetail  string
+	}{
+		"valid": {
+			secret: "feedfacefeedfacefeedfacefeedfacefeedfacefeedfacefeedfacefeedface",
+			want: []byte{
+				0xfe, 0xed, 0xfa, 0xce, 0xfe, 0xed, 0xfa, 0xce,
+				0xfe, 0xed, 0xfa, 0xce, 0xfe, 0xed, 0xfa, 0xce,
+				0xfe, 0xed, 0xfa, 0xce, 0xfe, 0xed, 0xfa, 0xce,
+				0xfe, 0xed, 0xfa, 0xce, 0xfe, 0xed, 0xfa, 0xce,
+			},
+			wantCipher: querysecret.CipherSecretbox,
+		},
+		"aes-256-gcm": {
+			secret: "feedfacefeedfacefeedfacefeedfacefeedfacefeedfacefeedfacefeedface",
+			cipher: "aes-256-gcm",
+			want: []byte{
+				0xfe, 0xed, 0xfa, 0xce, 0xfe, 0xed, 0xfa, 0xce,
+				0xfe, 0xed, 0xfa, 0xce, 0xfe, 0xed, 0xfa, 0xce,
+				0xfe, 0xed, 0xfa, 0xce, 0xfe, 0xed, 0xfa, 0xce,
+				0xfe, 0xed, 0xfa, 0xce, 0xfe, 0xed, 0xfa, 0xce,
+			},
+			wantCipher: querysecret.CipherAES256GCM,
+		},
+		"too short": {
+			secret:      "feedface",
+			wantSummary: "Invalid query string secret",
+			wantDetail:  "The secretbox cipher requires a 32-byte (256-bit) secret key, written as exactly 64 hexadecimal digits, but this value has 8 characters.",
+		},
+		"too short for aes-256-gcm": {
+			secret:      "feedface",
+			cipher:      "aes-256-gcm",
+			wantSummary: "Invalid query string secret",
+			wantDetail:  "The aes-256-gcm cipher requires a 32-byte (256-bit) secret key, written as exactly 64 hexadecimal digits, but this value has 8 characters.",
+		},
+		"not hex": {
+			secret:      "zzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz",
+			wantSummary: "Invalid query string secret",
+			wantDetail:  "The secretbox cipher requires a 32-byte (256-bit) secret key, written as exactly 64 hexadecimal digits: encoding/hex: invalid byte: U+007A 'z'.",
+		},
+		"unsupported cipher": {
+			secret:      "feedfacefeedfacefeedfacefeedfacefeedfacefeedfacefeedfacefeedface",
+			cipher:      "rot13",
+			wantSummary: "Invalid query string cipher",
+			wantDetail:  `The query string cipher must be either "secretbox" or "aes-256-gcm".`,
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			cipher := ""
+			if test.cipher != "" {
+				cipher = `query_string_cipher = "` + test.cipher + `"`
+			}
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+				}
+
+				server {
+					query_string_secret = "` + test.secret + `"
+					` + cipher + `
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantDetail != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantDetail)
+				}
+				if got, want := diags[0].Summary, test.wantSummary; got != want {
+					t.Errorf("wrong error summary %q; want %q", got, want)
+				}
+				if got := diags[0].Detail; got != test.wantDetail {
+					t.Errorf("wrong error detail\ngot:  %s\nwant: %s", got, test.wantDetail)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if diff := cmp.Diff(test.want, gotConfig.Server.QueryStringSecret); diff != "" {
+				t.Errorf("wrong secret\n%s", diff)
+			}
+			if got := gotConfig.Server.QueryStringCipher; got != test.wantCipher {
+				t.Errorf("wrong cipher %q; want %q", got, test.wantCipher)
+			}
+		})
+	}
+}
+
+func TestLoadConfigCapabilities(t *testing.T) {
+	tests := map[string]struct {
+		server       string
+		mirror       string
+		wantPath     string
+		wantTTL      time.Duration
+		wantProvider string
+		wantErr      string
+	}{
+		"defaults": {
+			wantTTL: 10 * time.Minute,
+		},
+		"all set": {
+			server:       `capabilities_path = "/capabilities.json"` + "\n" + `capabilities_ttl = "1m"`,
+			mirror:       `probe_provider = "Example.com/Foo/Bar"`,
+			wantPath:     "/capabilities.json",
+			wantTTL:      time.Minute,
+			wantProvider: "example.com/foo/bar",
+		},
+		"relative path": {
+			server:  `capabilities_path = "capabilities.json"`,
+			wantErr: "Invalid capabilities path",
+		},
+		"invalid provider": {
+			mirror:  `probe_provider = "foo/bar"`,
+			wantErr: "Invalid probe provider address",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.mirror + `
+				}
+
+				server {
+					` + test.server + `
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if got := gotConfig.Server.CapabilitiesPath; got != test.wantPath {
+				t.Errorf("wrong path %q; want %q", got, test.wantPath)
+			}
+			if got := gotConfig.Server.CapabilitiesTTL; got != test.wantTTL {
+				t.Errorf("wrong TTL %s; want %s", got, test.wantTTL)
+			}
+			if got := gotConfig.ProviderMirrors["mirror"].ProbeProvider; got != test.wantProvider {
+				t.Errorf("wrong probe provider %q; want %q", got, test.wantProvider)
+			}
+		})
+	}
+}
+
+func TestLoadConfigAcceptHeader(t *testing.T) {
+	tests := map[string]struct {
+		setting string
+		want    AcceptHeader
+		wantErr string
+	}{
+		"default": {
+			setting: "",
+			want:    AcceptHeaderIgnore,
+		},
+		"negotiate": {
+			setting: `accept_header = "negotiate"`,
+			want:    AcceptHeaderNegotiate,
+		},
+		"invalid": {
+			setting: `accept_header = "strict"`,
+			wantErr: "Invalid Accept header handling",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.setting + `
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if got := gotConfig.ProviderMirrors["mirror"].AcceptHeader; got != test.want {
+				t.Errorf("wrong AcceptHeader %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRootResponse(t *testing.T) {
+	tests := map[string]struct {
+		setting      string
+		want         RootResponse
+		wantRedirect string
+		wantErr      string
+	}{
+		"default": {
+			setting: "",
+			want:    RootResponseHTML,
+		},
+		"json": {
+			setting: `root_response = "json"`,
+			want:    RootResponseJSON,
+		},
+		"not found": {
+			setting: `root_response = "not_found"`,
+			want:    RootResponseNotFound,
+		},
+		"redirect": {
+			setting: `
+				root_response     = "redirect"
+				root_redirect_url = "https://docs.example.com/mirror"
+			`,
+			want:         RootResponseRedirect,
+			wantRedirect: "https://docs.example.com/mirror",
+		},
+		"invalid": {
+			setting: `root_response = "teapot"`,
+			wantErr: "Invalid root response",
+		},
+		"redirect without URL": {
+			setting: `root_response = "redirect"`,
+			wantErr: "Missing root redirect URL",
+		},
+		"URL without redirect": {
+			setting: `root_redirect_url = "https://docs.example.com/mirror"`,
+			wantErr: "Root redirect URL requires redirect",
+		},
+		"relative URL": {
+			setting: `
+				root_response     = "redirect"
+				root_redirect_url = "/docs"
+			`,
+			wantErr: "Invalid root redirect URL",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_mirror "mirror" {
+					origin_url     = "http://127.0.0.1:5000/"
+					name_prefix    = "terraform-providers"
+					proxy_packages = false
+					` + test.setting + `
+				}
+
+				server {
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			mirror := gotConfig.ProviderMirrors["mirror"]
+			if got := mirror.RootResponse; got != test.want {
+				t.Errorf("wrong root response %q; want %q", got, test.want)
+			}
+			var gotRedirect string
+			if mirror.RootRedirectURL != nil {
+				gotRedirect = mirror.RootRedirectURL.String()
+			}
+			if gotRedirect != test.wantRedirect {
+				t.Errorf("wrong redirect URL %q; want %q", gotRedirect, test.wantRedirect)
+			}
+		})
+	}
+}
+
+func TestLoadConfigExternalURL(t *testing.T) {
+	src := []byte(`
+		provider_mirror "inherited" {
+			origin_url     = "http://127.0.0.1:5000/"
+			name_prefix    = "terraform-providers"
+			proxy_packages = false
+		}
+
+		provider_mirror "overridden" {
+			origin_url     = "http://127.0.0.1:5000/"
+			name_prefix    = "terraform-providers"
+			proxy_packages = false
+			external_url   = "https://vanity.example.com/providers"
+		}
+
+		server {
+			external_url = "https://registry.example.com/base/"
+		}
+	`)
+	gotConfig, diags := LoadConfig(src, "test.hcl")
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+	if got, want := gotConfig.Server.ExternalURL.String(), "https://registry.example.com/base/"; got != want {
+		t.Errorf("wrong server external URL %q; want %q", got, want)
+	}
+	if got, want := gotConfig.ProviderMirrors["inherited"].ExternalURL.String(), "https://registry.example.com/base/inherited/"; got != want {
+		t.Errorf("wrong inherited external URL %q; want %q", got, want)
+	}
+	if got, want := gotConfig.ProviderMirrors["overridden"].ExternalURL.String(), "https://vanity.example.com/providers/"; got != want {
+		t.Errorf("wrong overridden external URL %q; want %q", got, want)
+	}
+
+	src = []byte(`
+		server {
+			external_url = "/relative/"
+		}
+	`)
+	_, diags = LoadConfig(src, "test.hcl")
+	if !diags.HasErrors() {
+		t.Fatalf("no errors for relative external URL")
+	}
+	if got, want := diags[0].Summary, "Invalid external URL"; got != want {
+		t.Errorf("wrong error summary %q; want %q", got, want)
+	}
+}
+
+func TestLoadConfigTrustedDigestAlgorithms(t *testing.T) {
+	tests := map[string]struct {
+		setting string
+		want    []string
+		wantErr string
+	}{
+		"default": {
+			setting: "",
+			want:    DefaultTrustedDigestAlgorithms,
+		},
+		"sha512 only": {
+			setting: `trusted_digest_algorithms = ["sha512"]`,
+			want:    []string{"sha512"},
+		},
+		"empty": {
+			setting: `trusted_digest_algorithms = []`,
+			wantErr: "Invalid trusted digest algorithms",
+		},
+		"unsupported": {
+			setting: `trusted_digest_algorithms = ["sha256", "blake3"]`,
+			wantErr: "Invalid trusted digest algorithms",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				server {
+					query_string_secret = "0000000000000000000000000000000000000000000000000000000000000000"
+					` + test.setting + `
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if diff := cmp.Diff(test.want, gotConfig.Server.TrustedDigestAlgorithms); diff != "" {
+				t.Errorf("wrong trusted digest algorithms\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLoadConfigProviderRegistry(t *testing.T) {
+	dir := t.TempDir()
+	key := writeTestSigningKeys(t, dir)
+	src := []byte(`
+		provider_registry "registry" {
+			origin_url       = "http://127.0.0.1:5000/"
+			name_prefix      = "terraform-providers"
+			signing_key_file = "signing-key.asc"
+			backend_timeout  = "5s"
+			cache_ttl       = "1m"
+			cache_max_stale = "1h"
+		}
+
+		server {
+			backend_max_concurrency = 4
+		}
+	`)
+	gotConfig, diags := LoadConfig(src, filepath.Join(dir, "test.hcl"))
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+	registry := gotConfig.ProviderRegistries["registry"]
+	if registry == nil {
+		t.Fatalf("no provider registry")
+	}
+	if got, want := registry.OriginURL.String(), "http://127.0.0.1:5000/"; got != want {
+		t.Errorf("wrong origin URL %q; want %q", got, want)
+	}
+	if got, want := registry.NamePrefix, (ocidist.Namespace{"terraform-providers"}); !cmp.Equal(got, want) {
+		t.Errorf("wrong name prefix %#v; want %#v", got, want)
+	}
+	if got, want := registry.Backend, (BackendPolicy{Timeout: 5 * time.Second, MaxConcurrency: 4}); got != want {
+		t.Errorf("wrong backend policy %#v; want %#v", got, want)
+	}
+	if registry.CacheTTL != time.Minute || registry.CacheMaxStale != time.Hour {
+		t.Errorf("wrong cache settings %s and %s; want 1m0s and 1h0m0s", registry.CacheTTL, registry.CacheMaxStale)
+	}
+	if got, want := registry.SigningKey.PrimaryKey.KeyId, key.PrimaryKey.KeyId; got != want {
+		t.Errorf("wrong signing key %016X; want %016X", got, want)
+	}
+	if got, want := gotConfig.ServiceCounts()["provider_registry"], 1; got != want {
+		t.Errorf("wrong service count %d; want %d", got, want)
+	}
+
+	src = []byte(`
+		provider_mirror "shared" {
+			origin_url     = "http://127.0.0.1:5000/"
+			name_prefix    = "terraform-providers"
+			proxy_packages = false
+		}
+		provider_registry "shared" {
+			origin_url       = "http://127.0.0.1:5000/"
+			name_prefix      = "terraform-providers"
+			signing_key_file = "signing-key.asc"
+		}
+
+		server {
+		}
+	`)
+	_, diags = LoadConfig(src, filepath.Join(dir, "test.hcl"))
+	if !diags.HasErrors() {
+		t.Fatalf("no errors for duplicate service name")
+	}
+	if got, want := diags[0].Summary, "Duplicate service name"; got != want {
+		t.Errorf("wrong error summary %q; want %q", got, want)
+	}
+}
+
+func TestLoadConfigProviderRegistrySigningKey(t *testing.T) {
+	dir := t.TempDir()
+	writeTestSigningKeys(t, dir)
+	if err := os.WriteFile(filepath.Join(dir, "garbage.asc"), []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		filename string
+		wantErr  string
+	}{
+		"private key": {
+			filename: "signing-key.asc",
+		},
+		"absolute path": {
+			filename: filepath.Join(dir, "signing-key.asc"),
+		},
+		"public key only": {
+			filename: "public-key.asc",
+			wantErr:  "Invalid signing key",
+		},
+		"not a key": {
+			filename: "garbage.asc",
+			wantErr:  "Invalid signing key",
+		},
+		"missing file": {
+			filename: "nonexistent.asc",
+			wantErr:  "Cannot read signing key file",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				provider_registry "registry" {
+					origin_url       = "http://127.0.0.1:5000/"
+					name_prefix      = "terraform-providers"
+					signing_key_file = "` + filepath.ToSlash(test.filename) + `"
+				}
+
+				server {
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, filepath.Join(dir, "test.hcl"))
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if gotConfig.ProviderRegistries["registry"].SigningKey == nil {
+				t.Errorf("no signing key")
+			}
+		})
+	}
+}
+
+// writeTestSigningKeys generates a new OpenPGP key and writes its private
+// key to signing-key.asc and only its public key to public-key.asc in the
+// given directory, returning the key.
+func writeTestSigningKeys(t *testing.T, dir string) *openpgp.Entity {
+	t.Helper()
+	key, err := openpgp.NewEntity("Test", "", "test@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeArmored := func(filename string, blockType string, serialize func(io.Writer) error) {
+		t.Helper()
+		var buf bytes.Buffer
+		w, err := armor.Encode(&buf, blockType, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := serialize(w); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		if err := os.WriteFile(filepath.Join(dir, filename), buf.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeArmored("signing-key.asc", openpgp.PrivateKeyType, func(w io.Writer) error {
+		return key.SerializePrivate(w, nil)
+	})
+	writeArmored("public-key.asc", openpgp.PublicKeyType, key.Serialize)
+	return key
+}
+
+func TestLoadConfigModuleRegistry(t *testing.T) {
+	tests := map[string]struct {
+		block     string
+		server    string
+		wantProxy bool
+		wantTTL   time.Duration
+		wantErr   string
+	}{
+		"direct": {
+			block: `
+				origin_url  = "http://127.0.0.1:5000/"
+				name_prefix = "terraform-modules"
+			`,
+		},
+		"proxy": {
+			block: `
+				origin_url     = "http://127.0.0.1:5000/"
+				name_prefix    = "terraform-modules"
+				proxy_packages = true
+			`,
+			server:    `query_string_secret = "feedfacefeedfacefeedfacefeedfacefeedfacefeedfacefeedfacefeedface"`,
+			wantProxy: true,
+		},
+		"cached": {
+			block: `
+				origin_url  = "http://127.0.0.1:5000/"
+				name_prefix = "terraform-modules"
+				cache_ttl   = "1m"
+			`,
+			wantTTL: time.Minute,
+		},
+		"proxy without secret": {
+			block: `
+				origin_url     = "http://127.0.0.1:5000/"
+				name_prefix    = "terraform-modules"
+				proxy_packages = true
+			`,
+			wantErr: "Query string secret required for package proxy",
+		},
+		"invalid prefix": {
+			block: `
+				origin_url  = "http://127.0.0.1:5000/"
+				name_prefix = "Terraform Modules"
+			`,
+			wantErr: "Invalid OCI repository name prefix",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			src := []byte(`
+				module_registry "modules" {
+					` + test.block + `
+				}
+
+				server {
+					` + test.server + `
+				}
+			`)
+			gotConfig, diags := LoadConfig(src, "test.hcl")
+			if test.wantErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("no errors; want %q", test.wantErr)
+				}
+				if got := diags[0].Summary; got != test.wantErr {
+					t.Errorf("wrong error summary %q; want %q", got, test.wantErr)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			registry := gotConfig.ModuleRegistries["modules"]
+			if got, want := registry.NamePrefix, (ocidist.Namespace{"terraform-modules"}); !cmp.Equal(got, want) {
+				t.Errorf("wrong name prefix %#v; want %#v", got, want)
+			}
+			if got := registry.ProxyPackages; got != test.wantProxy {
+				t.Errorf("wrong proxy_packages %t; want %t", got, test.wantProxy)
+			}
+			if got := registry.CacheTTL; got != test.wantTTL {
+				t.Errorf("wrong cache TTL %s; want %s", got, test.wantTTL)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+// Package diskcache implements a content-addressed store of blobs in a local
+// directory, for keeping copies of provider packages fetched from an origin
+// registry that survive restarting the server.
+//
+// Each blob is stored in a file named after the hex-encoded part of its
+// digest, in a subdirectory named after the digest algorithm. The directory
+// contents are therefore the whole of the cache's state, and [Open]
+// rebuilds the index of available blobs just by listing them.
+package diskcache
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+)
+
+// ErrNotCached is returned from [Cache.Get] when the cache has no blob with
+// the requested digest.
+var ErrNotCached = errors.New("blob is not cached")
+
+// ErrCorrupt is returned from reading the result of [Cache.Get] when a
+// blob's content doesn't match its digest. The cache has already evicted
+// the blob by the time a caller sees this error.
+var ErrCorrupt = errors.New("cached blob does not match its digest")
+
+// partialSuffix is the filename suffix of a blob that's still being
+// written. A file with this suffix that exists when the cache is opened
+// was left behind by an earlier process that didn't finish writing it.
+const partialSuffix = ".partial"
+
+// algorithms are the digest algorithms whose blobs the cache can store,
+// each of which has a subdirectory of the same name.
+var algorithms = []string{"sha256", "sha512"}
+
+// Cache is a content-addressed store of blobs in a directory.
+//
+// Blobs found in the directory when the cache is opened aren't trusted
+// until they've been read in full once, at which point the cache verifies
+// their digests and evicts any that don't match. Blobs written through
+// [Cache.Put] are verified as they're written.
+type Cache struct {
+	dir string
+
+	// trusted are the digest algorithms whose blobs the cache stores and
+	// serves, or nil for all of the algorithms it supports.
+	trusted []string
+
+	mu      sync.Mutex
+	entries map[ocidist.Digest]*entry
+}
+
+type entry struct {
+	size     int64
+	verified bool
+}
+
+// Open returns a cache that stores blobs in the given directory, creating
+// it if necessary, and indexes the blobs already in it.
+//
+// If trusted is not nil then the cache only stores and serves blobs whose
+// digests use one of the given algorithms, and [Cache.Get] and [Cache.Put]
+// return [ocidist.UntrustedDigestError] for any other digest. Open leaves
+// blobs that use other algorithms on disk but doesn't index them.
+//
+// Open deletes any partially-written blobs left behind by an earlier
+// process. It ignores any other files, and any subdirectories that aren't
+// named after a supported digest algorithm, so that pointing it at the
+// wrong directory can't destroy anything.
+func Open(dir string, trusted []string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &Cache{
+		dir:     dir,
+		trusted: trusted,
+		entries: make(map[ocidist.Digest]*entry),
+	}
+	for _, algorithm := range algorithms {
+		if c.checkAlgorithm(ocidist.Digest(algorithm+":")) != nil {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(dir, algorithm))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if !file.Type().IsRegular() {
+				continue
+			}
+			filename := filepath.Join(dir, algorithm, file.Name())
+			if strings.HasSuffix(file.Name(), partialSuffix) {
+				if err := os.Remove(filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					return nil, fmt.Errorf("failed to remove %s: %w", filename, err)
+				}
+				continue
+			}
+			digest, ok := blobDigest(algorithm, file.Name())
+			if !ok {
+				continue
+			}
+			info, err := file.Info()
+			if err != nil {
+				return nil, err
+			}
+			c.entries[digest] = &entry{size: info.Size()}
+		}
+	}
+	return c, nil
+}
+
+// Len returns the number of blobs in the cache.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Get returns a reader for the content of the blob with the given digest
+// and the blob's size, or [ErrNotCached] if there's no such blob.
+//
+// If the blob hasn't been verified yet then the reader computes its digest
+// while it's read, and returns [ErrCorrupt] instead of [io.EOF] if the
+// digest doesn't match, having evicted the blob. The caller must close the
+// reader.
+func (c *Cache) Get(digest ocidist.Digest) (io.ReadCloser, int64, error) {
+	if err := c.checkAlgorithm(digest); err != nil {
+		return nil, 0, err
+	}
+	c.mu.Lock()
+	e, exists := c.entries[digest]
+	var size int64
+	var verified bool
+	if exists {
+		size, verified = e.size, e.verified
+	}
+	c.mu.Unlock()
+	if !exists {
+		return nil, 0, ErrNotCached
+	}
+
+	f, err := os.Open(c.filename(digest))
+	if errors.Is(err, fs.ErrNotExist) {
+		// Something else removed the file.
+		c.Remove(digest)
+		return nil, 0, ErrNotCached
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if verified {
+		return f, size, nil
+	}
+	dr, err := ocidist.NewDigestingReader(f, digest.Algorithm())
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return &verifyingReader{f: f, dr: dr, cache: c, digest: digest, size: size}, size, nil
+}
+
+// Put stores the content read from r as the blob with the given digest,
+// returning an error without storing anything if the content doesn't match
+// the digest.
+func (c *Cache) Put(digest ocidist.Digest, r io.Reader) error {
+	if err := c.checkAlgorithm(digest); err != nil {
+		return err
+	}
+	filename := c.filename(digest)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(filename), digest.Encoded()+".*"+partialSuffix)
+	if err != nil {
+		return err
+	}
+	tempName := f.Name()
+	defer os.Remove(tempName) // does nothing once the file is renamed
+
+	dr, err := ocidist.NewDigestingReader(r, digest.Algorithm())
+	if err != nil {
+		f.Close()
+		return err
+	}
+	size, err := io.Copy(f, dr)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if got := dr.Digest(); got != digest {
+		return fmt.Errorf("content has digest %s, not %s", got, digest)
+	}
+	if err := os.Rename(tempName, filename); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.entries[digest] = &entry{size: size, verified: true}
+	c.mu.Unlock()
+	return nil
+}
+
+// Remove evicts the blob with the given digest, if it's cached.
+func (c *Cache) Remove(digest ocidist.Digest) error {
+	c.mu.Lock()
+	delete(c.entries, digest)
+	c.mu.Unlock()
+	err := os.Remove(c.filename(digest))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// checkAlgorithm returns an [ocidist.UntrustedDigestError] if the given
+// digest uses an algorithm that the cache doesn't trust.
+func (c *Cache) checkAlgorithm(digest ocidist.Digest) error {
+	if c.trusted == nil {
+		return nil
+	}
+	return digest.CheckAlgorithm(c.trusted)
+}
+
+// markVerified records that the blob with the given digest has been found
+// to match its digest, so that later reads don't need to check it again.
+func (c *Cache) markVerified(digest ocidist.Digest) {
+	c.mu.Lock()
+	if e, exists := c.entries[digest]; exists {
+		e.verified = true
+	}
+	c.mu.Unlock()
+}
+
+// blobDigest returns the digest of the blob that would be stored in a file
+// with the given name in the subdirectory for the given algorithm, or false
+// if that isn't a blob filename.
+func blobDigest(algorithm, name string) (ocidist.Digest, bool) {
+	var size int
+	switch algorithm {
+	case "sha256":
+		size = sha256.Size
+	case "sha512":
+		size = sha512.Size
+	default:
+		return "", false
+	}
+	raw, err := hex.DecodeString(name)
+	if err != nil || len(raw) != size || hex.EncodeToString(raw) != name {
+		return "", false
+	}
+	return ocidist.Digest(algorithm + ":" + name), true
+}
+
+func (c *Cache) filename(digest ocidist.Digest) string {
+	return filepath.Join(c.dir, digest.Algorithm(), digest.Encoded())
+}
+
+// verifyingReader is the reader that [Cache.Get] returns for a blob that
+// hasn't been verified yet.
+type verifyingReader struct {
+	f      *os.File
+	dr     *ocidist.DigestingReader
+	cache  *Cache
+	digest ocidist.Digest
+	size   int64
+	read   int64
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.dr.Read(p)
+	r.read += int64(n)
+	if err != io.EOF {
+		return n, err
+	}
+	if r.read != r.size || r.dr.Digest() != r.digest {
+		r.cache.Remove(r.digest)
+		return n, ErrCorrupt
+	}
+	r.cache.markVerified(r.digest)
+	return n, io.EOF
+}
+
+func (r *verifyingReader) Close() error {
+	return r.f.Close()
+}
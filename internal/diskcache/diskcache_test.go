@@ -0,0 +1,173 @@
+package diskcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+)
+
+func TestOpenExisting(t *testing.T) {
+	dir := t.TempDir()
+	good := []byte("good blob")
+	goodDigest := testDigest(good)
+	corruptDigest := testDigest([]byte("original content"))
+	writeTestFile(t, dir, "sha256/"+goodDigest.Encoded(), good)
+	writeTestFile(t, dir, "sha256/"+corruptDigest.Encoded(), []byte("tampered content"))
+	writeTestFile(t, dir, "sha256/"+goodDigest.Encoded()+".12345"+partialSuffix, []byte("go"))
+	writeTestFile(t, dir, "sha256/junk", []byte("junk"))
+	writeTestFile(t, dir, "other/"+goodDigest.Encoded()+partialSuffix, []byte("not ours"))
+
+	c, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Len(), 2; got != want {
+		t.Fatalf("wrong number of blobs %d; want %d", got, want)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	junk := false
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), partialSuffix) {
+			t.Errorf("Open didn't remove %s", e.Name())
+		}
+		junk = junk || e.Name() == "junk"
+	}
+	if !junk {
+		t.Errorf("Open removed a file that isn't a partially-written blob")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "other", goodDigest.Encoded()+partialSuffix)); err != nil {
+		t.Errorf("Open removed a file outside of the algorithm directories: %s", err)
+	}
+
+	r, size, err := c.Get(goodDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("failed to read good blob: %s", err)
+	}
+	if !bytes.Equal(got, good) || size != int64(len(good)) {
+		t.Errorf("wrong content %q (size %d) for good blob", got, size)
+	}
+	if _, ok := r.(*verifyingReader); !ok {
+		t.Errorf("first read of an indexed blob didn't verify it")
+	}
+	r, _, err = c.Get(goodDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if _, ok := r.(*verifyingReader); ok {
+		t.Errorf("blob still unverified after reading it in full")
+	}
+
+	r, _, err = c.Get(corruptDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(r)
+	r.Close()
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("wrong error %v reading corrupt blob; want ErrCorrupt", err)
+	}
+	if _, _, err := c.Get(corruptDigest); !errors.Is(err, ErrNotCached) {
+		t.Errorf("wrong error %v after reading corrupt blob; want ErrNotCached", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sha256", corruptDigest.Encoded())); !os.IsNotExist(err) {
+		t.Errorf("corrupt blob still on disk")
+	}
+}
+
+func TestPut(t *testing.T) {
+	dir := t.TempDir()
+	c, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("new blob")
+	digest := testDigest(content)
+	if err := c.Put(digest, strings.NewReader("something else")); err == nil {
+		t.Fatalf("Put succeeded with wrong content")
+	}
+	if _, _, err := c.Get(digest); !errors.Is(err, ErrNotCached) {
+		t.Fatalf("wrong error %v after failed Put; want ErrNotCached", err)
+	}
+	if err := c.Put(digest, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new cache in the same directory finds the blob again.
+	c, err = Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Len(), 1; got != want {
+		t.Fatalf("wrong number of blobs %d after reopening; want %d", got, want)
+	}
+	r, _, err := c.Get(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("wrong content %q", got)
+	}
+}
+
+func testDigest(content []byte) ocidist.Digest {
+	sum := sha256.Sum256(content)
+	return ocidist.Digest("sha256:" + hex.EncodeToString(sum[:]))
+}
+
+func writeTestFile(t *testing.T, dir, name string, content []byte) {
+	t.Helper()
+	filename := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUntrustedAlgorithm(t *testing.T) {
+	dir := t.TempDir()
+	blob := []byte("blob")
+	digest := testDigest(blob)
+	writeTestFile(t, dir, "sha256/"+digest.Encoded(), blob)
+
+	c, err := Open(dir, []string{"sha512"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Len(), 0; got != want {
+		t.Errorf("wrong number of blobs %d; want %d", got, want)
+	}
+	if _, _, err := c.Get(digest); !errors.As(err, new(ocidist.UntrustedDigestError)) {
+		t.Errorf("wrong error from Get %v; want UntrustedDigestError", err)
+	}
+	if err := c.Put(digest, bytes.NewReader(blob)); !errors.As(err, new(ocidist.UntrustedDigestError)) {
+		t.Errorf("wrong error from Put %v; want UntrustedDigestError", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sha256", digest.Encoded())); err != nil {
+		t.Errorf("Open removed a blob that uses an untrusted algorithm: %s", err)
+	}
+}
@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AccessLogEntry describes a completed request, for access logging.
+type AccessLogEntry struct {
+	RemoteHost  string
+	Time        time.Time
+	RequestLine string // e.g. "GET /foo HTTP/1.1"
+	Status      int
+	Bytes       int64
+	Referer     string
+	UserAgent   string
+}
+
+// CombinedFormat returns the entry formatted as a line in the Combined Log
+// Format used by Apache httpd and many other servers, without a trailing
+// newline.
+func (e AccessLogEntry) CombinedFormat() string {
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+	return fmt.Sprintf(
+		"%s - - [%s] \"%s\" %d %s \"%s\" \"%s\"",
+		orDash(e.RemoteHost),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		escapeAccessLogString(e.RequestLine),
+		e.Status,
+		bytes,
+		escapeAccessLogString(orDash(e.Referer)),
+		escapeAccessLogString(orDash(e.UserAgent)),
+	)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// escapeAccessLogString escapes quotes, backslashes, and non-printable
+// characters in the same way as Apache httpd does, so that client-provided
+// strings can't break the structure of a log line.
+func escapeAccessLogString(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
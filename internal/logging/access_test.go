@@ -0,0 +1,54 @@
+package logging
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccessLogEntryCombinedFormat(t *testing.T) {
+	zone := time.FixedZone("", -7*60*60)
+	tests := map[string]struct {
+		entry AccessLogEntry
+		want  string
+	}{
+		"full": {
+			AccessLogEntry{
+				RemoteHost:  "192.0.2.1",
+				Time:        time.Date(2000, time.October, 10, 13, 55, 36, 0, zone),
+				RequestLine: "GET /mirror/example.com/foo/bar/index.json HTTP/1.1",
+				Status:      200,
+				Bytes:       2326,
+				Referer:     "http://example.com/start.html",
+				UserAgent:   "Terraform/1.5.0",
+			},
+			`192.0.2.1 - - [10/Oct/2000:13:55:36 -0700] "GET /mirror/example.com/foo/bar/index.json HTTP/1.1" 200 2326 "http://example.com/start.html" "Terraform/1.5.0"`,
+		},
+		"minimal": {
+			AccessLogEntry{
+				RemoteHost:  "192.0.2.1",
+				Time:        time.Date(2000, time.October, 10, 13, 55, 36, 0, zone),
+				RequestLine: "GET / HTTP/1.1",
+				Status:      404,
+			},
+			`192.0.2.1 - - [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.1" 404 - "-" "-"`,
+		},
+		"escaping": {
+			AccessLogEntry{
+				RemoteHost:  "192.0.2.1",
+				Time:        time.Date(2000, time.October, 10, 13, 55, 36, 0, zone),
+				RequestLine: "GET / HTTP/1.1",
+				Status:      200,
+				UserAgent:   "evil\" \\agent\n",
+			},
+			`192.0.2.1 - - [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.1" 200 - "-" "evil\" \\agent\x0a"`,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := test.entry.CombinedFormat()
+			if got != test.want {
+				t.Errorf("wrong result\ngot:  %s\nwant: %s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// AuditEventKind identifies a kind of security-relevant event.
+type AuditEventKind string
+
+const (
+	// AuditClientAuthFailure is when the server refuses a client's request
+	// with a 401 or 403 status.
+	AuditClientAuthFailure AuditEventKind = "client_auth_failure"
+
+	// AuditInvalidDownloadToken is when a client presents a package
+	// download token that is malformed, was tampered with, or has expired.
+	AuditInvalidDownloadToken AuditEventKind = "invalid_download_token"
+
+	// AuditBackendAuthFailure is when an origin registry refuses a request
+	// from the server with a 401 or 403 status.
+	AuditBackendAuthFailure AuditEventKind = "backend_auth_failure"
+
+	// AuditEventsDropped reports how many events the audit log dropped
+	// because they exceeded its rate limit.
+	AuditEventsDropped AuditEventKind = "audit_events_dropped"
+)
+
+// AuditEvent describes a security-relevant event, for audit logging.
+type AuditEvent struct {
+	Time time.Time      `json:"time"`
+	Kind AuditEventKind `json:"event"`
+
+	// Service is the name of the service that the event relates to, if
+	// any.
+	Service string `json:"service,omitempty"`
+
+	// Client is the address of the client whose request caused the event,
+	// and User is the username that the client authenticated as, if known.
+	// Both are empty for events caused by the server's own activity, such
+	// as warming caches.
+	Client string `json:"client,omitempty"`
+	User   string `json:"user,omitempty"`
+
+	// Path is the path of the client's request, without any query string.
+	Path string `json:"path,omitempty"`
+
+	Reason string `json:"reason"`
+}
+
+// AuditLog writes audit events to a writer as JSON objects, one per line.
+//
+// To prevent a flood of events, such as from a client repeatedly guessing
+// credentials, from overwhelming the log's destination, the log writes no
+// more than a maximum number of events in any one second. It counts any
+// further events and reports the count in an [AuditEventsDropped] event
+// along with the next event written in a later second.
+//
+// A nil *AuditLog is valid and discards all events.
+type AuditLog struct {
+	maxPerSecond int
+
+	mu      sync.Mutex
+	w       io.Writer
+	now     func() time.Time
+	window  time.Time // the start of the current second
+	written int       // events written during the current second
+	dropped int       // events dropped since the last report
+}
+
+// NewAuditLog returns an audit log that writes events to the given writer,
+// no more than maxPerSecond of them in any one second. If maxPerSecond is
+// zero then there is no limit.
+func NewAuditLog(w io.Writer, maxPerSecond int) *AuditLog {
+	return &AuditLog{
+		maxPerSecond: maxPerSecond,
+		w:            w,
+		now:          time.Now,
+	}
+}
+
+// Record writes the given event to the log, unless the log has already
+// written its maximum number of events in the current second. If the event
+// has no time then the current time is used.
+func (l *AuditLog) Record(event AuditEvent) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if event.Time.IsZero() {
+		event.Time = now
+	}
+	if window := now.Truncate(time.Second); !window.Equal(l.window) {
+		l.window = window
+		l.written = 0
+		if l.dropped != 0 {
+			l.write(AuditEvent{
+				Time:   now,
+				Kind:   AuditEventsDropped,
+				Reason: fmt.Sprintf("%d events exceeded the audit log's rate limit", l.dropped),
+			})
+			l.dropped = 0
+		}
+	}
+	if l.maxPerSecond != 0 && l.written >= l.maxPerSecond {
+		l.dropped++
+		return
+	}
+	l.write(event)
+}
+
+// write writes a single event. The caller must hold l.mu.
+func (l *AuditLog) write(event AuditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		// Can't happen, because all of the fields are simple types.
+		panic(fmt.Sprintf("failed to serialize audit event: %s", err))
+	}
+	l.w.Write(append(line, '\n'))
+	l.written++
+}
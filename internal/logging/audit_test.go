@@ -0,0 +1,63 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewAuditLog(&buf, 2)
+	start := time.Date(2000, time.October, 10, 13, 55, 36, 0, time.UTC)
+	now := start
+	log.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		log.Record(AuditEvent{
+			Kind:   AuditInvalidDownloadToken,
+			Client: "192.0.2.1",
+			Reason: "expired",
+		})
+	}
+	now = now.Add(1500 * time.Millisecond)
+	log.Record(AuditEvent{
+		Kind:   AuditClientAuthFailure,
+		Client: "192.0.2.2",
+		Path:   "/mirror/example.com/foo/bar/index.json",
+		Reason: "responded with status 401",
+	})
+
+	var got []AuditEvent
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var event AuditEvent
+		if err := dec.Decode(&event); err != nil {
+			t.Fatalf("invalid audit log line: %s", err)
+		}
+		got = append(got, event)
+	}
+	want := []AuditEvent{
+		{Time: start, Kind: AuditInvalidDownloadToken, Client: "192.0.2.1", Reason: "expired"},
+		{Time: start, Kind: AuditInvalidDownloadToken, Client: "192.0.2.1", Reason: "expired"},
+		{Time: now, Kind: AuditEventsDropped, Reason: "3 events exceeded the audit log's rate limit"},
+		{Time: now, Kind: AuditClientAuthFailure, Client: "192.0.2.2", Path: "/mirror/example.com/foo/bar/index.json", Reason: "responded with status 401"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong events\n%s", diff)
+	}
+}
+
+func TestAuditLogUnlimited(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewAuditLog(&buf, 0)
+	for i := 0; i < 500; i++ {
+		log.Record(AuditEvent{Kind: AuditBackendAuthFailure})
+	}
+	if got := bytes.Count(buf.Bytes(), []byte("\n")); got != 500 {
+		t.Errorf("wrote %d events; want 500", got)
+	}
+}
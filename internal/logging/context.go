@@ -10,15 +10,25 @@ func ContextWithLogger(parentCtx context.Context, logger *log.Logger) context.Co
 	return context.WithValue(parentCtx, loggerContextKey, logger)
 }
 
-func ContextLogger(ctx context.Context) *log.Logger {
-	logger := ctx.Value(loggerContextKey).(*log.Logger)
-	if logger == nil {
+// ContextWithLoggerPrefix returns a context whose logger is like that of the
+// given context except that the given string is appended to its prefix.
+func ContextWithLoggerPrefix(parentCtx context.Context, prefix string) context.Context {
+	logger, ok := parentCtx.Value(loggerContextKey).(*log.Logger)
+	if !ok || logger == nil {
 		logger = log.Default()
 	}
-	return logger
+	return ContextWithLogger(parentCtx, log.New(logger.Writer(), logger.Prefix()+prefix, logger.Flags()))
 }
 
-func ContextLoggerRequest(ctx context.Context, f string, args ...any) (*log.Logger, func()) {
+func ContextLogger(ctx context.Context) *Logger {
+	logger, ok := ctx.Value(loggerContextKey).(*log.Logger)
+	if !ok || logger == nil {
+		logger = log.Default()
+	}
+	return NewLogger(logger)
+}
+
+func ContextLoggerRequest(ctx context.Context, f string, args ...any) (*Logger, func()) {
 	logger := ContextLogger(ctx)
 	reqType := fmt.Sprintf(f, args...)
 	logger.Print("BEGIN ", reqType)
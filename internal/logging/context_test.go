@@ -0,0 +1,42 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"testing"
+)
+
+func TestContextLogger(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		// Must not panic, and must return a usable logger.
+		logger := ContextLogger(context.Background())
+		if logger == nil {
+			t.Fatal("no logger returned")
+		}
+	})
+	t.Run("wrong type", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), loggerContextKey, "not a logger")
+		if logger := ContextLogger(ctx); logger == nil {
+			t.Fatal("no logger returned")
+		}
+	})
+	t.Run("populated", func(t *testing.T) {
+		var buf bytes.Buffer
+		ctx := ContextWithLogger(context.Background(), log.New(&buf, "", 0))
+		ContextLogger(ctx).Errorf("hello")
+		if got, want := buf.String(), "error: hello\n"; got != want {
+			t.Errorf("wrong output %q; want %q", got, want)
+		}
+	})
+}
+
+func TestContextWithLoggerPrefix(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := ContextWithLogger(context.Background(), log.New(&buf, "[client] ", log.Lmsgprefix))
+	ctx = ContextWithLoggerPrefix(ctx, "[service] ")
+	ContextLogger(ctx).Errorf("hello")
+	if got, want := buf.String(), "[client] [service] error: hello\n"; got != want {
+		t.Errorf("wrong output %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,114 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// Level is a verbosity level for log messages. Messages are written only if
+// their level is no greater than the current level set using [SetLevel].
+type Level int32
+
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+)
+
+// DefaultLevel is the level used if [SetLevel] is never called.
+const DefaultLevel = LevelInfo
+
+var currentLevel = int32(DefaultLevel)
+
+// SetLevel changes the level of messages that will be written by all
+// loggers.
+func SetLevel(level Level) {
+	atomic.StoreInt32(&currentLevel, int32(level))
+}
+
+// CurrentLevel returns the level most recently set using [SetLevel].
+func CurrentLevel() Level {
+	return Level(atomic.LoadInt32(&currentLevel))
+}
+
+// ParseLevel returns the level with the given name, which is one of "error",
+// "warn", "info", or "debug".
+func ParseLevel(s string) (Level, error) {
+	switch s {
+	case "error":
+		return LevelError, nil
+	case "warn":
+		return LevelWarn, nil
+	case "info":
+		return LevelInfo, nil
+	case "debug":
+		return LevelDebug, nil
+	default:
+		return DefaultLevel, fmt.Errorf("unsupported log level %q; must be error, warn, info, or debug", s)
+	}
+}
+
+func (l Level) String() string {
+	switch l {
+	case LevelError:
+		return "error"
+	case LevelWarn:
+		return "warn"
+	case LevelInfo:
+		return "info"
+	case LevelDebug:
+		return "debug"
+	default:
+		return fmt.Sprintf("Level(%d)", int32(l))
+	}
+}
+
+// Logger wraps a [log.Logger] to filter its messages by level.
+//
+// Print and Printf write messages at the info level, for compatibility with
+// code written for [log.Logger].
+type Logger struct {
+	l *log.Logger
+}
+
+// NewLogger returns a leveled logger that writes to the given logger.
+func NewLogger(l *log.Logger) *Logger {
+	return &Logger{l}
+}
+
+func (l *Logger) logf(level Level, prefix string, f string, args ...any) {
+	if level > CurrentLevel() {
+		return
+	}
+	l.l.Output(3, prefix+fmt.Sprintf(f, args...))
+}
+
+// Errorf writes a message at the error level.
+func (l *Logger) Errorf(f string, args ...any) {
+	l.logf(LevelError, "error: ", f, args...)
+}
+
+// Warnf writes a message at the warn level.
+func (l *Logger) Warnf(f string, args ...any) {
+	l.logf(LevelWarn, "warning: ", f, args...)
+}
+
+// Printf writes a message at the info level.
+func (l *Logger) Printf(f string, args ...any) {
+	l.logf(LevelInfo, "", f, args...)
+}
+
+// Print writes a message at the info level.
+func (l *Logger) Print(args ...any) {
+	if LevelInfo > CurrentLevel() {
+		return
+	}
+	l.l.Output(2, fmt.Sprint(args...))
+}
+
+// Debugf writes a message at the debug level.
+func (l *Logger) Debugf(f string, args ...any) {
+	l.logf(LevelDebug, "debug: ", f, args...)
+}
@@ -0,0 +1,50 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLoggerLevels(t *testing.T) {
+	defer SetLevel(CurrentLevel())
+
+	tests := map[Level]string{
+		LevelError: "error: e\n",
+		LevelWarn:  "error: e\nwarning: w\n",
+		LevelInfo:  "error: e\nwarning: w\ni\ni\n",
+		LevelDebug: "error: e\nwarning: w\ni\ni\ndebug: d\n",
+	}
+	for level, want := range tests {
+		t.Run(level.String(), func(t *testing.T) {
+			SetLevel(level)
+			var buf bytes.Buffer
+			logger := NewLogger(log.New(&buf, "", 0))
+			logger.Errorf("e")
+			logger.Warnf("w")
+			logger.Printf("i")
+			logger.Print("i")
+			logger.Debugf("d")
+			if diff := cmp.Diff(want, buf.String()); diff != "" {
+				t.Errorf("wrong output\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, want := range []Level{LevelError, LevelWarn, LevelInfo, LevelDebug} {
+		got, err := ParseLevel(want.String())
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", want, err)
+		}
+		if got != want {
+			t.Errorf("wrong level for %q: %s", want, got)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("no error for invalid level")
+	}
+}
@@ -0,0 +1,361 @@
+package ocidist
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials are what a [Client] uses to authenticate to a registry that
+// requires it, as set using [Client.SetCredentials].
+type Credentials struct {
+	// Username and Password, if set, are sent using HTTP basic
+	// authentication to the token service that the registry names in its
+	// challenge, or to the registry itself if it asks for basic
+	// authentication. If neither is set then the client requests anonymous
+	// tokens, which some registries require even for public content.
+	Username string
+	Password string
+
+	// Token, if set, is sent to the registry as a bearer token with every
+	// request, instead of obtaining tokens from a token service.
+	Token string
+}
+
+// defaultTokenLifetime is how long a token from a token service remains
+// valid if the token service doesn't say, as specified by the Docker
+// registry token authentication protocol.
+const defaultTokenLifetime = 60 * time.Second
+
+// tokenExpiryMargin is how long before a token expires that the client
+// stops using it, so that it doesn't expire while a request is in transit.
+const tokenExpiryMargin = 5 * time.Second
+
+// tokenAuth obtains and caches the Authorization header values that a
+// [Client] uses for each repository, after the registry has challenged a
+// request for that repository.
+type tokenAuth struct {
+	creds Credentials
+
+	mu      sync.Mutex
+	headers map[string]cachedAuthHeader
+}
+
+type cachedAuthHeader struct {
+	value string
+	// expires is the zero time if the value doesn't expire.
+	expires time.Time
+}
+
+func newTokenAuth(creds Credentials) *tokenAuth {
+	return &tokenAuth{
+		creds:   creds,
+		headers: make(map[string]cachedAuthHeader),
+	}
+}
+
+// cached returns the Authorization header value to use for requests about
+// the repository with the given key, or an empty string if there's no
+// current value.
+func (a *tokenAuth) cached(key string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	header, ok := a.headers[key]
+	if !ok {
+		return ""
+	}
+	if !header.expires.IsZero() && time.Now().After(header.expires) {
+		delete(a.headers, key)
+		return ""
+	}
+	return header.value
+}
+
+func (a *tokenAuth) store(key string, header cachedAuthHeader) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for k, existing := range a.headers {
+		if !existing.expires.IsZero() && now.After(existing.expires) {
+			delete(a.headers, k)
+		}
+	}
+	a.headers[key] = header
+}
+
+// maxAuthResponseSize is the most that the client reads of a token
+// service's response, or of a challenge response that it keeps in case it
+// needs to return it.
+const maxAuthResponseSize = 1 << 20
+
+// authorize returns an Authorization header value that answers the given
+// challenge, fetching a token from the token service the challenge names
+// if necessary, using do to send the token request.
+//
+// It returns [ErrUnauthorized] if the token service rejects the client's
+// credentials, or if the challenge uses a scheme that the client can't
+// answer.
+func (a *tokenAuth) authorize(ctx context.Context, do func(req *http.Request) (*http.Response, error), registryURL *url.URL, challenge authChallenge) (cachedAuthHeader, error) {
+	switch challenge.scheme {
+	case "bearer":
+		return a.fetchToken(ctx, do, registryURL, challenge.params)
+	case "basic":
+		if a.creds.Username == "" && a.creds.Password == "" {
+			return cachedAuthHeader{}, ErrUnauthorized
+		}
+		req := &http.Request{Header: make(http.Header)}
+		req.SetBasicAuth(a.creds.Username, a.creds.Password)
+		return cachedAuthHeader{value: req.Header.Get("Authorization")}, nil
+	default:
+		return cachedAuthHeader{}, ErrUnauthorized
+	}
+}
+
+func (a *tokenAuth) fetchToken(ctx context.Context, do func(req *http.Request) (*http.Response, error), registryURL *url.URL, params map[string]string) (cachedAuthHeader, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return cachedAuthHeader{}, ErrBadGateway
+	}
+	// We'll send the credentials to the token service, so it must be at
+	// least as secure as the registry that named it.
+	if realm.Scheme != "https" && !(realm.Scheme == "http" && registryURL.Scheme == "http") {
+		return cachedAuthHeader{}, ErrBadGateway
+	}
+	query := realm.Query()
+	for _, name := range []string{"service", "scope"} {
+		if v, ok := params[name]; ok {
+			query.Set(name, v)
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", realm.String(), nil)
+	if err != nil {
+		return cachedAuthHeader{}, err
+	}
+	if a.creds.Username != "" || a.creds.Password != "" {
+		req.SetBasicAuth(a.creds.Username, a.creds.Password)
+	}
+	resp, err := do(req)
+	if err != nil {
+		return cachedAuthHeader{}, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == 401 || resp.StatusCode == 403:
+		return cachedAuthHeader{}, ErrUnauthorized
+	case resp.StatusCode != 200:
+		return cachedAuthHeader{}, ErrBadGateway
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxAuthResponseSize)).Decode(&body); err != nil {
+		return cachedAuthHeader{}, ErrBadGateway
+	}
+	token := body.Token
+	if token == "" {
+		// Some token services use the OAuth 2 property name instead.
+		token = body.AccessToken
+	}
+	if token == "" {
+		return cachedAuthHeader{}, ErrBadGateway
+	}
+	lifetime := defaultTokenLifetime
+	if body.ExpiresIn > 0 {
+		lifetime = time.Duration(body.ExpiresIn) * time.Second
+	}
+	if lifetime > 2*tokenExpiryMargin {
+		lifetime -= tokenExpiryMargin
+	}
+	return cachedAuthHeader{
+		value:   "Bearer " + token,
+		expires: time.Now().Add(lifetime),
+	}, nil
+}
+
+// authChallenge is one challenge from a WWW-Authenticate response header.
+type authChallenge struct {
+	// scheme is always lowercase.
+	scheme string
+	// params have lowercase names.
+	params map[string]string
+}
+
+// parseAuthChallenges parses the challenges from the given values of the
+// WWW-Authenticate header, ignoring any that are malformed.
+func parseAuthChallenges(values []string) []authChallenge {
+	var ret []authChallenge
+	for _, value := range values {
+		s := value
+		var current *authChallenge
+		for {
+			s = strings.TrimLeft(s, " \t,")
+			if s == "" {
+				break
+			}
+			var tok string
+			tok, s = splitAuthToken(s)
+			if tok == "" {
+				break // malformed, so ignore the rest of this value
+			}
+			rest := strings.TrimLeft(s, " \t")
+			if current == nil || !strings.HasPrefix(rest, "=") {
+				// A token that isn't a parameter name begins a new
+				// challenge.
+				ret = append(ret, authChallenge{
+					scheme: strings.ToLower(tok),
+					params: make(map[string]string),
+				})
+				current = &ret[len(ret)-1]
+				continue
+			}
+			rest = strings.TrimLeft(rest[1:], " \t")
+			var val string
+			if strings.HasPrefix(rest, `"`) {
+				var ok bool
+				val, s, ok = splitQuotedString(rest)
+				if !ok {
+					break
+				}
+			} else {
+				val, s = splitAuthToken(rest)
+			}
+			current.params[strings.ToLower(tok)] = val
+		}
+	}
+	return ret
+}
+
+// splitAuthToken returns the token at the start of the given string, and
+// the remainder of the string after it.
+func splitAuthToken(s string) (string, string) {
+	i := strings.IndexAny(s, " \t,=\"")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+// splitQuotedString returns the unescaped content of the quoted string at
+// the start of the given string, and the remainder of the string after it,
+// or false if the string isn't terminated.
+func splitQuotedString(s string) (string, string, bool) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			if i < len(s) {
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String(), s[i+1:], true
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", "", false
+}
+
+// authChallengeFor returns the challenge from the given response that the
+// client should try to answer, or false if there isn't one.
+func authChallengeFor(resp *http.Response) (authChallenge, bool) {
+	challenges := parseAuthChallenges(resp.Header.Values("WWW-Authenticate"))
+	// We prefer bearer tokens, because they are scoped to what we're
+	// requesting, but will fall back on basic authentication.
+	for _, scheme := range []string{"bearer", "basic"} {
+		for _, challenge := range challenges {
+			if challenge.scheme == scheme {
+				return challenge, true
+			}
+		}
+	}
+	return authChallenge{}, false
+}
+
+// authScopeKey returns the key under which the client caches the
+// Authorization header for requests to the given URL, which is the
+// repository that the URL refers to, if any.
+func (c *Client) authScopeKey(u *url.URL) string {
+	prefix := c.baseURL.JoinPath("v2").Path + "/"
+	path := strings.TrimPrefix(u.Path, prefix)
+	if path == u.Path {
+		return ""
+	}
+	for _, sep := range []string{"/manifests/", "/blobs/", "/tags/"} {
+		if i := strings.LastIndex(path, sep); i >= 0 {
+			return path[:i]
+		}
+	}
+	return ""
+}
+
+// doAuthenticated sends the given request, which doesn't already have an
+// Authorization header, using the client's credentials. If the registry
+// challenges the request then it obtains an Authorization header value that
+// answers the challenge and retries the request once.
+//
+// If the registry rejects the client's credentials, the result is the
+// registry's "401 Unauthorized" response, as if the client had no
+// credentials.
+func (c *Client) doAuthenticated(client *http.Client, req *http.Request) (*http.Response, error) {
+	if token := c.auth.creds.Token; token != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+token)
+		return c.doRetrying(client, req)
+	}
+
+	key := c.authScopeKey(req.URL)
+	first := req
+	if value := c.auth.cached(key); value != "" {
+		first = req.Clone(req.Context())
+		first.Header.Set("Authorization", value)
+	}
+	resp, err := c.doRetrying(client, first)
+	if err != nil || resp.StatusCode != 401 {
+		return resp, err
+	}
+	challenge, ok := authChallengeFor(resp)
+	if !ok || (req.Body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+	// The challenge response holds a concurrency slot until its body is
+	// closed, and the token request needs a slot of its own, so we keep
+	// only a copy of the body in case we return the response after all.
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxAuthResponseSize))
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	// The token request counts toward the client's concurrency limit and
+	// is observed like any other request, but isn't retried.
+	header, err := c.auth.authorize(req.Context(), func(tokenReq *http.Request) (*http.Response, error) {
+		return c.doLimited(client, tokenReq)
+	}, c.baseURL, challenge)
+	if err == ErrUnauthorized {
+		return resp, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain a token: %w", err)
+	}
+	c.auth.store(key, header)
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Set("Authorization", header.value)
+	return c.doRetrying(client, retry)
+}
@@ -0,0 +1,234 @@
+package ocidist
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseAuthChallenges(t *testing.T) {
+	tests := map[string]struct {
+		values []string
+		want   []authChallenge
+	}{
+		"bearer": {
+			[]string{`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:foo/bar:pull"`},
+			[]authChallenge{
+				{
+					scheme: "bearer",
+					params: map[string]string{
+						"realm":   "https://auth.example.com/token",
+						"service": "registry.example.com",
+						"scope":   "repository:foo/bar:pull",
+					},
+				},
+			},
+		},
+		"several in one value": {
+			[]string{`Basic realm="Registry", BEARER Realm=https://auth.example.com/token, scope="a \"quoted\" scope"`},
+			[]authChallenge{
+				{
+					scheme: "basic",
+					params: map[string]string{"realm": "Registry"},
+				},
+				{
+					scheme: "bearer",
+					params: map[string]string{
+						"realm": "https://auth.example.com/token",
+						"scope": `a "quoted" scope`,
+					},
+				},
+			},
+		},
+		"several values": {
+			[]string{`Negotiate`, `Basic realm="Registry"`},
+			[]authChallenge{
+				{scheme: "negotiate", params: map[string]string{}},
+				{scheme: "basic", params: map[string]string{"realm": "Registry"}},
+			},
+		},
+		"unterminated": {
+			[]string{`Bearer realm="https://auth.example.com/token`},
+			[]authChallenge{
+				{scheme: "bearer", params: map[string]string{}},
+			},
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			got := parseAuthChallenges(test.values)
+			if diff := cmp.Diff(test.want, got, cmp.AllowUnexported(authChallenge{})); diff != "" {
+				t.Errorf("wrong result\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClientSetCredentials(t *testing.T) {
+	var tokenRequests int64
+	var tokenServerURL string
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&tokenRequests, 1)
+		if user, pass, ok := req.BasicAuth(); ok && (user != "user" || pass != "secret") {
+			resp.WriteHeader(401)
+			return
+		}
+		scope := req.URL.Query().Get("scope")
+		if req.URL.Query().Get("service") != "registry.example.com" {
+			t.Errorf("wrong service in token request %s", req.URL)
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		// Some token services use "access_token" instead of "token".
+		if scope == "repository:foo/baz:pull" {
+			resp.Write([]byte(`{"access_token":"baz-token","expires_in":300}`))
+			return
+		}
+		resp.Write([]byte(`{"token":"` + scope + `-token"}`))
+	}))
+	defer tokenServer.Close()
+	tokenServerURL = tokenServer.URL
+
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		var scope, want string
+		switch req.URL.Path {
+		case "/v2/":
+			scope, want = "", "Bearer -token"
+		case "/v2/foo/bar/tags/list":
+			scope, want = "repository:foo/bar:pull", "Bearer repository:foo/bar:pull-token"
+		case "/v2/foo/baz/tags/list":
+			scope, want = "repository:foo/baz:pull", "Bearer baz-token"
+		case "/v2/static/tags/list":
+			want = "Bearer static-token"
+		case "/v2/basic/tags/list":
+			if user, pass, ok := req.BasicAuth(); ok && user == "user" && pass == "secret" {
+				resp.Header().Set("Content-Type", "application/json")
+				resp.Write([]byte(`{"name":"basic","tags":["1.0.0"]}`))
+				return
+			}
+			resp.Header().Set("WWW-Authenticate", `Basic realm="Registry"`)
+			resp.WriteHeader(401)
+			return
+		}
+		if got := req.Header.Get("Authorization"); got != want {
+			challenge := `Bearer realm="` + tokenServerURL + `/token",service="registry.example.com"`
+			if scope != "" {
+				challenge += `,scope="` + scope + `"`
+			}
+			resp.Header().Set("WWW-Authenticate", challenge)
+			resp.Header().Set("Content-Type", "application/json")
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`))
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write([]byte(`{"name":"foo/bar","tags":["1.0.0"]}`))
+	}))
+	defer backend.Close()
+	ctx := context.Background()
+
+	t.Run("token service", func(t *testing.T) {
+		atomic.StoreInt64(&tokenRequests, 0)
+		client := newTestClient(t, backend.URL)
+		client.SetCredentials(Credentials{Username: "user", Password: "secret"})
+		if err := client.CheckAPISupport(ctx); err != nil {
+			t.Fatalf("unexpected error from API check: %s", err)
+		}
+		for i := 0; i < 2; i++ {
+			for _, name := range []string{"foo/bar", "foo/baz"} {
+				tags, err := client.GetNamespaceTags(ctx, MustParseNamespace(name))
+				if err != nil {
+					t.Fatalf("unexpected error for %s: %s", name, err)
+				}
+				if len(tags) != 1 {
+					t.Errorf("wrong tags %#v for %s", tags, name)
+				}
+			}
+		}
+		// The tokens for each repository are reused for the second round
+		// of requests.
+		if got, want := atomic.LoadInt64(&tokenRequests), int64(3); got != want {
+			t.Errorf("wrong number of token requests %d; want %d", got, want)
+		}
+	})
+	t.Run("token requests are limited and observed", func(t *testing.T) {
+		atomic.StoreInt64(&tokenRequests, 0)
+		client := newTestClient(t, backend.URL)
+		client.SetCredentials(Credentials{Username: "user", Password: "secret"})
+		// With only one request slot, the token request can only proceed
+		// if the challenge response has released its slot.
+		client.SetMaxConcurrency(1)
+		var observed []string
+		client.AddObserveResponse(func(obs ResponseObservation) {
+			observed = append(observed, obs.Request.URL.Path)
+		})
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		if _, err := client.GetNamespaceTags(ctx, MustParseNamespace("foo/bar")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		want := []string{"/v2/foo/bar/tags/list", "/token", "/v2/foo/bar/tags/list"}
+		if diff := cmp.Diff(want, observed); diff != "" {
+			t.Errorf("wrong observed requests\n%s", diff)
+		}
+	})
+	t.Run("anonymous", func(t *testing.T) {
+		client := newTestClient(t, backend.URL)
+		client.SetCredentials(Credentials{})
+		if _, err := client.GetNamespaceTags(ctx, MustParseNamespace("foo/bar")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	})
+	t.Run("wrong password", func(t *testing.T) {
+		client := newTestClient(t, backend.URL)
+		client.SetCredentials(Credentials{Username: "user", Password: "wrong"})
+		_, err := client.GetNamespaceTags(ctx, MustParseNamespace("foo/bar"))
+		if err != ErrUnauthorized {
+			t.Errorf("wrong error %#v; want ErrUnauthorized", err)
+		}
+	})
+	t.Run("static token", func(t *testing.T) {
+		atomic.StoreInt64(&tokenRequests, 0)
+		client := newTestClient(t, backend.URL)
+		client.SetCredentials(Credentials{Token: "static-token"})
+		if _, err := client.GetNamespaceTags(ctx, MustParseNamespace("static")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got := atomic.LoadInt64(&tokenRequests); got != 0 {
+			t.Errorf("client requested %d tokens despite having a static token", got)
+		}
+	})
+	t.Run("basic", func(t *testing.T) {
+		client := newTestClient(t, backend.URL)
+		client.SetCredentials(Credentials{Username: "user", Password: "secret"})
+		if _, err := client.GetNamespaceTags(ctx, MustParseNamespace("basic")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	})
+	t.Run("without credentials", func(t *testing.T) {
+		client := newTestClient(t, backend.URL)
+		_, err := client.GetNamespaceTags(ctx, MustParseNamespace("foo/bar"))
+		if err != ErrUnauthorized {
+			t.Errorf("wrong error %#v; want ErrUnauthorized", err)
+		}
+	})
+	t.Run("pass-through header", func(t *testing.T) {
+		client := newTestClient(t, backend.URL)
+		client.SetCredentials(Credentials{Username: "user", Password: "secret"})
+		client.AddPrepareRequest(func(req *http.Request) error {
+			req.Header.Set("Authorization", "Bearer client-token")
+			return nil
+		})
+		// The client doesn't replace an Authorization header it was given,
+		// even if the registry rejects it.
+		_, err := client.GetNamespaceTags(ctx, MustParseNamespace("foo/bar"))
+		if err != ErrUnauthorized {
+			t.Errorf("wrong error %#v; want ErrUnauthorized", err)
+		}
+	})
+}
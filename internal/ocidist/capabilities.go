@@ -0,0 +1,112 @@
+package ocidist
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Capabilities describes which optional features of the OCI Distribution
+// protocol a registry supports, as detected by [Client.ProbeCapabilities].
+//
+// The capabilities that can only be probed using a sample blob are nil if
+// no sample was given.
+type Capabilities struct {
+	// Catalog is whether the registry supports listing its namespaces.
+	Catalog bool
+
+	// Referrers is whether the registry supports the referrers API.
+	Referrers *bool
+
+	// RangeRequests is whether the registry honors the Range header when
+	// returning blob content. This is nil if the registry required
+	// authentication to fetch the sample blob, since the range request
+	// then didn't reach the blob at all.
+	RangeRequests *bool
+
+	// BlobsRequireAuth is whether the registry refused to return the
+	// sample blob without credentials.
+	BlobsRequireAuth *bool
+}
+
+// ProbeCapabilities makes some lightweight requests to the registry to find
+// out which optional protocol features it supports.
+//
+// If blob is not empty then it must be the digest of a blob that exists in
+// the given namespace, which is then used to probe the capabilities that
+// relate to a specific namespace or blob. Those probes are made without
+// any credentials given to [Client.GetBlobContent], but are still subject
+// to the client's request-preparing callbacks.
+//
+// The result describes only what the probes observed, and so a registry
+// might behave differently for other namespaces or for other clients.
+func (c *Client) ProbeCapabilities(ctx context.Context, ns Namespace, blob Digest) (Capabilities, error) {
+	var ret Capabilities
+
+	status, err := c.probe(ctx, nil, "v2", "_catalog")
+	if err != nil {
+		return ret, err
+	}
+	ret.Catalog = status == 200
+
+	if blob == "" {
+		return ret, nil
+	}
+
+	// Registries that support the referrers API return an empty index for
+	// a digest that has no referrers, even if it isn't a manifest.
+	status, err = c.probe(ctx, nil, "v2", ns.String(), "referrers", blob.String())
+	if err != nil {
+		return ret, err
+	}
+	referrers := status == 200
+	ret.Referrers = &referrers
+
+	status, err = c.probe(ctx, http.Header{"Range": {"bytes=0-0"}}, "v2", ns.String(), "blobs", blob.String())
+	if err != nil {
+		return ret, err
+	}
+	requireAuth := status == 401 || status == 403
+	ret.BlobsRequireAuth = &requireAuth
+	if !requireAuth {
+		ranges := status == 206
+		ret.RangeRequests = &ranges
+	}
+
+	return ret, nil
+}
+
+// probe makes a GET request to the given path and returns the status code of
+// the response, discarding its body. The given header fields, if any, are
+// added to the request.
+//
+// An error is returned only if the request couldn't be made at all.
+func (c *Client) probe(ctx context.Context, header http.Header, urlParts ...string) (int, error) {
+	req, err := c.newRequest(ctx, "GET", urlParts...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare request: %s", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if c.timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), c.timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return 0, ErrTimeout
+		}
+		return 0, RequestError{err}
+	}
+	// We only need the status, but reading a little of the body allows the
+	// connection to be reused for small responses.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
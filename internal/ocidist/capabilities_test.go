@@ -0,0 +1,134 @@
+package ocidist
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestClientProbeCapabilities(t *testing.T) {
+	content := []byte("blob content")
+	digest, err := ComputeDigest("sha256", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobPath := "/v2/foo/bar/blobs/" + digest.String()
+	referrersPath := "/v2/foo/bar/referrers/" + digest.String()
+
+	// fullSupport is a backend that supports everything we probe for and
+	// doesn't require authentication.
+	fullSupport := func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v2/_catalog":
+			io.WriteString(resp, `{"repositories":["foo/bar"]}`)
+		case referrersPath:
+			resp.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			io.WriteString(resp, `{"schemaVersion":2,"manifests":[]}`)
+		case blobPath:
+			if req.Header.Get("Range") == "bytes=0-0" {
+				resp.Header().Set("Content-Range", "bytes 0-0/12")
+				resp.WriteHeader(206)
+				resp.Write(content[:1])
+				return
+			}
+			resp.Write(content)
+		default:
+			resp.WriteHeader(404)
+		}
+	}
+	// minimal is a backend that supports only the required parts of the
+	// protocol.
+	minimal := func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case blobPath:
+			resp.Write(content)
+		default:
+			resp.WriteHeader(404)
+		}
+	}
+	// authRequired is a backend that requires credentials for everything.
+	authRequired := func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("WWW-Authenticate", `Bearer realm="https://auth.example.com/token"`)
+		resp.WriteHeader(401)
+	}
+
+	tests := map[string]struct {
+		handler http.HandlerFunc
+		noBlob  bool
+		want    Capabilities
+	}{
+		"full support": {
+			handler: fullSupport,
+			want: Capabilities{
+				Catalog:          true,
+				Referrers:        boolPtr(true),
+				RangeRequests:    boolPtr(true),
+				BlobsRequireAuth: boolPtr(false),
+			},
+		},
+		"full support without sample blob": {
+			handler: fullSupport,
+			noBlob:  true,
+			want: Capabilities{
+				Catalog: true,
+			},
+		},
+		"minimal": {
+			handler: minimal,
+			want: Capabilities{
+				Catalog:          false,
+				Referrers:        boolPtr(false),
+				RangeRequests:    boolPtr(false),
+				BlobsRequireAuth: boolPtr(false),
+			},
+		},
+		"auth required": {
+			handler: authRequired,
+			want: Capabilities{
+				Catalog:          false,
+				Referrers:        boolPtr(false),
+				RangeRequests:    nil,
+				BlobsRequireAuth: boolPtr(true),
+			},
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			backend := httptest.NewServer(test.handler)
+			defer backend.Close()
+			client := newTestClient(t, backend.URL)
+
+			blob := digest
+			if test.noBlob {
+				blob = ""
+			}
+			got, err := client.ProbeCapabilities(context.Background(), MustParseNamespace("foo/bar"), blob)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("wrong result\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		backend := httptest.NewServer(http.HandlerFunc(minimal))
+		client := newTestClient(t, backend.URL)
+		backend.Close()
+
+		_, err := client.ProbeCapabilities(context.Background(), MustParseNamespace("foo/bar"), digest)
+		if _, ok := err.(RequestError); !ok {
+			t.Errorf("wrong error %v; want a request error", err)
+		}
+	})
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
@@ -1,13 +1,19 @@
 package ocidist
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Client is a client for the subset of the OCI distribution protocol that's
@@ -20,7 +26,52 @@ import (
 type Client struct {
 	baseURL    *url.URL
 	prepareReq []func(req *http.Request) error
+	observe    []func(obs ResponseObservation)
 	rawClient  *http.Client
+
+	// timeout is the maximum time to wait for each metadata request, or
+	// zero if there is no timeout.
+	timeout time.Duration
+
+	// requestSlots is a semaphore limiting how many requests can be in
+	// progress at once, or nil if there is no limit.
+	requestSlots chan struct{}
+
+	// prefetchPages enables requesting the next page of a paginated
+	// response while still decoding the current one.
+	prefetchPages bool
+
+	// strictJSON makes the client reject JSON responses that have anything
+	// other than whitespace after the JSON document.
+	strictJSON bool
+
+	// blobIdleTimeout is the maximum time to wait for each read of a blob's
+	// content to return, or zero if there is no limit.
+	blobIdleTimeout time.Duration
+
+	// verifyBlobs makes the client check the content of whole blobs
+	// against their digests while they're being read.
+	verifyBlobs bool
+
+	// trustedAlgorithms are the only digest algorithms that the client
+	// accepts for identifying or verifying content, or nil if it accepts
+	// any algorithm that it supports.
+	trustedAlgorithms []string
+
+	// retry decides which requests the client retries after temporary
+	// failures, and when.
+	retry RetryPolicy
+
+	// auth obtains credentials for requests that don't already have an
+	// Authorization header, or is nil if the client only sends the
+	// Authorization headers it's given.
+	auth *tokenAuth
+
+	// blobRanges remembers whether the registry supports ranged requests
+	// for blob content, once [Client.SupportsBlobRanges] has found out.
+	blobRanges      bool
+	blobRangesMu    sync.Mutex
+	blobRangesKnown bool
 }
 
 // NewClient constructs and returns a new [Client] that will talk to an OCI
@@ -86,6 +137,172 @@ func (c *Client) AddPrepareRequest(cb func(req *http.Request) error) {
 	c.prepareReq = append(c.prepareReq, cb)
 }
 
+// ResponseObservation describes the outcome of one HTTP request that a
+// [Client] made, as passed to the functions registered using
+// [Client.AddObserveResponse].
+type ResponseObservation struct {
+	// Request is the request that was sent. Observers must not modify it.
+	Request *http.Request
+
+	// StatusCode and Header are from the response, or are zero and nil if
+	// there was no response because the request failed.
+	StatusCode int
+	Header     http.Header
+
+	// Duration is how long the registry took to respond with the response
+	// header, not including any time spent waiting for the client's
+	// concurrency limit or reading the response body.
+	Duration time.Duration
+
+	// Err is the error that prevented the client from getting a response,
+	// or nil if there was a response, even if its status code reports
+	// an error.
+	Err error
+}
+
+// AddObserveResponse provides a function that the client will call after
+// each HTTP request it makes, as soon as the response header arrives or the
+// request fails, for cross-cutting concerns such as metrics or tracing.
+//
+// Observers are called synchronously, before the response is handled, and
+// so should return quickly. They receive only a copy of the response header
+// and not the response body, so they can't interfere with how the client
+// reads the response.
+//
+// This must not be called concurrently with any other method of the same
+// client object. Typically it would be called only during the initial setup of
+// the client.
+func (c *Client) AddObserveResponse(cb func(obs ResponseObservation)) {
+	c.observe = append(c.observe, cb)
+}
+
+// SetTimeout sets the maximum time the client will wait for each metadata
+// request to complete, including reading the response body. Zero means no
+// timeout, which is the default.
+//
+// The timeout does not apply to [Client.GetBlobContent], because blobs
+// can be arbitrarily large and so may legitimately take a long time to
+// transfer.
+//
+// This must not be called concurrently with any other method of the same
+// client object.
+func (c *Client) SetTimeout(d time.Duration) {
+	c.timeout = d
+}
+
+// SetBlobIdleTimeout sets the maximum time the client will wait for the
+// registry to send more of a blob's content, when reading from the reader
+// returned by [Client.GetBlobContent] or [Client.GetBlobContentOrLocation].
+// If the registry sends nothing for that long then the request is aborted
+// and the read returns [ErrBlobStalled]. Zero means no limit, which is the
+// default.
+//
+// Only time spent waiting inside a read counts, so a caller that reads
+// slowly, such as when copying to a slow client, doesn't trigger the
+// timeout.
+//
+// This must not be called concurrently with any other method of the same
+// client object.
+func (c *Client) SetBlobIdleTimeout(d time.Duration) {
+	c.blobIdleTimeout = d
+}
+
+// SetVerifyBlobs enables or disables checking that the content of each blob
+// returned by [Client.GetBlobContent] or [Client.GetBlobContentOrLocation]
+// matches the requested digest, which is disabled by default.
+//
+// The client computes the digest while the caller reads the content, so
+// the final read returns [ErrBlobDigestMismatch] instead of [io.EOF] if the
+// content doesn't match, or [ErrBlobTruncated] if the registry sent less
+// content than its Content-Length header promised. Callers that relay the
+// content elsewhere as they read it must therefore treat any error from
+// the reader as a reason to abandon whatever they've relayed so far.
+//
+// This must not be called concurrently with any other method of the same
+// client object.
+func (c *Client) SetVerifyBlobs(enabled bool) {
+	c.verifyBlobs = enabled
+}
+
+// SetTrustedDigestAlgorithms limits the digest algorithms that the client
+// accepts for identifying or verifying manifests and blobs to those in the
+// given list. By default the client accepts any algorithm it supports.
+//
+// Methods that take a digest return an [UntrustedDigestError] if it uses
+// any other algorithm, as does [Client.ResolveDigest] if the registry
+// reports one. If the registry reports an untrusted digest for a manifest
+// fetched by tag, the client identifies the manifest by a digest it
+// computes itself instead.
+//
+// This must not be called concurrently with any other method of the same
+// client object.
+func (c *Client) SetTrustedDigestAlgorithms(algorithms []string) {
+	c.trustedAlgorithms = algorithms
+}
+
+// SetMaxConcurrency sets the maximum number of requests the client will have
+// in progress at once. Additional requests wait until an earlier request is
+// complete, or until their context is cancelled. Zero means no limit, which
+// is the default.
+//
+// For [Client.GetBlobContent], a request remains in progress until the
+// caller closes the returned reader.
+//
+// This must not be called concurrently with any other method of the same
+// client object.
+func (c *Client) SetMaxConcurrency(n int) {
+	if n == 0 {
+		c.requestSlots = nil
+		return
+	}
+	c.requestSlots = make(chan struct{}, n)
+}
+
+// SetCredentials makes the client authenticate to the registry using the
+// given credentials, for requests that don't already have an Authorization
+// header. By default the client sends only the Authorization headers that
+// request-preparation functions or callers provide.
+//
+// Unless the credentials include a static token, the client answers the
+// registry's challenges: if the registry responds to a request with
+// "401 Unauthorized" and a WWW-Authenticate header, the client obtains a
+// bearer token from the token service that the header names, or uses basic
+// authentication if that's what the registry asks for, and then retries the
+// request. It reuses each token for later requests about the same
+// repository until the token expires.
+//
+// This must not be called concurrently with any other method of the same
+// client object.
+func (c *Client) SetCredentials(creds Credentials) {
+	c.auth = newTokenAuth(creds)
+}
+
+// SetPrefetchPages enables or disables prefetching of paginated responses,
+// which is disabled by default. When enabled, the client requests the next
+// page of a paginated response, such as a long tag list, as soon as the
+// current page's response header arrives, overlapping the network latency
+// of each page with decoding the previous one. This means each paginated
+// operation may have two requests in progress at once.
+//
+// This must not be called concurrently with any other method of the same
+// client object.
+func (c *Client) SetPrefetchPages(enabled bool) {
+	c.prefetchPages = enabled
+}
+
+// SetStrictJSON enables or disables rejecting JSON responses, including
+// manifests, that have anything other than whitespace after the JSON
+// document. Such trailing data is invalid per the OCI Distribution
+// specification, but by default the client ignores it. A registry that
+// sends it may have a bug that corrupts or double-encodes its responses,
+// which rejecting them can help to detect.
+//
+// This must not be called concurrently with any other method of the same
+// client object.
+func (c *Client) SetStrictJSON(enabled bool) {
+	c.strictJSON = enabled
+}
+
 // CheckAPISupport attempts to detect whether the client's configured base
 // URL is an implementation of the OCI Distribution specification.
 //
@@ -101,14 +318,16 @@ func (c *Client) CheckAPISupport(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to prepare request: %s", err)
 	}
-	for _, cb := range c.prepareReq {
-		err := cb(req)
-		if err != nil {
-			return RequestError{err}
-		}
+	if c.timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), c.timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
 	}
-	resp, err := c.rawClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return ErrTimeout
+		}
 		return RequestError{err}
 	}
 	defer resp.Body.Close()
@@ -119,7 +338,8 @@ func (c *Client) CheckAPISupport(ctx context.Context) error {
 }
 
 // GetNamespaceTags returns all of the tags that are available for the
-// given namespace in the target registry.
+// given namespace in the target registry, following pagination links as
+// necessary.
 //
 // If the server returns any tag names that aren't valid reference strings per
 // the OCI Distribution specification then this function will silently discard
@@ -133,41 +353,448 @@ func (c *Client) GetNamespaceTags(ctx context.Context, ns Namespace) ([]Referenc
 	type RespBody struct {
 		Tags []string `json:"tags"`
 	}
-	var respBody RespBody
-	err = c.doRequestJSONResp(req, &respBody)
+	ret := make([]Reference, 0)
+	err = getPaginatedJSON(c, req, func(respBody *RespBody) {
+		for _, rawTag := range respBody.Tags {
+			ref, err := ParseReference(rawTag)
+			if err != nil {
+				continue
+			}
+			ret = append(ret, ref)
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
+	return ret, nil
+}
 
-	ret := make([]Reference, 0, len(respBody.Tags))
-	for _, rawTag := range respBody.Tags {
-		ref, err := ParseReference(rawTag)
-		if err != nil {
-			continue
+// GetCatalog returns all of the namespaces that the registry reports in its
+// catalog, following pagination links as necessary.
+//
+// Namespaces that are not valid per [ParseNamespace] are silently ignored.
+//
+// The catalog endpoint is optional in the OCI Distribution specification. If
+// the registry doesn't support it then GetCatalog returns
+// [ErrCatalogNotSupported].
+func (c *Client) GetCatalog(ctx context.Context) ([]Namespace, error) {
+	req, err := c.newRequest(ctx, "GET", "v2", "_catalog")
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare request: %s", err)
+	}
+
+	type RespBody struct {
+		Repositories []string `json:"repositories"`
+	}
+	var ret []Namespace
+	err = getPaginatedJSON(c, req, func(respBody *RespBody) {
+		for _, raw := range respBody.Repositories {
+			ns, err := ParseNamespace(raw)
+			if err != nil {
+				continue
+			}
+			ret = append(ret, ns)
+		}
+	})
+	if err != nil {
+		// The specification calls for registries that don't support
+		// listing the catalog to respond with 404 Not Found.
+		if _, ok := err.(NotFoundError); ok {
+			return nil, ErrCatalogNotSupported
 		}
-		ret = append(ret, ref)
+		return nil, err
 	}
 	return ret, nil
 }
 
 // GetManifest returns the manifest for the given reference associated with
 // the given namespace.
+//
+// If the reference refers to an image index instead of a manifest then
+// GetManifest returns [ErrImageIndex].
 func (c *Client) GetManifest(ctx context.Context, ns Namespace, ref Reference) (*Manifest, error) {
-	req, err := c.newRequest(ctx, "GET", "v2", ns.String(), "manifests", ref.String())
+	raw, err := c.GetManifestRaw(ctx, ns, ref)
 	if err != nil {
-		return nil, fmt.Errorf("failed to prepare request: %s", err)
+		return nil, err
 	}
-	req.Header.Set("Accept", "application/vnd.oci.image.manifest.v1+json, application/vnd.oci.artifact.manifest.v1+json")
+	return decodeManifest(raw, c.strictJSON)
+}
 
-	respBody := &Manifest{}
-	err = c.doRequestJSONResp(req, respBody)
+// GetManifestByDigest is like [Client.GetManifest] but fetches the manifest
+// with the given digest, rather than whichever manifest a tag currently
+// refers to.
+//
+// If the registry returns content that doesn't match the digest then
+// GetManifestByDigest returns [ErrBadGateway]. If the digest uses an
+// algorithm that the client doesn't trust then it returns
+// [UntrustedDigestError] without making any request.
+func (c *Client) GetManifestByDigest(ctx context.Context, ns Namespace, digest Digest) (*Manifest, error) {
+	raw, err := c.getManifestRaw(ctx, ns, digest.String(), digest)
 	if err != nil {
 		return nil, err
 	}
+	return decodeManifest(raw, c.strictJSON)
+}
+
+// decodeManifest decodes the given raw manifest, returning [ErrImageIndex]
+// if it's an image index rather than a manifest. If strict is set then it
+// also rejects a manifest that has trailing data after the JSON object.
+func decodeManifest(raw *RawManifest, strict bool) (*Manifest, error) {
+	if isImageIndexMediaType(raw.MediaType) {
+		return nil, ErrImageIndex
+	}
+
+	var respBody struct {
+		Manifest
+		// Manifests is present only in an image index, which some
+		// registries return without a specific media type.
+		Manifests json.RawMessage `json:"manifests"`
+	}
+	// NOTE: As with other JSON responses, we ignore anything trailing after
+	// the JSON object unless the client is in strict mode.
+	dec := json.NewDecoder(bytes.NewReader(raw.Content))
+	err := dec.Decode(&respBody)
+	if err != nil {
+		return nil, fmt.Errorf("response is not in the expected format: %s", err)
+	}
+	if strict {
+		if err := checkTrailingJSON(dec); err != nil {
+			return nil, err
+		}
+	}
+	if respBody.Manifests != nil && respBody.Layers == nil {
+		return nil, ErrImageIndex
+	}
 	if respBody.SchemaVersion != 2 {
 		return nil, fmt.Errorf("unsupported manifest schema version %#v", respBody.SchemaVersion)
 	}
-	return respBody, nil
+	return &respBody.Manifest, nil
+}
+
+// isImageIndexMediaType returns true if the given media type is one used for
+// image indexes, including the Docker manifest list format that OCI image
+// indexes are based on.
+func isImageIndexMediaType(mediaType string) bool {
+	switch mediaType {
+	case "application/vnd.oci.image.index.v1+json", "application/vnd.docker.distribution.manifest.list.v2+json":
+		return true
+	default:
+		return false
+	}
+}
+
+// RawManifest is a manifest exactly as returned by the registry, along with
+// metadata about it.
+type RawManifest struct {
+	// Content is the manifest's raw JSON representation.
+	Content []byte
+
+	// MediaType is the media type of the manifest as reported in the
+	// response's Content-Type header, or from the manifest's own
+	// "mediaType" property if the response has no Content-Type.
+	MediaType string
+
+	// Digest is the digest of Content. This is the digest that the
+	// registry reported in its Docker-Content-Digest header, after
+	// verifying that it matches, or a digest that the client computed
+	// itself if the registry didn't report one that the client supports
+	// and trusts.
+	Digest Digest
+}
+
+// GetManifestRaw is like [Client.GetManifest] but returns the manifest
+// without decoding it.
+//
+// If the registry reports a digest for the manifest that doesn't match its
+// content then GetManifestRaw returns [ErrBadGateway].
+func (c *Client) GetManifestRaw(ctx context.Context, ns Namespace, ref Reference) (*RawManifest, error) {
+	return c.getManifestRaw(ctx, ns, ref.String(), "")
+}
+
+// getManifestRaw is the main implementation of [Client.GetManifestRaw],
+// taking either a tag or a digest as the reference. If want is not empty
+// then the content must match that digest.
+func (c *Client) getManifestRaw(ctx context.Context, ns Namespace, ref string, want Digest) (*RawManifest, error) {
+	if want != "" {
+		if err := c.checkDigestAlgorithm(want); err != nil {
+			return nil, err
+		}
+	}
+	req, err := c.newRequest(ctx, "GET", "v2", ns.String(), "manifests", ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare request: %s", err)
+	}
+	req.Header.Set("Accept", manifestAcceptHeader)
+	if c.timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), c.timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, ErrTimeout
+		}
+		return nil, RequestError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, errForResponse(resp)
+	}
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, ErrTimeout
+		}
+		return nil, RequestError{err}
+	}
+	if len(content) > maxManifestSize {
+		return nil, ErrBadGateway
+	}
+	if err := errForErrorDocument(content); err != nil {
+		return nil, err
+	}
+
+	ret := &RawManifest{Content: content}
+	if ty, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil {
+		ret.MediaType = ty
+	} else {
+		var withType struct {
+			MediaType string `json:"mediaType"`
+		}
+		if err := json.Unmarshal(content, &withType); err == nil {
+			ret.MediaType = withType.MediaType
+		}
+	}
+
+	if raw := resp.Header.Get("Docker-Content-Digest"); raw != "" {
+		reported, err := ParseDigest(raw)
+		if err != nil {
+			return nil, ErrBadGateway
+		}
+		got, err := ComputeDigest(reported.Algorithm(), content)
+		if err != nil || c.checkDigestAlgorithm(reported) != nil {
+			// We can't verify a digest using an algorithm we don't
+			// support, and won't identify content by one we don't
+			// trust, so we'll use our own instead.
+			got, _ = ComputeDigest(c.ownDigestAlgorithm(), content)
+		} else if got != reported {
+			return nil, ErrBadGateway
+		}
+		ret.Digest = got
+	} else {
+		ret.Digest, _ = ComputeDigest(c.ownDigestAlgorithm(), content)
+	}
+	if want != "" {
+		got, err := ComputeDigest(want.Algorithm(), content)
+		if err != nil || got != want {
+			return nil, ErrBadGateway
+		}
+		ret.Digest = want
+	}
+	return ret, nil
+}
+
+// checkDigestAlgorithm returns an [UntrustedDigestError] if the given digest
+// uses an algorithm that the client doesn't trust.
+func (c *Client) checkDigestAlgorithm(digest Digest) error {
+	if c.trustedAlgorithms == nil {
+		return nil
+	}
+	return digest.CheckAlgorithm(c.trustedAlgorithms)
+}
+
+// ownDigestAlgorithm returns the algorithm that the client uses to compute
+// a manifest's digest when the registry doesn't report one that the client
+// can use. That's SHA-256 unless the client doesn't trust it.
+func (c *Client) ownDigestAlgorithm() string {
+	if c.checkDigestAlgorithm("sha256:") == nil {
+		return "sha256"
+	}
+	for _, algorithm := range c.trustedAlgorithms {
+		if SupportedDigestAlgorithm(algorithm) {
+			return algorithm
+		}
+	}
+	return "sha256"
+}
+
+// maxManifestSize is the largest manifest that [Client.GetManifestRaw] will
+// accept, which is the limit the OCI Distribution specification suggests
+// registries should support.
+const maxManifestSize = 4 * 1024 * 1024
+
+// GetConfigBlob returns the content of the config blob that the given
+// manifest from the given namespace refers to, after verifying that it
+// matches the digest and size in the manifest's config descriptor.
+//
+// A manifest with an empty config, either because the descriptor has size
+// zero or because it's the standard OCI "empty" descriptor whose content is
+// just "{}", produces its content without any request to the registry.
+//
+// If the blob is larger than the registry is willing to serve for metadata,
+// or doesn't match its descriptor, GetConfigBlob returns [ErrBadGateway].
+// If the descriptor's digest uses an algorithm that the client doesn't
+// trust then it returns [UntrustedDigestError].
+func (c *Client) GetConfigBlob(ctx context.Context, ns Namespace, manifest *Manifest) ([]byte, error) {
+	desc := manifest.Config
+	if desc.Size == 0 {
+		return []byte{}, nil
+	}
+	if err := c.checkDigestAlgorithm(desc.Digest); err != nil {
+		return nil, err
+	}
+	if desc.MediaType == emptyConfigMediaType && desc.Size == int64(len(emptyConfigContent)) {
+		if got, err := ComputeDigest(desc.Digest.Algorithm(), []byte(emptyConfigContent)); err == nil && got == desc.Digest {
+			return []byte(emptyConfigContent), nil
+		}
+	}
+	if desc.Size < 0 || desc.Size > maxConfigBlobSize {
+		return nil, ErrBadGateway
+	}
+
+	req, err := c.newRequest(ctx, "GET", "v2", ns.String(), "blobs", desc.Digest.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare request: %s", err)
+	}
+	if c.timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), c.timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, ErrTimeout
+		}
+		return nil, RequestError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, errForResponse(resp)
+	}
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, desc.Size+1))
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, ErrTimeout
+		}
+		return nil, RequestError{err}
+	}
+	if int64(len(content)) != desc.Size {
+		return nil, ErrBadGateway
+	}
+	// We can't trust content whose digest we're unable to verify, so an
+	// unsupported algorithm is treated the same as a mismatch.
+	if got, err := ComputeDigest(desc.Digest.Algorithm(), content); err != nil || got != desc.Digest {
+		return nil, ErrBadGateway
+	}
+	return content, nil
+}
+
+// maxConfigBlobSize is the largest config blob that [Client.GetConfigBlob]
+// will accept. Config blobs are metadata, so this is the same as the limit
+// for manifests.
+const maxConfigBlobSize = maxManifestSize
+
+// emptyConfigMediaType and emptyConfigContent describe the standard empty
+// descriptor from the OCI Image specification, which artifacts that have
+// no meaningful config use as a placeholder.
+const emptyConfigMediaType = "application/vnd.oci.empty.v1+json"
+const emptyConfigContent = "{}"
+
+// ResolveDigest returns the digest of the manifest that the given reference
+// currently refers to in the given namespace, without fetching the manifest
+// itself.
+//
+// This relies on the registry returning the Docker-Content-Digest header in
+// response to a HEAD request, which is optional in the OCI Distribution
+// specification. If the registry doesn't return that header then
+// ResolveDigest returns [ErrBadGateway], or [UntrustedDigestError] if the
+// header's digest uses an algorithm that the client doesn't trust.
+func (c *Client) ResolveDigest(ctx context.Context, ns Namespace, ref Reference) (Digest, error) {
+	req, err := c.newRequest(ctx, "HEAD", "v2", ns.String(), "manifests", ref.String())
+	if err != nil {
+		return "", fmt.Errorf("failed to prepare request: %s", err)
+	}
+	req.Header.Set("Accept", manifestAcceptHeader)
+	if c.timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), c.timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return "", ErrTimeout
+		}
+		return "", RequestError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", errForResponse(resp)
+	}
+
+	digest, err := ParseDigest(resp.Header.Get("Docker-Content-Digest"))
+	if err != nil {
+		return "", ErrBadGateway
+	}
+	if err := c.checkDigestAlgorithm(digest); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+// ManifestExists checks whether the given reference refers to a manifest in
+// the given namespace, without fetching the manifest itself, and if so
+// returns the manifest's digest.
+//
+// As with [Client.ResolveDigest], this returns [ErrBadGateway] if the
+// registry doesn't report the digest of a manifest that exists.
+func (c *Client) ManifestExists(ctx context.Context, ns Namespace, ref Reference) (Digest, bool, error) {
+	digest, err := c.ResolveDigest(ctx, ns, ref)
+	if _, ok := err.(NotFoundError); ok {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return digest, true, nil
+}
+
+// BlobExists checks whether the blob with the given digest exists in the
+// given namespace, without retrieving its content.
+func (c *Client) BlobExists(ctx context.Context, ns Namespace, digest Digest) (bool, error) {
+	req, err := c.newRequest(ctx, "HEAD", "v2", ns.String(), "blobs", digest.String())
+	if err != nil {
+		return false, fmt.Errorf("failed to prepare request: %s", err)
+	}
+	if c.timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), c.timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return false, ErrTimeout
+		}
+		return false, RequestError{err}
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	default:
+		return false, errForResponse(resp)
+	}
 }
 
 // BlobURL returns the full URL for retrieving the content of the object with
@@ -188,34 +815,205 @@ func (c *Client) BlobURL(ns Namespace, digest Digest) *url.URL {
 // Authorization header in the request, overriding any header field of that
 // name added by the configured request-preparing callbacks.
 func (c *Client) GetBlobContent(ctx context.Context, ns Namespace, digest Digest, authHeader string) (http.Header, io.ReadCloser, error) {
+	resp, err := c.getBlob(ctx, ns, digest, authHeader, "", c.rawClient)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		return nil, nil, errForResponse(resp)
+	}
+	body, err := c.blobBody(resp, digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Header, body, nil
+}
+
+// GetBlobContentOrLocation is like [Client.GetBlobContent] except that if
+// the registry responds with a redirect to some other location, such as a
+// presigned URL for a separate storage service, it returns that location
+// instead of following the redirect. In that case the returned header and
+// reader are both nil.
+//
+// If the registry returns the blob content directly then the location is
+// nil and the other results are as for [Client.GetBlobContent].
+func (c *Client) GetBlobContentOrLocation(ctx context.Context, ns Namespace, digest Digest, authHeader string) (*url.URL, http.Header, io.ReadCloser, error) {
+	noRedirectClient := *c.rawClient
+	noRedirectClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := c.getBlob(ctx, ns, digest, authHeader, "", &noRedirectClient)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	switch resp.StatusCode {
+	case 200:
+		body, err := c.blobBody(resp, digest)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return nil, resp.Header, body, nil
+	case 301, 302, 303, 307, 308:
+		defer resp.Body.Close()
+		location, err := resp.Location()
+		if err != nil {
+			return nil, nil, nil, ErrBadGateway
+		}
+		return location, nil, nil, nil
+	default:
+		defer resp.Body.Close()
+		return nil, nil, nil, errForResponse(resp)
+	}
+}
+
+// getBlob sends a request for the content of the given blob, limited to the
+// given byte range, in the syntax of the HTTP Range header, unless byteRange
+// is empty. It returns [UntrustedDigestError] without sending anything if
+// the digest uses an algorithm that the client doesn't trust.
+func (c *Client) getBlob(ctx context.Context, ns Namespace, digest Digest, authHeader string, byteRange string, client *http.Client) (*http.Response, error) {
+	if err := c.checkDigestAlgorithm(digest); err != nil {
+		return nil, err
+	}
+	if c.blobIdleTimeout == 0 {
+		return c.sendBlobRequest(ctx, ns, digest, authHeader, byteRange, client)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	resp, err := c.sendBlobRequest(ctx, ns, digest, authHeader, byteRange, client)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = newIdleTimeoutBody(resp.Body, c.blobIdleTimeout, cancel)
+	return resp, nil
+}
+
+func (c *Client) sendBlobRequest(ctx context.Context, ns Namespace, digest Digest, authHeader string, byteRange string, client *http.Client) (*http.Response, error) {
 	url := c.BlobURL(ns, digest)
-	req, err := http.NewRequest("GET", url.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url.String(), nil)
 	if err != nil {
-		return nil, nil, RequestError{err}
+		return nil, RequestError{err}
 	}
 	for _, cb := range c.prepareReq {
 		err := cb(req)
 		if err != nil {
-			return nil, nil, RequestError{err}
+			return nil, RequestError{err}
 		}
 	}
 	if authHeader != "" {
 		req.Header.Set("Authorization", authHeader)
 	}
-	resp, err := c.rawClient.Get(url.String())
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	resp, err := c.doWithClient(client, req)
 	if err != nil {
-		return nil, nil, RequestError{err}
+		return nil, RequestError{err}
 	}
-	if resp.StatusCode != 200 {
-		defer resp.Body.Close()
-		return nil, nil, errForResponse(resp)
+	return resp, nil
+}
+
+// idleTimeoutBody is a response body that aborts its request, by canceling
+// its context, if any single read waits longer than a timeout.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+
+	stalled atomic.Bool
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *idleTimeoutBody {
+	ret := &idleTimeoutBody{
+		ReadCloser: body,
+		timeout:    timeout,
+		cancel:     cancel,
+	}
+	ret.timer = time.AfterFunc(timeout, func() {
+		ret.stalled.Store(true)
+		cancel()
+	})
+	// The timer runs only during each read.
+	ret.timer.Stop()
+	return ret
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	if b.stalled.Load() {
+		return n, ErrBlobStalled
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// blobBody returns the body of the given successful response for the whole
+// content of the blob with the given digest, verifying the content as it's
+// read if the client is verifying blobs.
+func (c *Client) blobBody(resp *http.Response, digest Digest) (io.ReadCloser, error) {
+	if !c.verifyBlobs {
+		return resp.Body, nil
+	}
+	digester, err := NewDigestingReader(resp.Body, digest.Algorithm())
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("can't verify blob content: %w", err)
 	}
-	return resp.Header, resp.Body, nil
+	return &verifyingBody{
+		ReadCloser: resp.Body,
+		digester:   digester,
+		want:       digest,
+		size:       resp.ContentLength,
+	}, nil
+}
+
+// verifyingBody is a response body that checks that the content it returns
+// matches a digest, once the underlying body is exhausted.
+type verifyingBody struct {
+	io.ReadCloser
+	digester *DigestingReader
+	want     Digest
+
+	// size is the length of the content that the registry promised, or
+	// -1 if it didn't say.
+	size int64
+	read int64
+}
+
+func (b *verifyingBody) Read(p []byte) (int, error) {
+	n, err := b.digester.Read(p)
+	b.read += int64(n)
+	switch err {
+	case io.EOF:
+		// Truncation would also cause a digest mismatch, but it's a more
+		// specific explanation of the problem.
+		if b.size >= 0 && b.read < b.size {
+			return n, ErrBlobTruncated
+		}
+		if b.digester.Digest() != b.want {
+			return n, ErrBlobDigestMismatch
+		}
+	case io.ErrUnexpectedEOF:
+		// The HTTP client reports this if the connection closes before it
+		// has read as much content as the Content-Length header promised.
+		return n, ErrBlobTruncated
+	}
+	return n, err
 }
 
 func (c *Client) newRequest(ctx context.Context, method string, urlParts ...string) (*http.Request, error) {
 	u := c.baseURL.JoinPath(urlParts...)
-	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -230,7 +1028,7 @@ func (c *Client) newRequest(ctx context.Context, method string, urlParts ...stri
 
 func (c *Client) newRequestWithBody(ctx context.Context, method string, body io.Reader, urlParts ...string) (*http.Request, error) {
 	u := c.baseURL.JoinPath(urlParts...)
-	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), body)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
 	if err != nil {
 		return nil, err
 	}
@@ -244,39 +1042,375 @@ func (c *Client) newRequestWithBody(ctx context.Context, method string, body io.
 	return req, nil
 }
 
-func (c *Client) doRequestJSONResp(req *http.Request, into any) error {
-	resp, err := c.rawClient.Do(req)
+// do sends the given request, waiting first if the client is already at
+// its concurrency limit. The caller must close the body of a successful
+// response, which then releases the request's concurrency slot.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	return c.doWithClient(c.rawClient, req)
+}
+
+// doWithClient is like [Client.do] but uses the given HTTP client instead
+// of the client's default one.
+func (c *Client) doWithClient(client *http.Client, req *http.Request) (*http.Response, error) {
+	if c.auth != nil && req.Header.Get("Authorization") == "" {
+		return c.doAuthenticated(client, req)
+	}
+	return c.doRetrying(client, req)
+}
+
+// doLimited sends the given request using the given HTTP client, waiting
+// first if the client is already at its concurrency limit.
+func (c *Client) doLimited(client *http.Client, req *http.Request) (*http.Response, error) {
+	if c.requestSlots == nil {
+		return c.doObserved(client, req)
+	}
+
+	select {
+	case c.requestSlots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	resp, err := c.doObserved(client, req)
 	if err != nil {
-		if err == context.Canceled {
-			return ErrTimeout
+		<-c.requestSlots
+		return nil, err
+	}
+	resp.Body = &releasingBody{
+		ReadCloser: resp.Body,
+		release:    func() { <-c.requestSlots },
+	}
+	return resp, nil
+}
+
+// doObserved sends the given request using the given HTTP client and then
+// passes the outcome to each of the client's response observers.
+func (c *Client) doObserved(client *http.Client, req *http.Request) (*http.Response, error) {
+	if len(c.observe) == 0 {
+		return client.Do(req)
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	obs := ResponseObservation{
+		Request:  req,
+		Duration: time.Since(start),
+		Err:      err,
+	}
+	if resp != nil {
+		obs.StatusCode = resp.StatusCode
+	}
+	for _, cb := range c.observe {
+		// Each observer gets its own copy of the header so that none of
+		// them can affect the response or what the others see.
+		if resp != nil {
+			obs.Header = resp.Header.Clone()
 		}
-		return RequestError{err}
+		cb(obs)
+	}
+	return resp, err
+}
+
+func (c *Client) doRequestJSONResp(req *http.Request, into any) error {
+	_, err := c.doRequestJSONRespHeader(req, into)
+	return err
+}
+
+// getPaginatedJSON makes the given request and decodes its JSON response into
+// a new value of type T, which it passes to the given callback. If the
+// response has a "next" link then it then repeats the process for the
+// linked URL, and so on until a response has no "next" link.
+//
+// If the client has page prefetching enabled then the request for each next
+// page is sent as soon as the previous page's response header arrives,
+// while its body is still being decoded. At most one page is prefetched at
+// a time, and the prefetch request still counts against the client's
+// concurrency limit.
+func getPaginatedJSON[T any](c *Client, req *http.Request, each func(page *T)) error {
+	if c.prefetchPages {
+		return getPaginatedJSONPrefetch(c, req, each)
+	}
+	for page := 0; ; page++ {
+		if page >= maxPages {
+			// The registry's pagination links are probably looping.
+			return ErrBadGateway
+		}
+		var body T
+		header, err := c.doRequestJSONRespHeader(req, &body)
+		if err != nil {
+			return err
+		}
+		each(&body)
+
+		next, err := NextPageURL(header, req.URL)
+		if err != nil {
+			return ErrBadGateway
+		}
+		if next == nil {
+			return nil
+		}
+		req, err = nextPageRequest(req, next)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// getPaginatedJSONPrefetch is the implementation of [getPaginatedJSON] for
+// clients that prefetch pages.
+func getPaginatedJSONPrefetch[T any](c *Client, req *http.Request, each func(page *T)) error {
+	// Cancelling this context abandons any prefetch that's still in
+	// progress when we return early.
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	type pendingPage struct {
+		resp   *http.Response
+		cancel context.CancelFunc
+		err    error
+	}
+	startPage := func(req *http.Request) <-chan pendingPage {
+		ch := make(chan pendingPage, 1)
+		go func() {
+			resp, cancel, err := c.startJSONRequest(req)
+			ch <- pendingPage{resp, cancel, err}
+		}()
+		return ch
+	}
+	// discardPage waits for an abandoned prefetch to finish and then
+	// releases its resources.
+	discardPage := func(ch <-chan pendingPage) {
+		if ch == nil {
+			return
+		}
+		cancel()
+		if pending := <-ch; pending.err == nil {
+			pending.resp.Body.Close()
+			pending.cancel()
+		}
+	}
+
+	current := startPage(req)
+	for page := 0; ; page++ {
+		pending := <-current
+		if pending.err != nil {
+			return pending.err
+		}
+		if page >= maxPages {
+			// The registry's pagination links are probably looping.
+			pending.resp.Body.Close()
+			pending.cancel()
+			return ErrBadGateway
+		}
+
+		var nextPage <-chan pendingPage
+		next, err := NextPageURL(pending.resp.Header, req.URL)
+		if err != nil {
+			pending.resp.Body.Close()
+			pending.cancel()
+			return ErrBadGateway
+		}
+		if next != nil {
+			req, err = nextPageRequest(req, next)
+			if err != nil {
+				pending.resp.Body.Close()
+				pending.cancel()
+				return err
+			}
+			nextPage = startPage(req)
+		}
+
+		var body T
+		err = decodeJSONResponse(pending.resp, &body, c.strictJSON)
+		pending.resp.Body.Close()
+		pending.cancel()
+		if err != nil {
+			discardPage(nextPage)
+			return err
+		}
+		each(&body)
+
+		if nextPage == nil {
+			return nil
+		}
+		current = nextPage
+	}
+}
+
+// nextPageRequest returns a copy of the given request that instead requests
+// the given URL, which [NextPageURL] returned for the request's response.
+//
+// The copy keeps the request's header, including any credentials, so this
+// returns [ErrBadGateway] if the URL has a different scheme or host than the
+// request, rather than sending those credentials elsewhere.
+func nextPageRequest(req *http.Request, next *url.URL) (*http.Request, error) {
+	if next.Scheme != req.URL.Scheme || !strings.EqualFold(next.Host, req.URL.Host) {
+		return nil, ErrBadGateway
 	}
+	req = req.Clone(req.Context())
+	req.URL = next
+	req.Host = ""
+	return req, nil
+}
+
+// maxPages is the maximum number of pages that [getPaginatedJSON] will
+// request before assuming that the registry's pagination links are looping.
+const maxPages = 1000
+
+// doRequestJSONRespHeader is like doRequestJSONResp but also returns the
+// header of a successful response.
+func (c *Client) doRequestJSONRespHeader(req *http.Request, into any) (http.Header, error) {
+	resp, cancel, err := c.startJSONRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
 	defer resp.Body.Close()
 
+	if err := decodeJSONResponse(resp, into, c.strictJSON); err != nil {
+		return nil, err
+	}
+	return resp.Header, nil
+}
+
+// startJSONRequest sends the given request for a JSON document, applying the
+// client's timeout, and returns the response once its header has arrived
+// with a successful status. The caller must close the response body and
+// then call the returned cancel function, whose timeout also covers reading
+// the body.
+func (c *Client) startJSONRequest(req *http.Request) (*http.Response, context.CancelFunc, error) {
+	cancel := context.CancelFunc(func() {})
+	if c.timeout > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(req.Context(), c.timeout)
+		req = req.WithContext(ctx)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		cancel()
+		// A context that was canceled, rather than one whose deadline
+		// passed, typically means that the client we're acting on behalf
+		// of has disconnected, so we report that as an ordinary request
+		// error wrapping context.Canceled, rather than as a timeout.
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, nil, ErrTimeout
+		}
+		return nil, nil, RequestError{err}
+	}
+
 	if resp.StatusCode != 200 {
-		return errForResponse(resp)
+		defer cancel()
+		defer resp.Body.Close()
+		return nil, nil, errForResponse(resp)
 	}
+	return resp, cancel, nil
+}
 
+// decodeJSONResponse decodes the body of a response returned by
+// [Client.startJSONRequest] into the given value.
+//
+// Some registries respond with a successful status but an error document as
+// the body, so in that case this returns the error the document describes,
+// as if the registry had used an error status.
+//
+// If strict is set then this also rejects a body that has anything other than
+// whitespace after the JSON document.
+func decodeJSONResponse(resp *http.Response, into any, strict bool) error {
+	var raw json.RawMessage
 	dec := json.NewDecoder(resp.Body)
-	err = dec.Decode(into)
+	err := dec.Decode(&raw)
+	if err != nil {
+		return fmt.Errorf("response is not in the expected format: %s", err)
+	}
+	// NOTE: Unless strict is set, if there's anything trailing after the
+	// JSON object then we'll just ignore it. That would not be valid per the
+	// OCI Distribution spec but we'll tolerate it by default because it
+	// doesn't hurt and is easier.
+	if strict {
+		if err := checkTrailingJSON(dec); err != nil {
+			return err
+		}
+	}
+	if err := errForErrorDocument(raw); err != nil {
+		return err
+	}
+	err = json.Unmarshal(raw, into)
 	if err != nil {
 		return fmt.Errorf("response is not in the expected format: %s", err)
 	}
-	// NOTE: If there's anything trailing after the JSON object then we'll
-	// just ignore it. That would not be valid per the OCI Distribution spec
-	// but we'll tolerate it anyway because it doesn't hurt and is easier.
 	return nil
 }
 
+// checkTrailingJSON returns an error if the given decoder, which has just
+// decoded a JSON document, has anything other than whitespace remaining in
+// its input.
+func checkTrailingJSON(dec *json.Decoder) error {
+	_, err := dec.Token()
+	var syntaxErr *json.SyntaxError
+	switch {
+	case err == io.EOF:
+		return nil
+	case err == nil || errors.As(err, &syntaxErr):
+		return fmt.Errorf("response is not in the expected format: unexpected data after the JSON document")
+	default:
+		return fmt.Errorf("response is not in the expected format: %s", err)
+	}
+}
+
+// errForErrorDocument returns the error described by the given JSON
+// document if it's an error document as described in the OCI Distribution
+// specification, or nil if it isn't.
+//
+// The first error code in the document decides which error is returned.
+func errForErrorDocument(src []byte) error {
+	var doc struct {
+		Errors []struct {
+			Code string `json:"code"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(src, &doc); err != nil || len(doc.Errors) == 0 {
+		return nil
+	}
+	switch doc.Errors[0].Code {
+	case "BLOB_UNKNOWN", "MANIFEST_UNKNOWN", "NAME_UNKNOWN":
+		return NotFoundError{JSONDesc: json.RawMessage(src)}
+	case "UNAUTHORIZED", "DENIED":
+		return ErrUnauthorized
+	default:
+		return ErrBadGateway
+	}
+}
+
+// releasingBody is a response body that calls a release function the first
+// time it's closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// manifestAcceptHeader is the Accept header value we use when requesting
+// manifests, describing the manifest formats this client understands.
+const manifestAcceptHeader = "application/vnd.oci.image.manifest.v1+json, application/vnd.oci.artifact.manifest.v1+json"
+
 func errForResponse(resp *http.Response) error {
 	switch resp.StatusCode {
 	case 401, 403:
 		return ErrUnauthorized
+	case 408, 504:
+		return ErrBackendTimeout
 	case 404:
 		var jsonErr json.RawMessage
 		ty, _, err := mime.ParseMediaType(resp.Header.Get("content-type"))
-		if err == nil && ty == "application/json" {
+		// Responses to HEAD requests have no body even when the
+		// Content-Type header says JSON.
+		if err == nil && ty == "application/json" && resp.Request.Method != "HEAD" {
 			errSrc, err := io.ReadAll(resp.Body)
 			if err != nil {
 				return ErrBadGateway
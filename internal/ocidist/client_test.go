@@ -0,0 +1,1089 @@
+package ocidist
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestClientResolveDigest(t *testing.T) {
+	const wantDigest = "sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != "HEAD" {
+			t.Errorf("unexpected %s request", req.Method)
+		}
+		switch req.URL.Path {
+		case "/v2/foo/bar/manifests/1.0.0":
+			resp.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			resp.Header().Set("Docker-Content-Digest", wantDigest)
+			resp.WriteHeader(200)
+		case "/v2/foo/bar/manifests/no-digest":
+			resp.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			resp.WriteHeader(200)
+		default:
+			resp.Header().Set("Content-Type", "application/json")
+			resp.WriteHeader(404)
+		}
+	}))
+	defer backend.Close()
+	client := newTestClient(t, backend.URL)
+	ns := MustParseNamespace("foo/bar")
+
+	t.Run("found", func(t *testing.T) {
+		got, err := client.ResolveDigest(context.Background(), ns, MustParseReference("1.0.0"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got != wantDigest {
+			t.Errorf("wrong digest %q; want %q", got, wantDigest)
+		}
+	})
+	t.Run("not found", func(t *testing.T) {
+		_, err := client.ResolveDigest(context.Background(), ns, MustParseReference("2.0.0"))
+		if _, ok := err.(NotFoundError); !ok {
+			t.Errorf("wrong error %#v; want NotFoundError", err)
+		}
+	})
+	t.Run("no digest header", func(t *testing.T) {
+		_, err := client.ResolveDigest(context.Background(), ns, MustParseReference("no-digest"))
+		if err != ErrBadGateway {
+			t.Errorf("wrong error %#v; want ErrBadGateway", err)
+		}
+	})
+}
+
+func TestClientManifestExists(t *testing.T) {
+	const wantDigest = "sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != "HEAD" {
+			t.Errorf("unexpected %s request", req.Method)
+		}
+		switch req.URL.Path {
+		case "/v2/foo/bar/manifests/1.0.0":
+			resp.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			resp.Header().Set("Docker-Content-Digest", wantDigest)
+			resp.WriteHeader(200)
+		case "/v2/foo/bar/manifests/bad-digest":
+			resp.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			resp.Header().Set("Docker-Content-Digest", "not a digest")
+			resp.WriteHeader(200)
+		case "/v2/foo/bar/manifests/broken":
+			resp.WriteHeader(500)
+		default:
+			resp.Header().Set("Content-Type", "application/json")
+			resp.WriteHeader(404)
+		}
+	}))
+	defer backend.Close()
+	client := newTestClient(t, backend.URL)
+	ctx := context.Background()
+	ns := MustParseNamespace("foo/bar")
+
+	got, exists, err := client.ManifestExists(ctx, ns, MustParseReference("1.0.0"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !exists || got != wantDigest {
+		t.Errorf("wrong result (%q, %t); want (%q, true)", got, exists, wantDigest)
+	}
+
+	_, exists, err = client.ManifestExists(ctx, ns, MustParseReference("2.0.0"))
+	if err != nil {
+		t.Fatalf("unexpected error for missing manifest: %s", err)
+	}
+	if exists {
+		t.Errorf("missing manifest reported as existing")
+	}
+
+	_, _, err = client.ManifestExists(ctx, ns, MustParseReference("bad-digest"))
+	if err != ErrBadGateway {
+		t.Errorf("wrong error %#v for invalid digest; want ErrBadGateway", err)
+	}
+	_, _, err = client.ManifestExists(ctx, ns, MustParseReference("broken"))
+	if err == nil {
+		t.Errorf("no error for server error response")
+	}
+}
+
+func TestClientGetBlobContentOrLocation(t *testing.T) {
+	const digestStr = "sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v2/foo/redirect/blobs/" + digestStr:
+			resp.Header().Set("Location", "https://storage.example.com/blob?signature=abc")
+			resp.WriteHeader(307)
+		case "/v2/foo/direct/blobs/" + digestStr:
+			resp.Header().Set("Content-Type", "application/octet-stream")
+			resp.WriteHeader(200)
+			io.WriteString(resp, "hello")
+		default:
+			resp.Header().Set("Content-Type", "application/json")
+			resp.WriteHeader(404)
+			io.WriteString(resp, `{"errors":[{"code":"BLOB_UNKNOWN","message":"not found"}]}`)
+		}
+	}))
+	defer backend.Close()
+	client := newTestClient(t, backend.URL)
+	digest, err := ParseDigest(digestStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("redirect", func(t *testing.T) {
+		location, _, body, err := client.GetBlobContentOrLocation(context.Background(), MustParseNamespace("foo/redirect"), digest, "")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if body != nil {
+			body.Close()
+			t.Error("returned a body for a redirect response")
+		}
+		if location == nil {
+			t.Fatal("no location returned")
+		}
+		if got, want := location.String(), "https://storage.example.com/blob?signature=abc"; got != want {
+			t.Errorf("wrong location %q; want %q", got, want)
+		}
+	})
+	t.Run("direct", func(t *testing.T) {
+		location, _, body, err := client.GetBlobContentOrLocation(context.Background(), MustParseNamespace("foo/direct"), digest, "")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if location != nil {
+			t.Errorf("unexpected location %s", location)
+		}
+		if body == nil {
+			t.Fatal("no body returned")
+		}
+		defer body.Close()
+		got, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("failed to read body: %s", err)
+		}
+		if string(got) != "hello" {
+			t.Errorf("wrong body %q", got)
+		}
+	})
+	t.Run("not found", func(t *testing.T) {
+		_, _, _, err := client.GetBlobContentOrLocation(context.Background(), MustParseNamespace("foo/missing"), digest, "")
+		if _, ok := err.(NotFoundError); !ok {
+			t.Errorf("wrong error %#v; want NotFoundError", err)
+		}
+	})
+}
+
+func TestClientVerifyBlobs(t *testing.T) {
+	content := []byte("hello world")
+	digest, err := ComputeDigest("sha256", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "application/octet-stream")
+		switch req.URL.Path {
+		case "/v2/foo/intact/blobs/" + digest.String():
+			resp.Write(content)
+		case "/v2/foo/corrupted/blobs/" + digest.String():
+			resp.Write([]byte("hello w0rld"))
+		case "/v2/foo/truncated/blobs/" + digest.String():
+			// The server closes the connection after the handler returns
+			// without writing as much as the Content-Length promised.
+			resp.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			resp.Write(content[:5])
+		case "/v2/foo/unsized/blobs/" + digest.String():
+			// Without a Content-Length, a truncated body is detected only
+			// by its digest.
+			resp.Write(content[:5])
+			resp.(http.Flusher).Flush()
+		default:
+			resp.WriteHeader(404)
+		}
+	}))
+	defer backend.Close()
+	ctx := context.Background()
+
+	tests := map[string]struct {
+		verify  bool
+		wantErr error
+	}{
+		"intact":              {true, nil},
+		"corrupted":           {true, ErrBlobDigestMismatch},
+		"truncated":           {true, ErrBlobTruncated},
+		"unsized":             {true, ErrBlobDigestMismatch},
+		"corrupted unchecked": {false, nil},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			client := newTestClient(t, backend.URL)
+			client.SetVerifyBlobs(test.verify)
+			repo := strings.TrimSuffix(name, " unchecked")
+			for _, orLocation := range []bool{false, true} {
+				var body io.ReadCloser
+				var err error
+				if orLocation {
+					_, _, body, err = client.GetBlobContentOrLocation(ctx, MustParseNamespace("foo/"+repo), digest, "")
+				} else {
+					_, body, err = client.GetBlobContent(ctx, MustParseNamespace("foo/"+repo), digest, "")
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				_, err = io.ReadAll(body)
+				body.Close()
+				if err != test.wantErr {
+					t.Errorf("wrong error %v; want %v", err, test.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestClientGetManifestRaw(t *testing.T) {
+	const content = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.hashicorp.terraform-provider.config.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[]}`
+	wantDigest, err := ComputeDigest("sha256", []byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v2/foo/bar/manifests/good":
+			resp.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			resp.Header().Set("Docker-Content-Digest", wantDigest.String())
+		case "/v2/foo/bar/manifests/nodigest":
+			// No Content-Type either, so the media type comes from the
+			// manifest itself.
+			resp.Header()["Content-Type"] = nil
+		case "/v2/foo/bar/manifests/wrongdigest":
+			resp.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			resp.Header().Set("Docker-Content-Digest", "sha256:0000000000000000000000000000000000000000000000000000000000000000")
+		default:
+			resp.WriteHeader(404)
+			return
+		}
+		io.WriteString(resp, content)
+	}))
+	defer backend.Close()
+	client := newTestClient(t, backend.URL)
+	ns := MustParseNamespace("foo/bar")
+
+	for _, ref := range []Reference{"good", "nodigest"} {
+		ref := ref
+		t.Run(ref.String(), func(t *testing.T) {
+			got, err := client.GetManifestRaw(context.Background(), ns, ref)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			want := &RawManifest{
+				Content:   []byte(content),
+				MediaType: "application/vnd.oci.image.manifest.v1+json",
+				Digest:    wantDigest,
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("wrong result\n%s", diff)
+			}
+
+			// GetManifest must decode the same content.
+			manifest, err := client.GetManifest(context.Background(), ns, ref)
+			if err != nil {
+				t.Fatalf("unexpected error from GetManifest: %s", err)
+			}
+			if got, want := manifest.Config.Digest, Digest("sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"); got != want {
+				t.Errorf("wrong config digest %s; want %s", got, want)
+			}
+		})
+	}
+	t.Run("wrongdigest", func(t *testing.T) {
+		_, err := client.GetManifestRaw(context.Background(), ns, "wrongdigest")
+		if err != ErrBadGateway {
+			t.Errorf("wrong error %v; want %v", err, ErrBadGateway)
+		}
+	})
+}
+
+func TestClientGetManifestByDigest(t *testing.T) {
+	const content = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.hashicorp.terraform-provider.config.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[]}`
+	digest, err := ComputeDigest("sha256", []byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDigest, err := ComputeDigest("sha256", []byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v2/foo/bar/manifests/" + digest.String(), "/v2/foo/bar/manifests/" + otherDigest.String():
+			// The registry returns the same content for both digests, so
+			// it's only correct for one of them.
+			resp.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			io.WriteString(resp, content)
+		default:
+			resp.WriteHeader(404)
+		}
+	}))
+	defer backend.Close()
+	client := newTestClient(t, backend.URL)
+	ns := MustParseNamespace("foo/bar")
+
+	manifest, err := client.GetManifestByDigest(context.Background(), ns, digest)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := manifest.Config.Digest, Digest("sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"); got != want {
+		t.Errorf("wrong config digest %s; want %s", got, want)
+	}
+
+	_, err = client.GetManifestByDigest(context.Background(), ns, otherDigest)
+	if err != ErrBadGateway {
+		t.Errorf("wrong error %v for mismatched content; want %v", err, ErrBadGateway)
+	}
+}
+
+func TestClientSetTrustedDigestAlgorithms(t *testing.T) {
+	const content = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.hashicorp.terraform-provider.config.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[]}`
+	sha256Digest, err := ComputeDigest("sha256", []byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha512Digest, err := ComputeDigest("sha512", []byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests []string
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		resp.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		resp.Header().Set("Docker-Content-Digest", sha256Digest.String())
+		io.WriteString(resp, content)
+	}))
+	defer backend.Close()
+	client := newTestClient(t, backend.URL)
+	client.SetTrustedDigestAlgorithms([]string{"sha512"})
+	ctx := context.Background()
+	ns := MustParseNamespace("foo/bar")
+
+	t.Run("manifest by tag", func(t *testing.T) {
+		// The registry's SHA-256 digest isn't trusted, so the client
+		// identifies the manifest by its own SHA-512 digest instead.
+		got, err := client.GetManifestRaw(ctx, ns, "good")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got.Digest != sha512Digest {
+			t.Errorf("wrong digest %s; want %s", got.Digest, sha512Digest)
+		}
+	})
+	t.Run("manifest by digest", func(t *testing.T) {
+		requests = nil
+		_, err := client.GetManifestByDigest(ctx, ns, sha256Digest)
+		if _, ok := err.(UntrustedDigestError); !ok {
+			t.Errorf("wrong error %v; want UntrustedDigestError", err)
+		}
+		if len(requests) != 0 {
+			t.Errorf("unexpected requests %q", requests)
+		}
+	})
+	t.Run("resolve digest", func(t *testing.T) {
+		_, err := client.ResolveDigest(ctx, ns, "good")
+		if _, ok := err.(UntrustedDigestError); !ok {
+			t.Errorf("wrong error %v; want UntrustedDigestError", err)
+		}
+	})
+	t.Run("blob", func(t *testing.T) {
+		requests = nil
+		_, _, err := client.GetBlobContent(ctx, ns, sha256Digest, "")
+		if _, ok := err.(UntrustedDigestError); !ok {
+			t.Errorf("wrong error %v; want UntrustedDigestError", err)
+		}
+		if len(requests) != 0 {
+			t.Errorf("unexpected requests %q", requests)
+		}
+	})
+}
+
+func TestClientGetManifestImageIndex(t *testing.T) {
+	const index = `{"schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2}]}`
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v2/foo/bar/manifests/oci":
+			resp.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		case "/v2/foo/bar/manifests/docker":
+			resp.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.list.v2+json")
+		case "/v2/foo/bar/manifests/untyped":
+			resp.Header().Set("Content-Type", "application/json")
+		default:
+			resp.WriteHeader(404)
+			return
+		}
+		io.WriteString(resp, index)
+	}))
+	defer backend.Close()
+	client := newTestClient(t, backend.URL)
+	ns := MustParseNamespace("foo/bar")
+
+	for _, ref := range []Reference{"oci", "docker", "untyped"} {
+		ref := ref
+		t.Run(ref.String(), func(t *testing.T) {
+			_, err := client.GetManifest(context.Background(), ns, ref)
+			if err != ErrImageIndex {
+				t.Errorf("wrong error %v; want %v", err, ErrImageIndex)
+			}
+		})
+	}
+}
+
+func TestClientGetConfigBlob(t *testing.T) {
+	const content = `{"provider":"example"}`
+	digest, err := ComputeDigest("sha256", []byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const missing = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	var requests int
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requests++
+		switch req.URL.Path {
+		case "/v2/foo/bar/blobs/" + digest.String():
+			io.WriteString(resp, content)
+		case "/v2/foo/tampered/blobs/" + digest.String():
+			io.WriteString(resp, `{"provider":"evil!!"}`)
+		default:
+			resp.WriteHeader(404)
+		}
+	}))
+	defer backend.Close()
+	client := newTestClient(t, backend.URL)
+
+	configManifest := func(desc ObjectMeta) *Manifest {
+		return &Manifest{SchemaVersion: 2, Config: desc}
+	}
+	tests := map[string]struct {
+		ns           string
+		desc         ObjectMeta
+		want         string
+		wantErr      error
+		wantRequests int
+	}{
+		"valid": {
+			ns:           "foo/bar",
+			desc:         ObjectMeta{MediaType: "application/json", Digest: digest, Size: int64(len(content))},
+			want:         content,
+			wantRequests: 1,
+		},
+		"wrong content": {
+			ns:           "foo/tampered",
+			desc:         ObjectMeta{MediaType: "application/json", Digest: digest, Size: int64(len(content))},
+			wantErr:      ErrBadGateway,
+			wantRequests: 1,
+		},
+		"wrong size": {
+			ns:           "foo/bar",
+			desc:         ObjectMeta{MediaType: "application/json", Digest: digest, Size: 5},
+			wantErr:      ErrBadGateway,
+			wantRequests: 1,
+		},
+		"too large": {
+			ns:           "foo/bar",
+			desc:         ObjectMeta{MediaType: "application/json", Digest: digest, Size: maxConfigBlobSize + 1},
+			wantErr:      ErrBadGateway,
+			wantRequests: 0,
+		},
+		"missing": {
+			ns:           "foo/bar",
+			desc:         ObjectMeta{MediaType: "application/json", Digest: missing, Size: 10},
+			wantErr:      NotFoundError{},
+			wantRequests: 1,
+		},
+		"zero size": {
+			ns:           "foo/bar",
+			desc:         ObjectMeta{MediaType: "application/json", Digest: missing, Size: 0},
+			want:         "",
+			wantRequests: 0,
+		},
+		"standard empty": {
+			ns:           "foo/bar",
+			desc:         ObjectMeta{MediaType: "application/vnd.oci.empty.v1+json", Digest: "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a", Size: 2},
+			want:         "{}",
+			wantRequests: 0,
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			requests = 0
+			got, err := client.GetConfigBlob(context.Background(), MustParseNamespace(test.ns), configManifest(test.desc))
+			if requests != test.wantRequests {
+				t.Errorf("made %d requests; want %d", requests, test.wantRequests)
+			}
+			if test.wantErr != nil {
+				if err == nil {
+					t.Fatalf("no error; want %#v", test.wantErr)
+				}
+				if _, isNotFound := test.wantErr.(NotFoundError); isNotFound {
+					if _, ok := err.(NotFoundError); !ok {
+						t.Errorf("wrong error %#v; want NotFoundError", err)
+					}
+				} else if err != test.wantErr {
+					t.Errorf("wrong error %#v; want %#v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(got) != test.want {
+				t.Errorf("wrong content %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestClientBlobExists(t *testing.T) {
+	const present = "sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+	const missing = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != "HEAD" {
+			t.Errorf("unexpected %s request", req.Method)
+		}
+		switch req.URL.Path {
+		case "/v2/foo/bar/blobs/" + present:
+			resp.WriteHeader(200)
+		case "/v2/foo/broken/blobs/" + present:
+			resp.WriteHeader(500)
+		default:
+			resp.WriteHeader(404)
+		}
+	}))
+	defer backend.Close()
+	client := newTestClient(t, backend.URL)
+
+	got, err := client.BlobExists(context.Background(), MustParseNamespace("foo/bar"), present)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !got {
+		t.Errorf("existing blob reported as missing")
+	}
+	got, err = client.BlobExists(context.Background(), MustParseNamespace("foo/bar"), missing)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got {
+		t.Errorf("missing blob reported as existing")
+	}
+	_, err = client.BlobExists(context.Background(), MustParseNamespace("foo/broken"), present)
+	if err == nil {
+		t.Errorf("no error for server error response")
+	}
+}
+
+func TestClientGetCatalog(t *testing.T) {
+	t.Run("paginated", func(t *testing.T) {
+		backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/v2/_catalog" {
+				t.Errorf("unexpected request for %s", req.URL.Path)
+				resp.WriteHeader(404)
+				return
+			}
+			resp.Header().Set("Content-Type", "application/json")
+			switch req.URL.Query().Get("last") {
+			case "":
+				resp.Header().Set("Link", `</v2/_catalog?last=foo%2Fbar&n=2>; rel="next"`)
+				io.WriteString(resp, `{"repositories":["foo/baz","foo/bar"]}`)
+			case "foo/bar":
+				io.WriteString(resp, `{"repositories":["Not Valid","foo/qux"]}`)
+			default:
+				t.Errorf("unexpected last=%q", req.URL.Query().Get("last"))
+				resp.WriteHeader(404)
+			}
+		}))
+		defer backend.Close()
+		client := newTestClient(t, backend.URL)
+
+		got, err := client.GetCatalog(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var gotStrs []string
+		for _, ns := range got {
+			gotStrs = append(gotStrs, ns.String())
+		}
+		want := []string{"foo/baz", "foo/bar", "foo/qux"}
+		if diff := cmp.Diff(want, gotStrs); diff != "" {
+			t.Errorf("wrong result\n%s", diff)
+		}
+	})
+	t.Run("not supported", func(t *testing.T) {
+		backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			resp.Header().Set("Content-Type", "application/json")
+			resp.WriteHeader(404)
+			io.WriteString(resp, `{"errors":[{"code":"UNSUPPORTED"}]}`)
+		}))
+		defer backend.Close()
+		client := newTestClient(t, backend.URL)
+
+		_, err := client.GetCatalog(context.Background())
+		if err != ErrCatalogNotSupported {
+			t.Errorf("wrong error\ngot:  %v\nwant: %v", err, ErrCatalogNotSupported)
+		}
+	})
+}
+
+func TestClientGetNamespaceTagsPaginated(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v2/foo/bar/tags/list" {
+			t.Errorf("unexpected request for %s", req.URL.Path)
+			resp.WriteHeader(404)
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		switch req.URL.Query().Get("last") {
+		case "":
+			resp.Header().Set("Link", `</v2/foo/bar/tags/list?last=1.1.0&n=2>; rel="next"`)
+			io.WriteString(resp, `{"name":"foo/bar","tags":["1.0.0","1.1.0"]}`)
+		case "1.1.0":
+			io.WriteString(resp, `{"name":"foo/bar","tags":["2.0.0"]}`)
+		default:
+			t.Errorf("unexpected last=%q", req.URL.Query().Get("last"))
+			resp.WriteHeader(404)
+		}
+	}))
+	defer backend.Close()
+
+	for _, prefetch := range []bool{false, true} {
+		prefetch := prefetch
+		t.Run(fmt.Sprintf("prefetch=%t", prefetch), func(t *testing.T) {
+			client := newTestClient(t, backend.URL)
+			client.SetPrefetchPages(prefetch)
+			// Prefetching must not deadlock waiting for the concurrency
+			// slot held by the page still being decoded.
+			client.SetMaxConcurrency(1)
+
+			got, err := client.GetNamespaceTags(context.Background(), MustParseNamespace("foo/bar"))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			want := []Reference{"1.0.0", "1.1.0", "2.0.0"}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("wrong result\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClientPaginatedCrossOrigin(t *testing.T) {
+	var otherRequests int64
+	other := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&otherRequests, 1)
+		if got := req.Header.Get("Authorization"); got != "" {
+			t.Errorf("other server received Authorization header %q", got)
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		io.WriteString(resp, `{"name":"foo/bar","tags":["2.0.0"]}`)
+	}))
+	defer other.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Header().Set("Link", `<`+other.URL+`/v2/foo/bar/tags/list?last=1.1.0&n=2>; rel="next"`)
+		io.WriteString(resp, `{"name":"foo/bar","tags":["1.0.0","1.1.0"]}`)
+	}))
+	defer backend.Close()
+
+	for _, prefetch := range []bool{false, true} {
+		prefetch := prefetch
+		t.Run(fmt.Sprintf("prefetch=%t", prefetch), func(t *testing.T) {
+			client := newTestClient(t, backend.URL)
+			client.SetPrefetchPages(prefetch)
+			client.AddPrepareRequest(func(req *http.Request) error {
+				req.Header.Set("Authorization", "Bearer secret")
+				return nil
+			})
+
+			_, err := client.GetNamespaceTags(context.Background(), MustParseNamespace("foo/bar"))
+			if err != ErrBadGateway {
+				t.Errorf("wrong error %v; want %v", err, ErrBadGateway)
+			}
+			if got := atomic.LoadInt64(&otherRequests); got != 0 {
+				t.Errorf("client followed the cross-origin link %d times", got)
+			}
+		})
+	}
+}
+
+func TestClientPrefetchPagesError(t *testing.T) {
+	// The first page is malformed, so the prefetched second page must be
+	// abandoned without leaking its response.
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "application/json")
+		if req.URL.Query().Get("last") == "" {
+			resp.Header().Set("Link", `</v2/foo/bar/tags/list?last=1.0.0>; rel="next"`)
+			io.WriteString(resp, `{"name":"foo/bar","tags":[`)
+			return
+		}
+		io.WriteString(resp, `{"name":"foo/bar","tags":["2.0.0"]}`)
+	}))
+	defer backend.Close()
+	client := newTestClient(t, backend.URL)
+	client.SetPrefetchPages(true)
+	client.SetMaxConcurrency(1)
+
+	_, err := client.GetNamespaceTags(context.Background(), MustParseNamespace("foo/bar"))
+	if err == nil {
+		t.Fatalf("no error for malformed page")
+	}
+
+	// This would block forever if either request had failed to release
+	// its concurrency slot.
+	if _, err := client.GetNamespaceTags(context.Background(), MustParseNamespace("foo/bar")); err == nil {
+		t.Fatalf("no error for malformed page on second attempt")
+	}
+}
+
+// BenchmarkClientGetNamespaceTags compares fetching a long paginated tag
+// list with and without page prefetching, from a registry with some
+// latency for each request and that takes some time to send each body.
+func BenchmarkClientGetNamespaceTags(b *testing.B) {
+	const pages = 20
+	const perPage = 500
+	var pageBodies [pages]string
+	for i := range pageBodies {
+		tags := make([]string, perPage)
+		for j := range tags {
+			tags[j] = fmt.Sprintf("%d.%d.0", i, j)
+		}
+		src, err := json.Marshal(map[string]any{"name": "foo/bar", "tags": tags})
+		if err != nil {
+			b.Fatal(err)
+		}
+		pageBodies[i] = string(src)
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		time.Sleep(time.Millisecond) // simulated network latency
+		page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+		resp.Header().Set("Content-Type", "application/json")
+		if page+1 < pages {
+			resp.Header().Set("Link", fmt.Sprintf(`</v2/foo/bar/tags/list?page=%d>; rel="next"`, page+1))
+		}
+		resp.WriteHeader(200)
+		resp.(http.Flusher).Flush()
+		time.Sleep(2 * time.Millisecond) // simulated time to transfer the body
+		io.WriteString(resp, pageBodies[page])
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL + "/")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, prefetch := range []bool{false, true} {
+		prefetch := prefetch
+		b.Run(fmt.Sprintf("prefetch=%t", prefetch), func(b *testing.B) {
+			client := NewClient(u)
+			client.SetPrefetchPages(prefetch)
+			for i := 0; i < b.N; i++ {
+				got, err := client.GetNamespaceTags(context.Background(), MustParseNamespace("foo/bar"))
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(got) != pages*perPage {
+					b.Fatalf("got %d tags; want %d", len(got), pages*perPage)
+				}
+			}
+		})
+	}
+}
+
+func TestClientErrorDocumentWithSuccessStatus(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/v2/foo/missing/tags/list":
+			io.WriteString(resp, `{"errors":[{"code":"NAME_UNKNOWN","message":"repository name not known to registry"}]}`)
+		case "/v2/foo/denied/tags/list":
+			io.WriteString(resp, `{"errors":[{"code":"DENIED","message":"requested access to the resource is denied"}]}`)
+		case "/v2/foo/limited/tags/list":
+			io.WriteString(resp, `{"errors":[{"code":"TOOMANYREQUESTS","message":"too many requests"}]}`)
+		case "/v2/foo/bar/manifests/1.0.0":
+			io.WriteString(resp, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`)
+		default:
+			resp.WriteHeader(404)
+		}
+	}))
+	defer backend.Close()
+	client := newTestClient(t, backend.URL)
+	ctx := context.Background()
+
+	_, err := client.GetNamespaceTags(ctx, MustParseNamespace("foo/missing"))
+	if _, ok := err.(NotFoundError); !ok {
+		t.Errorf("wrong error for unknown name %v; want not found", err)
+	}
+	_, err = client.GetNamespaceTags(ctx, MustParseNamespace("foo/denied"))
+	if err != ErrUnauthorized {
+		t.Errorf("wrong error for denied access %v; want %v", err, ErrUnauthorized)
+	}
+	_, err = client.GetNamespaceTags(ctx, MustParseNamespace("foo/limited"))
+	if err != ErrBadGateway {
+		t.Errorf("wrong error for other error code %v; want %v", err, ErrBadGateway)
+	}
+	_, err = client.GetManifest(ctx, MustParseNamespace("foo/bar"), MustParseReference("1.0.0"))
+	if _, ok := err.(NotFoundError); !ok {
+		t.Errorf("wrong error for unknown manifest %v; want not found", err)
+	}
+}
+
+func TestClientStrictJSON(t *testing.T) {
+	const manifest = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[]}`
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v2/foo/bar/manifests/garbage":
+			resp.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			io.WriteString(resp, manifest+"garbage")
+		case "/v2/foo/bar/manifests/twice":
+			resp.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			io.WriteString(resp, manifest+manifest)
+		case "/v2/foo/bar/manifests/whitespace":
+			resp.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			io.WriteString(resp, manifest+"\n\n")
+		case "/v2/foo/bar/tags/list":
+			resp.Header().Set("Content-Type", "application/json")
+			io.WriteString(resp, `{"name":"foo/bar","tags":["1.0.0"]}}`)
+		default:
+			resp.WriteHeader(404)
+		}
+	}))
+	defer backend.Close()
+	ctx := context.Background()
+	ns := MustParseNamespace("foo/bar")
+
+	for _, strict := range []bool{false, true} {
+		strict := strict
+		t.Run(fmt.Sprintf("strict=%t", strict), func(t *testing.T) {
+			client := newTestClient(t, backend.URL)
+			client.SetStrictJSON(strict)
+
+			for _, ref := range []Reference{"garbage", "twice"} {
+				_, err := client.GetManifest(ctx, ns, ref)
+				switch {
+				case strict && err == nil:
+					t.Errorf("unexpected success for %s", ref)
+				case strict && !strings.Contains(err.Error(), "unexpected data after the JSON document"):
+					t.Errorf("wrong error for %s: %s", ref, err)
+				case !strict && err != nil:
+					t.Errorf("unexpected error for %s: %s", ref, err)
+				}
+			}
+			if _, err := client.GetManifest(ctx, ns, "whitespace"); err != nil {
+				t.Errorf("unexpected error for trailing whitespace: %s", err)
+			}
+
+			_, err := client.GetNamespaceTags(ctx, ns)
+			switch {
+			case strict && err == nil:
+				t.Errorf("unexpected success for tag list")
+			case !strict && err != nil:
+				t.Errorf("unexpected error for tag list: %s", err)
+			}
+		})
+	}
+}
+
+func TestClientObserveResponse(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v2/foo/bar/tags/list":
+			resp.Header().Set("Content-Type", "application/json")
+			resp.Header().Set("X-Example", "tags")
+			resp.Write([]byte(`{"name":"foo/bar","tags":["1.0.0"]}`))
+		default:
+			resp.WriteHeader(404)
+		}
+	}))
+	defer backend.Close()
+
+	type observation struct {
+		Path       string
+		StatusCode int
+		Example    string
+		HasErr     bool
+	}
+	var got []observation
+	var gotSecond int
+	client := newTestClient(t, backend.URL)
+	client.AddObserveResponse(func(obs ResponseObservation) {
+		o := observation{
+			Path:       obs.Request.URL.Path,
+			StatusCode: obs.StatusCode,
+			HasErr:     obs.Err != nil,
+		}
+		if obs.Header != nil {
+			o.Example = obs.Header.Get("X-Example")
+			// Changing the header must not affect the client or any
+			// other observer.
+			obs.Header.Set("Content-Type", "text/plain")
+			obs.Header.Set("X-Example", "modified")
+		}
+		if obs.Duration <= 0 {
+			t.Errorf("observation for %s has no duration", obs.Request.URL.Path)
+		}
+		got = append(got, o)
+	})
+	client.AddObserveResponse(func(obs ResponseObservation) {
+		if obs.Header != nil && obs.Header.Get("X-Example") == "modified" {
+			t.Errorf("second observer saw the first observer's modification")
+		}
+		gotSecond++
+	})
+
+	tags, err := client.GetNamespaceTags(context.Background(), MustParseNamespace("foo/bar"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(tags) != 1 {
+		t.Errorf("wrong tags %#v; the response was affected by an observer", tags)
+	}
+	if _, err := client.GetNamespaceTags(context.Background(), MustParseNamespace("foo/missing")); err == nil {
+		t.Errorf("no error for missing namespace")
+	}
+
+	// A request that gets no response at all is observed with its error.
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	unreachable := newTestClient(t, closed.URL)
+	var gotErr error
+	unreachable.AddObserveResponse(func(obs ResponseObservation) {
+		gotErr = obs.Err
+		if obs.StatusCode != 0 || obs.Header != nil {
+			t.Errorf("observation of failed request has a response")
+		}
+	})
+	if _, err := unreachable.GetNamespaceTags(context.Background(), MustParseNamespace("foo/bar")); err == nil {
+		t.Errorf("no error for unreachable registry")
+	}
+	if gotErr == nil {
+		t.Errorf("failed request wasn't observed with an error")
+	}
+
+	want := []observation{
+		{Path: "/v2/foo/bar/tags/list", StatusCode: 200, Example: "tags"},
+		{Path: "/v2/foo/missing/tags/list", StatusCode: 404},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong observations\n%s", diff)
+	}
+	if gotSecond != len(want) {
+		t.Errorf("second observer was called %d times; want %d", gotSecond, len(want))
+	}
+}
+
+func TestClientTimeouts(t *testing.T) {
+	unblock := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v2/foo/slow/tags/list":
+			select {
+			case <-unblock:
+			case <-req.Context().Done():
+			}
+			resp.WriteHeader(500)
+		case "/v2/foo/gateway/tags/list":
+			resp.WriteHeader(504)
+		default:
+			resp.WriteHeader(404)
+		}
+	}))
+	defer backend.Close()
+	defer close(unblock)
+	client := newTestClient(t, backend.URL)
+	client.SetTimeout(10 * time.Millisecond)
+
+	_, err := client.GetNamespaceTags(context.Background(), MustParseNamespace("foo/slow"))
+	if err != ErrTimeout {
+		t.Errorf("wrong error for slow backend %v; want %v", err, ErrTimeout)
+	}
+	_, err = client.GetNamespaceTags(context.Background(), MustParseNamespace("foo/gateway"))
+	if err != ErrBackendTimeout {
+		t.Errorf("wrong error for backend gateway timeout %v; want %v", err, ErrBackendTimeout)
+	}
+}
+
+func TestClientBlobIdleTimeout(t *testing.T) {
+	content := []byte("blob content sent in two parts")
+	digest, err := ComputeDigest("sha256", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unblock := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		resp.WriteHeader(200)
+		resp.Write(content[:10])
+		resp.(http.Flusher).Flush()
+		if req.URL.Path == "/v2/foo/stalled/blobs/"+digest.String() {
+			select {
+			case <-unblock:
+			case <-req.Context().Done():
+			}
+			return
+		}
+		resp.Write(content[10:])
+	}))
+	defer backend.Close()
+	defer close(unblock)
+	client := newTestClient(t, backend.URL)
+	client.SetBlobIdleTimeout(50 * time.Millisecond)
+
+	t.Run("stalled", func(t *testing.T) {
+		_, r, err := client.GetBlobContent(context.Background(), MustParseNamespace("foo/stalled"), digest, "")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer r.Close()
+		got, err := io.ReadAll(r)
+		if err != ErrBlobStalled {
+			t.Errorf("wrong error %v; want %v", err, ErrBlobStalled)
+		}
+		if string(got) != string(content[:10]) {
+			t.Errorf("wrong partial content %q", got)
+		}
+	})
+	t.Run("slow reader", func(t *testing.T) {
+		_, r, err := client.GetBlobContent(context.Background(), MustParseNamespace("foo/complete"), digest, "")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer r.Close()
+		// Time spent between reads doesn't count towards the timeout.
+		time.Sleep(100 * time.Millisecond)
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(got) != string(content) {
+			t.Errorf("wrong content %q", got)
+		}
+	})
+}
+
+// newTestClient returns a client for the registry at the given base URL,
+// which would typically be the URL of an httptest server.
+func newTestClient(t *testing.T, baseURL string) *Client {
+	t.Helper()
+	u, err := url.Parse(baseURL + "/")
+	if err != nil {
+		t.Fatalf("invalid base URL: %s", err)
+	}
+	return NewClient(u)
+}
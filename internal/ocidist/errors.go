@@ -3,6 +3,7 @@ package ocidist
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 )
 
 type staticError string
@@ -12,9 +13,41 @@ func (err staticError) Error() string {
 }
 
 const ErrUnauthorized = staticError("unauthorized")
+
+// ErrTimeout is returned when a request to the registry takes longer than
+// the timeout set using [Client.SetTimeout].
 const ErrTimeout = staticError("timeout")
+
+// ErrBackendTimeout is returned when the registry itself reports that it
+// timed out, such as when its own upstream server took too long, as opposed
+// to the client giving up waiting for it as with [ErrTimeout].
+const ErrBackendTimeout = staticError("registry reported a timeout")
 const ErrBadGateway = staticError("invalid response from backend server")
 
+// ErrBlobStalled is returned when reading a blob's content if the registry
+// sends nothing for longer than the timeout set using
+// [Client.SetBlobIdleTimeout].
+const ErrBlobStalled = staticError("registry stopped sending blob content")
+
+// ErrBlobTruncated is returned when reading a blob's content, if the client
+// is verifying blobs, when the registry sends less content than its
+// Content-Length header promised.
+const ErrBlobTruncated = staticError("registry sent incomplete blob content")
+
+// ErrBlobDigestMismatch is returned when reading a blob's content, if the
+// client is verifying blobs, when the registry sends content that doesn't
+// match the requested digest.
+const ErrBlobDigestMismatch = staticError("registry sent blob content that doesn't match its digest")
+
+// ErrImageIndex is returned by [Client.GetManifest] when the given
+// reference refers to an image index, such as a multi-platform image,
+// rather than to a single manifest.
+const ErrImageIndex = staticError("reference is an image index rather than a manifest")
+
+// ErrCatalogNotSupported is returned by [Client.GetCatalog] when the
+// registry does not support listing its namespaces.
+const ErrCatalogNotSupported = staticError("registry does not support listing its catalog")
+
 type NotFoundError struct {
 	JSONDesc json.RawMessage
 }
@@ -34,3 +67,24 @@ func (err RequestError) Error() string {
 func (err RequestError) Unwrap() error {
 	return err.Wrapped
 }
+
+// UntrustedDigestError is returned when a digest uses a hash algorithm that
+// is not trusted for verifying content.
+type UntrustedDigestError struct {
+	Algorithm string
+}
+
+func (err UntrustedDigestError) Error() string {
+	return fmt.Sprintf("digest algorithm %q is not trusted", err.Algorithm)
+}
+
+// DeniedAddressError is returned when a request would connect to an IP
+// address that the client's [IPPolicy] denies.
+type DeniedAddressError struct {
+	IP     net.IP
+	Reason string
+}
+
+func (err DeniedAddressError) Error() string {
+	return fmt.Sprintf("connection to %s denied by IP policy: %s", err.IP, err.Reason)
+}
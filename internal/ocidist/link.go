@@ -0,0 +1,202 @@
+package ocidist
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// link is a single link from a "Link" header field, as defined in RFC 8288.
+type link struct {
+	// Target is the link's target URI reference, exactly as written in the
+	// header and so possibly relative.
+	Target string
+
+	// Params are the link's parameters, keyed by their lowercase names.
+	// If a parameter appears more than once then only the first is kept,
+	// as RFC 8288 requires for the "rel" parameter.
+	Params map[string]string
+}
+
+// HasRel returns true if the link's "rel" parameter includes the given
+// relation type. Relation types are case-insensitive.
+func (l link) HasRel(rel string) bool {
+	for _, got := range strings.Fields(l.Params["rel"]) {
+		if strings.EqualFold(got, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLinkHeader parses the given values of "Link" header fields, each of
+// which may contain multiple comma-separated links.
+//
+// Parsing is lenient: any link that is malformed is skipped, along with any
+// remaining content of the same header field if the parser can't find
+// where the malformed link ends.
+func parseLinkHeader(values []string) []link {
+	var ret []link
+	for _, value := range values {
+		p := linkParser{s: value}
+		for {
+			p.skipSpaceAndCommas()
+			if p.done() {
+				break
+			}
+			l, ok := p.link()
+			if !ok {
+				break
+			}
+			ret = append(ret, l)
+		}
+	}
+	return ret
+}
+
+// NextPageURL returns the target of the "next" link in the given response
+// header, resolved relative to the URL of the request that the response
+// belongs to, or nil if there is no such link.
+//
+// Servers that paginate their own responses in the same way as the OCI
+// Distribution protocol can use [NextPageLink] to generate the link.
+func NextPageURL(header http.Header, reqURL *url.URL) (*url.URL, error) {
+	for _, l := range parseLinkHeader(header.Values("Link")) {
+		if l.HasRel("next") {
+			return reqURL.Parse(l.Target)
+		}
+	}
+	return nil, nil
+}
+
+// NextPageLink returns a "Link" header field value that links to the given
+// URL reference as the next page of a paginated response, which
+// [NextPageURL] recognizes.
+func NextPageLink(target *url.URL) string {
+	return "<" + target.String() + `>; rel="next"`
+}
+
+// linkParser is the state of a parser for a single "Link" header field.
+type linkParser struct {
+	s   string
+	pos int
+}
+
+func (p *linkParser) done() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *linkParser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *linkParser) skipSpace() {
+	for !p.done() && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *linkParser) skipSpaceAndCommas() {
+	for !p.done() && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t' || p.s[p.pos] == ',') {
+		p.pos++
+	}
+}
+
+// link parses a single link-value, returning false if it's malformed.
+func (p *linkParser) link() (link, bool) {
+	if p.peek() != '<' {
+		return link{}, false
+	}
+	end := strings.IndexByte(p.s[p.pos:], '>')
+	if end == -1 {
+		return link{}, false
+	}
+	ret := link{
+		Target: p.s[p.pos+1 : p.pos+end],
+		Params: make(map[string]string),
+	}
+	p.pos += end + 1
+
+	for {
+		p.skipSpace()
+		if p.peek() != ';' {
+			break
+		}
+		p.pos++
+		p.skipSpace()
+		name := strings.ToLower(p.token())
+		if name == "" {
+			return link{}, false
+		}
+		p.skipSpace()
+		var val string
+		if p.peek() == '=' {
+			p.pos++
+			p.skipSpace()
+			if p.peek() == '"' {
+				var ok bool
+				val, ok = p.quotedString()
+				if !ok {
+					return link{}, false
+				}
+			} else {
+				val = p.token()
+			}
+		}
+		if _, exists := ret.Params[name]; !exists {
+			ret.Params[name] = val
+		}
+	}
+
+	p.skipSpace()
+	if !p.done() && p.peek() != ',' {
+		return link{}, false
+	}
+	return ret, true
+}
+
+// token consumes and returns a token as defined in RFC 7230, which is empty
+// if there is no token at the current position.
+func (p *linkParser) token() string {
+	start := p.pos
+	for !p.done() && isTokenChar(p.s[p.pos]) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// quotedString consumes a quoted string starting at the current position,
+// returning its content with any escaping removed.
+func (p *linkParser) quotedString() (string, bool) {
+	p.pos++ // opening quote
+	var b strings.Builder
+	for !p.done() {
+		c := p.s[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return b.String(), true
+		case '\\':
+			if p.done() {
+				return "", false
+			}
+			b.WriteByte(p.s[p.pos])
+			p.pos++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", false // unterminated
+}
+
+func isTokenChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	default:
+		return strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1
+	}
+}
@@ -0,0 +1,147 @@
+package ocidist
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseLinkHeader(t *testing.T) {
+	tests := map[string]struct {
+		values []string
+		want   []link
+	}{
+		"none": {
+			nil,
+			nil,
+		},
+		"Docker Hub": {
+			[]string{`</v2/library/alpine/tags/list?last=3.14&n=100>; rel="next"`},
+			[]link{
+				{Target: "/v2/library/alpine/tags/list?last=3.14&n=100", Params: map[string]string{"rel": "next"}},
+			},
+		},
+		"ghcr.io": {
+			[]string{`</v2/example/provider/tags/list?last=v1.2.3&n=0>; rel="next"`},
+			[]link{
+				{Target: "/v2/example/provider/tags/list?last=v1.2.3&n=0", Params: map[string]string{"rel": "next"}},
+			},
+		},
+		"multiple links in one header": {
+			[]string{`<https://example.com/a?page=2>; rel="next", <https://example.com/a?page=5>; rel="last"`},
+			[]link{
+				{Target: "https://example.com/a?page=2", Params: map[string]string{"rel": "next"}},
+				{Target: "https://example.com/a?page=5", Params: map[string]string{"rel": "last"}},
+			},
+		},
+		"multiple headers": {
+			[]string{`</prev>; rel=prev`, `</next>;rel=next`},
+			[]link{
+				{Target: "/prev", Params: map[string]string{"rel": "prev"}},
+				{Target: "/next", Params: map[string]string{"rel": "next"}},
+			},
+		},
+		"quoted commas and semicolons": {
+			[]string{`</a>; title="one, two; three"; REL="next", </b>; rel=other`},
+			[]link{
+				{Target: "/a", Params: map[string]string{"title": "one, two; three", "rel": "next"}},
+				{Target: "/b", Params: map[string]string{"rel": "other"}},
+			},
+		},
+		"escaped quote": {
+			[]string{`</a>; title="say \"hi\""`},
+			[]link{
+				{Target: "/a", Params: map[string]string{"title": `say "hi"`}},
+			},
+		},
+		"repeated rel": {
+			[]string{`</a>; rel=next; rel=prev`},
+			[]link{
+				{Target: "/a", Params: map[string]string{"rel": "next"}},
+			},
+		},
+		"malformed": {
+			[]string{`garbage`, `</a>; rel="unterminated`, `</b>; rel=next`},
+			[]link{
+				{Target: "/b", Params: map[string]string{"rel": "next"}},
+			},
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			got := parseLinkHeader(test.values)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("wrong result\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNextPageURL(t *testing.T) {
+	reqURL := &url.URL{Scheme: "https", Host: "registry.example.com", Path: "/v2/foo/tags/list"}
+	tests := map[string]struct {
+		values []string
+		want   string
+	}{
+		"none": {
+			nil,
+			"",
+		},
+		"relative": {
+			[]string{`</v2/foo/tags/list?last=b&n=2>; rel="next"`},
+			"https://registry.example.com/v2/foo/tags/list?last=b&n=2",
+		},
+		"absolute": {
+			[]string{`<https://other.example.com/page2>; rel="next"`},
+			"https://other.example.com/page2",
+		},
+		"among others": {
+			[]string{`</first>; rel="first"`, `</prev>; rel="prev", </next>; rel="next"`},
+			"https://registry.example.com/next",
+		},
+		"multiple relation types": {
+			[]string{`</next>; rel="last next"`},
+			"https://registry.example.com/next",
+		},
+		"no next": {
+			[]string{`</other>; rel="other"`},
+			"",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			header := http.Header{"Link": test.values}
+			got, err := NextPageURL(header, reqURL)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			gotStr := ""
+			if got != nil {
+				gotStr = got.String()
+			}
+			if gotStr != test.want {
+				t.Errorf("wrong result\ngot:  %q\nwant: %q", gotStr, test.want)
+			}
+		})
+	}
+}
+
+func TestNextPageLink(t *testing.T) {
+	reqURL, err := url.Parse("https://registry.example.com/v2/_catalog?n=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &url.URL{RawQuery: url.Values{"n": {"2"}, "last": {"foo/bar"}}.Encode()}
+	header := http.Header{"Link": {NextPageLink(target)}}
+	got, err := NextPageURL(header, reqURL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := "https://registry.example.com/v2/_catalog?last=foo%2Fbar&n=2"; got == nil || got.String() != want {
+		t.Errorf("wrong result\ngot:  %v\nwant: %s", got, want)
+	}
+}
@@ -4,6 +4,7 @@ package ocidist
 type Manifest struct {
 	SchemaVersion int64          `json:"schemaVersion"`
 	MediaType     string         `json:"mediaType"`
+	ArtifactType  string         `json:"artifactType,omitempty"`
 	Config        ObjectMeta     `json:"config"`
 	Layers        []ObjectMeta   `json:"layers"`
 	Annotations   map[string]any `json:"annotations"`
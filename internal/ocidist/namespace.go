@@ -1,8 +1,13 @@
 package ocidist
 
 import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
+	"io"
 	"regexp"
 	"strings"
 )
@@ -23,7 +28,7 @@ type Namespace []NamespacePart
 // be valid namespace parts as defined in the OCI Distribution specification,
 // which means they must match the following regular expression pattern:
 //
-//	[a-z0-9]+([._-][a-z0-9]+)*
+//	[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*
 //
 // Use [ParseNamespacePart] to guarantee a valid value.
 type NamespacePart string
@@ -79,7 +84,7 @@ func MustParseNamespace(s string) Namespace {
 
 func ParseNamespacePart(s string) (NamespacePart, error) {
 	if !namespacePartRe.MatchString(s) {
-		return "", fmt.Errorf("must consist of one or more sequences of lowercase latin letters and digits separated by individual periods, underscores, or dashes")
+		return "", fmt.Errorf("must consist of one or more sequences of lowercase latin letters and digits separated by a period, one or two underscores, or one or more dashes")
 	}
 	return NamespacePart(s), nil
 }
@@ -166,6 +171,81 @@ func (d Digest) Encoded() string {
 	return string(d)[colon+1:]
 }
 
+// CheckAlgorithm returns an [UntrustedDigestError] if the receiver uses a
+// hash algorithm that isn't in the given list of allowed algorithms.
+func (d Digest) CheckAlgorithm(allowed []string) error {
+	algo := d.Algorithm()
+	for _, candidate := range allowed {
+		if candidate == algo {
+			return nil
+		}
+	}
+	return UntrustedDigestError{Algorithm: algo}
+}
+
+// ComputeDigest returns the digest of the given content using the given hash
+// algorithm, which must be either "sha256" or "sha512".
+func ComputeDigest(algorithm string, content []byte) (Digest, error) {
+	h, err := newDigestHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	h.Write(content)
+	return Digest(algorithm + ":" + hex.EncodeToString(h.Sum(nil))), nil
+}
+
+// SupportedDigestAlgorithm returns true if the given name is a digest
+// algorithm that this package can compute, and so can verify content
+// against.
+func SupportedDigestAlgorithm(name string) bool {
+	_, err := newDigestHash(name)
+	return err == nil
+}
+
+// newDigestHash returns a new hash for the given digest algorithm, which
+// must be either "sha256" or "sha512".
+func newDigestHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+}
+
+// DigestingReader is an [io.Reader] that computes the digest of everything
+// read through it, for verifying content too large to hold in memory.
+type DigestingReader struct {
+	r         io.Reader
+	algorithm string
+	h         hash.Hash
+}
+
+// NewDigestingReader returns a reader that reads from r while computing a
+// digest using the given hash algorithm, which must be either "sha256" or
+// "sha512".
+func NewDigestingReader(r io.Reader, algorithm string) (*DigestingReader, error) {
+	h, err := newDigestHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &DigestingReader{r: r, algorithm: algorithm, h: h}, nil
+}
+
+func (r *DigestingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	return n, err
+}
+
+// Digest returns the digest of the content read so far, which is the
+// digest of the whole content once the underlying reader is exhausted.
+func (r *DigestingReader) Digest() Digest {
+	return Digest(r.algorithm + ":" + hex.EncodeToString(r.h.Sum(nil)))
+}
+
 func (d *Digest) UnmarshalJSON(src []byte) error {
 	var raw string
 	err := json.Unmarshal(src, &raw)
@@ -180,7 +260,7 @@ func (d *Digest) UnmarshalJSON(src []byte) error {
 	return nil
 }
 
-var namespacePartRe = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*$`)
+var namespacePartRe = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*$`)
 var referenceRe = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
 var digestAlgorithmRe = regexp.MustCompile(`^[a-z0-9]+([+._-][a-z0-9]+)*$`)
 var digestEncodedRe = regexp.MustCompile(`^[a-zA-Z0-9=_-]+$`)
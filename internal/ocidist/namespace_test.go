@@ -0,0 +1,84 @@
+package ocidist
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDigestCheckAlgorithm(t *testing.T) {
+	allowed := []string{"sha256", "sha512"}
+
+	d, err := ParseDigest("sha512:aaaaaaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CheckAlgorithm(allowed); err != nil {
+		t.Errorf("unexpected error for sha512: %s", err)
+	}
+
+	d, err = ParseDigest("md5:aaaaaaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.CheckAlgorithm(allowed)
+	if got, want := err, (UntrustedDigestError{Algorithm: "md5"}); got != want {
+		t.Errorf("wrong error %#v; want %#v", got, want)
+	}
+}
+
+func TestDigestingReader(t *testing.T) {
+	content := strings.Repeat("provider package ", 1000)
+	for _, algorithm := range []string{"sha256", "sha512"} {
+		r, err := NewDigestingReader(strings.NewReader(content), algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			t.Fatal(err)
+		}
+		want, err := ComputeDigest(algorithm, []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.Digest(); got != want {
+			t.Errorf("wrong %s digest %s; want %s", algorithm, got, want)
+		}
+	}
+
+	if _, err := NewDigestingReader(strings.NewReader(content), "md5"); err == nil {
+		t.Errorf("no error for unsupported algorithm")
+	}
+}
+
+func TestParseNamespacePart(t *testing.T) {
+	valid := []string{
+		"foo",
+		"foo.bar",
+		"foo_bar",
+		"foo__bar",
+		"foo-bar",
+		"xn--bcher-kva",
+		"a0.b1-c2_d3",
+	}
+	invalid := []string{
+		"",
+		"Foo",
+		"foo..bar",
+		"foo___bar",
+		"-foo",
+		"foo-",
+		"foo.-bar",
+		"bücher",
+	}
+	for _, s := range valid {
+		if _, err := ParseNamespacePart(s); err != nil {
+			t.Errorf("unexpected error for %q: %s", s, err)
+		}
+	}
+	for _, s := range invalid {
+		if _, err := ParseNamespacePart(s); err == nil {
+			t.Errorf("no error for %q", s)
+		}
+	}
+}
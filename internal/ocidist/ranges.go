@@ -0,0 +1,75 @@
+package ocidist
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// SupportsBlobRanges returns true if the registry honors the Range header
+// when returning blob content, so that a caller can safely offer resumable
+// downloads of blobs fetched using [Client.GetBlobContentRange].
+//
+// The first call probes the registry by requesting just the first byte of
+// the given blob, using authHeader as for [Client.GetBlobContent]. Support
+// for ranges is a property of the registry rather than of any particular
+// blob, and so later calls reuse the result of the first successful probe
+// without making any requests. A failed probe is not remembered, so the
+// next call probes again.
+func (c *Client) SupportsBlobRanges(ctx context.Context, ns Namespace, digest Digest, authHeader string) (bool, error) {
+	c.blobRangesMu.Lock()
+	known, supported := c.blobRangesKnown, c.blobRanges
+	c.blobRangesMu.Unlock()
+	if known {
+		return supported, nil
+	}
+
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	resp, err := c.sendBlobRequest(ctx, ns, digest, authHeader, "bytes=0-0", c.rawClient)
+	if err != nil {
+		return false, err
+	}
+	// A registry that doesn't support ranges returns the whole blob, which
+	// we don't want to wait for.
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 206:
+		supported = true
+	case 200:
+		supported = false
+	default:
+		return false, errForResponse(resp)
+	}
+
+	c.blobRangesMu.Lock()
+	c.blobRangesKnown, c.blobRanges = true, supported
+	c.blobRangesMu.Unlock()
+	return supported, nil
+}
+
+// GetBlobContentRange is like [Client.GetBlobContent] except that it asks
+// for only the given byte range of the blob, in the syntax of the HTTP
+// Range header, like "bytes=100-".
+//
+// The returned status code is 206 if the registry returned only the
+// requested range, in which case the header includes Content-Range, or 200
+// if it returned the whole blob anyway. If the range isn't satisfiable then
+// the status code is 416, and the caller must still close the returned
+// reader.
+func (c *Client) GetBlobContentRange(ctx context.Context, ns Namespace, digest Digest, authHeader string, byteRange string) (int, http.Header, io.ReadCloser, error) {
+	resp, err := c.getBlob(ctx, ns, digest, authHeader, byteRange, c.rawClient)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	switch resp.StatusCode {
+	case 200, 206, 416:
+		return resp.StatusCode, resp.Header, resp.Body, nil
+	default:
+		defer resp.Body.Close()
+		return 0, nil, nil, errForResponse(resp)
+	}
+}
@@ -0,0 +1,149 @@
+package ocidist
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientSupportsBlobRanges(t *testing.T) {
+	content := []byte("blob content")
+	digest, err := ComputeDigest("sha256", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobPath := "/v2/foo/bar/blobs/" + digest.String()
+
+	tests := map[string]struct {
+		supportRanges bool
+		want          bool
+	}{
+		"supported":   {supportRanges: true, want: true},
+		"unsupported": {supportRanges: false, want: false},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			var requests int
+			var gotAuth string
+			backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != blobPath {
+					resp.WriteHeader(404)
+					return
+				}
+				requests++
+				gotAuth = req.Header.Get("Authorization")
+				if test.supportRanges {
+					http.ServeContent(resp, req, "", time.Time{}, bytes.NewReader(content))
+					return
+				}
+				resp.Write(content)
+			}))
+			defer backend.Close()
+			client := newTestClient(t, backend.URL)
+
+			for i := 0; i < 2; i++ {
+				got, err := client.SupportsBlobRanges(context.Background(), MustParseNamespace("foo/bar"), digest, "Bearer abc123")
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if got != test.want {
+					t.Errorf("wrong result %t; want %t", got, test.want)
+				}
+			}
+			// The result of the first probe is reused for the second call.
+			if requests != 1 {
+				t.Errorf("registry received %d requests; want 1", requests)
+			}
+			if gotAuth != "Bearer abc123" {
+				t.Errorf("wrong Authorization header %q", gotAuth)
+			}
+		})
+	}
+
+	t.Run("failed probe", func(t *testing.T) {
+		authorized := false
+		backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			if !authorized {
+				resp.WriteHeader(401)
+				return
+			}
+			http.ServeContent(resp, req, "", time.Time{}, bytes.NewReader(content))
+		}))
+		defer backend.Close()
+		client := newTestClient(t, backend.URL)
+
+		_, err := client.SupportsBlobRanges(context.Background(), MustParseNamespace("foo/bar"), digest, "")
+		if err != ErrUnauthorized {
+			t.Fatalf("wrong error %v; want %v", err, ErrUnauthorized)
+		}
+		// The failure isn't remembered, so a later call probes again.
+		authorized = true
+		got, err := client.SupportsBlobRanges(context.Background(), MustParseNamespace("foo/bar"), digest, "")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !got {
+			t.Errorf("ranges not supported after successful probe")
+		}
+	})
+}
+
+func TestClientGetBlobContentRange(t *testing.T) {
+	content := []byte("blob content")
+	digest, err := ComputeDigest("sha256", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		http.ServeContent(resp, req, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer backend.Close()
+	client := newTestClient(t, backend.URL)
+
+	tests := map[string]struct {
+		byteRange        string
+		wantStatus       int
+		wantBody         string
+		wantContentRange string
+	}{
+		"suffix": {
+			byteRange:        "bytes=5-",
+			wantStatus:       206,
+			wantBody:         "content",
+			wantContentRange: "bytes 5-11/12",
+		},
+		"unsatisfiable": {
+			byteRange:        "bytes=20-",
+			wantStatus:       416,
+			wantContentRange: "bytes */12",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			status, header, r, err := client.GetBlobContentRange(context.Background(), MustParseNamespace("foo/bar"), digest, "", test.byteRange)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			body, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatalf("failed to read body: %s", err)
+			}
+			if status != test.wantStatus {
+				t.Errorf("wrong status %d; want %d", status, test.wantStatus)
+			}
+			if test.wantStatus == 206 && string(body) != test.wantBody {
+				t.Errorf("wrong body %q; want %q", body, test.wantBody)
+			}
+			if got := header.Get("Content-Range"); got != test.wantContentRange {
+				t.Errorf("wrong Content-Range %q; want %q", got, test.wantContentRange)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package ocidist
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy decides whether a [Client] retries requests that fail in ways
+// that are likely to be temporary, as set using [Client.SetRetryPolicy].
+//
+// Only GET and HEAD requests are retried, because they are idempotent, and
+// only when the registry responds with "502 Bad Gateway", "503 Service
+// Unavailable", or "504 Gateway Timeout", or the connection fails before
+// the registry responds at all.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times the client sends each
+	// request, including the first. A value less than two disables
+	// retries.
+	MaxAttempts int
+
+	// BaseDelay is how long the client waits before the first retry, which
+	// doubles for each subsequent retry, with random jitter so that many
+	// clients retrying at once don't stay synchronized. If zero, the client
+	// uses [DefaultRetryBaseDelay].
+	//
+	// If the registry's response includes a Retry-After header then the
+	// client waits for that long instead.
+	BaseDelay time.Duration
+}
+
+// DefaultRetryBaseDelay is the delay before a [Client]'s first retry of a
+// request if its [RetryPolicy] doesn't specify one.
+const DefaultRetryBaseDelay = 200 * time.Millisecond
+
+// maxRetryDelay is the longest that a [Client] waits before retrying a
+// request. If the registry asks the client to wait longer than this using
+// Retry-After then the client doesn't retry at all, because failing quickly
+// is more useful to our own clients than waiting for so long.
+const maxRetryDelay = 30 * time.Second
+
+// SetRetryPolicy sets how the client retries requests that fail in ways
+// that are likely to be temporary. By default the client doesn't retry
+// requests.
+//
+// The request's context applies across all of the attempts, including the
+// waits between them, so canceling it stops the client from waiting any
+// longer.
+//
+// This must not be called concurrently with any other method of the same
+// client object.
+func (c *Client) SetRetryPolicy(policy RetryPolicy) {
+	if policy.BaseDelay == 0 {
+		policy.BaseDelay = DefaultRetryBaseDelay
+	}
+	c.retry = policy
+}
+
+// doRetrying sends the given request, retrying it according to the client's
+// retry policy.
+func (c *Client) doRetrying(client *http.Client, req *http.Request) (*http.Response, error) {
+	if c.retry.MaxAttempts < 2 || (req.Method != "GET" && req.Method != "HEAD") {
+		return c.doLimited(client, req)
+	}
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		resp, err := c.doLimited(client, req)
+		if attempt >= c.retry.MaxAttempts || !shouldRetry(ctx, resp, err) {
+			return resp, err
+		}
+		delay, ok := c.retryDelay(attempt, resp)
+		if !ok {
+			return resp, err
+		}
+		if resp != nil {
+			// Reading a little of the body first allows the connection to
+			// be reused for the next attempt.
+			io.CopyN(io.Discard, resp.Body, 4096)
+			resp.Body.Close()
+		}
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// shouldRetry returns true if the given outcome of a request with the given
+// context is likely to be temporary.
+func shouldRetry(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return errors.Is(err, syscall.ECONNRESET) ||
+			errors.Is(err, syscall.ECONNREFUSED) ||
+			errors.Is(err, io.EOF) ||
+			errors.Is(err, io.ErrUnexpectedEOF)
+	}
+	switch resp.StatusCode {
+	case 502, 503, 504:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryDelay returns how long to wait after the given attempt at a request,
+// which got the given response if not nil, or false if the registry asked
+// the client to wait too long.
+func (c *Client) retryDelay(attempt int, resp *http.Response) (time.Duration, bool) {
+	if resp != nil {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			return d, d <= maxRetryDelay
+		}
+	}
+	d := c.retry.BaseDelay << (attempt - 1)
+	if d > maxRetryDelay || d <= 0 {
+		d = maxRetryDelay
+	}
+	// We wait for between half of the full delay and the full delay.
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1)), true
+}
+
+// parseRetryAfter returns the delay that the given Retry-After header value
+// asks for, relative to the given time, or false if the value is absent or
+// malformed.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		if secs > int64(maxRetryDelay/time.Second) {
+			// Avoid overflow for absurdly large values.
+			return maxRetryDelay + time.Second, true
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	d := t.Sub(now)
+	if d < 0 {
+		d = 0
+	}
+	return d, true
+}
+
+// sleepContext waits for the given duration, or returns the context's error
+// as soon as the given context is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,155 @@
+package ocidist
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientSetRetryPolicy(t *testing.T) {
+	var requests int64
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt64(&requests, 1)
+		switch req.URL.Path {
+		case "/v2/flaky/tags/list":
+			if n < 3 {
+				resp.WriteHeader(503)
+				return
+			}
+		case "/v2/retry-after/tags/list":
+			if n < 2 {
+				resp.Header().Set("Retry-After", "1")
+				resp.WriteHeader(503)
+				return
+			}
+		case "/v2/too-long/tags/list":
+			resp.Header().Set("Retry-After", "3600")
+			resp.WriteHeader(503)
+			return
+		case "/v2/broken/tags/list":
+			resp.WriteHeader(503)
+			return
+		case "/v2/missing/tags/list":
+			resp.WriteHeader(404)
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write([]byte(`{"name":"foo","tags":["1.0.0"]}`))
+	}))
+	defer backend.Close()
+	ctx := context.Background()
+
+	newClient := func(t *testing.T) *Client {
+		atomic.StoreInt64(&requests, 0)
+		client := newTestClient(t, backend.URL)
+		client.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+		return client
+	}
+
+	t.Run("recovers", func(t *testing.T) {
+		client := newClient(t)
+		if _, err := client.GetNamespaceTags(ctx, MustParseNamespace("flaky")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got, want := atomic.LoadInt64(&requests), int64(3); got != want {
+			t.Errorf("wrong number of requests %d; want %d", got, want)
+		}
+	})
+	t.Run("gives up", func(t *testing.T) {
+		client := newClient(t)
+		if _, err := client.GetNamespaceTags(ctx, MustParseNamespace("broken")); err == nil {
+			t.Fatalf("unexpected success")
+		}
+		if got, want := atomic.LoadInt64(&requests), int64(3); got != want {
+			t.Errorf("wrong number of requests %d; want %d", got, want)
+		}
+	})
+	t.Run("not transient", func(t *testing.T) {
+		client := newClient(t)
+		if _, err := client.GetNamespaceTags(ctx, MustParseNamespace("missing")); err == nil {
+			t.Fatalf("unexpected success")
+		}
+		if got, want := atomic.LoadInt64(&requests), int64(1); got != want {
+			t.Errorf("wrong number of requests %d; want %d", got, want)
+		}
+	})
+	t.Run("Retry-After", func(t *testing.T) {
+		client := newClient(t)
+		start := time.Now()
+		if _, err := client.GetNamespaceTags(ctx, MustParseNamespace("retry-after")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if elapsed := time.Since(start); elapsed < time.Second {
+			t.Errorf("client retried after %s, despite Retry-After asking for one second", elapsed)
+		}
+	})
+	t.Run("Retry-After too long", func(t *testing.T) {
+		client := newClient(t)
+		if _, err := client.GetNamespaceTags(ctx, MustParseNamespace("too-long")); err == nil {
+			t.Fatalf("unexpected success")
+		}
+		if got, want := atomic.LoadInt64(&requests), int64(1); got != want {
+			t.Errorf("wrong number of requests %d; want %d", got, want)
+		}
+	})
+	t.Run("not idempotent", func(t *testing.T) {
+		client := newClient(t)
+		req, err := http.NewRequestWithContext(ctx, "POST", backend.URL+"/v2/broken/tags/list", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.doRetrying(http.DefaultClient, req)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp.Body.Close()
+		if got, want := atomic.LoadInt64(&requests), int64(1); got != want {
+			t.Errorf("wrong number of requests %d; want %d", got, want)
+		}
+	})
+	t.Run("canceled", func(t *testing.T) {
+		client := newClient(t)
+		client.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: 20 * time.Second})
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		if _, err := client.GetNamespaceTags(ctx, MustParseNamespace("broken")); err == nil {
+			t.Fatalf("unexpected success")
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("client waited %s after the context was canceled", elapsed)
+		}
+		if got, want := atomic.LoadInt64(&requests), int64(1); got != want {
+			t.Errorf("wrong number of requests %d; want %d", got, want)
+		}
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := map[string]struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		"absent":   {"", 0, false},
+		"seconds":  {"5", 5 * time.Second, true},
+		"negative": {"-5", 0, false},
+		"huge":     {"99999999999999999", maxRetryDelay + time.Second, true},
+		"date":     {"Tue, 02 Jan 2024 03:04:15 GMT", 10 * time.Second, true},
+		"past":     {"Tue, 02 Jan 2024 03:00:00 GMT", 0, true},
+		"garbage":  {"soon", 0, false},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			got, gotOK := parseRetryAfter(test.value, now)
+			if got != test.want || gotOK != test.wantOK {
+				t.Errorf("wrong result (%s, %t); want (%s, %t)", got, gotOK, test.want, test.wantOK)
+			}
+		})
+	}
+}
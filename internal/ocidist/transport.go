@@ -0,0 +1,121 @@
+package ocidist
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// NewHTTP1Transport returns a new HTTP transport, suitable for use with
+// [NewClientWithRoundTripper], that is configured like
+// [http.DefaultTransport] except that it never uses HTTP/2.
+//
+// This is for registries whose HTTP/2 implementations are unreliable.
+func NewHTTP1Transport() *http.Transport {
+	ret := http.DefaultTransport.(*http.Transport).Clone()
+	ret.ForceAttemptHTTP2 = false
+	// A non-nil empty map disables the automatic HTTP/2 upgrade during
+	// TLS negotiation.
+	ret.TLSNextProto = make(map[string]func(authority string, c *tls.Conn) http.RoundTripper)
+	if ret.TLSClientConfig != nil {
+		ret.TLSClientConfig.NextProtos = nil
+	}
+	return ret
+}
+
+// IPPolicy decides which IP addresses a transport created by
+// [NewTransportWithIPPolicy] may connect to, to limit server-side request
+// forgery when a registry URL, or a location that a registry redirects to,
+// isn't fully trusted.
+//
+// An address is denied if it's in any of the Deny networks, or if Allow is
+// not empty and the address isn't in any of the Allow networks.
+type IPPolicy struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// Check returns a [DeniedAddressError] if the policy denies connections to
+// the given address, or nil if it allows them.
+func (p *IPPolicy) Check(ip net.IP) error {
+	for _, network := range p.Deny {
+		if network.Contains(ip) {
+			return DeniedAddressError{
+				IP:     ip,
+				Reason: fmt.Sprintf("address is in denied network %s", network),
+			}
+		}
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	for _, network := range p.Allow {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	return DeniedAddressError{
+		IP:     ip,
+		Reason: "address is not in any allowed network",
+	}
+}
+
+// NewTransportWithIPPolicy returns a copy of the given transport that
+// checks each address it connects to against the given policy, refusing
+// to connect to any address that the policy denies.
+//
+// The check happens after name resolution, immediately before connecting,
+// so a hostname can't circumvent the policy by resolving to a different
+// address than it did when checked. If the transport uses an HTTP proxy
+// then the policy applies to the address of the proxy.
+func NewTransportWithIPPolicy(base *http.Transport, policy *IPPolicy) *http.Transport {
+	ret := base.Clone()
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("invalid IP address %q", host)
+			}
+			return policy.Check(ip)
+		},
+	}
+	ret.DialContext = dialer.DialContext
+	return ret
+}
+
+// TLSClientOptions are the TLS client settings applied by
+// [NewTransportWithTLSOptions].
+type TLSClientOptions struct {
+	// SessionCacheSize is the number of TLS sessions the transport
+	// remembers so that it can resume them when making new connections,
+	// avoiding a full handshake. Zero disables session resumption.
+	SessionCacheSize int
+
+	// Renegotiation is whether a server may request TLS renegotiation,
+	// which some registries use to request client certificates.
+	Renegotiation tls.RenegotiationSupport
+}
+
+// NewTransportWithTLSOptions returns a copy of the given transport with the
+// given TLS client settings, retaining any other TLS settings the given
+// transport already had.
+func NewTransportWithTLSOptions(base *http.Transport, opts TLSClientOptions) *http.Transport {
+	ret := base.Clone()
+	if ret.TLSClientConfig == nil {
+		ret.TLSClientConfig = &tls.Config{}
+	}
+	if opts.SessionCacheSize > 0 {
+		ret.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(opts.SessionCacheSize)
+	}
+	ret.TLSClientConfig.Renegotiation = opts.Renegotiation
+	return ret
+}
@@ -0,0 +1,211 @@
+package ocidist
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNewHTTP1Transport(t *testing.T) {
+	transport := NewHTTP1Transport()
+	if transport.ForceAttemptHTTP2 {
+		t.Errorf("ForceAttemptHTTP2 is enabled")
+	}
+	if transport.TLSNextProto == nil || len(transport.TLSNextProto) != 0 {
+		t.Errorf("TLSNextProto is %#v; want empty non-nil map", transport.TLSNextProto)
+	}
+	if transport == http.DefaultTransport {
+		t.Errorf("returned the default transport rather than a copy")
+	}
+
+	// The transport should negotiate HTTP/1.1 even with a server that
+	// supports HTTP/2.
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("X-Proto", req.Proto)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	transport.TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	transport.TLSClientConfig.NextProtos = nil
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	resp.Body.Close()
+	if got, want := resp.Header.Get("X-Proto"), "HTTP/1.1"; got != want {
+		t.Errorf("server saw protocol %q; want %q", got, want)
+	}
+}
+
+func TestIPPolicyCheck(t *testing.T) {
+	mustParseCIDR := func(s string) *net.IPNet {
+		_, ret, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	}
+	denyOnly := &IPPolicy{
+		Deny: []*net.IPNet{
+			mustParseCIDR("169.254.0.0/16"),
+			mustParseCIDR("fe80::/10"),
+		},
+	}
+	allowAndDeny := &IPPolicy{
+		Allow: []*net.IPNet{mustParseCIDR("10.0.0.0/8")},
+		Deny:  []*net.IPNet{mustParseCIDR("10.1.0.0/16")},
+	}
+
+	tests := map[string]struct {
+		policy *IPPolicy
+		ip     string
+		want   bool
+	}{
+		"empty policy":            {&IPPolicy{}, "169.254.169.254", true},
+		"not denied":              {denyOnly, "192.0.2.1", true},
+		"denied":                  {denyOnly, "169.254.169.254", false},
+		"denied IPv6":             {denyOnly, "fe80::1", false},
+		"denied IPv4-mapped":      {denyOnly, "::ffff:169.254.169.254", false},
+		"allowed":                 {allowAndDeny, "10.2.3.4", true},
+		"not allowed":             {allowAndDeny, "192.0.2.1", false},
+		"allowed but also denied": {allowAndDeny, "10.1.2.3", false},
+		"IPv6 not allowed":        {allowAndDeny, "2001:db8::1", false},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			err := test.policy.Check(net.ParseIP(test.ip))
+			if got := err == nil; got != test.want {
+				t.Errorf("wrong result %v (error: %v); want %v", got, err, test.want)
+			}
+			if err != nil {
+				var denied DeniedAddressError
+				if !errors.As(err, &denied) {
+					t.Errorf("wrong error type %T; want DeniedAddressError", err)
+				}
+			}
+		})
+	}
+}
+
+func TestNewTransportWithIPPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	base := http.DefaultTransport.(*http.Transport)
+
+	allowing := NewTransportWithIPPolicy(base, &IPPolicy{Allow: []*net.IPNet{loopback}})
+	resp, err := (&http.Client{Transport: allowing}).Get(server.URL)
+	if err != nil {
+		t.Fatalf("request to allowed address failed: %s", err)
+	}
+	resp.Body.Close()
+
+	denying := NewTransportWithIPPolicy(base, &IPPolicy{Deny: []*net.IPNet{loopback}})
+	_, err = (&http.Client{Transport: denying}).Get(server.URL)
+	var denied DeniedAddressError
+	if !errors.As(err, &denied) {
+		t.Fatalf("wrong error %v; want DeniedAddressError", err)
+	}
+	if got, want := denied.Error(), "connection to 127.0.0.1 denied by IP policy: address is in denied network 127.0.0.0/8"; got != want {
+		t.Errorf("wrong error message\ngot:  %s\nwant: %s", got, want)
+	}
+}
+
+func TestNewTransportWithTLSOptions(t *testing.T) {
+	var fullHandshakes atomic.Int64
+	server := newTestTLSServer(&fullHandshakes)
+	defer server.Close()
+
+	base := server.Client().Transport.(*http.Transport).Clone()
+	base.DisableKeepAlives = true
+	transport := NewTransportWithTLSOptions(base, TLSClientOptions{
+		SessionCacheSize: 4,
+		Renegotiation:    tls.RenegotiateOnceAsClient,
+	})
+	if transport == base {
+		t.Fatalf("returned the given transport rather than a copy")
+	}
+	if base.TLSClientConfig.ClientSessionCache != nil {
+		t.Errorf("modified the given transport's TLS settings")
+	}
+	if got, want := transport.TLSClientConfig.Renegotiation, tls.RenegotiateOnceAsClient; got != want {
+		t.Errorf("wrong renegotiation setting %d; want %d", got, want)
+	}
+	if transport.TLSClientConfig.RootCAs == nil {
+		t.Errorf("didn't retain the given transport's root certificates")
+	}
+
+	// Each request makes a new connection, but only the first needs a full
+	// handshake because the others resume its session.
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		resp.Body.Close()
+	}
+	if got := fullHandshakes.Load(); got != 1 {
+		t.Errorf("server performed %d full handshakes; want 1", got)
+	}
+}
+
+func BenchmarkTransportTLSSessionResumption(b *testing.B) {
+	for _, cacheSize := range []int{0, 64} {
+		name := "without session cache"
+		if cacheSize > 0 {
+			name = "with session cache"
+		}
+		b.Run(name, func(b *testing.B) {
+			var fullHandshakes atomic.Int64
+			server := newTestTLSServer(&fullHandshakes)
+			defer server.Close()
+
+			// Disabling keep-alives makes every request use a new
+			// connection, like a connection pool with a lot of churn.
+			base := server.Client().Transport.(*http.Transport).Clone()
+			base.DisableKeepAlives = true
+			client := &http.Client{
+				Transport: NewTransportWithTLSOptions(base, TLSClientOptions{SessionCacheSize: cacheSize}),
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := client.Get(server.URL)
+				if err != nil {
+					b.Fatalf("request failed: %s", err)
+				}
+				resp.Body.Close()
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(fullHandshakes.Load())/float64(b.N), "full-handshakes/op")
+		})
+	}
+}
+
+// newTestTLSServer starts a TLS server that counts the handshakes that
+// didn't resume an earlier session.
+func newTestTLSServer(fullHandshakes *atomic.Int64) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(204)
+	}))
+	server.TLS = &tls.Config{
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if !state.DidResume {
+				fullHandshakes.Add(1)
+			}
+			return nil
+		},
+	}
+	server.StartTLS()
+	return server
+}
@@ -6,9 +6,12 @@ package querysecret
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"time"
@@ -16,22 +19,153 @@ import (
 	"golang.org/x/crypto/nacl/secretbox"
 )
 
-const nonceLength = 24
+// Lifetime is how long a message wrapped by [Secreter.Wrap] remains valid.
+const Lifetime = 3 * time.Minute
+
+// ErrExpired is the error returned when unwrapping a message whose lifetime
+// has passed, including any grace period.
+var ErrExpired = errors.New("message has expired")
+
+// Cipher identifies an authenticated encryption algorithm that can protect
+// wrapped messages.
+type Cipher string
+
+const (
+	// CipherSecretbox is NaCl's secretbox construction, which combines the
+	// XSalsa20 stream cipher with the Poly1305 authenticator. This is the
+	// cipher used by [NewSecreter].
+	CipherSecretbox Cipher = "secretbox"
+
+	// CipherAES256GCM is AES with a 256-bit key in Galois/Counter Mode, as
+	// implemented by the crypto/cipher package, for deployments that
+	// require an algorithm approved by NIST.
+	CipherAES256GCM Cipher = "aes-256-gcm"
+)
+
+// Ciphers returns all of the supported ciphers.
+func Ciphers() []Cipher {
+	return []Cipher{CipherSecretbox, CipherAES256GCM}
+}
+
+// KeySize returns the length in bytes of the secret keys that the cipher
+// requires, or zero if the cipher isn't supported.
+func (c Cipher) KeySize() int {
+	switch c {
+	case CipherSecretbox, CipherAES256GCM:
+		return 32
+	default:
+		return 0
+	}
+}
+
+// id returns the byte that identifies the cipher at the start of each
+// message it wraps, or zero if the cipher isn't supported.
+func (c Cipher) id() byte {
+	switch c {
+	case CipherSecretbox:
+		return 1
+	case CipherAES256GCM:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// newAEAD returns the implementation of the cipher using the given key, which
+// must have the length given by [Cipher.KeySize].
+func (c Cipher) newAEAD(secretKey []byte) (cipher.AEAD, error) {
+	switch c {
+	case CipherSecretbox:
+		ret := secretboxAEAD{}
+		copy(ret.key[:], secretKey)
+		return ret, nil
+	case CipherAES256GCM:
+		block, err := aes.NewCipher(secretKey)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	default:
+		return nil, fmt.Errorf("unsupported cipher %q", c)
+	}
+}
+
+// cipherForID returns the cipher that the given identifying byte belongs to,
+// or the empty string if it doesn't belong to any supported cipher.
+func cipherForID(id byte) Cipher {
+	for _, c := range Ciphers() {
+		if c.id() == id {
+			return c
+		}
+	}
+	return ""
+}
+
+// secretboxAEAD adapts NaCl's secretbox to the [cipher.AEAD] interface.
+// Secretbox can't authenticate additional data, so the Seal and Open methods
+// panic if given any.
+type secretboxAEAD struct {
+	key [32]byte
+}
+
+func (a secretboxAEAD) NonceSize() int {
+	return 24
+}
+
+func (a secretboxAEAD) Overhead() int {
+	return secretbox.Overhead
+}
+
+func (a secretboxAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(additionalData) != 0 {
+		panic("secretbox does not support additional data")
+	}
+	var n [24]byte
+	copy(n[:], nonce)
+	return secretbox.Seal(dst, plaintext, &n, &a.key)
+}
+
+func (a secretboxAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(additionalData) != 0 {
+		panic("secretbox does not support additional data")
+	}
+	var n [24]byte
+	copy(n[:], nonce)
+	ret, ok := secretbox.Open(dst, ciphertext, &n, &a.key)
+	if !ok {
+		return nil, fmt.Errorf("message authentication failed")
+	}
+	return ret, nil
+}
 
 // Secreter is an object that can encrypt and decrypt query string secrets.
+//
+// A Secreter is safe for concurrent use by multiple goroutines, as long as
+// its random reader is. The reader used by [NewSecreter] is.
 type Secreter struct {
 	// randReader is a reader from a cryptographically secure random number
 	// generator.
 	randReader io.Reader
 
-	// secretKey is the secret key used to protect the messages. This value
-	// should be protected from access by anyone who wouldn't normally have
-	// access to watch whatever data is being smuggled in the query string.
-	secretKey [32]byte
+	// cipher is the algorithm used to protect the messages, and aead is its
+	// implementation using the secret key. The key should be protected from
+	// access by anyone who wouldn't normally have access to watch whatever
+	// data is being smuggled in the query string.
+	cipher Cipher
+	aead   cipher.AEAD
+
+	// maxLifetime, if nonzero, is the furthest into the future that a
+	// message's expiration time may be for Unwrap to accept it.
+	maxLifetime time.Duration
+
+	// gracePeriod is how long after its expiration time a message is still
+	// accepted by Unwrap.
+	gracePeriod time.Duration
 }
 
-// NewSecreter constructs and returns a new [Secreter] using the default
-// random reader from the crypto/rand package.
+// NewSecreter constructs and returns a new [Secreter] using
+// [CipherSecretbox] and the default random reader from the crypto/rand
+// package.
 func NewSecreter(secretKey [32]byte) *Secreter {
 	return NewSecreterWithRand(secretKey, rand.Reader)
 }
@@ -40,20 +174,94 @@ func NewSecreter(secretKey [32]byte) *Secreter {
 // your own random byte reader.
 //
 // The reader must represent a random number generator suitable for
-// cryptographic use.
+// cryptographic use. If the Secreter will be used concurrently then the
+// reader must also be safe for concurrent use.
 func NewSecreterWithRand(secretKey [32]byte, randReader io.Reader) *Secreter {
+	ret, err := NewSecreterWithCipher(CipherSecretbox, secretKey[:], randReader)
+	if err != nil {
+		// Should never happen, because secretbox accepts any 32-byte key.
+		panic(err)
+	}
+	return ret
+}
+
+// NewSecreterWithCipher is like [NewSecreterWithRand] but additionally allows
+// choosing the cipher, returning an error if the cipher isn't supported or
+// if the secret key isn't the length that the cipher requires.
+//
+// Each wrapped message records which cipher produced it, and a Secreter
+// rejects messages produced by any other cipher even if they were wrapped
+// using the same key.
+func NewSecreterWithCipher(c Cipher, secretKey []byte, randReader io.Reader) (*Secreter, error) {
+	size := c.KeySize()
+	if size == 0 {
+		return nil, fmt.Errorf("unsupported cipher %q", c)
+	}
+	if len(secretKey) != size {
+		return nil, fmt.Errorf("the %s cipher requires a %d-byte key, not %d bytes", c, size, len(secretKey))
+	}
+	aead, err := c.newAEAD(secretKey)
+	if err != nil {
+		return nil, err
+	}
 	return &Secreter{
 		randReader: randReader,
-		secretKey:  secretKey,
-	}
+		cipher:     c,
+		aead:       aead,
+	}, nil
+}
+
+// Cipher returns the cipher that the Secreter uses to protect messages.
+func (s *Secreter) Cipher() Cipher {
+	return s.cipher
+}
+
+// SetMaxLifetime sets the longest remaining lifetime that a message may
+// claim for [Secreter.Unwrap] to accept it, regardless of the expiration
+// time embedded in the message. Zero, the default, means no limit.
+//
+// Messages are authenticated, so this can't be violated without the secret
+// key, but enforcing it limits the damage if the key is ever compromised.
+// The limit should be no shorter than [Lifetime], or newly-wrapped messages
+// will be rejected.
+//
+// SetMaxLifetime must not be called concurrently with any other method.
+func (s *Secreter) SetMaxLifetime(d time.Duration) {
+	s.maxLifetime = d
+}
+
+// SetGracePeriod sets how long after a message expires that
+// [Secreter.Unwrap] will still accept it. Zero, the default, means that
+// messages are rejected as soon as they expire.
+//
+// [Secreter.UnwrapLate] reports when a message was accepted only because of
+// the grace period.
+//
+// SetGracePeriod must not be called concurrently with any other method.
+func (s *Secreter) SetGracePeriod(d time.Duration) {
+	s.gracePeriod = d
 }
 
 // Wrap encrypts the given message and returns a string that uses the
 // URL-oriented base64 alpbabet to represent both the message and some
 // additonal overhead used to authenticate it.
 func (s *Secreter) Wrap(msg []byte) (string, error) {
-	var nonce [24]byte
-	n, err := s.randReader.Read(nonce[:])
+	return s.wrapExpiring(msg, time.Now().Add(Lifetime))
+}
+
+// WrapIssuedAt is like [Secreter.Wrap] except that the result expires
+// [Lifetime] after the given time rather than after the current time. It
+// exists so that tests can produce messages that have already expired.
+func (s *Secreter) WrapIssuedAt(msg []byte, issued time.Time) (string, error) {
+	return s.wrapExpiring(msg, issued.Add(Lifetime))
+}
+
+// wrapExpiring is the main implementation of [Secreter.Wrap], allowing the
+// expiration time to be chosen by the caller.
+func (s *Secreter) wrapExpiring(msg []byte, expiration time.Time) (string, error) {
+	nonceLength := s.aead.NonceSize()
+	nonce := make([]byte, nonceLength)
+	n, err := s.randReader.Read(nonce)
 	if err != nil {
 		return "", fmt.Errorf("failed to generate nonce: %w", err)
 	}
@@ -61,54 +269,83 @@ func (s *Secreter) Wrap(msg []byte) (string, error) {
 		return "", fmt.Errorf("nonce has incorrect length")
 	}
 
-	wrapped := make([]byte, nonceLength, nonceLength+len(msg)+8+secretbox.Overhead)
-	copy(wrapped, nonce[:])
+	// The wrapped message starts with a byte identifying the cipher, so
+	// that a Secreter can recognize messages from a different cipher
+	// during a change of configuration.
+	wrapped := make([]byte, 1+nonceLength, 1+nonceLength+len(msg)+8+s.aead.Overhead())
+	wrapped[0] = s.cipher.id()
+	copy(wrapped[1:], nonce)
 
-	// A secret message is valid for three minutes after being generated
-	expiration := time.Now().Unix() + 180
 	var buf bytes.Buffer
 	buf.Grow(8)
-	binary.Write(&buf, binary.BigEndian, expiration)
+	binary.Write(&buf, binary.BigEndian, expiration.Unix())
 	fullMsg := make([]byte, 0, len(msg)+8)
 	fullMsg = append(fullMsg, buf.Bytes()...)
 	fullMsg = append(fullMsg, msg...)
 
-	wrapped = secretbox.Seal(wrapped, fullMsg, &nonce, &s.secretKey)
+	wrapped = s.aead.Seal(wrapped, nonce, fullMsg, nil)
 	return base64.URLEncoding.EncodeToString(wrapped), nil
 }
 
 // Unwrap takes a result from an earlier call to [Secreter.Wrap] on a Secreter
 // with the same key as the receiver and returns the message wrapped inside.
 func (s *Secreter) Unwrap(wrapped string) ([]byte, error) {
+	msg, _, err := s.UnwrapLate(wrapped)
+	return msg, err
+}
+
+// UnwrapLate is like [Secreter.Unwrap] but additionally returns how long ago
+// the message expired if it was accepted only because of the grace period
+// set using [Secreter.SetGracePeriod]. For a message that hasn't expired,
+// the second result is zero.
+func (s *Secreter) UnwrapLate(wrapped string) ([]byte, time.Duration, error) {
+	nonceLength := s.aead.NonceSize()
+	overhead := s.aead.Overhead()
 	rawLen := base64.URLEncoding.DecodedLen(len(wrapped))
-	if rawLen < (nonceLength + secretbox.Overhead) {
-		return nil, fmt.Errorf("message too short")
+	if rawLen < (1 + nonceLength + overhead) {
+		return nil, 0, fmt.Errorf("message too short")
 	}
 	raw, err := base64.URLEncoding.DecodeString(wrapped)
 	if err != nil {
-		return nil, fmt.Errorf("invalid base64 encoding")
+		return nil, 0, fmt.Errorf("invalid base64 encoding")
+	}
+	if len(raw) < (1 + nonceLength + overhead) {
+		return nil, 0, fmt.Errorf("message too short")
+	}
+	if id := raw[0]; id != s.cipher.id() {
+		if c := cipherForID(id); c != "" {
+			return nil, 0, fmt.Errorf("message was wrapped using %s, not %s", c, s.cipher)
+		}
+		return nil, 0, fmt.Errorf("message was wrapped using an unsupported cipher")
 	}
-	var nonce [24]byte
-	copy(nonce[:], raw)
-	raw = raw[24:]
+	nonce := raw[1 : 1+nonceLength]
+	raw = raw[1+nonceLength:]
 
-	ret := make([]byte, 0, len(raw)-secretbox.Overhead)
-	ret, ok := secretbox.Open(ret, raw, &nonce, &s.secretKey)
-	if !ok {
-		return nil, fmt.Errorf("decryption error")
+	ret := make([]byte, 0, len(raw)-overhead)
+	ret, err = s.aead.Open(ret, nonce, raw, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("decryption error")
 	}
 
 	r := bytes.NewReader(ret)
 	var expirationUnix int64
 	err = binary.Read(r, binary.BigEndian, &expirationUnix)
 	if err != nil {
-		return nil, fmt.Errorf("missing expiration time")
+		return nil, 0, fmt.Errorf("missing expiration time")
 	}
 	ret = ret[8:]
 	expiration := time.Unix(expirationUnix, 0)
-	if now := time.Now(); now.After(expiration) {
-		return nil, fmt.Errorf("message has expired")
+	now := time.Now()
+	var late time.Duration
+	if now.After(expiration) {
+		late = now.Sub(expiration)
+		if late > s.gracePeriod {
+			return nil, 0, ErrExpired
+		}
+	}
+	if s.maxLifetime != 0 && expiration.Sub(now) > s.maxLifetime {
+		return nil, 0, fmt.Errorf("message claims to be valid for longer than allowed")
 	}
 
-	return ret, nil
+	return ret, late, nil
 }
@@ -3,7 +3,10 @@ package querysecret
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/base64"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestSecreter(t *testing.T) {
@@ -32,3 +35,239 @@ func TestSecreter(t *testing.T) {
 		t.Error("result does not match input")
 	}
 }
+
+func TestSecreterCiphers(t *testing.T) {
+	key := [32]byte{1, 2, 3}
+	msg := []byte("hello!")
+	for _, c := range Ciphers() {
+		c := c
+		t.Run(string(c), func(t *testing.T) {
+			s, err := NewSecreterWithCipher(c, key[:], rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Cipher(); got != c {
+				t.Errorf("wrong cipher %q", got)
+			}
+
+			qsArg, err := s.Wrap(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.Unwrap(qsArg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Error("result does not match input")
+			}
+
+			other, err := NewSecreterWithCipher(c, []byte("a different thirty-two byte key!"), rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := other.Unwrap(qsArg); err == nil {
+				t.Errorf("no error for message wrapped using a different key")
+			}
+
+			// Tampering with any part of the message, including the byte
+			// identifying the cipher, must cause it to be rejected.
+			raw, err := base64.URLEncoding.DecodeString(qsArg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range raw {
+				tampered := append([]byte(nil), raw...)
+				tampered[i] ^= 0x01
+				if _, err := s.Unwrap(base64.URLEncoding.EncodeToString(tampered)); err == nil {
+					t.Errorf("no error for message with byte %d modified", i)
+				}
+			}
+		})
+	}
+
+	t.Run("mismatched ciphers", func(t *testing.T) {
+		secretbox, err := NewSecreterWithCipher(CipherSecretbox, key[:], rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gcm, err := NewSecreterWithCipher(CipherAES256GCM, key[:], rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		qsArg, err := secretbox.Wrap(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = gcm.Unwrap(qsArg)
+		if err == nil {
+			t.Fatalf("no error for message wrapped using a different cipher")
+		}
+		if got, want := err.Error(), "message was wrapped using secretbox, not aes-256-gcm"; got != want {
+			t.Errorf("wrong error\ngot:  %s\nwant: %s", got, want)
+		}
+	})
+
+	t.Run("unsupported cipher", func(t *testing.T) {
+		if _, err := NewSecreterWithCipher("rot13", key[:], rand.Reader); err == nil {
+			t.Errorf("no error for unsupported cipher")
+		}
+	})
+
+	t.Run("wrong key size", func(t *testing.T) {
+		for _, c := range Ciphers() {
+			for _, size := range []int{0, 16, 31, 33, 64} {
+				if _, err := NewSecreterWithCipher(c, make([]byte, size), rand.Reader); err == nil {
+					t.Errorf("no error for %s with a %d-byte key", c, size)
+				}
+			}
+		}
+	})
+}
+
+func TestSecreterMaxLifetime(t *testing.T) {
+	s := NewSecreter([32]byte{})
+	qsArg, err := s.Wrap([]byte("hello!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetMaxLifetime(Lifetime + time.Minute)
+	if _, err := s.Unwrap(qsArg); err != nil {
+		t.Errorf("unexpected error with generous limit: %s", err)
+	}
+
+	// The message's embedded expiration is further out than this limit, so
+	// it must be rejected even though it hasn't expired.
+	s.SetMaxLifetime(time.Minute)
+	if _, err := s.Unwrap(qsArg); err == nil {
+		t.Errorf("no error for message exceeding the maximum lifetime")
+	}
+
+	s.SetMaxLifetime(0)
+	if _, err := s.Unwrap(qsArg); err != nil {
+		t.Errorf("unexpected error with no limit: %s", err)
+	}
+}
+
+func TestSecreterGracePeriod(t *testing.T) {
+	s := NewSecreter([32]byte{})
+	fresh, err := s.Wrap([]byte("fresh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := s.WrapIssuedAt([]byte("expired"), time.Now().Add(-Lifetime-2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Unwrap(expired); err != ErrExpired {
+		t.Errorf("wrong error %v for expired message without a grace period; want %v", err, ErrExpired)
+	}
+
+	s.SetGracePeriod(5 * time.Minute)
+	got, late, err := s.UnwrapLate(expired)
+	if err != nil {
+		t.Fatalf("unexpected error for message within the grace period: %s", err)
+	}
+	if string(got) != "expired" {
+		t.Errorf("wrong message %q", got)
+	}
+	if late < 2*time.Minute || late > 3*time.Minute {
+		t.Errorf("wrong lateness %s; want about 2m", late)
+	}
+	if _, late, err := s.UnwrapLate(fresh); err != nil || late != 0 {
+		t.Errorf("wrong result for unexpired message: lateness %s, error %v", late, err)
+	}
+
+	s.SetGracePeriod(time.Minute)
+	if _, _, err := s.UnwrapLate(expired); err != ErrExpired {
+		t.Errorf("wrong error %v for message beyond the grace period; want %v", err, ErrExpired)
+	}
+}
+
+func TestSecreterConcurrentNonces(t *testing.T) {
+	s := NewSecreter([32]byte{})
+
+	const goroutines = 8
+	const perGoroutine = 200
+	results := make(chan string, goroutines*perGoroutine)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perGoroutine; j++ {
+				wrapped, err := s.Wrap([]byte("hello!"))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				results <- wrapped
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	seenNonces := make(map[string]bool)
+	for wrapped := range results {
+		raw, err := base64.URLEncoding.DecodeString(wrapped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce := string(raw[1 : 1+s.aead.NonceSize()])
+		if seenNonces[nonce] {
+			t.Fatalf("nonce %x was used more than once", nonce)
+		}
+		seenNonces[nonce] = true
+
+		if _, err := s.Unwrap(wrapped); err != nil {
+			t.Errorf("failed to unwrap: %s", err)
+		}
+	}
+}
+
+func BenchmarkSecreterWrapUnwrapParallel(b *testing.B) {
+	s := NewSecreter([32]byte{})
+	msg := []byte("sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef:Bearer abc123")
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			wrapped, err := s.Wrap(msg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := s.Unwrap(wrapped); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSecreterWrapUnwrap(b *testing.B) {
+	s := NewSecreter([32]byte{})
+	msg := []byte("sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef:Bearer abc123")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		wrapped, err := s.Wrap(msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := s.Unwrap(wrapped); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCipherKeySize(t *testing.T) {
+	var key [32]byte
+	for _, c := range Ciphers() {
+		if got, want := c.KeySize(), len(key); got != want {
+			t.Errorf("wrong key size %d for %s; want %d", got, c, want)
+		}
+	}
+	if got := Cipher("rot13").KeySize(); got != 0 {
+		t.Errorf("wrong key size %d for unsupported cipher; want 0", got)
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// negotiateMediaType returns whichever of the offered media types the given
+// Accept header value gives the highest quality, preferring earlier offers
+// when the client has no preference between them, or "" if the client
+// accepts none of them.
+func negotiateMediaType(accept string, offers ...string) string {
+	best, bestQuality := "", 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(accept, offer); q > bestQuality {
+			best, bestQuality = offer, q
+		}
+	}
+	return best
+}
+
+// writeNotAcceptable responds to a client that accepts none of the offered
+// media types, listing the ones that are available.
+func writeNotAcceptable(resp http.ResponseWriter, offers ...string) {
+	writeTextResponse(resp, http.StatusNotAcceptable, "This resource is available only as "+strings.Join(offers, " or ")+".\n")
+}
+
+// checkAcceptsJSON returns true if the given request's Accept header allows
+// a JSON response. Otherwise it responds with "406 Not Acceptable" and
+// returns false.
+//
+// Either way the response varies by the Accept header.
+func checkAcceptsJSON(resp http.ResponseWriter, req *http.Request) bool {
+	resp.Header().Add("Vary", "Accept")
+	if acceptQuality(req.Header.Get("Accept"), "application/json") == 0 {
+		writeNotAcceptable(resp, "application/json")
+		return false
+	}
+	return true
+}
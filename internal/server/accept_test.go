@@ -0,0 +1,161 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+)
+
+func TestNegotiateMediaType(t *testing.T) {
+	tests := map[string]string{
+		"":                                    "text/html",
+		"*/*":                                 "text/html",
+		"application/json":                    "application/json",
+		"text/html;q=0.5, application/json":   "application/json",
+		"application/*":                       "application/json",
+		"text/*, application/json;q=0.1":      "text/html",
+		"image/png":                           "",
+		"text/html;q=0, application/json;q=0": "",
+	}
+	for accept, want := range tests {
+		accept, want := accept, want
+		t.Run(accept, func(t *testing.T) {
+			if got := negotiateMediaType(accept, "text/html", "application/json"); got != want {
+				t.Errorf("wrong result %q; want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorAcceptHeader(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.supportCatalog = true
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.0.0", testProviderManifest())
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	tests := map[string]struct {
+		mode            config.AcceptHeader
+		rootResponse    config.RootResponse
+		path            string
+		accept          string
+		wantStatus      int
+		wantContentType string
+	}{
+		"ignored": {
+			mode:            config.AcceptHeaderIgnore,
+			path:            "/mirror/example.com/foo/bar/index.json",
+			accept:          "text/html",
+			wantStatus:      200,
+			wantContentType: "application/json",
+		},
+		"protocol default": {
+			mode:            config.AcceptHeaderNegotiate,
+			path:            "/mirror/example.com/foo/bar/index.json",
+			wantStatus:      200,
+			wantContentType: "application/json",
+		},
+		"protocol wildcard": {
+			mode:            config.AcceptHeaderNegotiate,
+			path:            "/mirror/example.com/foo/bar/1.0.0.json",
+			accept:          "text/html, */*;q=0.1",
+			wantStatus:      200,
+			wantContentType: "application/json",
+		},
+		"protocol unsatisfiable": {
+			mode:            config.AcceptHeaderNegotiate,
+			path:            "/mirror/example.com/foo/bar/index.json",
+			accept:          "text/html",
+			wantStatus:      406,
+			wantContentType: "text/plain; charset=utf-8",
+		},
+		"root default": {
+			mode:            config.AcceptHeaderNegotiate,
+			rootResponse:    config.RootResponseHTML,
+			path:            "/mirror/",
+			accept:          "*/*",
+			wantStatus:      200,
+			wantContentType: "text/html; charset=utf-8",
+		},
+		"root prefers JSON": {
+			mode:            config.AcceptHeaderNegotiate,
+			rootResponse:    config.RootResponseHTML,
+			path:            "/mirror/",
+			accept:          "application/json",
+			wantStatus:      200,
+			wantContentType: "application/json",
+		},
+		"root prefers HTML": {
+			mode:            config.AcceptHeaderNegotiate,
+			rootResponse:    config.RootResponseJSON,
+			path:            "/mirror/",
+			accept:          "text/html,application/xhtml+xml,*/*;q=0.8",
+			wantStatus:      200,
+			wantContentType: "text/html; charset=utf-8",
+		},
+		"root unsatisfiable": {
+			mode:            config.AcceptHeaderNegotiate,
+			rootResponse:    config.RootResponseHTML,
+			path:            "/mirror/",
+			accept:          "image/png",
+			wantStatus:      406,
+			wantContentType: "text/plain; charset=utf-8",
+		},
+		"root not negotiable": {
+			mode:         config.AcceptHeaderNegotiate,
+			rootResponse: config.RootResponseNotFound,
+			path:         "/mirror/",
+			accept:       "image/png",
+			wantStatus:   404,
+		},
+		"provider index prefers JSON": {
+			mode:            config.AcceptHeaderNegotiate,
+			path:            "/mirror/_providers",
+			accept:          "application/json",
+			wantStatus:      200,
+			wantContentType: "application/json",
+		},
+		"provider index JSON unsatisfiable": {
+			mode:            config.AcceptHeaderNegotiate,
+			path:            "/mirror/_providers.json",
+			accept:          "text/html",
+			wantStatus:      406,
+			wantContentType: "text/plain; charset=utf-8",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			mirror := newTestProviderMirror(t, registryServer.URL)
+			mirror.AcceptHeader = test.mode
+			mirror.ProviderIndex = true
+			if test.rootResponse != "" {
+				mirror.RootResponse = test.rootResponse
+			}
+			_, handler := providerMirrorHandler(mirror, newTestSharedState())
+
+			req := httptest.NewRequest("GET", test.path, nil)
+			if test.accept != "" {
+				req.Header.Set("Accept", test.accept)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != test.wantStatus {
+				t.Fatalf("wrong status %d; want %d\n%s", rec.Code, test.wantStatus, rec.Body.String())
+			}
+			if got := rec.Header().Get("Content-Type"); got != test.wantContentType {
+				t.Errorf("wrong Content-Type %q; want %q", got, test.wantContentType)
+			}
+			varyAccept := false
+			for _, v := range rec.Header().Values("Vary") {
+				if v == "Accept" {
+					varyAccept = true
+				}
+			}
+			if want := test.mode == config.AcceptHeaderNegotiate && test.wantStatus != 404; varyAccept != want {
+				t.Errorf("wrong Vary %q", rec.Header().Values("Vary"))
+			}
+		})
+	}
+}
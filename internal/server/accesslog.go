@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/logging"
+)
+
+// withAccessLog wraps the given handler so that it writes an access log line
+// in the given format to w for each request, or returns the handler
+// unchanged if the format doesn't include an access log.
+func withAccessLog(next http.Handler, format config.LogFormat, w io.Writer) http.Handler {
+	if format != config.LogFormatCombined {
+		return next
+	}
+	var mu sync.Mutex // serializes writes to w
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: resp}
+		next.ServeHTTP(rec, req)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		// We omit the query string because it can contain secrets used to
+		// authenticate package downloads.
+		urlNoQuery := *req.URL
+		urlNoQuery.RawQuery = ""
+		entry := logging.AccessLogEntry{
+			RemoteHost:  host,
+			Time:        start,
+			RequestLine: fmt.Sprintf("%s %s %s", req.Method, urlNoQuery.RequestURI(), req.Proto),
+			Status:      status,
+			Bytes:       rec.bytes,
+			Referer:     req.Referer(),
+			UserAgent:   req.UserAgent(),
+		}
+		mu.Lock()
+		fmt.Fprintln(w, entry.CombinedFormat())
+		mu.Unlock()
+	})
+}
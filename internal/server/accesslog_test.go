@@ -0,0 +1,41 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+)
+
+func TestWithAccessLog(t *testing.T) {
+	inner := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(201)
+		io.WriteString(resp, "hello")
+	})
+
+	t.Run("text", func(t *testing.T) {
+		var buf bytes.Buffer
+		handler := withAccessLog(inner, config.LogFormatText, &buf)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil))
+		if buf.Len() != 0 {
+			t.Errorf("unexpected access log output: %s", buf.String())
+		}
+	})
+	t.Run("combined", func(t *testing.T) {
+		var buf bytes.Buffer
+		handler := withAccessLog(inner, config.LogFormatCombined, &buf)
+		req := httptest.NewRequest("GET", "/foo?secret", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("User-Agent", "Terraform/1.5.0")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		lineRe := regexp.MustCompile(`^192\.0\.2\.1 - - \[\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /foo HTTP/1\.1" 201 5 "-" "Terraform/1\.5\.0"\n$`)
+		if got := buf.String(); !lineRe.MatchString(got) {
+			t.Errorf("wrong access log line: %q", got)
+		}
+	})
+}
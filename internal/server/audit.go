@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/logging"
+)
+
+// withAuditLog wraps the given handler so that each response refusing a
+// client's request with a 401 or 403 status is recorded in the given audit
+// log, or returns the handler unchanged if there is no audit log. Clients
+// are identified as for [clientKey] with the given IPv6 prefix length.
+func withAuditLog(next http.Handler, auditLog *logging.AuditLog, ipv6PrefixLength int) http.Handler {
+	if auditLog == nil {
+		return next
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		rec := &statusRecorder{ResponseWriter: resp}
+		next.ServeHTTP(rec, req)
+		if rec.status == http.StatusUnauthorized || rec.status == http.StatusForbidden {
+			auditLog.Record(clientAuditEvent(req, ipv6PrefixLength, logging.AuditClientAuthFailure, "", fmt.Sprintf("responded with status %d", rec.status)))
+		}
+	})
+}
+
+// clientAuditEvent returns an audit event of the given kind caused by the
+// given client request to the service with the given name, if any. The
+// client is identified as for [clientKey] with the given IPv6 prefix length.
+func clientAuditEvent(req *http.Request, ipv6PrefixLength int, kind logging.AuditEventKind, service string, reason string) logging.AuditEvent {
+	user, _, _ := req.BasicAuth()
+	return logging.AuditEvent{
+		Kind:    kind,
+		Service: service,
+		Client:  clientKey(req, ipv6PrefixLength),
+		User:    user,
+		Path:    req.URL.Path,
+		Reason:  reason,
+	}
+}
+
+// auditBackendAuthTransport is an [http.RoundTripper] that records each
+// response from an origin registry refusing a request with a 401 or 403
+// status in an audit log.
+type auditBackendAuthTransport struct {
+	auditLog *logging.AuditLog
+	service  string
+	next     http.RoundTripper
+
+	// ipv6PrefixLength is passed to [clientKey] when attributing a
+	// response to the client whose request caused it.
+	ipv6PrefixLength int
+
+	// handshake is set if the service's client authenticates using its own
+	// credentials, in which case a "401 Unauthorized" response to a
+	// request without credentials is just the registry's challenge, and
+	// not a failure.
+	handshake bool
+}
+
+func (t *auditBackendAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || (resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden) {
+		return resp, err
+	}
+
+	credentials := "without credentials"
+	if req.Header.Get("Authorization") != "" {
+		credentials = "with credentials"
+	} else if t.handshake && resp.StatusCode == http.StatusUnauthorized {
+		return resp, nil
+	}
+	reason := fmt.Sprintf("origin registry responded with status %d to %s %s %s", resp.StatusCode, req.Method, req.URL.Redacted(), credentials)
+	event := logging.AuditEvent{
+		Kind:    logging.AuditBackendAuthFailure,
+		Service: t.service,
+		Reason:  reason,
+	}
+	// Requests made on behalf of a client, rather than for the server's own
+	// purposes, are attributed to that client.
+	if originalReq := contextOriginalReq(req.Context()); originalReq != nil {
+		event = clientAuditEvent(originalReq, t.ipv6PrefixLength, logging.AuditBackendAuthFailure, t.service, reason)
+	}
+	if event.User == "" {
+		event.User, _, _ = req.BasicAuth()
+	}
+	t.auditLog.Record(event)
+	return resp, nil
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/logging"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/querysecret"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWithAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	auditLog := logging.NewAuditLog(&buf, 0)
+	handler := withAuditLog(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/unauthorized":
+			resp.WriteHeader(401)
+		case "/forbidden":
+			resp.WriteHeader(403)
+		case "/missing":
+			resp.WriteHeader(404)
+		default:
+			resp.WriteHeader(200)
+		}
+	}), auditLog, 0)
+
+	for _, path := range []string{"/ok", "/unauthorized", "/missing", "/forbidden"} {
+		req := httptest.NewRequest("GET", path+"?secret=1", nil)
+		req.SetBasicAuth("alice", "password")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	got := readAuditEvents(t, &buf)
+	want := []logging.AuditEvent{
+		{
+			Kind:   logging.AuditClientAuthFailure,
+			Client: "192.0.2.1",
+			User:   "alice",
+			Path:   "/unauthorized",
+			Reason: "responded with status 401",
+		},
+		{
+			Kind:   logging.AuditClientAuthFailure,
+			Client: "192.0.2.1",
+			User:   "alice",
+			Path:   "/forbidden",
+			Reason: "responded with status 403",
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong events\n%s", diff)
+	}
+}
+
+func TestWithAuditLogIPv6Prefix(t *testing.T) {
+	var buf bytes.Buffer
+	auditLog := logging.NewAuditLog(&buf, 0)
+	handler := withAuditLog(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(401)
+	}), auditLog, 64)
+
+	for _, remoteAddr := range []string{"[2001:db8:1:2::a]:1234", "192.0.2.1:1234"} {
+		req := httptest.NewRequest("GET", "/unauthorized", nil)
+		req.RemoteAddr = remoteAddr
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	var got []string
+	for _, event := range readAuditEvents(t, &buf) {
+		got = append(got, event.Client)
+	}
+	want := []string{"2001:db8:1:2::/64", "192.0.2.1"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong clients\n%s", diff)
+	}
+}
+
+func TestProviderMirrorAuditLog(t *testing.T) {
+	registryServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/v2/" {
+			resp.WriteHeader(200)
+			return
+		}
+		resp.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+		resp.WriteHeader(401)
+	}))
+	defer registryServer.Close()
+
+	var buf bytes.Buffer
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.ProxyPackages = true
+	shared := newTestSharedState()
+	shared.auditLog = logging.NewAuditLog(&buf, 0)
+	shared.secreter = querysecret.NewSecreter([32]byte{})
+	mirrorServer := newTestMirrorServerShared(t, mirror, shared)
+	defer mirrorServer.Close()
+
+	req, err := http.NewRequest("GET", mirrorServer.URL+"/mirror/example.com/foo/bar/index.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("alice", "wrong")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Errorf("wrong status %d for index; want 401", resp.StatusCode)
+	}
+
+	resp, err = http.Get(mirrorServer.URL + "/mirror/example.com/foo/bar/download?not-a-token")
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("wrong status %d for download; want 404", resp.StatusCode)
+	}
+
+	got := readAuditEvents(t, &buf)
+	if len(got) != 2 {
+		t.Fatalf("wrong number of events %d; want 2\n%#v", len(got), got)
+	}
+	for i := range got {
+		// The reasons include details we don't need to check exactly.
+		if got[i].Reason == "" {
+			t.Errorf("event %d has no reason", i)
+		}
+		got[i].Reason = ""
+	}
+	want := []logging.AuditEvent{
+		{
+			Kind:    logging.AuditBackendAuthFailure,
+			Service: "mirror",
+			Client:  "127.0.0.1",
+			User:    "alice",
+			Path:    "/mirror/example.com/foo/bar/index.json",
+		},
+		{
+			Kind:    logging.AuditInvalidDownloadToken,
+			Service: "mirror",
+			Client:  "127.0.0.1",
+			Path:    "/mirror/example.com/foo/bar/download",
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong events\n%s", diff)
+	}
+}
+
+// readAuditEvents decodes the audit events written to the given buffer,
+// with their times removed so that they can be compared.
+func readAuditEvents(t *testing.T, buf *bytes.Buffer) []logging.AuditEvent {
+	t.Helper()
+	var ret []logging.AuditEvent
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var event logging.AuditEvent
+		if err := dec.Decode(&event); err != nil {
+			t.Fatalf("invalid audit log line: %s", err)
+		}
+		if event.Time.IsZero() {
+			t.Errorf("event has no time")
+		}
+		event.Time = time.Time{}
+		ret = append(ret, event)
+	}
+	return ret
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"expvar"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// backpressureDelays counts how many requests were delayed by
+// [withBackpressure] because too many requests were already in progress.
+var backpressureDelays = expvar.NewInt("backpressure_delays")
+
+// withBackpressure wraps the given handler so that, once more than threshold
+// requests are in progress at once, each new request is delayed before
+// being handled. The delay grows in proportion to how far over the
+// threshold the server is, up to maxDelay.
+//
+// This is gentler than rejecting requests outright, so that bursts of
+// legitimate traffic are smoothed out rather than failing. If the client
+// gives up while its request is delayed then the wrapped handler is never
+// called, and the response status is [statusClientClosedRequest] so that
+// the request isn't logged as a success.
+//
+// If threshold is zero then the handler is returned unchanged.
+func withBackpressure(next http.Handler, threshold int, maxDelay time.Duration) http.Handler {
+	if threshold == 0 {
+		return next
+	}
+	var inFlight int64
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+
+		if delay := backpressureDelay(n, threshold, maxDelay); delay > 0 {
+			backpressureDelays.Add(1)
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				resp.WriteHeader(statusClientClosedRequest)
+				return
+			}
+		}
+		next.ServeHTTP(resp, req)
+	})
+}
+
+// statusClientClosedRequest is the non-standard status code, borrowed from
+// nginx, for a request whose client went away before the server responded.
+// The client never sees it, but the access log records it.
+const statusClientClosedRequest = 499
+
+// backpressureDelay returns how long to delay a request when inFlight
+// requests, including that one, are in progress.
+func backpressureDelay(inFlight int64, threshold int, maxDelay time.Duration) time.Duration {
+	excess := inFlight - int64(threshold)
+	if excess <= 0 {
+		return 0
+	}
+	if excess >= int64(threshold) {
+		return maxDelay
+	}
+	return maxDelay * time.Duration(excess) / time.Duration(threshold)
+}
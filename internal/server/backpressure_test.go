@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+)
+
+func TestBackpressureDelay(t *testing.T) {
+	tests := []struct {
+		inFlight int64
+		want     time.Duration
+	}{
+		{1, 0},
+		{4, 0},
+		{5, 250 * time.Millisecond},
+		{6, 500 * time.Millisecond},
+		{7, 750 * time.Millisecond},
+		{8, time.Second},
+		{100, time.Second},
+	}
+	for _, test := range tests {
+		got := backpressureDelay(test.inFlight, 4, time.Second)
+		if got != test.want {
+			t.Errorf("wrong delay for %d in flight\ngot:  %s\nwant: %s", test.inFlight, got, test.want)
+		}
+	}
+}
+
+func TestWithBackpressure(t *testing.T) {
+	const maxDelay = 200 * time.Millisecond
+
+	// The first request blocks until we unblock it, so that it holds the
+	// server at its threshold while we make other requests.
+	unblock := make(chan struct{})
+	started := make(chan struct{})
+	var called int32
+	handler := withBackpressure(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/block" {
+			close(started)
+			<-unblock
+			return
+		}
+		atomic.AddInt32(&called, 1)
+		resp.WriteHeader(http.StatusNoContent)
+	}), 1, maxDelay)
+
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/block", nil))
+		close(done)
+	}()
+	<-started
+	defer func() {
+		close(unblock)
+		<-done
+	}()
+
+	t.Run("delayed", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if elapsed := time.Since(start); elapsed < maxDelay {
+			t.Errorf("request completed after only %s; want at least %s", elapsed, maxDelay)
+		}
+		if got, want := rec.Code, http.StatusNoContent; got != want {
+			t.Errorf("wrong status %d; want %d", got, want)
+		}
+	})
+	t.Run("canceled", func(t *testing.T) {
+		atomic.StoreInt32(&called, 0)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		start := time.Now()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+		if elapsed := time.Since(start); elapsed >= maxDelay {
+			t.Errorf("canceled request was delayed for %s", elapsed)
+		}
+		if atomic.LoadInt32(&called) != 0 {
+			t.Errorf("handler was called for canceled request")
+		}
+	})
+	t.Run("canceled during delay", func(t *testing.T) {
+		atomic.StoreInt32(&called, 0)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		time.AfterFunc(maxDelay/4, cancel)
+		var logs bytes.Buffer
+		rec := httptest.NewRecorder()
+		withAccessLog(handler, config.LogFormatCombined, &logs).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+		if got, want := rec.Code, statusClientClosedRequest; got != want {
+			t.Errorf("wrong status %d; want %d", got, want)
+		}
+		if !strings.Contains(logs.String(), `"GET / HTTP/1.1" 499 `) {
+			t.Errorf("access log doesn't record status 499:\n%s", logs.String())
+		}
+		if atomic.LoadInt32(&called) != 0 {
+			t.Errorf("handler was called for canceled request")
+		}
+	})
+}
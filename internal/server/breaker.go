@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// circuitBreaker tracks failures of requests to a backend so that we can stop
+// sending requests to a backend that's consistently failing, for a cooldown
+// period, instead of making every client wait for it to fail again.
+//
+// A breaker starts closed, allowing all requests. After threshold
+// consecutive failures it opens, rejecting all requests until the cooldown
+// period has passed. It's then half-open, allowing a single probe request
+// whose outcome decides whether the breaker closes again or reopens for
+// another cooldown period.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	// now is the function used to get the current time, which can be
+	// overridden for testing.
+	now func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("breakerState(%d)", int(s))
+	}
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow decides whether a request may be sent to the backend. If not, the
+// first result is how long the caller should wait before trying again.
+//
+// If allow returns true then the caller must later call exactly one of
+// [circuitBreaker.record] or [circuitBreaker.abandon].
+func (b *circuitBreaker) allow() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen {
+		remain := b.openedAt.Add(b.cooldown).Sub(b.now())
+		if remain > 0 {
+			return remain, false
+		}
+		b.state = breakerHalfOpen
+	}
+	if b.state == breakerHalfOpen {
+		if b.probing {
+			// Only one probe at a time, so that a still-failing backend
+			// isn't hit by a burst of requests as soon as the cooldown ends.
+			return b.cooldown, false
+		}
+		b.probing = true
+	}
+	return 0, true
+}
+
+// record reports the outcome of a request previously allowed by
+// [circuitBreaker.allow].
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if success {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+// abandon reports that a request previously allowed by
+// [circuitBreaker.allow] ended without telling us anything about the health
+// of the backend, such as because the client canceled it.
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *circuitBreaker) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// breakerTransport is an [http.RoundTripper] that consults a circuit breaker
+// before each request and reports the outcome of each request to it.
+//
+// Network errors and server error responses count as failures.
+type breakerTransport struct {
+	breaker *circuitBreaker
+	next    http.RoundTripper
+
+	// host is the host of the origin registry that the breaker protects.
+	// Requests to other hosts, such as the storage locations that the
+	// origin registry redirects blob requests to, bypass the breaker
+	// because their failures say nothing about the origin registry.
+	host string
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host {
+		return t.next.RoundTrip(req)
+	}
+	retryAfter, ok := t.breaker.allow()
+	if !ok {
+		return nil, breakerOpenError{RetryAfter: retryAfter}
+	}
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case err != nil && req.Context().Err() == context.Canceled:
+		t.breaker.abandon()
+	case err != nil:
+		t.breaker.record(false)
+	default:
+		t.breaker.record(resp.StatusCode < 500)
+	}
+	return resp, err
+}
+
+// breakerOpenError is returned when a request is rejected because the
+// circuit breaker for its backend is open.
+type breakerOpenError struct {
+	RetryAfter time.Duration
+}
+
+func (err breakerOpenError) Error() string {
+	return "backend is temporarily unavailable after repeated failures"
+}
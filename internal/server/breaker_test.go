@@ -0,0 +1,215 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker(3, 10*time.Second)
+	b.now = func() time.Time { return now }
+
+	mustAllow := func(t *testing.T) {
+		t.Helper()
+		if _, ok := b.allow(); !ok {
+			t.Fatalf("request rejected in state %s", b.currentState())
+		}
+	}
+	mustReject := func(t *testing.T) time.Duration {
+		t.Helper()
+		retryAfter, ok := b.allow()
+		if ok {
+			t.Fatalf("request allowed in state %s", b.currentState())
+		}
+		return retryAfter
+	}
+	wantState := func(t *testing.T, want breakerState) {
+		t.Helper()
+		if got := b.currentState(); got != want {
+			t.Fatalf("wrong state %s; want %s", got, want)
+		}
+	}
+
+	// Failures below the threshold, interrupted by a success, don't trip
+	// the breaker.
+	for i := 0; i < 2; i++ {
+		mustAllow(t)
+		b.record(false)
+	}
+	mustAllow(t)
+	b.record(true)
+	wantState(t, breakerClosed)
+
+	// Consecutive failures reaching the threshold do.
+	for i := 0; i < 3; i++ {
+		mustAllow(t)
+		b.record(false)
+	}
+	wantState(t, breakerOpen)
+	if got, want := mustReject(t), 10*time.Second; got != want {
+		t.Errorf("wrong retry delay %s; want %s", got, want)
+	}
+
+	now = now.Add(4 * time.Second)
+	if got, want := mustReject(t), 6*time.Second; got != want {
+		t.Errorf("wrong retry delay %s; want %s", got, want)
+	}
+
+	// After the cooldown, a single probe is allowed.
+	now = now.Add(6 * time.Second)
+	mustAllow(t)
+	wantState(t, breakerHalfOpen)
+	mustReject(t)
+
+	// A failed probe reopens the breaker for another cooldown period.
+	b.record(false)
+	wantState(t, breakerOpen)
+	mustReject(t)
+
+	// A probe abandoned without an outcome allows another probe.
+	now = now.Add(10 * time.Second)
+	mustAllow(t)
+	b.abandon()
+	wantState(t, breakerHalfOpen)
+	mustAllow(t)
+
+	// A successful probe closes the breaker.
+	b.record(true)
+	wantState(t, breakerClosed)
+	mustAllow(t)
+	b.record(true)
+}
+
+func TestBreakerTransport(t *testing.T) {
+	status := 500
+	backend := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(status)
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	breaker := newCircuitBreaker(2, time.Minute)
+	client := &http.Client{
+		Transport: &breakerTransport{
+			breaker: breaker,
+			next:    http.DefaultTransport,
+			host:    backendURL.Host,
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(backend.URL)
+		if err != nil {
+			t.Fatalf("request %d failed: %s", i, err)
+		}
+		resp.Body.Close()
+	}
+	if got := breaker.currentState(); got != breakerOpen {
+		t.Fatalf("wrong state %s after server errors; want open", got)
+	}
+
+	status = 200
+	_, err = client.Get(backend.URL)
+	var breakerErr breakerOpenError
+	if !errors.As(err, &breakerErr) {
+		t.Fatalf("wrong error %v; want breakerOpenError", err)
+	}
+	if breakerErr.RetryAfter <= 0 {
+		t.Errorf("non-positive retry delay %s", breakerErr.RetryAfter)
+	}
+}
+
+func TestBreakerTransportOtherHost(t *testing.T) {
+	// The origin registry redirects every request to a storage host that
+	// always fails.
+	storage := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(500)
+	}))
+	defer storage.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		http.Redirect(resp, req, storage.URL+req.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer origin.Close()
+	originURL, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A single failure would be enough to open this breaker if it counted
+	// the requests to the storage host.
+	breaker := newCircuitBreaker(1, time.Minute)
+	client := &http.Client{
+		Transport: &breakerTransport{
+			breaker: breaker,
+			next:    http.DefaultTransport,
+			host:    originURL.Host,
+		},
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(origin.URL + "/blob")
+		if err != nil {
+			t.Fatalf("request %d failed: %s", i, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 500 {
+			t.Fatalf("wrong status %d for request %d; want 500", resp.StatusCode, i)
+		}
+	}
+	if got := breaker.currentState(); got != breakerClosed {
+		t.Errorf("wrong state %s after storage errors; want closed", got)
+	}
+}
+
+func TestProviderMirrorBreakerOpen(t *testing.T) {
+	backendRequests := 0
+	registryServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		backendRequests++
+		resp.WriteHeader(500)
+	}))
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	shared := newTestSharedState()
+	shared.config.BreakerThreshold = 2
+	shared.config.BreakerCooldown = time.Minute
+	mirrorServer := newTestMirrorServerShared(t, mirror, shared)
+	defer mirrorServer.Close()
+
+	get := func(t *testing.T) *http.Response {
+		t.Helper()
+		resp, err := http.Get(mirrorServer.URL + "/mirror/example.com/foo/bar/index.json")
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 2; i++ {
+		if resp := get(t); resp.StatusCode != 502 {
+			t.Fatalf("wrong status %d for request %d; want 502", resp.StatusCode, i)
+		}
+	}
+
+	// The breaker is now open, so the server answers without asking the
+	// origin registry, and tells the client when the cooldown ends.
+	backendRequests = 0
+	resp := get(t)
+	if resp.StatusCode != 503 {
+		t.Fatalf("wrong status %d with open breaker; want 503", resp.StatusCode)
+	}
+	if got, want := resp.Header.Get("Retry-After"), "60"; got != want {
+		t.Errorf("wrong Retry-After %q; want %q", got, want)
+	}
+	if backendRequests != 0 {
+		t.Errorf("made %d requests to the origin registry with open breaker; want none", backendRequests)
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/cache"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/logging"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+)
+
+// capabilityProbe probes the capabilities of a service's origin registry.
+type capabilityProbe func(ctx context.Context) (ocidist.Capabilities, error)
+
+// capabilitiesReport is the JSON response describing which optional features
+// the origin registry of each service supports, for use by operators
+// deciding which features they can safely enable.
+type capabilitiesReport struct {
+	Services []serviceCapabilities `json:"services"`
+}
+
+type serviceCapabilities struct {
+	Name string `json:"name"`
+
+	// Capabilities is nil if probing the origin registry failed, in which
+	// case Error describes why.
+	Capabilities *capabilitiesJSON `json:"capabilities,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// capabilitiesJSON is the JSON representation of [ocidist.Capabilities],
+// where null means that the capability wasn't probed.
+type capabilitiesJSON struct {
+	Catalog          bool  `json:"catalog"`
+	Referrers        *bool `json:"referrers"`
+	RangeRequests    *bool `json:"range_requests"`
+	BlobsRequireAuth *bool `json:"blobs_require_auth"`
+}
+
+// capabilitiesHandler returns a handler that responds with the capabilities
+// of the origin registry of each service with a probe in the given map,
+// reusing each result for the given time-to-live.
+func capabilitiesHandler(probes map[string]capabilityProbe, ttl time.Duration) http.HandlerFunc {
+	names := make([]string, 0, len(probes))
+	for name := range probes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	results := cache.New[string, ocidist.Capabilities](ttl, 0)
+	neverStale := func(error) bool { return false }
+
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			resp.Header().Set("Allow", "GET, HEAD")
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := req.Context()
+		logger := logging.ContextLogger(ctx)
+
+		report := capabilitiesReport{
+			Services: make([]serviceCapabilities, 0, len(names)),
+		}
+		for _, name := range names {
+			probe := probes[name]
+			caps, _, err := results.Get(name, func() (ocidist.Capabilities, error) {
+				logger.Printf("probing capabilities of the origin registry for %q", name)
+				return probe(ctx)
+			}, neverStale)
+			svc := serviceCapabilities{Name: name}
+			if err != nil {
+				logger.Warnf("failed to probe capabilities of the origin registry for %q: %s", name, err)
+				svc.Error = err.Error()
+			} else {
+				svc.Capabilities = &capabilitiesJSON{
+					Catalog:          caps.Catalog,
+					Referrers:        caps.Referrers,
+					RangeRequests:    caps.RangeRequests,
+					BlobsRequireAuth: caps.BlobsRequireAuth,
+				}
+			}
+			report.Services = append(report.Services, svc)
+		}
+		writeJSONResponse(resp, req, report, jsonResponseOptions{headContentLength: true}, logger)
+	}
+}
+
+// findProbeSample returns the namespace and digest of a provider package
+// that can be used as the sample blob when probing an origin registry's
+// capabilities, choosing the first package of one of the given media types
+// in the manifest of the newest version of the provider.
+func findProbeSample(ctx context.Context, client *ocidist.Client, metaAddr, pkgAddr ocidist.Namespace, mediaTypes []string) (ocidist.Namespace, ocidist.Digest, error) {
+	tags, err := client.GetNamespaceTags(ctx, metaAddr)
+	if err != nil {
+		return nil, "", err
+	}
+	tag, ok := newestVersionTag(tags)
+	if !ok {
+		return nil, "", fmt.Errorf("%s has no version tags", metaAddr)
+	}
+	manifest, err := client.GetManifest(ctx, metaAddr, tag)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, layer := range manifest.Layers {
+		for _, mt := range mediaTypes {
+			if layer.MediaType == mt {
+				return pkgAddr, layer.Digest, nil
+			}
+		}
+	}
+	return nil, "", fmt.Errorf("%s:%s has no provider packages", metaAddr, tag)
+}
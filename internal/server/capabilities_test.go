@@ -0,0 +1,135 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCapabilitiesHandler(t *testing.T) {
+	pkg := []byte("package")
+	registry := newFakeRegistry()
+	registry.addManifest(
+		"terraform-providers/example.com/foo/bar", "1.0.0",
+		testProviderManifest(ocidist.ObjectMeta{
+			MediaType: "application/vnd.hashicorp.terraform.provider-package+zip",
+			Digest:    testDigest(pkg),
+			Size:      int64(len(pkg)),
+			Annotations: map[string]any{
+				"io.terraform.target-platforms": "linux_amd64",
+			},
+		}),
+	)
+	registry.addBlob("terraform-providers/example.com/foo/bar", pkg)
+	var catalogRequests int
+	registryServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/_catalog") {
+			catalogRequests++
+		}
+		registry.ServeHTTP(resp, req)
+	}))
+	defer registryServer.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	shared := newTestSharedState()
+
+	sampled := newTestProviderMirror(t, registryServer.URL)
+	sampled.Name = "sampled"
+	sampled.ProbeProvider = "example.com/foo/bar"
+	providerMirrorHandler(sampled, shared)
+
+	unsampled := newTestProviderMirror(t, registryServer.URL)
+	unsampled.Name = "unsampled"
+	providerMirrorHandler(unsampled, shared)
+
+	broken := newTestProviderMirror(t, unreachable.URL)
+	broken.Name = "broken"
+	providerMirrorHandler(broken, shared)
+
+	server := httptest.NewServer(capabilitiesHandler(shared.capabilityProbes, time.Minute))
+	defer server.Close()
+
+	var got capabilitiesReport
+	status := getJSON(t, server.URL, &got)
+	if status != 200 {
+		t.Fatalf("wrong status %d", status)
+	}
+	if len(got.Services) != 3 {
+		t.Fatalf("wrong number of services %d; want 3", len(got.Services))
+	}
+	if got.Services[0].Error == "" {
+		t.Errorf("no error message for unreachable registry")
+	}
+	got.Services[0].Error = ""
+	// The fake registry supports only the required parts of the protocol,
+	// and doesn't require authentication.
+	no := false
+	want := capabilitiesReport{
+		Services: []serviceCapabilities{
+			{Name: "broken"},
+			{
+				Name: "sampled",
+				Capabilities: &capabilitiesJSON{
+					Catalog:          false,
+					Referrers:        &no,
+					RangeRequests:    &no,
+					BlobsRequireAuth: &no,
+				},
+			},
+			{
+				Name: "unsampled",
+				Capabilities: &capabilitiesJSON{
+					Catalog: false,
+				},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong response\n%s", diff)
+	}
+
+	// The results are cached, so a second request doesn't probe again.
+	if status := getJSON(t, server.URL, &got); status != 200 {
+		t.Fatalf("wrong status %d for second request", status)
+	}
+	if catalogRequests != 2 {
+		t.Errorf("registry received %d catalog requests; want 2", catalogRequests)
+	}
+}
+
+func TestNewestVersionTag(t *testing.T) {
+	tests := map[string]struct {
+		tags   []ocidist.Reference
+		want   ocidist.Reference
+		wantOK bool
+	}{
+		"none": {
+			tags:   nil,
+			wantOK: false,
+		},
+		"no versions": {
+			tags:   []ocidist.Reference{"latest", "main"},
+			wantOK: false,
+		},
+		"mixed": {
+			tags:   []ocidist.Reference{"1.0.0", "latest", "1.10.0", "1.2.0"},
+			want:   "1.10.0",
+			wantOK: true,
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			got, ok := newestVersionTag(test.tags)
+			if got != test.want || ok != test.wantOK {
+				t.Errorf("wrong result %q, %t; want %q, %t", got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
@@ -2,22 +2,67 @@ package server
 
 import (
 	"context"
+	"net"
 	"net/http"
+	"net/url"
 )
 
+// contextKey is the type of all of the context keys used by this package.
+// Because it's unexported, these keys can't collide with those of any other
+// package.
+//
+// Values associated with these keys must be accessed only through the
+// accessor functions in this file, which tolerate the value being absent.
 type contextKey string
 
 const remoteAddrContextKey = contextKey("remoteAddr")
 const originalReq = contextKey("originalReq")
+const backendQueryContextKey = contextKey("backendQuery")
+const serverTimingsContextKey = contextKey("serverTimings")
 
 func contextWithOriginalReq(parentCtx context.Context, req *http.Request) context.Context {
 	return context.WithValue(parentCtx, originalReq, req)
 }
 
+// contextOriginalReq returns the request previously saved using
+// [contextWithOriginalReq], or nil if there is none.
 func contextOriginalReq(ctx context.Context) *http.Request {
-	ret := ctx.Value(originalReq)
-	if ret == nil {
-		return nil
-	}
-	return ret.(*http.Request)
+	ret, _ := ctx.Value(originalReq).(*http.Request)
+	return ret
+}
+
+func contextWithRemoteAddr(parentCtx context.Context, addr net.Addr) context.Context {
+	return context.WithValue(parentCtx, remoteAddrContextKey, addr)
+}
+
+// contextRemoteAddr returns the address previously saved using
+// [contextWithRemoteAddr], or nil if there is none.
+func contextRemoteAddr(ctx context.Context) net.Addr {
+	ret, _ := ctx.Value(remoteAddrContextKey).(net.Addr)
+	return ret
+}
+
+// contextWithBackendQuery returns a context that causes requests to the
+// origin registry made with it to include the given query string arguments,
+// in addition to any that the request already has.
+func contextWithBackendQuery(parentCtx context.Context, query url.Values) context.Context {
+	return context.WithValue(parentCtx, backendQueryContextKey, query)
+}
+
+// contextBackendQuery returns the query string arguments previously saved
+// using [contextWithBackendQuery], or nil if there are none.
+func contextBackendQuery(ctx context.Context) url.Values {
+	ret, _ := ctx.Value(backendQueryContextKey).(url.Values)
+	return ret
+}
+
+func contextWithServerTimings(parentCtx context.Context, timings *serverTimings) context.Context {
+	return context.WithValue(parentCtx, serverTimingsContextKey, timings)
+}
+
+// contextServerTimings returns the server timings previously saved using
+// [contextWithServerTimings], or nil if there are none.
+func contextServerTimings(ctx context.Context) *serverTimings {
+	ret, _ := ctx.Value(serverTimingsContextKey).(*serverTimings)
+	return ret
 }
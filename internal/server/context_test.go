@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestContextAccessors(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		ctx := context.Background()
+		if got := contextOriginalReq(ctx); got != nil {
+			t.Errorf("unexpected original request %#v", got)
+		}
+		if got := contextRemoteAddr(ctx); got != nil {
+			t.Errorf("unexpected remote address %#v", got)
+		}
+	})
+	t.Run("wrong types", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), originalReq, "not a request")
+		ctx = context.WithValue(ctx, remoteAddrContextKey, 12)
+		if got := contextOriginalReq(ctx); got != nil {
+			t.Errorf("unexpected original request %#v", got)
+		}
+		if got := contextRemoteAddr(ctx); got != nil {
+			t.Errorf("unexpected remote address %#v", got)
+		}
+	})
+	t.Run("populated", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+		ctx := contextWithOriginalReq(context.Background(), req)
+		ctx = contextWithRemoteAddr(ctx, addr)
+		if got := contextOriginalReq(ctx); got != req {
+			t.Errorf("wrong original request %#v", got)
+		}
+		if got := contextRemoteAddr(ctx); got != addr {
+			t.Errorf("wrong remote address %#v", got)
+		}
+	})
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/logging"
+)
+
+// serverDescription is the JSON response describing the services that the
+// server offers, for use by operators and their tools. This is unrelated to
+// Terraform's own service discovery protocol.
+type serverDescription struct {
+	Services []serviceDescription `json:"services"`
+}
+
+type serviceDescription struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+
+	// BasePath is the path under which the service's endpoints are
+	// available on this server, and BaseURL is the absolute URL where
+	// clients can reach it, if configured.
+	BasePath string `json:"base_path"`
+	BaseURL  string `json:"base_url,omitempty"`
+
+	Endpoints []endpointDescription `json:"endpoints"`
+}
+
+type endpointDescription struct {
+	Method string `json:"method"`
+
+	// Path is a template for the endpoint's path, relative to the service's
+	// base path, with variable segments written in braces.
+	Path        string `json:"path"`
+	Description string `json:"description"`
+}
+
+// describeServer returns a description of the services in the given
+// configuration, in order by name.
+func describeServer(cfg *config.Config) serverDescription {
+	ret := serverDescription{
+		Services: make([]serviceDescription, 0, len(cfg.ProviderMirrors)+len(cfg.ProviderRegistries)+len(cfg.ModuleRegistries)),
+	}
+	for _, mirror := range cfg.ProviderMirrors {
+		svc := serviceDescription{
+			Name:     mirror.Name,
+			Protocol: "provider_mirror",
+			BasePath: "/" + mirror.Name + "/",
+			Endpoints: []endpointDescription{
+				{
+					Method:      "GET",
+					Path:        "{hostname}/{namespace}/{type}/index.json",
+					Description: "Lists the available versions of a provider.",
+				},
+				{
+					Method:      "GET",
+					Path:        "{hostname}/{namespace}/{type}/{version}.json",
+					Description: "Lists the packages available for a provider version.",
+				},
+			},
+		}
+		if mirror.ExternalURL != nil {
+			svc.BaseURL = mirror.ExternalURL.String()
+		}
+		if mirror.ProxyPackages {
+			svc.Endpoints = append(svc.Endpoints, endpointDescription{
+				Method:      "GET",
+				Path:        "{hostname}/{namespace}/{type}/download",
+				Description: "Downloads a provider package, using a URL from a version response.",
+			})
+		}
+		if mirror.ProviderIndex {
+			svc.Endpoints = append(svc.Endpoints,
+				endpointDescription{
+					Method:      "GET",
+					Path:        "_providers",
+					Description: "Lists all of the available providers as a HTML page.",
+				},
+				endpointDescription{
+					Method:      "GET",
+					Path:        "_providers.json",
+					Description: "Lists all of the available providers as JSON.",
+				},
+			)
+		}
+		ret.Services = append(ret.Services, svc)
+	}
+	for _, registry := range cfg.ProviderRegistries {
+		ret.Services = append(ret.Services, serviceDescription{
+			Name:     registry.Name,
+			Protocol: "provider_registry",
+			BasePath: "/" + registry.Name + "/",
+			Endpoints: []endpointDescription{
+				{
+					Method:      "GET",
+					Path:        registryProtocolPath + "{namespace}/{type}/versions",
+					Description: "Lists the available versions of a provider and their platforms.",
+				},
+				{
+					Method:      "GET",
+					Path:        registryProtocolPath + "{namespace}/{type}/{version}/download/{os}/{arch}",
+					Description: "Describes the package for a provider version on one platform.",
+				},
+				{
+					Method:      "GET",
+					Path:        registryProtocolPath + "{namespace}/{type}/{version}/shasums",
+					Description: "Lists the SHA-256 checksums of the packages for a provider version.",
+				},
+			},
+		})
+	}
+	for _, registry := range cfg.ModuleRegistries {
+		svc := serviceDescription{
+			Name:     registry.Name,
+			Protocol: "module_registry",
+			BasePath: "/" + registry.Name + "/",
+			Endpoints: []endpointDescription{
+				{
+					Method:      "GET",
+					Path:        moduleProtocolPath + "{namespace}/{name}/{system}/versions",
+					Description: "Lists the available versions of a module.",
+				},
+				{
+					Method:      "GET",
+					Path:        moduleProtocolPath + "{namespace}/{name}/{system}/{version}/download",
+					Description: "Gives the location of a module version's package in the X-Terraform-Get header.",
+				},
+			},
+		}
+		if registry.ProxyPackages {
+			svc.Endpoints = append(svc.Endpoints, endpointDescription{
+				Method:      "GET",
+				Path:        moduleProtocolPath + "{namespace}/{name}/{system}/download",
+				Description: "Downloads a module package, using a URL from a download response.",
+			})
+		}
+		ret.Services = append(ret.Services, svc)
+	}
+	sort.Slice(ret.Services, func(i, j int) bool {
+		return ret.Services[i].Name < ret.Services[j].Name
+	})
+	return ret
+}
+
+// descriptionHandler returns a handler that responds with the description of
+// the services in the given configuration.
+func descriptionHandler(cfg *config.Config) http.HandlerFunc {
+	desc := describeServer(cfg)
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			resp.Header().Set("Allow", "GET, HEAD")
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSONResponse(resp, req, desc, jsonResponseOptions{headContentLength: true}, logging.ContextLogger(req.Context()))
+	}
+}
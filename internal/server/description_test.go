@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDescriptionHandler(t *testing.T) {
+	cfg := &config.Config{
+		ProviderMirrors: map[string]*config.ProviderMirror{
+			"public": {
+				Name:          "public",
+				ProxyPackages: true,
+				ExternalURL:   &url.URL{Scheme: "https", Host: "example.com", Path: "/public/"},
+			},
+			"internal": {
+				Name:          "internal",
+				ProviderIndex: true,
+			},
+		},
+		Server: &config.Server{},
+	}
+	handler := descriptionHandler(cfg)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/services.json", nil))
+	if rec.Code != 200 {
+		t.Fatalf("wrong status %d", rec.Code)
+	}
+	var got any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON response: %s", err)
+	}
+
+	indexEndpoint := map[string]any{
+		"method":      "GET",
+		"path":        "{hostname}/{namespace}/{type}/index.json",
+		"description": "Lists the available versions of a provider.",
+	}
+	versionEndpoint := map[string]any{
+		"method":      "GET",
+		"path":        "{hostname}/{namespace}/{type}/{version}.json",
+		"description": "Lists the packages available for a provider version.",
+	}
+	want := map[string]any{
+		"services": []any{
+			map[string]any{
+				"name":      "internal",
+				"protocol":  "provider_mirror",
+				"base_path": "/internal/",
+				"endpoints": []any{
+					indexEndpoint,
+					versionEndpoint,
+					map[string]any{
+						"method":      "GET",
+						"path":        "_providers",
+						"description": "Lists all of the available providers as a HTML page.",
+					},
+					map[string]any{
+						"method":      "GET",
+						"path":        "_providers.json",
+						"description": "Lists all of the available providers as JSON.",
+					},
+				},
+			},
+			map[string]any{
+				"name":      "public",
+				"protocol":  "provider_mirror",
+				"base_path": "/public/",
+				"base_url":  "https://example.com/public/",
+				"endpoints": []any{
+					indexEndpoint,
+					versionEndpoint,
+					map[string]any{
+						"method":      "GET",
+						"path":        "{hostname}/{namespace}/{type}/download",
+						"description": "Downloads a provider package, using a URL from a version response.",
+					},
+				},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong response\n%s", diff)
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("POST", "/services.json", nil))
+	if rec.Code != 405 {
+		t.Errorf("wrong status %d for POST; want 405", rec.Code)
+	}
+}
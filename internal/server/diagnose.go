@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+)
+
+// originConfig is a combination of origin registry URL and name prefix that
+// a provider mirror could be configured with.
+type originConfig struct {
+	URL        *url.URL
+	NamePrefix ocidist.Namespace
+}
+
+// swappedOriginConfigs returns plausible corrections of the given origin
+// configuration for two common mistakes: including part of the repository
+// path in the origin URL rather than in the name prefix, and including the
+// registry's hostname in the name prefix.
+//
+// The result is empty if neither mistake seems possible, which is the case
+// for most valid configurations.
+func swappedOriginConfigs(cur originConfig) []originConfig {
+	var ret []originConfig
+	if path := strings.Trim(cur.URL.Path, "/"); path != "" {
+		if pathNS, err := ocidist.ParseNamespace(path); err == nil {
+			u := *cur.URL
+			u.Path = "/"
+			u.RawPath = ""
+			ret = append(ret, originConfig{
+				URL:        &u,
+				NamePrefix: pathNS.Append(cur.NamePrefix...),
+			})
+		}
+	}
+	if len(cur.NamePrefix) > 1 && strings.EqualFold(string(cur.NamePrefix[0]), cur.URL.Hostname()) {
+		ret = append(ret, originConfig{
+			URL:        cur.URL,
+			NamePrefix: cur.NamePrefix[1:],
+		})
+	}
+	return ret
+}
+
+// diagnoseOriginConfig looks for signs that the given origin configuration
+// is one of the mistakes that [swappedOriginConfigs] corrects, returning a
+// hint describing a better configuration, or "" if there's nothing to
+// suggest.
+//
+// sample is the part of the namespace of a provider's metadata that follows
+// the name prefix. probe reports whether the origin registry has that
+// namespace under a particular configuration, returning
+// [ocidist.NotFoundError] if not. If sample is nil then probe is instead
+// called with a nil namespace and must just check that the registry's API
+// is at the configured URL, which can reveal only a misplaced URL path.
+//
+// This is only a heuristic, so any other error from probe just means that
+// there's no hint.
+func diagnoseOriginConfig(ctx context.Context, cur originConfig, sample ocidist.Namespace, probe func(ctx context.Context, cfg originConfig, ns ocidist.Namespace) error) string {
+	candidates := swappedOriginConfigs(cur)
+	if len(candidates) == 0 {
+		return ""
+	}
+	sampleNS := func(cfg originConfig) ocidist.Namespace {
+		if sample == nil {
+			return nil
+		}
+		return cfg.NamePrefix.Append(sample...)
+	}
+
+	if _, ok := probe(ctx, cur, sampleNS(cur)).(ocidist.NotFoundError); !ok {
+		return ""
+	}
+	for _, alt := range candidates {
+		if sample == nil && alt.URL == cur.URL {
+			// Without a sample we can only check the URL.
+			continue
+		}
+		if probe(ctx, alt, sampleNS(alt)) == nil {
+			return fmt.Sprintf(
+				"the origin registry returned 404 Not Found with origin_url = %q and name_prefix = %q, but not with origin_url = %q and name_prefix = %q; origin_url should usually have no path, and name_prefix should not include the registry's hostname",
+				cur.URL, cur.NamePrefix, alt.URL, alt.NamePrefix,
+			)
+		}
+	}
+	return ""
+}
+
+// sampleMetadataNamespace returns the part after the name prefix of the
+// metadata namespace of a provider that the given service is expected to
+// serve, for [diagnoseOriginConfig], or nil if there's no such provider.
+func sampleMetadataNamespace(cfg *config.ProviderMirror) ocidist.Namespace {
+	var addr string
+	switch {
+	case cfg.ProbeProvider != "":
+		addr = cfg.ProbeProvider
+	case len(cfg.WarmProviders) != 0:
+		addr = cfg.WarmProviders[0]
+	default:
+		return nil
+	}
+	ns, err := providerNamespace(nil, cfg.AddressLayout, strings.Split(addr, "/"))
+	if err != nil {
+		return nil
+	}
+	return ns.Append(cfg.MetadataNameSuffix...)
+}
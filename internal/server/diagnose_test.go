@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/logging"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSwappedOriginConfigs(t *testing.T) {
+	tests := map[string]struct {
+		url        string
+		namePrefix string
+		want       []string
+	}{
+		"correct": {
+			url:        "https://registry.example.com/",
+			namePrefix: "terraform-providers",
+			want:       nil,
+		},
+		"path in URL": {
+			url:        "https://registry.example.com/myorg/",
+			namePrefix: "terraform-providers",
+			want:       []string{"https://registry.example.com/ myorg/terraform-providers"},
+		},
+		"hostname in prefix": {
+			url:        "https://registry.example.com:5000/",
+			namePrefix: "registry.example.com/terraform-providers",
+			want:       []string{"https://registry.example.com:5000/ terraform-providers"},
+		},
+		"only hostname in prefix": {
+			url:        "https://registry.example.com/",
+			namePrefix: "registry.example.com",
+			want:       nil,
+		},
+		"both": {
+			url:        "https://registry.example.com/myorg/",
+			namePrefix: "registry.example.com/terraform-providers",
+			want: []string{
+				"https://registry.example.com/ myorg/registry.example.com/terraform-providers",
+				"https://registry.example.com/myorg/ terraform-providers",
+			},
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			u, err := url.Parse(test.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cur := originConfig{URL: u, NamePrefix: ocidist.MustParseNamespace(test.namePrefix)}
+			var got []string
+			for _, alt := range swappedOriginConfigs(cur) {
+				got = append(got, alt.URL.String()+" "+alt.NamePrefix.String())
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("wrong result\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDiagnoseOriginConfig(t *testing.T) {
+	// The registry at registry.example.com has its API at the root and
+	// the sample provider under myorg/terraform-providers.
+	probe := func(ctx context.Context, cfg originConfig, ns ocidist.Namespace) error {
+		if cfg.URL.Path != "/" {
+			return ocidist.NotFoundError{}
+		}
+		if ns != nil && ns.String() != "myorg/terraform-providers/example.com/foo/bar" {
+			return ocidist.NotFoundError{}
+		}
+		return nil
+	}
+	sample := ocidist.MustParseNamespace("example.com/foo/bar")
+
+	tests := map[string]struct {
+		url        string
+		namePrefix string
+		sample     ocidist.Namespace
+		probe      func(ctx context.Context, cfg originConfig, ns ocidist.Namespace) error
+		wantHint   string
+	}{
+		"correct": {
+			url:        "https://registry.example.com/",
+			namePrefix: "myorg/terraform-providers",
+			sample:     sample,
+		},
+		"path in URL": {
+			url:        "https://registry.example.com/myorg/",
+			namePrefix: "terraform-providers",
+			sample:     sample,
+			wantHint:   `but not with origin_url = "https://registry.example.com/" and name_prefix = "myorg/terraform-providers"`,
+		},
+		"path in URL without sample": {
+			url:        "https://registry.example.com/myorg/",
+			namePrefix: "terraform-providers",
+			wantHint:   `but not with origin_url = "https://registry.example.com/" and name_prefix = "myorg/terraform-providers"`,
+		},
+		"hostname in prefix": {
+			url:        "https://registry.example.com/",
+			namePrefix: "registry.example.com/myorg/terraform-providers",
+			sample:     sample,
+			wantHint:   `but not with origin_url = "https://registry.example.com/" and name_prefix = "myorg/terraform-providers"`,
+		},
+		"hostname in prefix without sample": {
+			url:        "https://registry.example.com/",
+			namePrefix: "registry.example.com/myorg/terraform-providers",
+		},
+		"swap doesn't help": {
+			url:        "https://registry.example.com/other/",
+			namePrefix: "terraform-providers",
+			sample:     sample,
+		},
+		"unrelated failure": {
+			url:        "https://registry.example.com/myorg/",
+			namePrefix: "terraform-providers",
+			sample:     sample,
+			probe: func(ctx context.Context, cfg originConfig, ns ocidist.Namespace) error {
+				if cfg.URL.Path != "/" {
+					return ocidist.ErrUnauthorized
+				}
+				return nil
+			},
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			u, err := url.Parse(test.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cur := originConfig{URL: u, NamePrefix: ocidist.MustParseNamespace(test.namePrefix)}
+			p := probe
+			if test.probe != nil {
+				p = test.probe
+			}
+			got := diagnoseOriginConfig(context.Background(), cur, test.sample, p)
+			if test.wantHint == "" {
+				if got != "" {
+					t.Errorf("unexpected hint: %s", got)
+				}
+				return
+			}
+			if !strings.Contains(got, test.wantHint) {
+				t.Errorf("wrong hint\ngot:  %s\nwant: ...%s...", got, test.wantHint)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorDiagnoseOriginConfig(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.0.0", testProviderManifest())
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL+"/terraform-providers")
+	mirror.NamePrefix = ocidist.MustParseNamespace("example.com")
+	shared := newTestSharedState()
+	providerMirrorHandler(mirror, shared)
+
+	if got, want := len(shared.startupTasks), 1; got != want {
+		t.Fatalf("wrong number of startup tasks %d; want %d", got, want)
+	}
+	var logs bytes.Buffer
+	ctx := logging.ContextWithLogger(context.Background(), log.New(&logs, "", 0))
+	shared.startupTasks[0](ctx)
+	want := `warning: provider mirror "mirror": the origin registry returned 404 Not Found with origin_url = "` + registryServer.URL + `/terraform-providers/" and name_prefix = "example.com", but not with origin_url = "` + registryServer.URL + `/" and name_prefix = "terraform-providers/example.com"`
+	if !strings.HasPrefix(logs.String(), want) {
+		t.Errorf("wrong log output\ngot:  %s\nwant: %s...", logs.String(), want)
+	}
+}
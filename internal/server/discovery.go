@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/logging"
+)
+
+// discoveryPath is where Terraform looks for a host's service discovery
+// document.
+const discoveryPath = "/.well-known/terraform.json"
+
+// discoveryDocument returns the Terraform service discovery document for the
+// given configuration, mapping service identifiers to the URLs of the
+// services advertised under them, or nil if there's nothing to advertise.
+//
+// Each service contributes an entry for each of its discovery IDs, using its
+// external URL if it has one or else its base path, which Terraform resolves
+// relative to the discovery document's own URL. The server's explicit
+// discovery services then add to or override those entries.
+func discoveryDocument(cfg *config.Config) map[string]string {
+	ret := make(map[string]string)
+	for _, mirror := range cfg.ProviderMirrors {
+		base := "/" + mirror.Name + "/"
+		if mirror.ExternalURL != nil {
+			base = mirror.ExternalURL.String()
+		}
+		for _, id := range mirror.DiscoveryIDs {
+			ret[id] = base
+		}
+	}
+	for id, u := range cfg.Server.DiscoveryServices {
+		ret[id] = u
+	}
+	if len(ret) == 0 {
+		return nil
+	}
+	return ret
+}
+
+// discoveryHandler returns a handler that responds with the given service
+// discovery document.
+func discoveryHandler(doc map[string]string) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			resp.Header().Set("Allow", "GET, HEAD")
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSONResponse(resp, req, doc, jsonResponseOptions{headContentLength: true}, logging.ContextLogger(req.Context()))
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiscoveryDocument(t *testing.T) {
+	tests := map[string]struct {
+		mirrors  []*config.ProviderMirror
+		services map[string]string
+		want     map[string]string
+	}{
+		"nothing advertised": {
+			mirrors: []*config.ProviderMirror{
+				{Name: "mirror"},
+			},
+			want: nil,
+		},
+		"one service": {
+			mirrors: []*config.ProviderMirror{
+				{Name: "mirror", DiscoveryIDs: []string{"example.v1"}},
+			},
+			want: map[string]string{
+				"example.v1": "/mirror/",
+			},
+		},
+		"several services": {
+			mirrors: []*config.ProviderMirror{
+				{Name: "public", DiscoveryIDs: []string{"example.v1", "example.v2"}},
+				{Name: "internal"},
+				{
+					Name:         "other",
+					DiscoveryIDs: []string{"other.v1"},
+					ExternalURL:  &url.URL{Scheme: "https", Host: "example.com", Path: "/other/"},
+				},
+			},
+			want: map[string]string{
+				"example.v1": "/public/",
+				"example.v2": "/public/",
+				"other.v1":   "https://example.com/other/",
+			},
+		},
+		"server entries only": {
+			services: map[string]string{
+				"providers.v1": "https://registry.example.com/v1/providers/",
+			},
+			want: map[string]string{
+				"providers.v1": "https://registry.example.com/v1/providers/",
+			},
+		},
+		"server entries add and override": {
+			mirrors: []*config.ProviderMirror{
+				{Name: "mirror", DiscoveryIDs: []string{"example.v1", "example.v2"}},
+			},
+			services: map[string]string{
+				"example.v2": "/mirror/v2/",
+				"login.v1":   "https://auth.example.com/",
+			},
+			want: map[string]string{
+				"example.v1": "/mirror/",
+				"example.v2": "/mirror/v2/",
+				"login.v1":   "https://auth.example.com/",
+			},
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			cfg := &config.Config{
+				ProviderMirrors: make(map[string]*config.ProviderMirror),
+				Server:          &config.Server{DiscoveryServices: test.services},
+			}
+			for _, mirror := range test.mirrors {
+				cfg.ProviderMirrors[mirror.Name] = mirror
+			}
+			got := discoveryDocument(cfg)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("wrong document\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDiscoveryHandler(t *testing.T) {
+	handler := discoveryHandler(map[string]string{"example.v1": "/mirror/"})
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", discoveryPath, nil))
+	if rec.Code != 200 {
+		t.Fatalf("wrong status %d", rec.Code)
+	}
+	var got map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON response: %s", err)
+	}
+	if diff := cmp.Diff(map[string]string{"example.v1": "/mirror/"}, got); diff != "" {
+		t.Errorf("wrong response\n%s", diff)
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("POST", discoveryPath, nil))
+	if rec.Code != 405 {
+		t.Errorf("wrong status %d for POST; want 405", rec.Code)
+	}
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apparentlymart/go-versions/versions"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/querysecret"
+)
+
+// downloadToken is the information we smuggle through the query string of a
+// package download URL, so that the download request can be handled without
+// any additional context.
+type downloadToken struct {
+	Digest ocidist.Digest
+
+	// AuthHeader is the Authorization header from the request that
+	// generated the download URL, or empty if there was none. Terraform
+	// doesn't send credentials when downloading packages, so we must
+	// remember them on the client's behalf.
+	AuthHeader string
+
+	// Filename is the filename to suggest to the client in the
+	// Content-Disposition header of the download response, or empty to
+	// leave that header as the origin registry sent it.
+	Filename string
+}
+
+// wrap encrypts the token using the given secreter, returning a string
+// suitable for use as a raw query string.
+func (t downloadToken) wrap(secreter *querysecret.Secreter) (string, error) {
+	msg, err := t.encode()
+	if err != nil {
+		return "", err
+	}
+	return secreter.Wrap(msg)
+}
+
+// encode returns the message that [downloadToken.wrap] encrypts.
+func (t downloadToken) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(t.Digest.String())
+	if t.Filename != "" {
+		// The filename follows the digest after a semicolon, which can't
+		// appear in a digest, so that a server that doesn't expect a
+		// filename rejects the token as having an invalid digest rather
+		// than misinterpreting the rest of it.
+		if strings.ContainsAny(t.Filename, ":;") {
+			return nil, fmt.Errorf("invalid filename %q", t.Filename)
+		}
+		fmt.Fprintf(&buf, ";%s", t.Filename)
+	}
+	fmt.Fprintf(&buf, ":%s", t.AuthHeader)
+	return buf.Bytes(), nil
+}
+
+// unwrapDownloadToken is the inverse of [downloadToken.wrap].
+//
+// If the token has expired but was accepted because of the secreter's grace
+// period then the second result is how long ago it expired. Otherwise it's
+// zero.
+func unwrapDownloadToken(secreter *querysecret.Secreter, qs string) (downloadToken, time.Duration, error) {
+	if len(qs) == 0 {
+		return downloadToken{}, 0, fmt.Errorf("missing query string to authenticate the download request")
+	}
+	raw, late, err := secreter.UnwrapLate(qs)
+	if err != nil {
+		return downloadToken{}, 0, fmt.Errorf("invalid query string argument: %w", err)
+	}
+
+	// The digest itself contains a colon separating the algorithm from the
+	// hash, so the auth header begins after the second colon.
+	firstColon := bytes.IndexByte(raw, ':')
+	if firstColon == -1 {
+		return downloadToken{}, 0, fmt.Errorf("query string has no digest")
+	}
+	secondColon := bytes.IndexByte(raw[firstColon+1:], ':')
+	if secondColon == -1 {
+		return downloadToken{}, 0, fmt.Errorf("query string has no authorization delimiter")
+	}
+	secondColon += firstColon + 1
+
+	digestStr, filename, _ := strings.Cut(string(raw[:secondColon]), ";")
+	digest, err := ocidist.ParseDigest(digestStr)
+	if err != nil {
+		return downloadToken{}, 0, fmt.Errorf("query string has invalid digest %q: %w", digestStr, err)
+	}
+	return downloadToken{
+		Digest:     digest,
+		AuthHeader: string(raw[secondColon+1:]),
+		Filename:   filename,
+	}, late, nil
+}
+
+// splitDownloadQuery separates the raw query string of a download request
+// into the wrapped download token, which is always the first
+// "&"-separated part because that's how [downloadURL] generates it, and the
+// values of any of the allowed parameters that an intermediary appended
+// after it.
+//
+// The token's encoding never includes "&", so parameters appended after it
+// can't change the token. Parameters that aren't allowed are ignored, as
+// are any that can't be parsed.
+func splitDownloadQuery(rawQuery string, allowed []string) (string, url.Values) {
+	token, rest, _ := strings.Cut(rawQuery, "&")
+	if rest == "" || len(allowed) == 0 {
+		return token, nil
+	}
+	given, _ := url.ParseQuery(rest)
+	var ret url.Values
+	for _, name := range allowed {
+		if values, ok := given[name]; ok {
+			if ret == nil {
+				ret = make(url.Values)
+			}
+			ret[name] = values
+		}
+	}
+	return token, ret
+}
+
+// downloadProtocol represents one of Terraform's protocols that can include
+// package download URLs in its responses. Each protocol identifies providers
+// in a different way and so uses a different download path.
+type downloadProtocol int
+
+const (
+	// mirrorProtocol is the provider network mirror protocol, where the
+	// download path is the provider's hostname, namespace, and type
+	// followed by "download".
+	mirrorProtocol downloadProtocol = iota
+
+	// registryProtocol is the provider registry protocol, where the
+	// download path is the provider's namespace and type followed by
+	// "download", because a registry's hostname is implied by the
+	// registry itself.
+	registryProtocol
+
+	// moduleProtocol is the module registry protocol, where the download
+	// path is the module's namespace, name, and target system followed by
+	// "download".
+	moduleProtocol
+)
+
+// downloadURL returns the URL for downloading the package described by the
+// given token from a service with the given base URL, using the given
+// protocol.
+//
+// addr must be the path segments representing the provider's address as
+// used by the given protocol, and must already be escaped for use in a URL
+// path.
+func downloadURL(serviceBase *url.URL, protocol downloadProtocol, addr []string, secreter *querysecret.Secreter, token downloadToken) (*url.URL, error) {
+	var want int
+	switch protocol {
+	case mirrorProtocol:
+		want = 3
+	case registryProtocol:
+		want = 2
+	case moduleProtocol:
+		want = 3
+	default:
+		panic(fmt.Sprintf("unsupported download protocol %d", protocol))
+	}
+	if len(addr) != want {
+		return nil, fmt.Errorf("provider address has %d segments; need %d", len(addr), want)
+	}
+
+	qs, err := token.wrap(secreter)
+	if err != nil {
+		return nil, err
+	}
+	elems := make([]string, 0, len(addr)+1)
+	elems = append(elems, addr...)
+	elems = append(elems, "download")
+	ret := serviceBase.JoinPath(elems...)
+	ret.RawQuery = qs
+	return ret, nil
+}
+
+// packageFilename returns the conventional filename for the zip archive of
+// the given provider type, version, and platform, like
+// "terraform-provider-aws_5.0.0_linux_amd64.zip".
+func packageFilename(providerType string, version versions.Version, platform string) string {
+	return fmt.Sprintf("terraform-provider-%s_%s_%s.zip", providerType, version, platform)
+}
+
+// shasumsDocument returns a SHA256SUMS document describing the zip archives
+// among the given package layers, keyed by platform as returned by
+// [selectPackageLayers], in the format that the provider registry protocol
+// expects to find at a download response's "shasums_url".
+//
+// Each line gives a package's digest and its conventional filename, sorted
+// by filename. A layer's digest is the SHA-256 checksum of the archive
+// itself, so this doesn't need to fetch any package content, but it does
+// mean that the document can't describe layers whose digests use another
+// algorithm. Those cause an error, as do malformed sha256 digests, while
+// layers that aren't zip archives are ignored because the registry protocol
+// has no way to describe them.
+func shasumsDocument(providerType string, version versions.Version, layers map[string]ocidist.ObjectMeta) ([]byte, error) {
+	lines := make([]shasumsLine, 0, len(layers))
+	for platform, meta := range layers {
+		if meta.MediaType != providerPackageMediaType {
+			continue
+		}
+		if algo := meta.Digest.Algorithm(); algo != "sha256" {
+			return nil, fmt.Errorf("package for %s has a %s digest, but SHA256SUMS can describe only sha256 digests", platform, algo)
+		}
+		// The digest came from the origin registry, so we make sure it's
+		// really a SHA-256 checksum before presenting it as one.
+		encoded := meta.Digest.Encoded()
+		if b, err := hex.DecodeString(encoded); err != nil || len(b) != sha256.Size || strings.ToLower(encoded) != encoded {
+			return nil, fmt.Errorf("package for %s has invalid sha256 digest %q", platform, encoded)
+		}
+		lines = append(lines, shasumsLine{
+			filename: packageFilename(providerType, version, platform),
+			checksum: encoded,
+		})
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		return lines[i].filename < lines[j].filename
+	})
+	var buf strings.Builder
+	for _, line := range lines {
+		buf.WriteString(line.checksum + "  " + line.filename + "\n")
+	}
+	return []byte(buf.String()), nil
+}
+
+// shasumsLine is a single entry in a document built by [shasumsDocument].
+type shasumsLine struct {
+	filename string
+	checksum string
+}
+
+// spoolBlob copies everything from the given reader into a new temporary
+// file, so that its content can be verified before sending any of it to a
+// client. It returns a reader for the file's content along with its size.
+//
+// Closing the returned reader deletes the temporary file.
+func spoolBlob(r io.Reader) (io.ReadCloser, int64, error) {
+	f, err := os.CreateTemp("", "terraform-provider-package-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	spooled := &tempFile{f}
+	size, err := io.Copy(f, r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spooled.Close()
+		return nil, 0, err
+	}
+	return spooled, size, nil
+}
+
+// tempFile is an [os.File] that is deleted when closed.
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
@@ -0,0 +1,954 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apparentlymart/go-versions/versions"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/diskcache"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/querysecret"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDownloadToken(t *testing.T) {
+	secreter := querysecret.NewSecreter([32]byte{})
+	digest := testDigest([]byte("package"))
+
+	tests := map[string]string{
+		"no auth":            "",
+		"bearer":             "Bearer abc123",
+		"colons in auth":     "Basic dXNlcjpwYXNz:extra:colons",
+		"leading colon auth": ":",
+	}
+	for name, authHeader := range tests {
+		t.Run(name, func(t *testing.T) {
+			want := downloadToken{Digest: digest, AuthHeader: authHeader}
+			qs, err := want.wrap(secreter)
+			if err != nil {
+				t.Fatalf("failed to wrap: %s", err)
+			}
+			got, _, err := unwrapDownloadToken(secreter, qs)
+			if err != nil {
+				t.Fatalf("failed to unwrap: %s", err)
+			}
+			if got != want {
+				t.Errorf("wrong token\ngot:  %#v\nwant: %#v", got, want)
+			}
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		if _, _, err := unwrapDownloadToken(secreter, ""); err == nil {
+			t.Errorf("no error for empty query string")
+		}
+	})
+	t.Run("no delimiter", func(t *testing.T) {
+		qs, err := secreter.Wrap([]byte(digest.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := unwrapDownloadToken(secreter, qs); err == nil {
+			t.Errorf("no error for token without authorization delimiter")
+		}
+	})
+	t.Run("filename", func(t *testing.T) {
+		want := downloadToken{
+			Digest:     digest,
+			AuthHeader: "Basic dXNlcjpwYXNz:extra",
+			Filename:   "terraform-provider-bar_1.0.0_linux_amd64.zip",
+		}
+		qs, err := want.wrap(secreter)
+		if err != nil {
+			t.Fatalf("failed to wrap: %s", err)
+		}
+		got, _, err := unwrapDownloadToken(secreter, qs)
+		if err != nil {
+			t.Fatalf("failed to unwrap: %s", err)
+		}
+		if got != want {
+			t.Errorf("wrong token\ngot:  %#v\nwant: %#v", got, want)
+		}
+	})
+	t.Run("invalid filename", func(t *testing.T) {
+		token := downloadToken{Digest: digest, Filename: "a:b.zip"}
+		if _, err := token.wrap(secreter); err == nil {
+			t.Errorf("no error for filename containing a colon")
+		}
+	})
+}
+
+func TestDownloadURL(t *testing.T) {
+	secreter := querysecret.NewSecreter([32]byte{})
+	token := downloadToken{Digest: testDigest([]byte("package"))}
+
+	tests := map[string]struct {
+		base     *url.URL
+		protocol downloadProtocol
+		addr     []string
+		want     string
+	}{
+		"mirror relative": {
+			base:     &url.URL{Path: "/mirror/"},
+			protocol: mirrorProtocol,
+			addr:     []string{"example.com", "foo", "bar"},
+			want:     "/mirror/example.com/foo/bar/download",
+		},
+		"mirror external": {
+			base:     &url.URL{Scheme: "https", Host: "providers.example.net", Path: "/tf/"},
+			protocol: mirrorProtocol,
+			addr:     []string{"example.com", "foo", "bar"},
+			want:     "https://providers.example.net/tf/example.com/foo/bar/download",
+		},
+		"registry relative": {
+			base:     &url.URL{Path: "/registry/v1/providers/"},
+			protocol: registryProtocol,
+			addr:     []string{"foo", "bar"},
+			want:     "/registry/v1/providers/foo/bar/download",
+		},
+		"registry external": {
+			base:     &url.URL{Scheme: "https", Host: "registry.example.net", Path: "/"},
+			protocol: registryProtocol,
+			addr:     []string{"foo", "bar"},
+			want:     "https://registry.example.net/foo/bar/download",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := downloadURL(test.base, test.protocol, test.addr, secreter, token)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			gotToken, _, err := unwrapDownloadToken(secreter, got.RawQuery)
+			if err != nil {
+				t.Fatalf("generated URL has invalid token: %s", err)
+			}
+			if gotToken != token {
+				t.Errorf("wrong token %#v; want %#v", gotToken, token)
+			}
+			got.RawQuery = ""
+			if got.String() != test.want {
+				t.Errorf("wrong URL %q; want %q", got, test.want)
+			}
+		})
+	}
+
+	t.Run("wrong address length", func(t *testing.T) {
+		_, err := downloadURL(&url.URL{Path: "/registry/"}, registryProtocol, []string{"example.com", "foo", "bar"}, secreter, token)
+		if err == nil {
+			t.Errorf("no error for mirror-style address with registry protocol")
+		}
+	})
+}
+
+func TestShasumsDocument(t *testing.T) {
+	linux := ocidist.ObjectMeta{
+		MediaType: providerPackageMediaType,
+		Digest:    testDigest([]byte("linux package")),
+	}
+	darwin := ocidist.ObjectMeta{
+		MediaType: providerPackageMediaType,
+		Digest:    testDigest([]byte("darwin package")),
+	}
+	tarball := ocidist.ObjectMeta{
+		MediaType: "application/vnd.example.provider-package+tar",
+		Digest:    testDigest([]byte("tar package")),
+	}
+	version := versions.MustParseVersion("1.2.0")
+
+	got, err := shasumsDocument("bar", version, map[string]ocidist.ObjectMeta{
+		"linux_amd64":   linux,
+		"linux_arm64":   linux,
+		"darwin_arm64":  darwin,
+		"windows_amd64": tarball,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := darwin.Digest.Encoded() + "  terraform-provider-bar_1.2.0_darwin_arm64.zip\n" +
+		linux.Digest.Encoded() + "  terraform-provider-bar_1.2.0_linux_amd64.zip\n" +
+		linux.Digest.Encoded() + "  terraform-provider-bar_1.2.0_linux_arm64.zip\n"
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("wrong document\n%s", diff)
+	}
+
+	t.Run("sha512", func(t *testing.T) {
+		sha512, err := ocidist.ComputeDigest("sha512", []byte("linux package"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = shasumsDocument("bar", version, map[string]ocidist.ObjectMeta{
+			"linux_amd64": {
+				MediaType: providerPackageMediaType,
+				Digest:    sha512,
+			},
+		})
+		if err == nil {
+			t.Errorf("no error for package with a sha512 digest")
+		}
+	})
+	t.Run("malformed sha256", func(t *testing.T) {
+		for _, digest := range []ocidist.Digest{
+			"sha256:abc",
+			"sha256:" + ocidist.Digest(strings.Repeat("zz", 32)),
+			"sha256:" + ocidist.Digest(strings.ToUpper(linux.Digest.Encoded())),
+			"sha256:" + ocidist.Digest(strings.Repeat("\n", 64)),
+		} {
+			_, err := shasumsDocument("bar", version, map[string]ocidist.ObjectMeta{
+				"linux_amd64": {
+					MediaType: providerPackageMediaType,
+					Digest:    digest,
+				},
+			})
+			if err == nil {
+				t.Errorf("no error for package with digest %q", digest)
+			}
+		}
+	})
+}
+
+func TestSplitDownloadQuery(t *testing.T) {
+	tests := map[string]struct {
+		rawQuery  string
+		allowed   []string
+		wantToken string
+		want      url.Values
+	}{
+		"token only": {
+			"abc_-=",
+			[]string{"sig"},
+			"abc_-=",
+			nil,
+		},
+		"allowed param": {
+			"abc_-=&sig=x%26y&other=z",
+			[]string{"sig"},
+			"abc_-=",
+			url.Values{"sig": {"x&y"}},
+		},
+		"repeated param": {
+			"abc&sig=1&sig=2",
+			[]string{"sig", "missing"},
+			"abc",
+			url.Values{"sig": {"1", "2"}},
+		},
+		"none allowed": {
+			"abc&sig=x",
+			nil,
+			"abc",
+			nil,
+		},
+		"only unlisted": {
+			"abc&other=z",
+			[]string{"sig"},
+			"abc",
+			nil,
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			gotToken, got := splitDownloadQuery(test.rawQuery, test.allowed)
+			if gotToken != test.wantToken {
+				t.Errorf("wrong token %q; want %q", gotToken, test.wantToken)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("wrong forwarded query\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorDownloadTokenLifecycle(t *testing.T) {
+	pkg := []byte("package")
+	registry := newFakeRegistry()
+	registry.addManifest(
+		"terraform-providers/example.com/foo/bar", "1.0.0",
+		testProviderManifest(ocidist.ObjectMeta{
+			MediaType: "application/vnd.hashicorp.terraform.provider-package+zip",
+			Digest:    testDigest(pkg),
+			Size:      int64(len(pkg)),
+			Annotations: map[string]any{
+				"io.terraform.target-platforms": "linux_amd64",
+			},
+		}),
+	)
+	registry.addBlob("terraform-providers/example.com/foo/bar", pkg)
+	var blobAuth []string
+	registryServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.Path, "/blobs/") {
+			blobAuth = append(blobAuth, req.Header.Get("Authorization"))
+		}
+		registry.ServeHTTP(resp, req)
+	}))
+	defer registryServer.Close()
+
+	key := [32]byte{1, 2, 3}
+	secreter := querysecret.NewSecreter(key)
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.ProxyPackages = true
+	shared := newTestSharedState()
+	shared.secreter = secreter
+	mirrorServer := newTestMirrorServerShared(t, mirror, shared)
+	defer mirrorServer.Close()
+
+	// The version response mints the token, remembering the credentials
+	// that the client used to request it.
+	req, err := http.NewRequest("GET", mirrorServer.URL+"/mirror/example.com/foo/bar/1.0.0.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer abc123")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("version request failed: %s", err)
+	}
+	var version struct {
+		Archives map[string]struct {
+			URL string `json:"url"`
+		} `json:"archives"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&version)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("invalid version response: %s", err)
+	}
+	validURL := version.Archives["linux_amd64"].URL
+	basePath, validToken, ok := strings.Cut(validURL, "?")
+	if !ok {
+		t.Fatalf("download URL %q has no query string", validURL)
+	}
+
+	wrapToken := func(t *testing.T, s *querysecret.Secreter, token downloadToken) string {
+		t.Helper()
+		ret, err := token.wrap(s)
+		if err != nil {
+			t.Fatalf("failed to wrap token: %s", err)
+		}
+		return ret
+	}
+	tamper := func(token string) string {
+		// Changing any character of the base64 encoding changes the
+		// encrypted payload, so it no longer authenticates.
+		b := []byte(token)
+		i := len(b) / 2
+		if b[i] == 'A' {
+			b[i] = 'B'
+		} else {
+			b[i] = 'A'
+		}
+		return string(b)
+	}
+
+	tests := map[string]struct {
+		query      func(t *testing.T) string
+		wantStatus int
+	}{
+		"valid": {
+			func(t *testing.T) string { return validToken },
+			200,
+		},
+		"missing query string": {
+			func(t *testing.T) string { return "" },
+			404,
+		},
+		"tampered": {
+			func(t *testing.T) string { return tamper(validToken) },
+			404,
+		},
+		"garbage": {
+			func(t *testing.T) string { return "not-a-token" },
+			404,
+		},
+		"wrong key": {
+			func(t *testing.T) string {
+				other := querysecret.NewSecreter([32]byte{4, 5, 6})
+				return wrapToken(t, other, downloadToken{Digest: testDigest(pkg)})
+			},
+			404,
+		},
+		"expired": {
+			func(t *testing.T) string {
+				return wrapExpiredTestToken(t, secreter, downloadToken{Digest: testDigest(pkg)}, time.Minute)
+			},
+			404,
+		},
+		"digest no longer in registry": {
+			func(t *testing.T) string {
+				return wrapToken(t, secreter, downloadToken{Digest: testDigest([]byte("deleted package"))})
+			},
+			404,
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			blobAuth = nil
+			downloadURL := mirrorServer.URL + basePath
+			if query := test.query(t); query != "" {
+				downloadURL += "?" + query
+			}
+			resp, err := http.Get(downloadURL)
+			if err != nil {
+				t.Fatalf("download failed: %s", err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("failed to read body: %s", err)
+			}
+			if resp.StatusCode != test.wantStatus {
+				t.Fatalf("wrong status %d; want %d", resp.StatusCode, test.wantStatus)
+			}
+			if test.wantStatus != 200 {
+				return
+			}
+			if !bytes.Equal(body, pkg) {
+				t.Errorf("wrong package content %q", body)
+			}
+			// There may also be a request probing whether the registry
+			// supports ranges, which must use the same credentials.
+			if len(blobAuth) == 0 {
+				t.Errorf("no origin registry blob request")
+			}
+			for _, got := range blobAuth {
+				if got != "Bearer abc123" {
+					t.Errorf("wrong credentials %q for origin registry blob request", got)
+				}
+			}
+		})
+	}
+}
+
+func TestProviderMirrorDownloadTokenGracePeriod(t *testing.T) {
+	pkg := []byte("package")
+	registry := newFakeRegistry()
+	registry.addBlob("terraform-providers/example.com/foo/bar", pkg)
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	key := [32]byte{1, 2, 3}
+	secreter := querysecret.NewSecreter(key)
+	secreter.SetGracePeriod(2 * time.Minute)
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.ProxyPackages = true
+	shared := newTestSharedState()
+	shared.secreter = secreter
+	mirrorServer := newTestMirrorServerShared(t, mirror, shared)
+	defer mirrorServer.Close()
+
+	tests := map[string]struct {
+		age        time.Duration
+		wantStatus int
+		wantGrace  int64
+	}{
+		"within grace period": {
+			age:        time.Minute,
+			wantStatus: 200,
+			wantGrace:  1,
+		},
+		"beyond grace period": {
+			age:        5 * time.Minute,
+			wantStatus: 404,
+			wantGrace:  0,
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			token := wrapExpiredTestToken(t, secreter, downloadToken{Digest: testDigest(pkg)}, test.age)
+			graceBefore := downloadTokenGraceRedemptions.Value()
+
+			resp, err := http.Get(mirrorServer.URL + "/mirror/example.com/foo/bar/download?" + token)
+			if err != nil {
+				t.Fatalf("download failed: %s", err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("failed to read body: %s", err)
+			}
+			if resp.StatusCode != test.wantStatus {
+				t.Fatalf("wrong status %d; want %d", resp.StatusCode, test.wantStatus)
+			}
+			if test.wantStatus == 200 && !bytes.Equal(body, pkg) {
+				t.Errorf("wrong package content %q", body)
+			}
+			if got := downloadTokenGraceRedemptions.Value() - graceBefore; got != test.wantGrace {
+				t.Errorf("grace redemption count increased by %d; want %d", got, test.wantGrace)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorPackageFilenames(t *testing.T) {
+	pkg := []byte("package")
+	registry := newFakeRegistry()
+	registry.addManifest(
+		"terraform-providers/example.com/foo/bar", "1.0.0",
+		testProviderManifest(ocidist.ObjectMeta{
+			MediaType: "application/vnd.hashicorp.terraform.provider-package+zip",
+			Digest:    testDigest(pkg),
+			Size:      int64(len(pkg)),
+			Annotations: map[string]any{
+				// The same package works on both platforms, so both share
+				// a single layer.
+				"io.terraform.target-platforms": "linux_amd64,darwin_arm64",
+			},
+		}),
+	)
+	registry.addBlob("terraform-providers/example.com/foo/bar", pkg)
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	tests := map[string]struct {
+		enabled bool
+		want    map[string]string
+	}{
+		"disabled": {
+			enabled: false,
+			want: map[string]string{
+				"linux_amd64":  "",
+				"darwin_arm64": "",
+			},
+		},
+		"enabled": {
+			enabled: true,
+			want: map[string]string{
+				"linux_amd64":  `attachment; filename=terraform-provider-bar_1.0.0_linux_amd64.zip`,
+				"darwin_arm64": `attachment; filename=terraform-provider-bar_1.0.0_darwin_arm64.zip`,
+			},
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			mirror := newTestProviderMirror(t, registryServer.URL)
+			mirror.ProxyPackages = true
+			mirror.PackageFilenames = test.enabled
+			shared := newTestSharedState()
+			shared.secreter = querysecret.NewSecreter([32]byte{})
+			mirrorServer := newTestMirrorServerShared(t, mirror, shared)
+			defer mirrorServer.Close()
+
+			var version struct {
+				Archives map[string]struct {
+					URL string `json:"url"`
+				} `json:"archives"`
+			}
+			status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/1.0.0.json", &version)
+			if status != 200 {
+				t.Fatalf("wrong status %d for version", status)
+			}
+
+			got := make(map[string]string)
+			for platform, archive := range version.Archives {
+				resp, err := http.Get(mirrorServer.URL + archive.URL)
+				if err != nil {
+					t.Fatalf("download failed: %s", err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != 200 {
+					t.Fatalf("wrong status %d for %s download", resp.StatusCode, platform)
+				}
+				got[platform] = resp.Header.Get("Content-Disposition")
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("wrong Content-Disposition headers\n%s", diff)
+			}
+		})
+	}
+}
+
+// wrapExpiredTestToken is like [downloadToken.wrap] except that the result
+// expired the given duration ago.
+func wrapExpiredTestToken(t *testing.T, secreter *querysecret.Secreter, token downloadToken, age time.Duration) string {
+	t.Helper()
+	msg, err := token.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret, err := secreter.WrapIssuedAt(msg, time.Now().Add(-querysecret.Lifetime-age))
+	if err != nil {
+		t.Fatalf("failed to wrap token: %s", err)
+	}
+	return ret
+}
+
+func TestProviderMirrorRedirectPackages(t *testing.T) {
+	pkg := []byte("package")
+	registry := newFakeRegistry()
+	registry.addManifest(
+		"terraform-providers/example.com/foo/bar", "1.0.0",
+		testProviderManifest(ocidist.ObjectMeta{
+			MediaType: "application/vnd.hashicorp.terraform.provider-package+zip",
+			Digest:    testDigest(pkg),
+			Size:      int64(len(pkg)),
+			Annotations: map[string]any{
+				"io.terraform.target-platforms": "linux_amd64",
+			},
+		}),
+	)
+	registry.addBlob("terraform-providers/example.com/foo/bar", pkg)
+
+	// storageServer stands in for a storage service on another host, where
+	// the origin registry has offloaded its blobs.
+	storageRequests := 0
+	storageServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		storageRequests++
+		resp.Write(pkg)
+	}))
+	defer storageServer.Close()
+
+	var redirectTo string
+	registryServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/storage/package":
+			resp.Write(pkg)
+		case strings.Contains(req.URL.Path, "/blobs/") && redirectTo != "":
+			http.Redirect(resp, req, redirectTo, http.StatusTemporaryRedirect)
+		default:
+			registry.ServeHTTP(resp, req)
+		}
+	}))
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.ProxyPackages = true
+	mirror.RedirectPackages = true
+	shared := newTestSharedState()
+	shared.secreter = querysecret.NewSecreter([32]byte{})
+	mirrorServer := newTestMirrorServerShared(t, mirror, shared)
+	defer mirrorServer.Close()
+
+	var version struct {
+		Archives map[string]struct {
+			URL string `json:"url"`
+		} `json:"archives"`
+	}
+	if status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/1.0.0.json", &version); status != 200 {
+		t.Fatalf("wrong status %d for version", status)
+	}
+	downloadURL := mirrorServer.URL + version.Archives["linux_amd64"].URL
+	noFollow := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	tests := map[string]struct {
+		redirectTo   string
+		wantStatus   int
+		wantLocation string
+	}{
+		"external location": {
+			redirectTo:   storageServer.URL + "/package",
+			wantStatus:   302,
+			wantLocation: storageServer.URL + "/package",
+		},
+		"origin host": {
+			// A redirect elsewhere on the registry might need the
+			// credentials that only the server has, so it's followed.
+			redirectTo: registryServer.URL + "/storage/package",
+			wantStatus: 200,
+		},
+		"no redirect": {
+			wantStatus: 200,
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			redirectTo = test.redirectTo
+			storageRequests = 0
+			resp, err := noFollow.Get(downloadURL)
+			if err != nil {
+				t.Fatalf("download failed: %s", err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("failed to read body: %s", err)
+			}
+			if resp.StatusCode != test.wantStatus {
+				t.Fatalf("wrong status %d; want %d", resp.StatusCode, test.wantStatus)
+			}
+			if got := resp.Header.Get("Location"); got != test.wantLocation {
+				t.Errorf("wrong Location %q; want %q", got, test.wantLocation)
+			}
+			if test.wantStatus == 200 && !bytes.Equal(body, pkg) {
+				t.Errorf("wrong package content %q", body)
+			}
+			if storageRequests != 0 {
+				t.Errorf("server made %d requests to the external location itself", storageRequests)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorPackageVerification(t *testing.T) {
+	pkg := []byte("package")
+	tests := map[string]struct {
+		verification config.PackageVerification
+		tampered     bool
+		wantStatus   int
+		wantErr      bool
+	}{
+		"streaming matching": {
+			verification: config.PackageVerificationStreaming,
+			wantStatus:   200,
+		},
+		"streaming tampered": {
+			verification: config.PackageVerificationStreaming,
+			tampered:     true,
+			// The response has already started by the time the content
+			// can be checked, so it's aborted rather than failed.
+			wantErr: true,
+		},
+		"buffered matching": {
+			verification: config.PackageVerificationBuffered,
+			wantStatus:   200,
+		},
+		"buffered tampered": {
+			verification: config.PackageVerificationBuffered,
+			tampered:     true,
+			wantStatus:   502,
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			registry := newFakeRegistry()
+			registry.supportRanges = true
+			registry.addManifest(
+				"terraform-providers/example.com/foo/bar", "1.0.0",
+				testProviderManifest(ocidist.ObjectMeta{
+					MediaType: "application/vnd.hashicorp.terraform.provider-package+zip",
+					Digest:    testDigest(pkg),
+					Size:      int64(len(pkg)),
+					Annotations: map[string]any{
+						"io.terraform.target-platforms": "linux_amd64",
+					},
+				}),
+			)
+			digest := registry.addBlob("terraform-providers/example.com/foo/bar", pkg)
+			if test.tampered {
+				registry.blobs["terraform-providers/example.com/foo/bar@"+digest.String()] = []byte("pwned!!")
+			}
+			registryServer := httptest.NewServer(registry)
+			defer registryServer.Close()
+
+			mirror := newTestProviderMirror(t, registryServer.URL)
+			mirror.ProxyPackages = true
+			mirror.PackageVerification = test.verification
+			shared := newTestSharedState()
+			shared.secreter = querysecret.NewSecreter([32]byte{})
+			mirrorServer := newTestMirrorServerShared(t, mirror, shared)
+			defer mirrorServer.Close()
+
+			var version struct {
+				Archives map[string]struct {
+					URL string `json:"url"`
+				} `json:"archives"`
+			}
+			status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/1.0.0.json", &version)
+			if status != 200 {
+				t.Fatalf("wrong status %d for version", status)
+			}
+
+			req, err := http.NewRequest("GET", mirrorServer.URL+version.Archives["linux_amd64"].URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Verification needs the whole package, so ranges are ignored.
+			req.Header.Set("Range", "bytes=2-")
+			resp, err := http.DefaultClient.Do(req)
+			if err == nil {
+				var body []byte
+				body, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err == nil && resp.StatusCode == 200 && !bytes.Equal(body, pkg) {
+					t.Errorf("wrong body %q; want %q", body, pkg)
+				}
+			}
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("download succeeded with status %d; want error", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("download failed: %s", err)
+			}
+			if resp.StatusCode != test.wantStatus {
+				t.Errorf("wrong status %d; want %d", resp.StatusCode, test.wantStatus)
+			}
+			if got, want := resp.Header.Get("Accept-Ranges"), "none"; got != want {
+				t.Errorf("wrong Accept-Ranges %q; want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorPackageCache(t *testing.T) {
+	pkg := []byte("package")
+	registry := newFakeRegistry()
+	registry.supportRanges = true
+	registry.addManifest(
+		"terraform-providers/example.com/foo/bar", "1.0.0",
+		testProviderManifest(ocidist.ObjectMeta{
+			MediaType: "application/vnd.hashicorp.terraform.provider-package+zip",
+			Digest:    testDigest(pkg),
+			Size:      int64(len(pkg)),
+			Annotations: map[string]any{
+				"io.terraform.target-platforms": "linux_amd64",
+			},
+		}),
+	)
+	blobKey := "terraform-providers/example.com/foo/bar@" + registry.addBlob("terraform-providers/example.com/foo/bar", pkg).String()
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	cacheDir := t.TempDir()
+	newMirrorServer := func(t *testing.T) *httptest.Server {
+		pkgCache, err := diskcache.Open(cacheDir, config.DefaultTrustedDigestAlgorithms)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mirror := newTestProviderMirror(t, registryServer.URL)
+		mirror.ProxyPackages = true
+		mirror.PackageCacheDir = cacheDir
+		shared := newTestSharedState()
+		shared.secreter = querysecret.NewSecreter([32]byte{})
+		shared.packageCaches = map[string]*diskcache.Cache{"mirror": pkgCache}
+		return newTestMirrorServerShared(t, mirror, shared)
+	}
+	download := func(t *testing.T, mirrorServer *httptest.Server) (int, []byte) {
+		t.Helper()
+		var version struct {
+			Archives map[string]struct {
+				URL string `json:"url"`
+			} `json:"archives"`
+		}
+		if status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/1.0.0.json", &version); status != 200 {
+			t.Fatalf("wrong status %d for version", status)
+		}
+		resp, err := http.Get(mirrorServer.URL + version.Archives["linux_amd64"].URL)
+		if err != nil {
+			t.Fatalf("download failed: %s", err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("download failed: %s", err)
+		}
+		if got, want := resp.Header.Get("Accept-Ranges"), "none"; resp.StatusCode == 200 && got != want {
+			t.Errorf("wrong Accept-Ranges %q; want %q", got, want)
+		}
+		return resp.StatusCode, body
+	}
+
+	t.Run("tampered", func(t *testing.T) {
+		registry.blobs[blobKey] = []byte("pwned!!")
+		defer func() { registry.blobs[blobKey] = pkg }()
+		mirrorServer := newMirrorServer(t)
+		defer mirrorServer.Close()
+
+		if status, _ := download(t, mirrorServer); status != 502 {
+			t.Errorf("wrong status %d; want 502", status)
+		}
+	})
+	t.Run("fills the cache", func(t *testing.T) {
+		mirrorServer := newMirrorServer(t)
+		defer mirrorServer.Close()
+
+		status, body := download(t, mirrorServer)
+		if status != 200 || !bytes.Equal(body, pkg) {
+			t.Fatalf("wrong response %d %q; want 200 %q", status, body, pkg)
+		}
+	})
+	t.Run("survives a restart", func(t *testing.T) {
+		// With the blob gone from the origin registry, the package can
+		// only come from the cache that the previous subtest filled.
+		delete(registry.blobs, blobKey)
+		defer func() { registry.blobs[blobKey] = pkg }()
+		mirrorServer := newMirrorServer(t)
+		defer mirrorServer.Close()
+
+		status, body := download(t, mirrorServer)
+		if status != 200 || !bytes.Equal(body, pkg) {
+			t.Fatalf("wrong response %d %q; want 200 %q", status, body, pkg)
+		}
+	})
+}
+
+func TestProviderMirrorTrustedDigestAlgorithms(t *testing.T) {
+	pkg := []byte("package")
+	registry := newFakeRegistry()
+	registry.addManifest(
+		"terraform-providers/example.com/foo/bar", "1.0.0",
+		testProviderManifest(ocidist.ObjectMeta{
+			MediaType: "application/vnd.hashicorp.terraform.provider-package+zip",
+			Digest:    testDigest(pkg),
+			Size:      int64(len(pkg)),
+			Annotations: map[string]any{
+				"io.terraform.target-platforms": "linux_amd64",
+			},
+		}),
+	)
+	registry.addBlob("terraform-providers/example.com/foo/bar", pkg)
+	blobRequests := 0
+	registryServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.Path, "/blobs/") {
+			blobRequests++
+		}
+		registry.ServeHTTP(resp, req)
+	}))
+	defer registryServer.Close()
+
+	secreter := querysecret.NewSecreter([32]byte{})
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.ProxyPackages = true
+	shared := newTestSharedState()
+	shared.config.TrustedDigestAlgorithms = []string{"sha512"}
+	shared.secreter = secreter
+	mirrorServer := newTestMirrorServerShared(t, mirror, shared)
+	defer mirrorServer.Close()
+
+	t.Run("version", func(t *testing.T) {
+		var version struct {
+			Archives map[string]any `json:"archives"`
+		}
+		getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/1.0.0.json", &version)
+		if _, exists := version.Archives["linux_amd64"]; exists {
+			t.Errorf("version offers a package whose digest uses an untrusted algorithm")
+		}
+	})
+	t.Run("download", func(t *testing.T) {
+		// A token minted before the configuration changed can still name
+		// a package whose digest is no longer trusted.
+		u, err := downloadURL(&url.URL{Path: "/mirror/"}, mirrorProtocol, []string{"example.com", "foo", "bar"}, secreter, downloadToken{Digest: testDigest(pkg)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Get(mirrorServer.URL + u.String())
+		if err != nil {
+			t.Fatalf("download failed: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 404 {
+			t.Errorf("wrong status %d; want 404", resp.StatusCode)
+		}
+		if blobRequests != 0 {
+			t.Errorf("made %d blob requests to the origin registry; want none", blobRequests)
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// downloadTracker counts the package downloads that are currently being
+// transferred, so that shutdown can report how many are still active.
+//
+// The zero value is ready to use.
+type downloadTracker struct {
+	active int64
+}
+
+// start records the beginning of a download and returns a function that the
+// caller must call exactly once when the download has finished.
+func (t *downloadTracker) start() (done func()) {
+	atomic.AddInt64(&t.active, 1)
+	return func() {
+		atomic.AddInt64(&t.active, -1)
+	}
+}
+
+// count returns the number of downloads currently in progress.
+func (t *downloadTracker) count() int64 {
+	return atomic.LoadInt64(&t.active)
+}
+
+// drainableServer is the subset of [http.Server] used by [drainServer].
+type drainableServer interface {
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+// drainServer gracefully shuts down the given server, allowing in-progress
+// requests up to the given timeout to complete. While waiting it logs the
+// number of active downloads at each progress interval, so that operators
+// can see how draining is going. If requests are still active once the
+// timeout has passed then their connections are forcibly closed.
+//
+// Before anything else it sets shuttingDown, so that the readiness endpoint
+// immediately reports that the server isn't ready, and then waits for the
+// given delay while still accepting new requests, so that load balancers
+// can notice and stop sending traffic before the server stops listening.
+//
+// The result is [context.DeadlineExceeded] if the server had to be forcibly
+// closed.
+func drainServer(srv drainableServer, downloads *downloadTracker, shuttingDown *atomic.Bool, delay time.Duration, timeout time.Duration, progressInterval time.Duration) error {
+	shuttingDown.Store(true)
+	if delay > 0 {
+		log.Printf("waiting %s for load balancers to notice the server is shutting down", delay)
+		time.Sleep(delay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-shutdownErr:
+			if errors.Is(err, context.DeadlineExceeded) {
+				log.Printf("shutdown timeout reached; forcibly closing connections with %d downloads still active", downloads.count())
+				srv.Close()
+			}
+			return err
+		case <-ticker.C:
+			if n := downloads.count(); n != 0 {
+				log.Printf("waiting for %d active downloads to complete", n)
+			}
+		}
+	}
+}
+
+// readinessAlarm returns the download token alarm that should affect the
+// server's readiness, which is nil unless the server is configured to
+// report that it isn't ready while the alarm is active.
+func readinessAlarm(shared *sharedState) *tokenFailureAlarm {
+	if !shared.config.TokenAlertUnready {
+		return nil
+	}
+	return shared.tokenAlarm
+}
+
+// readinessHandler returns a handler that reports whether the server is
+// ready to accept new requests, which it is until shutting down is set.
+//
+// If tokenAlarm isn't nil then the server also isn't ready while that alarm
+// is active.
+func readinessHandler(shuttingDown *atomic.Bool, tokenAlarm *tokenFailureAlarm) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Cache-Control", "no-store")
+		if shuttingDown.Load() {
+			writeTextResponse(resp, http.StatusServiceUnavailable, "Shutting down.\n")
+			return
+		}
+		if tokenAlarm.active() {
+			writeTextResponse(resp, http.StatusServiceUnavailable, "Rejecting too many download tokens.\n")
+			return
+		}
+		writeTextResponse(resp, http.StatusOK, "Ready.\n")
+	}
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+)
+
+func TestDrainServer(t *testing.T) {
+	tests := map[string]struct {
+		// finishAfter is how long the simulated download takes to complete
+		// once shutdown has begun.
+		finishAfter time.Duration
+		timeout     time.Duration
+		wantErr     error
+		wantBody    string
+	}{
+		"completes in time": {
+			finishAfter: 50 * time.Millisecond,
+			timeout:     5 * time.Second,
+			wantErr:     nil,
+			wantBody:    "first half, second half",
+		},
+		"forcibly closed": {
+			finishAfter: time.Hour,
+			timeout:     100 * time.Millisecond,
+			wantErr:     context.DeadlineExceeded,
+			wantBody:    "first half, ",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			var downloads downloadTracker
+			started := make(chan struct{})
+			finish := make(chan struct{})
+			srv := &http.Server{
+				Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+					done := downloads.start()
+					defer done()
+					io.WriteString(resp, "first half, ")
+					resp.(http.Flusher).Flush()
+					close(started)
+					select {
+					case <-finish:
+						io.WriteString(resp, "second half")
+					case <-req.Context().Done():
+					}
+				}),
+			}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go srv.Serve(l)
+
+			bodyCh := make(chan string, 1)
+			go func() {
+				resp, err := http.Get("http://" + l.Addr().String() + "/download")
+				if err != nil {
+					bodyCh <- ""
+					return
+				}
+				defer resp.Body.Close()
+				body, _ := io.ReadAll(resp.Body) // error expected if forcibly closed
+				bodyCh <- string(body)
+			}()
+			<-started
+			if got, want := downloads.count(), int64(1); got != want {
+				t.Fatalf("wrong active download count %d; want %d", got, want)
+			}
+
+			time.AfterFunc(test.finishAfter, func() { close(finish) })
+			var shuttingDown atomic.Bool
+			err = drainServer(srv, &downloads, &shuttingDown, 0, test.timeout, 10*time.Millisecond)
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("wrong error %v; want %v", err, test.wantErr)
+			}
+			if got := <-bodyCh; got != test.wantBody {
+				t.Errorf("wrong body %q; want %q", got, test.wantBody)
+			}
+		})
+	}
+}
+
+func TestDrainServerReadiness(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.0.0", testProviderManifest())
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	shared := newTestSharedState()
+	mux := http.NewServeMux()
+	mux.HandleFunc(providerMirrorHandler(newTestProviderMirror(t, registryServer.URL), shared))
+	mux.Handle("/readyz", readinessHandler(&shared.shuttingDown, nil))
+	srv := &http.Server{Handler: mux}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	baseURL := "http://" + l.Addr().String()
+
+	getStatus := func(path string) int {
+		t.Helper()
+		resp, err := http.Get(baseURL + path)
+		if err != nil {
+			t.Fatalf("request for %s failed: %s", path, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := getStatus("/readyz"); got != 200 {
+		t.Fatalf("wrong readiness status %d before shutdown; want 200", got)
+	}
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- drainServer(srv, &shared.downloads, &shared.shuttingDown, 500*time.Millisecond, 5*time.Second, 10*time.Millisecond)
+	}()
+	for !shared.shuttingDown.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// During the shutdown delay the server still serves new requests, but
+	// reports that it isn't ready for more.
+	if got := getStatus("/readyz"); got != 503 {
+		t.Errorf("wrong readiness status %d during shutdown; want 503", got)
+	}
+	if got := getStatus("/mirror/example.com/foo/bar/index.json"); got != 200 {
+		t.Errorf("wrong status %d for mirror request during shutdown; want 200", got)
+	}
+
+	if err := <-drained; err != nil {
+		t.Errorf("unexpected error from drain: %s", err)
+	}
+}
+
+func TestRunShutdownCompletesDownloads(t *testing.T) {
+	pkg := []byte("first half, second half")
+	registry := newFakeRegistry()
+	registry.addManifest(
+		"terraform-providers/example.com/foo/bar", "1.0.0",
+		testProviderManifest(ocidist.ObjectMeta{
+			MediaType: "application/vnd.hashicorp.terraform.provider-package+zip",
+			Digest:    testDigest(pkg),
+			Size:      int64(len(pkg)),
+			Annotations: map[string]any{
+				"io.terraform.target-platforms": "linux_amd64",
+			},
+		}),
+	)
+	registry.addBlob("terraform-providers/example.com/foo/bar", pkg)
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	registryServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		// Only the package download itself is slow, and not the probe
+		// requests the server makes for its own purposes.
+		if !strings.Contains(req.URL.Path, "/blobs/") || req.Method != "GET" || req.Header.Get("Range") != "" {
+			registry.ServeHTTP(resp, req)
+			return
+		}
+		resp.Header().Set("Content-Length", strconv.Itoa(len(pkg)))
+		resp.WriteHeader(200)
+		resp.Write(pkg[:12])
+		resp.(http.Flusher).Flush()
+		close(started)
+		select {
+		case <-finish:
+			resp.Write(pkg[12:])
+		case <-req.Context().Done():
+		}
+	}))
+	defer registryServer.Close()
+
+	// Run listens on its own, so we find a free port for it first.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenAddr := l.Addr().String()
+	l.Close()
+	cfg, diags := config.LoadConfig([]byte(fmt.Sprintf(`
+		provider_mirror "mirror" {
+			origin_url     = "%s/"
+			name_prefix    = "terraform-providers"
+			proxy_packages = true
+		}
+
+		server {
+			listen_addr         = "%s"
+			query_string_secret = "0000000000000000000000000000000000000000000000000000000000000000"
+		}
+	`, registryServer.URL, listenAddr)), "test.hcl")
+	if diags.HasErrors() {
+		t.Fatalf("invalid config: %s", diags.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- Run(ctx, cfg)
+	}()
+
+	baseURL := "http://" + listenAddr
+	var version struct {
+		Archives map[string]struct {
+			URL string `json:"url"`
+		} `json:"archives"`
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if conn, err := net.Dial("tcp", listenAddr); err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server didn't start listening on %s", listenAddr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := getJSON(t, baseURL+"/mirror/example.com/foo/bar/1.0.0.json", &version); status != 200 {
+		t.Fatalf("wrong status %d for version", status)
+	}
+
+	bodyCh := make(chan []byte, 1)
+	go func() {
+		resp, err := http.Get(baseURL + version.Archives["linux_amd64"].URL)
+		if err != nil {
+			bodyCh <- nil
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body) // error expected if the download is cut short
+		bodyCh <- body
+	}()
+	<-started
+
+	// Shutdown begins while the download is still in progress, and the
+	// origin registry only finishes sending the package afterwards.
+	cancel()
+	time.AfterFunc(50*time.Millisecond, func() { close(finish) })
+
+	if got := <-bodyCh; !bytes.Equal(got, pkg) {
+		t.Errorf("wrong body %q; want %q", got, pkg)
+	}
+	if err := <-runErr; err != nil {
+		t.Errorf("unexpected error from Run: %s", err)
+	}
+}
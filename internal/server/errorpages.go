@@ -0,0 +1,128 @@
+package server
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+)
+
+// withErrorPages wraps the given handler so that any response it writes with
+// one of the status codes in pages has its body replaced by the configured
+// custom content, in whichever of the page's formats the client prefers.
+// Other headers the handler set, such as Retry-After, are preserved.
+//
+// If pages is empty then the handler is returned unchanged.
+func withErrorPages(next http.Handler, pages map[int]*config.ErrorPage) http.Handler {
+	if len(pages) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(&errorPageWriter{ResponseWriter: resp, req: req, pages: pages}, req)
+	})
+}
+
+// errorPageWriter is the [http.ResponseWriter] used by [withErrorPages].
+type errorPageWriter struct {
+	http.ResponseWriter
+	req   *http.Request
+	pages map[int]*config.ErrorPage
+
+	wroteHeader bool
+
+	// replaced is set if the response body has been replaced by an error
+	// page, in which case anything the handler writes is discarded.
+	replaced bool
+}
+
+func (w *errorPageWriter) WriteHeader(status int) {
+	page, ok := w.pages[status]
+	if w.wroteHeader || !ok {
+		w.wroteHeader = true
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+	w.replaced = true
+
+	contentType, body := negotiateErrorPage(page, w.req.Header.Get("Accept"))
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	header.Del("Content-Encoding")
+	w.ResponseWriter.WriteHeader(status)
+	if w.req.Method != http.MethodHead {
+		w.ResponseWriter.Write(body)
+	}
+}
+
+func (w *errorPageWriter) Write(buf []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return len(buf), nil
+	}
+	return w.ResponseWriter.Write(buf)
+}
+
+// negotiateErrorPage returns the content type and body to use for the given
+// error page in response to a request with the given Accept header. HTML is
+// used only if the client prefers it over JSON, so that clients that don't
+// express a preference get a machine-readable response.
+func negotiateErrorPage(page *config.ErrorPage, accept string) (string, []byte) {
+	useHTML := page.JSON == nil ||
+		(page.HTML != nil && acceptQuality(accept, "text/html") > acceptQuality(accept, "application/json"))
+	if useHTML {
+		return "text/html; charset=utf-8", page.HTML
+	}
+	return "application/json", page.JSON
+}
+
+// acceptQuality returns the quality value between zero and one that the
+// given Accept header assigns to the given media type, using the most
+// specific of the media ranges that match it. An empty header accepts
+// everything equally.
+func acceptQuality(accept string, mediaType string) float64 {
+	if strings.TrimSpace(accept) == "" {
+		return 1
+	}
+	typ, _, _ := strings.Cut(mediaType, "/")
+	quality := 0.0
+	bestSpecificity := -1
+	for _, part := range strings.Split(accept, ",") {
+		rangeType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue // ignore malformed ranges
+		}
+		var specificity int
+		switch rangeType {
+		case mediaType:
+			specificity = 2
+		case typ + "/*":
+			specificity = 1
+		case "*/*":
+			specificity = 0
+		default:
+			continue
+		}
+		if specificity < bestSpecificity {
+			continue
+		}
+		q := 1.0
+		if raw, ok := params["q"]; ok {
+			parsed, err := strconv.ParseFloat(raw, 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				continue
+			}
+			q = parsed
+		}
+		if specificity > bestSpecificity || q > quality {
+			quality = q
+		}
+		bestSpecificity = specificity
+	}
+	return quality
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+)
+
+func TestWithErrorPages(t *testing.T) {
+	registry := newFakeRegistry()
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mux := http.NewServeMux()
+	mux.HandleFunc(providerMirrorHandler(mirror, newTestSharedState()))
+	mux.HandleFunc("/unavailable", func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Retry-After", "5")
+		writeTextResponse(resp, 503, "Built-in message.\n")
+	})
+	mux.HandleFunc("/teapot", func(resp http.ResponseWriter, req *http.Request) {
+		writeTextResponse(resp, 418, "Built-in message.\n")
+	})
+	handler := withErrorPages(mux, map[int]*config.ErrorPage{
+		404: {
+			HTML: []byte("<p>Not here.</p>"),
+			JSON: []byte(`{"error":"not here"}`),
+		},
+		503: {
+			HTML: []byte("<p>Try later.</p>"),
+		},
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	tests := map[string]struct {
+		method          string
+		path            string
+		accept          string
+		wantStatus      int
+		wantContentType string
+		wantBody        string
+	}{
+		"custom 404 with no preference": {
+			"GET", "/mirror/example.com/foo/missing/index.json", "",
+			404, "application/json", `{"error":"not here"}`,
+		},
+		"custom 404 for browser": {
+			"GET", "/mirror/example.com/foo/missing/index.json", "text/html,application/xhtml+xml,*/*;q=0.8",
+			404, "text/html; charset=utf-8", "<p>Not here.</p>",
+		},
+		"custom 404 preferring JSON": {
+			"GET", "/mirror/example.com/foo/missing/index.json", "application/json, text/html;q=0.5",
+			404, "application/json", `{"error":"not here"}`,
+		},
+		"custom 404 for HEAD": {
+			"HEAD", "/mirror/example.com/foo/missing/index.json", "",
+			404, "application/json", "",
+		},
+		"custom page with only HTML replaces handler body": {
+			"GET", "/unavailable", "application/json",
+			503, "text/html; charset=utf-8", "<p>Try later.</p>",
+		},
+		"no custom page": {
+			"GET", "/teapot", "",
+			418, "text/plain; charset=utf-8", "Built-in message.\n",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, server.URL+test.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.accept != "" {
+				req.Header.Set("Accept", test.accept)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %s", err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("failed to read body: %s", err)
+			}
+			if resp.StatusCode != test.wantStatus {
+				t.Errorf("wrong status %d; want %d", resp.StatusCode, test.wantStatus)
+			}
+			if got := resp.Header.Get("Content-Type"); got != test.wantContentType {
+				t.Errorf("wrong Content-Type %q; want %q", got, test.wantContentType)
+			}
+			if got := string(body); got != test.wantBody {
+				t.Errorf("wrong body %q; want %q", got, test.wantBody)
+			}
+		})
+	}
+
+	t.Run("other headers preserved", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/unavailable")
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		resp.Body.Close()
+		if got, want := resp.Header.Get("Retry-After"), "5"; got != want {
+			t.Errorf("wrong Retry-After %q; want %q", got, want)
+		}
+	})
+}
+
+func TestAcceptQuality(t *testing.T) {
+	tests := []struct {
+		accept    string
+		mediaType string
+		want      float64
+	}{
+		{"", "text/html", 1},
+		{"text/html", "text/html", 1},
+		{"text/html", "application/json", 0},
+		{"*/*;q=0.8", "application/json", 0.8},
+		{"text/*;q=0.5, */*;q=0.9", "text/html", 0.5},
+		{"text/html;q=0.2, text/*;q=0.9", "text/html", 0.2},
+		{"application/json;q=bad, */*;q=0.1", "application/json", 0.1},
+	}
+	for _, test := range tests {
+		if got := acceptQuality(test.accept, test.mediaType); got != test.want {
+			t.Errorf("acceptQuality(%q, %q) = %v; want %v", test.accept, test.mediaType, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/logging"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+)
+
+// failoverTransport is an [http.RoundTripper] that retries requests to the
+// primary origin registry against a fallback registry when the primary
+// can't be reached, including when its circuit breaker is open, or responds
+// with a server error.
+//
+// Only GET and HEAD requests are retried, since those have no body and are
+// safe to repeat. Requests to other hosts, such as a storage service that a
+// registry redirects to, are sent only through primaryNext.
+type failoverTransport struct {
+	primary  *url.URL
+	fallback *url.URL
+
+	primaryNext  http.RoundTripper
+	fallbackNext http.RoundTripper
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fallbackURL := t.fallbackURL(req)
+	if fallbackURL == nil {
+		return t.primaryNext.RoundTrip(req)
+	}
+
+	resp, err := t.primaryNext.RoundTrip(req)
+	if err == nil && resp.StatusCode < 500 {
+		return resp, nil
+	}
+	ctx := req.Context()
+	if ctx.Err() != nil {
+		// The request was canceled or timed out, so the fallback would
+		// fail in the same way.
+		return resp, err
+	}
+	logger := logging.ContextLogger(ctx)
+	if err != nil {
+		logger.Printf("origin registry request failed, so trying fallback: %s", err)
+	} else {
+		logger.Printf("origin registry returned status %d, so trying fallback", resp.StatusCode)
+		resp.Body.Close()
+	}
+
+	fallbackReq := req.Clone(ctx)
+	fallbackReq.URL = fallbackURL
+	fallbackReq.Host = fallbackURL.Host
+	if fallbackURL.Scheme != t.primary.Scheme || !strings.EqualFold(fallbackURL.Host, t.primary.Host) {
+		// The credentials were meant for the primary registry, whether
+		// they're a client's own or the service's origin credentials, so
+		// they must not be sent anywhere else.
+		fallbackReq.Header.Del("Authorization")
+	}
+	resp, err = t.fallbackNext.RoundTrip(fallbackReq)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyFallbackContent(fallbackURL, resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// fallbackURL returns the URL on the fallback registry corresponding to the
+// URL of the given request, or nil if the request isn't one that should
+// fail over.
+func (t *failoverTransport) fallbackURL(req *http.Request) *url.URL {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return nil
+	}
+	if req.URL.Scheme != t.primary.Scheme || req.URL.Host != t.primary.Host {
+		return nil
+	}
+	rel := strings.TrimPrefix(req.URL.Path, t.primary.Path)
+	if len(rel) == len(req.URL.Path) {
+		return nil
+	}
+	ret := *t.fallback
+	ret.Path = t.fallback.Path + rel
+	ret.RawPath = ""
+	ret.RawQuery = req.URL.RawQuery
+	return &ret
+}
+
+// verifyFallbackContent checks that the given response, if it's for a
+// manifest or blob requested by digest, has content matching that digest,
+// which might not be true if the two registries don't have the same
+// content.
+//
+// It returns an error if the fallback registry reports a different digest,
+// or if a manifest's content doesn't match. Blobs can be too large to check
+// before returning, so instead this replaces the response body with one
+// whose final read fails if the content doesn't match.
+func verifyFallbackContent(u *url.URL, resp *http.Response) error {
+	if resp.StatusCode != 200 {
+		return nil
+	}
+	dir, rawWant := path.Split(u.Path)
+	if !strings.Contains(rawWant, ":") {
+		return nil // not requested by digest
+	}
+	kind := path.Base(dir)
+	if kind != "blobs" && kind != "manifests" {
+		return nil
+	}
+	want, err := ocidist.ParseDigest(rawWant)
+	if err != nil {
+		return fmt.Errorf("invalid digest %q: %w", rawWant, err)
+	}
+	if got := resp.Header.Get("Docker-Content-Digest"); got != "" && got != want.String() {
+		return fmt.Errorf("fallback origin registry returned content with digest %s instead of %s", got, want)
+	}
+	if resp.Request != nil && resp.Request.Method == "HEAD" {
+		return nil // there's no content to check
+	}
+
+	if kind == "manifests" {
+		content, err := io.ReadAll(io.LimitReader(resp.Body, maxFallbackManifestSize+1))
+		if err != nil {
+			return err
+		}
+		if len(content) > maxFallbackManifestSize {
+			return fmt.Errorf("fallback origin registry returned a manifest that is too large")
+		}
+		got, err := ocidist.ComputeDigest(want.Algorithm(), content)
+		if err != nil {
+			return fmt.Errorf("can't verify manifest from fallback origin registry: %w", err)
+		}
+		if got != want {
+			return fmt.Errorf("fallback origin registry returned content with digest %s instead of %s", got, want)
+		}
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(content))
+		return nil
+	}
+
+	digester, err := ocidist.NewDigestingReader(resp.Body, want.Algorithm())
+	if err != nil {
+		return fmt.Errorf("can't verify blob from fallback origin registry: %w", err)
+	}
+	resp.Body = &fallbackBlobBody{
+		ReadCloser: resp.Body,
+		digester:   digester,
+		want:       want,
+	}
+	return nil
+}
+
+// maxFallbackManifestSize is the largest manifest that
+// [verifyFallbackContent] will read to check its digest, which matches the
+// limit the OCI client applies to manifests.
+const maxFallbackManifestSize = 4 * 1024 * 1024
+
+// fallbackBlobBody is the body of a response for a blob from the fallback
+// registry, whose final read fails if the content doesn't match the digest
+// it was requested by.
+type fallbackBlobBody struct {
+	io.ReadCloser
+	digester *ocidist.DigestingReader
+	want     ocidist.Digest
+}
+
+func (b *fallbackBlobBody) Read(p []byte) (int, error) {
+	n, err := b.digester.Read(p)
+	if err == io.EOF {
+		if got := b.digester.Digest(); got != b.want {
+			return n, fmt.Errorf("fallback origin registry returned content with digest %s instead of %s", got, b.want)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFailoverTransport(t *testing.T) {
+	primaryStatus := 200
+	var primaryPaths, fallbackPaths []string
+	primary := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		primaryPaths = append(primaryPaths, req.URL.Path)
+		resp.WriteHeader(primaryStatus)
+		io.WriteString(resp, "primary")
+	}))
+	defer primary.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		fallbackPaths = append(fallbackPaths, req.URL.RequestURI())
+		io.WriteString(resp, "fallback")
+	}))
+	defer fallback.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	tests := map[string]struct {
+		primaryURL string
+		status     int
+		method     string
+		reqPath    string
+		want       string
+		wantPath   string
+	}{
+		"primary ok": {
+			primary.URL, 200, "GET", "/a/v2/foo/tags/list", "primary", "",
+		},
+		"primary not found": {
+			primary.URL, 404, "GET", "/a/v2/foo/tags/list", "primary", "",
+		},
+		"primary server error": {
+			primary.URL, 503, "GET", "/a/v2/foo/tags/list?n=5", "fallback", "/b/v2/foo/tags/list?n=5",
+		},
+		"primary server error for HEAD": {
+			primary.URL, 502, "HEAD", "/a/v2/foo/manifests/1.0.0", "", "/b/v2/foo/manifests/1.0.0",
+		},
+		"primary server error for POST": {
+			primary.URL, 503, "POST", "/a/v2/foo/blobs/uploads/", "primary", "",
+		},
+		"primary server error outside base path": {
+			primary.URL, 503, "GET", "/other/v2/", "primary", "",
+		},
+		"primary unreachable": {
+			unreachable.URL, 200, "GET", "/a/v2/", "fallback", "/b/v2/",
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			primaryStatus = test.status
+			primaryPaths, fallbackPaths = nil, nil
+			primaryURL, _ := url.Parse(test.primaryURL + "/a/")
+			fallbackURL, _ := url.Parse(fallback.URL + "/b/")
+			client := &http.Client{
+				Transport: &failoverTransport{
+					primary:      primaryURL,
+					fallback:     fallbackURL,
+					primaryNext:  http.DefaultTransport,
+					fallbackNext: http.DefaultTransport,
+				},
+			}
+
+			req, err := http.NewRequest(test.method, test.primaryURL+test.reqPath, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %s", err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("failed to read body: %s", err)
+			}
+			if got := string(body); got != test.want {
+				t.Errorf("wrong response body %q; want %q", got, test.want)
+			}
+			if test.wantPath == "" {
+				if len(fallbackPaths) != 0 {
+					t.Errorf("unexpected fallback requests %q", fallbackPaths)
+				}
+			} else if len(fallbackPaths) != 1 || fallbackPaths[0] != test.wantPath {
+				t.Errorf("wrong fallback requests %q; want %q", fallbackPaths, test.wantPath)
+			}
+		})
+	}
+}
+
+func TestFailoverTransportDigestMismatch(t *testing.T) {
+	content := []byte("fallback")
+	digest := testDigest(content)
+	other := testDigest([]byte("something else"))
+	primary := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(503)
+	}))
+	defer primary.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/reported/") {
+			resp.Header().Set("Docker-Content-Digest", digest.String())
+		}
+		resp.Write(content)
+	}))
+	defer fallback.Close()
+
+	primaryURL, _ := url.Parse(primary.URL + "/")
+	fallbackURL, _ := url.Parse(fallback.URL + "/")
+	client := &http.Client{
+		Transport: &failoverTransport{
+			primary:      primaryURL,
+			fallback:     fallbackURL,
+			primaryNext:  http.DefaultTransport,
+			fallbackNext: http.DefaultTransport,
+		},
+	}
+
+	tests := map[string]struct {
+		path    string
+		wantErr string
+	}{
+		"blob matching": {
+			path: "/reported/v2/foo/blobs/" + digest.String(),
+		},
+		"blob matching without header": {
+			path: "/v2/foo/blobs/" + digest.String(),
+		},
+		"blob reported mismatch": {
+			path:    "/reported/v2/foo/blobs/" + other.String(),
+			wantErr: "digest " + digest.String() + " instead of " + other.String(),
+		},
+		"blob mismatch without header": {
+			path:    "/v2/foo/blobs/" + other.String(),
+			wantErr: "digest " + digest.String() + " instead of " + other.String(),
+		},
+		"manifest matching without header": {
+			path: "/v2/foo/manifests/" + digest.String(),
+		},
+		"manifest mismatch without header": {
+			path:    "/v2/foo/manifests/" + other.String(),
+			wantErr: "digest " + digest.String() + " instead of " + other.String(),
+		},
+		"manifest by tag": {
+			path: "/v2/foo/manifests/1.0.0",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			resp, err := client.Get(primary.URL + test.path)
+			if err == nil {
+				var body []byte
+				body, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err == nil && string(body) != string(content) {
+					t.Errorf("wrong body %q", body)
+				}
+			}
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("wrong error %v; want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestFailoverTransportAuthorization(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(503)
+	}))
+	defer primary.Close()
+	var gotAuth []string
+	fallback := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		gotAuth = append(gotAuth, req.Header.Get("Authorization"))
+	}))
+	defer fallback.Close()
+
+	primaryURL, _ := url.Parse(primary.URL + "/a/")
+	for name, fallbackBase := range map[string]string{
+		"other host": fallback.URL + "/b/",
+		// Requests to the primary's own host reach the fallback server
+		// only in this test, but the transport treats it as the same
+		// origin.
+		"same host": primary.URL + "/b/",
+	} {
+		fallbackBase := fallbackBase
+		t.Run(name, func(t *testing.T) {
+			gotAuth = nil
+			fallbackURL, _ := url.Parse(fallbackBase)
+			client := &http.Client{
+				Transport: &failoverTransport{
+					primary:      primaryURL,
+					fallback:     fallbackURL,
+					primaryNext:  http.DefaultTransport,
+					fallbackNext: rewriteHostTransport{fallback.URL},
+				},
+			}
+			req, err := http.NewRequest("GET", primary.URL+"/a/v2/foo/tags/list", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer secret")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %s", err)
+			}
+			resp.Body.Close()
+
+			want := ""
+			if name == "same host" {
+				want = "Bearer secret"
+			}
+			if len(gotAuth) != 1 || gotAuth[0] != want {
+				t.Errorf("fallback received Authorization headers %q; want %q", gotAuth, want)
+			}
+		})
+	}
+}
+
+// rewriteHostTransport sends every request to the server at the given base
+// URL, regardless of the host in the request's URL.
+type rewriteHostTransport struct {
+	base string
+}
+
+func (t rewriteHostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, err := url.Parse(t.base)
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.URL.Scheme = u.Scheme
+	req.URL.Host = u.Host
+	req.Host = ""
+	return http.DefaultTransport.RoundTrip(req)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// acceptsGzip returns true if the given Accept-Encoding header allows a
+// gzip-compressed response, either by naming gzip or by accepting any
+// encoding, without giving it a quality value of zero.
+func acceptsGzip(acceptEncoding string) bool {
+	wildcard := false
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "gzip" && name != "x-gzip" && name != "*" {
+			continue
+		}
+		accepted := true
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(key) != "q" {
+				continue
+			}
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			accepted = err == nil && q > 0
+		}
+		if name == "*" {
+			wildcard = accepted
+			continue
+		}
+		// An explicit entry for gzip takes precedence over any wildcard.
+		return accepted
+	}
+	return wildcard
+}
+
+// gzipBytes returns the gzip-compressed form of the given content, using the
+// given compression level or the gzip package's default level if it's zero.
+//
+// The level must be valid for [gzip.NewWriterLevel].
+func gzipBytes(content []byte, level int) []byte {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		panic(err)
+	}
+	// Writing to a bytes.Buffer can't fail.
+	w.Write(content)
+	w.Close()
+	return buf.Bytes()
+}
+
+// gzipCache remembers the most recent JSON response body for each resource
+// along with its gzip-compressed form, so that a response identical to the
+// previous one can be served compressed without compressing it again.
+//
+// A nil *gzipCache is valid and just compresses every body.
+type gzipCache struct {
+	mu      sync.Mutex
+	entries map[string]gzipCacheEntry
+}
+
+type gzipCacheEntry struct {
+	plain      []byte
+	compressed []byte
+}
+
+func newGzipCache() *gzipCache {
+	return &gzipCache{
+		entries: make(map[string]gzipCacheEntry),
+	}
+}
+
+// compress returns the gzip-compressed form of the given response body for
+// the resource with the given key, compressed at the given level, reusing
+// the previous result for that key if the body hasn't changed.
+//
+// Comparing the whole body means that the cache can never serve a stale
+// response, but it also means that responses that differ on every request,
+// such as those containing download tokens, always miss.
+//
+// Each entry remembers only the body, so a cache must always be used with
+// the same level.
+func (c *gzipCache) compress(key string, body []byte, level int) []byte {
+	if c == nil {
+		return gzipBytes(body, level)
+	}
+	c.mu.Lock()
+	entry, exists := c.entries[key]
+	c.mu.Unlock()
+	if exists && bytes.Equal(entry.plain, body) {
+		return entry.compressed
+	}
+
+	compressed := gzipBytes(body, level)
+	c.mu.Lock()
+	c.entries[key] = gzipCacheEntry{
+		plain:      body,
+		compressed: compressed,
+	}
+	c.mu.Unlock()
+	return compressed
+}
+
+// maybeGzipResponse returns the body to send in response to the given
+// request, compressing the given body and setting the corresponding
+// response headers if the client accepts gzip.
+func maybeGzipResponse(resp http.ResponseWriter, req *http.Request, body []byte, level int, cache *gzipCache, key string) []byte {
+	// The response varies by encoding whether or not this particular client
+	// accepts gzip, so that shared caches don't serve one client's
+	// response to another that can't decode it.
+	resp.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(req.Header.Get("Accept-Encoding")) {
+		return body
+	}
+	resp.Header().Set("Content-Encoding", "gzip")
+	return cache.compress(key, body, level)
+}
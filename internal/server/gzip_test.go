@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/logging"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := map[string]bool{
+		"":                     false,
+		"identity":             false,
+		"gzip":                 true,
+		"GZIP":                 true,
+		"x-gzip":               true,
+		"deflate, gzip;q=0.5":  true,
+		"br;q=1.0, gzip;q=0.8": true,
+		"gzip;q=0":             false,
+		"gzip; q=0.0":          false,
+		"*":                    true,
+		"*;q=0":                false,
+		"gzip;q=0, *":          false,
+		"*, gzip;q=0":          false,
+		"gzip;q=invalid":       false,
+	}
+	for header, want := range tests {
+		t.Run(header, func(t *testing.T) {
+			if got := acceptsGzip(header); got != want {
+				t.Errorf("wrong result %v; want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestGzipCache(t *testing.T) {
+	c := newGzipCache()
+	first := c.compress("a", []byte(`{"versions":{}}`), 0)
+	if got := gunzipTestBytes(t, first); got != `{"versions":{}}` {
+		t.Fatalf("wrong decompressed content %q", got)
+	}
+
+	again := c.compress("a", []byte(`{"versions":{}}`), 0)
+	if &again[0] != &first[0] {
+		t.Errorf("compressed an unchanged body again")
+	}
+
+	changed := c.compress("a", []byte(`{"versions":{"1.0.0":{}}}`), 0)
+	if got := gunzipTestBytes(t, changed); got != `{"versions":{"1.0.0":{}}}` {
+		t.Errorf("wrong decompressed content after change %q", got)
+	}
+
+	other := c.compress("b", []byte(`{"versions":{}}`), 0)
+	if &other[0] == &first[0] {
+		t.Errorf("reused the compressed body of a different key")
+	}
+
+	var nilCache *gzipCache
+	if got := gunzipTestBytes(t, nilCache.compress("a", []byte("{}"), 0)); got != "{}" {
+		t.Errorf("wrong decompressed content from nil cache %q", got)
+	}
+}
+
+func TestProviderMirrorGzipResponses(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.0.0", testProviderManifest())
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.CacheGzipResponses = true
+	shared := newTestSharedState()
+	shared.config.GzipResponses = true
+	mirrorServer := newTestMirrorServerShared(t, mirror, shared)
+	defer mirrorServer.Close()
+
+	// The transport must not decompress the responses itself, so that we
+	// can see what the server actually sent.
+	client := &http.Client{
+		Transport: &http.Transport{DisableCompression: true},
+	}
+	const want = `{"versions":{"1.0.0":{}}}`
+	tests := map[string]struct {
+		acceptEncoding string
+		wantEncoding   string
+	}{
+		"gzip":     {"gzip", "gzip"},
+		"identity": {"", ""},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", mirrorServer.URL+"/mirror/example.com/foo/bar/index.json", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", test.acceptEncoding)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %s", err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("failed to read body: %s", err)
+			}
+			if resp.StatusCode != 200 {
+				t.Fatalf("wrong status %d", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != test.wantEncoding {
+				t.Errorf("wrong Content-Encoding %q; want %q", got, test.wantEncoding)
+			}
+			if got, want := resp.Header.Get("Vary"), "Accept-Encoding"; got != want {
+				t.Errorf("wrong Vary %q; want %q", got, want)
+			}
+			if got, want := resp.ContentLength, int64(len(body)); got != want {
+				t.Errorf("wrong Content-Length %d; want %d", got, want)
+			}
+			got := string(body)
+			if test.wantEncoding == "gzip" {
+				got = gunzipTestBytes(t, body)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("wrong response body\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorCompressionLevel(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.0.0", testProviderManifest())
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	// The gzip package records the fastest and best compression levels in
+	// the "extra flags" byte of the gzip header, and leaves it zero for
+	// other levels.
+	tests := map[int]byte{
+		gzip.BestSpeed:                 4,
+		config.DefaultCompressionLevel: 0,
+		gzip.BestCompression:           2,
+	}
+	for level, wantFlags := range tests {
+		level, wantFlags := level, wantFlags
+		t.Run(fmt.Sprintf("level=%d", level), func(t *testing.T) {
+			shared := newTestSharedState()
+			shared.config.GzipResponses = true
+			shared.config.CompressionLevel = level
+			_, handler := providerMirrorHandler(newTestProviderMirror(t, registryServer.URL), shared)
+
+			req := httptest.NewRequest("GET", "/mirror/example.com/foo/bar/index.json", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			body := rec.Body.Bytes()
+			if rec.Code != 200 || len(body) < 10 {
+				t.Fatalf("wrong response %d with %d bytes", rec.Code, len(body))
+			}
+			if got := body[8]; got != wantFlags {
+				t.Errorf("wrong gzip extra flags %d; want %d", got, wantFlags)
+			}
+			if got, want := gunzipTestBytes(t, body), `{"versions":{"1.0.0":{}}}`; got != want {
+				t.Errorf("wrong decompressed content %q; want %q", got, want)
+			}
+		})
+	}
+}
+
+// BenchmarkWriteJSONResponseGzip compares compressing a version index
+// response for every request with reusing the compressed form of an
+// unchanged response.
+func BenchmarkWriteJSONResponseGzip(b *testing.B) {
+	versions := make(map[string]struct{})
+	for i := 0; i < 200; i++ {
+		versions[fmt.Sprintf("%d.%d.0", i/10, i%10)] = struct{}{}
+	}
+	respJSON := struct {
+		Versions map[string]struct{} `json:"versions"`
+	}{versions}
+	req := httptest.NewRequest("GET", "/mirror/example.com/foo/bar/index.json", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	logger := logging.NewLogger(log.Default())
+
+	benchmarks := map[string]jsonResponseOptions{
+		"uncompressed": {},
+		"per-request":  {gzip: true},
+		"cached":       {gzip: true, gzipCache: newGzipCache(), gzipKey: "example.com/foo/bar"},
+	}
+	for name, opts := range benchmarks {
+		opts := opts
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				writeJSONResponse(httptest.NewRecorder(), req, respJSON, opts, logger)
+			}
+		})
+	}
+}
+
+func gunzipTestBytes(t *testing.T, compressed []byte) string {
+	t.Helper()
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("invalid gzip stream: %s", err)
+	}
+	ret, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("invalid gzip stream: %s", err)
+	}
+	return string(ret)
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+)
+
+// clientLimiter tracks how many operations of a particular kind are active
+// for each client, and rejects new operations for a client that already
+// has the maximum number active.
+type clientLimiter struct {
+	// limit is the maximum number of concurrent operations for each
+	// client, or zero if there is no limit.
+	limit int
+
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func newClientLimiter(limit int) *clientLimiter {
+	return &clientLimiter{
+		limit:  limit,
+		active: make(map[string]int),
+	}
+}
+
+// acquire attempts to start a new operation for the given client. If the
+// client is already at the limit then acquire returns false and the caller
+// must not proceed. Otherwise, the caller must call the returned function
+// once the operation is complete.
+func (l *clientLimiter) acquire(client string) (release func(), ok bool) {
+	if l.limit == 0 {
+		return func() {}, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[client] >= l.limit {
+		return nil, false
+	}
+	l.active[client]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.active[client]--
+			if l.active[client] == 0 {
+				delete(l.active, client)
+			}
+		})
+	}, true
+}
+
+// clientKey returns the string used to identify the client that made the
+// given request, for the purpose of per-client limits and audit logging.
+//
+// If ipv6PrefixLength is nonzero then clients with IPv6 addresses are
+// identified by the network prefix of that length containing their address,
+// like "2001:db8:1:2::/64", because a single client often rotates between
+// addresses within its network. IPv4 addresses, including IPv4-mapped IPv6
+// addresses, are always used in full.
+func clientKey(req *http.Request, ipv6PrefixLength int) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	if ipv6PrefixLength == 0 {
+		return host
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !addr.Is6() || addr.Is4In6() {
+		return host
+	}
+	prefix, err := addr.WithZone("").Prefix(ipv6PrefixLength)
+	if err != nil {
+		return host
+	}
+	return prefix.String()
+}
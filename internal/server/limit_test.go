@@ -0,0 +1,130 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientLimiter(t *testing.T) {
+	l := newClientLimiter(2)
+
+	release1, ok := l.acquire("192.0.2.1")
+	if !ok {
+		t.Fatal("first download was rejected")
+	}
+	release2, ok := l.acquire("192.0.2.1")
+	if !ok {
+		t.Fatal("second download was rejected")
+	}
+	if _, ok := l.acquire("192.0.2.1"); ok {
+		t.Fatal("third concurrent download was accepted; should've been rejected")
+	}
+	if release, ok := l.acquire("192.0.2.2"); !ok {
+		t.Fatal("download from a different client was rejected")
+	} else {
+		release()
+	}
+
+	release1()
+	release1() // releasing twice must not free up a second slot
+	release3, ok := l.acquire("192.0.2.1")
+	if !ok {
+		t.Fatal("download was rejected after an earlier one completed")
+	}
+	if _, ok := l.acquire("192.0.2.1"); ok {
+		t.Fatal("download was accepted after a double release")
+	}
+	release2()
+	release3()
+
+	if len(l.active) != 0 {
+		t.Errorf("limiter still tracking clients after all releases: %#v", l.active)
+	}
+}
+
+func TestClientLimiterUnlimited(t *testing.T) {
+	l := newClientLimiter(0)
+	for i := 0; i < 100; i++ {
+		if _, ok := l.acquire("192.0.2.1"); !ok {
+			t.Fatalf("download %d was rejected by unlimited limiter", i)
+		}
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	tests := map[string]struct {
+		remoteAddr   string
+		prefixLength int
+		want         string
+	}{
+		"ipv4": {
+			remoteAddr: "192.0.2.1:1234",
+			want:       "192.0.2.1",
+		},
+		"ipv4 with prefix length": {
+			remoteAddr:   "192.0.2.1:1234",
+			prefixLength: 64,
+			want:         "192.0.2.1",
+		},
+		"ipv4-mapped ipv6 with prefix length": {
+			remoteAddr:   "[::ffff:192.0.2.1]:1234",
+			prefixLength: 64,
+			want:         "::ffff:192.0.2.1",
+		},
+		"ipv6": {
+			remoteAddr: "[2001:db8:1:2:3:4:5:6]:1234",
+			want:       "2001:db8:1:2:3:4:5:6",
+		},
+		"ipv6 with /64": {
+			remoteAddr:   "[2001:db8:1:2:3:4:5:6]:1234",
+			prefixLength: 64,
+			want:         "2001:db8:1:2::/64",
+		},
+		"ipv6 with /48": {
+			remoteAddr:   "[2001:db8:1:2:3:4:5:6]:1234",
+			prefixLength: 48,
+			want:         "2001:db8:1::/48",
+		},
+		"ipv6 with zone": {
+			remoteAddr:   "[fe80::1:2%eth0]:1234",
+			prefixLength: 64,
+			want:         "fe80::/64",
+		},
+		"no port": {
+			remoteAddr:   "unix-socket",
+			prefixLength: 64,
+			want:         "unix-socket",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = test.remoteAddr
+			if got := clientKey(req, test.prefixLength); got != test.want {
+				t.Errorf("wrong key %q; want %q", got, test.want)
+			}
+		})
+	}
+
+	t.Run("rotating addresses share a limit", func(t *testing.T) {
+		l := newClientLimiter(1)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "[2001:db8:1:2::a]:1234"
+		release, ok := l.acquire(clientKey(req, 64))
+		if !ok {
+			t.Fatal("first download was rejected")
+		}
+		defer release()
+		req.RemoteAddr = "[2001:db8:1:2::b]:1234"
+		if _, ok := l.acquire(clientKey(req, 64)); ok {
+			t.Errorf("download from another address in the same network was accepted")
+		}
+		req.RemoteAddr = "[2001:db8:1:3::a]:1234"
+		if release, ok := l.acquire(clientKey(req, 64)); !ok {
+			t.Errorf("download from a different network was rejected")
+		} else {
+			release()
+		}
+	})
+}
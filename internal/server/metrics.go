@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"sync"
+)
+
+// requestOutcomes counts the requests handled by the server, broken down by
+// the labels returned from [classifyOutcome] along with "aborted" for
+// responses that were cut short, as described for [countRequestOutcomes].
+var requestOutcomes = expvar.NewMap("requests_by_outcome")
+
+// downloadTokenFailures counts how many times the server was unable to
+// generate the authentication string for a package download URL, which
+// suggests a problem with the query string secret.
+var downloadTokenFailures = expvar.NewInt("download_token_failures")
+
+// downloadTokenRejections counts the package download requests that the
+// server rejected because of a problem with their download token, broken
+// down by the labels returned from [tokenFailureReason].
+var downloadTokenRejections = expvar.NewMap("download_token_rejections_by_reason")
+
+// downloadTokenAlerts counts how many times the rate of rejected download
+// tokens has exceeded the configured alert threshold.
+var downloadTokenAlerts = expvar.NewInt("download_token_alerts")
+
+// downloadTokenGraceRedemptions counts how many package downloads used a
+// token that had already expired but was still within the configured grace
+// period, which suggests that the token lifetime is too short for some
+// clients.
+var downloadTokenGraceRedemptions = expvar.NewInt("download_token_grace_redemptions")
+
+// backendTimeouts counts timeouts of requests to origin registries, broken
+// down by whether it was the server's own timeout that elapsed ("proxy") or
+// the origin registry that reported a timeout ("backend").
+var backendTimeouts = expvar.NewMap("backend_timeouts_by_source")
+
+// downloadBytes counts the bytes of package content that each service has
+// served to clients when proxying package downloads.
+var downloadBytes = expvar.NewMap("download_bytes_by_service")
+
+// providerDownloads counts the package download requests for each provider,
+// and providerDownloadBytes the bytes of package content served for each,
+// keyed by the service name and provider address separated by a colon.
+var providerDownloads = newBoundedCounter("downloads_by_provider", maxMetricsProviders)
+var providerDownloadBytes = newBoundedCounter("download_bytes_by_provider", maxMetricsProviders)
+
+// maxMetricsProviders is the number of distinct providers that the
+// per-provider metrics track individually. The provider address comes from
+// the request path, so this guards against a client inflating the metrics
+// without limit by requesting many different addresses.
+const maxMetricsProviders = 1000
+
+// boundedCounter is a set of counters published as an [expvar.Map] that
+// tracks at most a fixed number of distinct keys. Once that many keys have
+// been seen, any other keys are counted together under "other".
+type boundedCounter struct {
+	vars  *expvar.Map
+	limit int
+
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+func newBoundedCounter(name string, limit int) *boundedCounter {
+	return &boundedCounter{
+		vars:  expvar.NewMap(name),
+		limit: limit,
+		keys:  make(map[string]struct{}),
+	}
+}
+
+// Add adds delta to the counter for the given key, or to the "other"
+// counter if the key would exceed the limit.
+func (c *boundedCounter) Add(key string, delta int64) {
+	c.mu.Lock()
+	if _, exists := c.keys[key]; !exists {
+		if len(c.keys) < c.limit {
+			c.keys[key] = struct{}{}
+		} else {
+			key = "other"
+		}
+	}
+	c.mu.Unlock()
+	c.vars.Add(key, delta)
+}
+
+// countRequestOutcomes wraps the given handler so that the outcome of each
+// request is counted in [requestOutcomes].
+//
+// A handler that panics, such as with [http.ErrAbortHandler] to cut short a
+// download that has already begun, is counted as "aborted" unless the
+// client had already gone away. The panic then continues as normal.
+func countRequestOutcomes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		rec := &statusRecorder{ResponseWriter: resp}
+		completed := false
+		defer func() {
+			outcome := classifyOutcome(req.Context().Err(), rec.status)
+			if !completed && outcome != "client_canceled" {
+				outcome = "aborted"
+			}
+			requestOutcomes.Add(outcome, 1)
+		}()
+		next.ServeHTTP(rec, req)
+		completed = true
+	})
+}
+
+// classifyOutcome returns a short label describing the outcome of a request,
+// given the error (if any) from the request's context and the status code
+// of the response.
+//
+// A client disconnecting before we finish responding is classified as
+// "client_canceled" regardless of the response status, so that ordinary
+// Terraform retries and interruptions are not counted as errors.
+//
+// Malformed requests are classified as "bad_request", separately from
+// "not_found", so that clients sending garbage can be distinguished from
+// clients asking for things that don't exist.
+func classifyOutcome(ctxErr error, status int) string {
+	switch {
+	case ctxErr == context.Canceled:
+		return "client_canceled"
+	case ctxErr == context.DeadlineExceeded || status == http.StatusGatewayTimeout:
+		return "timeout"
+	case status == http.StatusNotFound:
+		return "not_found"
+	case status == http.StatusBadRequest:
+		return "bad_request"
+	case status >= 500:
+		return "error"
+	case status >= 400:
+		return "client_error"
+	default:
+		return "ok"
+	}
+}
+
+// statusRecorder is an [http.ResponseWriter] that remembers the status code
+// written by the handler it's passed to, and how many bytes of body it wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(buf []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(buf)
+	r.bytes += int64(n)
+	return n, err
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/logging"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestClassifyOutcome(t *testing.T) {
+	tests := []struct {
+		ctxErr error
+		status int
+		want   string
+	}{
+		{nil, 200, "ok"},
+		{nil, 0, "ok"},
+		{nil, 404, "not_found"},
+		{nil, 400, "bad_request"},
+		{nil, 401, "client_error"},
+		{nil, 502, "error"},
+		{nil, 504, "timeout"},
+		{context.Canceled, 502, "client_canceled"},
+		{context.Canceled, 200, "client_canceled"},
+		{context.DeadlineExceeded, 502, "timeout"},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%v %d", test.ctxErr, test.status), func(t *testing.T) {
+			got := classifyOutcome(test.ctxErr, test.status)
+			if got != test.want {
+				t.Errorf("wrong outcome %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCountRequestOutcomesAborted(t *testing.T) {
+	handler := countRequestOutcomes(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(200)
+		panic(http.ErrAbortHandler)
+	}))
+	count := func() int64 {
+		if v, ok := requestOutcomes.Get("aborted").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := count()
+
+	func() {
+		defer func() {
+			if got := recover(); got != http.ErrAbortHandler {
+				t.Errorf("wrong panic %v; want http.ErrAbortHandler", got)
+			}
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/download", nil))
+	}()
+	if got, want := count()-before, int64(1); got != want {
+		t.Errorf("counted %d aborted requests; want %d", got, want)
+	}
+}
+
+func TestPropagateOCIDistErrorTimeouts(t *testing.T) {
+	tests := map[string]struct {
+		err      error
+		source   string
+		wantBody string
+	}{
+		"proxy": {
+			ocidist.ErrTimeout,
+			"proxy",
+			"Timed out waiting for the origin registry to respond.\n",
+		},
+		"backend": {
+			ocidist.ErrBackendTimeout,
+			"backend",
+			"The origin registry reported a timeout.\n",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			var logs bytes.Buffer
+			logger := logging.NewLogger(log.New(&logs, "", 0))
+			before := expvarIntValue(backendTimeouts.Get(test.source))
+
+			rec := httptest.NewRecorder()
+			propagateOCIDistError(test.err, rec, logger)
+			if rec.Code != 504 {
+				t.Errorf("wrong status %d; want 504", rec.Code)
+			}
+			if got := rec.Body.String(); got != test.wantBody {
+				t.Errorf("wrong body\ngot:  %q\nwant: %q", got, test.wantBody)
+			}
+			if got := expvarIntValue(backendTimeouts.Get(test.source)) - before; got != 1 {
+				t.Errorf("%s timeout counter increased by %d; want 1", test.source, got)
+			}
+			if logs.Len() == 0 {
+				t.Errorf("no log message")
+			}
+		})
+	}
+}
+
+func TestBoundedCounter(t *testing.T) {
+	// Constructed directly so that the test doesn't publish a variable.
+	c := &boundedCounter{
+		vars:  new(expvar.Map).Init(),
+		limit: 2,
+		keys:  make(map[string]struct{}),
+	}
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Add("c", 3)
+	c.Add("a", 4)
+	c.Add("d", 5)
+
+	want := map[string]int64{"a": 5, "b": 2, "other": 8}
+	got := make(map[string]int64)
+	c.vars.Do(func(kv expvar.KeyValue) {
+		got[kv.Key] = expvarIntValue(kv.Value)
+	})
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong counters\n%s", diff)
+	}
+}
+
+// expvarIntValue returns the value of the given expvar variable, which must
+// be either nil or an [expvar.Int], treating nil as zero.
+func expvarIntValue(v expvar.Var) int64 {
+	if v == nil {
+		return 0
+	}
+	return v.(*expvar.Int).Value()
+}
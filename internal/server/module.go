@@ -0,0 +1,331 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/apparentlymart/go-versions/versions"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/cache"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/logging"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+)
+
+// moduleProtocolPath is the path under a module registry service's base
+// path where the module registry protocol's endpoints live, and so is what
+// the service's "modules.v1" discovery entry should refer to.
+const moduleProtocolPath = "v1/modules/"
+
+// modulePackagePath is the path under a module registry service's base path
+// where clients download proxied module packages, kept apart from the
+// protocol's own endpoints so that the two can never be confused.
+const modulePackagePath = "packages/"
+
+// modulePackageMediaType is the media type of the manifest layer containing
+// a module package, as a gzip-compressed tar archive.
+const modulePackageMediaType = "application/vnd.hashicorp.terraform-module+tar.gz"
+
+// xTerraformGet is the response header through which the module registry
+// protocol tells Terraform where to download a module package from.
+const xTerraformGet = "X-Terraform-Get"
+
+// moduleRegistryHandler returns the base path and handler for a service that
+// serves the module registry protocol, where each module version is a tag
+// in the namespace for the module whose manifest has a module package layer.
+func moduleRegistryHandler(cfg *config.ModuleRegistry, shared *sharedState) (string, func(resp http.ResponseWriter, req *http.Request)) {
+	secreter := shared.secreter
+	serviceName := cfg.Name
+	prefix := "/" + serviceName + "/"
+
+	// packageBase is the base URL for the proxied package download links
+	// that we generate in responses, which Terraform resolves relative to
+	// the URL of the response.
+	packageBase := &url.URL{Path: prefix + modulePackagePath}
+
+	ociClient := newRegistryServiceClient("module registry", serviceName, cfg.OriginURL, cfg.Backend, shared)
+	shared.addBackendProbe(serviceName, ociClient.CheckAPISupport)
+
+	jsonOpts := jsonResponseOptions{
+		headContentLength: true,
+		gzip:              shared.config.GzipResponses,
+		gzipLevel:         shared.config.CompressionLevel,
+	}
+
+	manifestCache := cache.New[string, *ocidist.Manifest](cfg.CacheTTL, cfg.CacheMaxStale)
+
+	// getModuleLayer fetches the manifest for the given version tag and
+	// returns its module package layer, or nil if it has none.
+	getModuleLayer := func(ctx context.Context, logger *logging.Logger, nsAddr ocidist.Namespace, tag ocidist.Reference, authHeader string) (*ocidist.ObjectMeta, cache.Status, error) {
+		cacheKey := metadataCacheKey(nsAddr.String()+":"+tag.String(), authHeader)
+		manifest, cacheStatus, err := timedCacheGet(ctx, manifestCache, cacheKey, func() (*ocidist.Manifest, error) {
+			logger.Printf("fetch layers for %s:%s", nsAddr, tag)
+			return ociClient.GetManifest(ctx, nsAddr, tag)
+		}, backendUnavailable)
+		if err != nil {
+			return nil, cacheStatus, err
+		}
+		for i, meta := range manifest.Layers {
+			if meta.MediaType != modulePackageMediaType {
+				continue
+			}
+			if err := meta.Digest.CheckAlgorithm(shared.config.TrustedDigestAlgorithms); err != nil {
+				logger.Printf("ignoring package layer %s: %s", meta.Digest, err)
+				continue
+			}
+			return &manifest.Layers[i], cacheStatus, nil
+		}
+		return nil, cacheStatus, nil
+	}
+
+	versionsHandler := func(resp http.ResponseWriter, req *http.Request, logger *logging.Logger, nsAddr ocidist.Namespace) {
+		ctx := contextWithOriginalReq(req.Context(), req)
+		logger.Printf("fetch tags for %s", nsAddr)
+		tags, err := ociClient.GetNamespaceTags(ctx, nsAddr)
+		if err != nil {
+			propagateOCIDistError(err, resp, logger)
+			return
+		}
+
+		type RespVersion struct {
+			Version string `json:"version"`
+		}
+		type RespModule struct {
+			Versions []RespVersion `json:"versions"`
+		}
+		type RespJSON struct {
+			Modules []RespModule `json:"modules"`
+		}
+		versionTags := make(map[versions.Version]ocidist.Reference)
+		var versionList versions.List
+		for _, tag := range tags {
+			v, err := versions.ParseVersion(tag.String())
+			if err != nil {
+				continue // Ignore tags that aren't version numbers
+			}
+			versionTags[v] = tag
+			versionList = append(versionList, v)
+		}
+		versionList.Sort()
+
+		// Only versions with a module package can be downloaded, so we
+		// need every version's manifest to decide which to list.
+		type release struct {
+			layer *ocidist.ObjectMeta
+			stale bool
+		}
+		authHeader := req.Header.Get("authorization")
+		releases, errs := fetchConcurrently(versionList, maxConcurrentManifestFetches, func(v versions.Version) (release, error) {
+			layer, cacheStatus, err := getModuleLayer(ctx, logger, nsAddr, versionTags[v], authHeader)
+			return release{layer: layer, stale: cacheStatus == cache.Stale}, err
+		})
+		module := RespModule{Versions: []RespVersion{}}
+		stale := false
+		for i, v := range versionList {
+			tag, err := versionTags[v], errs[i]
+			stale = stale || releases[i].stale
+			if _, ok := err.(ocidist.NotFoundError); ok {
+				continue // tag was presumably deleted after we listed it
+			}
+			if err == ocidist.ErrImageIndex {
+				logger.Printf("ignoring %s:%s because it is an image index", nsAddr, tag)
+				continue
+			}
+			if err != nil && (backendUnavailable(err) || err == ocidist.ErrUnauthorized) {
+				propagateOCIDistError(err, resp, logger)
+				return
+			}
+			if err != nil {
+				// A broken version shouldn't hide all of the others.
+				logger.Warnf("ignoring %s:%s: %s", nsAddr, tag, err)
+				continue
+			}
+			if releases[i].layer == nil {
+				logger.Printf("ignoring %s:%s because it has no module package layer", nsAddr, tag)
+				continue
+			}
+			module.Versions = append(module.Versions, RespVersion{Version: v.String()})
+		}
+		if stale {
+			logger.Printf("origin registry is unavailable, so serving stale manifests for %s", nsAddr)
+			markStaleResponse(resp)
+		}
+		writeJSONResponse(resp, req, RespJSON{Modules: []RespModule{module}}, jsonOpts, logger)
+	}
+
+	downloadHandler := func(resp http.ResponseWriter, req *http.Request, logger *logging.Logger, addrParts []string, nsAddr ocidist.Namespace, selector string) {
+		version, err := versions.ParseVersion(selector)
+		if err != nil {
+			logger.Printf("unsupported version %q for %s", selector, nsAddr)
+			resp.WriteHeader(404)
+			return
+		}
+		tag, err := ocidist.ParseReference(version.String())
+		if err != nil {
+			logger.Printf("version %s for %s uses version syntax that isn't valid OCI Distribution ref syntax", version, nsAddr)
+			resp.WriteHeader(404)
+			return
+		}
+		ctx := contextWithOriginalReq(req.Context(), req)
+		layer, cacheStatus, err := getModuleLayer(ctx, logger, nsAddr, tag, req.Header.Get("authorization"))
+		if err == ocidist.ErrImageIndex {
+			resp.WriteHeader(404)
+			return
+		}
+		if err != nil {
+			propagateOCIDistError(err, resp, logger)
+			return
+		}
+		if layer == nil {
+			logger.Printf("%s:%s has no module package layer", nsAddr, tag)
+			resp.WriteHeader(404)
+			return
+		}
+		if cacheStatus == cache.Stale {
+			logger.Printf("origin registry is unavailable, so serving a stale manifest for %s:%s", nsAddr, tag)
+			markStaleResponse(resp)
+		}
+
+		var location *url.URL
+		if cfg.ProxyPackages {
+			token := downloadToken{
+				Digest:     layer.Digest,
+				AuthHeader: req.Header.Get("authorization"),
+			}
+			location, err = downloadURL(packageBase, moduleProtocol, addrParts, secreter, token)
+			if err != nil {
+				logger.Errorf("failed to generate download authentication string: %s", err)
+				downloadTokenFailures.Add(1)
+				writeTextResponse(resp, 500, "Failed to generate a download URL for this module package.\nThe server's query string secret may be misconfigured; see the server logs for details.\n")
+				return
+			}
+		} else {
+			location = ociClient.BlobURL(nsAddr, layer.Digest)
+		}
+		// The URL doesn't end with an archive filename suffix, so Terraform
+		// needs to be told what kind of archive it refers to. Terraform
+		// removes this argument before making its request.
+		if location.RawQuery != "" {
+			location.RawQuery += "&"
+		}
+		location.RawQuery += "archive=tar.gz"
+		resp.Header().Set(xTerraformGet, location.String())
+		resp.WriteHeader(http.StatusNoContent)
+	}
+
+	proxyHandler := func(resp http.ResponseWriter, req *http.Request, logger *logging.Logger, nsAddr ocidist.Namespace) {
+		rawToken, _ := splitDownloadQuery(req.URL.RawQuery, nil)
+		token, late, err := unwrapDownloadToken(secreter, rawToken)
+		if err != nil {
+			shared.rejectDownloadToken(req, logger, serviceName, rawToken, err)
+			resp.WriteHeader(404)
+			return
+		}
+		if late > 0 {
+			logger.Warnf("accepting download token that expired %s ago, within the grace period", late.Round(time.Second))
+			downloadTokenGraceRedemptions.Add(1)
+		}
+		digest := token.Digest
+		if err := digest.CheckAlgorithm(shared.config.TrustedDigestAlgorithms); err != nil {
+			logger.Printf("refusing to download %s: %s", digest, err)
+			resp.WriteHeader(404)
+			return
+		}
+
+		client := clientKey(req, shared.config.ClientIPv6PrefixLength)
+		release, ok := shared.downloadLimiter.acquire(client)
+		if !ok {
+			logger.Printf("rejecting download because client %s has too many concurrent downloads", client)
+			resp.Header().Set("Retry-After", "1")
+			resp.WriteHeader(429)
+			return
+		}
+		defer release()
+		downloadDone := shared.downloads.start()
+		defer downloadDone()
+
+		ctx := contextWithOriginalReq(req.Context(), req)
+		header, r, err := ociClient.GetBlobContent(ctx, nsAddr, digest, token.AuthHeader)
+		if err != nil {
+			propagateOCIDistError(err, resp, logger)
+			return
+		}
+		defer r.Close()
+		logger.Printf("proxying content for %s blob %s", nsAddr, digest)
+
+		copyAllowedHeaders(resp.Header(), header, config.DefaultPackageResponseHeaders)
+		resp.WriteHeader(200)
+		n, err := io.Copy(resp, r)
+		downloadBytes.Add(serviceName, n)
+		if err != nil {
+			// We've already sent a successful status, so the only way to
+			// tell the client that the download is incomplete is to abort
+			// the response. Returning normally would end a response
+			// without a Content-Length as if it were complete.
+			logger.Printf("aborting download of %s blob %s: %s", nsAddr, digest, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	return prefix, func(resp http.ResponseWriter, req *http.Request) {
+		if shared.config.LogServiceNames {
+			req = req.WithContext(logging.ContextWithLoggerPrefix(req.Context(), "["+serviceName+"] "))
+		}
+		urlNoQuery := *req.URL
+		urlNoQuery.RawQuery = ""
+		logger, done := logging.ContextLoggerRequest(req.Context(), "request to module registry: %s", &urlNoQuery)
+		defer done()
+
+		path, err := normalizeRequestPath(req.URL.EscapedPath())
+		if err != nil {
+			logger.Printf("rejecting request path: %s", err)
+			writeTextResponse(resp, 400, "Invalid request path: "+err.Error()+".\n")
+			return
+		}
+		// The first part is always empty and the second is the service
+		// name, so the protocol's paths and the package downloads begin at
+		// the third.
+		pathParts := strings.Split(path, "/")
+		var addrSegments, remainParts []string
+		packageDownload := false
+		switch {
+		case len(pathParts) >= 8 && pathParts[2]+"/"+pathParts[3]+"/" == moduleProtocolPath:
+			addrSegments, remainParts = pathParts[4:7], pathParts[7:]
+		case cfg.ProxyPackages && len(pathParts) == 7 && pathParts[2]+"/" == modulePackagePath && pathParts[6] == "download":
+			addrSegments, packageDownload = pathParts[3:6], true
+		default:
+			resp.WriteHeader(404)
+			return
+		}
+
+		// A module address doesn't include a hostname, but
+		// normalizeProviderAddr expects the first segment to be one.
+		addrParts, err := normalizeProviderAddr(append([]string{""}, addrSegments...))
+		if err != nil {
+			logger.Printf("invalid module address: %s", err)
+			resp.WriteHeader(404)
+			return
+		}
+		addrParts = addrParts[1:]
+		nsAddr, err := ociDistNamespaceFromPathSegments(cfg.NamePrefix, addrParts)
+		if err != nil {
+			logger.Printf("unsupported module address: %s", err)
+			resp.WriteHeader(404)
+			return
+		}
+
+		switch {
+		case packageDownload:
+			proxyHandler(resp, req, logger, nsAddr)
+		case len(remainParts) == 1 && remainParts[0] == "versions":
+			versionsHandler(resp, req, logger, nsAddr)
+		case len(remainParts) == 2 && remainParts[1] == "download":
+			downloadHandler(resp, req, logger, addrParts, nsAddr, remainParts[0])
+		default:
+			resp.WriteHeader(404)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/querysecret"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestModuleRegistry(t *testing.T) {
+	const ns = "terraform-modules/example/network/aws"
+	registry := newFakeRegistry()
+	pkg := []byte("module package")
+	pkgDigest := registry.addBlob(ns, pkg)
+	moduleManifest := func(layers ...ocidist.ObjectMeta) *ocidist.Manifest {
+		return &ocidist.Manifest{
+			SchemaVersion: 2,
+			MediaType:     "application/vnd.oci.image.manifest.v1+json",
+			Config: ocidist.ObjectMeta{
+				MediaType: "application/vnd.oci.empty.v1+json",
+				Digest:    testDigest([]byte("{}")),
+				Size:      2,
+			},
+			Layers: layers,
+		}
+	}
+	registry.addManifest(ns, "1.2.0", moduleManifest(ocidist.ObjectMeta{
+		MediaType: modulePackageMediaType,
+		Digest:    pkgDigest,
+		Size:      int64(len(pkg)),
+	}))
+	registry.addManifest(ns, "1.0.0", moduleManifest(ocidist.ObjectMeta{
+		MediaType: "application/vnd.example.something-else",
+		Digest:    pkgDigest,
+		Size:      int64(len(pkg)),
+	}))
+	registry.addManifest(ns, "latest", moduleManifest())
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	originURL, err := url.Parse(registryServer.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newServer := func(t *testing.T, proxy bool) (*httptest.Server, string) {
+		shared := newTestSharedState()
+		shared.secreter = querysecret.NewSecreter([32]byte{1, 2, 3})
+		mux := http.NewServeMux()
+		mux.HandleFunc(moduleRegistryHandler(&config.ModuleRegistry{
+			Name:          "modules",
+			OriginURL:     originURL,
+			NamePrefix:    ocidist.MustParseNamespace("terraform-modules"),
+			ProxyPackages: proxy,
+		}, shared))
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+		return server, server.URL + "/modules/v1/modules/"
+	}
+	// getLocation requests the download endpoint for the given version and
+	// returns its X-Terraform-Get header.
+	getLocation := func(t *testing.T, base string, version string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(base + "example/network/aws/" + version + "/download")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header.Get(xTerraformGet)
+	}
+
+	t.Run("versions", func(t *testing.T) {
+		_, base := newServer(t, false)
+		var got any
+		if status := getJSON(t, base+"example/Network/aws/versions", &got); status != 200 {
+			t.Fatalf("wrong status %d", status)
+		}
+		want := map[string]any{
+			"modules": []any{
+				map[string]any{
+					// 1.0.0 has no module package, so it can't be
+					// downloaded and isn't listed.
+					"versions": []any{
+						map[string]any{"version": "1.2.0"},
+					},
+				},
+			},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("wrong response\n%s", diff)
+		}
+		if status := getJSON(t, base+"example/other/aws/versions", &got); status != 404 {
+			t.Errorf("wrong status %d for nonexistent module; want 404", status)
+		}
+	})
+
+	t.Run("direct download", func(t *testing.T) {
+		_, base := newServer(t, false)
+		status, location := getLocation(t, base, "1.2.0")
+		if status != http.StatusNoContent {
+			t.Fatalf("wrong status %d", status)
+		}
+		want := registryServer.URL + "/v2/" + ns + "/blobs/" + pkgDigest.String() + "?archive=tar.gz"
+		if location != want {
+			t.Errorf("wrong location\ngot:  %s\nwant: %s", location, want)
+		}
+
+		for _, version := range []string{"1.0.0", "2.0.0", "latest"} {
+			if status, _ := getLocation(t, base, version); status != 404 {
+				t.Errorf("wrong status %d for version %s; want 404", status, version)
+			}
+		}
+	})
+
+	t.Run("proxied download", func(t *testing.T) {
+		server, base := newServer(t, true)
+		status, location := getLocation(t, base, "1.2.0")
+		if status != http.StatusNoContent {
+			t.Fatalf("wrong status %d", status)
+		}
+		if want := "/modules/packages/example/network/aws/download?"; !strings.HasPrefix(location, want) || !strings.HasSuffix(location, "&archive=tar.gz") {
+			t.Fatalf("wrong location %s; want %s...&archive=tar.gz", location, want)
+		}
+
+		resp, err := http.Get(server.URL + location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("wrong status %d for package download", resp.StatusCode)
+		}
+		if string(body) != string(pkg) {
+			t.Errorf("wrong package content %q", body)
+		}
+
+		resp, err = http.Get(server.URL + "/modules/packages/example/network/aws/download?not-a-token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 404 {
+			t.Errorf("wrong status %d for invalid token; want 404", resp.StatusCode)
+		}
+
+		// The protocol's own download path for the latest version isn't
+		// supported, and in particular doesn't accept download tokens.
+		_, query, _ := strings.Cut(location, "?")
+		resp, err = http.Get(base + "example/network/aws/download?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 404 {
+			t.Errorf("wrong status %d for the protocol's download path; want 404", resp.StatusCode)
+		}
+	})
+}
+
+func TestModuleRegistryProxiedDownloadInterrupted(t *testing.T) {
+	const ns = "terraform-modules/example/network/aws"
+	registry := newFakeRegistry()
+	pkg := []byte("module package")
+	pkgDigest := registry.addBlob(ns, pkg)
+	registry.addManifest(ns, "1.2.0", &ocidist.Manifest{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.manifest.v1+json",
+		Config: ocidist.ObjectMeta{
+			MediaType: "application/vnd.oci.empty.v1+json",
+			Digest:    testDigest([]byte("{}")),
+			Size:      2,
+		},
+		Layers: []ocidist.ObjectMeta{
+			{
+				MediaType: modulePackageMediaType,
+				Digest:    pkgDigest,
+				Size:      int64(len(pkg)),
+			},
+		},
+	})
+	// The origin registry sends the package without a Content-Length and
+	// then drops the connection partway through.
+	registryServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if !strings.Contains(req.URL.Path, "/blobs/") {
+			registry.ServeHTTP(resp, req)
+			return
+		}
+		resp.WriteHeader(200)
+		resp.Write(pkg[:6])
+		resp.(http.Flusher).Flush()
+		conn, _, err := resp.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	defer registryServer.Close()
+
+	originURL, err := url.Parse(registryServer.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := newTestSharedState()
+	shared.secreter = querysecret.NewSecreter([32]byte{1, 2, 3})
+	mux := http.NewServeMux()
+	mux.HandleFunc(moduleRegistryHandler(&config.ModuleRegistry{
+		Name:          "modules",
+		OriginURL:     originURL,
+		NamePrefix:    ocidist.MustParseNamespace("terraform-modules"),
+		ProxyPackages: true,
+	}, shared))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/modules/v1/modules/example/network/aws/1.2.0/download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location := resp.Header.Get(xTerraformGet)
+	if location == "" {
+		t.Fatalf("no download location")
+	}
+
+	// The client must be able to tell that the package is incomplete,
+	// rather than seeing what looks like a complete response.
+	resp, err = http.Get(server.URL + location)
+	if err != nil {
+		return // the connection was aborted before any response
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Errorf("download succeeded with status %d and body %q; want error", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+)
+
+// providerIndexName is the path segment, directly under a provider mirror's
+// root, of its optional index of all available providers. The index is HTML
+// unless the segment has a ".json" suffix.
+//
+// Namespace parts can't start with an underscore, so this can never be
+// mistaken for the start of a provider address.
+const providerIndexName = "_providers"
+
+// catalogProviders returns the addresses of the providers whose metadata is
+// stored in the given namespaces from an origin registry's catalog, given
+// the service's name prefix and metadata name suffix, in sorted order.
+//
+// Namespaces that don't have the prefix and suffix, or that don't have
+// exactly three parts between them, can't belong to a provider and so are
+// ignored.
+func catalogProviders(namespaces []ocidist.Namespace, prefix, suffix ocidist.Namespace) []string {
+	ret := make([]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		if len(ns) != len(prefix)+3+len(suffix) {
+			continue
+		}
+		if !namespaceHasPrefix(ns, prefix) || !namespaceHasPrefix(ns[len(ns)-len(suffix):], suffix) {
+			continue
+		}
+		addr := ns[len(prefix) : len(prefix)+3]
+		ret = append(ret, addr.String())
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// providerIndexPage returns the page of the given sorted provider addresses
+// that the given query asks for, using the "n" and "last" parameters in the
+// same way as the OCI Distribution protocol's paginated responses, along
+// with the query for the next page, or nil if this is the last page.
+//
+// If maxSize is nonzero then pages have at most that many providers even if
+// the query asks for more, and otherwise a query without "n" gets all of
+// the providers after "last".
+func providerIndexPage(providers []string, query url.Values, maxSize int) ([]string, url.Values, error) {
+	size := maxSize
+	if raw := query.Get("n"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return nil, nil, fmt.Errorf("page size must be a positive whole number")
+		}
+		if maxSize == 0 || n < maxSize {
+			size = n
+		}
+	}
+	start := 0
+	if last := query.Get("last"); last != "" {
+		start = sort.SearchStrings(providers, last)
+		if start < len(providers) && providers[start] == last {
+			start++
+		}
+	}
+	rest := providers[start:]
+	if size == 0 || len(rest) <= size {
+		return rest, nil, nil
+	}
+	page := rest[:size]
+	next := url.Values{
+		"n":    {strconv.Itoa(size)},
+		"last": {page[len(page)-1]},
+	}
+	return page, next, nil
+}
+
+// namespaceHasPrefix returns true if the first parts of the given namespace
+// are the parts of the given prefix.
+func namespaceHasPrefix(ns, prefix ocidist.Namespace) bool {
+	if len(ns) < len(prefix) {
+		return false
+	}
+	for i, part := range prefix {
+		if ns[i] != part {
+			return false
+		}
+	}
+	return true
+}
+
+// writeProviderIndexHTML writes a page listing the given provider addresses,
+// each linking to the provider's version list, and then linking to the
+// given next page unless it's nil.
+func writeProviderIndexHTML(resp http.ResponseWriter, req *http.Request, serviceName string, providers []string, next *url.URL) {
+	var buf strings.Builder
+	buf.WriteString("<!DOCTYPE html><html><title>Providers in ")
+	buf.WriteString(html.EscapeString(serviceName))
+	buf.WriteString("</title><body><ul>")
+	for _, addr := range providers {
+		buf.WriteString(`<li><a href="`)
+		buf.WriteString(html.EscapeString(addr + "/index.json"))
+		buf.WriteString(`">`)
+		buf.WriteString(html.EscapeString(addr))
+		buf.WriteString("</a></li>")
+	}
+	buf.WriteString("</ul>")
+	if next != nil {
+		buf.WriteString(`<p><a rel="next" href="`)
+		buf.WriteString(html.EscapeString(next.String()))
+		buf.WriteString(`">Next page</a></p>`)
+	}
+	buf.WriteString("</body></html>")
+
+	content := buf.String()
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	resp.WriteHeader(200)
+	if req.Method != "HEAD" {
+		resp.Write([]byte(content))
+	}
+}
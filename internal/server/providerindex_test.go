@@ -0,0 +1,268 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCatalogProviders(t *testing.T) {
+	namespaces := []ocidist.Namespace{
+		ocidist.MustParseNamespace("terraform-providers/example.com/foo/baz/meta"),
+		ocidist.MustParseNamespace("terraform-providers/example.com/foo/bar/meta"),
+		ocidist.MustParseNamespace("terraform-providers/example.com/foo/bar/packages"),
+		ocidist.MustParseNamespace("terraform-providers/example.com/foo/meta"),
+		ocidist.MustParseNamespace("terraform-providers/example.com/foo/bar/baz/meta"),
+		ocidist.MustParseNamespace("other/example.com/foo/bar/meta"),
+	}
+	got := catalogProviders(namespaces, ocidist.MustParseNamespace("terraform-providers"), ocidist.MustParseNamespace("meta"))
+	want := []string{
+		"example.com/foo/bar",
+		"example.com/foo/baz",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong providers\n%s", diff)
+	}
+}
+
+func TestProviderIndexPage(t *testing.T) {
+	providers := []string{"a/a/a", "a/a/b", "a/a/c", "a/a/d", "a/a/e"}
+	tests := map[string]struct {
+		query    string
+		maxSize  int
+		want     []string
+		wantNext string
+		wantErr  bool
+	}{
+		"all":               {"", 0, providers, "", false},
+		"first page":        {"n=2", 0, []string{"a/a/a", "a/a/b"}, "last=a%2Fa%2Fb&n=2", false},
+		"middle page":       {"n=2&last=a/a/b", 0, []string{"a/a/c", "a/a/d"}, "last=a%2Fa%2Fd&n=2", false},
+		"last page":         {"n=2&last=a/a/d", 0, []string{"a/a/e"}, "", false},
+		"exactly last page": {"n=2&last=a/a/c", 0, []string{"a/a/d", "a/a/e"}, "", false},
+		"after unknown":     {"last=a/a/bb", 0, []string{"a/a/c", "a/a/d", "a/a/e"}, "", false},
+		"after everything":  {"last=z", 0, []string{}, "", false},
+		"default maximum":   {"", 3, []string{"a/a/a", "a/a/b", "a/a/c"}, "last=a%2Fa%2Fc&n=3", false},
+		"above maximum":     {"n=10", 3, []string{"a/a/a", "a/a/b", "a/a/c"}, "last=a%2Fa%2Fc&n=3", false},
+		"below maximum":     {"n=1", 3, []string{"a/a/a"}, "last=a%2Fa%2Fa&n=1", false},
+		"invalid size":      {"n=lots", 0, nil, "", true},
+		"nonpositive size":  {"n=0", 0, nil, "", true},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			query, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, next, err := providerIndexPage(providers, query, test.maxSize)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("no error; want one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("wrong page\n%s", diff)
+			}
+			if gotNext := next.Encode(); gotNext != test.wantNext {
+				t.Errorf("wrong next query %q; want %q", gotNext, test.wantNext)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorProviderIndexPagination(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.supportCatalog = true
+	var want []string
+	for i := 0; i < 250; i++ {
+		addr := fmt.Sprintf("example.com/foo/p%03d", i)
+		registry.addManifest("terraform-providers/"+addr, "1.0.0", testProviderManifest())
+		want = append(want, addr)
+	}
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.ProviderIndex = true
+	mirror.ProviderIndexPageSize = 100
+	mirror.CacheTTL = time.Minute
+	mirrorServer := newTestMirrorServer(t, mirror)
+	defer mirrorServer.Close()
+
+	// listAll follows the "next" links from the given URL, returning all of
+	// the providers and the number of pages.
+	listAll := func(t *testing.T, start string) ([]string, int) {
+		t.Helper()
+		var all []string
+		pages := 0
+		next, err := url.Parse(start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for next != nil {
+			pages++
+			if pages > 10 {
+				t.Fatalf("too many pages; pagination is probably looping")
+			}
+			resp, err := http.Get(next.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var body struct {
+				Providers []string `json:"providers"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("invalid response: %s", err)
+			}
+			if resp.StatusCode != 200 {
+				t.Fatalf("wrong status %d for %s", resp.StatusCode, next)
+			}
+			all = append(all, body.Providers...)
+			next, err = ocidist.NextPageURL(resp.Header, next)
+			if err != nil {
+				t.Fatalf("invalid Link header: %s", err)
+			}
+		}
+		return all, pages
+	}
+
+	t.Run("default page size", func(t *testing.T) {
+		got, pages := listAll(t, mirrorServer.URL+"/mirror/_providers.json")
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("wrong providers\n%s", diff)
+		}
+		if pages != 3 {
+			t.Errorf("wrong number of pages %d; want 3", pages)
+		}
+	})
+	t.Run("client page size", func(t *testing.T) {
+		got, pages := listAll(t, mirrorServer.URL+"/mirror/_providers.json?n=30")
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("wrong providers\n%s", diff)
+		}
+		if pages != 9 {
+			t.Errorf("wrong number of pages %d; want 9", pages)
+		}
+	})
+	t.Run("html", func(t *testing.T) {
+		resp, err := http.Get(mirrorServer.URL + "/mirror/_providers?n=10")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `<a rel="next" href="?last=example.com%2Ffoo%2Fp009&amp;n=10">`; !strings.Contains(string(body), want) {
+			t.Errorf("page doesn't link to the next page with %q\n%s", want, body)
+		}
+		if got, want := resp.Header.Get("Link"), `<?last=example.com%2Ffoo%2Fp009&n=10>; rel="next"`; got != want {
+			t.Errorf("wrong Link header %q; want %q", got, want)
+		}
+	})
+	t.Run("invalid page size", func(t *testing.T) {
+		resp, err := http.Get(mirrorServer.URL + "/mirror/_providers.json?n=0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("wrong status %d; want 400", resp.StatusCode)
+		}
+	})
+}
+
+func TestProviderMirrorProviderIndex(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.supportCatalog = true
+	registry.addManifest("terraform-providers/example.com/foo/baz", "1.0.0", testProviderManifest())
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.0.0", testProviderManifest())
+	registry.addManifest("unrelated/example.com/foo/bar", "1.0.0", testProviderManifest())
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	t.Run("disabled", func(t *testing.T) {
+		mirror := newTestProviderMirror(t, registryServer.URL)
+		mirrorServer := newTestMirrorServer(t, mirror)
+		defer mirrorServer.Close()
+
+		resp, err := http.Get(mirrorServer.URL + "/mirror/_providers.json")
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 404 {
+			t.Errorf("wrong status %d; want 404", resp.StatusCode)
+		}
+	})
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.ProviderIndex = true
+	mirror.CacheTTL = time.Minute
+	mirrorServer := newTestMirrorServer(t, mirror)
+	defer mirrorServer.Close()
+
+	t.Run("json", func(t *testing.T) {
+		var got struct {
+			Providers []string `json:"providers"`
+		}
+		// The second request should be served from the cache.
+		for i := 0; i < 2; i++ {
+			if status := getJSON(t, mirrorServer.URL+"/mirror/_providers.json", &got); status != 200 {
+				t.Fatalf("wrong status %d", status)
+			}
+		}
+		want := []string{"example.com/foo/bar", "example.com/foo/baz"}
+		if diff := cmp.Diff(want, got.Providers); diff != "" {
+			t.Errorf("wrong providers\n%s", diff)
+		}
+		if registry.catalogRequests != 1 {
+			t.Errorf("registry received %d catalog requests; want 1", registry.catalogRequests)
+		}
+	})
+
+	t.Run("html", func(t *testing.T) {
+		resp, err := http.Get(mirrorServer.URL + "/mirror/_providers")
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to read body: %s", err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("wrong status %d", resp.StatusCode)
+		}
+		if got, want := resp.Header.Get("Content-Type"), "text/html; charset=utf-8"; got != want {
+			t.Errorf("wrong Content-Type %q; want %q", got, want)
+		}
+		for _, want := range []string{
+			`<a href="example.com/foo/bar/index.json">example.com/foo/bar</a>`,
+			`<a href="example.com/foo/baz/index.json">example.com/foo/baz</a>`,
+		} {
+			if !strings.Contains(string(body), want) {
+				t.Errorf("page doesn't contain %q\n%s", want, body)
+			}
+		}
+		if strings.Contains(string(body), "unrelated") {
+			t.Errorf("page includes a namespace outside the name prefix\n%s", body)
+		}
+	})
+}
@@ -0,0 +1,499 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/apparentlymart/go-versions/versions"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/cache"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/logging"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// registryProtocolPath is the path under a provider registry service's base
+// path where the provider registry protocol's endpoints live, and so is
+// what the service's "providers.v1" discovery entry should refer to.
+const registryProtocolPath = "v1/providers/"
+
+// protocolsAnnotation is the manifest annotation that lists the Terraform
+// plugin protocol versions that a provider release supports, like "5.0",
+// separated by commas.
+const protocolsAnnotation = "io.terraform.plugin-protocols"
+
+// registryPlatform is a platform as described in the provider registry
+// protocol's responses.
+type registryPlatform struct {
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+}
+
+// registrySigningKeys is the "signing_keys" property of a download response
+// in the provider registry protocol, which gives the keys that Terraform
+// should accept signatures of the SHA256SUMS document from.
+type registrySigningKeys struct {
+	GPGPublicKeys []registryGPGPublicKey `json:"gpg_public_keys"`
+}
+
+type registryGPGPublicKey struct {
+	KeyID      string `json:"key_id"`
+	ASCIIArmor string `json:"ascii_armor"`
+}
+
+// newRegistrySigningKeys returns the description of the public part of the
+// given key for use in download responses.
+func newRegistrySigningKeys(key *openpgp.Entity) (registrySigningKeys, error) {
+	if key == nil {
+		return registrySigningKeys{}, fmt.Errorf("no signing key is configured")
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return registrySigningKeys{}, err
+	}
+	if err := key.Serialize(w); err != nil {
+		return registrySigningKeys{}, err
+	}
+	if err := w.Close(); err != nil {
+		return registrySigningKeys{}, err
+	}
+	return registrySigningKeys{
+		GPGPublicKeys: []registryGPGPublicKey{
+			{
+				KeyID:      fmt.Sprintf("%016X", key.PrimaryKey.KeyId),
+				ASCIIArmor: buf.String(),
+			},
+		},
+	}, nil
+}
+
+// providerRegistryHandler returns the base path and handler for a service
+// that serves the provider registry protocol from the same kind of origin
+// registry layout as a provider mirror.
+//
+// Unlike a mirror, a registry doesn't proxy packages: its download
+// responses refer clients directly to the origin registry's blobs. It does
+// serve the SHA256SUMS documents that describe them, signed with the
+// service's own signing key.
+func providerRegistryHandler(cfg *config.ProviderRegistry, shared *sharedState) (string, func(resp http.ResponseWriter, req *http.Request)) {
+	serviceName := cfg.Name
+	prefix := "/" + serviceName + "/"
+
+	// serviceBase is the base URL for any links to this service that we
+	// generate in responses, which Terraform resolves relative to the URL
+	// of the response.
+	serviceBase := &url.URL{Path: prefix + registryProtocolPath}
+
+	ociClient := newRegistryServiceClient("provider registry", serviceName, cfg.OriginURL, cfg.Backend, shared)
+	shared.addBackendProbe(serviceName, ociClient.CheckAPISupport)
+
+	jsonOpts := jsonResponseOptions{
+		headContentLength: true,
+		gzip:              shared.config.GzipResponses,
+		gzipLevel:         shared.config.CompressionLevel,
+	}
+	layerPolicy := packageLayerPolicy{
+		// The registry protocol can describe only zip archives.
+		MediaTypes:         []string{providerPackageMediaType},
+		TrustedAlgorithms:  shared.config.TrustedDigestAlgorithms,
+		DuplicatePlatforms: config.DuplicatePlatformsLowestDigest,
+		MaxPlatforms:       config.DefaultMaxPlatforms,
+	}
+
+	manifestCache := cache.New[string, *ocidist.Manifest](cfg.CacheTTL, cfg.CacheMaxStale)
+
+	// Every download response offers the same signing key, so we prepare
+	// its description only once.
+	signingKeys, signingKeysErr := newRegistrySigningKeys(cfg.SigningKey)
+
+	// getRelease fetches the manifest for the given version tag and selects
+	// the package layer to offer for each platform.
+	getRelease := func(ctx context.Context, logger *logging.Logger, nsAddr ocidist.Namespace, tag ocidist.Reference, authHeader string) (*ocidist.Manifest, map[string]ocidist.ObjectMeta, cache.Status, error) {
+		cacheKey := metadataCacheKey(nsAddr.String()+":"+tag.String(), authHeader)
+		manifest, cacheStatus, err := timedCacheGet(ctx, manifestCache, cacheKey, func() (*ocidist.Manifest, error) {
+			logger.Printf("fetch layers for %s:%s", nsAddr, tag)
+			return ociClient.GetManifest(ctx, nsAddr, tag)
+		}, backendUnavailable)
+		if err != nil {
+			return nil, nil, cacheStatus, err
+		}
+		if err := checkProviderArtifact(manifest, ""); err != nil {
+			return nil, nil, cacheStatus, fmt.Errorf("artifact %s", err)
+		}
+		layers, err := selectPackageLayers(manifest.Layers, layerPolicy, logger)
+		if err != nil {
+			return nil, nil, cacheStatus, err
+		}
+		return manifest, layers, cacheStatus, nil
+	}
+
+	versionsHandler := func(resp http.ResponseWriter, req *http.Request, logger *logging.Logger, nsAddr ocidist.Namespace) {
+		ctx := contextWithOriginalReq(req.Context(), req)
+		logger.Printf("fetch tags for %s", nsAddr)
+		tags, err := ociClient.GetNamespaceTags(ctx, nsAddr)
+		if err != nil {
+			propagateOCIDistError(err, resp, logger)
+			return
+		}
+
+		type RespVersion struct {
+			Version   string             `json:"version"`
+			Protocols []string           `json:"protocols"`
+			Platforms []registryPlatform `json:"platforms"`
+		}
+		type RespJSON struct {
+			Versions []RespVersion `json:"versions"`
+		}
+		respJSON := RespJSON{Versions: []RespVersion{}}
+		versionTags := make(map[versions.Version]ocidist.Reference)
+		var versionList versions.List
+		for _, tag := range tags {
+			v, err := versions.ParseVersion(tag.String())
+			if err != nil {
+				continue // Ignore tags that aren't version numbers
+			}
+			versionTags[v] = tag
+			versionList = append(versionList, v)
+		}
+		versionList.Sort()
+
+		// The registry protocol requires the platforms of each version in
+		// the version list, so unlike the mirror protocol we need every
+		// version's manifest here.
+		type release struct {
+			manifest *ocidist.Manifest
+			layers   map[string]ocidist.ObjectMeta
+			stale    bool
+		}
+		authHeader := req.Header.Get("authorization")
+		releases, errs := fetchConcurrently(versionList, maxConcurrentManifestFetches, func(v versions.Version) (release, error) {
+			manifest, layers, cacheStatus, err := getRelease(ctx, logger, nsAddr, versionTags[v], authHeader)
+			return release{manifest: manifest, layers: layers, stale: cacheStatus == cache.Stale}, err
+		})
+		stale := false
+		for i, v := range versionList {
+			tag := versionTags[v]
+			manifest, layers, err := releases[i].manifest, releases[i].layers, errs[i]
+			stale = stale || releases[i].stale
+			if _, ok := err.(ocidist.NotFoundError); ok {
+				continue // tag was presumably deleted after we listed it
+			}
+			if err == ocidist.ErrImageIndex {
+				logger.Printf("ignoring %s:%s because it is an image index", nsAddr, tag)
+				continue
+			}
+			if err != nil && (backendUnavailable(err) || err == ocidist.ErrUnauthorized) {
+				propagateOCIDistError(err, resp, logger)
+				return
+			}
+			if err != nil {
+				// A broken release shouldn't hide all of the others.
+				logger.Warnf("ignoring %s:%s: %s", nsAddr, tag, err)
+				continue
+			}
+			protocols, err := parseProtocolsAnnotation(manifest.Annotations)
+			if err != nil {
+				logger.Warnf("ignoring %s annotation of %s:%s: %s", protocolsAnnotation, nsAddr, tag, err)
+			}
+			respJSON.Versions = append(respJSON.Versions, RespVersion{
+				Version:   v.String(),
+				Protocols: protocols,
+				Platforms: registryPlatforms(layers),
+			})
+		}
+		if stale {
+			logger.Printf("origin registry is unavailable, so serving stale manifests for %s", nsAddr)
+			markStaleResponse(resp)
+		}
+		writeJSONResponse(resp, req, respJSON, jsonOpts, logger)
+	}
+
+	releaseHandler := func(resp http.ResponseWriter, req *http.Request, logger *logging.Logger, addrParts []string, nsAddr ocidist.Namespace, remainParts []string) {
+		version, err := versions.ParseVersion(remainParts[0])
+		if err != nil {
+			logger.Printf("unsupported version %q for %s", remainParts[0], nsAddr)
+			resp.WriteHeader(404)
+			return
+		}
+		tag, err := ocidist.ParseReference(version.String())
+		if err != nil {
+			logger.Printf("version %s for %s uses version syntax that isn't valid OCI Distribution ref syntax", version, nsAddr)
+			resp.WriteHeader(404)
+			return
+		}
+		ctx := contextWithOriginalReq(req.Context(), req)
+		manifest, layers, cacheStatus, err := getRelease(ctx, logger, nsAddr, tag, req.Header.Get("authorization"))
+		if _, ok := err.(ocidist.NotFoundError); ok || err == ocidist.ErrImageIndex {
+			resp.WriteHeader(404)
+			return
+		}
+		if err != nil && (backendUnavailable(err) || err == ocidist.ErrUnauthorized) {
+			propagateOCIDistError(err, resp, logger)
+			return
+		}
+		if err != nil {
+			logger.Errorf("invalid manifest for %s:%s: %s", nsAddr, tag, err)
+			resp.WriteHeader(502)
+			return
+		}
+		if cacheStatus == cache.Stale {
+			logger.Printf("origin registry is unavailable, so serving a stale manifest for %s:%s", nsAddr, tag)
+			markStaleResponse(resp)
+		}
+
+		if len(remainParts) == 2 {
+			doc, err := shasumsDocument(addrParts[1], version, layers)
+			if err != nil {
+				logger.Errorf("can't describe the packages of %s:%s: %s", nsAddr, tag, err)
+				resp.WriteHeader(502)
+				return
+			}
+			contentType := "text/plain; charset=utf-8"
+			if remainParts[1] == "shasums.sig" {
+				// The signature covers the document exactly as we'd
+				// serve it from the neighboring "shasums" URL.
+				var sig bytes.Buffer
+				if err := openpgp.DetachSign(&sig, cfg.SigningKey, bytes.NewReader(doc), nil); err != nil {
+					logger.Errorf("can't sign the SHA256SUMS document for %s:%s: %s", nsAddr, tag, err)
+					resp.WriteHeader(500)
+					return
+				}
+				doc = sig.Bytes()
+				contentType = "application/octet-stream"
+			}
+			resp.Header().Set("Content-Type", contentType)
+			resp.Header().Set("Content-Length", strconv.Itoa(len(doc)))
+			resp.WriteHeader(200)
+			resp.Write(doc)
+			return
+		}
+
+		platform := remainParts[2] + "_" + remainParts[3]
+		meta, ok := layers[platform]
+		if !ok {
+			logger.Printf("no %s package for %s:%s", platform, nsAddr, tag)
+			resp.WriteHeader(404)
+			return
+		}
+		if algo := meta.Digest.Algorithm(); algo != "sha256" {
+			// The registry protocol describes packages only by their
+			// SHA-256 checksums.
+			logger.Errorf("can't offer %s package for %s:%s because it has a %s digest", platform, nsAddr, tag, algo)
+			resp.WriteHeader(502)
+			return
+		}
+		if signingKeysErr != nil {
+			logger.Errorf("can't offer the signing key: %s", signingKeysErr)
+			resp.WriteHeader(500)
+			return
+		}
+		protocols, err := parseProtocolsAnnotation(manifest.Annotations)
+		if err != nil {
+			logger.Warnf("ignoring %s annotation of %s:%s: %s", protocolsAnnotation, nsAddr, tag, err)
+		}
+
+		type RespJSON struct {
+			Protocols   []string `json:"protocols"`
+			OS          string   `json:"os"`
+			Arch        string   `json:"arch"`
+			Filename    string   `json:"filename"`
+			DownloadURL string   `json:"download_url"`
+			ShasumsURL  string   `json:"shasums_url"`
+			Shasum      string   `json:"shasum"`
+
+			ShasumsSignatureURL string              `json:"shasums_signature_url"`
+			SigningKeys         registrySigningKeys `json:"signing_keys"`
+		}
+		respJSON := RespJSON{
+			Protocols:   protocols,
+			OS:          remainParts[2],
+			Arch:        remainParts[3],
+			Filename:    packageFilename(addrParts[1], version, platform),
+			DownloadURL: ociClient.BlobURL(nsAddr, meta.Digest).String(),
+			ShasumsURL:  serviceBase.JoinPath(addrParts[0], addrParts[1], version.String(), "shasums").String(),
+			Shasum:      meta.Digest.Encoded(),
+
+			ShasumsSignatureURL: serviceBase.JoinPath(addrParts[0], addrParts[1], version.String(), "shasums.sig").String(),
+			SigningKeys:         signingKeys,
+		}
+		writeJSONResponse(resp, req, respJSON, jsonOpts, logger)
+	}
+
+	return prefix, func(resp http.ResponseWriter, req *http.Request) {
+		if shared.config.LogServiceNames {
+			req = req.WithContext(logging.ContextWithLoggerPrefix(req.Context(), "["+serviceName+"] "))
+		}
+		urlNoQuery := *req.URL
+		urlNoQuery.RawQuery = ""
+		logger, done := logging.ContextLoggerRequest(req.Context(), "request to provider registry: %s", &urlNoQuery)
+		defer done()
+
+		path, err := normalizeRequestPath(req.URL.EscapedPath())
+		if err != nil {
+			logger.Printf("rejecting request path: %s", err)
+			writeTextResponse(resp, 400, "Invalid request path: "+err.Error()+".\n")
+			return
+		}
+		// The first part is always empty and the second is the service
+		// name, so the protocol's paths begin at the third.
+		pathParts := strings.Split(path, "/")
+		if len(pathParts) < 7 || pathParts[2]+"/"+pathParts[3]+"/" != registryProtocolPath {
+			resp.WriteHeader(404)
+			return
+		}
+
+		// A registry's provider addresses don't include a hostname, but
+		// normalizeProviderAddr expects the first segment to be one.
+		addrParts, err := normalizeProviderAddr(append([]string{""}, pathParts[4:6]...))
+		if err != nil {
+			logger.Printf("invalid provider address: %s", err)
+			resp.WriteHeader(404)
+			return
+		}
+		addrParts = addrParts[1:]
+		nsAddr, err := ociDistNamespaceFromPathSegments(cfg.NamePrefix, addrParts)
+		if err != nil {
+			logger.Printf("unsupported provider address: %s", err)
+			resp.WriteHeader(404)
+			return
+		}
+
+		remainParts := pathParts[6:]
+		switch {
+		case len(remainParts) == 1 && remainParts[0] == "versions":
+			versionsHandler(resp, req, logger, nsAddr)
+		case len(remainParts) == 2 && (remainParts[1] == "shasums" || remainParts[1] == "shasums.sig"):
+			releaseHandler(resp, req, logger, addrParts, nsAddr, remainParts)
+		case len(remainParts) == 4 && remainParts[1] == "download":
+			releaseHandler(resp, req, logger, addrParts, nsAddr, remainParts)
+		default:
+			resp.WriteHeader(404)
+		}
+	}
+}
+
+// maxConcurrentManifestFetches is the maximum number of manifests that a
+// registry service fetches concurrently on behalf of a single client
+// request.
+const maxConcurrentManifestFetches = 4
+
+// fetchConcurrently calls fetch for each of the given items, making up to
+// limit calls concurrently, and returns the results and errors of the calls
+// in the same order as the items.
+func fetchConcurrently[T, R any](items []T, limit int, fetch func(T) (R, error)) ([]R, []error) {
+	results := make([]R, len(items))
+	errs := make([]error, len(items))
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i, item := range items {
+		i, item := i, item
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			// Each call writes only its own elements, so there's no need
+			// for a lock.
+			results[i], errs[i] = fetch(item)
+		}()
+	}
+	wg.Wait()
+	return results, errs
+}
+
+// newRegistryServiceClient returns a client for the origin registry of a
+// registry service of the given kind and name, which passes through the
+// Authorization header of the client request that each backend request is
+// made on behalf of.
+//
+// This is simpler than a provider mirror's client, because registry
+// services don't support all of the mirror's backend options.
+func newRegistryServiceClient(kind, serviceName string, originURL *url.URL, backend config.BackendPolicy, shared *sharedState) *ocidist.Client {
+	var transport http.RoundTripper = http.DefaultTransport
+	if breaker := shared.breakerFor(originURL.Host); breaker != nil {
+		transport = &breakerTransport{
+			breaker: breaker,
+			next:    transport,
+			host:    originURL.Host,
+		}
+	}
+	ociClient := ocidist.NewClientWithRoundTripper(originURL, transport)
+	ociClient.SetTimeout(backend.Timeout)
+	ociClient.SetMaxConcurrency(backend.MaxConcurrency)
+	ociClient.SetBlobIdleTimeout(backend.IdleTimeout)
+	ociClient.SetTrustedDigestAlgorithms(shared.config.TrustedDigestAlgorithms)
+	ociClient.SetRetryPolicy(ocidist.RetryPolicy{
+		MaxAttempts: backend.RetryAttempts,
+		BaseDelay:   backend.RetryDelay,
+	})
+	userAgent := fmt.Sprintf("oci-distribution-terraform-registry (%s %q)", kind, serviceName)
+	ociClient.AddPrepareRequest(func(req *http.Request) error {
+		req.Header.Set("User-Agent", userAgent)
+
+		ctx := req.Context()
+		logging.ContextLogger(ctx).Debugf("origin registry request: %s %s", req.Method, req.URL.Redacted())
+		if originalReq := contextOriginalReq(ctx); originalReq != nil {
+			if a := originalReq.Header.Get("authorization"); a != "" {
+				// Pass through the Authorization header to the backend.
+				req.Header.Set("Authorization", a)
+			}
+		}
+		return nil
+	})
+	return ociClient
+}
+
+// parseProtocolsAnnotation returns the plugin protocol versions listed in
+// the [protocolsAnnotation] of the given manifest annotations, or an empty
+// list if there is no such annotation. Terraform assumes that a provider
+// release with no protocols listed is compatible.
+func parseProtocolsAnnotation(annotations map[string]any) ([]string, error) {
+	raw, exists := annotations[protocolsAnnotation]
+	if !exists {
+		return []string{}, nil
+	}
+	str, ok := raw.(string)
+	if !ok {
+		return []string{}, fmt.Errorf("must be a string, not %T", raw)
+	}
+	ret := strings.Split(str, ",")
+	for _, protocol := range ret {
+		if !protocolVersionRe.MatchString(protocol) {
+			return []string{}, fmt.Errorf("invalid protocol version %q", protocol)
+		}
+	}
+	return ret, nil
+}
+
+// protocolVersionRe matches a plugin protocol version, like "5" or "5.0".
+var protocolVersionRe = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// registryPlatforms returns the platforms of the given package layers, as
+// returned by [selectPackageLayers], sorted by operating system and then
+// architecture.
+func registryPlatforms(layers map[string]ocidist.ObjectMeta) []registryPlatform {
+	ret := make([]registryPlatform, 0, len(layers))
+	for platform := range layers {
+		os, arch, _ := strings.Cut(platform, "_")
+		ret = append(ret, registryPlatform{OS: os, Arch: arch})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].OS != ret[j].OS {
+			return ret[i].OS < ret[j].OS
+		}
+		return ret[i].Arch < ret[j].Arch
+	})
+	return ret
+}
@@ -0,0 +1,340 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func TestProviderRegistry(t *testing.T) {
+	registry := newFakeRegistry()
+	linuxDigest := registry.addBlob("terraform-providers/foo/bar", []byte("linux package"))
+	darwinDigest := registry.addBlob("terraform-providers/foo/bar", []byte("darwin package"))
+	v2 := testProviderManifest(
+		ocidist.ObjectMeta{
+			MediaType:   providerPackageMediaType,
+			Digest:      linuxDigest,
+			Annotations: map[string]any{platformsAnnotation: "linux_amd64,linux_arm64"},
+		},
+		ocidist.ObjectMeta{
+			MediaType:   providerPackageMediaType,
+			Digest:      darwinDigest,
+			Annotations: map[string]any{platformsAnnotation: "darwin_arm64"},
+		},
+	)
+	v2.Annotations = map[string]any{protocolsAnnotation: "5.0,6.0"}
+	registry.addManifest("terraform-providers/foo/bar", "2.0.0", v2)
+	registry.addManifest("terraform-providers/foo/bar", "1.0.0", testProviderManifest(ocidist.ObjectMeta{
+		MediaType:   providerPackageMediaType,
+		Digest:      linuxDigest,
+		Annotations: map[string]any{platformsAnnotation: "linux_amd64"},
+	}))
+	registry.addManifest("terraform-providers/foo/bar", "latest", v2)
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	originURL, err := url.Parse(registryServer.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	signingKey := newTestSigningKey(t)
+	mux.HandleFunc(providerRegistryHandler(&config.ProviderRegistry{
+		Name:       "registry",
+		OriginURL:  originURL,
+		NamePrefix: ocidist.MustParseNamespace("terraform-providers"),
+		SigningKey: signingKey,
+	}, newTestSharedState()))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	base := server.URL + "/registry/v1/providers/"
+
+	t.Run("versions", func(t *testing.T) {
+		var got any
+		if status := getJSON(t, base+"Foo/bar/versions", &got); status != 200 {
+			t.Fatalf("wrong status %d", status)
+		}
+		want := map[string]any{
+			"versions": []any{
+				map[string]any{
+					"version":   "1.0.0",
+					"protocols": []any{},
+					"platforms": []any{
+						map[string]any{"os": "linux", "arch": "amd64"},
+					},
+				},
+				map[string]any{
+					"version":   "2.0.0",
+					"protocols": []any{"5.0", "6.0"},
+					"platforms": []any{
+						map[string]any{"os": "darwin", "arch": "arm64"},
+						map[string]any{"os": "linux", "arch": "amd64"},
+						map[string]any{"os": "linux", "arch": "arm64"},
+					},
+				},
+			},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("wrong response\n%s", diff)
+		}
+	})
+
+	t.Run("download", func(t *testing.T) {
+		var got any
+		if status := getJSON(t, base+"foo/bar/2.0.0/download/linux/arm64", &got); status != 200 {
+			t.Fatalf("wrong status %d", status)
+		}
+		var publicKey bytes.Buffer
+		w, err := armor.Encode(&publicKey, openpgp.PublicKeyType, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := signingKey.Serialize(w); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		want := map[string]any{
+			"protocols":             []any{"5.0", "6.0"},
+			"os":                    "linux",
+			"arch":                  "arm64",
+			"filename":              "terraform-provider-bar_2.0.0_linux_arm64.zip",
+			"download_url":          registryServer.URL + "/v2/terraform-providers/foo/bar/blobs/" + linuxDigest.String(),
+			"shasums_url":           "/registry/v1/providers/foo/bar/2.0.0/shasums",
+			"shasums_signature_url": "/registry/v1/providers/foo/bar/2.0.0/shasums.sig",
+			"shasum":                linuxDigest.Encoded(),
+			"signing_keys": map[string]any{
+				"gpg_public_keys": []any{
+					map[string]any{
+						"key_id":      fmt.Sprintf("%016X", signingKey.PrimaryKey.KeyId),
+						"ascii_armor": publicKey.String(),
+					},
+				},
+			},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("wrong response\n%s", diff)
+		}
+	})
+
+	t.Run("shasums signature", func(t *testing.T) {
+		get := func(path string) []byte {
+			t.Helper()
+			resp, err := http.Get(base + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != 200 {
+				t.Fatalf("wrong status %d for %s", resp.StatusCode, path)
+			}
+			return body
+		}
+		doc := get("foo/bar/2.0.0/shasums")
+		sig := get("foo/bar/2.0.0/shasums.sig")
+
+		// Terraform verifies the signature using only the public key from
+		// the download response.
+		keyring := openpgp.EntityList{{PrimaryKey: signingKey.PrimaryKey, Identities: signingKey.Identities}}
+		signer, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(doc), bytes.NewReader(sig))
+		if err != nil {
+			t.Fatalf("invalid signature: %s", err)
+		}
+		if got, want := signer.PrimaryKey.KeyId, signingKey.PrimaryKey.KeyId; got != want {
+			t.Errorf("signed by %016X; want %016X", got, want)
+		}
+	})
+
+	t.Run("shasums", func(t *testing.T) {
+		resp, err := http.Get(base + "foo/bar/2.0.0/shasums")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("wrong status %d", resp.StatusCode)
+		}
+		want := darwinDigest.Encoded() + "  terraform-provider-bar_2.0.0_darwin_arm64.zip\n" +
+			linuxDigest.Encoded() + "  terraform-provider-bar_2.0.0_linux_amd64.zip\n" +
+			linuxDigest.Encoded() + "  terraform-provider-bar_2.0.0_linux_arm64.zip\n"
+		if diff := cmp.Diff(want, string(body)); diff != "" {
+			t.Errorf("wrong document\n%s", diff)
+		}
+	})
+
+	for _, path := range []string{
+		"foo/bar/1.0.0/download/darwin/arm64",
+		"foo/bar/3.0.0/download/linux/amd64",
+		"foo/baz/versions",
+		"foo/bar/index.json",
+		"example.com/foo/bar/versions",
+	} {
+		var got any
+		if status := getJSON(t, base+path, &got); status != 404 {
+			t.Errorf("wrong status %d for %s; want 404", status, path)
+		}
+	}
+}
+
+func TestProviderRegistryManifestFetches(t *testing.T) {
+	registry := newFakeRegistry()
+	digest := registry.addBlob("terraform-providers/foo/bar", []byte("linux package"))
+	for i := 0; i < 10; i++ {
+		registry.addManifest("terraform-providers/foo/bar", fmt.Sprintf("1.%d.0", i), testProviderManifest(ocidist.ObjectMeta{
+			MediaType:   providerPackageMediaType,
+			Digest:      digest,
+			Annotations: map[string]any{platformsAnnotation: "linux_amd64"},
+		}))
+	}
+	var manifestRequests, inFlight, maxInFlight int64
+	registryServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.Path, "/manifests/") {
+			atomic.AddInt64(&manifestRequests, 1)
+			n := atomic.AddInt64(&inFlight, 1)
+			defer atomic.AddInt64(&inFlight, -1)
+			for {
+				prev := atomic.LoadInt64(&maxInFlight)
+				if n <= prev || atomic.CompareAndSwapInt64(&maxInFlight, prev, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		registry.ServeHTTP(resp, req)
+	}))
+	defer registryServer.Close()
+
+	originURL, err := url.Parse(registryServer.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(providerRegistryHandler(&config.ProviderRegistry{
+		Name:       "registry",
+		OriginURL:  originURL,
+		NamePrefix: ocidist.MustParseNamespace("terraform-providers"),
+		CacheTTL:   time.Hour,
+		SigningKey: newTestSigningKey(t),
+	}, newTestSharedState()))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		var got struct {
+			Versions []struct {
+				Version string `json:"version"`
+			} `json:"versions"`
+		}
+		if status := getJSON(t, server.URL+"/registry/v1/providers/foo/bar/versions", &got); status != 200 {
+			t.Fatalf("wrong status %d", status)
+		}
+		if got, want := len(got.Versions), 10; got != want {
+			t.Fatalf("wrong number of versions %d; want %d", got, want)
+		}
+	}
+	// The second response comes entirely from the cache.
+	if got, want := atomic.LoadInt64(&manifestRequests), int64(10); got != want {
+		t.Errorf("wrong number of manifest requests %d; want %d", got, want)
+	}
+	if got := atomic.LoadInt64(&maxInFlight); got > maxConcurrentManifestFetches {
+		t.Errorf("made %d manifest requests at once; want at most %d", got, maxConcurrentManifestFetches)
+	}
+}
+
+func TestProviderRegistryNoSigningKey(t *testing.T) {
+	registry := newFakeRegistry()
+	digest := registry.addBlob("terraform-providers/foo/bar", []byte("linux package"))
+	registry.addManifest("terraform-providers/foo/bar", "1.0.0", testProviderManifest(ocidist.ObjectMeta{
+		MediaType:   providerPackageMediaType,
+		Digest:      digest,
+		Annotations: map[string]any{platformsAnnotation: "linux_amd64"},
+	}))
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	originURL, err := url.Parse(registryServer.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(providerRegistryHandler(&config.ProviderRegistry{
+		Name:       "registry",
+		OriginURL:  originURL,
+		NamePrefix: ocidist.MustParseNamespace("terraform-providers"),
+	}, newTestSharedState()))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// A download response without the signing key would be useless to
+	// Terraform, so the server reports an error instead.
+	var got any
+	if status := getJSON(t, server.URL+"/registry/v1/providers/foo/bar/1.0.0/download/linux/amd64", &got); status != 500 {
+		t.Errorf("wrong status %d; want 500", status)
+	}
+}
+
+// newTestSigningKey generates a new OpenPGP key for a provider registry
+// service to sign its SHA256SUMS documents with.
+func newTestSigningKey(t *testing.T) *openpgp.Entity {
+	t.Helper()
+	key, err := openpgp.NewEntity("Test", "", "test@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestFetchConcurrently(t *testing.T) {
+	items := []int{1, 2, 3, 4, 5, 6, 7, 8}
+	var inFlight, maxInFlight int64
+	results, errs := fetchConcurrently(items, 3, func(n int) (int, error) {
+		cur := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		for {
+			prev := atomic.LoadInt64(&maxInFlight)
+			if cur <= prev || atomic.CompareAndSwapInt64(&maxInFlight, prev, cur) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		if n%4 == 0 {
+			return 0, fmt.Errorf("no %d", n)
+		}
+		return n * 10, nil
+	})
+	for i, n := range items {
+		if n%4 == 0 {
+			if errs[i] == nil {
+				t.Errorf("no error for %d", n)
+			}
+			continue
+		}
+		if errs[i] != nil || results[i] != n*10 {
+			t.Errorf("wrong result (%d, %v) for %d; want (%d, nil)", results[i], errs[i], n, n*10)
+		}
+	}
+	if got := atomic.LoadInt64(&maxInFlight); got > 3 {
+		t.Errorf("made %d calls at once; want at most 3", got)
+	}
+}
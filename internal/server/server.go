@@ -3,21 +3,34 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net"
 	"net/http"
 	"net/textproto"
 	"net/url"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/apparentlymart/go-versions/versions"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/cache"
 	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/diskcache"
 	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/logging"
 	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
 	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/querysecret"
@@ -30,23 +43,111 @@ func Run(ctx context.Context, config *config.Config) error {
 	// enabled.
 	var secreter *querysecret.Secreter
 	if config.Server.QueryStringSecret != nil {
-		secreter = querysecret.NewSecreter(*config.Server.QueryStringSecret)
+		var err error
+		secreter, err = querysecret.NewSecreterWithCipher(config.Server.QueryStringCipher, config.Server.QueryStringSecret, rand.Reader)
+		if err != nil {
+			return fmt.Errorf("query string secret is unusable: %w", err)
+		}
+		secreter.SetMaxLifetime(config.Server.DownloadTokenMaxLifetime)
+		secreter.SetGracePeriod(config.Server.DownloadTokenGracePeriod)
+		// We'll fail early if the secret can't actually be used, rather
+		// than waiting until a client first needs a download URL.
+		if err := checkSecreter(secreter); err != nil {
+			return fmt.Errorf("query string secret is unusable: %w", err)
+		}
+	}
+
+	shared := &sharedState{
+		config:          config.Server,
+		secreter:        secreter,
+		downloadLimiter: newClientLimiter(config.Server.MaxDownloadsPerClient),
+		breakers:        make(map[string]*circuitBreaker),
+	}
+	if config.Server.TokenAlertThreshold != 0 {
+		shared.tokenAlarm = newTokenFailureAlarm(config.Server.TokenAlertThreshold, config.Server.TokenAlertWindow)
+	}
+	if config.Server.AuditLog != nil {
+		f, err := os.OpenFile(config.Server.AuditLog.Filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open audit log: %w", err)
+		}
+		defer f.Close()
+		shared.auditLog = logging.NewAuditLog(f, config.Server.AuditLog.MaxEventsPerSecond)
+	}
+
+	for _, mirrorSvc := range config.ProviderMirrors {
+		if mirrorSvc.PackageCacheDir == "" {
+			continue
+		}
+		// Opening the cache indexes the packages that an earlier process
+		// left in it, so they're available immediately after a restart.
+		pkgCache, err := diskcache.Open(mirrorSvc.PackageCacheDir, config.Server.TrustedDigestAlgorithms)
+		if err != nil {
+			return fmt.Errorf("failed to open package cache for %q: %w", mirrorSvc.Name, err)
+		}
+		if shared.packageCaches == nil {
+			shared.packageCaches = make(map[string]*diskcache.Cache)
+		}
+		shared.packageCaches[mirrorSvc.Name] = pkgCache
+		log.Printf("package cache for %q has %d packages", mirrorSvc.Name, pkgCache.Len())
 	}
 
+	log.Printf("configured %s", describeServiceCounts(config.ServiceCounts()))
 	mux := http.NewServeMux()
 
 	for _, mirrorSvc := range config.ProviderMirrors {
-		mux.HandleFunc(providerMirrorHandler(mirrorSvc, secreter))
+		mux.HandleFunc(providerMirrorHandler(mirrorSvc, shared))
+	}
+	for _, registrySvc := range config.ProviderRegistries {
+		mux.HandleFunc(providerRegistryHandler(registrySvc, shared))
+	}
+	for _, registrySvc := range config.ModuleRegistries {
+		mux.HandleFunc(moduleRegistryHandler(registrySvc, shared))
+	}
+	if config.Server.MetricsPath != "" {
+		mux.Handle(config.Server.MetricsPath, expvar.Handler())
+	}
+	if config.Server.DescriptionPath != "" {
+		mux.Handle(config.Server.DescriptionPath, descriptionHandler(config))
+	}
+	if config.Server.CapabilitiesPath != "" {
+		mux.Handle(config.Server.CapabilitiesPath, capabilitiesHandler(shared.capabilityProbes, config.Server.CapabilitiesTTL))
+	}
+	if config.Server.ReadinessPath != "" {
+		mux.Handle(config.Server.ReadinessPath, readinessHandler(&shared.shuttingDown, readinessAlarm(shared)))
+	}
+	if doc := discoveryDocument(config); doc != nil {
+		mux.Handle(discoveryPath, discoveryHandler(doc))
 	}
 
+	if timeout := config.Server.StartupProbeTimeout; timeout > 0 && len(shared.backendProbes) != 0 {
+		// The server starts even if some origin registries are unavailable,
+		// because they might recover later and the other services are
+		// still useful in the meantime.
+		start := time.Now()
+		failures := probeBackends(ctx, shared.backendProbes, config.Server.StartupProbeConcurrency, timeout)
+		if len(failures) != 0 {
+			logging.ContextLogger(ctx).Warnf("%s", describeProbeFailures(failures))
+		}
+		log.Printf("checked %d origin registries in %s", len(shared.backendProbes), time.Since(start).Round(time.Millisecond))
+	}
+
+	handler := withServerTiming(mux, config.Server.ServerTiming)
+	handler = withErrorPages(handler, config.Server.ErrorPages)
+	handler = withAuditLog(handler, shared.auditLog, config.Server.ClientIPv6PrefixLength)
+	handler = withBackpressure(handler, config.Server.BackpressureThreshold, config.Server.BackpressureMaxDelay)
+	handler = withAccessLog(countRequestOutcomes(handler), config.Server.LogFormat, log.Writer())
+
 	httpServer := &http.Server{
 		Addr:    config.Server.ListenAddr,
-		Handler: mux,
+		Handler: handler,
+		// Requests don't inherit ctx, because its cancellation only begins
+		// the shutdown; drainServer lets in-progress requests finish.
 		BaseContext: func(l net.Listener) context.Context {
-			return ctx
+			return context.Background()
 		},
 		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
-			ctx = context.WithValue(ctx, remoteAddrContextKey, c.RemoteAddr())
+			ctx = contextWithRemoteAddr(ctx, c.RemoteAddr())
 			logPrefix := fmt.Sprintf("[%s] ", c.RemoteAddr())
 			logger := log.New(log.Writer(), logPrefix, log.Ldate|log.Ltime|log.LUTC|log.Lmsgprefix)
 			return logging.ContextWithLogger(ctx, logger)
@@ -65,83 +166,636 @@ func Run(ctx context.Context, config *config.Config) error {
 	go func() {
 		httpServer.ListenAndServe()
 	}()
+	for _, task := range shared.startupTasks {
+		go task(ctx)
+	}
 
 	<-ctx.Done()
 	log.Printf("server shutting down")
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	return httpServer.Shutdown(shutdownCtx)
+	return drainServer(httpServer, &shared.downloads, &shared.shuttingDown, config.Server.ShutdownDelay, config.Server.ShutdownTimeout, time.Second)
+}
+
+// describeServiceCounts returns a summary of the given numbers of services
+// of each type, like "3 services (2 provider_mirror, 1 other)", for logging
+// at startup.
+func describeServiceCounts(counts map[string]int) string {
+	types := make([]string, 0, len(counts))
+	total := 0
+	for ty, count := range counts {
+		types = append(types, ty)
+		total += count
+	}
+	sort.Strings(types)
+	parts := make([]string, len(types))
+	for i, ty := range types {
+		parts[i] = fmt.Sprintf("%d %s", counts[ty], ty)
+	}
+	noun := "services"
+	if total == 1 {
+		noun = "service"
+	}
+	return fmt.Sprintf("%d %s (%s)", total, noun, strings.Join(parts, ", "))
+}
+
+// checkSecreter makes sure that the given secreter can wrap a message and
+// then unwrap it again to produce the original message.
+func checkSecreter(secreter *querysecret.Secreter) error {
+	want := []byte("self-test")
+	wrapped, err := secreter.Wrap(want)
+	if err != nil {
+		return err
+	}
+	got, err := secreter.Unwrap(wrapped)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("unwrapped message does not match the original")
+	}
+	return nil
+}
+
+// isOriginHost returns true if the given host is that of the given
+// service's origin registry or its fallback.
+func isOriginHost(cfg *config.ProviderMirror, host string) bool {
+	if host == cfg.OriginURL.Host {
+		return true
+	}
+	return cfg.FallbackOriginURL != nil && host == cfg.FallbackOriginURL.Host
+}
+
+// sharedState is the configuration and other objects shared between all of
+// the services in a server.
+type sharedState struct {
+	config *config.Server
+
+	// secreter is nil if the server has no query string secret configured.
+	secreter *querysecret.Secreter
+
+	downloadLimiter *clientLimiter
+
+	// shuttingDown is set once the server begins shutting down, so that the
+	// readiness endpoint can report that it's no longer ready while
+	// in-progress requests complete.
+	shuttingDown atomic.Bool
+
+	// downloads tracks the package downloads in progress, so that shutdown
+	// can report on them.
+	downloads downloadTracker
+
+	// breakers are the circuit breakers for each origin registry host,
+	// created on first use by [sharedState.breakerFor].
+	breakers map[string]*circuitBreaker
+
+	// startupTasks are functions that services register while being set up
+	// which [Run] then starts in the background once the server is ready,
+	// such as warming caches.
+	startupTasks []func(ctx context.Context)
+
+	// capabilityProbes are functions that each service registers while
+	// being set up to probe the capabilities of its origin registry, keyed
+	// by service name.
+	capabilityProbes map[string]capabilityProbe
+
+	// backendProbes are functions that each service registers while being
+	// set up to check that its origin registry is reachable, keyed by
+	// service name, which [Run] calls at startup if the configuration
+	// enables that check.
+	backendProbes map[string]func(context.Context) error
+
+	// auditLog records security-relevant events, or is nil if the server
+	// has no audit log configured.
+	auditLog *logging.AuditLog
+
+	// tokenAlarm watches the rate of rejected download tokens, or is nil if
+	// the server has no alert threshold configured.
+	tokenAlarm *tokenFailureAlarm
+
+	// packageCaches are the on-disk caches of proxied packages for each
+	// provider mirror that has one, keyed by service name.
+	packageCaches map[string]*diskcache.Cache
+}
+
+// addCapabilityProbe registers the function that probes the capabilities of
+// the origin registry for the service with the given name.
+//
+// This is not safe to call concurrently, and so should be called only while
+// setting up the server.
+func (s *sharedState) addCapabilityProbe(serviceName string, probe capabilityProbe) {
+	if s.capabilityProbes == nil {
+		s.capabilityProbes = make(map[string]capabilityProbe)
+	}
+	s.capabilityProbes[serviceName] = probe
+}
+
+// addBackendProbe registers the function that checks whether the origin
+// registry for the service with the given name is reachable.
+//
+// This is not safe to call concurrently, and so should be called only while
+// setting up the server.
+func (s *sharedState) addBackendProbe(serviceName string, probe func(context.Context) error) {
+	if s.backendProbes == nil {
+		s.backendProbes = make(map[string]func(context.Context) error)
+	}
+	s.backendProbes[serviceName] = probe
 }
 
-func providerMirrorHandler(cfg *config.ProviderMirror, secreter *querysecret.Secreter) (string, func(resp http.ResponseWriter, req *http.Request)) {
+// rejectDownloadToken records that a download request for the service with
+// the given name had an invalid token, in the logs, audit log, and metrics,
+// and raises an alert if there have been too many such requests recently.
+func (s *sharedState) rejectDownloadToken(req *http.Request, logger *logging.Logger, serviceName string, rawToken string, err error) {
+	logger.Printf("rejecting download request: %s", err)
+	s.auditLog.Record(clientAuditEvent(req, s.config.ClientIPv6PrefixLength, logging.AuditInvalidDownloadToken, serviceName, err.Error()))
+	downloadTokenRejections.Add(tokenFailureReason(rawToken, err), 1)
+	if failures, alert := s.tokenAlarm.record(); alert {
+		logger.Errorf(
+			"ALERT: rejected %d download tokens within %s, more than the threshold of %d; this may mean that someone is probing download URLs, that servers have different query string secrets, or that a server's clock is wrong",
+			failures, s.config.TokenAlertWindow, s.config.TokenAlertThreshold,
+		)
+		downloadTokenAlerts.Add(1)
+	}
+}
+
+// breakerFor returns the circuit breaker for the given origin registry host,
+// or nil if circuit breakers are disabled.
+//
+// This is not safe to call concurrently, and so should be called only while
+// setting up the server.
+func (s *sharedState) breakerFor(host string) *circuitBreaker {
+	if s.config.BreakerThreshold == 0 {
+		return nil
+	}
+	if b, exists := s.breakers[host]; exists {
+		return b
+	}
+	b := newCircuitBreaker(s.config.BreakerThreshold, s.config.BreakerCooldown)
+	s.breakers[host] = b
+	return b
+}
+
+func providerMirrorHandler(cfg *config.ProviderMirror, shared *sharedState) (string, func(resp http.ResponseWriter, req *http.Request)) {
+	secreter := shared.secreter
 	serviceName := cfg.Name
 	prefix := "/" + serviceName + "/"
 
-	ociClient := ocidist.NewClient(cfg.OriginURL)
+	baseTransport := http.DefaultTransport.(*http.Transport)
+	if cfg.BackendForceHTTP1 {
+		baseTransport = ocidist.NewHTTP1Transport()
+	}
+	if cfg.BackendIPPolicy != nil {
+		baseTransport = ocidist.NewTransportWithIPPolicy(baseTransport, cfg.BackendIPPolicy)
+	}
+	if cfg.BackendTLSSessionCacheSize > 0 || cfg.BackendTLSRenegotiation != tls.RenegotiateNever {
+		baseTransport = ocidist.NewTransportWithTLSOptions(baseTransport, ocidist.TLSClientOptions{
+			SessionCacheSize: cfg.BackendTLSSessionCacheSize,
+			Renegotiation:    cfg.BackendTLSRenegotiation,
+		})
+	}
+	var transport http.RoundTripper = baseTransport
+	withBreaker := func(host string, next http.RoundTripper) http.RoundTripper {
+		if breaker := shared.breakerFor(host); breaker != nil {
+			return &breakerTransport{
+				breaker: breaker,
+				next:    next,
+				host:    host,
+			}
+		}
+		return next
+	}
+	if cfg.FallbackOriginURL != nil {
+		transport = &failoverTransport{
+			primary:      cfg.OriginURL,
+			fallback:     cfg.FallbackOriginURL,
+			primaryNext:  withBreaker(cfg.OriginURL.Host, transport),
+			fallbackNext: withBreaker(cfg.FallbackOriginURL.Host, transport),
+		}
+	} else {
+		transport = withBreaker(cfg.OriginURL.Host, transport)
+	}
+	if shared.auditLog != nil {
+		transport = &auditBackendAuthTransport{
+			auditLog: shared.auditLog,
+			service:  serviceName,
+			next:     transport,
+
+			ipv6PrefixLength: shared.config.ClientIPv6PrefixLength,
+			handshake:        cfg.OriginCredentials != nil,
+		}
+	}
+	ociClient := ocidist.NewClientWithRoundTripper(cfg.OriginURL, transport)
+	if cfg.OriginCredentials != nil {
+		ociClient.SetCredentials(*cfg.OriginCredentials)
+	}
+	ociClient.SetTimeout(cfg.Backend.Timeout)
+	ociClient.SetMaxConcurrency(cfg.Backend.MaxConcurrency)
+	ociClient.SetBlobIdleTimeout(cfg.Backend.IdleTimeout)
+	ociClient.SetRetryPolicy(ocidist.RetryPolicy{
+		MaxAttempts: cfg.Backend.RetryAttempts,
+		BaseDelay:   cfg.Backend.RetryDelay,
+	})
+	ociClient.SetPrefetchPages(cfg.BackendPrefetchPages)
+	ociClient.SetStrictJSON(cfg.BackendStrictJSON)
+	ociClient.SetTrustedDigestAlgorithms(shared.config.TrustedDigestAlgorithms)
+	ociClient.SetVerifyBlobs(cfg.PackageVerification == config.PackageVerificationStreaming || cfg.PackageVerification == config.PackageVerificationBuffered)
 	userAgent := fmt.Sprintf("oci-distribution-terraform-registry (provider mirror %q)", "serviceName")
 	ociClient.AddPrepareRequest(func(req *http.Request) error {
 		req.Header.Set("User-Agent", userAgent)
 
 		ctx := req.Context()
+		logging.ContextLogger(ctx).Debugf("origin registry request: %s %s", req.Method, req.URL.Redacted())
 		originalReq := contextOriginalReq(ctx)
-		if originalReq != nil {
+		if originalReq != nil && cfg.OriginCredentials == nil {
 			if a := originalReq.Header.Get("authorization"); a != "" {
 				// Pass through the Authorization header to the backend.
 				req.Header.Set("Authorization", a)
 			}
 		}
+		if extra := contextBackendQuery(ctx); len(extra) != 0 {
+			query := req.URL.Query()
+			for name, values := range extra {
+				query[name] = values
+			}
+			req.URL.RawQuery = query.Encode()
+		}
 
 		return nil
 	})
 
-	advertiseHandler := func(resp http.ResponseWriter, req *http.Request) {
-		// TODO: A more elaborate page
-		content := "<!DOCTYPE html><html><title>Provider Mirror</title><body>This is a Terraform provider mirror.</body></html>"
-		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
-		resp.Header().Set("Content-Length", strconv.FormatInt(int64(len(content)), 10))
-		resp.WriteHeader(200)
-		resp.Write([]byte(content))
+	// serviceBase is the base URL for any links to this service that we
+	// generate in responses. Unless an external URL is configured, this is
+	// just an absolute path and so the generated links will be relative to
+	// whatever host the client used to reach us.
+	serviceBase := cfg.ExternalURL
+	if serviceBase == nil {
+		serviceBase = &url.URL{Path: prefix}
+	}
+
+	jsonOpts := jsonResponseOptions{
+		headContentLength: cfg.HeadContentLength,
+		gzip:              shared.config.GzipResponses,
+		gzipLevel:         shared.config.CompressionLevel,
+	}
+	if cfg.CacheGzipResponses {
+		jsonOpts.gzipCache = newGzipCache()
+	}
+
+	tagsCache := cache.New[string, []ocidist.Reference](cfg.CacheTTL, cfg.CacheMaxStale)
+	manifestCache := cache.New[string, *ocidist.Manifest](cfg.CacheTTL, cfg.CacheMaxStale)
+	catalogCache := cache.New[string, []ocidist.Namespace](cfg.CacheTTL, cfg.CacheMaxStale)
+
+	// getManifest fetches the manifest for the given tag in the given
+	// metadata namespace, using the cache if possible.
+	getManifest := func(ctx context.Context, logger *logging.Logger, metaAddr ocidist.Namespace, tag ocidist.Reference, authHeader string) (*ocidist.Manifest, cache.Status, error) {
+		cacheKey := metadataCacheKey(metaAddr.String()+":"+tag.String(), authHeader)
+		return timedCacheGet(ctx, manifestCache, cacheKey, func() (*ocidist.Manifest, error) {
+			logger.Printf("fetch layers for %s:%s", metaAddr, tag)
+			return ociClient.GetManifest(ctx, metaAddr, tag)
+		}, backendUnavailable)
+	}
+
+	// getVersionManifest fetches the manifest for the given version tag. If
+	// the service pins manifest digests then it also returns the digest that
+	// the tag currently refers to, having fetched the manifest by that
+	// digest. A manifest fetched by digest can be cached regardless of later
+	// tag changes, but the tag itself is resolved again on every call.
+	getVersionManifest := func(ctx context.Context, logger *logging.Logger, metaAddr ocidist.Namespace, tag ocidist.Reference, authHeader string) (*ocidist.Manifest, ocidist.Digest, cache.Status, error) {
+		if !cfg.PinManifestDigests {
+			manifest, cacheStatus, err := getManifest(ctx, logger, metaAddr, tag, authHeader)
+			return manifest, "", cacheStatus, err
+		}
+		for retried := false; ; retried = true {
+			digest, err := ociClient.ResolveDigest(ctx, metaAddr, tag)
+			if err != nil {
+				return nil, "", cache.Fetched, err
+			}
+			cacheKey := metadataCacheKey(metaAddr.String()+"@"+digest.String(), authHeader)
+			manifest, cacheStatus, err := timedCacheGet(ctx, manifestCache, cacheKey, func() (*ocidist.Manifest, error) {
+				logger.Printf("fetch layers for %s@%s", metaAddr, digest)
+				return ociClient.GetManifestByDigest(ctx, metaAddr, digest)
+			}, backendUnavailable)
+			if _, ok := err.(ocidist.NotFoundError); ok && !retried {
+				// The tag probably moved and the manifest it used to
+				// refer to was garbage-collected in the meantime.
+				logger.Printf("manifest %s@%s disappeared, so resolving %s again", metaAddr, digest, tag)
+				continue
+			}
+			return manifest, digest, cacheStatus, err
+		}
+	}
+
+	if len(cfg.WarmProviders) != 0 {
+		// warmProvider fetches the tags and the manifest of the newest
+		// version of the given provider into the caches, as if an
+		// anonymous client had requested them.
+		warmProvider := func(ctx context.Context, addrParts []string) error {
+			logger := logging.ContextLogger(ctx)
+			nsAddr, err := providerNamespace(cfg.NamePrefix, cfg.AddressLayout, addrParts)
+			if err != nil {
+				return err
+			}
+			metaAddr := nsAddr.Append(cfg.MetadataNameSuffix...)
+			tags, _, err := tagsCache.Get(metadataCacheKey(metaAddr.String(), ""), func() ([]ocidist.Reference, error) {
+				logger.Printf("fetch tags for %s", metaAddr)
+				return ociClient.GetNamespaceTags(ctx, metaAddr)
+			}, backendUnavailable)
+			if err != nil {
+				return err
+			}
+			tag, ok := newestVersionTag(tags)
+			if !ok {
+				return nil // nothing more to warm
+			}
+			_, _, err = getManifest(ctx, logger, metaAddr, tag, "")
+			return err
+		}
+		shared.startupTasks = append(shared.startupTasks, func(ctx context.Context) {
+			warmCache(ctx, serviceName, cfg.WarmProviders, ociClient.CheckAPISupport, warmProvider)
+		})
+	}
+
+	if origin := (originConfig{URL: cfg.OriginURL, NamePrefix: cfg.NamePrefix}); len(swappedOriginConfigs(origin)) != 0 {
+		// The configuration looks like it might have mixed up the origin
+		// URL and the name prefix, so we'll check once at startup whether
+		// some other combination would work better.
+		shared.startupTasks = append(shared.startupTasks, func(ctx context.Context) {
+			probe := func(ctx context.Context, alt originConfig, ns ocidist.Namespace) error {
+				client := ociClient
+				if alt.URL != cfg.OriginURL {
+					client = ocidist.NewClientWithRoundTripper(alt.URL, transport)
+				}
+				if ns == nil {
+					return client.CheckAPISupport(ctx)
+				}
+				_, err := client.GetNamespaceTags(ctx, ns)
+				return err
+			}
+			if hint := diagnoseOriginConfig(ctx, origin, sampleMetadataNamespace(cfg), probe); hint != "" {
+				logging.ContextLogger(ctx).Warnf("provider mirror %q: %s", serviceName, hint)
+			}
+		})
+	}
+
+	shared.addBackendProbe(serviceName, ociClient.CheckAPISupport)
+	shared.addCapabilityProbe(serviceName, func(ctx context.Context) (ocidist.Capabilities, error) {
+		if cfg.ProbeProvider == "" {
+			return ociClient.ProbeCapabilities(ctx, nil, "")
+		}
+		nsAddr, err := providerNamespace(cfg.NamePrefix, cfg.AddressLayout, strings.Split(cfg.ProbeProvider, "/"))
+		if err != nil {
+			return ocidist.Capabilities{}, err
+		}
+		metaAddr := nsAddr.Append(cfg.MetadataNameSuffix...)
+		pkgAddr := nsAddr.Append(cfg.PackageNameSuffix...)
+		ns, blob, err := findProbeSample(ctx, ociClient, metaAddr, pkgAddr, cfg.PackageMediaTypes)
+		if err != nil {
+			return ocidist.Capabilities{}, fmt.Errorf("failed to find a sample package: %w", err)
+		}
+		return ociClient.ProbeCapabilities(ctx, ns, blob)
+	})
+
+	// negotiate is set if the service chooses between the media types
+	// available for a resource according to the client's Accept header.
+	negotiate := cfg.AcceptHeader == config.AcceptHeaderNegotiate
+
+	advertiseHandler := func(resp http.ResponseWriter, req *http.Request, logger *logging.Logger) {
+		mode := cfg.RootResponse
+		if negotiate && (mode == config.RootResponseHTML || mode == config.RootResponseJSON) {
+			// Both the page and the summary are available, and the
+			// configured one is preferred if the client doesn't mind.
+			offers := []string{"text/html", "application/json"}
+			if mode == config.RootResponseJSON {
+				offers[0], offers[1] = offers[1], offers[0]
+			}
+			resp.Header().Add("Vary", "Accept")
+			switch negotiateMediaType(req.Header.Get("Accept"), offers...) {
+			case "text/html":
+				mode = config.RootResponseHTML
+			case "application/json":
+				mode = config.RootResponseJSON
+			default:
+				logger.Printf("client accepts neither HTML nor JSON for the root")
+				writeNotAcceptable(resp, offers...)
+				return
+			}
+		}
+		switch mode {
+		case config.RootResponseJSON:
+			summary := rootSummary{
+				Name:         serviceName,
+				Protocol:     "provider_mirror",
+				DiscoveryIDs: cfg.DiscoveryIDs,
+			}
+			writeJSONResponse(resp, req, summary, jsonResponseOptions{headContentLength: true}, logger)
+		case config.RootResponseNotFound:
+			resp.WriteHeader(404)
+		case config.RootResponseRedirect:
+			resp.Header().Set("Location", cfg.RootRedirectURL.String())
+			resp.WriteHeader(302)
+		default:
+			// TODO: A more elaborate page
+			content := "<!DOCTYPE html><html><title>Provider Mirror</title><body>This is a Terraform provider mirror.</body></html>"
+			resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+			resp.Header().Set("Content-Length", strconv.FormatInt(int64(len(content)), 10))
+			resp.WriteHeader(200)
+			resp.Write([]byte(content))
+		}
+	}
+
+	providerIndexHandler := func(resp http.ResponseWriter, req *http.Request, logger *logging.Logger, asJSON bool) {
+		if negotiate {
+			if asJSON {
+				if !checkAcceptsJSON(resp, req) {
+					logger.Printf("client doesn't accept JSON")
+					return
+				}
+			} else {
+				// The page without a suffix is HTML by default, but
+				// it can also be JSON for clients that prefer that.
+				resp.Header().Add("Vary", "Accept")
+				switch negotiateMediaType(req.Header.Get("Accept"), "text/html", "application/json") {
+				case "text/html":
+				case "application/json":
+					asJSON = true
+				default:
+					logger.Printf("client accepts neither HTML nor JSON for the provider index")
+					writeNotAcceptable(resp, "text/html", "application/json")
+					return
+				}
+			}
+		}
+		ctx := contextWithOriginalReq(req.Context(), req)
+		cacheKey := metadataCacheKey("_catalog", req.Header.Get("authorization"))
+		namespaces, cacheStatus, err := timedCacheGet(ctx, catalogCache, cacheKey, func() ([]ocidist.Namespace, error) {
+			logger.Printf("fetch catalog")
+			return ociClient.GetCatalog(ctx)
+		}, backendUnavailable)
+		if err == ocidist.ErrCatalogNotSupported {
+			logger.Printf("can't list providers: %s", err)
+			resp.WriteHeader(404)
+			return
+		}
+		if err != nil {
+			propagateOCIDistError(err, resp, logger)
+			return
+		}
+		if cacheStatus == cache.Stale {
+			logger.Printf("origin registry is unavailable, so serving stale catalog")
+			markStaleResponse(resp)
+		}
+		providers := catalogProviders(namespaces, cfg.NamePrefix, cfg.MetadataNameSuffix)
+		query := req.URL.Query()
+		providers, nextQuery, err := providerIndexPage(providers, query, cfg.ProviderIndexPageSize)
+		if err != nil {
+			logger.Printf("invalid provider index query: %s", err)
+			writeTextResponse(resp, 400, "Invalid provider index query: "+err.Error()+".\n")
+			return
+		}
+		// The next page has the same path as this one, so a link containing
+		// only the query is enough.
+		var next *url.URL
+		if nextQuery != nil {
+			next = &url.URL{RawQuery: nextQuery.Encode()}
+			resp.Header().Set("Link", ocidist.NextPageLink(next))
+		}
+		if !asJSON {
+			writeProviderIndexHTML(resp, req, serviceName, providers, next)
+			return
+		}
+		type RespJSON struct {
+			Providers []string `json:"providers"`
+		}
+		opts := jsonOpts
+		opts.gzipKey = providerIndexName
+		if query.Get("last") != "" {
+			// Only the first page is worth caching in compressed form,
+			// because that's the one most clients request.
+			opts.gzipCache = nil
+		}
+		writeJSONResponse(resp, req, RespJSON{Providers: providers}, opts, logger)
 	}
 
 	return prefix, func(resp http.ResponseWriter, req *http.Request) {
+		if shared.config.LogServiceNames {
+			req = req.WithContext(logging.ContextWithLoggerPrefix(req.Context(), "["+serviceName+"] "))
+		}
 		urlNoQuery := *req.URL
 		urlNoQuery.RawQuery = ""
 		logger, done := logging.ContextLoggerRequest(req.Context(), "request to provider mirror: %s", &urlNoQuery)
 		defer done()
 
-		pathParts := strings.Split(req.URL.EscapedPath(), "/")
-		if len(pathParts) == 3 && pathParts[2] == "" {
+		// Clients and intermediaries sometimes add extra slashes to paths,
+		// so we'll ignore them to avoid miscounting the path segments. None
+		// of the paths in the protocol have empty segments.
+		path, err := normalizeRequestPath(req.URL.EscapedPath())
+		if err != nil {
+			logger.Printf("rejecting request path: %s", err)
+			writeTextResponse(resp, 400, "Invalid request path: "+err.Error()+".\n")
+			return
+		}
+		pathParts := strings.Split(path, "/")
+		if len(pathParts) == 2 {
 			// This is a request to our root, which isn't used as part of the
-			// mirror protocol and so we'll produce a HTML page advertising
-			// the mirror instead.
-			advertiseHandler(resp, req)
+			// mirror protocol and so we'll respond however the service is
+			// configured to, which by default is a HTML page advertising
+			// the mirror.
+			advertiseHandler(resp, req, logger)
 			return
 		}
+		if cfg.ProviderIndex && len(pathParts) == 3 {
+			switch pathParts[2] {
+			case providerIndexName:
+				providerIndexHandler(resp, req, logger, false)
+				return
+			case providerIndexName + ".json":
+				providerIndexHandler(resp, req, logger, true)
+				return
+			}
+		}
 
-		if len(pathParts) < 5 {
-			// If there aren't at least five parts then there aren't enoough
-			// segments to encode a provider address.
-			resp.WriteHeader(404)
+		// malformedPath responds to a request whose path can't possibly
+		// represent a provider address and selector, which by default is
+		// indistinguishable from a request for a provider that doesn't exist.
+		malformedPath := func(reason string) {
+			logger.Printf("malformed request path: %s", reason)
+			if !cfg.RejectMalformedPaths {
+				resp.WriteHeader(404)
+				return
+			}
+			msg := "Malformed provider mirror request path: " + reason + ".\n"
+			resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			resp.Header().Set("Content-Length", strconv.Itoa(len(msg)))
+			resp.WriteHeader(400)
+			io.WriteString(resp, msg)
+		}
+
+		if cfg.CanonicalRedirects && (req.Method == "GET" || req.Method == "HEAD") && len(pathParts) >= 4 && len(pathParts) <= 6 {
+			// The path might be a provider address in a non-canonical form
+			// followed by one more segment for the request, in which case
+			// we redirect to the canonical URL so that clients and caches
+			// all converge on the same one.
+			last := len(pathParts) - 1
+			canonical, ok := canonicalProviderAddr(pathParts[2:last])
+			if ok {
+				// We only redirect to a provider address we could serve.
+				_, err := providerNamespace(cfg.NamePrefix, cfg.AddressLayout, canonical)
+				ok = err == nil
+			}
+			if ok {
+				// normalizeRequestPath already rejected any invalid
+				// percent-encoding.
+				selector, _ := url.PathUnescape(pathParts[last])
+				location := serviceBase.JoinPath(append(canonical, selector)...)
+				location.RawQuery = req.URL.RawQuery
+				logger.Printf("redirecting to canonical URL %s", location)
+				resp.Header().Set("Location", location.String())
+				resp.WriteHeader(301)
+				return
+			}
+		}
+
+		if len(pathParts) < 6 {
+			// If there aren't at least six parts then there aren't enough
+			// segments to encode a provider address and what we're
+			// querying about it.
+			malformedPath(fmt.Sprintf("a provider address has three segments (hostname/namespace/type), followed by one more for the request, but the path has only %d", len(pathParts)-2))
 			return
 		}
 
-		addrParts := pathParts[2:5]
-		nsAddr, err := ociDistNamespaceFromPathSegments(cfg.NamePrefix, addrParts)
+		addrParts, err := normalizeProviderAddr(pathParts[2:5])
+		if err != nil {
+			malformedPath(err.Error())
+			return
+		}
+		nsAddr, err := providerNamespace(cfg.NamePrefix, cfg.AddressLayout, addrParts)
 		if err != nil {
 			// Can't pass on address that uses characters not allowed by the
-			// underlying protocol.
-			logger.Printf("unsupported provider address: %s", err)
-			resp.WriteHeader(404)
+			// underlying protocol, even if they were only allowed into the
+			// request path by percent-encoding, or that the address layout
+			// turns into an invalid namespace part.
+			malformedPath(fmt.Sprintf("unsupported provider address: %s", err))
 			return
 		}
+		// The origin registry may store metadata and packages in different
+		// namespaces, each with their own optional suffix.
+		metaAddr := nsAddr.Append(cfg.MetadataNameSuffix...)
+		pkgAddr := nsAddr.Append(cfg.PackageNameSuffix...)
+
 		remainParts := pathParts[5:]
-		if len(remainParts) != 1 {
+		if len(remainParts) > 1 {
+			// Terraform never sends provider addresses with more than
+			// three segments, even if the origin registry has more levels
+			// of namespace.
+			malformedPath(fmt.Sprintf("a provider address has three segments (hostname/namespace/type), followed by one more for the request, but the path has %d", len(pathParts)-2))
+			return
+		}
+		if remainParts[0] == "" {
 			// Should always have exactly one remaining part, which specifies
 			// what about the selected address we are querying.
-			resp.WriteHeader(404)
+			malformedPath("expected exactly one path segment after the provider address")
 			return
 		}
-		selector := remainParts[0]
+		// normalizeRequestPath already rejected any invalid percent-encoding.
+		selector, _ := url.PathUnescape(remainParts[0])
 
 		ctx := contextWithOriginalReq(req.Context(), req)
 
@@ -151,96 +805,355 @@ func providerMirrorHandler(cfg *config.ProviderMirror, secreter *querysecret.Sec
 				// specifies both which object digest we're downloading and
 				// possibly an Authorization header value to use when fetching
 				// it.
-				qs := req.URL.RawQuery
-				if len(qs) == 0 {
-					logger.Print("missing query string to authenticate the download request")
-					resp.WriteHeader(404)
-					return
-				}
-				raw, err := secreter.Unwrap(qs)
+				rawToken, forwardQuery := splitDownloadQuery(req.URL.RawQuery, cfg.ForwardQueryParams)
+				token, late, err := unwrapDownloadToken(secreter, rawToken)
 				if err != nil {
-					logger.Printf("invalid query string argument: %s", err)
+					shared.rejectDownloadToken(req, logger, serviceName, rawToken, err)
 					resp.WriteHeader(404)
 					return
 				}
-				firstColon := bytes.IndexByte(raw, ':')
-				if firstColon == -1 {
-					resp.WriteHeader(404)
-					return
+				if late > 0 {
+					// Operators can use how often this happens to decide
+					// whether the token lifetime is too short.
+					logger.Warnf("accepting download token that expired %s ago, within the grace period", late.Round(time.Second))
+					downloadTokenGraceRedemptions.Add(1)
+				}
+				if forwardQuery != nil {
+					ctx = contextWithBackendQuery(ctx, forwardQuery)
 				}
-				secondColon := firstColon + 1 + bytes.IndexByte(raw[firstColon+1:], ':')
-				if secondColon == -1 {
+				digest := token.Digest
+				if err := digest.CheckAlgorithm(shared.config.TrustedDigestAlgorithms); err != nil {
+					logger.Printf("refusing to download %s: %s", digest, err)
 					resp.WriteHeader(404)
 					return
 				}
-				digestStr := string(raw[:secondColon])
-				digest, err := ocidist.ParseDigest(digestStr)
-				if err != nil {
-					logger.Printf("query string has invalid digest %q: %s", digestStr, err)
-					resp.WriteHeader(404)
+
+				client := clientKey(req, shared.config.ClientIPv6PrefixLength)
+				release, ok := shared.downloadLimiter.acquire(client)
+				if !ok {
+					logger.Printf("rejecting download because client %s has too many concurrent downloads", client)
+					resp.Header().Set("Retry-After", "1")
+					resp.WriteHeader(429)
 					return
 				}
+				defer release()
+				downloadDone := shared.downloads.start()
+				defer downloadDone()
+				providerKey := serviceName + ":" + strings.Join(addrParts, "/")
+				providerDownloads.Add(providerKey, 1)
 
-				logger.Printf("proxying content for %s blob %s", nsAddr, digest)
-				authHeader := string(raw[secondColon+1:])
-				header, r, err := ociClient.GetBlobContent(ctx, nsAddr, digest, authHeader)
+				authHeader := token.AuthHeader
+				status := 200
+				var header http.Header
+				var r io.ReadCloser
+				pkgCache := shared.packageCaches[serviceName]
+				fromCache := false
+				if pkgCache != nil {
+					r, _, err = pkgCache.Get(digest)
+					switch {
+					case err == nil:
+						fromCache = true
+					case errors.Is(err, diskcache.ErrNotCached):
+						err = nil
+					default:
+						// The origin registry can still provide the
+						// package, so a broken cache only costs us time.
+						logger.Errorf("failed to read %s blob %s from the package cache: %s", pkgAddr, digest, err)
+						err = nil
+					}
+				}
+				if cfg.RedirectPackages && r == nil {
+					var location *url.URL
+					location, header, r, err = ociClient.GetBlobContentOrLocation(ctx, pkgAddr, digest, authHeader)
+					if err != nil {
+						propagateOCIDistError(err, resp, logger)
+						return
+					}
+					if location != nil && !isOriginHost(cfg, location.Host) {
+						// The registry has offloaded the blob to some other
+						// location, such as a presigned URL for a storage
+						// service, and so we'll send the client there
+						// directly. We only do this for other hosts, because
+						// a redirect elsewhere on the registry itself would
+						// probably require the credentials that we're
+						// keeping server-side.
+						logger.Printf("redirecting to external location for %s blob %s", pkgAddr, digest)
+						resp.Header().Set("Location", location.String())
+						resp.WriteHeader(302)
+						return
+					}
+				}
+				verify := cfg.PackageVerification == config.PackageVerificationStreaming || cfg.PackageVerification == config.PackageVerificationBuffered
+				if r == nil {
+					// We only offer resumable downloads if the origin
+					// registry supports ranges, so that we never promise
+					// something that we can't deliver. Only whole packages
+					// can be verified or cached, so we never offer ranges
+					// when doing either.
+					ranges := false
+					if !verify && pkgCache == nil {
+						var probeErr error
+						ranges, probeErr = ociClient.SupportsBlobRanges(ctx, pkgAddr, digest, authHeader)
+						if probeErr != nil {
+							logger.Printf("can't tell whether the origin registry supports ranges: %s", probeErr)
+						}
+					}
+					if ranges {
+						resp.Header().Set("Accept-Ranges", "bytes")
+					} else {
+						resp.Header().Set("Accept-Ranges", "none")
+					}
+					if byteRange := req.Header.Get("Range"); ranges && byteRange != "" {
+						// Blobs are immutable, so there's no need to check
+						// any If-Range condition before forwarding the range.
+						status, header, r, err = ociClient.GetBlobContentRange(ctx, pkgAddr, digest, authHeader, byteRange)
+					} else {
+						header, r, err = ociClient.GetBlobContent(ctx, pkgAddr, digest, authHeader)
+					}
+				}
 				if err != nil {
-					propagateOCIDistError(err, resp)
+					propagateOCIDistError(err, resp, logger)
 					return
 				}
 				defer r.Close()
+				if pkgCache != nil && !fromCache {
+					// The cache checks the content against its digest while
+					// storing it, so as with buffered verification the
+					// client receives nothing until the whole package has
+					// arrived from the origin registry.
+					err := pkgCache.Put(digest, r)
+					if err == nil {
+						var cached io.ReadCloser
+						cached, _, err = pkgCache.Get(digest)
+						if err == nil {
+							defer cached.Close()
+							r, fromCache = cached, true
+						}
+					}
+					if err != nil {
+						logger.Errorf("failed to cache %s blob %s: %s", pkgAddr, digest, err)
+						resp.WriteHeader(502)
+						return
+					}
+				}
+				if fromCache {
+					logger.Printf("serving %s blob %s from the package cache", pkgAddr, digest)
+				} else {
+					logger.Printf("proxying content for %s blob %s", pkgAddr, digest)
+				}
 
-				// We'll copy over all of the server's content-related header
-				// fields, such as Content-Type, Content-Length, etc.
-				respHeader := resp.Header()
-				for n, vs := range header {
-					n = textproto.CanonicalMIMEHeaderKey(n)
-					if strings.HasPrefix(n, "Content-") {
-						respHeader[n] = vs
+				// When verifying, the client checks the content against
+				// its digest as we read it, and so reading fails if it
+				// doesn't match.
+				var body io.Reader = r
+				var spooledSize int64
+				if cfg.PackageVerification == config.PackageVerificationBuffered && !fromCache {
+					spooled, size, err := spoolBlob(r)
+					if err != nil {
+						if errors.Is(err, ocidist.ErrBlobDigestMismatch) || errors.Is(err, ocidist.ErrBlobTruncated) {
+							logger.Errorf("refusing to serve %s blob %s: %s", pkgAddr, digest, err)
+						} else {
+							logger.Errorf("failed to buffer %s blob %s: %s", pkgAddr, digest, err)
+						}
+						resp.WriteHeader(502)
+						return
 					}
+					defer spooled.Close()
+					body, spooledSize = spooled, size
 				}
 
-				resp.WriteHeader(200)
-				io.Copy(resp, r)
+				copyAllowedHeaders(resp.Header(), header, cfg.PackageResponseHeaders)
+				if token.Filename != "" {
+					resp.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": token.Filename}))
+				}
+				switch {
+				case fromCache:
+					// Packages that were already in the cache when it was
+					// opened are checked against their digests only as
+					// they're read, so as with streaming verification the
+					// response mustn't claim a length.
+					resp.Header().Del("Content-Length")
+					resp.Header().Set("Accept-Ranges", "none")
+				case cfg.PackageVerification == config.PackageVerificationStreaming:
+					// Without a Content-Length, a client can tell that a
+					// response we abort after sending the last byte is
+					// incomplete.
+					resp.Header().Del("Content-Length")
+				case cfg.PackageVerification == config.PackageVerificationBuffered:
+					resp.Header().Set("Content-Length", strconv.FormatInt(spooledSize, 10))
+				}
+
+				resp.WriteHeader(status)
+				n, err := io.Copy(resp, body)
+				downloadBytes.Add(serviceName, n)
+				providerDownloadBytes.Add(providerKey, n)
+				if err != nil {
+					// We've already sent a successful status, so the only
+					// way to tell the client that the download is
+					// incomplete is to abort the response. Returning
+					// normally would end a response without a
+					// Content-Length as if it were complete.
+					if errors.Is(err, ocidist.ErrBlobDigestMismatch) || errors.Is(err, ocidist.ErrBlobTruncated) || errors.Is(err, diskcache.ErrCorrupt) {
+						logger.Errorf("aborting download of %s blob %s: %s", pkgAddr, digest, err)
+					} else {
+						logger.Printf("aborting download of %s blob %s: %s", pkgAddr, digest, err)
+					}
+					panic(http.ErrAbortHandler)
+				}
 				return
 			}
 		}
 
-		if !strings.HasSuffix(selector, ".json") {
+		selector, ok := parseJSONSelector(selector, cfg.LenientSelectors)
+		if !ok {
 			// All selectors always have a .json suffix in the protocol
 			resp.WriteHeader(404)
 			return
 		}
-		selector = selector[:len(selector)-5]
+		if negotiate && !checkAcceptsJSON(resp, req) {
+			// The protocol defines only JSON responses.
+			logger.Printf("client doesn't accept JSON")
+			return
+		}
+
+		if msg, deprecated := deprecationMessage(cfg.DeprecatedProviders, addrParts); deprecated {
+			logger.Printf("serving deprecated provider %s", strings.Join(addrParts, "/"))
+			setDeprecationHeaders(resp.Header(), strings.Join(addrParts, "/"), msg)
+		}
 
 		if selector == "index" {
-			logger.Printf("fetch tags for %s", nsAddr)
-			tags, err := ociClient.GetNamespaceTags(ctx, nsAddr)
+			cacheKey := metadataCacheKey(metaAddr.String(), req.Header.Get("authorization"))
+			tags, cacheStatus, err := timedCacheGet(ctx, tagsCache, cacheKey, func() ([]ocidist.Reference, error) {
+				logger.Printf("fetch tags for %s", metaAddr)
+				return ociClient.GetNamespaceTags(ctx, metaAddr)
+			}, backendUnavailable)
 			if err != nil {
-				propagateOCIDistError(err, resp)
+				propagateOCIDistError(err, resp, logger)
 				return
 			}
+			if cacheStatus == cache.Stale {
+				logger.Printf("origin registry is unavailable, so serving stale tags for %s", metaAddr)
+				markStaleResponse(resp)
+			}
+			type VersionJSON struct {
+				// Created is an extension to the mirror protocol which
+				// reports when the version was published, from the
+				// manifest annotation named by CreatedAnnotation.
+				Created string `json:"created,omitempty"`
+			}
 			type RespJSON struct {
-				Versions map[string]struct{} `json:"versions"`
+				Versions map[string]VersionJSON `json:"versions"`
+
+				// Latest is an extension to the mirror protocol which
+				// reports which version the origin registry's "latest" tag
+				// refers to, when ResolveLatest is enabled.
+				Latest string `json:"latest,omitempty"`
+			}
+			respJSON := RespJSON{Versions: make(map[string]VersionJSON)}
+			var latestTag ocidist.Reference
+			versionTags := make(map[string]ocidist.Reference)
+			var versionList versions.List
+			type candidate struct {
+				tag     ocidist.Reference
+				version versions.Version
 			}
-			respJSON := RespJSON{make(map[string]struct{})}
+			var candidates []candidate
 			for _, tag := range tags {
+				if tag == latestTagName {
+					latestTag = tag
+				}
 				v, err := versions.ParseVersion(tag.String())
 				if err != nil {
 					continue // Ignore tags that aren't version numbers
 				}
-				respJSON.Versions[v.String()] = struct{}{}
+				if belowMinVersion(v, cfg.MinVersion) {
+					continue
+				}
+				candidates = append(candidates, candidate{tag: tag, version: v})
 			}
-			respBytes, err := json.Marshal(respJSON)
-			if err != nil {
-				logger.Printf("failed to serialize JSON response: %s", err)
-				resp.WriteHeader(500)
-				return
+
+			// Some settings need each version's manifest, which we fetch
+			// concurrently so that a namespace with many versions doesn't
+			// take a round trip per version.
+			type fetched struct {
+				manifest    *ocidist.Manifest
+				cacheStatus cache.Status
 			}
-			resp.Header().Set("Content-Length", strconv.FormatInt(int64(len(respBytes)), 10))
-			resp.Header().Set("Content-Type", "application/json")
-			resp.WriteHeader(200)
-			resp.Write(respBytes)
+			needManifests := cfg.ArtifactChecking == config.ArtifactCheckingLenient || cfg.YankedAnnotation != "" || cfg.CreatedAnnotation != ""
+			var manifests []fetched
+			var manifestErrs []error
+			if needManifests {
+				authHeader := req.Header.Get("authorization")
+				manifests, manifestErrs = fetchConcurrently(candidates, maxConcurrentManifestFetches, func(c candidate) (fetched, error) {
+					manifest, cacheStatus, err := getManifest(ctx, logger, metaAddr, c.tag, authHeader)
+					return fetched{manifest: manifest, cacheStatus: cacheStatus}, err
+				})
+			}
+
+			for i, c := range candidates {
+				tag, v := c.tag, c.version
+				var versionJSON VersionJSON
+				if needManifests {
+					manifest, cacheStatus, err := manifests[i].manifest, manifests[i].cacheStatus, manifestErrs[i]
+					if _, ok := err.(ocidist.NotFoundError); ok {
+						continue // tag was presumably deleted after we listed it
+					}
+					if err == ocidist.ErrImageIndex {
+						if cfg.ArtifactChecking == config.ArtifactCheckingLenient {
+							logger.Printf("ignoring %s:%s because it is an image index", metaAddr, tag)
+							continue
+						}
+						// There's no manifest to check for yanking, so we'll
+						// list the version and let the version document
+						// request explain the problem.
+						respJSON.Versions[v.String()] = versionJSON
+						versionTags[v.String()] = tag
+						versionList = append(versionList, v)
+						continue
+					}
+					if err != nil {
+						propagateOCIDistError(err, resp, logger)
+						return
+					}
+					if cacheStatus == cache.Stale {
+						markStaleResponse(resp)
+					}
+					if cfg.ArtifactChecking == config.ArtifactCheckingLenient {
+						// In lenient mode we only include versions whose
+						// tags refer to provider releases, so that the
+						// namespace can also contain other kinds of artifact.
+						if err := checkProviderArtifact(manifest, cfg.RequiredArtifactType); err != nil {
+							logger.Printf("ignoring %s:%s because it %s", metaAddr, tag, err)
+							continue
+						}
+					}
+					if isYanked(manifest, cfg.YankedAnnotation) {
+						logger.Printf("ignoring %s:%s because it is yanked", metaAddr, tag)
+						continue
+					}
+					versionJSON.Created = createdTime(manifest, cfg.CreatedAnnotation)
+				}
+				respJSON.Versions[v.String()] = versionJSON
+				versionTags[v.String()] = tag
+				versionList = append(versionList, v)
+			}
+			if cfg.ResolveLatest && latestTag != "" {
+				latest, found, err := findLatestVersion(versionList, func() (ocidist.Digest, error) {
+					return ociClient.ResolveDigest(ctx, metaAddr, latestTag)
+				}, func(v versions.Version) (ocidist.Digest, error) {
+					return ociClient.ResolveDigest(ctx, metaAddr, versionTags[v.String()])
+				})
+				if err != nil {
+					// The "latest" marker is just a convenience, so we'll
+					// still return the version list without it.
+					logger.Warnf("failed to resolve the latest version of %s: %s", metaAddr, err)
+				} else if found {
+					respJSON.Latest = latest.String()
+				}
+			}
+			opts := jsonOpts
+			opts.gzipKey = metaAddr.String()
+			writeJSONResponse(resp, req, respJSON, opts, logger)
 			return
 		}
 
@@ -253,87 +1166,893 @@ func providerMirrorHandler(cfg *config.ProviderMirror, secreter *querysecret.Sec
 				resp.WriteHeader(404)
 				return
 			}
+			if belowMinVersion(version, cfg.MinVersion) {
+				logger.Printf("version %s for %s is older than the minimum version %s", version, nsAddr, cfg.MinVersion)
+				resp.WriteHeader(404)
+				return
+			}
 			tag, err := ocidist.ParseReference(version.String())
 			if err != nil {
 				logger.Printf("version %s for %s uses version syntax that isn't valid OCI Distribution ref syntax", version, nsAddr)
 				resp.WriteHeader(404)
 				return
 			}
-			logger.Printf("fetch layers for %s:%s", nsAddr, tag)
-			manifest, err := ociClient.GetManifest(ctx, nsAddr, tag)
-			if err != nil {
-				propagateOCIDistError(err, resp)
-				return
+			if len(cfg.PackageMediaTypes) > 1 {
+				resp.Header().Add("Vary", packageMediaTypesHeader)
 			}
+			mediaTypes := acceptablePackageMediaTypes(cfg.PackageMediaTypes, req.Header.Values(packageMediaTypesHeader))
+			// serveVersion writes the response for this version, unless
+			// canRetry is set and the service pins manifest digests and the
+			// pinned manifest refers to missing blobs. In that case it writes
+			// nothing and returns true, so that we can start again from the
+			// tag, at most once.
+			serveVersion := func(canRetry bool) (retry bool) {
+				manifest, pinned, cacheStatus, err := getVersionManifest(ctx, logger, metaAddr, tag, req.Header.Get("authorization"))
+				if err == ocidist.ErrImageIndex {
+					logger.Printf("artifact %s:%s is an image index rather than a manifest", metaAddr, tag)
+					if cfg.ArtifactChecking == config.ArtifactCheckingLenient {
+						// In lenient mode this version doesn't appear in the
+						// index, so we'll treat it as nonexistent here too.
+						resp.WriteHeader(404)
+						return false
+					}
+					// The tag exists, but the origin registry's layout isn't
+					// one we can serve, so this is the registry's problem
+					// rather than the client's.
+					writeTextResponse(resp, 502, fmt.Sprintf(
+						"Version %s is published as an image index, such as a multi-platform image, but each provider version tag must refer to a single manifest.\n",
+						version,
+					))
+					return false
+				}
+				if err != nil {
+					propagateOCIDistError(err, resp, logger)
+					return false
+				}
 
-			if mt := manifest.Config.MediaType; mt != "application/vnd.hashicorp.terraform-provider.config.v1+json" {
-				logger.Printf("artifact %s %s has unsupported media type %s", nsAddr, tag, mt)
-				resp.WriteHeader(406)
-				return
-			}
+				if err := checkProviderArtifact(manifest, cfg.RequiredArtifactType); err != nil {
+					logger.Printf("artifact %s:%s %s", metaAddr, tag, err)
+					if cfg.ArtifactChecking == config.ArtifactCheckingLenient {
+						// In lenient mode this version doesn't appear in the
+						// index, so we'll treat it as nonexistent here too.
+						resp.WriteHeader(404)
+					} else {
+						writeTextResponse(resp, 406, fmt.Sprintf(
+							"Version %s is not a Terraform provider release: its manifest %s.\n",
+							version, err,
+						))
+					}
+					return false
+				}
 
-			type RespArchive struct {
-				URL    string   `json:"url"`
-				Hashes []string `json:"hashes,omitempty"`
-			}
-			type RespJSON struct {
-				Archives map[string]RespArchive `json:"archives"`
-			}
-			respJSON := RespJSON{make(map[string]RespArchive)}
+				type RespArchive struct {
+					URL    string   `json:"url"`
+					Hashes []string `json:"hashes,omitempty"`
+				}
+				type RespJSON struct {
+					Archives map[string]RespArchive `json:"archives"`
 
-			for _, meta := range manifest.Layers {
-				if meta.MediaType != "application/vnd.hashicorp.terraform.provider-package+zip" {
-					continue // ignore any layer types other than our own
+					// Annotations is an extension to the mirror protocol for
+					// exposing selected manifest annotations, such as
+					// provenance information, to tools that want them.
+					Annotations map[string]any `json:"annotations,omitempty"`
 				}
-				supportedPlatformsRaw, _ := meta.Annotations["io.terraform.target-platforms"].(string)
-				if supportedPlatformsRaw == "" {
-					continue // all packages should indicate which platforms they support
+				respJSON := RespJSON{Archives: make(map[string]RespArchive)}
+				for _, key := range cfg.ExposedAnnotations {
+					if v, exists := manifest.Annotations[key]; exists {
+						if respJSON.Annotations == nil {
+							respJSON.Annotations = make(map[string]any)
+						}
+						respJSON.Annotations[key] = v
+					}
+				}
+
+				layers, err := selectPackageLayers(manifest.Layers, packageLayerPolicy{
+					MediaTypes:         mediaTypes,
+					TrustedAlgorithms:  shared.config.TrustedDigestAlgorithms,
+					StrictAnnotations:  cfg.StrictAnnotations,
+					DuplicatePlatforms: cfg.DuplicatePlatforms,
+					MaxPlatforms:       cfg.MaxPlatforms,
+				}, logger)
+				var tooManyErr tooManyPlatformsError
+				if errors.As(err, &tooManyErr) {
+					logger.Errorf("refusing version %s:%s: %s", metaAddr, tag, err)
+					writeTextResponse(resp, 502, fmt.Sprintf(
+						"Version %s offers packages for more than %d platforms, which is more than this server allows.\n",
+						version, tooManyErr.Limit,
+					))
+					return false
 				}
-				var downloadURL *url.URL
-				if cfg.ProxyPackages {
-					downloadURL = req.URL.JoinPath("../download")
-					authHeader := req.Header.Get("authorization")
-					var buf bytes.Buffer
-					fmt.Fprintf(&buf, "%s:%s", meta.Digest.String(), authHeader)
-					secret, err := secreter.Wrap(buf.Bytes())
+				if err != nil {
+					logger.Errorf("invalid manifest for %s:%s: %s", metaAddr, tag, err)
+					resp.WriteHeader(502)
+					return false
+				}
+				if cfg.VerifyLayers {
+					var digests []ocidist.Digest
+					seen := make(map[ocidist.Digest]bool)
+					for _, meta := range layers {
+						if !seen[meta.Digest] {
+							seen[meta.Digest] = true
+							digests = append(digests, meta.Digest)
+						}
+					}
+					missing, err := findMissingBlobs(digests, maxConcurrentLayerChecks, func(digest ocidist.Digest) (bool, error) {
+						return ociClient.BlobExists(ctx, pkgAddr, digest)
+					})
 					if err != nil {
-						logger.Printf("failed to generate download authentication string: %s", err)
-						resp.WriteHeader(500)
-						return
+						propagateOCIDistError(err, resp, logger)
+						return false
+					}
+					if len(missing) != 0 && pinned != "" && canRetry {
+						// The blobs of a pinned manifest can only disappear if
+						// they were garbage-collected after the tag moved, so
+						// we'll start again from the tag's new manifest.
+						logger.Printf("manifest %s@%s refers to missing blobs, so resolving %s again", metaAddr, pinned, tag)
+						return true
+					}
+					for platform, meta := range layers {
+						if missing[meta.Digest] {
+							logger.Warnf("not offering %s package for %s:%s because blob %s doesn't exist", platform, metaAddr, tag, meta.Digest)
+							delete(layers, platform)
+						}
 					}
-					downloadURL.RawQuery = secret
-				} else {
-					downloadURL = ociClient.BlobURL(nsAddr, meta.Digest)
-				}
-				respArchive := RespArchive{
-					URL: downloadURL.String(),
 				}
-				if meta.Digest.Algorithm() == "sha256" {
-					// Terraform's own "zh" ("ziphash") hashing scheme happens to
-					// be exactly compatible with OCI Distribution's sha256
-					// scheme, aside from the prefix, so we'll include this
-					// to help the client do an integrity check on what it
-					// has downloaded.
-					respArchive.Hashes = []string{"zh:" + meta.Digest.Encoded()}
+				// We mark the response as stale only now that we've committed
+				// to this manifest, because a retry would use a fresh one.
+				if cacheStatus == cache.Stale {
+					logger.Printf("origin registry is unavailable, so serving stale manifest for %s:%s", metaAddr, tag)
+					markStaleResponse(resp)
 				}
-				for _, platform := range strings.Split(supportedPlatformsRaw, ",") {
+				archives := make(map[ocidist.Digest]RespArchive)
+				for platform, meta := range layers {
+					if respArchive, exists := archives[meta.Digest]; exists && !cfg.PackageFilenames {
+						// Same layer already used for another platform. With
+						// package filenames each platform needs its own URL,
+						// because the filename includes the platform.
+						respJSON.Archives[platform] = respArchive
+						continue
+					}
+					var archiveURL *url.URL
+					if cfg.ProxyPackages {
+						token := downloadToken{
+							Digest: meta.Digest,
+						}
+						if cfg.OriginCredentials == nil {
+							token.AuthHeader = req.Header.Get("authorization")
+						}
+						if cfg.PackageFilenames && meta.MediaType == providerPackageMediaType {
+							token.Filename = packageFilename(addrParts[2], version, platform)
+						}
+						var err error
+						archiveURL, err = downloadURL(serviceBase, mirrorProtocol, addrParts, secreter, token)
+						if err != nil {
+							logger.Errorf("failed to generate download authentication string: %s", err)
+							downloadTokenFailures.Add(1)
+							msg := "Failed to generate a download URL for this provider package.\nThe server's query string secret may be misconfigured; see the server logs for details.\n"
+							resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+							resp.Header().Set("Content-Length", strconv.Itoa(len(msg)))
+							resp.WriteHeader(500)
+							io.WriteString(resp, msg)
+							return false
+						}
+					} else {
+						archiveURL = ociClient.BlobURL(pkgAddr, meta.Digest)
+					}
+					respArchive := RespArchive{
+						URL: archiveURL.String(),
+					}
+					hashes, err := packageHashes(meta, cfg.HashSchemes)
+					if err != nil {
+						logger.Warnf("ignoring %s annotation of package layer %s: %s", packageHashesAnnotation, meta.Digest, err)
+					}
+					respArchive.Hashes = hashes
+					archives[meta.Digest] = respArchive
 					respJSON.Archives[platform] = respArchive
 				}
+
+				opts := jsonOpts
+				opts.gzipKey = metaAddr.String() + ":" + tag.String()
+				writeJSONResponse(resp, req, respJSON, opts, logger)
+				return false
 			}
+			if serveVersion(true) {
+				serveVersion(false)
+			}
+		}
+	}
+}
+
+// deprecationMessage returns the configured deprecation message for the
+// provider with the given address path segments, and whether the provider is
+// deprecated at all.
+func deprecationMessage(deprecated map[string]string, addrParts []string) (string, bool) {
+	if len(deprecated) == 0 {
+		return "", false
+	}
+	unescaped := make([]string, len(addrParts))
+	for i, part := range addrParts {
+		var err error
+		unescaped[i], err = url.PathUnescape(part)
+		if err != nil {
+			return "", false
+		}
+	}
+	msg, ok := deprecated[strings.ToLower(strings.Join(unescaped, "/"))]
+	return msg, ok
+}
+
+// setDeprecationHeaders adds header fields to a response about a deprecated
+// provider, to inform clients that the provider is planned to be removed.
+//
+// The Deprecation field is for automated tools, while the message is in a
+// Warning field for display to humans.
+func setDeprecationHeaders(header http.Header, addr string, msg string) {
+	header.Set("Deprecation", "true")
+	text := fmt.Sprintf("Provider %s is deprecated", addr)
+	if msg != "" {
+		text += ": " + msg
+	}
+	text = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(text)
+	header.Set("Warning", fmt.Sprintf(`299 - "%s"`, text))
+}
+
+// copyAllowedHeaders copies the header fields with the given names from src
+// to dst, replacing any existing values in dst. Any other fields in src are
+// ignored.
+func copyAllowedHeaders(dst, src http.Header, allowed []string) {
+	for _, name := range allowed {
+		if vs := src.Values(name); len(vs) != 0 {
+			dst[textproto.CanonicalMIMEHeaderKey(name)] = vs
+		}
+	}
+}
+
+// parseJSONSelector removes the ".json" suffix from the final path segment
+// of a request for mirror metadata, returning false if the segment doesn't
+// have that suffix.
+//
+// If lenient is true then the suffix is matched case-insensitively and may
+// be repeated, and the "index" selector is also matched case-insensitively,
+// to tolerate intermediaries that rewrite paths. Otherwise only the exact
+// form used by the protocol is accepted.
+func parseJSONSelector(segment string, lenient bool) (string, bool) {
+	const suffix = ".json"
+	hasSuffix := func(s string) bool {
+		if !lenient {
+			return strings.HasSuffix(s, suffix)
+		}
+		return len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
+	}
+	if !hasSuffix(segment) {
+		return "", false
+	}
+	ret := segment[:len(segment)-len(suffix)]
+	if lenient {
+		if hasSuffix(ret) {
+			// Accidental double extension, like "index.json.json"
+			ret = ret[:len(ret)-len(suffix)]
+		}
+		if strings.EqualFold(ret, "index") {
+			ret = "index"
+		}
+	}
+	return ret, true
+}
+
+// jsonResponseOptions customizes how [writeJSONResponse] writes a response.
+type jsonResponseOptions struct {
+	// headContentLength decides whether responses to HEAD requests include
+	// Content-Length, which requires generating the full response.
+	headContentLength bool
+
+	// gzip enables compressing the response for clients that accept gzip,
+	// at gzipLevel or the gzip package's default level if that's zero.
+	// If gzipCache is also set then it's used to reuse the compressed form
+	// of an unchanged response, with gzipKey identifying the resource.
+	gzip      bool
+	gzipLevel int
+	gzipCache *gzipCache
+	gzipKey   string
+}
+
+// rootSummary is the JSON response for requests to the root of a service
+// whose root response is [config.RootResponseJSON].
+type rootSummary struct {
+	Name         string   `json:"name"`
+	Protocol     string   `json:"protocol"`
+	DiscoveryIDs []string `json:"discovery_ids,omitempty"`
+}
+
+// writeJSONResponse writes a successful response containing the JSON
+// serialization of the given value.
+//
+// For HEAD requests the body is omitted, and Content-Length is included only
+// if opts.headContentLength is true.
+func writeJSONResponse(resp http.ResponseWriter, req *http.Request, v any, opts jsonResponseOptions, logger *logging.Logger) {
+	respBytes, err := json.Marshal(v)
+	if err != nil {
+		logger.Errorf("failed to serialize JSON response: %s", err)
+		resp.WriteHeader(500)
+		return
+	}
+	if opts.gzip {
+		respBytes = maybeGzipResponse(resp, req, respBytes, opts.gzipLevel, opts.gzipCache, opts.gzipKey)
+	}
+	if req.Method != "HEAD" || opts.headContentLength {
+		resp.Header().Set("Content-Length", strconv.FormatInt(int64(len(respBytes)), 10))
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(200)
+	if req.Method != "HEAD" {
+		resp.Write(respBytes)
+	}
+}
+
+// providerConfigMediaType is the config media type used by manifests that
+// represent Terraform provider releases.
+const providerConfigMediaType = "application/vnd.hashicorp.terraform-provider.config.v1+json"
+
+// checkProviderArtifact returns an error describing why the given manifest
+// doesn't represent a Terraform provider release, or nil if it does.
+//
+// If requiredArtifactType is set then the manifest's artifact type must
+// match it, where a manifest that doesn't declare an artifact type is
+// treated as having its config media type as its artifact type. Otherwise
+// the manifest must have the provider config media type.
+func checkProviderArtifact(manifest *ocidist.Manifest, requiredArtifactType string) error {
+	if requiredArtifactType != "" {
+		artifactType := manifest.ArtifactType
+		if artifactType == "" {
+			artifactType = manifest.Config.MediaType
+		}
+		if artifactType != requiredArtifactType {
+			return fmt.Errorf("has artifact type %s, but %s is required", artifactType, requiredArtifactType)
+		}
+		return nil
+	}
+	switch mt := manifest.Config.MediaType; mt {
+	case providerConfigMediaType:
+		return nil
+	case "":
+		return fmt.Errorf("has no config media type")
+	default:
+		return fmt.Errorf("has unsupported config media type %s", mt)
+	}
+}
+
+// providerPackageMediaType is the media type of the layers containing
+// provider packages in Terraform's zip archive format.
+const providerPackageMediaType = "application/vnd.hashicorp.terraform.provider-package+zip"
+
+// packageMediaTypesHeader is a request header that clients can use to
+// list which provider package media types they are able to accept, in
+// order of preference, separated by commas.
+const packageMediaTypesHeader = "X-Terraform-Package-Media-Types"
+
+// latestTagName is the tag that some registries use to mark the newest
+// release of an artifact, in addition to its version number tag.
+const latestTagName = ocidist.Reference("latest")
+
+// findLatestVersion returns which of the given versions has the same
+// manifest digest as the "latest" tag, using the given functions to find
+// the digest of the latest tag and of each version.
+//
+// If more than one version matches then the result is the newest of them.
+// The second result is false if no version matches.
+func findLatestVersion(candidates versions.List, latestDigest func() (ocidist.Digest, error), versionDigest func(versions.Version) (ocidist.Digest, error)) (versions.Version, bool, error) {
+	want, err := latestDigest()
+	if err != nil {
+		return versions.Unspecified, false, err
+	}
+
+	// We'll check the newest versions first, because the latest tag most
+	// likely refers to one of them.
+	sorted := make(versions.List, len(candidates))
+	copy(sorted, candidates)
+	sorted.Sort()
+	for i := len(sorted) - 1; i >= 0; i-- {
+		v := sorted[i]
+		got, err := versionDigest(v)
+		if err != nil {
+			return versions.Unspecified, false, err
+		}
+		if got == want {
+			return v, true, nil
+		}
+	}
+	return versions.Unspecified, false, nil
+}
+
+// maxConcurrentLayerChecks is the maximum number of requests that
+// [findMissingBlobs] will make concurrently on behalf of a single client
+// request.
+const maxConcurrentLayerChecks = 4
 
-			respBytes, err := json.Marshal(respJSON)
+// findMissingBlobs uses the given function to check whether each of the given
+// blobs exists, making up to limit checks concurrently, and returns the set
+// of digests that don't exist.
+//
+// If any check fails then the result is an error from one of the failing
+// checks.
+func findMissingBlobs(digests []ocidist.Digest, limit int, exists func(ocidist.Digest) (bool, error)) (map[ocidist.Digest]bool, error) {
+	var mu sync.Mutex
+	var firstErr error
+	missing := make(map[ocidist.Digest]bool)
+
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for _, digest := range digests {
+		digest := digest
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			ok, err := exists(digest)
+			mu.Lock()
+			defer mu.Unlock()
 			if err != nil {
-				logger.Printf("failed to serialize JSON response: %s", err)
-				resp.WriteHeader(500)
+				if firstErr == nil {
+					firstErr = err
+				}
 				return
 			}
-			resp.Header().Set("Content-Length", strconv.FormatInt(int64(len(respBytes)), 10))
-			resp.Header().Set("Content-Type", "application/json")
-			resp.WriteHeader(200)
-			resp.Write(respBytes)
-			return
+			if !ok {
+				missing[digest] = true
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return missing, nil
+}
+
+// acceptablePackageMediaTypes returns which of the configured package media
+// types to offer a client, in order of preference, given the values of the
+// client's [packageMediaTypesHeader] header.
+//
+// If the client didn't send the header then the result is the configured
+// types in their configured order. Otherwise, the result is those of the
+// configured types that the client listed, in the client's order of
+// preference, which may be empty if the client accepts none of them.
+func acceptablePackageMediaTypes(configured []string, hints []string) []string {
+	if len(hints) == 0 {
+		return configured
+	}
+	allowed := make(map[string]bool, len(configured))
+	for _, ty := range configured {
+		allowed[ty] = true
+	}
+	var ret []string
+	for _, hint := range hints {
+		for _, ty := range strings.Split(hint, ",") {
+			ty = strings.ToLower(strings.TrimSpace(ty))
+			if allowed[ty] {
+				ret = append(ret, ty)
+				delete(allowed, ty) // ignore any duplicates
+			}
 		}
 	}
+	return ret
+}
+
+// packageLayerPolicy describes which manifest layers [selectPackageLayers]
+// may offer as provider packages.
+type packageLayerPolicy struct {
+	// MediaTypes are the acceptable package media types, most preferred
+	// first.
+	MediaTypes []string
+
+	// TrustedAlgorithms are the digest algorithms that packages may use.
+	TrustedAlgorithms []string
+
+	// StrictAnnotations makes a malformed platforms annotation on an
+	// otherwise-acceptable layer an error, instead of causing that layer
+	// to be skipped with a warning.
+	StrictAnnotations bool
+
+	// DuplicatePlatforms decides which layer to select when more than one
+	// layer of the same media type supports the same platform.
+	DuplicatePlatforms config.DuplicatePlatforms
+
+	// MaxPlatforms, if nonzero, is the largest number of platforms that
+	// may be selected.
+	MaxPlatforms int
+}
+
+// tooManyPlatformsError is returned by [selectPackageLayers] when the layers
+// support more platforms than its policy allows.
+type tooManyPlatformsError struct {
+	Limit int
+}
+
+func (err tooManyPlatformsError) Error() string {
+	return fmt.Sprintf("package layers support more than %d platforms", err.Limit)
+}
+
+// platformsAnnotation is the layer annotation that lists the platforms that
+// a provider package supports, separated by commas.
+const platformsAnnotation = "io.terraform.target-platforms"
+
+// selectPackageLayers chooses which of the given manifest layers to offer for
+// each platform, returning a map from platform to layer.
+//
+// Only provider package layers of the policy's media types whose digests use
+// one of its trusted algorithms are considered. If packages of more than
+// one media type support the same platform then the one whose media type
+// is most preferred is selected. If more than one layer of that type claims
+// to support the same platform then the policy's DuplicatePlatforms mode
+// decides which is selected, and a warning is written to the given logger.
+//
+// An error is returned if the policy has StrictAnnotations set and an
+// acceptable layer has a malformed platforms annotation. Otherwise a layer
+// whose annotation is missing or isn't a string is ignored, as is each
+// invalid platform in an annotation, with a warning. An error is also
+// returned if the policy's
+// DuplicatePlatforms mode is [config.DuplicatePlatformsError] and there are
+// duplicate layers for a platform. If the acceptable layers support more
+// than the policy's MaxPlatforms then the error is a
+// [tooManyPlatformsError], which is returned as soon as the limit is
+// exceeded rather than after considering all of the layers.
+func selectPackageLayers(layers []ocidist.ObjectMeta, policy packageLayerPolicy, logger *logging.Logger) (map[string]ocidist.ObjectMeta, error) {
+	preference := make(map[string]int, len(policy.MediaTypes))
+	for i, ty := range policy.MediaTypes {
+		if _, exists := preference[ty]; !exists {
+			preference[ty] = i
+		}
+	}
+
+	ret := make(map[string]ocidist.ObjectMeta)
+	for _, meta := range layers {
+		rank, acceptable := preference[meta.MediaType]
+		if !acceptable {
+			continue // ignore any layer types other than those requested
+		}
+		if err := meta.Digest.CheckAlgorithm(policy.TrustedAlgorithms); err != nil {
+			logger.Printf("ignoring package layer %s: %s", meta.Digest, err)
+			continue
+		}
+		platforms, invalid, err := parsePlatformsAnnotation(meta.Annotations)
+		if err == nil && len(invalid) != 0 && policy.StrictAnnotations {
+			err = fmt.Errorf("%s annotation has invalid platform %q", platformsAnnotation, invalid[0])
+		}
+		if err != nil {
+			if policy.StrictAnnotations {
+				return nil, fmt.Errorf("package layer %s: %w", meta.Digest, err)
+			}
+			logger.Warnf("ignoring package layer %s: %s", meta.Digest, err)
+			continue
+		}
+		for _, platform := range invalid {
+			logger.Warnf("ignoring package layer %s for invalid platform %q in its %s annotation", meta.Digest, platform, platformsAnnotation)
+		}
+		for _, platform := range platforms {
+			existing, exists := ret[platform]
+			if !exists {
+				if policy.MaxPlatforms > 0 && len(ret) >= policy.MaxPlatforms {
+					return nil, tooManyPlatformsError{Limit: policy.MaxPlatforms}
+				}
+				ret[platform] = meta
+				continue
+			}
+			if existing.Digest == meta.Digest {
+				continue // the same package listed twice is harmless
+			}
+			if existingRank := preference[existing.MediaType]; existingRank != rank {
+				if rank < existingRank {
+					ret[platform] = meta
+				}
+				continue
+			}
+			switch policy.DuplicatePlatforms {
+			case config.DuplicatePlatformsError:
+				return nil, fmt.Errorf("package layers %s and %s both support platform %s", existing.Digest, meta.Digest, platform)
+			case config.DuplicatePlatformsFirst:
+				logger.Warnf("multiple package layers for platform %s; ignoring all but the first", platform)
+			case config.DuplicatePlatformsLast:
+				logger.Warnf("multiple package layers for platform %s; ignoring all but the last", platform)
+				ret[platform] = meta
+			default:
+				logger.Warnf("multiple package layers for platform %s; ignoring all but the one with the lowest digest", platform)
+				if meta.Digest < existing.Digest {
+					ret[platform] = meta
+				}
+			}
+		}
+	}
+	return ret, nil
+}
+
+// belowMinVersion returns true if the given version is older than the given
+// minimum version. It always returns false if min is [versions.Unspecified].
+func belowMinVersion(v, min versions.Version) bool {
+	if min == versions.Unspecified {
+		return false
+	}
+	return v.LessThan(min)
+}
+
+// newestVersionTag returns the tag for the newest version among the given
+// tags, ignoring any that aren't version numbers, or false if there are no
+// version tags at all.
+func newestVersionTag(tags []ocidist.Reference) (ocidist.Reference, bool) {
+	var versionList versions.List
+	for _, tag := range tags {
+		if v, err := versions.ParseVersion(tag.String()); err == nil {
+			versionList = append(versionList, v)
+		}
+	}
+	if len(versionList) == 0 {
+		return "", false
+	}
+	tag, err := ocidist.ParseReference(versionList.Newest().String())
+	if err != nil {
+		return "", false
+	}
+	return tag, true
+}
+
+// isYanked returns true if the given manifest has the given annotation with
+// a value marking it as withdrawn, which is any string other than "" or
+// "false". It always returns false if annotation is empty.
+func isYanked(manifest *ocidist.Manifest, annotation string) bool {
+	if annotation == "" {
+		return false
+	}
+	value, ok := manifest.Annotations[annotation].(string)
+	return ok && value != "" && value != "false"
+}
+
+// createdTime returns the timestamp in the given annotation of the given
+// manifest, normalized to RFC 3339 format in UTC, or an empty string if the
+// annotation is absent or isn't a valid RFC 3339 timestamp. It always
+// returns an empty string if annotation is empty.
+func createdTime(manifest *ocidist.Manifest, annotation string) string {
+	if annotation == "" {
+		return ""
+	}
+	value, ok := manifest.Annotations[annotation].(string)
+	if !ok {
+		return ""
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// parsePlatformsAnnotation returns the platforms listed in the
+// [platformsAnnotation] of the given layer annotations, or an error if the
+// annotation is missing or isn't a string.
+//
+// Each platform must be an operating system and an architecture separated
+// by an underscore, such as "linux_amd64". Any entries that aren't are
+// returned separately as invalid, so that the caller can decide whether to
+// ignore just those entries or the whole annotation.
+func parsePlatformsAnnotation(annotations map[string]any) (platforms, invalid []string, err error) {
+	raw, exists := annotations[platformsAnnotation]
+	if !exists {
+		return nil, nil, fmt.Errorf("no %s annotation", platformsAnnotation)
+	}
+	str, ok := raw.(string)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s annotation must be a string, not %T", platformsAnnotation, raw)
+	}
+	for _, platform := range strings.Split(str, ",") {
+		os, arch, ok := strings.Cut(platform, "_")
+		if !ok || os == "" || arch == "" {
+			invalid = append(invalid, platform)
+			continue
+		}
+		platforms = append(platforms, platform)
+	}
+	return platforms, invalid, nil
+}
+
+// packageHashesAnnotation is the layer annotation that lists additional
+// hashes of a provider package in Terraform's own hash formats, like
+// "h1:...", separated by commas.
+const packageHashesAnnotation = "io.terraform.package-hashes"
+
+// packageHashes returns the hashes of the given package layer in each of the
+// given Terraform hash schemes, in the order of the schemes, for use in the
+// "hashes" property of a version response.
+//
+// Terraform's own "zh" ("ziphash") scheme happens to be exactly compatible
+// with OCI Distribution's sha256 scheme, aside from the prefix, so a zip
+// package with a sha256 digest always has a "zh" hash. Any other hashes
+// come from the layer's [packageHashesAnnotation], which allows including
+// hashes that can't be derived from the digest, such as "h1" hashes or a
+// "zh" hash for a layer with a sha512 digest. A scheme may have more than
+// one hash, in which case Terraform accepts a package matching any of them.
+//
+// If the annotation is malformed then the result includes only the hashes
+// derived from the digest, along with an error describing the problem.
+func packageHashes(meta ocidist.ObjectMeta, schemes []string) ([]string, error) {
+	// The "zh" scheme is defined only for zip archives, so other package
+	// formats can't have any "zh" hashes.
+	isZip := meta.MediaType == providerPackageMediaType
+	var candidates []string
+	if isZip && meta.Digest.Algorithm() == "sha256" {
+		candidates = append(candidates, "zh:"+meta.Digest.Encoded())
+	}
+
+	var err error
+	if raw, exists := meta.Annotations[packageHashesAnnotation]; exists {
+		var annotated []string
+		annotated, err = parsePackageHashes(raw)
+		if err == nil {
+			for _, hash := range annotated {
+				if strings.HasPrefix(hash, "zh:") && !isZip {
+					err = fmt.Errorf("zh hash %q for a package that isn't a zip archive", hash)
+					break
+				}
+			}
+		}
+		if err == nil {
+			candidates = append(candidates, annotated...)
+		}
+	}
+
+	var ret []string
+	seen := make(map[string]bool)
+	for _, scheme := range schemes {
+		for _, hash := range candidates {
+			if strings.HasPrefix(hash, scheme+":") && !seen[hash] {
+				seen[hash] = true
+				ret = append(ret, hash)
+			}
+		}
+	}
+	return ret, err
+}
+
+// parsePackageHashes parses the value of a [packageHashesAnnotation],
+// returning an error if it isn't a comma-separated list of hashes in
+// Terraform's "zh" or "h1" formats.
+func parsePackageHashes(raw any) ([]string, error) {
+	str, ok := raw.(string)
+	if !ok {
+		return nil, fmt.Errorf("must be a string, not %T", raw)
+	}
+	ret := strings.Split(str, ",")
+	for _, hash := range ret {
+		scheme, value, _ := strings.Cut(hash, ":")
+		switch scheme {
+		case "zh":
+			if b, err := hex.DecodeString(value); err != nil || len(b) != sha256.Size || strings.ToLower(value) != value {
+				return nil, fmt.Errorf("invalid zh hash %q", hash)
+			}
+		case "h1":
+			if b, err := base64.StdEncoding.DecodeString(value); err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("invalid h1 hash %q", hash)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported hash %q", hash)
+		}
+	}
+	return ret, nil
+}
+
+// normalizeRequestPath collapses any repeated slashes in the given escaped
+// request path and removes any trailing slash, so that the result splits
+// into only non-empty segments after the leading slash.
+//
+// It returns an error if any segment is "." or "..", whether literal or
+// percent-encoded, because the protocol never uses those and so they can
+// only be attempts to traverse out of the service's path. It also returns
+// an error if any segment has invalid percent-encoding, so that later steps
+// can always decode the segments of the result.
+func normalizeRequestPath(escapedPath string) (string, error) {
+	var b strings.Builder
+	for _, seg := range strings.Split(escapedPath, "/") {
+		if seg == "" {
+			continue
+		}
+		unescaped, err := url.PathUnescape(seg)
+		if err != nil {
+			return "", fmt.Errorf("path segment %q has invalid percent-encoding", seg)
+		}
+		if unescaped == "." || unescaped == ".." {
+			return "", fmt.Errorf("path must not contain %q segments", unescaped)
+		}
+		b.WriteByte('/')
+		b.WriteString(seg)
+	}
+	return b.String(), nil
+}
+
+// normalizeProviderAddr returns the canonical form of the given escaped path
+// segments representing a provider address, in the same way that Terraform
+// normalizes provider addresses: the segments are percent-decoded and then
+// letters are converted to lowercase, because provider addresses are
+// case-insensitive.
+//
+// The result isn't necessarily a valid provider address, because decoding
+// may produce characters that aren't allowed in a namespace part, like "/".
+//
+// Terraform always uses the ASCII ("punycode") form of internationalized
+// hostnames, so a hostname with non-ASCII characters is an error, as is any
+// other segment with non-ASCII characters.
+func normalizeProviderAddr(addrParts []string) ([]string, error) {
+	ret := make([]string, len(addrParts))
+	for i, part := range addrParts {
+		unescaped, err := url.PathUnescape(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid escaping in provider address")
+		}
+		for j := 0; j < len(unescaped); j++ {
+			if unescaped[j] < 0x80 {
+				continue
+			}
+			if i == 0 {
+				return nil, fmt.Errorf("hostname %q must be written in its ASCII form, with any internationalized labels encoded as punycode (\"xn--\")", unescaped)
+			}
+			return nil, fmt.Errorf("provider address segment %q must contain only ASCII characters", unescaped)
+		}
+		ret[i] = strings.ToLower(unescaped)
+	}
+	return ret, nil
+}
+
+// defaultProviderHostname and defaultProviderNamespace are what Terraform
+// assumes for the parts of a provider address that are omitted from its
+// shorthand forms.
+const (
+	defaultProviderHostname  = "registry.terraform.io"
+	defaultProviderNamespace = "hashicorp"
+)
+
+// canonicalProviderAddr returns the canonical form of the provider address
+// represented by the given escaped path segments, if they represent a valid
+// provider address that isn't already in its canonical form, or false
+// otherwise. The result isn't necessarily a valid provider address, in the
+// same way as for normalizeProviderAddr.
+//
+// In addition to the normalization of [normalizeProviderAddr], this accepts
+// Terraform's shorthand forms of provider addresses, with only a namespace
+// and type or only a type, and removes any trailing dot from the hostname.
+func canonicalProviderAddr(escaped []string) ([]string, bool) {
+	var full []string
+	switch len(escaped) {
+	case 1:
+		full = []string{defaultProviderHostname, defaultProviderNamespace, escaped[0]}
+	case 2:
+		full = []string{defaultProviderHostname, escaped[0], escaped[1]}
+	case 3:
+		full = escaped
+	default:
+		return nil, false
+	}
+	ret, err := normalizeProviderAddr(full)
+	if err != nil {
+		return nil, false
+	}
+	ret[0] = strings.TrimSuffix(ret[0], ".")
+	for _, part := range ret {
+		if part == "" {
+			return nil, false
+		}
+	}
+
+	if len(escaped) == 3 {
+		changed := false
+		for i, part := range ret {
+			if url.PathEscape(part) != escaped[i] {
+				changed = true
+			}
+		}
+		if !changed {
+			return nil, false
+		}
+	}
+	return ret, true
 }
 
 func ociDistNamespaceFromPathSegments(prefix ocidist.Namespace, segs []string) (ocidist.Namespace, error) {
@@ -344,21 +2063,129 @@ func ociDistNamespaceFromPathSegments(prefix ocidist.Namespace, segs []string) (
 	for i, seg := range segs {
 		part, err := ocidist.ParseNamespacePart(seg)
 		if err != nil {
-			return nil, fmt.Errorf("segment %d: %w", i, err)
+			return nil, fmt.Errorf("segment %d (%q): %w", i, seg, err)
 		}
 		ret[i] = part
 	}
 	return prefix.Append(ret...), nil
 }
 
-func propagateOCIDistError(err error, resp http.ResponseWriter) {
+// providerNamespace returns the namespace in the origin registry for the
+// provider with the given normalized address parts, under the given prefix
+// and according to the given address layout, or an error if the address
+// can't be represented as a namespace.
+//
+// If the layout joins more than one part of the address into a single
+// namespace part then none of the address parts may contain an underscore,
+// because the layout uses underscores to separate them. Terraform never
+// allows underscores in provider addresses anyway, but without this check
+// two different addresses could map to the same namespace.
+func providerNamespace(prefix ocidist.Namespace, layout []string, addrParts []string) (ocidist.Namespace, error) {
+	if layoutJoinsParts(layout) {
+		for _, part := range addrParts {
+			if strings.Contains(part, "_") {
+				return nil, fmt.Errorf("provider address segment %q must not contain underscores", part)
+			}
+		}
+	}
+	return ociDistNamespaceFromPathSegments(prefix, layoutProviderAddr(layout, addrParts))
+}
+
+// layoutJoinsParts returns true if any part of the given address layout
+// includes more than one placeholder.
+func layoutJoinsParts(layout []string) bool {
+	for _, part := range layout {
+		if strings.Count(part, "{") > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// layoutProviderAddr returns the namespace parts for the provider with the
+// given normalized address parts according to the given address layout, or
+// the address parts unchanged if the layout is nil.
+//
+// The result may include parts that aren't valid namespace part syntax, if
+// the address itself does, which ociDistNamespaceFromPathSegments detects.
+func layoutProviderAddr(layout []string, addrParts []string) []string {
+	if layout == nil || len(addrParts) != 3 {
+		return addrParts
+	}
+	replacer := strings.NewReplacer(
+		"{hostname}", addrParts[0],
+		"{namespace}", addrParts[1],
+		"{type}", addrParts[2],
+	)
+	ret := make([]string, len(layout))
+	for i, part := range layout {
+		ret[i] = replacer.Replace(part)
+	}
+	return ret
+}
+
+// metadataCacheKey returns a key for caching metadata about the given subject
+// that was fetched on behalf of a client that sent the given Authorization
+// header value.
+//
+// The Authorization header contributes to the key so that a client can never
+// be served cached metadata that was fetched using another client's
+// credentials.
+func metadataCacheKey(subject string, authHeader string) string {
+	authHash := sha256.Sum256([]byte(authHeader))
+	return subject + "#" + hex.EncodeToString(authHash[:])
+}
+
+// backendUnavailable returns true if the given error suggests that the
+// origin registry is currently unavailable, as opposed to it returning a
+// definitive answer such as "not found".
+func backendUnavailable(err error) bool {
+	if _, ok := err.(ocidist.RequestError); ok {
+		return true
+	}
+	return err == ocidist.ErrBadGateway || err == ocidist.ErrTimeout || err == ocidist.ErrBackendTimeout
+}
+
+// markStaleResponse adds a header to the response indicating that it was
+// built from cached data that would normally be considered too old to use.
+func markStaleResponse(resp http.ResponseWriter) {
+	resp.Header().Set("Warning", `110 - "Response is Stale"`)
+}
+
+// propagateOCIDistError writes a response describing the given error from
+// the origin registry client.
+func propagateOCIDistError(err error, resp http.ResponseWriter, logger *logging.Logger) {
+	var breakerErr breakerOpenError
+	if errors.As(err, &breakerErr) {
+		// Round up so that we never tell the client to retry before the
+		// breaker would allow it.
+		secs := int64((breakerErr.RetryAfter + time.Second - 1) / time.Second)
+		resp.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+		resp.WriteHeader(503)
+		return
+	}
+
 	switch err {
 	case ocidist.ErrBadGateway:
 		resp.WriteHeader(502)
+		return
 	case ocidist.ErrUnauthorized:
 		resp.WriteHeader(401)
+		return
 	case ocidist.ErrTimeout:
-		resp.WriteHeader(504)
+		// Our own timeout for requests to the origin registry elapsed,
+		// which might mean that the timeout is too short.
+		logger.Warnf("gave up waiting for the origin registry after the configured backend timeout")
+		backendTimeouts.Add("proxy", 1)
+		writeTextResponse(resp, 504, "Timed out waiting for the origin registry to respond.\n")
+		return
+	case ocidist.ErrBackendTimeout:
+		// The origin registry responded, but reported that it timed out
+		// itself, and so the problem is on the registry's side.
+		logger.Warnf("the origin registry reported a timeout")
+		backendTimeouts.Add("backend", 1)
+		writeTextResponse(resp, 504, "The origin registry reported a timeout.\n")
+		return
 	}
 
 	switch err.(type) {
@@ -370,3 +2197,12 @@ func propagateOCIDistError(err error, resp http.ResponseWriter) {
 		resp.WriteHeader(502)
 	}
 }
+
+// writeTextResponse writes a response with the given status code and a
+// plain text body.
+func writeTextResponse(resp http.ResponseWriter, status int, msg string) {
+	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	resp.Header().Set("Content-Length", strconv.Itoa(len(msg)))
+	resp.WriteHeader(status)
+	io.WriteString(resp, msg)
+}
@@ -0,0 +1,3040 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apparentlymart/go-versions/versions"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/logging"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/querysecret"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestProviderMirrorSplitLayout(t *testing.T) {
+	pkg := []byte("fake provider package")
+	pkgDigest := testDigest(pkg)
+
+	registry := newFakeRegistry()
+	registry.addManifest(
+		"terraform-providers/example.com/foo/bar/meta", "1.0.0",
+		testProviderManifest(ocidist.ObjectMeta{
+			MediaType: "application/vnd.hashicorp.terraform.provider-package+zip",
+			Digest:    pkgDigest,
+			Size:      int64(len(pkg)),
+			Annotations: map[string]any{
+				"io.terraform.target-platforms": "linux_amd64",
+			},
+		}),
+	)
+	registry.addBlob("terraform-providers/example.com/foo/bar/pkg", pkg)
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.MetadataNameSuffix = ocidist.MustParseNamespace("meta")
+	mirror.PackageNameSuffix = ocidist.MustParseNamespace("pkg")
+	mirrorServer := newTestMirrorServer(t, mirror)
+	defer mirrorServer.Close()
+
+	t.Run("index", func(t *testing.T) {
+		var got map[string]any
+		status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/index.json", &got)
+		if status != 200 {
+			t.Fatalf("wrong status %d", status)
+		}
+		want := map[string]any{
+			"versions": map[string]any{
+				"1.0.0": map[string]any{},
+			},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("wrong response\n%s", diff)
+		}
+	})
+	t.Run("version", func(t *testing.T) {
+		var got map[string]any
+		status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/1.0.0.json", &got)
+		if status != 200 {
+			t.Fatalf("wrong status %d", status)
+		}
+		want := map[string]any{
+			"archives": map[string]any{
+				"linux_amd64": map[string]any{
+					"url":    registryServer.URL + "/v2/terraform-providers/example.com/foo/bar/pkg/blobs/" + pkgDigest.String(),
+					"hashes": []any{"zh:" + pkgDigest.Encoded()},
+				},
+			},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("wrong response\n%s", diff)
+		}
+	})
+}
+
+func TestProviderMirrorArtifactChecking(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest(
+		"terraform-providers/example.com/foo/bar", "1.0.0",
+		testProviderManifest(),
+	)
+	otherArtifact := testProviderManifest()
+	otherArtifact.Config.MediaType = "application/vnd.example.other.config.v1+json"
+	registry.addManifest("terraform-providers/example.com/foo/bar", "2.0.0", otherArtifact)
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	tests := map[config.ArtifactChecking]struct {
+		wantVersions    map[string]any
+		wantOtherStatus int
+	}{
+		config.ArtifactCheckingStrict: {
+			wantVersions: map[string]any{
+				"1.0.0": map[string]any{},
+				"2.0.0": map[string]any{},
+			},
+			wantOtherStatus: 406,
+		},
+		config.ArtifactCheckingLenient: {
+			wantVersions: map[string]any{
+				"1.0.0": map[string]any{},
+			},
+			wantOtherStatus: 404,
+		},
+	}
+	for mode, test := range tests {
+		test := test
+		t.Run(string(mode), func(t *testing.T) {
+			mirror := newTestProviderMirror(t, registryServer.URL)
+			mirror.ArtifactChecking = mode
+			mirrorServer := newTestMirrorServer(t, mirror)
+			defer mirrorServer.Close()
+
+			var got map[string]any
+			status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/index.json", &got)
+			if status != 200 {
+				t.Fatalf("wrong index status %d", status)
+			}
+			want := map[string]any{"versions": test.wantVersions}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("wrong index response\n%s", diff)
+			}
+
+			var ignored map[string]any
+			status = getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/1.0.0.json", &ignored)
+			if status != 200 {
+				t.Errorf("wrong status %d for provider version", status)
+			}
+			status = getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/2.0.0.json", &ignored)
+			if status != test.wantOtherStatus {
+				t.Errorf("wrong status %d for other artifact; want %d", status, test.wantOtherStatus)
+			}
+		})
+	}
+}
+
+func TestCheckProviderArtifact(t *testing.T) {
+	const required = "application/vnd.hashicorp.terraform-provider"
+	withArtifactType := func(artifactType, configType string) *ocidist.Manifest {
+		m := testProviderManifest()
+		m.ArtifactType = artifactType
+		m.Config.MediaType = configType
+		return m
+	}
+	tests := map[string]struct {
+		manifest *ocidist.Manifest
+		required string
+		wantOK   bool
+	}{
+		"config media type only": {
+			withArtifactType("", providerConfigMediaType), "", true,
+		},
+		"other config media type": {
+			withArtifactType("", "application/vnd.example.other.config.v1+json"), "", false,
+		},
+		"matching artifact type": {
+			withArtifactType(required, "application/vnd.oci.empty.v1+json"), required, true,
+		},
+		"other artifact type": {
+			withArtifactType("application/vnd.example.other", providerConfigMediaType), required, false,
+		},
+		"no artifact type with matching config media type": {
+			withArtifactType("", required), required, true,
+		},
+		"no artifact type with provider config media type": {
+			withArtifactType("", providerConfigMediaType), required, false,
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			err := checkProviderArtifact(test.manifest, test.required)
+			if gotOK := err == nil; gotOK != test.wantOK {
+				t.Errorf("wrong result %t; want %t (error: %v)", gotOK, test.wantOK, err)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorRequiredArtifactType(t *testing.T) {
+	const required = "application/vnd.hashicorp.terraform-provider"
+	registry := newFakeRegistry()
+	matching := testProviderManifest()
+	matching.ArtifactType = required
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.0.0", matching)
+	// This one is a provider release by its config media type, but doesn't
+	// declare the required artifact type.
+	registry.addManifest("terraform-providers/example.com/foo/bar", "2.0.0", testProviderManifest())
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	tests := map[config.ArtifactChecking]struct {
+		wantVersions    map[string]any
+		wantOtherStatus int
+	}{
+		config.ArtifactCheckingStrict: {
+			wantVersions: map[string]any{
+				"1.0.0": map[string]any{},
+				"2.0.0": map[string]any{},
+			},
+			wantOtherStatus: 406,
+		},
+		config.ArtifactCheckingLenient: {
+			wantVersions: map[string]any{
+				"1.0.0": map[string]any{},
+			},
+			wantOtherStatus: 404,
+		},
+	}
+	for mode, test := range tests {
+		test := test
+		t.Run(string(mode), func(t *testing.T) {
+			mirror := newTestProviderMirror(t, registryServer.URL)
+			mirror.ArtifactChecking = mode
+			mirror.RequiredArtifactType = required
+			mirrorServer := newTestMirrorServer(t, mirror)
+			defer mirrorServer.Close()
+
+			var got map[string]any
+			status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/index.json", &got)
+			if status != 200 {
+				t.Fatalf("wrong index status %d", status)
+			}
+			want := map[string]any{"versions": test.wantVersions}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("wrong index response\n%s", diff)
+			}
+
+			var ignored map[string]any
+			status = getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/1.0.0.json", &ignored)
+			if status != 200 {
+				t.Errorf("wrong status %d for matching artifact type", status)
+			}
+			status = getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/2.0.0.json", &ignored)
+			if status != test.wantOtherStatus {
+				t.Errorf("wrong status %d for missing artifact type; want %d", status, test.wantOtherStatus)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorUnexpectedManifestTypes(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.0.0", testProviderManifest())
+	otherArtifact := testProviderManifest()
+	otherArtifact.Config.MediaType = "application/vnd.example.other.config.v1+json"
+	registry.addManifest("terraform-providers/example.com/foo/bar", "2.0.0", otherArtifact)
+	index := &ocidist.Manifest{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.index.v1+json",
+	}
+	registry.addManifest("terraform-providers/example.com/foo/bar", "3.0.0", index)
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	type versionResult struct {
+		Status int
+		Body   string
+	}
+	tests := map[config.ArtifactChecking]struct {
+		wantVersions map[string]any
+		wantOther    versionResult
+		wantIndex    versionResult
+	}{
+		config.ArtifactCheckingStrict: {
+			wantVersions: map[string]any{
+				"1.0.0": map[string]any{},
+				"2.0.0": map[string]any{},
+				"3.0.0": map[string]any{},
+			},
+			wantOther: versionResult{
+				Status: 406,
+				Body:   "Version 2.0.0 is not a Terraform provider release: its manifest has unsupported config media type application/vnd.example.other.config.v1+json.\n",
+			},
+			wantIndex: versionResult{
+				Status: 502,
+				Body:   "Version 3.0.0 is published as an image index, such as a multi-platform image, but each provider version tag must refer to a single manifest.\n",
+			},
+		},
+		config.ArtifactCheckingLenient: {
+			wantVersions: map[string]any{
+				"1.0.0": map[string]any{},
+			},
+			wantOther: versionResult{Status: 404},
+			wantIndex: versionResult{Status: 404},
+		},
+	}
+	for mode, test := range tests {
+		test := test
+		t.Run(string(mode), func(t *testing.T) {
+			mirror := newTestProviderMirror(t, registryServer.URL)
+			mirror.ArtifactChecking = mode
+			mirrorServer := newTestMirrorServer(t, mirror)
+			defer mirrorServer.Close()
+
+			var got map[string]any
+			status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/index.json", &got)
+			if status != 200 {
+				t.Fatalf("wrong index status %d", status)
+			}
+			want := map[string]any{"versions": test.wantVersions}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("wrong index response\n%s", diff)
+			}
+
+			getVersion := func(version string) versionResult {
+				t.Helper()
+				resp, err := http.Get(mirrorServer.URL + "/mirror/example.com/foo/bar/" + version + ".json")
+				if err != nil {
+					t.Fatalf("request failed: %s", err)
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatalf("failed to read body: %s", err)
+				}
+				return versionResult{Status: resp.StatusCode, Body: string(body)}
+			}
+			if diff := cmp.Diff(test.wantOther, getVersion("2.0.0")); diff != "" {
+				t.Errorf("wrong response for wrong config media type\n%s", diff)
+			}
+			if diff := cmp.Diff(test.wantIndex, getVersion("3.0.0")); diff != "" {
+				t.Errorf("wrong response for image index\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorExternalURL(t *testing.T) {
+	pkgDigest := testDigest([]byte("package"))
+	registry := newFakeRegistry()
+	registry.addManifest(
+		"terraform-providers/example.com/foo/bar", "1.0.0",
+		testProviderManifest(ocidist.ObjectMeta{
+			MediaType: "application/vnd.hashicorp.terraform.provider-package+zip",
+			Digest:    pkgDigest,
+			Size:      7,
+			Annotations: map[string]any{
+				"io.terraform.target-platforms": "linux_amd64",
+			},
+		}),
+	)
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.ProxyPackages = true
+	mirror.ExternalURL = &url.URL{Scheme: "https", Host: "providers.example.net", Path: "/tf/"}
+	shared := newTestSharedState()
+	shared.secreter = querysecret.NewSecreter([32]byte{})
+	mirrorServer := newTestMirrorServerShared(t, mirror, shared)
+	defer mirrorServer.Close()
+
+	var got struct {
+		Archives map[string]struct {
+			URL string `json:"url"`
+		} `json:"archives"`
+	}
+	status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/1.0.0.json", &got)
+	if status != 200 {
+		t.Fatalf("wrong status %d", status)
+	}
+	gotURL, err := url.Parse(got.Archives["linux_amd64"].URL)
+	if err != nil {
+		t.Fatalf("invalid download URL: %s", err)
+	}
+	if gotURL.RawQuery == "" {
+		t.Errorf("download URL has no query string")
+	}
+	gotURL.RawQuery = ""
+	if got, want := gotURL.String(), "https://providers.example.net/tf/example.com/foo/bar/download"; got != want {
+		t.Errorf("wrong download URL %q; want %q", got, want)
+	}
+}
+
+func TestProviderMirrorPackageResponseHeaders(t *testing.T) {
+	pkg := []byte("package")
+	registry := newFakeRegistry()
+	registry.addManifest(
+		"terraform-providers/example.com/foo/bar", "1.0.0",
+		testProviderManifest(ocidist.ObjectMeta{
+			MediaType: "application/vnd.hashicorp.terraform.provider-package+zip",
+			Digest:    testDigest(pkg),
+			Size:      int64(len(pkg)),
+			Annotations: map[string]any{
+				"io.terraform.target-platforms": "linux_amd64",
+			},
+		}),
+	)
+	registry.addBlob("terraform-providers/example.com/foo/bar", pkg)
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	// These are the headers that the fake registry returns for a blob
+	// download, aside from Content-Length.
+	backendHeaders := map[string]string{
+		"Content-Type":        "application/octet-stream",
+		"Content-Disposition": `attachment; filename="blob"`,
+	}
+	tests := map[string]struct {
+		allowed []string
+		want    map[string]bool
+	}{
+		"default": {
+			config.DefaultPackageResponseHeaders,
+			map[string]bool{
+				"Content-Type":        true,
+				"Content-Disposition": false,
+			},
+		},
+		"custom": {
+			[]string{"Content-Disposition"},
+			map[string]bool{
+				"Content-Type":        false,
+				"Content-Disposition": true,
+			},
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			mirror := newTestProviderMirror(t, registryServer.URL)
+			mirror.ProxyPackages = true
+			mirror.PackageResponseHeaders = test.allowed
+			shared := newTestSharedState()
+			shared.secreter = querysecret.NewSecreter([32]byte{})
+			mirrorServer := newTestMirrorServerShared(t, mirror, shared)
+			defer mirrorServer.Close()
+
+			var version struct {
+				Archives map[string]struct {
+					URL string `json:"url"`
+				} `json:"archives"`
+			}
+			status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/1.0.0.json", &version)
+			if status != 200 {
+				t.Fatalf("wrong status %d for version", status)
+			}
+			resp, err := http.Get(mirrorServer.URL + version.Archives["linux_amd64"].URL)
+			if err != nil {
+				t.Fatalf("download failed: %s", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != 200 {
+				t.Fatalf("wrong status %d for download", resp.StatusCode)
+			}
+
+			// The HTTP server may generate some of these headers itself,
+			// so we check only whether the registry's values were relayed.
+			for name, want := range test.want {
+				got := resp.Header.Get(name) == backendHeaders[name]
+				if got != want {
+					t.Errorf("wrong relaying of %s: got %t, want %t (value %q)", name, got, want, resp.Header.Get(name))
+				}
+			}
+		})
+	}
+}
+
+func TestProviderMirrorForwardQueryParams(t *testing.T) {
+	pkg := []byte("package")
+	registry := newFakeRegistry()
+	registry.addManifest(
+		"terraform-providers/example.com/foo/bar", "1.0.0",
+		testProviderManifest(ocidist.ObjectMeta{
+			MediaType: "application/vnd.hashicorp.terraform.provider-package+zip",
+			Digest:    testDigest(pkg),
+			Size:      int64(len(pkg)),
+			Annotations: map[string]any{
+				"io.terraform.target-platforms": "linux_amd64",
+			},
+		}),
+	)
+	registry.addBlob("terraform-providers/example.com/foo/bar", pkg)
+	var blobQuery url.Values
+	registryServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.Path, "/blobs/") {
+			blobQuery = req.URL.Query()
+		}
+		registry.ServeHTTP(resp, req)
+	}))
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.ProxyPackages = true
+	mirror.ForwardQueryParams = []string{"sig"}
+	shared := newTestSharedState()
+	shared.secreter = querysecret.NewSecreter([32]byte{})
+	mirrorServer := newTestMirrorServerShared(t, mirror, shared)
+	defer mirrorServer.Close()
+
+	var version struct {
+		Archives map[string]struct {
+			URL string `json:"url"`
+		} `json:"archives"`
+	}
+	status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/1.0.0.json", &version)
+	if status != 200 {
+		t.Fatalf("wrong status %d for version", status)
+	}
+	downloadURL := mirrorServer.URL + version.Archives["linux_amd64"].URL
+
+	tests := map[string]struct {
+		extra string
+		want  url.Values
+	}{
+		"none":     {"", url.Values{}},
+		"listed":   {"&sig=abc", url.Values{"sig": {"abc"}}},
+		"unlisted": {"&other=abc", url.Values{}},
+		"both":     {"&other=abc&sig=def", url.Values{"sig": {"def"}}},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			blobQuery = nil
+			resp, err := http.Get(downloadURL + test.extra)
+			if err != nil {
+				t.Fatalf("download failed: %s", err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("failed to read body: %s", err)
+			}
+			if resp.StatusCode != 200 {
+				t.Fatalf("wrong status %d for download", resp.StatusCode)
+			}
+			if !bytes.Equal(body, pkg) {
+				t.Errorf("wrong package content %q", body)
+			}
+			if diff := cmp.Diff(test.want, blobQuery); diff != "" {
+				t.Errorf("wrong query for origin registry blob request\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorDownloadMetrics(t *testing.T) {
+	pkg := []byte("package content for metrics")
+	registry := newFakeRegistry()
+	registry.addManifest(
+		"terraform-providers/example.com/foo/bar", "1.0.0",
+		testProviderManifest(ocidist.ObjectMeta{
+			MediaType: "application/vnd.hashicorp.terraform.provider-package+zip",
+			Digest:    testDigest(pkg),
+			Size:      int64(len(pkg)),
+			Annotations: map[string]any{
+				"io.terraform.target-platforms": "linux_amd64",
+			},
+		}),
+	)
+	registry.addBlob("terraform-providers/example.com/foo/bar", pkg)
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.ProxyPackages = true
+	shared := newTestSharedState()
+	shared.secreter = querysecret.NewSecreter([32]byte{})
+	mirrorServer := newTestMirrorServerShared(t, mirror, shared)
+	defer mirrorServer.Close()
+
+	var version struct {
+		Archives map[string]struct {
+			URL string `json:"url"`
+		} `json:"archives"`
+	}
+	status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/1.0.0.json", &version)
+	if status != 200 {
+		t.Fatalf("wrong status %d for version", status)
+	}
+
+	const providerKey = "mirror:example.com/foo/bar"
+	bytesBefore := expvarIntValue(downloadBytes.Get("mirror"))
+	providerBytesBefore := expvarIntValue(providerDownloadBytes.vars.Get(providerKey))
+	downloadsBefore := expvarIntValue(providerDownloads.vars.Get(providerKey))
+
+	resp, err := http.Get(mirrorServer.URL + version.Archives["linux_amd64"].URL)
+	if err != nil {
+		t.Fatalf("download failed: %s", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to read body: %s", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("wrong status %d for download", resp.StatusCode)
+	}
+	if !bytes.Equal(body, pkg) {
+		t.Errorf("wrong package content %q", body)
+	}
+
+	if got, want := expvarIntValue(downloadBytes.Get("mirror"))-bytesBefore, int64(len(pkg)); got != want {
+		t.Errorf("service byte count increased by %d; want %d", got, want)
+	}
+	if got, want := expvarIntValue(providerDownloadBytes.vars.Get(providerKey))-providerBytesBefore, int64(len(pkg)); got != want {
+		t.Errorf("provider byte count increased by %d; want %d", got, want)
+	}
+	if got := expvarIntValue(providerDownloads.vars.Get(providerKey)) - downloadsBefore; got != 1 {
+		t.Errorf("provider download count increased by %d; want 1", got)
+	}
+}
+
+func TestProviderMirrorFallbackOrigin(t *testing.T) {
+	pkg := []byte("package")
+	registry := newFakeRegistry()
+	registry.addManifest(
+		"terraform-providers/example.com/foo/bar", "1.0.0",
+		testProviderManifest(ocidist.ObjectMeta{
+			MediaType: "application/vnd.hashicorp.terraform.provider-package+zip",
+			Digest:    testDigest(pkg),
+			Size:      int64(len(pkg)),
+			Annotations: map[string]any{
+				"io.terraform.target-platforms": "linux_amd64",
+			},
+		}),
+	)
+	registry.addBlob("terraform-providers/example.com/foo/bar", pkg)
+	fallbackServer := httptest.NewServer(registry)
+	defer fallbackServer.Close()
+	primaryServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primaryServer.Close()
+
+	mirror := newTestProviderMirror(t, primaryServer.URL)
+	mirror.FallbackOriginURL = newTestProviderMirror(t, fallbackServer.URL).OriginURL
+	mirror.ProxyPackages = true
+	shared := newTestSharedState()
+	shared.secreter = querysecret.NewSecreter([32]byte{})
+	mirrorServer := newTestMirrorServerShared(t, mirror, shared)
+	defer mirrorServer.Close()
+
+	var version struct {
+		Archives map[string]struct {
+			URL string `json:"url"`
+		} `json:"archives"`
+	}
+	status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/1.0.0.json", &version)
+	if status != 200 {
+		t.Fatalf("wrong status %d for version", status)
+	}
+
+	resp, err := http.Get(mirrorServer.URL + version.Archives["linux_amd64"].URL)
+	if err != nil {
+		t.Fatalf("download failed: %s", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to read body: %s", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("wrong status %d for download", resp.StatusCode)
+	}
+	if !bytes.Equal(body, pkg) {
+		t.Errorf("wrong package content %q", body)
+	}
+}
+
+func TestProviderMirrorYankedVersions(t *testing.T) {
+	const annotation = "io.terraform.yanked"
+	registry := newFakeRegistry()
+	yanked := func(value string) *ocidist.Manifest {
+		ret := testProviderManifest()
+		ret.Annotations = map[string]any{annotation: value}
+		return ret
+	}
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.0.0", testProviderManifest())
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.1.0", yanked("true"))
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.2.0", yanked("false"))
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.3.0", yanked("Withdrawn due to a security issue."))
+	var manifestRequests int64
+	registryServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.Path, "/manifests/") {
+			atomic.AddInt64(&manifestRequests, 1)
+		}
+		registry.ServeHTTP(resp, req)
+	}))
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.YankedAnnotation = annotation
+	mirror.CacheTTL = time.Minute
+	mirrorServer := newTestMirrorServer(t, mirror)
+	defer mirrorServer.Close()
+
+	want := map[string]any{
+		"versions": map[string]any{
+			"1.0.0": map[string]any{},
+			"1.2.0": map[string]any{},
+		},
+	}
+	for i := 0; i < 2; i++ {
+		var got map[string]any
+		status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/index.json", &got)
+		if status != 200 {
+			t.Fatalf("wrong index status %d", status)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("wrong index response\n%s", diff)
+		}
+	}
+	if got, want := atomic.LoadInt64(&manifestRequests), int64(4); got != want {
+		t.Errorf("made %d manifest requests; want %d, with the second index response using the cache", got, want)
+	}
+}
+
+func TestProviderMirrorIndexManifestFetches(t *testing.T) {
+	registry := newFakeRegistry()
+	for i := 0; i < 10; i++ {
+		registry.addManifest("terraform-providers/example.com/foo/bar", fmt.Sprintf("1.%d.0", i), testProviderManifest())
+	}
+	var inFlight, maxInFlight int64
+	registryServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.Path, "/manifests/") {
+			n := atomic.AddInt64(&inFlight, 1)
+			defer atomic.AddInt64(&inFlight, -1)
+			for {
+				prev := atomic.LoadInt64(&maxInFlight)
+				if n <= prev || atomic.CompareAndSwapInt64(&maxInFlight, prev, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		registry.ServeHTTP(resp, req)
+	}))
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.YankedAnnotation = "io.terraform.yanked"
+	mirrorServer := newTestMirrorServer(t, mirror)
+	defer mirrorServer.Close()
+
+	var got struct {
+		Versions map[string]any `json:"versions"`
+	}
+	if status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/index.json", &got); status != 200 {
+		t.Fatalf("wrong status %d", status)
+	}
+	if got, want := len(got.Versions), 10; got != want {
+		t.Fatalf("wrong number of versions %d; want %d", got, want)
+	}
+	maxSeen := atomic.LoadInt64(&maxInFlight)
+	if maxSeen < 2 {
+		t.Errorf("made manifest requests one at a time; want them concurrent")
+	}
+	if maxSeen > maxConcurrentManifestFetches {
+		t.Errorf("made %d manifest requests at once; want at most %d", maxSeen, maxConcurrentManifestFetches)
+	}
+}
+
+func TestProviderMirrorCreatedAnnotation(t *testing.T) {
+	const annotation = "org.opencontainers.image.created"
+	registry := newFakeRegistry()
+	created := func(value string) *ocidist.Manifest {
+		ret := testProviderManifest()
+		ret.Annotations = map[string]any{annotation: value}
+		return ret
+	}
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.0.0", testProviderManifest())
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.1.0", created("2023-01-02T03:04:05Z"))
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.2.0", created("2023-06-01T12:00:00+02:00"))
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.3.0", created("last Tuesday"))
+	var manifestRequests int64
+	registryServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.Path, "/manifests/") {
+			atomic.AddInt64(&manifestRequests, 1)
+		}
+		registry.ServeHTTP(resp, req)
+	}))
+	defer registryServer.Close()
+
+	t.Run("enabled", func(t *testing.T) {
+		atomic.StoreInt64(&manifestRequests, 0)
+		mirror := newTestProviderMirror(t, registryServer.URL)
+		mirror.CreatedAnnotation = annotation
+		mirror.CacheTTL = time.Minute
+		mirrorServer := newTestMirrorServer(t, mirror)
+		defer mirrorServer.Close()
+
+		want := map[string]any{
+			"versions": map[string]any{
+				"1.0.0": map[string]any{},
+				"1.1.0": map[string]any{"created": "2023-01-02T03:04:05Z"},
+				"1.2.0": map[string]any{"created": "2023-06-01T10:00:00Z"},
+				"1.3.0": map[string]any{},
+			},
+		}
+		for i := 0; i < 2; i++ {
+			var got map[string]any
+			status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/index.json", &got)
+			if status != 200 {
+				t.Fatalf("wrong index status %d", status)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("wrong index response\n%s", diff)
+			}
+		}
+		if got, want := atomic.LoadInt64(&manifestRequests), int64(4); got != want {
+			t.Errorf("made %d manifest requests; want %d, with the second index response using the cache", got, want)
+		}
+	})
+	t.Run("disabled", func(t *testing.T) {
+		atomic.StoreInt64(&manifestRequests, 0)
+		mirror := newTestProviderMirror(t, registryServer.URL)
+		mirrorServer := newTestMirrorServer(t, mirror)
+		defer mirrorServer.Close()
+
+		var got map[string]any
+		status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/index.json", &got)
+		if status != 200 {
+			t.Fatalf("wrong index status %d", status)
+		}
+		want := map[string]any{
+			"versions": map[string]any{
+				"1.0.0": map[string]any{},
+				"1.1.0": map[string]any{},
+				"1.2.0": map[string]any{},
+				"1.3.0": map[string]any{},
+			},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("wrong index response\n%s", diff)
+		}
+		if got := atomic.LoadInt64(&manifestRequests); got != 0 {
+			t.Errorf("made %d manifest requests; want none", got)
+		}
+	})
+}
+
+func TestProviderMirrorMinVersion(t *testing.T) {
+	registry := newFakeRegistry()
+	for _, v := range []string{"0.9.0", "1.0.0-beta1", "1.0.0", "1.5.0-beta1", "2.0.0"} {
+		registry.addManifest("terraform-providers/example.com/foo/bar", v, testProviderManifest())
+	}
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.MinVersion = versions.MustParseVersion("1.0.0")
+	mirrorServer := newTestMirrorServer(t, mirror)
+	defer mirrorServer.Close()
+
+	var got map[string]any
+	status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/index.json", &got)
+	if status != 200 {
+		t.Fatalf("wrong index status %d", status)
+	}
+	want := map[string]any{
+		"versions": map[string]any{
+			"1.0.0":       map[string]any{},
+			"1.5.0-beta1": map[string]any{},
+			"2.0.0":       map[string]any{},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong index response\n%s", diff)
+	}
+
+	versionStatuses := map[string]int{
+		"0.9.0":       404,
+		"1.0.0-beta1": 404,
+		"1.0.0":       200,
+		"2.0.0":       200,
+	}
+	for v, wantStatus := range versionStatuses {
+		var ignored map[string]any
+		status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/"+v+".json", &ignored)
+		if status != wantStatus {
+			t.Errorf("wrong status %d for version %s; want %d", status, v, wantStatus)
+		}
+	}
+}
+
+func TestProviderMirrorStalledDownload(t *testing.T) {
+	pkg := []byte("package content that the registry never finishes sending")
+	registry := newFakeRegistry()
+	registry.addManifest(
+		"terraform-providers/example.com/foo/bar", "1.0.0",
+		testProviderManifest(ocidist.ObjectMeta{
+			MediaType: "application/vnd.hashicorp.terraform.provider-package+zip",
+			Digest:    testDigest(pkg),
+			Size:      int64(len(pkg)),
+			Annotations: map[string]any{
+				"io.terraform.target-platforms": "linux_amd64",
+			},
+		}),
+	)
+	unblock := make(chan struct{})
+	registryServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if !strings.Contains(req.URL.Path, "/blobs/") {
+			registry.ServeHTTP(resp, req)
+			return
+		}
+		resp.Header().Set("Content-Length", strconv.Itoa(len(pkg)))
+		resp.WriteHeader(200)
+		resp.Write(pkg[:10])
+		resp.(http.Flusher).Flush()
+		select {
+		case <-unblock:
+		case <-req.Context().Done():
+		}
+	}))
+	defer registryServer.Close()
+	defer close(unblock)
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.ProxyPackages = true
+	mirror.Backend.IdleTimeout = 50 * time.Millisecond
+	shared := newTestSharedState()
+	shared.secreter = querysecret.NewSecreter([32]byte{})
+	mirrorServer := newTestMirrorServerShared(t, mirror, shared)
+	defer mirrorServer.Close()
+
+	var version struct {
+		Archives map[string]struct {
+			URL string `json:"url"`
+		} `json:"archives"`
+	}
+	status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/1.0.0.json", &version)
+	if status != 200 {
+		t.Fatalf("wrong status %d for version", status)
+	}
+
+	// The mirror server aborts the response once the origin registry has
+	// stalled. Since the partial content is small enough to still be
+	// buffered at that point, the client sees the connection close before
+	// any response at all.
+	resp, err := http.Get(mirrorServer.URL + version.Archives["linux_amd64"].URL)
+	if err == nil {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		t.Fatalf("download succeeded with status %d and body %q; want error", resp.StatusCode, body)
+	}
+}
+
+func TestProviderMirrorDeprecatedProviders(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest("terraform-providers/example.com/foo/old", "1.0.0", testProviderManifest())
+	registry.addManifest("terraform-providers/example.com/foo/new", "1.0.0", testProviderManifest())
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.DeprecatedProviders = map[string]string{
+		"example.com/foo/old": `Use "example.com/foo/new" instead.`,
+	}
+	mirrorServer := newTestMirrorServer(t, mirror)
+	defer mirrorServer.Close()
+
+	tests := map[string]string{
+		"/mirror/example.com/foo/old/index.json": `299 - "Provider example.com/foo/old is deprecated: Use \"example.com/foo/new\" instead."`,
+		"/mirror/example.com/foo/old/1.0.0.json": `299 - "Provider example.com/foo/old is deprecated: Use \"example.com/foo/new\" instead."`,
+		"/mirror/example.com/foo/new/index.json": "",
+		"/mirror/example.com/foo/new/1.0.0.json": "",
+	}
+	for path, wantWarning := range tests {
+		path, wantWarning := path, wantWarning
+		t.Run(path, func(t *testing.T) {
+			resp, err := http.Get(mirrorServer.URL + path)
+			if err != nil {
+				t.Fatalf("request failed: %s", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != 200 {
+				t.Fatalf("wrong status %d", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Warning"); got != wantWarning {
+				t.Errorf("wrong Warning header\ngot:  %s\nwant: %s", got, wantWarning)
+			}
+			wantDeprecation := ""
+			if wantWarning != "" {
+				wantDeprecation = "true"
+			}
+			if got := resp.Header.Get("Deprecation"); got != wantDeprecation {
+				t.Errorf("wrong Deprecation header %q; want %q", got, wantDeprecation)
+			}
+		})
+	}
+}
+
+func TestNormalizeRequestPath(t *testing.T) {
+	tests := map[string]struct {
+		want    string
+		wantErr bool
+	}{
+		"/mirror/example.com/foo/bar/index.json":    {"/mirror/example.com/foo/bar/index.json", false},
+		"/mirror/example.com/foo/bar/index.json/":   {"/mirror/example.com/foo/bar/index.json", false},
+		"//mirror//example.com///foo/bar/":          {"/mirror/example.com/foo/bar", false},
+		"/mirror/":                                  {"/mirror", false},
+		"/":                                         {"", false},
+		"/mirror/a%2Fb/foo/bar/index.json":          {"/mirror/a%2Fb/foo/bar/index.json", false},
+		"/mirror/.../foo/bar/index.json":            {"/mirror/.../foo/bar/index.json", false},
+		"/mirror/../etc/passwd":                     {"", true},
+		"/mirror/example.com/./foo/bar/index.json":  {"", true},
+		"/mirror/example.com/%2E%2e/bar/index.json": {"", true},
+		"/mirror/example.com/%2e/bar/index.json":    {"", true},
+		"/mirror/example.com/foo%zz/bar/index.json": {"", true},
+		"/mirror/example.com/foo/bar/index.json%":   {"", true},
+	}
+	for input, test := range tests {
+		input, test := input, test
+		t.Run(input, func(t *testing.T) {
+			got, err := normalizeRequestPath(input)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("no error; want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("wrong result %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeProviderAddr(t *testing.T) {
+	tests := map[string]struct {
+		input   []string
+		want    []string
+		wantErr string
+	}{
+		"already normalized": {
+			[]string{"example.com", "foo", "bar"},
+			[]string{"example.com", "foo", "bar"},
+			"",
+		},
+		"mixed case": {
+			[]string{"Example.COM", "HashiCorp", "AWS"},
+			[]string{"example.com", "hashicorp", "aws"},
+			"",
+		},
+		"punycode hostname": {
+			[]string{"xn--bcher-kva.example", "foo", "bar"},
+			[]string{"xn--bcher-kva.example", "foo", "bar"},
+			"",
+		},
+		"percent-encoded": {
+			[]string{"example%2Ecom", "F%4Fo", "bar"},
+			[]string{"example.com", "foo", "bar"},
+			"",
+		},
+		"percent-encoded slash": {
+			// Decoding can produce a segment that isn't a valid namespace
+			// part, which the caller must check for.
+			[]string{"example.com", "foo%2Fbaz", "bar"},
+			[]string{"example.com", "foo/baz", "bar"},
+			"",
+		},
+		"unicode hostname": {
+			[]string{"b%C3%BCcher.example", "foo", "bar"},
+			nil,
+			`hostname "bücher.example" must be written in its ASCII form`,
+		},
+		"unicode type": {
+			[]string{"example.com", "foo", "b%C3%A4r"},
+			nil,
+			`provider address segment "bär" must contain only ASCII characters`,
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			got, err := normalizeProviderAddr(test.input)
+			if test.wantErr != "" {
+				if err == nil {
+					t.Fatalf("no error; want %q", test.wantErr)
+				}
+				if !strings.HasPrefix(err.Error(), test.wantErr) {
+					t.Errorf("wrong error\ngot:  %s\nwant: %s", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("wrong result\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorAddressNormalization(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest("terraform-providers/xn--bcher-kva.example/foo/bar", "1.0.0", testProviderManifest())
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirrorServer := newTestMirrorServer(t, mirror)
+	defer mirrorServer.Close()
+
+	paths := map[string]int{
+		"/mirror/xn--bcher-kva.example/foo/bar/index.json":       200,
+		"/mirror/XN--BCHER-KVA.example/Foo/BAR/index.json":       200,
+		"/mirror/b%C3%BCcher.example/foo/bar/index.json":         404,
+		"/mirror/xn--bcher-kva.example/f%4Fo/bar/index%2Ejson":   200,
+		"/mirror/xn--bcher-kva.example/foo%2Fbar/bar/index.json": 404,
+		"/mirror/xn--bcher-kva.example/foo%20bar/bar/index.json": 404,
+	}
+	for path, wantStatus := range paths {
+		path, wantStatus := path, wantStatus
+		t.Run(path, func(t *testing.T) {
+			var got map[string]any
+			status := getJSON(t, mirrorServer.URL+path, &got)
+			if status != wantStatus {
+				t.Errorf("wrong status %d; want %d", status, wantStatus)
+			}
+		})
+	}
+
+	t.Run("rejecting malformed paths", func(t *testing.T) {
+		mirror := newTestProviderMirror(t, registryServer.URL)
+		mirror.RejectMalformedPaths = true
+		mirrorServer := newTestMirrorServer(t, mirror)
+		defer mirrorServer.Close()
+
+		// A segment that is invalid only once decoded is malformed, rather
+		// than a reference to a provider that doesn't exist.
+		var got map[string]any
+		status := getJSON(t, mirrorServer.URL+"/mirror/xn--bcher-kva.example/foo%2Fbar/bar/index.json", &got)
+		if status != 400 {
+			t.Errorf("wrong status %d; want 400", status)
+		}
+		status = getJSON(t, mirrorServer.URL+"/mirror/xn--bcher-kva.example/f%4Fo/bar/index.json", &got)
+		if status != 200 {
+			t.Errorf("wrong status %d for valid encoded path; want 200", status)
+		}
+	})
+}
+
+func TestProviderMirrorExposedAnnotations(t *testing.T) {
+	manifest := testProviderManifest()
+	manifest.Annotations = map[string]any{
+		"org.opencontainers.image.revision": "abc123",
+		"org.opencontainers.image.created":  "2023-01-01T00:00:00Z",
+		"com.example.secret":                "not for clients",
+	}
+	registry := newFakeRegistry()
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.0.0", manifest)
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	t.Run("default", func(t *testing.T) {
+		mirror := newTestProviderMirror(t, registryServer.URL)
+		mirrorServer := newTestMirrorServer(t, mirror)
+		defer mirrorServer.Close()
+
+		var got map[string]any
+		status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/1.0.0.json", &got)
+		if status != 200 {
+			t.Fatalf("wrong status %d", status)
+		}
+		if _, exists := got["annotations"]; exists {
+			t.Errorf("response includes annotations even though none are exposed")
+		}
+	})
+	t.Run("allow-listed", func(t *testing.T) {
+		mirror := newTestProviderMirror(t, registryServer.URL)
+		mirror.ExposedAnnotations = []string{
+			"org.opencontainers.image.revision",
+			"org.opencontainers.image.source", // not present in the manifest
+		}
+		mirrorServer := newTestMirrorServer(t, mirror)
+		defer mirrorServer.Close()
+
+		var got map[string]any
+		status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/1.0.0.json", &got)
+		if status != 200 {
+			t.Fatalf("wrong status %d", status)
+		}
+		want := map[string]any{
+			"archives": map[string]any{},
+			"annotations": map[string]any{
+				"org.opencontainers.image.revision": "abc123",
+			},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("wrong response\n%s", diff)
+		}
+	})
+}
+
+func TestSelectPackageLayers(t *testing.T) {
+	layerA := ocidist.ObjectMeta{
+		MediaType: providerPackageMediaType,
+		Digest:    testDigest([]byte("package a")),
+		Annotations: map[string]any{
+			"io.terraform.target-platforms": "linux_amd64,darwin_arm64",
+		},
+	}
+	layerB := ocidist.ObjectMeta{
+		MediaType: providerPackageMediaType,
+		Digest:    testDigest([]byte("package b")),
+		Annotations: map[string]any{
+			"io.terraform.target-platforms": "linux_amd64",
+		},
+	}
+	otherFormat := ocidist.ObjectMeta{
+		MediaType: "application/vnd.example.provider-package+tar",
+		Digest:    testDigest([]byte("package c")),
+		Annotations: map[string]any{
+			"io.terraform.target-platforms": "linux_amd64,windows_amd64",
+		},
+	}
+	wantLinux := layerA
+	if layerB.Digest < layerA.Digest {
+		wantLinux = layerB
+	}
+
+	orders := map[string][]ocidist.ObjectMeta{
+		"forward":  {layerA, otherFormat, layerB},
+		"backward": {layerB, otherFormat, layerA},
+	}
+	for name, layers := range orders {
+		layers := layers
+		t.Run(name, func(t *testing.T) {
+			var logs bytes.Buffer
+			logger := logging.NewLogger(log.New(&logs, "", 0))
+			got, err := selectPackageLayers(layers, packageLayerPolicy{
+				MediaTypes:        config.DefaultPackageMediaTypes,
+				TrustedAlgorithms: config.DefaultTrustedDigestAlgorithms,
+			}, logger)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			want := map[string]ocidist.ObjectMeta{
+				"linux_amd64":  wantLinux,
+				"darwin_arm64": layerA,
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("wrong result\n%s", diff)
+			}
+			if !strings.Contains(logs.String(), "multiple package layers for platform linux_amd64") {
+				t.Errorf("no warning about multiple layers; logs:\n%s", logs.String())
+			}
+		})
+	}
+}
+
+func TestSelectPackageLayersDuplicatePlatforms(t *testing.T) {
+	first := ocidist.ObjectMeta{
+		MediaType: providerPackageMediaType,
+		Digest:    testDigest([]byte("first package")),
+		Annotations: map[string]any{
+			platformsAnnotation: "linux_amd64,darwin_arm64",
+		},
+	}
+	last := ocidist.ObjectMeta{
+		MediaType: providerPackageMediaType,
+		Digest:    testDigest([]byte("last package")),
+		Annotations: map[string]any{
+			platformsAnnotation: "linux_amd64",
+		},
+	}
+	lowest := first
+	if last.Digest < first.Digest {
+		lowest = last
+	}
+	layers := []ocidist.ObjectMeta{first, last}
+
+	tests := map[config.DuplicatePlatforms]struct {
+		wantLinux ocidist.ObjectMeta
+		wantErr   bool
+	}{
+		config.DuplicatePlatformsLowestDigest: {wantLinux: lowest},
+		config.DuplicatePlatformsFirst:        {wantLinux: first},
+		config.DuplicatePlatformsLast:         {wantLinux: last},
+		config.DuplicatePlatformsError:        {wantErr: true},
+	}
+	for mode, test := range tests {
+		mode, test := mode, test
+		t.Run(string(mode), func(t *testing.T) {
+			var logs bytes.Buffer
+			logger := logging.NewLogger(log.New(&logs, "", 0))
+			got, err := selectPackageLayers(layers, packageLayerPolicy{
+				MediaTypes:         config.DefaultPackageMediaTypes,
+				TrustedAlgorithms:  config.DefaultTrustedDigestAlgorithms,
+				DuplicatePlatforms: mode,
+			}, logger)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("no error for duplicate platforms")
+				}
+				if !strings.Contains(err.Error(), "linux_amd64") {
+					t.Errorf("error doesn't mention the platform: %s", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			want := map[string]ocidist.ObjectMeta{
+				"linux_amd64":  test.wantLinux,
+				"darwin_arm64": first,
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("wrong result\n%s", diff)
+			}
+			if !strings.Contains(logs.String(), "multiple package layers for platform linux_amd64") {
+				t.Errorf("no warning about multiple layers; logs:\n%s", logs.String())
+			}
+		})
+	}
+}
+
+func TestSelectPackageLayersMediaTypes(t *testing.T) {
+	const tarMediaType = "application/vnd.example.provider-package+tar"
+	zipLayer := ocidist.ObjectMeta{
+		MediaType: providerPackageMediaType,
+		Digest:    testDigest([]byte("zip package")),
+		Annotations: map[string]any{
+			"io.terraform.target-platforms": "linux_amd64,darwin_arm64",
+		},
+	}
+	tarLayer := ocidist.ObjectMeta{
+		MediaType: tarMediaType,
+		Digest:    testDigest([]byte("tar package")),
+		Annotations: map[string]any{
+			"io.terraform.target-platforms": "linux_amd64,windows_amd64",
+		},
+	}
+	layers := []ocidist.ObjectMeta{zipLayer, tarLayer}
+
+	tests := map[string]struct {
+		mediaTypes []string
+		want       map[string]ocidist.ObjectMeta
+	}{
+		"zip only": {
+			[]string{providerPackageMediaType},
+			map[string]ocidist.ObjectMeta{
+				"linux_amd64":  zipLayer,
+				"darwin_arm64": zipLayer,
+			},
+		},
+		"prefer zip": {
+			[]string{providerPackageMediaType, tarMediaType},
+			map[string]ocidist.ObjectMeta{
+				"linux_amd64":   zipLayer,
+				"darwin_arm64":  zipLayer,
+				"windows_amd64": tarLayer,
+			},
+		},
+		"prefer tar": {
+			[]string{tarMediaType, providerPackageMediaType},
+			map[string]ocidist.ObjectMeta{
+				"linux_amd64":   tarLayer,
+				"darwin_arm64":  zipLayer,
+				"windows_amd64": tarLayer,
+			},
+		},
+		"none": {
+			nil,
+			map[string]ocidist.ObjectMeta{},
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			var logs bytes.Buffer
+			logger := logging.NewLogger(log.New(&logs, "", 0))
+			got, err := selectPackageLayers(layers, packageLayerPolicy{
+				MediaTypes:        test.mediaTypes,
+				TrustedAlgorithms: config.DefaultTrustedDigestAlgorithms,
+			}, logger)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("wrong result\n%s", diff)
+			}
+			if logs.Len() != 0 {
+				t.Errorf("unexpected log output:\n%s", logs.String())
+			}
+		})
+	}
+}
+
+func TestSelectPackageLayersMalformedAnnotations(t *testing.T) {
+	good := ocidist.ObjectMeta{
+		MediaType: providerPackageMediaType,
+		Digest:    testDigest([]byte("good package")),
+		Annotations: map[string]any{
+			platformsAnnotation: "linux_amd64",
+		},
+	}
+	tests := map[string]struct {
+		annotation any
+		// wantPlatforms are the platforms that the malformed layer is
+		// still offered for in lenient mode.
+		wantPlatforms []string
+	}{
+		"array":          {[]any{"darwin_arm64"}, nil},
+		"empty":          {"", nil},
+		"empty platform": {"darwin_arm64,", []string{"darwin_arm64"}},
+		"no arch":        {"darwin", nil},
+		"mixed":          {"darwin_arm64,windows,linux_arm64", []string{"darwin_arm64", "linux_arm64"}},
+	}
+	for name, test := range tests {
+		test := test
+		malformed := ocidist.ObjectMeta{
+			MediaType: providerPackageMediaType,
+			Digest:    testDigest([]byte("malformed package")),
+			Annotations: map[string]any{
+				platformsAnnotation: test.annotation,
+			},
+		}
+		layers := []ocidist.ObjectMeta{good, malformed}
+		policy := packageLayerPolicy{
+			MediaTypes:        config.DefaultPackageMediaTypes,
+			TrustedAlgorithms: config.DefaultTrustedDigestAlgorithms,
+		}
+
+		t.Run(name+" (lenient)", func(t *testing.T) {
+			var logs bytes.Buffer
+			logger := logging.NewLogger(log.New(&logs, "", 0))
+			got, err := selectPackageLayers(layers, policy, logger)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			want := map[string]ocidist.ObjectMeta{
+				"linux_amd64": good,
+			}
+			for _, platform := range test.wantPlatforms {
+				want[platform] = malformed
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("wrong result\n%s", diff)
+			}
+			if !strings.Contains(logs.String(), "warning: ignoring package layer "+malformed.Digest.String()) {
+				t.Errorf("no warning about malformed layer; logs:\n%s", logs.String())
+			}
+		})
+
+		policy.StrictAnnotations = true
+		t.Run(name+" (strict)", func(t *testing.T) {
+			logger := logging.NewLogger(log.New(io.Discard, "", 0))
+			_, err := selectPackageLayers(layers, policy, logger)
+			if err == nil {
+				t.Fatalf("no error for malformed annotation")
+			}
+			if !strings.Contains(err.Error(), malformed.Digest.String()) {
+				t.Errorf("error doesn't mention the malformed layer: %s", err)
+			}
+		})
+	}
+}
+
+func TestPackageHashes(t *testing.T) {
+	sha256Digest := testDigest([]byte("package"))
+	sha512Digest, err := ocidist.ComputeDigest("sha512", []byte("package"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zh := "zh:" + sha256Digest.Encoded()
+	otherZH := "zh:" + testDigest([]byte("other")).Encoded()
+	h1 := "h1:" + base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	tests := map[string]struct {
+		meta    ocidist.ObjectMeta
+		schemes []string
+		want    []string
+		wantErr bool
+	}{
+		"sha256 digest": {
+			meta: ocidist.ObjectMeta{
+				MediaType: providerPackageMediaType,
+				Digest:    sha256Digest,
+			},
+			schemes: []string{"zh"},
+			want:    []string{zh},
+		},
+		"sha512 digest": {
+			meta: ocidist.ObjectMeta{
+				MediaType: providerPackageMediaType,
+				Digest:    sha512Digest,
+			},
+			schemes: []string{"zh", "h1"},
+			want:    nil,
+		},
+		"sha512 digest with annotation": {
+			meta: ocidist.ObjectMeta{
+				MediaType: providerPackageMediaType,
+				Digest:    sha512Digest,
+				Annotations: map[string]any{
+					packageHashesAnnotation: zh + "," + h1,
+				},
+			},
+			schemes: []string{"zh", "h1"},
+			want:    []string{zh, h1},
+		},
+		"preference order": {
+			meta: ocidist.ObjectMeta{
+				MediaType: providerPackageMediaType,
+				Digest:    sha256Digest,
+				Annotations: map[string]any{
+					packageHashesAnnotation: h1,
+				},
+			},
+			schemes: []string{"h1", "zh"},
+			want:    []string{h1, zh},
+		},
+		"scheme not selected": {
+			meta: ocidist.ObjectMeta{
+				MediaType: providerPackageMediaType,
+				Digest:    sha256Digest,
+				Annotations: map[string]any{
+					packageHashesAnnotation: h1,
+				},
+			},
+			schemes: []string{"zh"},
+			want:    []string{zh},
+		},
+		"several hashes of one scheme": {
+			meta: ocidist.ObjectMeta{
+				MediaType: providerPackageMediaType,
+				Digest:    sha256Digest,
+				Annotations: map[string]any{
+					// The digest's own hash is listed again, which is harmless.
+					packageHashesAnnotation: otherZH + "," + zh,
+				},
+			},
+			schemes: []string{"zh"},
+			want:    []string{zh, otherZH},
+		},
+		"not a zip archive": {
+			meta: ocidist.ObjectMeta{
+				MediaType: "application/vnd.example.provider-package+tar",
+				Digest:    sha256Digest,
+				Annotations: map[string]any{
+					packageHashesAnnotation: h1,
+				},
+			},
+			schemes: []string{"zh", "h1"},
+			want:    []string{h1},
+		},
+		"zh hash for something other than a zip archive": {
+			meta: ocidist.ObjectMeta{
+				MediaType: "application/vnd.example.provider-package+tar",
+				Digest:    sha256Digest,
+				Annotations: map[string]any{
+					packageHashesAnnotation: zh,
+				},
+			},
+			schemes: []string{"zh", "h1"},
+			want:    nil,
+			wantErr: true,
+		},
+		"malformed annotation": {
+			meta: ocidist.ObjectMeta{
+				MediaType: providerPackageMediaType,
+				Digest:    sha256Digest,
+				Annotations: map[string]any{
+					packageHashesAnnotation: h1 + ",h1:not-base64",
+				},
+			},
+			schemes: []string{"zh", "h1"},
+			want:    []string{zh},
+			wantErr: true,
+		},
+		"unsupported scheme in annotation": {
+			meta: ocidist.ObjectMeta{
+				MediaType: providerPackageMediaType,
+				Digest:    sha256Digest,
+				Annotations: map[string]any{
+					packageHashesAnnotation: "sha512:abc",
+				},
+			},
+			schemes: []string{"zh", "h1"},
+			want:    []string{zh},
+			wantErr: true,
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			got, err := packageHashes(test.meta, test.schemes)
+			if (err != nil) != test.wantErr {
+				t.Errorf("wrong error %v; want error: %t", err, test.wantErr)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("wrong result\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorStrictAnnotations(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest(
+		"terraform-providers/example.com/foo/bar", "1.0.0",
+		testProviderManifest(ocidist.ObjectMeta{
+			MediaType: "application/vnd.hashicorp.terraform.provider-package+zip",
+			Digest:    testDigest([]byte("package")),
+			Size:      7,
+			Annotations: map[string]any{
+				"io.terraform.target-platforms": []any{"linux_amd64"},
+			},
+		}),
+	)
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	for _, strict := range []bool{false, true} {
+		mirror := newTestProviderMirror(t, registryServer.URL)
+		mirror.StrictAnnotations = strict
+		_, handler := providerMirrorHandler(mirror, newTestSharedState())
+
+		wantStatus := 200
+		if strict {
+			wantStatus = 502
+		}
+		t.Run(fmt.Sprintf("strict=%t", strict), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest("GET", "/mirror/example.com/foo/bar/1.0.0.json", nil))
+			if rec.Code != wantStatus {
+				t.Errorf("wrong status %d; want %d\n%s", rec.Code, wantStatus, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestProviderMirrorMaxPlatforms(t *testing.T) {
+	var layers []ocidist.ObjectMeta
+	for _, platform := range []string{"linux_amd64", "darwin_arm64", "windows_amd64"} {
+		layers = append(layers, ocidist.ObjectMeta{
+			MediaType: providerPackageMediaType,
+			Digest:    testDigest([]byte("package for " + platform)),
+			Annotations: map[string]any{
+				platformsAnnotation: platform,
+			},
+		})
+	}
+	registry := newFakeRegistry()
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.0.0", testProviderManifest(layers...))
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	tests := map[string]struct {
+		limit      int
+		wantStatus int
+		wantBody   string
+	}{
+		"within limit": {
+			limit:      3,
+			wantStatus: 200,
+		},
+		"exceeds limit": {
+			limit:      2,
+			wantStatus: 502,
+			wantBody:   "Version 1.0.0 offers packages for more than 2 platforms, which is more than this server allows.\n",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			mirror := newTestProviderMirror(t, registryServer.URL)
+			mirror.MaxPlatforms = test.limit
+			_, handler := providerMirrorHandler(mirror, newTestSharedState())
+
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest("GET", "/mirror/example.com/foo/bar/1.0.0.json", nil))
+			if rec.Code != test.wantStatus {
+				t.Fatalf("wrong status %d; want %d\n%s", rec.Code, test.wantStatus, rec.Body.String())
+			}
+			if test.wantBody != "" && rec.Body.String() != test.wantBody {
+				t.Errorf("wrong body\ngot:  %s\nwant: %s", rec.Body.String(), test.wantBody)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorLogServiceNames(t *testing.T) {
+	registry := newFakeRegistry()
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	for _, enabled := range []bool{false, true} {
+		enabled := enabled
+		t.Run(fmt.Sprintf("enabled=%t", enabled), func(t *testing.T) {
+			mirror := newTestProviderMirror(t, registryServer.URL)
+			shared := newTestSharedState()
+			shared.config.LogServiceNames = enabled
+			_, handler := providerMirrorHandler(mirror, shared)
+
+			var logs bytes.Buffer
+			req := httptest.NewRequest("GET", "/mirror/example.com/foo/bar/1.0.0.json", nil)
+			req = req.WithContext(logging.ContextWithLogger(req.Context(), log.New(&logs, "[client] ", log.Lmsgprefix)))
+			handler(httptest.NewRecorder(), req)
+
+			lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+			if len(lines) < 2 {
+				t.Fatalf("too few log lines\n%s", logs.String())
+			}
+			wantPrefix := "[client] "
+			if enabled {
+				wantPrefix = "[client] [mirror] "
+			}
+			for _, line := range lines {
+				if !strings.HasPrefix(line, wantPrefix) {
+					t.Errorf("log line doesn't start with %q: %s", wantPrefix, line)
+				}
+			}
+			if !strings.HasPrefix(lines[0], wantPrefix+"BEGIN ") || !strings.HasPrefix(lines[len(lines)-1], wantPrefix+"END ") {
+				t.Errorf("log doesn't start with BEGIN and end with END\n%s", logs.String())
+			}
+		})
+	}
+}
+
+func TestAcceptablePackageMediaTypes(t *testing.T) {
+	const tarMediaType = "application/vnd.example.provider-package+tar"
+	configured := []string{providerPackageMediaType, tarMediaType}
+	tests := map[string]struct {
+		hints []string
+		want  []string
+	}{
+		"no hint": {
+			nil,
+			configured,
+		},
+		"client prefers tar": {
+			[]string{tarMediaType + ", " + providerPackageMediaType},
+			[]string{tarMediaType, providerPackageMediaType},
+		},
+		"multiple headers": {
+			[]string{"application/unknown", strings.ToUpper(tarMediaType), tarMediaType},
+			[]string{tarMediaType},
+		},
+		"nothing acceptable": {
+			[]string{"application/unknown"},
+			nil,
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			got := acceptablePackageMediaTypes(configured, test.hints)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("wrong result\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorMalformedPaths(t *testing.T) {
+	registry := newFakeRegistry()
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	paths := map[string]string{
+		"too few parts":  "/mirror/example.com/foo",
+		"too many parts": "/mirror/example.com/foo/bar/baz/index.json",
+		"empty part":     "/mirror/example.com//bar/index.json",
+		"no selector":    "/mirror/example.com/foo/bar/",
+		"bad characters": "/mirror/example.com/f%20o/bar/index.json",
+	}
+	for _, reject := range []bool{false, true} {
+		mirror := newTestProviderMirror(t, registryServer.URL)
+		mirror.RejectMalformedPaths = reject
+		// We call the handler directly, rather than through a server, because
+		// http.ServeMux would otherwise redirect some of these paths to
+		// their cleaned equivalents.
+		_, handler := providerMirrorHandler(mirror, newTestSharedState())
+
+		wantStatus := 404
+		if reject {
+			wantStatus = 400
+		}
+		for name, path := range paths {
+			t.Run(fmt.Sprintf("%s (reject=%t)", name, reject), func(t *testing.T) {
+				rec := httptest.NewRecorder()
+				handler(rec, httptest.NewRequest("GET", path, nil))
+				if rec.Code != wantStatus {
+					t.Errorf("wrong status %d; want %d", rec.Code, wantStatus)
+				}
+				if reject && !strings.Contains(rec.Body.String(), "Malformed provider mirror request path") {
+					t.Errorf("response body doesn't describe the problem:\n%s", rec.Body.String())
+				}
+			})
+		}
+		t.Run(fmt.Sprintf("well-formed but unknown (reject=%t)", reject), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest("GET", "/mirror/example.com/foo/bar/index.json", nil))
+			if rec.Code != 404 {
+				t.Errorf("wrong status %d; want 404", rec.Code)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorCanonicalRedirects(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.0.0", testProviderManifest())
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.CanonicalRedirects = true
+	_, handler := providerMirrorHandler(mirror, newTestSharedState())
+
+	tests := map[string]struct {
+		method       string
+		path         string
+		wantStatus   int
+		wantLocation string
+	}{
+		"mixed case": {
+			method:       "GET",
+			path:         "/mirror/Example.COM/Foo/bar/index.json",
+			wantStatus:   301,
+			wantLocation: "/mirror/example.com/foo/bar/index.json",
+		},
+		"trailing dot": {
+			method:       "GET",
+			path:         "/mirror/example.com./foo/bar/1.0.0.json",
+			wantStatus:   301,
+			wantLocation: "/mirror/example.com/foo/bar/1.0.0.json",
+		},
+		"percent-encoded": {
+			method:       "HEAD",
+			path:         "/mirror/example.com/f%6Fo/bar/index.json",
+			wantStatus:   301,
+			wantLocation: "/mirror/example.com/foo/bar/index.json",
+		},
+		"default hostname": {
+			method:       "GET",
+			path:         "/mirror/foo/bar/index.json",
+			wantStatus:   301,
+			wantLocation: "/mirror/registry.terraform.io/foo/bar/index.json",
+		},
+		"default namespace": {
+			method:       "GET",
+			path:         "/mirror/AWS/index.json?x=1",
+			wantStatus:   301,
+			wantLocation: "/mirror/registry.terraform.io/hashicorp/aws/index.json?x=1",
+		},
+		"canonical": {
+			method:     "GET",
+			path:       "/mirror/example.com/foo/bar/index.json",
+			wantStatus: 200,
+		},
+		"not GET or HEAD": {
+			// The server rejects other methods before they reach the
+			// handler, but the handler itself mustn't redirect them.
+			method:     "POST",
+			path:       "/mirror/Example.com/foo/bar/index.json",
+			wantStatus: 200,
+		},
+		"invalid canonical form": {
+			method:     "GET",
+			path:       "/mirror/example.com/Foo_/bar/index.json",
+			wantStatus: 404,
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(test.method, test.path, nil))
+			if rec.Code != test.wantStatus {
+				t.Fatalf("wrong status %d; want %d\n%s", rec.Code, test.wantStatus, rec.Body.String())
+			}
+			if got := rec.Header().Get("Location"); got != test.wantLocation {
+				t.Errorf("wrong location %q; want %q", got, test.wantLocation)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorAddressLayout(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest("terraform-providers/example.com/foo_bar", "1.0.0", testProviderManifest())
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.AddressLayout = []string{"{hostname}", "{namespace}_{type}"}
+	mirror.RejectMalformedPaths = true
+	_, handler := providerMirrorHandler(mirror, newTestSharedState())
+
+	tests := map[string]struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		"rewritten": {
+			path:       "/mirror/example.com/foo/bar/index.json",
+			wantStatus: 200,
+		},
+		"under depth": {
+			path:       "/mirror/example.com/foo_bar/index.json",
+			wantStatus: 400,
+			wantBody:   "but the path has only 3",
+		},
+		"over depth": {
+			path:       "/mirror/example.com/foo/bar/baz/index.json",
+			wantStatus: 400,
+			wantBody:   "but the path has 5",
+		},
+		"ambiguous": {
+			// If underscores were allowed then this would be the same
+			// namespace as foo/bar.
+			path:       "/mirror/example.com/foo_/bar/index.json",
+			wantStatus: 400,
+			wantBody:   "must not contain underscores",
+		},
+		"unmappable": {
+			// A hostname with a port number is a valid provider address,
+			// but can't be a namespace part.
+			path:       "/mirror/example.com:8443/foo/bar/index.json",
+			wantStatus: 400,
+			wantBody:   "unsupported provider address",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest("GET", test.path, nil))
+			if rec.Code != test.wantStatus {
+				t.Errorf("wrong status %d; want %d\n%s", rec.Code, test.wantStatus, rec.Body.String())
+			}
+			if !strings.Contains(rec.Body.String(), test.wantBody) {
+				t.Errorf("response body doesn't include %q:\n%s", test.wantBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestProviderMirrorOriginCredentials(t *testing.T) {
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if user, pass, _ := req.BasicAuth(); user != "mirror" || pass != "secret" {
+			resp.WriteHeader(401)
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		io.WriteString(resp, `{"token":"mirror-token"}`)
+	}))
+	defer tokenServer.Close()
+	registry := newFakeRegistry()
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.0.0", testProviderManifest())
+	registryServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer mirror-token" {
+			resp.Header().Set("WWW-Authenticate", `Bearer realm="`+tokenServer.URL+`",service="registry"`)
+			resp.WriteHeader(401)
+			return
+		}
+		registry.ServeHTTP(resp, req)
+	}))
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.OriginCredentials = &ocidist.Credentials{Username: "mirror", Password: "secret"}
+	mirrorServer := newTestMirrorServer(t, mirror)
+	defer mirrorServer.Close()
+
+	// The mirror uses its own credentials rather than passing through the
+	// client's Authorization header.
+	req, err := http.NewRequest("GET", mirrorServer.URL+"/mirror/example.com/foo/bar/index.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer client-token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("wrong status %d; want 200", resp.StatusCode)
+	}
+}
+
+func TestFindLatestVersion(t *testing.T) {
+	digests := map[string]ocidist.Digest{
+		"1.0.0": "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+		"1.1.0": "sha256:2222222222222222222222222222222222222222222222222222222222222222",
+		"1.2.0": "sha256:2222222222222222222222222222222222222222222222222222222222222222",
+		"2.0.0": "sha256:3333333333333333333333333333333333333333333333333333333333333333",
+	}
+	candidates := versions.List{
+		versions.MustParseVersion("1.1.0"),
+		versions.MustParseVersion("2.0.0"),
+		versions.MustParseVersion("1.0.0"),
+		versions.MustParseVersion("1.2.0"),
+	}
+	versionDigest := func(v versions.Version) (ocidist.Digest, error) {
+		return digests[v.String()], nil
+	}
+
+	tests := map[string]struct {
+		latest    ocidist.Digest
+		want      string
+		wantFound bool
+	}{
+		"newest": {
+			latest:    digests["2.0.0"],
+			want:      "2.0.0",
+			wantFound: true,
+		},
+		"older": {
+			latest:    digests["1.0.0"],
+			want:      "1.0.0",
+			wantFound: true,
+		},
+		"shared digest": {
+			latest:    digests["1.1.0"],
+			want:      "1.2.0", // the newest of the two matching versions
+			wantFound: true,
+		},
+		"no match": {
+			latest:    "sha256:4444444444444444444444444444444444444444444444444444444444444444",
+			wantFound: false,
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			got, found, err := findLatestVersion(candidates, func() (ocidist.Digest, error) {
+				return test.latest, nil
+			}, versionDigest)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if found != test.wantFound {
+				t.Fatalf("wrong found %t; want %t", found, test.wantFound)
+			}
+			if found && got.String() != test.want {
+				t.Errorf("wrong version %s; want %s", got, test.want)
+			}
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		_, _, err := findLatestVersion(candidates, func() (ocidist.Digest, error) {
+			return digests["1.0.0"], nil
+		}, func(v versions.Version) (ocidist.Digest, error) {
+			return "", errors.New("backend failed")
+		})
+		if err == nil {
+			t.Errorf("no error when resolving a version digest failed")
+		}
+	})
+}
+
+func TestProviderMirrorResolveLatest(t *testing.T) {
+	registry := newFakeRegistry()
+	v1 := testProviderManifest()
+	v2 := testProviderManifest()
+	v2.Annotations = map[string]any{"version": "2"} // so that the digest differs
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.0.0", v1)
+	registry.addManifest("terraform-providers/example.com/foo/bar", "2.0.0", v2)
+	registry.addManifest("terraform-providers/example.com/foo/bar", "latest", v2)
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	for _, resolve := range []bool{false, true} {
+		t.Run(fmt.Sprintf("resolve=%t", resolve), func(t *testing.T) {
+			mirror := newTestProviderMirror(t, registryServer.URL)
+			mirror.ResolveLatest = resolve
+			mirrorServer := newTestMirrorServer(t, mirror)
+			defer mirrorServer.Close()
+
+			var got map[string]any
+			status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/index.json", &got)
+			if status != 200 {
+				t.Fatalf("wrong status %d", status)
+			}
+			want := map[string]any{
+				"versions": map[string]any{
+					"1.0.0": map[string]any{},
+					"2.0.0": map[string]any{},
+				},
+			}
+			if resolve {
+				want["latest"] = "2.0.0"
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("wrong response\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorVerifyLayers(t *testing.T) {
+	present := []byte("present package")
+	dangling := []byte("dangling package")
+	registry := newFakeRegistry()
+	registry.addManifest(
+		"terraform-providers/example.com/foo/bar", "1.0.0",
+		testProviderManifest(
+			ocidist.ObjectMeta{
+				MediaType: providerPackageMediaType,
+				Digest:    testDigest(present),
+				Size:      int64(len(present)),
+				Annotations: map[string]any{
+					"io.terraform.target-platforms": "linux_amd64",
+				},
+			},
+			ocidist.ObjectMeta{
+				MediaType: providerPackageMediaType,
+				Digest:    testDigest(dangling),
+				Size:      int64(len(dangling)),
+				Annotations: map[string]any{
+					"io.terraform.target-platforms": "darwin_arm64",
+				},
+			},
+		),
+	)
+	registry.addBlob("terraform-providers/example.com/foo/bar", present)
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	tests := map[bool][]string{
+		false: {"darwin_arm64", "linux_amd64"},
+		true:  {"linux_amd64"},
+	}
+	for verify, wantPlatforms := range tests {
+		t.Run(fmt.Sprintf("verify=%t", verify), func(t *testing.T) {
+			mirror := newTestProviderMirror(t, registryServer.URL)
+			mirror.VerifyLayers = verify
+			mirrorServer := newTestMirrorServer(t, mirror)
+			defer mirrorServer.Close()
+
+			var got struct {
+				Archives map[string]any `json:"archives"`
+			}
+			status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/1.0.0.json", &got)
+			if status != 200 {
+				t.Fatalf("wrong status %d", status)
+			}
+			var gotPlatforms []string
+			for platform := range got.Archives {
+				gotPlatforms = append(gotPlatforms, platform)
+			}
+			sort.Strings(gotPlatforms)
+			if diff := cmp.Diff(wantPlatforms, gotPlatforms); diff != "" {
+				t.Errorf("wrong platforms\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorPinManifestDigests(t *testing.T) {
+	const ns = "terraform-providers/example.com/foo/bar"
+	oldPackage := []byte("old package")
+	newPackage := []byte("new package")
+	testPackageManifest := func(content []byte) *ocidist.Manifest {
+		return testProviderManifest(ocidist.ObjectMeta{
+			MediaType: providerPackageMediaType,
+			Digest:    testDigest(content),
+			Size:      int64(len(content)),
+			Annotations: map[string]any{
+				"io.terraform.target-platforms": "linux_amd64",
+			},
+		})
+	}
+	oldManifest := testPackageManifest(oldPackage)
+	newManifest := testPackageManifest(newPackage)
+
+	tests := map[string]struct {
+		// keepOld keeps the old manifest available by digest after the
+		// tag moves, rather than simulating garbage collection.
+		keepOld bool
+		// oldBlob makes the old manifest's package blob available.
+		oldBlob bool
+		verify  bool
+		want    ocidist.Digest
+	}{
+		"tag moves after resolution": {
+			keepOld: true,
+			oldBlob: true,
+			want:    testDigest(oldPackage),
+		},
+		"pinned manifest garbage-collected": {
+			oldBlob: true,
+			want:    testDigest(newPackage),
+		},
+		"pinned package garbage-collected": {
+			keepOld: true,
+			verify:  true,
+			want:    testDigest(newPackage),
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			registry := newFakeRegistry()
+			registry.addManifest(ns, "1.0.0", oldManifest)
+			registry.addBlob(ns, newPackage)
+			if test.oldBlob {
+				registry.addBlob(ns, oldPackage)
+			}
+			// The tag moves to the new manifest as soon as the server has
+			// resolved it for the first time.
+			moved := false
+			registryServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				registry.ServeHTTP(resp, req)
+				if req.Method == "HEAD" && strings.HasSuffix(req.URL.Path, "/manifests/1.0.0") && !moved {
+					moved = true
+					if test.keepOld {
+						registry.manifests[ns+":old"] = oldManifest
+					}
+					registry.manifests[ns+":1.0.0"] = newManifest
+				}
+			}))
+			defer registryServer.Close()
+
+			mirror := newTestProviderMirror(t, registryServer.URL)
+			mirror.PinManifestDigests = true
+			mirror.VerifyLayers = test.verify
+			mirrorServer := newTestMirrorServer(t, mirror)
+			defer mirrorServer.Close()
+
+			var got struct {
+				Archives map[string]struct {
+					URL string `json:"url"`
+				} `json:"archives"`
+			}
+			status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/1.0.0.json", &got)
+			if status != 200 {
+				t.Fatalf("wrong status %d", status)
+			}
+			archive, ok := got.Archives["linux_amd64"]
+			if !ok {
+				t.Fatalf("no linux_amd64 package in response")
+			}
+			if !strings.HasSuffix(archive.URL, "/blobs/"+test.want.String()) {
+				t.Errorf("wrong package URL %s; want blob %s", archive.URL, test.want)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorPinnedStaleRetry(t *testing.T) {
+	const ns = "terraform-providers/example.com/foo/bar"
+	oldPackage := []byte("old package")
+	newPackage := []byte("new package")
+	testPackageManifest := func(content []byte) *ocidist.Manifest {
+		return testProviderManifest(ocidist.ObjectMeta{
+			MediaType: providerPackageMediaType,
+			Digest:    testDigest(content),
+			Size:      int64(len(content)),
+			Annotations: map[string]any{
+				"io.terraform.target-platforms": "linux_amd64",
+			},
+		})
+	}
+	registry := newFakeRegistry()
+	registry.addManifest(ns, "1.0.0", testPackageManifest(oldPackage))
+	oldBlob := registry.addBlob(ns, oldPackage)
+	// Once the old manifest is cached, the origin registry starts failing
+	// to return it, so that the server uses its stale cached copy. The tag
+	// then moves to a new manifest as soon as the server has resolved it.
+	var oldManifestPath string
+	failOld, moved := false, false
+	registryServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" && strings.Contains(req.URL.Path, "/manifests/") {
+			if oldManifestPath == "" {
+				oldManifestPath = req.URL.Path
+			}
+			if failOld && req.URL.Path == oldManifestPath {
+				resp.WriteHeader(500)
+				return
+			}
+		}
+		registry.ServeHTTP(resp, req)
+		if failOld && !moved && req.Method == "HEAD" && strings.HasSuffix(req.URL.Path, "/manifests/1.0.0") {
+			moved = true
+			registry.manifests[ns+":1.0.0"] = testPackageManifest(newPackage)
+		}
+	}))
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.PinManifestDigests = true
+	mirror.VerifyLayers = true
+	mirror.CacheTTL = time.Millisecond
+	mirror.CacheMaxStale = time.Hour
+	mirrorServer := newTestMirrorServer(t, mirror)
+	defer mirrorServer.Close()
+
+	get := func() (*http.Response, string) {
+		t.Helper()
+		resp, err := http.Get(mirrorServer.URL + "/mirror/example.com/foo/bar/1.0.0.json")
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("failed to read response: %s", err)
+		}
+		return resp, string(body)
+	}
+	if resp, _ := get(); resp.StatusCode != 200 {
+		t.Fatalf("wrong status %d for first request", resp.StatusCode)
+	}
+
+	// The old package is garbage-collected, so the server must abandon
+	// the stale manifest and retry with the fresh one.
+	time.Sleep(10 * time.Millisecond)
+	failOld = true
+	delete(registry.blobs, ns+"@"+oldBlob.String())
+	registry.addBlob(ns, newPackage)
+
+	resp, body := get()
+	if resp.StatusCode != 200 {
+		t.Fatalf("wrong status %d for second request", resp.StatusCode)
+	}
+	if !strings.Contains(body, testDigest(newPackage).String()) {
+		t.Errorf("response doesn't offer the new package\n%s", body)
+	}
+	if got := resp.Header.Get("Warning"); got != "" {
+		t.Errorf("response built from a fresh manifest has Warning %q", got)
+	}
+}
+
+func TestFindMissingBlobs(t *testing.T) {
+	digests := []ocidist.Digest{
+		testDigest([]byte("a")),
+		testDigest([]byte("b")),
+		testDigest([]byte("c")),
+	}
+	t.Run("some missing", func(t *testing.T) {
+		got, err := findMissingBlobs(digests, 2, func(d ocidist.Digest) (bool, error) {
+			return d != digests[1], nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		want := map[ocidist.Digest]bool{digests[1]: true}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("wrong result\n%s", diff)
+		}
+	})
+	t.Run("check fails", func(t *testing.T) {
+		_, err := findMissingBlobs(digests, 2, func(d ocidist.Digest) (bool, error) {
+			if d == digests[2] {
+				return false, ocidist.ErrBadGateway
+			}
+			return true, nil
+		})
+		if err != ocidist.ErrBadGateway {
+			t.Errorf("wrong error %v; want ErrBadGateway", err)
+		}
+	})
+}
+
+func TestProviderMirrorHead(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.0.0", testProviderManifest())
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	paths := []string{
+		"/mirror/example.com/foo/bar/index.json",
+		"/mirror/example.com/foo/bar/1.0.0.json",
+	}
+	for _, headContentLength := range []bool{true, false} {
+		mirror := newTestProviderMirror(t, registryServer.URL)
+		mirror.HeadContentLength = headContentLength
+		_, handler := providerMirrorHandler(mirror, newTestSharedState())
+
+		for _, path := range paths {
+			t.Run(fmt.Sprintf("%s (content length %t)", path, headContentLength), func(t *testing.T) {
+				getRec := httptest.NewRecorder()
+				handler(getRec, httptest.NewRequest("GET", path, nil))
+				headRec := httptest.NewRecorder()
+				handler(headRec, httptest.NewRequest("HEAD", path, nil))
+
+				if headRec.Code != 200 {
+					t.Fatalf("wrong status %d", headRec.Code)
+				}
+				if headRec.Body.Len() != 0 {
+					t.Errorf("HEAD response has a body: %s", headRec.Body.String())
+				}
+				if got, want := headRec.Header().Get("Content-Type"), "application/json"; got != want {
+					t.Errorf("wrong Content-Type %q; want %q", got, want)
+				}
+				got := headRec.Header().Get("Content-Length")
+				want := ""
+				if headContentLength {
+					want = strconv.Itoa(getRec.Body.Len())
+				}
+				if got != want {
+					t.Errorf("wrong Content-Length %q; want %q", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestParseJSONSelector(t *testing.T) {
+	tests := []struct {
+		segment string
+		lenient bool
+		want    string
+		wantOK  bool
+	}{
+		{"index.json", false, "index", true},
+		{"1.0.0.json", false, "1.0.0", true},
+		{"index", false, "", false},
+		{"INDEX.JSON", false, "", false},
+		{"Index.json", false, "Index", true}, // not a known selector, so will 404
+		{"index.json.json", false, "index.json", true},
+
+		{"index.json", true, "index", true},
+		{"1.0.0.json", true, "1.0.0", true},
+		{"index", true, "", false},
+		{"INDEX.JSON", true, "index", true},
+		{"Index.json", true, "index", true},
+		{"index.json.json", true, "index", true},
+		{"index.JSON.json", true, "index", true},
+		{"1.0.0.json.json", true, "1.0.0", true},
+		{"bogus.json", true, "bogus", true}, // not a known selector, so will 404
+		{".json", true, "", true},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s (lenient=%t)", test.segment, test.lenient), func(t *testing.T) {
+			got, ok := parseJSONSelector(test.segment, test.lenient)
+			if ok != test.wantOK {
+				t.Fatalf("wrong ok %t; want %t", ok, test.wantOK)
+			}
+			if got != test.want {
+				t.Errorf("wrong selector %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorLenientSelectors(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.0.0", testProviderManifest())
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	tests := map[string]struct {
+		strict  int
+		lenient int
+	}{
+		"index.json":      {200, 200},
+		"INDEX.JSON":      {404, 200},
+		"index.json.json": {404, 200},
+		"1.0.0.JSON":      {404, 200},
+		"bogus.json":      {404, 404},
+		"index":           {404, 404},
+	}
+	for _, lenient := range []bool{false, true} {
+		mirror := newTestProviderMirror(t, registryServer.URL)
+		mirror.LenientSelectors = lenient
+		mirrorServer := newTestMirrorServer(t, mirror)
+		defer mirrorServer.Close()
+
+		for selector, test := range tests {
+			want := test.strict
+			if lenient {
+				want = test.lenient
+			}
+			t.Run(fmt.Sprintf("%s (lenient=%t)", selector, lenient), func(t *testing.T) {
+				var ignored map[string]any
+				got := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/"+selector, &ignored)
+				if got != want {
+					t.Errorf("wrong status %d; want %d", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestProviderMirrorTrailingSlashes(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.0.0", testProviderManifest())
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	_, handler := providerMirrorHandler(mirror, newTestSharedState())
+
+	tests := map[string]struct {
+		wantStatus      int
+		wantContentType string
+	}{
+		"/mirror/":                               {200, "text/html; charset=utf-8"},
+		"/mirror//":                              {200, "text/html; charset=utf-8"},
+		"/mirror/example.com/foo/bar/index.json": {200, "application/json"},
+		"/mirror/example.com/foo/bar/index.json/":   {200, "application/json"},
+		"/mirror/example.com/foo/bar/index.json//":  {200, "application/json"},
+		"/mirror/example.com/foo/bar/1.0.0.json":    {200, "application/json"},
+		"/mirror/example.com/foo/bar/1.0.0.json/":   {200, "application/json"},
+		"/mirror/example.com/foo/bar/":              {404, ""},
+		"/mirror/example.com/foo/bar":               {404, ""},
+		"/mirror/example.com//foo///bar/index.json": {200, "application/json"},
+		"//mirror/example.com/foo/bar/1.0.0.json":   {200, "application/json"},
+		"/mirror/example.com/foo/../bar/index.json": {400, "text/plain; charset=utf-8"},
+		"/mirror/./example.com/foo/bar/index.json":  {400, "text/plain; charset=utf-8"},
+		"/mirror/example.com/foo/%2e%2E/index.json": {400, "text/plain; charset=utf-8"},
+	}
+	for path, test := range tests {
+		t.Run(path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest("GET", path, nil))
+			if rec.Code != test.wantStatus {
+				t.Errorf("wrong status %d; want %d", rec.Code, test.wantStatus)
+			}
+			if got := rec.Header().Get("Content-Type"); test.wantContentType != "" && got != test.wantContentType {
+				t.Errorf("wrong Content-Type %q; want %q", got, test.wantContentType)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorDownloadRanges(t *testing.T) {
+	pkg := []byte("package")
+	tests := map[string]struct {
+		supportRanges    bool
+		rangeHeader      string
+		wantStatus       int
+		wantBody         string
+		wantAcceptRanges string
+		wantContentRange string
+	}{
+		"supported": {
+			supportRanges:    true,
+			rangeHeader:      "bytes=2-",
+			wantStatus:       206,
+			wantBody:         "ckage",
+			wantAcceptRanges: "bytes",
+			wantContentRange: "bytes 2-6/7",
+		},
+		"supported without range request": {
+			supportRanges:    true,
+			wantStatus:       200,
+			wantBody:         "package",
+			wantAcceptRanges: "bytes",
+		},
+		"unsatisfiable": {
+			supportRanges:    true,
+			rangeHeader:      "bytes=100-",
+			wantStatus:       416,
+			wantAcceptRanges: "bytes",
+			wantContentRange: "bytes */7",
+		},
+		"unsupported": {
+			supportRanges:    false,
+			rangeHeader:      "bytes=2-",
+			wantStatus:       200,
+			wantBody:         "package",
+			wantAcceptRanges: "none",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			registry := newFakeRegistry()
+			registry.supportRanges = test.supportRanges
+			registry.addManifest(
+				"terraform-providers/example.com/foo/bar", "1.0.0",
+				testProviderManifest(ocidist.ObjectMeta{
+					MediaType: "application/vnd.hashicorp.terraform.provider-package+zip",
+					Digest:    testDigest(pkg),
+					Size:      int64(len(pkg)),
+					Annotations: map[string]any{
+						"io.terraform.target-platforms": "linux_amd64",
+					},
+				}),
+			)
+			registry.addBlob("terraform-providers/example.com/foo/bar", pkg)
+			registryServer := httptest.NewServer(registry)
+			defer registryServer.Close()
+
+			mirror := newTestProviderMirror(t, registryServer.URL)
+			mirror.ProxyPackages = true
+			shared := newTestSharedState()
+			shared.secreter = querysecret.NewSecreter([32]byte{})
+			mirrorServer := newTestMirrorServerShared(t, mirror, shared)
+			defer mirrorServer.Close()
+
+			var version struct {
+				Archives map[string]struct {
+					URL string `json:"url"`
+				} `json:"archives"`
+			}
+			status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/1.0.0.json", &version)
+			if status != 200 {
+				t.Fatalf("wrong status %d for version", status)
+			}
+
+			req, err := http.NewRequest("GET", mirrorServer.URL+version.Archives["linux_amd64"].URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.rangeHeader != "" {
+				req.Header.Set("Range", test.rangeHeader)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("download failed: %s", err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("failed to read body: %s", err)
+			}
+			if resp.StatusCode != test.wantStatus {
+				t.Errorf("wrong status %d; want %d", resp.StatusCode, test.wantStatus)
+			}
+			if test.wantStatus != 416 && string(body) != test.wantBody {
+				t.Errorf("wrong body %q; want %q", body, test.wantBody)
+			}
+			if got := resp.Header.Get("Accept-Ranges"); got != test.wantAcceptRanges {
+				t.Errorf("wrong Accept-Ranges %q; want %q", got, test.wantAcceptRanges)
+			}
+			if got := resp.Header.Get("Content-Range"); got != test.wantContentRange {
+				t.Errorf("wrong Content-Range %q; want %q", got, test.wantContentRange)
+			}
+		})
+	}
+}
+
+func TestProviderMirrorRootResponse(t *testing.T) {
+	docsURL, err := url.Parse("https://docs.example.com/mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[config.RootResponse]struct {
+		wantStatus      int
+		wantContentType string
+		wantLocation    string
+		wantBody        string
+	}{
+		config.RootResponseHTML: {
+			wantStatus:      200,
+			wantContentType: "text/html; charset=utf-8",
+			wantBody:        "<!DOCTYPE html><html><title>Provider Mirror</title><body>This is a Terraform provider mirror.</body></html>",
+		},
+		config.RootResponseJSON: {
+			wantStatus:      200,
+			wantContentType: "application/json",
+			wantBody:        `{"name":"mirror","protocol":"provider_mirror","discovery_ids":["providers.v1"]}`,
+		},
+		config.RootResponseNotFound: {
+			wantStatus: 404,
+		},
+		config.RootResponseRedirect: {
+			wantStatus:   302,
+			wantLocation: "https://docs.example.com/mirror",
+		},
+	}
+	for mode, test := range tests {
+		mode, test := mode, test
+		t.Run(string(mode), func(t *testing.T) {
+			mirror := newTestProviderMirror(t, "http://127.0.0.1:5000")
+			mirror.RootResponse = mode
+			mirror.DiscoveryIDs = []string{"providers.v1"}
+			if mode == config.RootResponseRedirect {
+				mirror.RootRedirectURL = docsURL
+			}
+			_, handler := providerMirrorHandler(mirror, newTestSharedState())
+
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest("GET", "/mirror/", nil))
+			if rec.Code != test.wantStatus {
+				t.Errorf("wrong status %d; want %d", rec.Code, test.wantStatus)
+			}
+			if got := rec.Header().Get("Content-Type"); got != test.wantContentType {
+				t.Errorf("wrong Content-Type %q; want %q", got, test.wantContentType)
+			}
+			if got := rec.Header().Get("Location"); got != test.wantLocation {
+				t.Errorf("wrong Location %q; want %q", got, test.wantLocation)
+			}
+			if got := rec.Body.String(); got != test.wantBody {
+				t.Errorf("wrong body\ngot:  %s\nwant: %s", got, test.wantBody)
+			}
+		})
+	}
+}
+
+func TestDescribeServiceCounts(t *testing.T) {
+	tests := map[string]struct {
+		counts map[string]int
+		want   string
+	}{
+		"one": {
+			counts: map[string]int{"provider_mirror": 1},
+			want:   "1 service (1 provider_mirror)",
+		},
+		"several types": {
+			counts: map[string]int{"provider_mirror": 3, "module_registry": 2},
+			want:   "5 services (2 module_registry, 3 provider_mirror)",
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			if got := describeServiceCounts(test.counts); got != test.want {
+				t.Errorf("wrong result %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckSecreter(t *testing.T) {
+	var key [32]byte
+	t.Run("usable", func(t *testing.T) {
+		err := checkSecreter(querysecret.NewSecreter(key))
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("broken random source", func(t *testing.T) {
+		err := checkSecreter(querysecret.NewSecreterWithRand(key, failingReader{}))
+		if err == nil {
+			t.Errorf("no error for secreter with broken random source")
+		}
+	})
+}
+
+func TestProviderMirrorDownloadTokenFailure(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest(
+		"terraform-providers/example.com/foo/bar", "1.0.0",
+		testProviderManifest(ocidist.ObjectMeta{
+			MediaType: "application/vnd.hashicorp.terraform.provider-package+zip",
+			Digest:    testDigest([]byte("package")),
+			Size:      7,
+			Annotations: map[string]any{
+				"io.terraform.target-platforms": "linux_amd64",
+			},
+		}),
+	)
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.ProxyPackages = true
+	shared := newTestSharedState()
+	shared.secreter = querysecret.NewSecreterWithRand([32]byte{}, failingReader{})
+	mirrorServer := newTestMirrorServerShared(t, mirror, shared)
+	defer mirrorServer.Close()
+
+	before := downloadTokenFailures.Value()
+	resp, err := http.Get(mirrorServer.URL + "/mirror/example.com/foo/bar/1.0.0.json")
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 500 {
+		t.Errorf("wrong status %d; want 500", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "query string secret") {
+		t.Errorf("response body doesn't mention the query string secret:\n%s", body)
+	}
+	if got := downloadTokenFailures.Value() - before; got != 1 {
+		t.Errorf("failure counter increased by %d; want 1", got)
+	}
+}
+
+// failingReader is an [io.Reader] that always fails, for simulating a
+// broken random number source.
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("random source unavailable")
+}
+
+// newTestProviderMirror returns a minimal provider mirror configuration named
+// "mirror" that uses the given origin registry URL and the name prefix
+// "terraform-providers". Tests can modify the result to enable other
+// settings before passing it to [newTestMirrorServer].
+func newTestProviderMirror(t *testing.T, originURL string) *config.ProviderMirror {
+	t.Helper()
+	u, err := url.Parse(originURL + "/")
+	if err != nil {
+		t.Fatalf("invalid origin URL: %s", err)
+	}
+	return &config.ProviderMirror{
+		Name:                   "mirror",
+		OriginURL:              u,
+		NamePrefix:             ocidist.MustParseNamespace("terraform-providers"),
+		ArtifactChecking:       config.ArtifactCheckingStrict,
+		HeadContentLength:      true,
+		PackageMediaTypes:      config.DefaultPackageMediaTypes,
+		DuplicatePlatforms:     config.DuplicatePlatformsLowestDigest,
+		MaxPlatforms:           config.DefaultMaxPlatforms,
+		PackageVerification:    config.PackageVerificationNone,
+		PackageResponseHeaders: config.DefaultPackageResponseHeaders,
+		RootResponse:           config.RootResponseHTML,
+		AcceptHeader:           config.AcceptHeaderIgnore,
+		HashSchemes:            config.DefaultHashSchemes,
+	}
+}
+
+// newTestSharedState returns server-wide state using default settings.
+// Tests can modify the result before passing it to
+// [newTestMirrorServerShared].
+func newTestSharedState() *sharedState {
+	return &sharedState{
+		config: &config.Server{
+			TrustedDigestAlgorithms: config.DefaultTrustedDigestAlgorithms,
+		},
+		downloadLimiter: newClientLimiter(0),
+		breakers:        make(map[string]*circuitBreaker),
+	}
+}
+
+// newTestMirrorServer starts a test HTTP server running only the handler for
+// the given provider mirror configuration, with default server-wide
+// settings.
+func newTestMirrorServer(t *testing.T, cfg *config.ProviderMirror) *httptest.Server {
+	t.Helper()
+	return newTestMirrorServerShared(t, cfg, newTestSharedState())
+}
+
+// newTestMirrorServerShared is like [newTestMirrorServer] but allows the
+// caller to provide the server-wide state.
+func newTestMirrorServerShared(t *testing.T, cfg *config.ProviderMirror, shared *sharedState) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc(providerMirrorHandler(cfg, shared))
+	return httptest.NewServer(mux)
+}
+
+// getJSON makes a GET request to the given URL and, if the response is
+// successful, decodes the response body as JSON into the given value.
+// It returns the response status code.
+func getJSON(t *testing.T, url string, into any) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return resp.StatusCode
+	}
+	err = json.NewDecoder(resp.Body).Decode(into)
+	if err != nil {
+		t.Fatalf("invalid JSON response: %s", err)
+	}
+	return resp.StatusCode
+}
+
+func testDigest(content []byte) ocidist.Digest {
+	hash := sha256.Sum256(content)
+	d, err := ocidist.ParseDigest("sha256:" + hex.EncodeToString(hash[:]))
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// testProviderManifest returns a manifest for a Terraform provider release
+// consisting of the given layers.
+func testProviderManifest(layers ...ocidist.ObjectMeta) *ocidist.Manifest {
+	configBlob := []byte("{}")
+	return &ocidist.Manifest{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.manifest.v1+json",
+		Config: ocidist.ObjectMeta{
+			MediaType: "application/vnd.hashicorp.terraform-provider.config.v1+json",
+			Digest:    testDigest(configBlob),
+			Size:      int64(len(configBlob)),
+		},
+		Layers: layers,
+	}
+}
+
+// fakeRegistry is a minimal in-memory implementation of the parts of the
+// OCI Distribution protocol that this server relies on, for testing.
+type fakeRegistry struct {
+	// tags maps namespace strings to the tags in that namespace, in the
+	// order they were added.
+	tags map[string][]string
+
+	// manifests maps "namespace:reference" strings to manifests.
+	manifests map[string]*ocidist.Manifest
+
+	// blobs maps "namespace@digest" strings to blob content.
+	blobs map[string][]byte
+
+	// supportRanges makes the registry honor the Range header in requests
+	// for blob content.
+	supportRanges bool
+
+	// supportCatalog makes the registry list every namespace that has tags
+	// in response to requests for its catalog, with catalogRequests
+	// counting those requests.
+	supportCatalog  bool
+	catalogRequests int
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		tags:      make(map[string][]string),
+		manifests: make(map[string]*ocidist.Manifest),
+		blobs:     make(map[string][]byte),
+	}
+}
+
+func (r *fakeRegistry) addManifest(ns string, tag string, manifest *ocidist.Manifest) {
+	r.tags[ns] = append(r.tags[ns], tag)
+	r.manifests[ns+":"+tag] = manifest
+}
+
+func (r *fakeRegistry) addBlob(ns string, content []byte) ocidist.Digest {
+	digest := testDigest(content)
+	r.blobs[ns+"@"+digest.String()] = content
+	return digest
+}
+
+func (r *fakeRegistry) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/v2/" {
+		// API version check
+		resp.WriteHeader(200)
+		return
+	}
+	if !strings.HasPrefix(req.URL.Path, "/v2/") {
+		resp.WriteHeader(404)
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if path == "_catalog" && r.supportCatalog {
+		r.catalogRequests++
+		repos := make([]string, 0, len(r.tags))
+		for ns := range r.tags {
+			repos = append(repos, ns)
+		}
+		sort.Strings(repos)
+		r.writeJSON(resp, "application/json", map[string]any{"repositories": repos})
+		return
+	}
+	if strings.HasSuffix(path, "/tags/list") {
+		ns := strings.TrimSuffix(path, "/tags/list")
+		tags, exists := r.tags[ns]
+		if !exists {
+			r.writeNotFound(resp)
+			return
+		}
+		r.writeJSON(resp, "application/json", map[string]any{"name": ns, "tags": tags})
+		return
+	}
+	if i := strings.LastIndex(path, "/manifests/"); i != -1 {
+		ns, ref := path[:i], path[i+len("/manifests/"):]
+		manifest, exists := r.manifests[ns+":"+ref]
+		if !exists && strings.HasPrefix(ref, "sha256:") {
+			manifest, exists = r.manifestByDigest(ns, ref)
+		}
+		if !exists {
+			r.writeNotFound(resp)
+			return
+		}
+		src, err := json.Marshal(manifest)
+		if err != nil {
+			panic(err)
+		}
+		resp.Header().Set("Docker-Content-Digest", testDigest(src).String())
+		r.writeJSON(resp, manifest.MediaType, manifest)
+		return
+	}
+	if i := strings.LastIndex(path, "/blobs/"); i != -1 {
+		ns, digest := path[:i], path[i+len("/blobs/"):]
+		content, exists := r.blobs[ns+"@"+digest]
+		if !exists {
+			r.writeNotFound(resp)
+			return
+		}
+		resp.Header().Set("Content-Type", "application/octet-stream")
+		resp.Header().Set("Content-Disposition", `attachment; filename="blob"`)
+		if r.supportRanges {
+			http.ServeContent(resp, req, "", time.Time{}, bytes.NewReader(content))
+			return
+		}
+		resp.WriteHeader(200)
+		resp.Write(content)
+		return
+	}
+	resp.WriteHeader(404)
+}
+
+// manifestByDigest finds a manifest in the given namespace whose digest is
+// the given digest string, regardless of which tag it's stored under.
+func (r *fakeRegistry) manifestByDigest(ns string, digest string) (*ocidist.Manifest, bool) {
+	for key, manifest := range r.manifests {
+		if !strings.HasPrefix(key, ns+":") {
+			continue
+		}
+		src, err := json.Marshal(manifest)
+		if err != nil {
+			panic(err)
+		}
+		if testDigest(src).String() == digest {
+			return manifest, true
+		}
+	}
+	return nil, false
+}
+
+func (r *fakeRegistry) writeJSON(resp http.ResponseWriter, contentType string, v any) {
+	src, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	resp.Header().Set("Content-Type", contentType)
+	resp.WriteHeader(200)
+	resp.Write(src)
+}
+
+func (r *fakeRegistry) writeNotFound(resp http.ResponseWriter) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(404)
+	io.WriteString(resp, `{"errors":[{"code":"NAME_UNKNOWN","message":"not found"}]}`)
+}
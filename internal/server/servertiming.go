@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/cache"
+)
+
+// The phases of handling a request that are reported in the Server-Timing
+// response header, in the order they appear there.
+const (
+	serverTimingCache   = "cache"
+	serverTimingBackend = "backend"
+	serverTimingTotal   = "total"
+)
+
+var serverTimingDescriptions = map[string]string{
+	serverTimingCache:   "Metadata cache",
+	serverTimingBackend: "Origin registry metadata",
+	serverTimingTotal:   "Total",
+}
+
+// serverTimings accumulates the time that a request spends in each phase of
+// handling, for the Server-Timing response header. A nil *serverTimings
+// ignores everything recorded in it, so callers needn't check whether
+// timings are enabled.
+type serverTimings struct {
+	mu        sync.Mutex
+	start     time.Time
+	durations map[string]time.Duration
+}
+
+// add records that the request spent the given additional time in the given
+// phase. Time spent concurrently in the same phase is summed, so a phase can
+// take longer than the request as a whole.
+func (t *serverTimings) add(phase string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.durations[phase] += d
+	t.mu.Unlock()
+}
+
+// header returns the value of the Server-Timing header describing the
+// phases recorded so far, along with the total time since the request
+// began, in milliseconds.
+func (t *serverTimings) header(now time.Time) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var parts []string
+	for _, phase := range []string{serverTimingCache, serverTimingBackend} {
+		if d, ok := t.durations[phase]; ok {
+			parts = append(parts, formatServerTiming(phase, d))
+		}
+	}
+	parts = append(parts, formatServerTiming(serverTimingTotal, now.Sub(t.start)))
+	return strings.Join(parts, ", ")
+}
+
+func formatServerTiming(phase string, d time.Duration) string {
+	ms := float64(d) / float64(time.Millisecond)
+	return phase + `;desc="` + serverTimingDescriptions[phase] + `";dur=` + strconv.FormatFloat(ms, 'f', 3, 64)
+}
+
+// withServerTiming wraps the given handler so that each response includes a
+// Server-Timing header breaking down how long the server took to produce
+// it, or returns the handler unchanged if enabled is false.
+//
+// The header is sent along with the status code, so for streamed responses
+// like package downloads the total is the time until the response began.
+func withServerTiming(next http.Handler, enabled bool) http.Handler {
+	if !enabled {
+		return next
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		timings := &serverTimings{
+			start:     time.Now(),
+			durations: make(map[string]time.Duration),
+		}
+		w := &serverTimingWriter{ResponseWriter: resp, timings: timings}
+		next.ServeHTTP(w, req.WithContext(contextWithServerTimings(req.Context(), timings)))
+	})
+}
+
+// serverTimingWriter is an [http.ResponseWriter] that adds a Server-Timing
+// header to the response just before the status code is written.
+type serverTimingWriter struct {
+	http.ResponseWriter
+	timings     *serverTimings
+	wroteHeader bool
+}
+
+func (w *serverTimingWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set("Server-Timing", w.timings.header(time.Now()))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *serverTimingWriter) Write(buf []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(buf)
+}
+
+func (w *serverTimingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// timedCacheGet is like [cache.Cache.Get] except that it records the time
+// spent fetching from the origin registry, and the remaining time spent in
+// the cache, in the server timings associated with the given context.
+func timedCacheGet[K comparable, V any](ctx context.Context, c *cache.Cache[K, V], key K, fetch func() (V, error), canServeStale func(error) bool) (V, cache.Status, error) {
+	timings := contextServerTimings(ctx)
+	start := time.Now()
+	var fetchTime time.Duration
+	v, status, err := c.Get(key, func() (V, error) {
+		fetchStart := time.Now()
+		defer func() { fetchTime = time.Since(fetchStart) }()
+		return fetch()
+	}, canServeStale)
+	timings.add(serverTimingCache, time.Since(start)-fetchTime)
+	if fetchTime != 0 {
+		timings.add(serverTimingBackend, fetchTime)
+	}
+	return v, status, err
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestProviderMirrorServerTiming(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.0.0", testProviderManifest())
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.CacheTTL = time.Minute
+	mux := http.NewServeMux()
+	mux.HandleFunc(providerMirrorHandler(mirror, newTestSharedState()))
+
+	getTiming := func(t *testing.T, handler http.Handler) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/mirror/example.com/foo/bar/index.json", nil))
+		if rec.Code != 200 {
+			t.Fatalf("wrong status %d", rec.Code)
+		}
+		return rec.Header().Get("Server-Timing")
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		if got := getTiming(t, withServerTiming(mux, false)); got != "" {
+			t.Errorf("unexpected Server-Timing header %q", got)
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		handler := withServerTiming(mux, true)
+
+		// An untimed request caches the tags, so that the timed one doesn't
+		// make a request to the origin registry.
+		getTiming(t, mux)
+		got := getTiming(t, handler)
+		want := regexp.MustCompile(`^cache;desc="Metadata cache";dur=[0-9]+\.[0-9]{3}, total;desc="Total";dur=[0-9]+\.[0-9]{3}$`)
+		if !want.MatchString(got) {
+			t.Errorf("wrong Server-Timing header for cached response\ngot:  %s\nwant: %s", got, want)
+		}
+
+		mirror.CacheTTL = 0
+		uncachedMux := http.NewServeMux()
+		uncachedMux.HandleFunc(providerMirrorHandler(mirror, newTestSharedState()))
+		got = getTiming(t, withServerTiming(uncachedMux, true))
+		want = regexp.MustCompile(`^cache;desc="Metadata cache";dur=[0-9]+\.[0-9]{3}, backend;desc="Origin registry metadata";dur=[0-9]+\.[0-9]{3}, total;desc="Total";dur=[0-9]+\.[0-9]{3}$`)
+		if !want.MatchString(got) {
+			t.Errorf("wrong Server-Timing header for uncached response\ngot:  %s\nwant: %s", got, want)
+		}
+	})
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// probeBackends calls each of the given probes, keyed by service name, and
+// returns the errors from any that fail, keyed in the same way.
+//
+// At most concurrency probes run at once, and each one gets at most timeout
+// to complete. A probe that's still running after its timeout counts as a
+// failure even if it doesn't respond to its context being cancelled, so
+// that one unresponsive origin registry can't delay startup for longer than
+// the timeout.
+func probeBackends(ctx context.Context, probes map[string]func(context.Context) error, concurrency int, timeout time.Duration) map[string]error {
+	type result struct {
+		serviceName string
+		err         error
+	}
+	results := make(chan result, len(probes))
+	sem := make(chan struct{}, concurrency)
+	for serviceName, probe := range probes {
+		serviceName, probe := serviceName, probe
+		go func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			// The probe gets its own buffered channel so that it can
+			// still complete after we've stopped waiting for it.
+			done := make(chan error, 1)
+			go func() {
+				done <- probe(ctx)
+			}()
+			select {
+			case err := <-done:
+				results <- result{serviceName, err}
+			case <-ctx.Done():
+				results <- result{serviceName, fmt.Errorf("no response within %s", timeout)}
+			}
+		}()
+	}
+
+	failures := make(map[string]error)
+	for range probes {
+		result := <-results
+		if result.err != nil {
+			failures[result.serviceName] = result.err
+		}
+	}
+	return failures
+}
+
+// describeProbeFailures returns a summary of the given errors from
+// [probeBackends], one line per service in order by service name, for
+// logging at startup.
+func describeProbeFailures(failures map[string]error) string {
+	names := make([]string, 0, len(failures))
+	for name := range failures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf strings.Builder
+	noun := "services"
+	if len(failures) == 1 {
+		noun = "service"
+	}
+	fmt.Fprintf(&buf, "origin registry unavailable for %d %s:", len(failures), noun)
+	for _, name := range names {
+		fmt.Fprintf(&buf, "\n  %q: %s", name, failures[name])
+	}
+	return buf.String()
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/ocidist"
+)
+
+func TestProbeBackends(t *testing.T) {
+	fast := httptest.NewServer(newFakeRegistry())
+	defer fast.Close()
+	unblock := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		<-unblock
+	}))
+	defer slow.Close()
+	defer close(unblock)
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	client := func(serverURL string) func(context.Context) error {
+		u, err := url.Parse(serverURL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ocidist.NewClient(u).CheckAPISupport
+	}
+	probes := map[string]func(context.Context) error{
+		"fast":        client(fast.URL),
+		"fast2":       client(fast.URL),
+		"slow":        client(slow.URL),
+		"unreachable": client(unreachable.URL),
+		// This one ignores its context, so probeBackends must stop waiting
+		// for it on its own.
+		"stuck": func(context.Context) error {
+			<-unblock
+			return nil
+		},
+	}
+
+	const timeout = 100 * time.Millisecond
+	start := time.Now()
+	failures := probeBackends(context.Background(), probes, 2, timeout)
+	elapsed := time.Since(start)
+
+	// With two probes at a time, the two that time out can at worst run
+	// one after the other.
+	if limit := 2*timeout + time.Second; elapsed > limit {
+		t.Errorf("probes took %s; want less than %s", elapsed, limit)
+	}
+	if got, want := len(failures), 3; got != want {
+		t.Errorf("wrong number of failures %d; want %d\n%v", got, want, failures)
+	}
+	for _, name := range []string{"slow", "stuck", "unreachable"} {
+		if failures[name] == nil {
+			t.Errorf("no failure for %q", name)
+		}
+	}
+
+	msg := describeProbeFailures(failures)
+	wantPrefix := "origin registry unavailable for 3 services:\n  \"slow\": "
+	if !strings.HasPrefix(msg, wantPrefix) {
+		t.Errorf("wrong message\ngot:  %s\nwant: %s...", msg, wantPrefix)
+	}
+	if !strings.Contains(msg, "\n  \"stuck\": no response within 100ms\n  \"unreachable\": ") {
+		t.Errorf("message doesn't report all failures in order\n%s", msg)
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/querysecret"
+)
+
+// tokenFailureAlarm watches how often the server rejects download tokens, so
+// that it can alert operators to a sudden increase. Many failures in a short
+// time can mean that someone is probing the download endpoint, that servers
+// behind the same load balancer have different query string secrets, or
+// that a server's clock is wrong.
+//
+// Failures are counted in consecutive fixed windows of the given duration.
+// The alarm is active from the failure that takes a window's count above
+// the threshold until the end of that window.
+//
+// A nil *tokenFailureAlarm is valid and never activates.
+type tokenFailureAlarm struct {
+	threshold int
+	window    time.Duration
+
+	// now is the function used to get the current time, which can be
+	// overridden for testing.
+	now func() time.Time
+
+	mu          sync.Mutex
+	windowStart time.Time
+	failures    int
+	alerting    bool
+}
+
+func newTokenFailureAlarm(threshold int, window time.Duration) *tokenFailureAlarm {
+	return &tokenFailureAlarm{
+		threshold: threshold,
+		window:    window,
+		now:       time.Now,
+	}
+}
+
+// record counts a failure. It returns true only for the failure that
+// activates the alarm, so that the caller can raise the alert just once
+// per window, along with the number of failures in the window so far.
+func (a *tokenFailureAlarm) record() (int, bool) {
+	if a == nil {
+		return 0, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.startWindow()
+	a.failures++
+	if a.failures > a.threshold && !a.alerting {
+		a.alerting = true
+		return a.failures, true
+	}
+	return a.failures, false
+}
+
+// active returns true if the alarm has activated in the current window.
+func (a *tokenFailureAlarm) active() bool {
+	if a == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.startWindow()
+	return a.alerting
+}
+
+// startWindow begins a new window if the current one has ended. The caller
+// must hold a.mu.
+func (a *tokenFailureAlarm) startWindow() {
+	now := a.now()
+	if now.Sub(a.windowStart) >= a.window {
+		a.windowStart = now
+		a.failures = 0
+		a.alerting = false
+	}
+}
+
+// tokenFailureReason returns a short label describing why the given
+// download token was rejected with the given error, for metrics.
+func tokenFailureReason(rawToken string, err error) string {
+	switch {
+	case rawToken == "":
+		return "missing"
+	case errors.Is(err, querysecret.ErrExpired):
+		return "expired"
+	default:
+		return "invalid"
+	}
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bytes"
+	"expvar"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/logging"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/querysecret"
+)
+
+func TestTokenFailureAlarm(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := newTokenFailureAlarm(2, time.Minute)
+	a.now = func() time.Time { return now }
+
+	for i := 1; i <= 2; i++ {
+		if _, alert := a.record(); alert {
+			t.Fatalf("alert after %d failures; threshold is 2", i)
+		}
+	}
+	if a.active() {
+		t.Fatalf("alarm active at the threshold")
+	}
+	failures, alert := a.record()
+	if !alert || failures != 3 {
+		t.Fatalf("wrong result (%d, %t) for failure over the threshold; want (3, true)", failures, alert)
+	}
+	if !a.active() {
+		t.Errorf("alarm not active over the threshold")
+	}
+	// The alert is raised only once per window.
+	if _, alert := a.record(); alert {
+		t.Errorf("second alert in the same window")
+	}
+
+	now = now.Add(time.Minute)
+	if a.active() {
+		t.Errorf("alarm still active after the window ended")
+	}
+	if failures, alert := a.record(); alert || failures != 1 {
+		t.Errorf("wrong result (%d, %t) for first failure in new window; want (1, false)", failures, alert)
+	}
+
+	var nilAlarm *tokenFailureAlarm
+	if _, alert := nilAlarm.record(); alert || nilAlarm.active() {
+		t.Errorf("nil alarm activated")
+	}
+}
+
+func TestProviderMirrorDownloadTokenAlert(t *testing.T) {
+	var key [32]byte
+	registry := newFakeRegistry()
+	registryServer := httptest.NewServer(registry)
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.ProxyPackages = true
+	shared := newTestSharedState()
+	shared.secreter = querysecret.NewSecreter(key)
+	shared.config.TokenAlertThreshold = 2
+	shared.config.TokenAlertWindow = time.Hour
+	shared.config.TokenAlertUnready = true
+	shared.tokenAlarm = newTokenFailureAlarm(shared.config.TokenAlertThreshold, shared.config.TokenAlertWindow)
+	_, handler := providerMirrorHandler(mirror, shared)
+	readiness := readinessHandler(&shared.shuttingDown, readinessAlarm(shared))
+
+	expired := wrapExpiredTestToken(t, shared.secreter, downloadToken{Digest: testDigest([]byte("package"))}, time.Hour)
+	alertsBefore := downloadTokenAlerts.Value()
+	var logs bytes.Buffer
+	for _, test := range []struct {
+		query      string
+		wantReason string
+	}{
+		{"", "missing"},
+		{expired, "expired"},
+		{"not-a-token", "invalid"},
+	} {
+		before := expvarMapInt(downloadTokenRejections, test.wantReason)
+		req := httptest.NewRequest("GET", "/mirror/example.com/foo/bar/download?"+test.query, nil)
+		req = req.WithContext(logging.ContextWithLogger(req.Context(), log.New(&logs, "", 0)))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != 404 {
+			t.Errorf("wrong status %d for %s token; want 404", rec.Code, test.wantReason)
+		}
+		if got := expvarMapInt(downloadTokenRejections, test.wantReason) - before; got != 1 {
+			t.Errorf("%s rejections increased by %d; want 1", test.wantReason, got)
+		}
+	}
+
+	if got := strings.Count(logs.String(), "ALERT: rejected 3 download tokens within 1h0m0s"); got != 1 {
+		t.Errorf("alert logged %d times; want once\n%s", got, logs.String())
+	}
+	if got := downloadTokenAlerts.Value() - alertsBefore; got != 1 {
+		t.Errorf("alerts increased by %d; want 1", got)
+	}
+
+	rec := httptest.NewRecorder()
+	readiness(rec, httptest.NewRequest("GET", "/readyz", nil))
+	body, _ := io.ReadAll(rec.Body)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("wrong readiness status %d while alerting; want 503\n%s", rec.Code, body)
+	}
+}
+
+// expvarMapInt returns the value of the integer with the given key in the
+// given map, or zero if there is no such key.
+func expvarMapInt(m *expvar.Map, key string) int64 {
+	v, ok := m.Get(key).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/logging"
+)
+
+// warmCache calls warmOne for each of the given provider addresses, so that
+// their metadata is already cached before the first client asks for it.
+//
+// It first calls checkBackend and skips warming entirely if that fails,
+// because every provider would fail in the same way. Otherwise it logs the
+// outcome for each provider and continues past any that fail, since warming
+// is only an optimization and clients can still fetch the metadata on
+// demand. It returns the number of providers that were warmed successfully.
+func warmCache(ctx context.Context, serviceName string, providers []string, checkBackend func(context.Context) error, warmOne func(ctx context.Context, addrParts []string) error) int {
+	logger := logging.ContextLogger(ctx)
+	if err := checkBackend(ctx); err != nil {
+		logger.Warnf("provider mirror %q: not warming cache because the origin registry is unavailable: %s", serviceName, err)
+		return 0
+	}
+
+	warmed := 0
+	for _, addr := range providers {
+		if err := ctx.Err(); err != nil {
+			return warmed
+		}
+		if err := warmOne(ctx, strings.Split(addr, "/")); err != nil {
+			logger.Warnf("provider mirror %q: failed to warm cache for %s: %s", serviceName, addr, err)
+			continue
+		}
+		logger.Printf("provider mirror %q: warmed cache for %s", serviceName, addr)
+		warmed++
+	}
+	return warmed
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWarmCache(t *testing.T) {
+	t.Run("continues past failures", func(t *testing.T) {
+		var warmed []string
+		got := warmCache(context.Background(), "mirror",
+			[]string{"example.com/foo/a", "example.com/foo/broken", "example.com/foo/b"},
+			func(context.Context) error { return nil },
+			func(ctx context.Context, addrParts []string) error {
+				if addrParts[2] == "broken" {
+					return errors.New("oops")
+				}
+				warmed = append(warmed, addrParts[2])
+				return nil
+			},
+		)
+		if got != 2 {
+			t.Errorf("wrong number of providers warmed %d; want 2", got)
+		}
+		if diff := cmp.Diff([]string{"a", "b"}, warmed); diff != "" {
+			t.Errorf("wrong providers warmed\n%s", diff)
+		}
+	})
+	t.Run("backend unavailable", func(t *testing.T) {
+		got := warmCache(context.Background(), "mirror",
+			[]string{"example.com/foo/a"},
+			func(context.Context) error { return errors.New("connection refused") },
+			func(ctx context.Context, addrParts []string) error {
+				t.Errorf("unexpected attempt to warm %v", addrParts)
+				return nil
+			},
+		)
+		if got != 0 {
+			t.Errorf("wrong number of providers warmed %d; want 0", got)
+		}
+	})
+}
+
+func TestProviderMirrorWarmProviders(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.0.0", testProviderManifest())
+	registry.addManifest("terraform-providers/example.com/foo/bar", "1.1.0", testProviderManifest())
+	var registryRequests int64
+	registryServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&registryRequests, 1)
+		registry.ServeHTTP(resp, req)
+	}))
+	defer registryServer.Close()
+
+	mirror := newTestProviderMirror(t, registryServer.URL)
+	mirror.CacheTTL = time.Hour
+	mirror.WarmProviders = []string{"example.com/foo/missing", "example.com/foo/bar"}
+	shared := newTestSharedState()
+	mirrorServer := newTestMirrorServerShared(t, mirror, shared)
+	defer mirrorServer.Close()
+
+	if got, want := len(shared.startupTasks), 1; got != want {
+		t.Fatalf("wrong number of startup tasks %d; want %d", got, want)
+	}
+	for _, task := range shared.startupTasks {
+		task(context.Background())
+	}
+	warmRequests := atomic.LoadInt64(&registryRequests)
+	if warmRequests == 0 {
+		t.Fatalf("no requests to the origin registry while warming")
+	}
+
+	// The failure to warm the missing provider should not have prevented
+	// warming the other, and so these should all be served from the cache.
+	var index struct {
+		Versions map[string]struct{} `json:"versions"`
+	}
+	if status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/index.json", &index); status != 200 {
+		t.Fatalf("wrong index status %d", status)
+	}
+	if _, ok := index.Versions["1.1.0"]; !ok {
+		t.Errorf("index does not include 1.1.0")
+	}
+	var version struct{}
+	if status := getJSON(t, mirrorServer.URL+"/mirror/example.com/foo/bar/1.1.0.json", &version); status != 200 {
+		t.Fatalf("wrong version status %d", status)
+	}
+	if got := atomic.LoadInt64(&registryRequests); got != warmRequests {
+		t.Errorf("made %d requests to the origin registry after warming; want none", got-warmRequests)
+	}
+}
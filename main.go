@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/apparentlymart/go-userdirs/userdirs"
 	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/config"
+	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/logging"
 	"github.com/apparentlymart/oci-distribution-terraform-registry/internal/server"
 	"github.com/hashicorp/hcl/v2"
 	"github.com/spf13/cobra"
@@ -28,15 +31,43 @@ func rootCommand() *cobra.Command {
 	}
 	root.SetUsageTemplate(usageTemplate)
 	cmdLineConfigFile := root.PersistentFlags().String("config", "", "Configuration file to use")
+	cmdLineLogLevel := root.PersistentFlags().String("log-level", logging.DefaultLevel.String(), "Minimum level of log messages to write: error, warn, info, or debug")
+	cmdLineMultipleConfigs := root.PersistentFlags().String("multiple-configs", string(multipleConfigsError), "What to do if more than one configuration file is found: error, or first to use the one in the highest-priority directory")
 	var globalConfig *config.Config
 
 	root.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		logLevel, err := logging.ParseLevel(*cmdLineLogLevel)
+		if err != nil {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Error: Invalid --log-level option: %s.\n", err)
+			os.Exit(1)
+		}
+		logging.SetLevel(logLevel)
+		multipleConfigs, err := parseMultipleConfigs(*cmdLineMultipleConfigs)
+		if err != nil {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Error: Invalid --multiple-configs option: %s.\n", err)
+			os.Exit(1)
+		}
+
 		var configFile string
 		if *cmdLineConfigFile != "" {
 			configFile = *cmdLineConfigFile
 		} else {
 			candidates := dirs.FindConfigFiles("config.hcl")
-			if len(candidates) == 0 {
+			configFile, err = chooseConfigFile(candidates, multipleConfigs)
+			switch err {
+			case nil:
+				if len(candidates) > 1 {
+					fmt.Fprintf(
+						cmd.ErrOrStderr(),
+						"Warning: Multiple configuration files found.\n\nUsing %s, from the highest-priority directory. Ignoring the following configuration files:\n",
+						configFile,
+					)
+					for _, filename := range candidates[1:] {
+						fmt.Fprintf(cmd.ErrOrStderr(), " - %s\n", filename)
+					}
+					fmt.Fprintln(cmd.ErrOrStderr())
+				}
+			case errNoConfigFiles:
 				fmt.Fprintf(
 					cmd.ErrOrStderr(),
 					"Error: No configuration file found.\n\nEither specify a config file using the --config option, or place config.hcl\nin one of the following directories:\n",
@@ -45,18 +76,16 @@ func rootCommand() *cobra.Command {
 					fmt.Fprintf(cmd.ErrOrStderr(), " - %s\n", dir)
 				}
 				os.Exit(1)
-			}
-			if len(candidates) != 1 {
+			default:
 				fmt.Fprintf(
 					cmd.ErrOrStderr(),
-					"Error: Multiple configuration files found.\n\nUse the --config option to specify which configuration file to use.\nFound the following configuration files:\n",
+					"Error: Multiple configuration files found.\n\nUse the --config option to specify which configuration file to use, or\n--multiple-configs=first to use the one from the highest-priority directory.\nFound the following configuration files:\n",
 				)
 				for _, filename := range candidates {
 					fmt.Fprintf(cmd.ErrOrStderr(), " - %s\n", filename)
 				}
 				os.Exit(1)
 			}
-			configFile = candidates[0]
 		}
 
 		gotConfig, diags := config.LoadConfigFile(configFile)
@@ -90,19 +119,13 @@ func rootCommand() *cobra.Command {
 			Use:   "server",
 			Short: "Run a server providing all of the services described in the configuration",
 			Run: func(cmd *cobra.Command, args []string) {
-				ctx, cancel := context.WithCancel(context.Background())
-				go func() {
-					defer cancel()
-
-					signalCh := make(chan os.Signal, 1)
-					signal.Notify(signalCh, os.Interrupt)
-
-					select {
-					case <-signalCh:
-					case <-ctx.Done():
-					}
-				}()
-				server.Run(ctx, globalConfig)
+				ctx, stop := shutdownContext()
+				err := server.Run(ctx, globalConfig)
+				stop()
+				if err != nil {
+					fmt.Fprintf(cmd.ErrOrStderr(), "Error: %s.\n", err)
+					os.Exit(1)
+				}
 			},
 		},
 	)
@@ -110,6 +133,65 @@ func rootCommand() *cobra.Command {
 	return root
 }
 
+// shutdownSignals are the signals that make the server begin a graceful
+// shutdown. Container runtimes and service managers send SIGTERM, while an
+// interactive user sends SIGINT.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// shutdownContext returns a context that is canceled once the process
+// receives any of [shutdownSignals], along with a function to stop
+// listening for them.
+func shutdownContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), shutdownSignals...)
+}
+
+// multipleConfigs represents the supported values of the --multiple-configs
+// option, which decides what happens when configuration files are found in
+// more than one of the configuration directories.
+type multipleConfigs string
+
+const (
+	// multipleConfigsError, the default, refuses to choose between the
+	// configuration files.
+	multipleConfigsError multipleConfigs = "error"
+
+	// multipleConfigsFirst uses the configuration file from the
+	// highest-priority configuration directory.
+	multipleConfigsFirst multipleConfigs = "first"
+)
+
+func parseMultipleConfigs(s string) (multipleConfigs, error) {
+	switch mode := multipleConfigs(s); mode {
+	case multipleConfigsError, multipleConfigsFirst:
+		return mode, nil
+	default:
+		return multipleConfigsError, fmt.Errorf("unsupported value %q; must be error or first", s)
+	}
+}
+
+var (
+	errNoConfigFiles       = errors.New("no configuration file found")
+	errMultipleConfigFiles = errors.New("multiple configuration files found")
+)
+
+// chooseConfigFile selects which of the given configuration files to use,
+// given the files found in the configuration directories in order of
+// decreasing priority.
+//
+// The result is always the highest-priority file if there are any, but if
+// there are several then it's an error unless the mode is
+// [multipleConfigsFirst].
+func chooseConfigFile(candidates []string, mode multipleConfigs) (string, error) {
+	switch {
+	case len(candidates) == 0:
+		return "", errNoConfigFiles
+	case len(candidates) > 1 && mode != multipleConfigsFirst:
+		return "", errMultipleConfigFiles
+	default:
+		return candidates[0], nil
+	}
+}
+
 var dirs = userdirs.ForApp(
 	"OCI Distribution Terraform Registry",
 	"apparentlymart",
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/apparentlymart/go-userdirs/userdirs"
+)
+
+func TestChooseConfigFile(t *testing.T) {
+	// The user's own configuration directory comes before the system-wide
+	// one, just as in the real search paths.
+	userDir := t.TempDir()
+	systemDir := t.TempDir()
+	emptyDir := t.TempDir()
+	for _, dir := range []string{userDir, systemDir} {
+		if err := os.WriteFile(filepath.Join(dir, "config.hcl"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	userConfig := filepath.Join(userDir, "config.hcl")
+	systemConfig := filepath.Join(systemDir, "config.hcl")
+
+	tests := map[string]struct {
+		configDirs []string
+		mode       multipleConfigs
+		want       string
+		wantErr    error
+	}{
+		"none": {
+			configDirs: []string{emptyDir},
+			mode:       multipleConfigsFirst,
+			wantErr:    errNoConfigFiles,
+		},
+		"one": {
+			configDirs: []string{emptyDir, systemDir},
+			mode:       multipleConfigsError,
+			want:       systemConfig,
+		},
+		"multiple with error": {
+			configDirs: []string{userDir, emptyDir, systemDir},
+			mode:       multipleConfigsError,
+			wantErr:    errMultipleConfigFiles,
+		},
+		"multiple with first": {
+			configDirs: []string{userDir, emptyDir, systemDir},
+			mode:       multipleConfigsFirst,
+			want:       userConfig,
+		},
+		"multiple with first in other order": {
+			configDirs: []string{systemDir, userDir},
+			mode:       multipleConfigsFirst,
+			want:       systemConfig,
+		},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			dirs := userdirs.Dirs{ConfigDirs: test.configDirs}
+			got, err := chooseConfigFile(dirs.FindConfigFiles("config.hcl"), test.mode)
+			if err != test.wantErr {
+				t.Fatalf("wrong error %v; want %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("wrong result %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseMultipleConfigs(t *testing.T) {
+	for _, s := range []string{"error", "first"} {
+		got, err := parseMultipleConfigs(s)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", s, err)
+		}
+		if string(got) != s {
+			t.Errorf("wrong result %q for %q", got, s)
+		}
+	}
+	if _, err := parseMultipleConfigs("last"); err == nil {
+		t.Errorf("no error for unsupported value")
+	}
+}
+
+func TestShutdownContext(t *testing.T) {
+	for _, sig := range []os.Signal{os.Interrupt, syscall.SIGTERM} {
+		sig := sig
+		t.Run(sig.String(), func(t *testing.T) {
+			ctx, stop := shutdownContext()
+			defer stop()
+
+			proc, err := os.FindProcess(os.Getpid())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := proc.Signal(sig); err != nil {
+				t.Fatalf("failed to send %s: %s", sig, err)
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatalf("context not canceled after %s", sig)
+			}
+		})
+	}
+}